@@ -0,0 +1,168 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// entity returns the folder or datacenter of the inventory path, or the root
+// folder if path is empty or "/".
+func (clt *vsClient) entity(ctx context.Context, path string) (types.ManagedObjectReference, error) {
+	c := clt.govmomi.Client
+	if path == "" || path == "/" {
+		return c.ServiceContent.RootFolder, nil
+	}
+
+	ref, err := object.NewSearchIndex(c).FindByInventoryPath(ctx, path)
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("find entity %q failed: %w", path, err)
+	}
+	if ref == nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("entity %q not found", path)
+	}
+
+	switch r := ref.Reference(); r.Type {
+	case "Folder", "Datacenter":
+		return r, nil
+	default:
+		return types.ManagedObjectReference{}, fmt.Errorf("entity %q is a %v, not a folder or datacenter", path, r.Type)
+	}
+}
+
+// alarms retrieves the definitions of the alarms defined on entity. Alarms
+// inherited from the parents of entity are not included.
+func (clt *vsClient) alarms(ctx context.Context, entity types.ManagedObjectReference) ([]mo.Alarm, error) {
+	c := clt.govmomi.Client
+	if c.ServiceContent.AlarmManager == nil {
+		return nil, errors.New("no alarm manager, alarms require vCenter")
+	}
+
+	req := types.GetAlarm{
+		This:   *c.ServiceContent.AlarmManager,
+		Entity: &entity,
+	}
+
+	res, err := methods.GetAlarm(ctx, c, &req)
+	if err != nil {
+		return nil, fmt.Errorf("get alarms of %v failed: %w", entity.Value, err)
+	}
+	if len(res.Returnval) == 0 {
+		return nil, nil
+	}
+
+	var alarms []mo.Alarm
+	err = property.DefaultCollector(c).Retrieve(ctx, res.Returnval, []string{"info"}, &alarms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve alarm definitions failed: %w", err)
+	}
+
+	return alarms, nil
+}
+
+// mark attaches the tag to ref if drift and detaches it otherwise. It returns
+// the action taken, "tagged" or "untagged", or "" if the tag was already as
+// expected.
+func (clt *vsClient) mark(ctx context.Context, ref types.ManagedObjectReference, tagID string, drift bool) (string, error) {
+	m := tags.NewManager(clt.rest)
+
+	attached, err := m.ListAttachedTags(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("list tags of %v failed: %w", ref.Value, err)
+	}
+
+	tagged := false
+	for _, id := range attached {
+		if id == tagID {
+			tagged = true
+			break
+		}
+	}
+
+	switch {
+	case drift && !tagged:
+		if err := m.AttachTag(ctx, tagID, ref); err != nil {
+			return "", fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+		}
+		return "tagged", nil
+	case !drift && tagged:
+		if err := m.DetachTag(ctx, tagID, ref); err != nil {
+			return "", fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+		}
+		return "untagged", nil
+	}
+
+	return "", nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package function
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// baseline is the expected definition of an alarm. Only the configured fields
+// are compared.
+type baseline struct {
+	// Name identifies the alarm definition.
+	Name string
+	// Enabled is the expected enabled state, if set.
+	Enabled *bool
+	// Yellow and Red are the expected thresholds of the conditions of the
+	// alarm, if set, see thresholds.
+	Yellow *string
+	Red    *string
+}
+
+// difference is a field of an alarm definition which drifted from the
+// baseline.
+type difference struct {
+	Alarm    string `json:"alarm"`
+	Field    string `json:"field"`
+	Baseline string `json:"baseline"`
+	VCenter  string `json:"vcenter"`
+}
+
+// validateBaseline ensures the baseline has alarms, each named once. Alarms
+// without further fields are only checked to be defined.
+func validateBaseline(alarms []baseline) error {
+	if len(alarms) == 0 {
+		return errors.New("required field(s) missing, including alarm")
+	}
+
+	seen := map[string]bool{}
+	for _, a := range alarms {
+		if a.Name == "" {
+			return errors.New("required field(s) missing, including alarm name")
+		}
+
+		if seen[a.Name] {
+			return fmt.Errorf("alarm %q is defined more than once", a.Name)
+		}
+		seen[a.Name] = true
+	}
+
+	return nil
+}
+
+// compare returns the differences of the alarm definitions from the
+// baseline, in the order of the baseline. Alarms of the baseline which are not
+// defined differ in the field defined. Alarms not in the baseline are not
+// compared.
+func compare(baselines []baseline, alarms []mo.Alarm) []difference {
+	defined := make(map[string]*types.AlarmInfo, len(alarms))
+	for i := range alarms {
+		info := &alarms[i].Info
+		defined[info.Name] = info
+	}
+
+	var diffs []difference
+	for _, b := range baselines {
+		info, ok := defined[b.Name]
+		if !ok {
+			diffs = append(diffs, difference{Alarm: b.Name, Field: "defined", Baseline: "true", VCenter: "false"})
+			continue
+		}
+
+		if b.Enabled != nil && *b.Enabled != info.Enabled {
+			diffs = append(diffs, difference{Alarm: b.Name, Field: "enabled", Baseline: strconv.FormatBool(*b.Enabled), VCenter: strconv.FormatBool(info.Enabled)})
+		}
+
+		yellow, red := thresholds(info.Expression)
+		if b.Yellow != nil && *b.Yellow != yellow {
+			diffs = append(diffs, difference{Alarm: b.Name, Field: "yellow", Baseline: *b.Yellow, VCenter: yellow})
+		}
+		if b.Red != nil && *b.Red != red {
+			diffs = append(diffs, difference{Alarm: b.Name, Field: "red", Baseline: *b.Red, VCenter: red})
+		}
+	}
+
+	return diffs
+}
+
+// thresholds returns the yellow and red thresholds of the metric and state
+// conditions of expr, joined with commas in their order, e.g. "7500" for a
+// metric alarm at 75 percent, which vCenter stores in hundredths of a percent,
+// or "notResponding" for a state alarm. Conditions without threshold of a
+// color are empty, event conditions have no thresholds.
+func thresholds(expr types.BaseAlarmExpression) (yellow, red string) {
+	var ys, rs []string
+
+	var walk func(expr types.BaseAlarmExpression)
+	walk = func(expr types.BaseAlarmExpression) {
+		switch e := expr.(type) {
+		case *types.OrAlarmExpression:
+			for _, sub := range e.Expression {
+				walk(sub)
+			}
+		case *types.AndAlarmExpression:
+			for _, sub := range e.Expression {
+				walk(sub)
+			}
+		case *types.MetricAlarmExpression:
+			ys = append(ys, metricThreshold(e.Yellow))
+			rs = append(rs, metricThreshold(e.Red))
+		case *types.StateAlarmExpression:
+			ys = append(ys, e.Yellow)
+			rs = append(rs, e.Red)
+		}
+	}
+	walk(expr)
+
+	return strings.Join(ys, ","), strings.Join(rs, ",")
+}
+
+// metricThreshold formats a threshold of a metric condition, which is unset
+// if 0.
+func metricThreshold(v int32) string {
+	if v == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(int(v))
+}
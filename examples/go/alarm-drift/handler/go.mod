@@ -0,0 +1,11 @@
+module github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/alarm-drift/handler
+
+go 1.22
+
+require (
+	github.com/openfaas/templates-sdk/go-http v0.0.0-20220408082716-5981c545cb03
+	github.com/pelletier/go-toml v1.6.0
+	github.com/vmware/govmomi v0.22.2
+)
+
+require github.com/google/uuid v0.0.0-20170306145142-6a5e28554805 // indirect
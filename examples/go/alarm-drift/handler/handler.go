@@ -0,0 +1,371 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// scheduledTaskEvent is the event of a started vCenter scheduled task.
+const scheduledTaskEvent = "ScheduledTaskStartedEvent"
+
+// defaultEvents start the audit if no events are configured.
+var defaultEvents = []string{scheduledTaskEvent}
+
+// cronTrigger names invocations without event, e.g. of the OpenFaaS cron
+// connector.
+const cronTrigger = "cron"
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Audit struct {
+		// Events start the audit, by default defaultEvents, e.g. also
+		// AlarmReconfiguredEvent to audit every change of an alarm.
+		// Invocations without event, e.g. of the OpenFaaS cron
+		// connector, always start it.
+		Events []string
+		// ScheduledTask limits scheduled task events to the task of this
+		// name.
+		ScheduledTask string `toml:"scheduled_task"`
+		// Entity is the inventory path of the folder or datacenter whose
+		// alarm definitions are audited, by default the root folder,
+		// which holds the default alarms of vCenter.
+		Entity string
+		// TagURN is attached to the entity while alarms drifted from the
+		// baseline and detached once they match it again.
+		TagURN string `toml:"tag_urn"`
+	}
+	// Alarms are the baseline of the alarm definitions.
+	Alarms []baseline `toml:"alarm"`
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		ScheduledTask *types.ScheduledTaskEventArgument `json:"ScheduledTask,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the drift of the alarm definitions from the baseline and
+// the actions taken.
+type report struct {
+	Trigger     string       `json:"trigger"`
+	Entity      string       `json:"entity,omitempty"`
+	Audited     int          `json:"audited,omitempty"`
+	Drift       bool         `json:"drift"`
+	Differences []difference `json:"differences,omitempty"`
+	Actions     []string     `json:"actions,omitempty"`
+	Skipped     string       `json:"skipped,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	trigger, skipped, err := parseTrigger(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	rep := report{Trigger: trigger, Skipped: skipped}
+
+	var actionErr error
+	if rep.Skipped == "" {
+		// Connect to vSphere govmomi API once and persist connection with global variable.
+		clt, err := vsConnect(ctx, cfg)
+		if err != nil {
+			wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+			slog.Error("connect to vSphere failed", "err", err)
+
+			return handler.Response{
+				Body:       []byte(wrapErr.Error()),
+				StatusCode: http.StatusInternalServerError,
+			}, wrapErr
+		}
+
+		actionErr = audit(ctx, clt, cfg, &rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("alarm audit failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// audit compares the alarm definitions of the entity with the baseline and
+// tags the entity on a drift. The differences and completed actions are added
+// to rep.
+func audit(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	ref, err := clt.entity(ctx, cfg.Audit.Entity)
+	if err != nil {
+		return err
+	}
+	rep.Entity = ref.Value
+
+	alarms, err := clt.alarms(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	rep.Audited = len(cfg.Alarms)
+	rep.Differences = compare(cfg.Alarms, alarms)
+	rep.Drift = len(rep.Differences) > 0
+
+	if cfg.Audit.TagURN == "" {
+		return nil
+	}
+
+	action, err := clt.mark(ctx, ref, cfg.Audit.TagURN, rep.Drift)
+	if err != nil {
+		return err
+	}
+	if action != "" {
+		rep.Actions = append(rep.Actions, action)
+	}
+
+	return nil
+}
+
+// runs reports whether event starts the audit.
+func (cfg *vcConfig) runs(event string) bool {
+	events := cfg.Audit.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	return validateBaseline(cfg.Alarms)
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseTrigger returns what triggered the audit: the configured event of req,
+// or cronTrigger if req is empty. Scheduled tasks of another name are returned
+// with the reason they are skipped.
+func parseTrigger(req []byte, cfg *vcConfig) (trigger, skipped string, err error) {
+	if len(bytes.TrimSpace(req)) == 0 {
+		return cronTrigger, "", nil
+	}
+
+	var event incoming
+
+	err = json.Unmarshal(req, &event)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.runs(event.Subject) {
+		return "", "", fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if st := event.Data.ScheduledTask; st != nil {
+		if name := cfg.Audit.ScheduledTask; name != "" && st.Name != name {
+			return event.Subject, fmt.Sprintf("scheduled task %v is not %v", st.Name, name), nil
+		}
+	}
+
+	return event.Subject, "", nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,343 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	enabled, disabled := true, false
+	yellow, red, notResponding := "7500", "9000", "notResponding"
+
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.Audit.Events = []string{scheduledTaskEvent, "AlarmReconfiguredEvent"}
+	full.Audit.ScheduledTask = "nightly alarm audit"
+	full.Audit.Entity = "/dc-01"
+	full.Audit.TagURN = "urn:vmomi:InventoryServiceTag:4c1e9a52-8d3f-4b7e-a0c6-2f9d81e7b3a4:GLOBAL"
+	full.Alarms = []baseline{
+		{Name: "Host CPU usage", Enabled: &enabled, Yellow: &yellow, Red: &red},
+		{Name: "Host connection and power state", Red: &notResponding},
+		{Name: "Datastore usage on disk"},
+	}
+
+	defaults := vcConfig{}
+	defaults.VCenter = full.VCenter
+	defaults.VCenter.Insecure = true
+	defaults.Alarms = []baseline{{Name: "Host CPU usage", Enabled: &disabled}}
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a full baseline loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&full,
+		},
+		{
+			"Test that toml file with the defaults loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&defaults,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a config without baseline results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an alarm defined twice results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an alarm without name results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseTrigger ensures the configured events start the audit and other
+// scheduled tasks are skipped.
+func TestParseTrigger(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc    string
+		jsonPath    string
+		expectErr   bool
+		want        string
+		wantSkipped bool
+	}{
+		{"Test that the started scheduled task is readable", "testdata/event.json", false, scheduledTaskEvent, false},
+		{"Test that an empty invocation is a cron trigger", "testdata/event2.json", false, cronTrigger, false},
+		{"Test that another scheduled task is skipped", "testdata/event3.json", false, scheduledTaskEvent, true},
+		{"Test that a configured alarm event is readable", "testdata/event4.json", false, "AlarmReconfiguredEvent", false},
+		{"Event should return error if it is not configured", "testdata/eventErr1.json", true, "", false},
+		{"Event should return error if it is no JSON", "testdata/eventErr2.json", true, "", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		got, skipped, err := parseTrigger(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if !tc.expectErr && got == tc.want && (skipped != "") == tc.wantSkipped {
+			t.Logf("got expected: %v, skipped %q. %v", got, skipped, passMark)
+		} else {
+			t.Logf("expected: %v, skipped %v, got: %v, skipped %q. %v", tc.want, tc.wantSkipped, got, skipped, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestCompare ensures only the configured fields of the baseline are compared
+// and missing alarms are a drift.
+func TestCompare(t *testing.T) {
+	enabled := true
+	yellow, red, notResponding := "7500", "9000", "notResponding"
+
+	cpu := mo.Alarm{Info: types.AlarmInfo{AlarmSpec: types.AlarmSpec{
+		Name:    "Host CPU usage",
+		Enabled: true,
+		Expression: &types.OrAlarmExpression{Expression: []types.BaseAlarmExpression{
+			&types.MetricAlarmExpression{Yellow: 7500, Red: 9000},
+		}},
+	}}}
+	state := mo.Alarm{Info: types.AlarmInfo{AlarmSpec: types.AlarmSpec{
+		Name:    "Host connection and power state",
+		Enabled: true,
+		Expression: &types.OrAlarmExpression{Expression: []types.BaseAlarmExpression{
+			&types.StateAlarmExpression{Red: "notResponding"},
+			&types.EventAlarmExpression{EventType: "HostConnectionLostEvent"},
+		}},
+	}}}
+	raised := cpu
+	raised.Info.Enabled = false
+	raised.Info.Expression = &types.OrAlarmExpression{Expression: []types.BaseAlarmExpression{
+		&types.MetricAlarmExpression{Yellow: 9000, Red: 9500},
+	}}
+
+	baselines := []baseline{
+		{Name: "Host CPU usage", Enabled: &enabled, Yellow: &yellow, Red: &red},
+		{Name: "Host connection and power state", Red: &notResponding},
+	}
+
+	var tests = []struct {
+		testDesc string
+		alarms   []mo.Alarm
+		want     []difference
+	}{
+		{"Test that alarms matching the baseline do not drift", []mo.Alarm{cpu, state}, nil},
+		{
+			"Test that a disabled alarm with raised thresholds drifts",
+			[]mo.Alarm{raised, state},
+			[]difference{
+				{Alarm: "Host CPU usage", Field: "enabled", Baseline: "true", VCenter: "false"},
+				{Alarm: "Host CPU usage", Field: "yellow", Baseline: "7500", VCenter: "9000"},
+				{Alarm: "Host CPU usage", Field: "red", Baseline: "9000", VCenter: "9500"},
+			},
+		},
+		{
+			"Test that a removed alarm drifts",
+			[]mo.Alarm{cpu},
+			[]difference{{Alarm: "Host connection and power state", Field: "defined", Baseline: "true", VCenter: "false"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := compare(baselines, tc.alarms)
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestMark ensures the audited entity is found by its inventory path and
+// tagged while the alarms drifted.
+func TestMark(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		rc := rest.NewClient(vc)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}, rest: rc}
+
+		m := tags.NewManager(rc)
+		category, err := m.CreateCategory(ctx, &tags.Category{Name: "alarms", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tag, err := m.CreateTag(ctx, &tags.Tag{Name: "alarm-drift", CategoryID: category})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		t.Log("=========== Test that the root folder is audited by default ===========")
+		root, err := clt.entity(ctx, "")
+		if err == nil && root == vc.ServiceContent.RootFolder {
+			t.Logf("got expected: %v. %v", root.Value, passMark)
+		} else {
+			t.Logf("expected the root folder, got: %v, %v. %v", root, err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a VM is no audited entity ===========")
+		if _, err := clt.entity(ctx, "/DC0/vm/DC0_H0_VM0"); err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected an error. %v", failMark)
+			t.Fail()
+		}
+
+		dc, err := clt.entity(ctx, "/DC0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var tests = []struct {
+			testDesc string
+			drift    bool
+			want     string
+		}{
+			{"Test that a drift tags the datacenter", true, "tagged"},
+			{"Test that a drift of a tagged datacenter takes no action", true, ""},
+			{"Test that no drift untags the datacenter", false, "untagged"},
+			{"Test that no drift of an untagged datacenter takes no action", false, ""},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			got, err := clt.mark(ctx, dc, tag, tc.drift)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %q. %v", got, passMark)
+			} else {
+				t.Logf("expected: %q, got: %q, %v. %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package function
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Sources of the last backup of a VM.
+const (
+	sourceEvent    = "event"    // completed event of the backup tool
+	sourceField    = "field"    // custom attribute recorded by earlier events
+	sourceSnapshot = "snapshot" // snapshot named like backup snapshots
+)
+
+// backupInfo is what a VM tells about its backups.
+type backupInfo struct {
+	Name string
+	// Recorded is the completed backup recorded in the custom attribute,
+	// zero if none.
+	Recorded time.Time
+	// Snapshots are all snapshots of the VM.
+	Snapshots []snapshot
+}
+
+// snapshot is a snapshot of a VM.
+type snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// flatten returns the snapshots of the snapshot trees.
+func flatten(trees []types.VirtualMachineSnapshotTree) []snapshot {
+	var snapshots []snapshot
+
+	for _, t := range trees {
+		snapshots = append(snapshots, snapshot{Name: t.Name, Created: t.CreateTime})
+		snapshots = append(snapshots, flatten(t.ChildSnapshotList)...)
+	}
+
+	return snapshots
+}
+
+// lastBackup returns the time of the last backup of info and its source: the
+// recorded backup or the newest snapshot named like pattern, whichever is
+// newer. Without backup, the time is zero.
+func lastBackup(info *backupInfo, pattern *regexp.Regexp) (time.Time, string) {
+	last, source := info.Recorded, sourceField
+	if last.IsZero() {
+		source = ""
+	}
+
+	if pattern == nil {
+		return last, source
+	}
+
+	for _, s := range info.Snapshots {
+		if pattern.MatchString(s.Name) && s.Created.After(last) {
+			last, source = s.Created, sourceSnapshot
+		}
+	}
+
+	return last, source
+}
+
+// overdue reports whether a VM last backed up at last, zero if never, is out
+// of sla at now.
+func overdue(last, now time.Time, sla time.Duration) bool {
+	return last.IsZero() || now.Sub(last) > sla
+}
@@ -0,0 +1,199 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// fieldKey returns the key of the VM custom attribute name. It is created if
+// it does not exist and create is set, otherwise the key is -1.
+func (clt *vsClient) fieldKey(ctx context.Context, name string, create bool) (int32, error) {
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return 0, fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	key, err := m.FindKey(ctx, name)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, object.ErrKeyNameNotFound) {
+		return 0, fmt.Errorf("find custom attribute %v failed: %w", name, err)
+	}
+	if !create {
+		return -1, nil
+	}
+
+	def, err := m.Add(ctx, name, "VirtualMachine", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("create custom attribute %v failed: %w", name, err)
+	}
+
+	return def.Key, nil
+}
+
+// setLastBackup records a completed backup of a VM in the custom attribute
+// field.
+func (clt *vsClient) setLastBackup(ctx context.Context, ref types.ManagedObjectReference, field string, done time.Time) error {
+	key, err := clt.fieldKey(ctx, field, true)
+	if err != nil {
+		return err
+	}
+
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	err = m.Set(ctx, ref, key, done.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("record backup of %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// backupInfo retrieves the name, the recorded backup and the snapshots of a
+// VM. Recorded values which are no time are ignored.
+func (clt *vsClient) backupInfo(ctx context.Context, ref types.ManagedObjectReference, field string) (*backupInfo, error) {
+	key, err := clt.fieldKey(ctx, field, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err = pc.RetrieveOne(ctx, ref, []string{"name", "snapshot", "customValue"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve backups of %v failed: %w", ref.Value, err)
+	}
+
+	info := backupInfo{Name: vm.Name}
+
+	if vm.Snapshot != nil {
+		info.Snapshots = flatten(vm.Snapshot.RootSnapshotList)
+	}
+
+	for _, v := range vm.CustomValue {
+		s, ok := v.(*types.CustomFieldStringValue)
+		if !ok || s.Key != key {
+			continue
+		}
+
+		if t, err := time.Parse(time.RFC3339, s.Value); err == nil {
+			info.Recorded = t
+		}
+	}
+
+	return &info, nil
+}
+
+// tagged reports whether a tag is attached to a VM.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to a VM.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from a VM.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
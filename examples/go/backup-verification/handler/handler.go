@@ -0,0 +1,491 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultField is the custom attribute recording the last completed backup of
+// a VM.
+const defaultField = "veba.lastBackup"
+
+// defaultCheckEvents check the backup of their VM if no check_events are
+// configured.
+var defaultCheckEvents = []string{"VmPoweredOnEvent", "VmReconfiguredEvent"}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Backup struct {
+		// SLAHours is the maximum age of the last backup of a VM.
+		SLAHours float64 `toml:"sla_hours"`
+		// SnapshotPattern matches the names of the snapshots backups
+		// leave on a VM, e.g. ^Backup.
+		SnapshotPattern string `toml:"snapshot_pattern"`
+		// CompletedEvents are the events of the backup tool signaling a
+		// completed backup of their VM, e.g. EventEx ids.
+		CompletedEvents []string `toml:"completed_events"`
+		// CheckEvents verify the backup of their VM, by default
+		// defaultCheckEvents.
+		CheckEvents []string `toml:"check_events"`
+		// Field is the custom attribute completed backups are recorded in,
+		// by default defaultField.
+		Field string
+		// TagURN is attached to VMs whose last backup is older than the
+		// SLA and detached once they are backed up again.
+		TagURN string `toml:"tag_urn"`
+	}
+	Notify struct {
+		// VMs out of SLA are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		CreatedTime time.Time              `json:"CreatedTime"`
+		Vm          *types.VmEventArgument `json:"Vm,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the backup of a VM and the actions taken.
+type report struct {
+	Event string `json:"event"`
+	VM    string `json:"vm"`
+	Name  string `json:"name,omitempty"`
+	// LastBackup is the time of the last completed backup, if any, and
+	// Source where it was found: event, field or snapshot.
+	LastBackup *time.Time `json:"last_backup,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Age        string     `json:"age,omitempty"`
+	Overdue    bool       `json:"overdue"`
+	Actions    []string   `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{
+		Event: event.Subject,
+		VM:    event.Data.Vm.Vm.Value,
+		Name:  event.Data.Vm.Name,
+	}
+
+	var actionErr error
+	if cfg.completes(event.Subject) {
+		actionErr = record(ctx, clt, cfg, &rep, event.Data.Vm.Vm, event.Data.CreatedTime)
+	} else {
+		actionErr = verify(ctx, clt, cfg, &rep, event.Data.Vm.Vm, time.Now())
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("verification of backup failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// record records a backup of vm completed at done in the custom attribute and
+// detaches the tag of VMs out of SLA. Completed actions are added to rep.
+func record(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, done time.Time) error {
+	if err := clt.setLastBackup(ctx, vm, cfg.field(), done); err != nil {
+		return err
+	}
+	rep.LastBackup = &done
+	rep.Source = sourceEvent
+	rep.Actions = append(rep.Actions, "recorded")
+
+	return untag(ctx, clt, cfg, rep, vm)
+}
+
+// verify checks whether the last backup of vm is within the SLA at now. VMs
+// out of SLA are tagged and posted, VMs backed up again are untagged.
+// Completed actions are added to rep, the joined errors of failed actions are
+// returned.
+func verify(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, now time.Time) error {
+	info, err := clt.backupInfo(ctx, vm, cfg.field())
+	if err != nil {
+		return err
+	}
+	if info.Name != "" {
+		rep.Name = info.Name
+	}
+
+	last, source := lastBackup(info, cfg.snapshotPattern())
+	if !last.IsZero() {
+		rep.LastBackup = &last
+		rep.Source = source
+		rep.Age = now.Sub(last).Round(time.Minute).String()
+	}
+
+	rep.Overdue = overdue(last, now, cfg.sla())
+	if !rep.Overdue {
+		return untag(ctx, clt, cfg, rep, vm)
+	}
+
+	// The tag marks VMs already reported, so each VM out of SLA is only
+	// posted once until it is backed up again.
+	if cfg.Backup.TagURN != "" {
+		tagged, err := clt.tagged(ctx, vm, cfg.Backup.TagURN)
+		if err != nil {
+			return err
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return nil
+		}
+	}
+
+	var errs []error
+
+	if cfg.Backup.TagURN != "" {
+		if err := clt.tag(ctx, vm, cfg.Backup.TagURN); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "tagged")
+		}
+	}
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, overdueMessage(rep, cfg.sla(), now)); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// untag detaches the tag of VMs out of SLA from vm, if attached.
+func untag(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	if cfg.Backup.TagURN == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, cfg.Backup.TagURN)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, cfg.Backup.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+// sla returns the maximum age of the last backup.
+func (cfg *vcConfig) sla() time.Duration {
+	return time.Duration(cfg.Backup.SLAHours * float64(time.Hour))
+}
+
+// field returns the custom attribute completed backups are recorded in.
+func (cfg *vcConfig) field() string {
+	if cfg.Backup.Field == "" {
+		return defaultField
+	}
+
+	return cfg.Backup.Field
+}
+
+// snapshotPattern returns the pattern of backup snapshot names, nil if backup
+// snapshots are not checked. The pattern is validated with the config.
+func (cfg *vcConfig) snapshotPattern() *regexp.Regexp {
+	if cfg.Backup.SnapshotPattern == "" {
+		return nil
+	}
+
+	return regexp.MustCompile(cfg.Backup.SnapshotPattern)
+}
+
+// completes reports whether event signals a completed backup.
+func (cfg *vcConfig) completes(event string) bool {
+	for _, e := range cfg.Backup.CompletedEvents {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checks reports whether event verifies the backup of its VM.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Backup.CheckEvents
+	if len(events) == 0 {
+		events = defaultCheckEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Backup.SLAHours <= 0 {
+		return errors.New("backup sla_hours must be positive")
+	}
+
+	if _, err := regexp.Compile(cfg.Backup.SnapshotPattern); err != nil {
+		return fmt.Errorf("invalid backup snapshot_pattern %q: %w", cfg.Backup.SnapshotPattern, err)
+	}
+
+	// Without either, no backup is ever found and every VM is out of SLA.
+	if cfg.Backup.SnapshotPattern == "" && len(cfg.Backup.CompletedEvents) == 0 {
+		return errors.New("required field(s) missing, including backup snapshot_pattern or completed_events")
+	}
+
+	for _, e := range cfg.Backup.CompletedEvents {
+		if cfg.checks(e) {
+			return fmt.Errorf("event %v is both a completed and a check event", e)
+		}
+	}
+
+	// A missed SLA nobody learns about is not worth verifying.
+	if cfg.Backup.TagURN == "" && cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return errors.New("required field(s) missing, including backup tag_urn or a notify sink")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a completed backup or check event of a VM.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.completes(event.Subject) && !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty virtual machine")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,359 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	snapshots := vcConfig{}
+	snapshots.VCenter.Server = "veba.local.corp"
+	snapshots.VCenter.User = "admin@vsphere.local"
+	snapshots.VCenter.Password = "password1234"
+	snapshots.Backup.SLAHours = 24
+	snapshots.Backup.SnapshotPattern = "^Backup "
+	snapshots.Backup.TagURN = "urn:vmomi:InventoryServiceTag:5d2c8e1f-7a3b-4c9d-a1e6-2f8b0c7d4e93:GLOBAL"
+
+	events := vcConfig{}
+	events.VCenter.Server = "veba.local.corp"
+	events.VCenter.User = "admin@vsphere.local"
+	events.VCenter.Password = "password1234"
+	events.Backup.SLAHours = 36
+	events.Backup.CompletedEvents = []string{"com.example.backup.completed"}
+	events.Backup.CheckEvents = []string{"VmPoweredOnEvent"}
+	events.Backup.Field = "backup.last"
+	events.Notify.WebhookURL = "https://hooks.local.corp/backup"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a snapshot pattern and a tag loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&snapshots,
+		},
+		{
+			"Test that toml file with backup tool events and a notify sink loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&events,
+		},
+		{
+			"Test that toml file without SLA results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an invalid snapshot pattern results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without snapshot pattern and completed events results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag and notify sink results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures completed backup and check events are read and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig2.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that a check event is read", "testdata/event.json", false, "vm-42 checked"},
+		{"Test that a completed backup event of the backup tool is read", "testdata/event2.json", false, "vm-42 backed up"},
+		{"Event should return error if it is no completed or check event", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if VM is empty", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := event.Data.Vm.Vm.Value + " checked"
+		if cfg.completes(event.Subject) {
+			got = event.Data.Vm.Vm.Value + " backed up"
+		}
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestLastBackup ensures the newer of the recorded backup and the newest
+// backup snapshot is the last backup and checked against the SLA.
+func TestLastBackup(t *testing.T) {
+	now := time.Date(2020, 6, 11, 8, 0, 0, 0, time.UTC)
+	pattern := regexp.MustCompile("^Backup ")
+
+	var tests = []struct {
+		testDesc    string
+		info        backupInfo
+		pattern     *regexp.Regexp
+		wantAge     time.Duration // -1 without backup
+		wantSource  string
+		wantOverdue bool
+	}{
+		{
+			"Test that a VM without backup is overdue",
+			backupInfo{Snapshots: []snapshot{{Name: "before upgrade", Created: now.Add(-time.Hour)}}},
+			pattern, -1, "", true,
+		},
+		{
+			"Test that the newest backup snapshot, also in a child tree, is the last backup",
+			backupInfo{Snapshots: []snapshot{{Name: "Backup 1", Created: now.Add(-30 * time.Hour)}, {Name: "Backup 2", Created: now.Add(-2 * time.Hour)}}},
+			pattern, 2 * time.Hour, sourceSnapshot, false,
+		},
+		{
+			"Test that a recorded backup newer than the snapshots is the last backup",
+			backupInfo{Recorded: now.Add(-time.Hour), Snapshots: []snapshot{{Name: "Backup 1", Created: now.Add(-30 * time.Hour)}}},
+			pattern, time.Hour, sourceField, false,
+		},
+		{
+			"Test that a last backup older than the SLA is overdue",
+			backupInfo{Snapshots: []snapshot{{Name: "Backup 1", Created: now.Add(-25 * time.Hour)}}},
+			pattern, 25 * time.Hour, sourceSnapshot, true,
+		},
+		{
+			"Test that snapshots are ignored without pattern",
+			backupInfo{Snapshots: []snapshot{{Name: "Backup 1", Created: now.Add(-time.Hour)}}},
+			nil, -1, "", true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		last, source := lastBackup(&tc.info, tc.pattern)
+
+		age := time.Duration(-1)
+		if !last.IsZero() {
+			age = now.Sub(last)
+		}
+		late := overdue(last, now, 24*time.Hour)
+
+		if age == tc.wantAge && source == tc.wantSource && late == tc.wantOverdue {
+			t.Logf("got expected: %v, %v, overdue %v. %v", age, source, late, passMark)
+		} else {
+			t.Logf("expected: %v, %v, overdue %v, got: %v, %v, overdue %v. %v", tc.wantAge, tc.wantSource, tc.wantOverdue, age, source, late, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestVerify ensures VMs out of SLA are tagged once and untagged when their
+// backup is recorded or a backup snapshot is taken.
+func TestVerify(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "backup", Cardinality: "SINGLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "overdue", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Backup.SLAHours = 24
+		cfg.Backup.SnapshotPattern = "^Backup "
+		cfg.Backup.TagURN = tagID
+
+		now := time.Now()
+
+		var tests = []struct {
+			testDesc    string
+			setup       func() error
+			record      bool
+			wantOverdue bool
+			wantSource  string
+			wantActions string
+		}{
+			{"Test that a VM without backup is tagged", nil, false, true, "", "tagged"},
+			{"Test that a tagged VM is not tagged again", nil, false, true, "", "already tagged"},
+			{"Test that a completed backup is recorded and untags the VM", nil, true, false, sourceEvent, "recorded,untagged"},
+			{"Test that the recorded backup is within the SLA", nil, false, false, sourceField, ""},
+			{
+				"Test that a backup snapshot newer than the recorded backup is the last backup",
+				func() error {
+					task, err := vm.CreateSnapshot(ctx, "Backup 2020-06-11", "", false, false)
+					if err == nil {
+						err = task.Wait(ctx)
+					}
+					return err
+				},
+				false, false, sourceSnapshot, "",
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				if err := tc.setup(); err != nil {
+					t.Fatal("Test failing due to improper test setup.", failMark, err)
+				}
+			}
+
+			var rep report
+			if tc.record {
+				err = record(ctx, clt, &cfg, &rep, vm.Reference(), now.Add(-time.Hour))
+			} else {
+				err = verify(ctx, clt, &cfg, &rep, vm.Reference(), now)
+			}
+			if err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if rep.Overdue == tc.wantOverdue && rep.Source == tc.wantSource && got == tc.wantActions {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected overdue %v, source %q and actions %q, got: %+v. %v", tc.wantOverdue, tc.wantSource, tc.wantActions, rep, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
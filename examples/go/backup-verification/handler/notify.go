@@ -0,0 +1,99 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// overdueMessage returns the notification of a VM whose last backup is older
+// than the SLA.
+func overdueMessage(rep *report, sla time.Duration, now time.Time) message {
+	name := rep.VM
+	if rep.Name != "" {
+		name = rep.Name
+	}
+
+	msg := message{
+		Title: "Backup overdue",
+		Text:  fmt.Sprintf("%v was not backed up within %v", name, sla),
+		Fields: map[string]string{
+			"vm":          rep.VM,
+			"last_backup": "never",
+		},
+		Time: now.UTC(),
+	}
+	if rep.LastBackup != nil {
+		msg.Fields["last_backup"] = fmt.Sprintf("%v (%v ago, %v)", rep.LastBackup.UTC().Format(time.RFC3339), rep.Age, rep.Source)
+	}
+
+	return msg
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// unassigned groups VMs in no top-level folder or without tag of the
+// category.
+const unassigned = "unassigned"
+
+// gib is the number of bytes of a GiB.
+const gib = 1 << 30
+
+// usage is the capacity allocated to the VMs of a group, and its cost.
+type usage struct {
+	Group      string  `json:"group"`
+	VMs        int     `json:"vms"`
+	PoweredOn  int     `json:"powered_on"`
+	VCPUs      int     `json:"vcpus"`
+	MemoryGiB  float64 `json:"memory_gib"`
+	StorageGiB float64 `json:"storage_gib"`
+	Cost       float64 `json:"cost,omitempty"`
+}
+
+// summary is the chargeback summary published by the roll-up.
+type summary struct {
+	Time    time.Time `json:"time"`
+	GroupBy string    `json:"group_by"`
+	Groups  []usage   `json:"groups"`
+	Total   usage     `json:"total"`
+}
+
+// rollUp aggregates the allocations of all VMs by group and publishes the
+// summary.
+func rollUp(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, now time.Time) error {
+	list, err := clt.allocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	var groups map[types.ManagedObjectReference]string
+	switch cfg.groupBy() {
+	case groupByTag:
+		groups, err = clt.tagsOf(ctx, cfg.Chargeback.Category)
+	default:
+		groups, err = clt.topFolders(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := summarize(cfg, list, func(a allocation) string {
+		if cfg.groupBy() == groupByTag {
+			return groups[a.Ref]
+		}
+		if a.Parent == nil {
+			return ""
+		}
+		return groups[*a.Parent]
+	}, now)
+
+	rep.Groups = len(s.Groups)
+	rep.VMs = s.Total.VMs
+	rep.Cost = s.Total.Cost
+
+	return publish(ctx, cfg, rep, s)
+}
+
+// summarize aggregates the allocations in list by the group returned by
+// groupOf, an empty group is unassigned. Groups are sorted by name.
+func summarize(cfg *vcConfig, list []allocation, groupOf func(allocation) string, now time.Time) summary {
+	byGroup := map[string]*usage{}
+	for _, a := range list {
+		g := groupOf(a)
+		if g == "" {
+			g = unassigned
+		}
+
+		u, ok := byGroup[g]
+		if !ok {
+			u = &usage{Group: g}
+			byGroup[g] = u
+		}
+		u.add(a)
+	}
+
+	s := summary{Time: now.UTC(), GroupBy: cfg.groupBy(), Groups: []usage{}}
+	for _, u := range byGroup {
+		u.price(cfg)
+		s.Groups = append(s.Groups, *u)
+	}
+	sort.Slice(s.Groups, func(i, j int) bool { return s.Groups[i].Group < s.Groups[j].Group })
+
+	s.Total.Group = "total"
+	for _, u := range s.Groups {
+		s.Total.VMs += u.VMs
+		s.Total.PoweredOn += u.PoweredOn
+		s.Total.VCPUs += u.VCPUs
+		s.Total.MemoryGiB += u.MemoryGiB
+		s.Total.StorageGiB += u.StorageGiB
+		s.Total.Cost += u.Cost
+	}
+	s.Total.MemoryGiB = round(s.Total.MemoryGiB)
+	s.Total.StorageGiB = round(s.Total.StorageGiB)
+	s.Total.Cost = round(s.Total.Cost)
+
+	return s
+}
+
+// add adds the allocation of a VM.
+func (u *usage) add(a allocation) {
+	u.VMs++
+	if a.PoweredOn {
+		u.PoweredOn++
+	}
+	u.VCPUs += int(a.VCPUs)
+	u.MemoryGiB += float64(a.MemoryMiB) / 1024
+	u.StorageGiB += float64(a.StorageBytes) / gib
+}
+
+// price rounds the allocation and computes its cost with the configured
+// rates. Powered off VMs are charged, too, since their capacity stays
+// allocated.
+func (u *usage) price(cfg *vcConfig) {
+	u.MemoryGiB = round(u.MemoryGiB)
+	u.StorageGiB = round(u.StorageGiB)
+
+	r := cfg.Rates
+	u.Cost = round(float64(u.VCPUs)*r.VCPU + u.MemoryGiB*r.MemoryGiB + u.StorageGiB*r.StorageGiB)
+}
+
+// round rounds f to two decimals.
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// encode encodes s in the configured format. It returns the encoded summary
+// and its content type.
+func encode(cfg *vcConfig, s summary) ([]byte, string, error) {
+	if cfg.format() != formatCSV {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, "", fmt.Errorf("encoding summary failed: %w", err)
+		}
+		return b, "application/json", nil
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	records := [][]string{{"group", "vms", "powered_on", "vcpus", "memory_gib", "storage_gib", "cost"}}
+	for _, u := range append(s.Groups, s.Total) {
+		records = append(records, []string{
+			u.Group,
+			strconv.Itoa(u.VMs),
+			strconv.Itoa(u.PoweredOn),
+			strconv.Itoa(u.VCPUs),
+			strconv.FormatFloat(u.MemoryGiB, 'f', 2, 64),
+			strconv.FormatFloat(u.StorageGiB, 'f', 2, 64),
+			strconv.FormatFloat(u.Cost, 'f', 2, 64),
+		})
+	}
+
+	if err := w.WriteAll(records); err != nil {
+		return nil, "", fmt.Errorf("encoding summary failed: %w", err)
+	}
+
+	return buf.Bytes(), "text/csv", nil
+}
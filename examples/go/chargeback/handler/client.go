@@ -0,0 +1,222 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// allocation is the capacity allocated to a VM.
+type allocation struct {
+	Ref          types.ManagedObjectReference
+	Name         string
+	Parent       *types.ManagedObjectReference
+	PoweredOn    bool
+	VCPUs        int32
+	MemoryMiB    int32
+	StorageBytes int64
+}
+
+// allocations returns the allocations of all VMs, without templates. The
+// storage of a VM is its committed and uncommitted storage, i.e. what thin
+// disks may grow to.
+func (clt *vsClient) allocations(ctx context.Context) ([]allocation, error) {
+	var vms []mo.VirtualMachine
+	err := clt.retrieveAll(ctx, "VirtualMachine", []string{"name", "parent", "config.template", "config.hardware", "runtime.powerState", "summary.storage"}, &vms)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []allocation
+	for _, vm := range vms {
+		// VMs being created or removed have no config.
+		if vm.Config == nil || vm.Config.Template {
+			continue
+		}
+
+		a := allocation{
+			Ref:       vm.Reference(),
+			Name:      vm.Name,
+			Parent:    vm.Parent,
+			PoweredOn: vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+			VCPUs:     vm.Config.Hardware.NumCPU,
+			MemoryMiB: vm.Config.Hardware.MemoryMB,
+		}
+		if s := vm.Summary.Storage; s != nil {
+			a.StorageBytes = s.Committed + s.Uncommitted
+		}
+		list = append(list, a)
+	}
+
+	return list, nil
+}
+
+// topFolders returns the name of the top-level VM folder of each VM folder,
+// by folder. The top-level VM folders are the children of the VM folder of a
+// datacenter; VMs directly in it are in no top-level folder.
+func (clt *vsClient) topFolders(ctx context.Context) (map[types.ManagedObjectReference]string, error) {
+	var dcs []mo.Datacenter
+	if err := clt.retrieveAll(ctx, "Datacenter", []string{"vmFolder"}, &dcs); err != nil {
+		return nil, err
+	}
+
+	var folders []mo.Folder
+	if err := clt.retrieveAll(ctx, "Folder", []string{"name", "parent"}, &folders); err != nil {
+		return nil, err
+	}
+
+	roots := map[types.ManagedObjectReference]bool{}
+	for _, dc := range dcs {
+		roots[dc.VmFolder] = true
+	}
+
+	byRef := map[types.ManagedObjectReference]mo.Folder{}
+	for _, f := range folders {
+		byRef[f.Reference()] = f
+	}
+
+	top := map[types.ManagedObjectReference]string{}
+	for _, f := range folders {
+		if roots[f.Reference()] {
+			continue
+		}
+
+		// Walk up to the folder below the VM folder of the datacenter.
+		cur := f
+		for cur.Parent != nil && !roots[*cur.Parent] {
+			parent, ok := byRef[*cur.Parent]
+			if !ok {
+				break
+			}
+			cur = parent
+		}
+		if cur.Parent != nil && roots[*cur.Parent] {
+			top[f.Reference()] = cur.Name
+		}
+	}
+
+	return top, nil
+}
+
+// tagsOf returns the name of the tag of category attached to each VM. VMs
+// with several tags of the category are counted for the first by name.
+func (clt *vsClient) tagsOf(ctx context.Context, category string) (map[types.ManagedObjectReference]string, error) {
+	m := tags.NewManager(clt.rest)
+
+	c, err := m.GetCategory(ctx, category)
+	if err != nil {
+		return nil, fmt.Errorf("get tag category %v failed: %w", category, err)
+	}
+
+	list, err := m.GetTagsForCategory(ctx, c.ID)
+	if err != nil {
+		return nil, fmt.Errorf("listing tags of category %v failed: %w", category, err)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	byVM := map[types.ManagedObjectReference]string{}
+	for _, t := range list {
+		refs, err := m.ListAttachedObjects(ctx, t.ID)
+		if err != nil {
+			return nil, fmt.Errorf("listing objects of tag %v failed: %w", t.Name, err)
+		}
+
+		for _, r := range refs {
+			ref := r.Reference()
+			if _, ok := byVM[ref]; !ok && ref.Type == "VirtualMachine" {
+				byVM[ref] = t.Name
+			}
+		}
+	}
+
+	return byVM, nil
+}
+
+// retrieveAll retrieves the properties ps of all objects of kind into dst.
+func (clt *vsClient) retrieveAll(ctx context.Context, kind string, ps []string, dst interface{}) error {
+	c := clt.govmomi.Client
+	m := view.NewManager(c)
+
+	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{kind}, true)
+	if err != nil {
+		return fmt.Errorf("create %v view failed: %w", kind, err)
+	}
+	defer v.Destroy(ctx)
+
+	if err := v.Retrieve(ctx, []string{kind}, ps, dst); err != nil {
+		return fmt.Errorf("retrieve %v failed: %w", kind, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
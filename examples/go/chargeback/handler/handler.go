@@ -0,0 +1,404 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents run the roll-up if no events are configured. vCenter posts
+// them when a scheduled task starts.
+var defaultEvents = []string{"ScheduledTaskStartedEvent"}
+
+// cronTrigger names invocations without event, e.g. of the OpenFaaS cron
+// connector.
+const cronTrigger = "cron"
+
+// Groupings of VMs.
+const (
+	groupByFolder = "folder"
+	groupByTag    = "tag"
+)
+
+// Formats of the summary.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Chargeback struct {
+		// Events run the roll-up, by default defaultEvents. Invocations
+		// without event, e.g. of the OpenFaaS cron connector, always
+		// run it.
+		Events []string
+		// ScheduledTask limits the roll-up to events of the scheduled
+		// task of this name, all scheduled tasks run it without.
+		ScheduledTask string `toml:"scheduled_task"`
+		// GroupBy is folder, the default, to group VMs by the top-level
+		// VM folder of their datacenter, or tag to group them by their
+		// tag of Category.
+		GroupBy  string `toml:"group_by"`
+		Category string
+		// Format of the summary, json, the default, or csv.
+		Format string
+	}
+	// Rates are the costs of one vCPU, GiB of memory and GiB of storage
+	// per period, e.g. per month. Without rates, no costs are computed.
+	Rates struct {
+		VCPU       float64 `toml:"vcpu"`
+		MemoryGiB  float64 `toml:"memory_gib"`
+		StorageGiB float64 `toml:"storage_gib"`
+	}
+	Publish struct {
+		// WebhookURL receives the summary as body of a POST.
+		WebhookURL string `toml:"webhook_url"`
+		// S3 stores the summary as object in a bucket of S3 or an S3
+		// compatible store, e.g. MinIO.
+		S3 struct {
+			Endpoint        string
+			Region          string
+			Bucket          string
+			Prefix          string
+			AccessKeyID     string `toml:"access_key_id"`
+			SecretAccessKey string `toml:"secret_access_key"`
+		} `toml:"s3"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		ScheduledTask *types.ScheduledTaskEventArgument `json:"ScheduledTask,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the roll-up and where its summary was published.
+type report struct {
+	Trigger string   `json:"trigger"`
+	Groups  int      `json:"groups"`
+	VMs     int      `json:"vms"`
+	Cost    float64  `json:"cost,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	trigger, err := parseTrigger(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{Trigger: trigger}
+	actionErr := rollUp(ctx, clt, cfg, &rep, time.Now())
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("chargeback roll-up failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// runs reports whether event runs the roll-up.
+func (cfg *vcConfig) runs(event string) bool {
+	events := cfg.Chargeback.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// groupBy returns how VMs are grouped.
+func (cfg *vcConfig) groupBy() string {
+	if cfg.Chargeback.GroupBy == "" {
+		return groupByFolder
+	}
+
+	return cfg.Chargeback.GroupBy
+}
+
+// format returns the format of the summary.
+func (cfg *vcConfig) format() string {
+	if cfg.Chargeback.Format == "" {
+		return formatJSON
+	}
+
+	return cfg.Chargeback.Format
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// A summary which is not published is lost.
+	p := cfg.Publish
+	if p.WebhookURL == "" && p.S3.Bucket == "" {
+		return errors.New("required field(s) missing, including publish webhook_url or s3 bucket")
+	}
+
+	if p.S3.Bucket != "" && p.S3.Region == "" {
+		return errors.New("publish s3 region is required")
+	}
+
+	switch cfg.groupBy() {
+	case groupByFolder:
+	case groupByTag:
+		if cfg.Chargeback.Category == "" {
+			return errors.New(`chargeback category is required with group_by "tag"`)
+		}
+	default:
+		return fmt.Errorf("unsupported chargeback group_by %q", cfg.Chargeback.GroupBy)
+	}
+
+	if f := cfg.format(); f != formatJSON && f != formatCSV {
+		return fmt.Errorf("unsupported chargeback format %q", f)
+	}
+
+	r := cfg.Rates
+	if r.VCPU < 0 || r.MemoryGiB < 0 || r.StorageGiB < 0 {
+		return errors.New("rates must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseTrigger returns what triggered the roll-up: the configured event of
+// req, or cronTrigger if req is empty.
+func parseTrigger(req []byte, cfg *vcConfig) (string, error) {
+	if len(bytes.TrimSpace(req)) == 0 {
+		return cronTrigger, nil
+	}
+
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return "", fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.runs(event.Subject) {
+		return "", fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if name := cfg.Chargeback.ScheduledTask; name != "" {
+		if st := event.Data.ScheduledTask; st == nil || st.Name != name {
+			return "", fmt.Errorf("event is not of scheduled task %q", name)
+		}
+	}
+
+	return event.Subject, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,450 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.Chargeback.Events = []string{"ScheduledTaskStartedEvent"}
+	full.Chargeback.ScheduledTask = "monthly chargeback"
+	full.Chargeback.GroupBy = groupByTag
+	full.Chargeback.Category = "cost-center"
+	full.Chargeback.Format = formatCSV
+	full.Rates.VCPU = 10.5
+	full.Rates.MemoryGiB = 4
+	full.Rates.StorageGiB = 0.1
+	full.Publish.WebhookURL = "https://hooks.local.corp/chargeback"
+	full.Publish.S3.Endpoint = "https://minio.local.corp:9000"
+	full.Publish.S3.Region = "us-east-1"
+	full.Publish.S3.Bucket = "chargeback"
+	full.Publish.S3.Prefix = "vcenter/"
+	full.Publish.S3.AccessKeyID = "AKIAEXAMPLE"
+	full.Publish.S3.SecretAccessKey = "secret1234"
+
+	minimal := vcConfig{}
+	minimal.VCenter = full.VCenter
+	minimal.VCenter.Insecure = true
+	minimal.Publish.WebhookURL = full.Publish.WebhookURL
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file grouping by tag and publishing CSV to both targets loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&full,
+		},
+		{
+			"Test that toml file with a webhook only loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&minimal,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml grouping by tag without category results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with a bucket without region results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with an unsupported format results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a missing vcconfig.toml results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseTrigger shows events of the configured scheduled task and
+// invocations without event run the roll-up.
+func TestParseTrigger(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that the started scheduled task is readable", "testdata/event.json", false, "ScheduledTaskStartedEvent"},
+		{"Test that an empty invocation is a cron trigger", "testdata/event2.json", false, cronTrigger},
+		{"Event should return error if it is of another scheduled task", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		got, err := parseTrigger(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestSummarize shows allocations are aggregated and priced by group, and
+// encoded as CSV with a total row.
+func TestSummarize(t *testing.T) {
+	var cfg vcConfig
+	cfg.Chargeback.Format = formatCSV
+	cfg.Rates.VCPU = 10
+	cfg.Rates.MemoryGiB = 2
+	cfg.Rates.StorageGiB = 0.5
+
+	list := []allocation{
+		{Name: "web-01", PoweredOn: true, VCPUs: 2, MemoryMiB: 4096, StorageBytes: 40 * gib},
+		{Name: "web-02", VCPUs: 2, MemoryMiB: 2048, StorageBytes: 20 * gib},
+		{Name: "db-01", PoweredOn: true, VCPUs: 8, MemoryMiB: 32768, StorageBytes: 200 * gib},
+		{Name: "scratch", VCPUs: 1, MemoryMiB: 512},
+	}
+	groupOf := func(a allocation) string {
+		switch {
+		case strings.HasPrefix(a.Name, "web"):
+			return "web"
+		case strings.HasPrefix(a.Name, "db"):
+			return "finance"
+		}
+		return ""
+	}
+
+	s := summarize(&cfg, list, groupOf, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC))
+
+	t.Log("=========== Test that groups are sorted, priced and totaled ===========")
+	want := []usage{
+		{Group: "finance", VMs: 1, PoweredOn: 1, VCPUs: 8, MemoryGiB: 32, StorageGiB: 200, Cost: 244},
+		{Group: unassigned, VMs: 1, VCPUs: 1, MemoryGiB: 0.5, Cost: 11},
+		{Group: "web", VMs: 2, PoweredOn: 1, VCPUs: 4, MemoryGiB: 6, StorageGiB: 60, Cost: 82},
+	}
+	total := usage{Group: "total", VMs: 4, PoweredOn: 2, VCPUs: 13, MemoryGiB: 38.5, StorageGiB: 260, Cost: 337}
+	if reflect.DeepEqual(s.Groups, want) && s.Total == total {
+		t.Logf("got expected: %+v. %v", s, passMark)
+	} else {
+		t.Logf("expected: %+v and %+v, got: %+v. %v", want, total, s, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that the summary is encoded as CSV ===========")
+	b, contentType, err := encode(&cfg, s)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	wantCSV := "group,vms,powered_on,vcpus,memory_gib,storage_gib,cost\n" +
+		"finance,1,1,8,32.00,200.00,244.00\n" +
+		"unassigned,1,0,1,0.50,0.00,11.00\n" +
+		"web,2,1,4,6.00,60.00,82.00\n" +
+		"total,4,2,13,38.50,260.00,337.00\n"
+	if string(b) == wantCSV && contentType == "text/csv" {
+		t.Logf("got expected: %q. %v", b, passMark)
+	} else {
+		t.Logf("expected: %q, got: %q (%v). %v", wantCSV, b, contentType, failMark)
+		t.Fail()
+	}
+}
+
+// TestPublish shows the summary is posted to the webhook and stored as signed
+// object in the bucket.
+func TestPublish(t *testing.T) {
+	type request struct {
+		method, path, contentType, auth, body string
+	}
+	var got []request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, request{r.Method, r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)})
+		if strings.HasSuffix(r.URL.Path, "/rejected") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	var cfg vcConfig
+	cfg.Publish.WebhookURL = srv.URL + "/hook"
+	cfg.Publish.S3.Endpoint = srv.URL
+	cfg.Publish.S3.Region = "us-east-1"
+	cfg.Publish.S3.Bucket = "chargeback"
+	cfg.Publish.S3.Prefix = "vcenter/"
+	cfg.Publish.S3.AccessKeyID = "AKIAEXAMPLE"
+	cfg.Publish.S3.SecretAccessKey = "secret1234"
+
+	s := summary{Time: time.Date(2020, 7, 1, 0, 0, 1, 0, time.UTC), GroupBy: groupByFolder, Groups: []usage{}}
+
+	t.Log("=========== Test that the summary is posted and stored ===========")
+	var rep report
+	if err := publish(context.Background(), &cfg, &rep, s); err != nil {
+		t.Fatal(failMark, err)
+	}
+
+	wantActions := "posted to webhook,stored vcenter/20200701T000001Z.json"
+	if len(got) == 2 && got[0].method == http.MethodPost && got[0].path == "/hook" &&
+		got[1].method == http.MethodPut && got[1].path == "/chargeback/vcenter/20200701T000001Z.json" &&
+		strings.HasPrefix(got[1].auth, "AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/") &&
+		got[0].body == got[1].body && got[1].contentType == "application/json" &&
+		strings.Join(rep.Actions, ",") == wantActions {
+		t.Logf("got expected: %+v. %v", got, passMark)
+	} else {
+		t.Logf("expected a post and a signed put, got: %+v, actions: %v. %v", got, rep.Actions, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that a rejected webhook does not keep the summary from being stored ===========")
+	got = nil
+	rep = report{}
+	cfg.Publish.WebhookURL = srv.URL + "/rejected"
+	if err := publish(context.Background(), &cfg, &rep, s); err != nil && len(got) == 2 && strings.Join(rep.Actions, ",") == "stored vcenter/20200701T000001Z.json" {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected an error and a stored summary, got: %v, actions: %v. %v", err, rep.Actions, failMark)
+		t.Fail()
+	}
+}
+
+// TestRollUp shows VMs are grouped by their top-level folder or tag.
+func TestRollUp(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		dc, err := finder.DefaultDatacenter(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		finder.SetDatacenter(dc)
+
+		folders, err := dc.Folders(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		finance, err := folders.VmFolder.CreateFolder(ctx, "finance")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		payroll, err := finance.CreateFolder(ctx, "payroll")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := payroll.MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "cost-center", Cardinality: "SINGLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "cc-1001", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vm2, err := finder.VirtualMachine(ctx, "DC0_H0_VM1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := m.AttachTag(ctx, tagID, vm2.Reference()); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		list, err := clt.allocations(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var posted string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			posted = string(body)
+		}))
+		defer srv.Close()
+
+		var tests = []struct {
+			testDesc   string
+			groupBy    string
+			wantGroups string
+		}{
+			{"Test that VMs are grouped by top-level folder", groupByFolder, "finance:1,unassigned:"},
+			{"Test that VMs are grouped by tag", groupByTag, "cc-1001:1,unassigned:"},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			var cfg vcConfig
+			cfg.Chargeback.GroupBy = tc.groupBy
+			cfg.Chargeback.Category = "cost-center"
+			cfg.Chargeback.Format = formatCSV
+			cfg.Publish.WebhookURL = srv.URL
+
+			var rep report
+			if err := rollUp(ctx, clt, &cfg, &rep, time.Now()); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			var groups []string
+			for _, line := range strings.Split(strings.TrimSpace(posted), "\n")[1:] {
+				f := strings.Split(line, ",")
+				if f[0] != "total" {
+					groups = append(groups, f[0]+":"+f[1])
+				}
+			}
+
+			got := strings.Join(groups, ",")
+			want := tc.wantGroups + strconv.Itoa(len(list)-1)
+			if got == want && rep.VMs == len(list) && rep.Groups == 2 {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v, report: %+v. %v", want, got, rep, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
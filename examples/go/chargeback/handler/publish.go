@@ -0,0 +1,156 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// publish posts the summary s to the webhook and stores it in the bucket,
+// as configured. A failing webhook does not keep the summary from being
+// stored.
+func publish(ctx context.Context, cfg *vcConfig, rep *report, s summary) error {
+	b, contentType, err := encode(cfg, s)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	p := cfg.Publish
+
+	if p.WebhookURL != "" {
+		if err := post(ctx, p.WebhookURL, contentType, b); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "posted to webhook")
+		}
+	}
+
+	if p.S3.Bucket != "" {
+		key := p.S3.Prefix + s.Time.Format("20060102T150405Z") + "." + cfg.format()
+		if err := put(ctx, cfg, key, contentType, b, time.Now()); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "stored "+key)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// post posts the summary b to the webhook u.
+func post(ctx context.Context, u, contentType string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating webhook request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return do(req, "webhook")
+}
+
+// put stores the summary b as object key in the bucket. Requests are signed
+// with AWS Signature Version 4 and use path-style addressing, which all S3
+// compatible stores support.
+func put(ctx context.Context, cfg *vcConfig, key, contentType string, b []byte, now time.Time) error {
+	s3 := cfg.Publish.S3
+
+	endpoint := s3.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + s3.Bucket + "/" + key)
+	if err != nil {
+		return fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating s3 request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	sign(cfg, req, b, now)
+
+	return do(req, "s3")
+}
+
+// do sends req and expects a 2xx response of target.
+func do(req *http.Request, target string) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("publishing to %v failed: %w", target, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("summary rejected by %v: %v %s", target, resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 of req with payload to its headers.
+func sign(cfg *vcConfig, req *http.Request, payload []byte, now time.Time) {
+	s3 := cfg.Publish.S3
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s3.SecretAccessKey), date)
+	key = hmacSHA256(key, s3.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,178 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// errPoweredOn is returned for VMs powered on since they were planned, which
+// would be migrated with Storage vMotion instead.
+var errPoweredOn = errors.New("powered on since planned")
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// datastores returns the accessible datastores which are not in maintenance
+// mode, limited to the datastores of names, if any.
+func (clt *vsClient) datastores(ctx context.Context, names []string) ([]*datastore, error) {
+	var list []mo.Datastore
+	err := clt.retrieveAll(ctx, "Datastore", []string{"name", "summary", "host"}, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	limited := map[string]bool{}
+	for _, n := range names {
+		limited[n] = true
+	}
+
+	var dss []*datastore
+	for _, ds := range list {
+		s := ds.Summary
+		if !s.Accessible || (s.MaintenanceMode != "" && s.MaintenanceMode != string(types.DatastoreSummaryMaintenanceModeStateNormal)) {
+			continue
+		}
+		if len(limited) > 0 && !limited[s.Name] {
+			continue
+		}
+
+		d := &datastore{
+			Ref:      ds.Reference(),
+			Name:     s.Name,
+			Capacity: s.Capacity,
+			Used:     s.Capacity - s.FreeSpace,
+			Hosts:    map[types.ManagedObjectReference]bool{},
+		}
+		for _, m := range ds.Host {
+			d.Hosts[m.Key] = true
+		}
+		dss = append(dss, d)
+	}
+
+	return dss, nil
+}
+
+// candidates returns the powered off VMs, without templates, stored on a
+// single datastore. VMs spanning datastores are not planned, since moving
+// them to one datastore frees space the plan does not account for.
+func (clt *vsClient) candidates(ctx context.Context) ([]candidate, error) {
+	var vms []mo.VirtualMachine
+	err := clt.retrieveAll(ctx, "VirtualMachine", []string{"name", "config.template", "runtime.powerState", "runtime.host", "datastore", "summary.storage"}, &vms)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []candidate
+	for _, vm := range vms {
+		// VMs being created or removed have no config.
+		if vm.Config == nil || vm.Config.Template {
+			continue
+		}
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff || vm.Runtime.Host == nil {
+			continue
+		}
+		if len(vm.Datastore) != 1 {
+			continue
+		}
+
+		c := candidate{
+			Ref:       vm.Reference(),
+			Name:      vm.Name,
+			Host:      *vm.Runtime.Host,
+			Datastore: vm.Datastore[0],
+		}
+		if s := vm.Summary.Storage; s != nil {
+			c.Bytes = s.Committed
+		}
+		list = append(list, c)
+	}
+
+	return list, nil
+}
+
+// relocate starts moving the files of a powered off VM to the datastore ds
+// and returns the task. The power state is checked again first, since VMs
+// powered on since planning would be moved with Storage vMotion.
+func (clt *vsClient) relocate(ctx context.Context, ref, ds types.ManagedObjectReference) (string, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"runtime.powerState"}, &vm)
+	if err != nil {
+		return "", fmt.Errorf("retrieve VM %v failed: %w", ref.Value, err)
+	}
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		return "", errPoweredOn
+	}
+
+	spec := types.VirtualMachineRelocateSpec{Datastore: &ds}
+	task, err := object.NewVirtualMachine(clt.govmomi.Client, ref).Relocate(ctx, spec, types.VirtualMachineMovePriorityDefaultPriority)
+	if err != nil {
+		return "", fmt.Errorf("relocate %v failed: %w", ref.Value, err)
+	}
+
+	return task.Reference().Value, nil
+}
+
+// retrieveAll retrieves the properties ps of all objects of kind into dst.
+func (clt *vsClient) retrieveAll(ctx context.Context, kind string, ps []string, dst interface{}) error {
+	c := clt.govmomi.Client
+	m := view.NewManager(c)
+
+	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{kind}, true)
+	if err != nil {
+		return fmt.Errorf("create %v view failed: %w", kind, err)
+	}
+	defer v.Destroy(ctx)
+
+	if err := v.Retrieve(ctx, []string{kind}, ps, dst); err != nil {
+		return fmt.Errorf("retrieve %v failed: %w", kind, err)
+	}
+
+	return nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	if err := clt.govmomi.Logout(ctx); err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
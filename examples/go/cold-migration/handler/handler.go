@@ -0,0 +1,439 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// alarmEvent is the event of alarms changing their status.
+const alarmEvent = "AlarmStatusChangedEvent"
+
+// defaultEvents start the planning if no events are configured: scheduled
+// tasks and alarms, e.g. of datastore usage.
+var defaultEvents = []string{"ScheduledTaskStartedEvent", alarmEvent}
+
+// cronTrigger names invocations without event, e.g. of the OpenFaaS cron
+// connector.
+const cronTrigger = "cron"
+
+// Defaults of the [migration] section.
+const (
+	defaultSourceUsedPercent = 85
+	defaultTargetUsedPercent = 70
+	defaultMaxMigrations     = 5
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Migration struct {
+		// Events start the planning, by default defaultEvents.
+		// Invocations without event, e.g. of the OpenFaaS cron
+		// connector, always start it.
+		Events []string
+		// ScheduledTask limits scheduled task events to the task of this
+		// name.
+		ScheduledTask string `toml:"scheduled_task"`
+		// Alarms limits alarm events to the alarms of these names, e.g.
+		// Datastore usage on disk. Alarms turning green never start the
+		// planning.
+		Alarms []string
+		// SourceUsedPercent is the used space beyond which datastores
+		// are overfull, by default defaultSourceUsedPercent.
+		SourceUsedPercent float64 `toml:"source_used_percent"`
+		// TargetUsedPercent is the used space datastores receiving VMs
+		// may reach, by default defaultTargetUsedPercent.
+		TargetUsedPercent float64 `toml:"target_used_percent"`
+		// MaxMigrations limits the migrations started per invocation, by
+		// default defaultMaxMigrations.
+		MaxMigrations int `toml:"max_migrations"`
+		// Datastores limits the overfull and receiving datastores to the
+		// datastores of these names, all datastores are planned without.
+		Datastores []string
+		// Windows are the times migrations are started, e.g. "saturday
+		// 22:00-06:00" or "daily 01:00-05:00", any time without.
+		Windows []string
+		// Timezone of the windows, by default UTC.
+		Timezone string
+		// DryRun reports the planned migrations without starting them.
+		DryRun bool `toml:"dry_run"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		ScheduledTask *types.ScheduledTaskEventArgument `json:"ScheduledTask,omitempty"`
+		Alarm         *types.AlarmEventArgument         `json:"Alarm,omitempty"`
+		To            string                            `json:"To,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the overfull datastores and the migrations planned for
+// them.
+type report struct {
+	Trigger    string      `json:"trigger"`
+	Overfull   []usage     `json:"overfull,omitempty"`
+	Migrations []migration `json:"migrations,omitempty"`
+	DryRun     bool        `json:"dry_run,omitempty"`
+	Skipped    string      `json:"skipped,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	trigger, skipped, err := parseTrigger(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	rep := report{Trigger: trigger, Skipped: skipped, DryRun: cfg.Migration.DryRun}
+
+	// Outside the windows, nothing is planned, so vCenter is not queried.
+	if rep.Skipped == "" && !cfg.inWindow(time.Now()) {
+		rep.Skipped = "outside migration windows"
+	}
+
+	var actionErr error
+	if rep.Skipped == "" {
+		// Connect to vSphere govmomi API once and persist connection with global variable.
+		clt, err := vsConnect(ctx, cfg)
+		if err != nil {
+			wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+			slog.Error("connect to vSphere failed", "err", err)
+
+			return handler.Response{
+				Body:       []byte(wrapErr.Error()),
+				StatusCode: http.StatusInternalServerError,
+			}, wrapErr
+		}
+
+		actionErr = migrate(ctx, clt, cfg, &rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("cold migration failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// runs reports whether event starts the planning.
+func (cfg *vcConfig) runs(event string) bool {
+	events := cfg.Migration.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceUsedPercent returns the used space beyond which datastores are
+// overfull.
+func (cfg *vcConfig) sourceUsedPercent() float64 {
+	if cfg.Migration.SourceUsedPercent == 0 {
+		return defaultSourceUsedPercent
+	}
+
+	return cfg.Migration.SourceUsedPercent
+}
+
+// targetUsedPercent returns the used space datastores receiving VMs may reach.
+func (cfg *vcConfig) targetUsedPercent() float64 {
+	if cfg.Migration.TargetUsedPercent == 0 {
+		return defaultTargetUsedPercent
+	}
+
+	return cfg.Migration.TargetUsedPercent
+}
+
+// maxMigrations returns the migrations started per invocation at most.
+func (cfg *vcConfig) maxMigrations() int {
+	if cfg.Migration.MaxMigrations == 0 {
+		return defaultMaxMigrations
+	}
+
+	return cfg.Migration.MaxMigrations
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	source, target := cfg.sourceUsedPercent(), cfg.targetUsedPercent()
+	if source <= 0 || source > 100 || target <= 0 || target > 100 {
+		return errors.New("migration source_used_percent and target_used_percent must be between 0 and 100")
+	}
+
+	// Receiving datastores would become overfull themselves.
+	if target >= source {
+		return fmt.Errorf("migration target_used_percent %v must be below source_used_percent %v", target, source)
+	}
+
+	if cfg.Migration.MaxMigrations < 0 {
+		return errors.New("migration max_migrations must not be negative")
+	}
+
+	if _, err := cfg.windows(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseTrigger returns what triggered the planning: the configured event of
+// req, or cronTrigger if req is empty. Events which do not start it, e.g.
+// alarms turning green, are returned with the reason they are skipped.
+func parseTrigger(req []byte, cfg *vcConfig) (trigger, skipped string, err error) {
+	if len(bytes.TrimSpace(req)) == 0 {
+		return cronTrigger, "", nil
+	}
+
+	var event incoming
+
+	err = json.Unmarshal(req, &event)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.runs(event.Subject) {
+		return "", "", fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if st := event.Data.ScheduledTask; st != nil {
+		if name := cfg.Migration.ScheduledTask; name != "" && st.Name != name {
+			return event.Subject, fmt.Sprintf("scheduled task %v is not %v", st.Name, name), nil
+		}
+	}
+
+	if event.Subject == alarmEvent {
+		alarm := event.Data.Alarm
+		if alarm == nil || alarm.Name == "" {
+			return "", "", errors.New("empty alarm")
+		}
+
+		if !cfg.watches(alarm.Name) {
+			return event.Subject, fmt.Sprintf("alarm %v is not watched", alarm.Name), nil
+		}
+
+		if event.Data.To == string(types.ManagedEntityStatusGreen) || event.Data.To == string(types.ManagedEntityStatusGray) {
+			return event.Subject, fmt.Sprintf("alarm %v turned %v", alarm.Name, event.Data.To), nil
+		}
+	}
+
+	return event.Subject, "", nil
+}
+
+// watches reports whether alarm events of the alarm name start the planning.
+func (cfg *vcConfig) watches(name string) bool {
+	if len(cfg.Migration.Alarms) == 0 {
+		return true
+	}
+
+	for _, a := range cfg.Migration.Alarms {
+		if a == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
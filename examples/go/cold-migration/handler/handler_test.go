@@ -0,0 +1,430 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.Migration.Events = []string{"ScheduledTaskStartedEvent", alarmEvent}
+	full.Migration.ScheduledTask = "nightly cold migration"
+	full.Migration.Alarms = []string{"Datastore usage on disk"}
+	full.Migration.SourceUsedPercent = 90
+	full.Migration.TargetUsedPercent = 75
+	full.Migration.MaxMigrations = 3
+	full.Migration.Datastores = []string{"ds-01", "ds-02", "ds-03"}
+	full.Migration.Windows = []string{"saturday 22:00-06:00", "daily 01:00-04:00"}
+	full.Migration.Timezone = "Europe/Berlin"
+	full.Migration.DryRun = true
+
+	defaults := vcConfig{}
+	defaults.VCenter = full.VCenter
+	defaults.VCenter.Insecure = true
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with windows loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&full,
+		},
+		{
+			"Test that toml file with the defaults loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&defaults,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a target above the source results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a window of an unknown day results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an unknown timezone results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseTrigger ensures scheduled tasks and alarms start the planning and
+// other scheduled tasks and alarms are skipped.
+func TestParseTrigger(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc    string
+		jsonPath    string
+		expectErr   bool
+		want        string
+		wantSkipped bool
+	}{
+		{"Test that the started scheduled task is readable", "testdata/event.json", false, "ScheduledTaskStartedEvent", false},
+		{"Test that an empty invocation is a cron trigger", "testdata/event2.json", false, cronTrigger, false},
+		{"Test that an alarm turning red is readable", "testdata/event3.json", false, alarmEvent, false},
+		{"Test that an alarm turning green is skipped", "testdata/event4.json", false, alarmEvent, true},
+		{"Test that another scheduled task is skipped", "testdata/event5.json", false, "ScheduledTaskStartedEvent", true},
+		{"Event should return error if it is not configured", "testdata/eventErr1.json", true, "", false},
+		{"Event should return error if the alarm is empty", "testdata/eventErr2.json", true, "", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		got, skipped, err := parseTrigger(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if !tc.expectErr && got == tc.want && (skipped != "") == tc.wantSkipped {
+			t.Logf("got expected: %v, skipped %q. %v", got, skipped, passMark)
+		} else {
+			t.Logf("expected: %v, skipped %v, got: %v, skipped %q. %v", tc.want, tc.wantSkipped, got, skipped, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestInWindow ensures migrations are started within the windows in their
+// timezone, including windows which wrap midnight.
+func TestInWindow(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc string
+		now      string
+		want     bool
+	}{
+		{"Test that Saturday night in Berlin is within the weekly window", "2020-07-04T21:30:00Z", true},
+		{"Test that the early Sunday is within the window started on Saturday", "2020-07-05T03:30:00Z", true},
+		{"Test that the Sunday after the window ended is outside", "2020-07-05T04:30:00Z", false},
+		{"Test that a Tuesday night is within the daily window", "2020-07-07T00:30:00Z", true},
+		{"Test that a Tuesday noon is outside", "2020-07-07T10:00:00Z", false},
+		{"Test that Saturday afternoon before the window is outside", "2020-07-04T14:00:00Z", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		now, err := time.Parse(time.RFC3339, tc.now)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		got := cfg.inWindow(now)
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPlan ensures VMs of the fullest datastores are planned, the largest
+// first, to the least used datastores mounted by their host, until the
+// datastores are no longer overfull.
+func TestPlan(t *testing.T) {
+	const gib = int64(1) << 30
+	host := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	other := types.ManagedObjectReference{Type: "HostSystem", Value: "host-2"}
+
+	ds := func(name string, capacity, used int64, hosts ...types.ManagedObjectReference) *datastore {
+		d := &datastore{
+			Ref:      types.ManagedObjectReference{Type: "Datastore", Value: name},
+			Name:     name,
+			Capacity: capacity * gib,
+			Used:     used * gib,
+			Hosts:    map[types.ManagedObjectReference]bool{},
+		}
+		for _, h := range hosts {
+			d.Hosts[h] = true
+		}
+		return d
+	}
+	vm := func(name, ds string, size int64, h types.ManagedObjectReference) candidate {
+		return candidate{
+			Ref:       types.ManagedObjectReference{Type: "VirtualMachine", Value: name},
+			Name:      name,
+			Host:      h,
+			Datastore: types.ManagedObjectReference{Type: "Datastore", Value: ds},
+			Bytes:     size * gib,
+		}
+	}
+
+	var cfg vcConfig
+	cfg.Migration.SourceUsedPercent = 85
+	cfg.Migration.TargetUsedPercent = 70
+
+	var tests = []struct {
+		testDesc     string
+		max          int
+		dss          []*datastore
+		vms          []candidate
+		want         []string
+		wantOverfull []usage
+	}{
+		{
+			"Test that the largest VM is moved to the least used datastore",
+			0,
+			[]*datastore{ds("full", 100, 90, host), ds("half", 100, 50, host), ds("empty", 100, 10, host)},
+			[]candidate{vm("small", "full", 2, host), vm("large", "full", 10, host)},
+			[]string{"large:full->empty"},
+			[]usage{{Datastore: "full", UsedPercent: 90, ProjectedPercent: 80}},
+		},
+		{
+			"Test that datastores not mounted by the host of the VM and beyond the target are not used",
+			0,
+			[]*datastore{ds("full", 100, 95, host), ds("unmounted", 100, 0, other), ds("tight", 100, 65, host)},
+			[]candidate{vm("large", "full", 10, host), vm("small", "full", 4, host), vm("tiny", "full", 1, host)},
+			[]string{"small:full->tight", "tiny:full->tight"},
+			[]usage{{Datastore: "full", UsedPercent: 95, ProjectedPercent: 90}},
+		},
+		{
+			"Test that the migrations are limited",
+			1,
+			[]*datastore{ds("fuller", 100, 99, host), ds("full", 100, 90, host), ds("empty", 1000, 0, host)},
+			[]candidate{vm("a", "full", 10, host), vm("b", "fuller", 5, host), vm("c", "fuller", 20, host)},
+			[]string{"c:fuller->empty"},
+			[]usage{{Datastore: "fuller", UsedPercent: 99, ProjectedPercent: 79}, {Datastore: "full", UsedPercent: 90, ProjectedPercent: 90}},
+		},
+		{
+			"Test that nothing is planned without overfull datastores",
+			0,
+			[]*datastore{ds("half", 100, 50, host), ds("empty", 100, 0, host)},
+			[]candidate{vm("a", "half", 10, host)},
+			nil,
+			[]usage{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg.Migration.MaxMigrations = tc.max
+
+		overfull, migrations := cfg.plan(tc.dss, tc.vms)
+
+		var got []string
+		for _, m := range migrations {
+			got = append(got, m.Name+":"+m.From+"->"+m.To)
+		}
+		if reflect.DeepEqual(got, tc.want) && reflect.DeepEqual(overfull, tc.wantOverfull) {
+			t.Logf("got expected: %v, %v. %v", got, overfull, passMark)
+		} else {
+			t.Logf("expected: %v, %v, got: %v, %v. %v", tc.want, tc.wantOverfull, got, overfull, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestMigrate shows powered off VMs of an overfull datastore are moved to
+// another datastore and powered on VMs stay.
+func TestMigrate(t *testing.T) {
+	const gib = int64(1) << 30
+
+	m := simulator.VPX()
+	m.Datastore = 2
+	defer m.Remove()
+
+	err := m.Run(func(ctx context.Context, c *vim25.Client) error {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		finder := find.NewFinder(c)
+		dc, err := finder.DefaultDatacenter(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		finder.SetDatacenter(dc)
+
+		full, err := finder.Datastore(ctx, "LocalDS_0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		empty, err := finder.Datastore(ctx, "LocalDS_1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// All VMs of the simulator are powered on and stored on LocalDS_0.
+		off, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		on, err := finder.VirtualMachine(ctx, "DC0_H0_VM1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		host, err := off.HostSystem(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// The simulator reports the space of the local file system and does
+		// not list the host of the VMs as mounting the datastores.
+		setUsage := func(ref types.ManagedObjectReference, capacity, used int64) {
+			ds := simulator.Map.Get(ref).(*simulator.Datastore)
+			ds.Summary.Capacity = capacity * gib
+			ds.Summary.FreeSpace = (capacity - used) * gib
+			ds.Host = append(ds.Host, types.DatastoreHostMount{Key: host.Reference()})
+		}
+		setUsage(full.Reference(), 100, 95)
+		setUsage(empty.Reference(), 100, 10)
+
+		task, err := off.PowerOff(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		for _, vm := range []types.ManagedObjectReference{off.Reference(), on.Reference()} {
+			simulator.Map.Get(vm).(*simulator.VirtualMachine).Summary.Storage = &types.VirtualMachineStorageSummary{Committed: 20 * gib}
+		}
+
+		var cfg vcConfig
+		rep := report{Trigger: cronTrigger}
+		if err := migrate(ctx, clt, &cfg, &rep); err != nil {
+			t.Fatal("migrate failed.", failMark, err)
+		}
+
+		t.Log("=========== Test that the powered off VM is moved to the empty datastore ===========")
+		if len(rep.Migrations) == 1 && rep.Migrations[0].VM == off.Reference().Value && rep.Migrations[0].Task != "" && rep.Migrations[0].To == "LocalDS_1" {
+			t.Logf("got expected: %+v. %v", rep.Migrations, passMark)
+		} else {
+			t.Logf("expected one migration of %v, got: %+v. %v", off.Reference().Value, rep.Migrations, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that the VM is stored on the empty datastore ===========")
+		var moved mo.VirtualMachine
+		if err := off.Properties(ctx, off.Reference(), []string{"datastore"}, &moved); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if len(moved.Datastore) == 1 && moved.Datastore[0] == empty.Reference() {
+			t.Logf("got expected: %v. %v", moved.Datastore, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", empty.Reference(), moved.Datastore, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that the overfull datastore is reported ===========")
+		want := []usage{{Datastore: "LocalDS_0", UsedPercent: 95, ProjectedPercent: 75}}
+		if reflect.DeepEqual(rep.Overfull, want) {
+			t.Logf("got expected: %+v. %v", rep.Overfull, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", want, rep.Overfull, failMark)
+			t.Fail()
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
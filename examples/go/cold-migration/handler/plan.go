@@ -0,0 +1,183 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// datastore is a datastore with its used space as planned.
+type datastore struct {
+	Ref      types.ManagedObjectReference
+	Name     string
+	Capacity int64
+	Used     int64
+	// Hosts mounting the datastore. VMs are only planned to datastores
+	// their host mounts, so they stay on their host.
+	Hosts map[types.ManagedObjectReference]bool
+}
+
+// percent returns the used space of d in percent after adding bytes.
+func (d *datastore) percent(adding int64) float64 {
+	if d.Capacity <= 0 {
+		return 100
+	}
+
+	return float64(d.Used+adding) / float64(d.Capacity) * 100
+}
+
+// candidate is a powered off VM stored on a single datastore.
+type candidate struct {
+	Ref       types.ManagedObjectReference
+	Name      string
+	Host      types.ManagedObjectReference
+	Datastore types.ManagedObjectReference
+	// Bytes is the committed storage, which moves with the VM.
+	Bytes int64
+}
+
+// usage is the used space of an overfull datastore before and after the
+// planned migrations.
+type usage struct {
+	Datastore        string  `json:"datastore"`
+	UsedPercent      float64 `json:"used_percent"`
+	ProjectedPercent float64 `json:"projected_percent"`
+}
+
+// migration is a planned cold migration of a VM.
+type migration struct {
+	VM    string `json:"vm"`
+	Name  string `json:"name"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Bytes int64  `json:"bytes"`
+	Task  string `json:"task,omitempty"`
+	// Skipped reports why a planned migration was not started.
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	vm types.ManagedObjectReference
+	to types.ManagedObjectReference
+}
+
+// plan returns the overfull datastores and the migrations which bring them
+// below source_used_percent. The datastores are planned from the fullest,
+// their VMs from the largest, each to the least used datastore mounted by
+// its host which stays at most target_used_percent used. Overfull
+// datastores never receive VMs. dss is updated to the planned usage.
+func (cfg *vcConfig) plan(dss []*datastore, vms []candidate) ([]usage, []migration) {
+	source, target := cfg.sourceUsedPercent(), cfg.targetUsedPercent()
+
+	var overfull, targets []*datastore
+	for _, d := range dss {
+		if d.percent(0) > source {
+			overfull = append(overfull, d)
+		} else {
+			targets = append(targets, d)
+		}
+	}
+	sort.SliceStable(overfull, func(i, j int) bool { return overfull[i].percent(0) > overfull[j].percent(0) })
+
+	byDatastore := map[types.ManagedObjectReference][]candidate{}
+	for _, vm := range vms {
+		byDatastore[vm.Datastore] = append(byDatastore[vm.Datastore], vm)
+	}
+
+	usages := make([]usage, 0, len(overfull))
+	var migrations []migration
+	for _, d := range overfull {
+		used := d.percent(0)
+
+		onDatastore := byDatastore[d.Ref]
+		sort.SliceStable(onDatastore, func(i, j int) bool { return onDatastore[i].Bytes > onDatastore[j].Bytes })
+
+		for _, vm := range onDatastore {
+			if d.percent(0) <= source || len(migrations) >= cfg.maxMigrations() {
+				break
+			}
+
+			to := receiver(targets, vm, target)
+			if to == nil {
+				continue
+			}
+
+			d.Used -= vm.Bytes
+			to.Used += vm.Bytes
+			migrations = append(migrations, migration{
+				VM:    vm.Ref.Value,
+				Name:  vm.Name,
+				From:  d.Name,
+				To:    to.Name,
+				Bytes: vm.Bytes,
+				vm:    vm.Ref,
+				to:    to.Ref,
+			})
+		}
+
+		usages = append(usages, usage{Datastore: d.Name, UsedPercent: round(used), ProjectedPercent: round(d.percent(0))})
+	}
+
+	return usages, migrations
+}
+
+// receiver returns the least used of targets which is mounted by the host of
+// vm and stays at most limit percent used with it, or nil.
+func receiver(targets []*datastore, vm candidate, limit float64) *datastore {
+	var best *datastore
+	for _, d := range targets {
+		if !d.Hosts[vm.Host] || d.percent(vm.Bytes) > limit {
+			continue
+		}
+		if best == nil || d.percent(vm.Bytes) < best.percent(vm.Bytes) {
+			best = d
+		}
+	}
+
+	return best
+}
+
+// round rounds a percentage to one decimal.
+func round(p float64) float64 {
+	return math.Round(p*10) / 10
+}
+
+// migrate plans the migrations of the overfull datastores and, unless
+// dry_run is set, starts them. The tasks are not waited for. Failed starts
+// are reported with the migration, their errors joined.
+func migrate(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	dss, err := clt.datastores(ctx, cfg.Migration.Datastores)
+	if err != nil {
+		return err
+	}
+
+	vms, err := clt.candidates(ctx)
+	if err != nil {
+		return err
+	}
+
+	rep.Overfull, rep.Migrations = cfg.plan(dss, vms)
+	if cfg.Migration.DryRun {
+		return nil
+	}
+
+	var errs []error
+	for i := range rep.Migrations {
+		m := &rep.Migrations[i]
+
+		task, err := clt.relocate(ctx, m.vm, m.to)
+		switch {
+		case errors.Is(err, errPoweredOn):
+			m.Skipped = err.Error()
+		case err != nil:
+			m.Error = err.Error()
+			errs = append(errs, err)
+		default:
+			m.Task = task
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package function
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Function images may lack the zoneinfo of the windows' timezone.
+	_ "time/tzdata"
+)
+
+// daily is the day of windows on every day of the week.
+const daily = "daily"
+
+// migrationWindow is a weekly or daily time of day migrations are started,
+// e.g. "saturday 22:00-06:00". Windows ending before they start end on the
+// next day.
+type migrationWindow struct {
+	daily bool
+	day   time.Weekday
+	start time.Duration // since midnight
+	end   time.Duration // since midnight
+}
+
+// parseWindow parses a window of the form "<day> <hh:mm>-<hh:mm>", where day
+// is a weekday, e.g. saturday, or daily.
+func parseWindow(s string) (migrationWindow, error) {
+	var w migrationWindow
+
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("migration window %q is not of the form <day> <hh:mm>-<hh:mm>", s)
+	}
+
+	if strings.EqualFold(fields[0], daily) {
+		w.daily = true
+	} else {
+		day, err := parseWeekday(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("migration window %q: %w", s, err)
+		}
+		w.day = day
+	}
+
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("migration window %q has no time range", s)
+	}
+
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("migration window %q: %w", s, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("migration window %q: %w", s, err)
+	}
+
+	if w.start == w.end {
+		return w, fmt.Errorf("migration window %q is empty", s)
+	}
+
+	return w, nil
+}
+
+// parseWeekday returns the weekday named s, e.g. "saturday".
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+// parseClock returns the time since midnight of a time of day, e.g. 22:00.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// on reports whether the window starts on day.
+func (w migrationWindow) on(day time.Weekday) bool {
+	return w.daily || w.day == day
+}
+
+// contains reports whether t, in the timezone of the window, is within it.
+func (w migrationWindow) contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.start < w.end {
+		return w.on(t.Weekday()) && clock >= w.start && clock < w.end
+	}
+
+	// The window wraps midnight, so its end is on the day after it started.
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.on(t.Weekday()) && clock >= w.start) || (w.on(yesterday) && clock < w.end)
+}
+
+// windows returns the parsed windows of the config.
+func (cfg *vcConfig) windows() ([]migrationWindow, error) {
+	if _, err := cfg.location(); err != nil {
+		return nil, err
+	}
+
+	windows := make([]migrationWindow, 0, len(cfg.Migration.Windows))
+	for _, s := range cfg.Migration.Windows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+// location returns the timezone of the windows.
+func (cfg *vcConfig) location() (*time.Location, error) {
+	if cfg.Migration.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(cfg.Migration.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown migration timezone %q: %w", cfg.Migration.Timezone, err)
+	}
+
+	return loc, nil
+}
+
+// inWindow reports whether migrations are started at now. Without windows,
+// they are started at any time.
+func (cfg *vcConfig) inWindow(now time.Time) bool {
+	// Windows and timezone are validated when loading the config.
+	windows, _ := cfg.windows()
+	if len(windows) == 0 {
+		return true
+	}
+
+	loc, _ := cfg.location()
+	now = now.In(loc)
+	for _, w := range windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,156 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// webhookTimeout limits the delivery of a notification.
+const webhookTimeout = 10 * time.Second
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// sourceIP returns the client address of the most recently active session of
+// user. Listing the sessions of other users requires the
+// Sessions.TerminateSession privilege.
+func (clt *vsClient) sourceIP(ctx context.Context, user string) (string, error) {
+	var sm mo.SessionManager
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	err := pc.RetrieveOne(ctx, *clt.govmomi.ServiceContent.SessionManager, []string{"sessionList"}, &sm)
+	if err != nil {
+		return "", fmt.Errorf("retrieve sessions failed: %w", err)
+	}
+
+	var latest *types.UserSession
+	for i := range sm.SessionList {
+		s := &sm.SessionList[i]
+		if !strings.EqualFold(s.UserName, user) {
+			continue
+		}
+		if latest == nil || s.LastActiveTime.After(latest.LastActiveTime) {
+			latest = s
+		}
+	}
+
+	if latest == nil {
+		return "", errors.New("no session found")
+	}
+
+	return latest.IpAddress, nil
+}
+
+// tag attaches the tag tagID to ref.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	m := tags.NewManager(clt.rest)
+
+	err := m.AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// notify posts rep as JSON to the webhook url.
+func notify(ctx context.Context, url string, rep *report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,386 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Access struct {
+		// Users allowed to open a console, e.g. "VSPHERE.LOCAL\\Administrator".
+		Users []string
+		// Networks in CIDR notation console access is allowed from. If empty,
+		// the source address is not checked.
+		Networks []string
+	}
+	Alert struct {
+		// WebhookURL receives a JSON report of unexpected console access.
+		WebhookURL string `toml:"webhook_url"`
+		// TagURN is attached to VMs with unexpected console access.
+		TagURN string `toml:"tag_urn"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string                      `json:"subject,omitempty"`
+	Data    types.VmAcquiredTicketEvent `json:"data,omitempty"`
+}
+
+// report describes a console access and the actions taken.
+type report struct {
+	VM       string    `json:"vm"`
+	VMName   string    `json:"vm_name"`
+	User     string    `json:"user"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	Ticket   string    `json:"ticket"`
+	Time     time.Time `json:"time"`
+	Expected bool      `json:"expected"`
+	Reason   string    `json:"reason,omitempty"`
+	Actions  []string  `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing console access event failed: %w", err)
+		slog.Debug("parsing console access event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	// The event does not carry the client address, the user's session does.
+	rep.SourceIP, err = clt.sourceIP(ctx, rep.User)
+	if err != nil {
+		slog.Debug("source address unknown", "user", rep.User, "err", err)
+	}
+
+	rep.Expected, rep.Reason = cfg.allowed(rep.User, rep.SourceIP)
+
+	var actionErr error
+	if !rep.Expected {
+		actionErr = alert(ctx, clt, cfg, rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("alerting failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// alert notifies and tags as configured. Completed actions are added to rep,
+// the joined errors of failed actions are returned.
+func alert(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	var errs []error
+
+	if cfg.Alert.WebhookURL != "" {
+		if err := notify(ctx, cfg.Alert.WebhookURL, rep); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	if cfg.Alert.TagURN != "" {
+		ref := rep.vmRef()
+		if err := clt.tag(ctx, ref, cfg.Alert.TagURN); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "tagged")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// allowed reports whether user may open a console from ip and the reason if
+// not. An unknown ip only passes if no networks are configured.
+func (cfg *vcConfig) allowed(user, ip string) (bool, string) {
+	known := false
+	for _, u := range cfg.Access.Users {
+		if strings.EqualFold(u, user) {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		return false, fmt.Sprintf("user %v is not allowed", user)
+	}
+
+	if len(cfg.Access.Networks) == 0 {
+		return true, ""
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, "source address unknown"
+	}
+
+	for _, n := range cfg.Access.Networks {
+		// Networks are validated when the config is loaded.
+		_, cidr, _ := net.ParseCIDR(n)
+		if cidr.Contains(addr) {
+			return true, ""
+		}
+	}
+
+	return false, fmt.Sprintf("source address %v is not allowed", ip)
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	for _, n := range cfg.Access.Networks {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return fmt.Errorf("invalid access network %q: %w", n, err)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns the report of a console ticket event.
+func parseEvent(req []byte) (*report, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty managed reference object")
+	}
+
+	if event.Data.UserName == "" {
+		return nil, errors.New("empty user name")
+	}
+
+	// VmAcquiredMksTicketEvent has no ticket type, it is always a MKS ticket.
+	ticket := event.Data.TicketType
+	if ticket == "" {
+		ticket = "mks"
+	}
+
+	return &report{
+		VM:     event.Data.Vm.Vm.Value,
+		VMName: event.Data.Vm.Name,
+		User:   event.Data.UserName,
+		Ticket: ticket,
+		Time:   event.Data.CreatedTime,
+	}, nil
+}
+
+// vmRef returns the reference of the accessed VM.
+func (r *report) vmRef() types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "VirtualMachine", Value: r.VM}
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
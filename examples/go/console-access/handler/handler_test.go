@@ -0,0 +1,358 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Access.Users = []string{`VSPHERE.LOCAL\Administrator`}
+	want.Access.Networks = []string{"10.0.0.0/24"}
+	want.Alert.WebhookURL = "https://hooks.local.corp/console"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml with invalid network results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures VM, user and ticket type are obtained from console
+// ticket events.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      [3]string // vm, user, ticket
+	}{
+		{
+			"Test that ticket event is readable",
+			"testdata/event.json",
+			false,
+			[3]string{"vm-42", `VSPHERE.LOCAL\jdoe`, "webmks"},
+		},
+		{
+			"Test that MKS ticket event defaults the ticket type",
+			"testdata/event2.json",
+			false,
+			[3]string{"vm-7", `VSPHERE.LOCAL\Administrator`, "mks"},
+		},
+		{
+			"Event should return error if VM is null",
+			"testdata/eventErr1.json",
+			true,
+			[3]string{},
+		},
+		{
+			"Event should return error if user is missing",
+			"testdata/eventErr2.json",
+			true,
+			[3]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		rep, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := [3]string{rep.VM, rep.User, rep.Ticket}
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestAllowed ensures console access is only expected for allowlisted users
+// from allowlisted networks.
+func TestAllowed(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	anyNet := *cfg
+	anyNet.Access.Networks = nil
+
+	var tests = []struct {
+		testDesc string
+		cfg      *vcConfig
+		user     string
+		ip       string
+		want     bool
+	}{
+		{"Test that allowlisted user and network is expected", cfg, `vsphere.local\administrator`, "10.0.0.15", true},
+		{"Test that unknown user is unexpected", cfg, `VSPHERE.LOCAL\jdoe`, "10.0.0.15", false},
+		{"Test that foreign network is unexpected", cfg, `VSPHERE.LOCAL\Administrator`, "192.168.1.5", false},
+		{"Test that unknown address is unexpected", cfg, `VSPHERE.LOCAL\Administrator`, "", false},
+		{"Test that address is ignored without networks", &anyNet, `VSPHERE.LOCAL\Administrator`, "", true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		ok, reason := tc.cfg.allowed(tc.user, tc.ip)
+		if ok == tc.want {
+			t.Logf("got expected: %v (%v). %v", ok, reason, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v (%v). %v", tc.want, ok, reason, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestNotify ensures the report is posted to the webhook and rejections are
+// returned as error.
+func TestNotify(t *testing.T) {
+	var got report
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	rep := &report{VM: "vm-42", User: `VSPHERE.LOCAL\jdoe`, Ticket: "webmks", Reason: "user is not allowed"}
+
+	t.Log("=========== Test that the report is posted ===========")
+	if err := notify(context.Background(), srv.URL, rep); err != nil || got.VM != rep.VM {
+		t.Fatalf("expected posted report for %v, got: %+v (%v). %v", rep.VM, got, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", got.VM, passMark)
+
+	t.Log("=========== Test that a rejected notification ends in error ===========")
+	status = http.StatusForbidden
+	if err := notify(context.Background(), srv.URL, rep); err == nil {
+		t.Fatalf("expected error. %v", failMark)
+	}
+	t.Logf("got an error, as expected. %v", passMark)
+}
+
+// TestSourceIP shows the client address of a user is taken from their
+// session, and users without session result in error.
+func TestSourceIP(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		var tests = []struct {
+			testDesc  string
+			user      string
+			expectErr bool
+			want      string
+		}{
+			{"Test that the address of the session of a user is returned", simulator.DefaultLogin.Username(), false, "127.0.0.1"},
+			{"Test that users are matched case insensitively", strings.ToUpper(simulator.DefaultLogin.Username()), false, "127.0.0.1"},
+			{"Test that a user without session results in error", `VSPHERE.LOCAL\jdoe`, true, ""},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			got, err := clt.sourceIP(ctx, tc.user)
+			if err != nil {
+				if tc.expectErr {
+					// An error is expected.
+					t.Logf("got an error, as expected: %v. %v", err, passMark)
+				} else {
+					t.Log(tc.testDesc, failMark, err)
+					t.Fail()
+				}
+				continue
+			}
+
+			if got == tc.want && !tc.expectErr {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestAlert shows unexpected console access is posted to the webhook and the
+// VM is tagged.
+func TestAlert(t *testing.T) {
+	var posted []report
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep report
+		json.NewDecoder(r.Body).Decode(&rep)
+		posted = append(posted, rep)
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "security", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "console-opened", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").Reference()
+		rep := &report{VM: vm.Value, User: `VSPHERE.LOCAL\jdoe`, Ticket: "webmks", Reason: "user is not allowed"}
+
+		var cfg vcConfig
+		cfg.Alert.WebhookURL = srv.URL
+		cfg.Alert.TagURN = tagID
+
+		t.Log("=========== Test that unexpected access is posted and the VM tagged ===========")
+		if err := alert(ctx, clt, &cfg, rep); err != nil {
+			t.Fatal(failMark, err)
+		}
+
+		attached, err := m.GetAttachedTags(ctx, vm)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got := strings.Join(rep.Actions, ",")
+		if got == "notified,tagged" && len(posted) == 1 && posted[0].VM == vm.Value && len(attached) == 1 && attached[0].ID == tagID {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: notified,tagged, got: %v, posted %v, attached %v. %v", got, posted, attached, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a failed tag ends in error after notifying ===========")
+		posted, rep.Actions = nil, nil
+		cfg.Alert.TagURN = "urn:vmomi:InventoryServiceTag:missing:GLOBAL"
+		err = alert(ctx, clt, &cfg, rep)
+		if got := strings.Join(rep.Actions, ","); err != nil && got == "notified" && len(posted) == 1 {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected error after notified, got: %v (%v). %v", got, err, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
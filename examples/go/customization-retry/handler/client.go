@@ -0,0 +1,291 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// webhookTimeout limits the delivery of a notification.
+const webhookTimeout = 10 * time.Second
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+// vmState is the state of a VM relevant to its customization.
+type vmState struct {
+	powerState types.VirtualMachinePowerState
+	// retried is set if the customization of the VM was retried.
+	retried bool
+	// guest holds the guest state reported by VMware Tools.
+	guest map[string]string
+	// hostName and ips are the host name and IP addresses of the guest.
+	hostName string
+	ips      []string
+	// annotation is the note of the VM, parent its folder.
+	annotation string
+	parent     *types.ManagedObjectReference
+	// guestinfo holds the guestinfo variables of the VM.
+	guestinfo map[string]string
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// state retrieves the customization state of a VM.
+func (clt *vsClient) state(ctx context.Context, ref types.ManagedObjectReference) (*vmState, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"config.extraConfig", "config.annotation", "guest", "parent", "runtime.powerState"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve state of %v failed: %w", ref.Value, err)
+	}
+
+	st := vmState{
+		powerState: vm.Runtime.PowerState,
+		guest:      map[string]string{},
+		guestinfo:  map[string]string{},
+		parent:     vm.Parent,
+	}
+
+	if g := vm.Guest; g != nil {
+		st.guest["guest.toolsRunningStatus"] = g.ToolsRunningStatus
+		st.guest["guest.toolsVersionStatus"] = g.ToolsVersionStatus2
+		st.guest["guest.guestState"] = g.GuestState
+		st.guest["guest.guestFullName"] = g.GuestFullName
+		st.hostName = g.HostName
+
+		for _, n := range g.Net {
+			st.ips = append(st.ips, n.IpAddress...)
+		}
+		if len(st.ips) == 0 && g.IpAddress != "" {
+			st.ips = []string{g.IpAddress}
+		}
+	}
+
+	if vm.Config != nil {
+		st.annotation = vm.Config.Annotation
+		for _, o := range vm.Config.ExtraConfig {
+			ov := o.GetOptionValue()
+			v := fmt.Sprint(ov.Value)
+
+			switch {
+			case ov.Key == retriedKey:
+				st.retried = v == "true"
+			case strings.HasPrefix(strings.ToLower(ov.Key), "guestinfo."):
+				st.guestinfo[ov.Key] = v
+			}
+		}
+	}
+
+	return &st, nil
+}
+
+// folderPath returns the inventory path of the folder ref below its
+// datacenter, e.g. /web/prod.
+func (clt *vsClient) folderPath(ctx context.Context, ref types.ManagedObjectReference) (string, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var names []string
+	for {
+		var e mo.ManagedEntity
+		err := pc.RetrieveOne(ctx, ref, []string{"name", "parent"}, &e)
+		if err != nil {
+			return "", fmt.Errorf("retrieve folder %v failed: %w", ref.Value, err)
+		}
+
+		// The VM folder of the datacenter is the root of the path.
+		if e.Parent == nil || e.Parent.Type != "Folder" {
+			break
+		}
+		names = append([]string{e.Name}, names...)
+		ref = *e.Parent
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// setRetried sets or clears the retry mark of a VM.
+func (clt *vsClient) setRetried(ctx context.Context, ref types.ManagedObjectReference, retried bool) error {
+	// An empty value removes the setting.
+	value := ""
+	if retried {
+		value = "true"
+	}
+
+	spec := types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: retriedKey, Value: value},
+		},
+	}
+
+	vm := object.NewVirtualMachine(clt.govmomi.Client, ref)
+	task, err := vm.Reconfigure(ctx, spec)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("update retry mark of %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// customize applies the customization spec name to a VM and powers it on to
+// run the customization. The VM is powered off first, as customization
+// requires it.
+func (clt *vsClient) customize(ctx context.Context, ref types.ManagedObjectReference, name string) error {
+	c := clt.govmomi.Client
+
+	item, err := object.NewCustomizationSpecManager(c).GetCustomizationSpec(ctx, name)
+	if err != nil {
+		return fmt.Errorf("get customization spec %q failed: %w", name, err)
+	}
+
+	st, err := clt.state(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	vm := object.NewVirtualMachine(c, ref)
+
+	if st.powerState != types.VirtualMachinePowerStatePoweredOff {
+		task, err := vm.PowerOff(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("power off %v failed: %w", ref.Value, err)
+		}
+	}
+
+	task, err := vm.Customize(ctx, item.Spec)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("customize %v failed: %w", ref.Value, err)
+	}
+
+	task, err = vm.PowerOn(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("power on %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// tag attaches an existing tag to a VM.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	m := tags.NewManager(clt.rest)
+
+	err := m.AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// notify posts rep as JSON to the webhook url.
+func notify(ctx context.Context, url string, rep *report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
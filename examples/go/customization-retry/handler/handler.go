@@ -0,0 +1,559 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// retriedKey is the advanced setting which marks a VM whose customization was
+// retried. It is not a guestinfo variable, so it is not visible in the guest.
+const retriedKey = "veba.customization.retried"
+
+// maxDiagnosticValue truncates guestinfo values in the report.
+const maxDiagnosticValue = 256
+
+// Outcomes of a customization event.
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeRetried   = "retried"
+	outcomeAborted   = "aborted"
+)
+
+// VM fields of the report, see vcConfig.Report.
+const (
+	fieldName       = "name"
+	fieldGuest      = "guest"
+	fieldHostname   = "hostname"
+	fieldIPs        = "ips"
+	fieldFolder     = "folder"
+	fieldAnnotation = "annotation"
+)
+
+// vmFields are the known VM fields of the report.
+var vmFields = map[string]bool{
+	fieldName:       true,
+	fieldGuest:      true,
+	fieldHostname:   true,
+	fieldIPs:        true,
+	fieldFolder:     true,
+	fieldAnnotation: true,
+}
+
+// failureEvents are the customization events of a failed customization.
+var failureEvents = map[string]bool{
+	"CustomizationFailed":              true,
+	"CustomizationSysprepFailed":       true,
+	"CustomizationLinuxIdentityFailed": true,
+	"CustomizationNetworkSetupFailed":  true,
+	"CustomizationUnknownFailure":      true,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Customization struct {
+		// Spec is the name of the customization specification applied on
+		// retry. Without it, failed customizations are not retried.
+		Spec string
+		// RetryDelaySeconds is waited before the retry.
+		RetryDelaySeconds int `toml:"retry_delay_seconds"`
+		// GuestinfoExclude lists guestinfo variables left out of the
+		// diagnostics, e.g. because they hold secrets.
+		GuestinfoExclude []string `toml:"guestinfo_exclude"`
+	}
+	Alert struct {
+		// WebhookURL receives a JSON report of aborted customizations.
+		WebhookURL string `toml:"webhook_url"`
+		// TagURN is attached to VMs whose customization aborted.
+		TagURN string `toml:"tag_urn"`
+	}
+	Report struct {
+		// VMFields are the VM fields included in the report, which is
+		// the response and the alert: name, guest, hostname, ips, folder
+		// and annotation. Defaults to name and guest, the others may
+		// identify people, networks or systems and must be opted in.
+		VMFields []string `toml:"vm_fields"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string                   `json:"subject,omitempty"`
+	Data    types.CustomizationEvent `json:"data,omitempty"`
+}
+
+// report describes a customization event and the actions taken.
+type report struct {
+	VM          string            `json:"vm"`
+	VMName      string            `json:"vm_name,omitempty"`
+	Folder      string            `json:"folder,omitempty"`
+	Annotation  string            `json:"annotation,omitempty"`
+	IPs         []string          `json:"ips,omitempty"`
+	Event       string            `json:"event"`
+	LogLocation string            `json:"log_location,omitempty"`
+	Time        time.Time         `json:"time"`
+	Outcome     string            `json:"outcome"`
+	Reason      string            `json:"reason,omitempty"`
+	Diagnostics map[string]string `json:"diagnostics,omitempty"`
+	Actions     []string          `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing customization event failed: %w", err)
+		slog.Debug("parsing customization event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	if !cfg.includes(fieldName) {
+		rep.VMName = ""
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	var actionErr error
+	if failureEvents[rep.Event] {
+		actionErr = retry(ctx, clt, cfg, rep)
+	} else {
+		actionErr = succeeded(ctx, clt, cfg, rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("handling customization failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// retry gathers the diagnostics of a failed customization and retries it
+// once. If the customization was retried before, cannot be retried or the retry
+// fails, the customization is aborted. Completed actions are added to rep, the
+// joined errors of failed actions are returned.
+func retry(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	var errs []error
+
+	st, err := clt.state(ctx, rep.vmRef())
+	if err != nil {
+		return err
+	}
+	rep.Diagnostics = diagnostics(st, cfg)
+	if err := addVMFields(ctx, clt, cfg, rep, st); err != nil {
+		return err
+	}
+
+	switch {
+	case st.retried:
+		rep.Reason = "customization failed again after retry"
+	case cfg.Customization.Spec == "":
+		rep.Reason = "no customization spec configured for retry"
+	default:
+		// Mark the VM first, so a failure of the retry is not retried again.
+		if err := clt.setRetried(ctx, rep.vmRef(), true); err != nil {
+			return err
+		}
+		st.retried = true
+
+		slog.Debug("retry customization", "vm", rep.VM, "delay", cfg.retryDelay())
+
+		select {
+		case <-time.After(cfg.retryDelay()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := clt.customize(ctx, rep.vmRef(), cfg.Customization.Spec)
+		if err == nil {
+			rep.Outcome = outcomeRetried
+			rep.Actions = append(rep.Actions, "retried")
+			return nil
+		}
+		rep.Reason = fmt.Sprintf("retry failed: %v", err)
+	}
+
+	rep.Outcome = outcomeAborted
+
+	// Clear the mark, so a later customization of the VM is retried again.
+	if st.retried {
+		if err := clt.setRetried(ctx, rep.vmRef(), false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.Alert.TagURN != "" {
+		if err := clt.tag(ctx, rep.vmRef(), cfg.Alert.TagURN); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "tagged")
+		}
+	}
+
+	if cfg.Alert.WebhookURL != "" {
+		if err := notify(ctx, cfg.Alert.WebhookURL, rep); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// succeeded clears the retry mark of a customized VM.
+func succeeded(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	rep.Outcome = outcomeSucceeded
+
+	st, err := clt.state(ctx, rep.vmRef())
+	if err != nil {
+		return err
+	}
+	if err := addVMFields(ctx, clt, cfg, rep, st); err != nil {
+		return err
+	}
+
+	if !st.retried {
+		return nil
+	}
+
+	if err := clt.setRetried(ctx, rep.vmRef(), false); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "cleared retry mark")
+
+	return nil
+}
+
+// diagnostics returns the guest state and guestinfo variables of st, without
+// the excluded variables. The guest state and host name are only returned if
+// their VM fields are included. Long values are truncated.
+func diagnostics(st *vmState, cfg *vcConfig) map[string]string {
+	exclude := cfg.Customization.GuestinfoExclude
+	skip := make(map[string]bool, len(exclude))
+	for _, k := range exclude {
+		skip[strings.ToLower(k)] = true
+	}
+
+	d := map[string]string{}
+	if cfg.includes(fieldGuest) {
+		for k, v := range st.guest {
+			d[k] = v
+		}
+	}
+	if cfg.includes(fieldHostname) && st.hostName != "" {
+		d["guest.hostName"] = st.hostName
+	}
+
+	for k, v := range st.guestinfo {
+		if skip[strings.ToLower(k)] {
+			continue
+		}
+
+		if len(v) > maxDiagnosticValue {
+			v = v[:maxDiagnosticValue] + "..."
+		}
+		d[k] = v
+	}
+
+	return d
+}
+
+// addVMFields adds the included VM fields of st to rep. The folder is only
+// looked up if included.
+func addVMFields(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, st *vmState) error {
+	if cfg.includes(fieldIPs) {
+		rep.IPs = st.ips
+	}
+	if cfg.includes(fieldAnnotation) {
+		rep.Annotation = st.annotation
+	}
+
+	if cfg.includes(fieldFolder) && st.parent != nil {
+		folder, err := clt.folderPath(ctx, *st.parent)
+		if err != nil {
+			return err
+		}
+		rep.Folder = folder
+	}
+
+	return nil
+}
+
+// includes reports whether the VM field is included in the report.
+func (cfg *vcConfig) includes(field string) bool {
+	for _, f := range cfg.Report.VMFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDelay returns the delay before a retry.
+func (cfg *vcConfig) retryDelay() time.Duration {
+	return time.Duration(cfg.Customization.RetryDelaySeconds) * time.Second
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	// cloud-init passes its data as guestinfo variables, which may hold
+	// secrets.
+	if cfg.Customization.GuestinfoExclude == nil {
+		cfg.Customization.GuestinfoExclude = []string{
+			"guestinfo.metadata",
+			"guestinfo.userdata",
+			"guestinfo.vendordata",
+		}
+	}
+
+	if cfg.Report.VMFields == nil {
+		cfg.Report.VMFields = []string{fieldName, fieldGuest}
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Customization.RetryDelaySeconds < 0 {
+		return errors.New("customization retry_delay_seconds must not be negative")
+	}
+
+	for _, f := range cfg.Report.VMFields {
+		if !vmFields[f] {
+			return fmt.Errorf("unknown report vm_fields entry %q", f)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns the report of a customization event.
+func parseEvent(req []byte) (*report, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !failureEvents[event.Subject] && event.Subject != "CustomizationSucceeded" {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty managed reference object")
+	}
+
+	return &report{
+		VM:          event.Data.Vm.Vm.Value,
+		VMName:      event.Data.Vm.Name,
+		Event:       event.Subject,
+		LogLocation: event.Data.LogLocation,
+		Time:        event.Data.CreatedTime,
+	}, nil
+}
+
+// vmRef returns the reference of the customized VM.
+func (r *report) vmRef() types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "VirtualMachine", Value: r.VM}
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,340 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Customization.Spec = "linux-default"
+	want.Customization.RetryDelaySeconds = 60
+	want.Customization.GuestinfoExclude = []string{
+		"guestinfo.metadata",
+		"guestinfo.userdata",
+		"guestinfo.vendordata",
+	}
+	want.Alert.WebhookURL = "https://hooks.local.corp/customization"
+	want.Report.VMFields = []string{"name", "guest"}
+
+	want2 := want
+	want2.Alert.WebhookURL = ""
+	want2.Report.VMFields = []string{"name", "ips", "folder"}
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly and cloud-init data is excluded by default",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that configured VM fields replace the default",
+			"testdata/vcconfig2.toml",
+			false,
+			&want2,
+		},
+		{
+			"Test that vcconfig.toml with negative retry delay results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an unknown VM field results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures customization events are read and other events are
+// rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      [3]string // vm, event, log location
+	}{
+		{
+			"Test that customization failure is readable",
+			"testdata/event.json",
+			false,
+			[3]string{"vm-88", "CustomizationLinuxIdentityFailed", "/var/log/vmware-imc/toolsDeployPkg.log"},
+		},
+		{
+			"Test that customization success is readable",
+			"testdata/event2.json",
+			false,
+			[3]string{"vm-88", "CustomizationSucceeded", `C:\Windows\TEMP\vmware-imc\guestcust.log`},
+		},
+		{
+			"Event should return error if VM is null",
+			"testdata/eventErr1.json",
+			true,
+			[3]string{},
+		},
+		{
+			"Event should return error if it is no customization event",
+			"testdata/eventErr2.json",
+			true,
+			[3]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		rep, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := [3]string{rep.VM, rep.Event, rep.LogLocation}
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestDiagnostics ensures excluded guestinfo variables are left out, long
+// values are truncated and the guest state and host name are only reported if
+// their VM fields are included.
+func TestDiagnostics(t *testing.T) {
+	st := &vmState{
+		guest:    map[string]string{"guest.toolsRunningStatus": "guestToolsRunning"},
+		hostName: "web-07.local.corp",
+		guestinfo: map[string]string{
+			"guestinfo.ovfEnv":    strings.Repeat("x", maxDiagnosticValue+10),
+			"guestinfo.userdata":  "I2Nsb3VkLWNvbmZpZwo=",
+			"guestinfo.gc.status": "Failed",
+		},
+	}
+
+	var tests = []struct {
+		testDesc string
+		fields   []string
+		want     map[string]string
+	}{
+		{
+			"Test that excluded variables are left out and long values truncated",
+			[]string{"name", "guest"},
+			map[string]string{
+				"guest.toolsRunningStatus": "guestToolsRunning",
+				"guestinfo.ovfEnv":         strings.Repeat("x", maxDiagnosticValue) + "...",
+				"guestinfo.gc.status":      "Failed",
+			},
+		},
+		{
+			"Test that the host name is reported if included",
+			[]string{"hostname"},
+			map[string]string{
+				"guest.hostName":      "web-07.local.corp",
+				"guestinfo.ovfEnv":    strings.Repeat("x", maxDiagnosticValue) + "...",
+				"guestinfo.gc.status": "Failed",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		var cfg vcConfig
+		cfg.Customization.GuestinfoExclude = []string{"GuestInfo.UserData"}
+		cfg.Report.VMFields = tc.fields
+
+		got := diagnostics(st, &cfg)
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected diagnostics. %v", passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestAddVMFields ensures only the included VM fields are added to the report.
+func TestAddVMFields(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		finder := find.NewFinder(c)
+		dc, err := finder.DefaultDatacenter(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		finder.SetDatacenter(dc)
+		folders, err := dc.Folders(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		web, err := folders.VmFolder.CreateFolder(ctx, "web")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		prod, err := web.CreateFolder(ctx, "prod")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := prod.MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		st, err := clt.state(ctx, vm.Reference())
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		st.ips = []string{"10.0.0.7"}
+		st.annotation = "owner: jane@example.com"
+
+		var tests = []struct {
+			testDesc string
+			fields   []string
+			want     report
+		}{
+			{
+				"Test that IPs, folder and annotation are left out by default",
+				[]string{"name", "guest"},
+				report{},
+			},
+			{
+				"Test that included fields are added",
+				[]string{"ips", "folder", "annotation"},
+				report{IPs: []string{"10.0.0.7"}, Folder: "/web/prod", Annotation: "owner: jane@example.com"},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			var cfg vcConfig
+			cfg.Report.VMFields = tc.fields
+
+			var got report
+			err := addVMFields(ctx, clt, &cfg, &got, st)
+			if err == nil && reflect.DeepEqual(got, tc.want) {
+				t.Logf("got expected: %+v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %+v, got: %+v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// webhookTimeout limits the delivery of a notification.
+const webhookTimeout = 10 * time.Second
+
+// errNoCloneTask is returned by cancel if the clone task of an event is not
+// running (anymore).
+var errNoCloneTask = errors.New("no running clone task found")
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// evaluate returns the overcommit of the destination datastore after prov. If
+// the event does not name the destination, the first datastore of the source
+// is assumed.
+func (clt *vsClient) evaluate(ctx context.Context, prov *provisioning) (*report, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var src mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, prov.Source, []string{"name", "datastore", "summary.storage"}, &src)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve source %v failed: %w", prov.Source.Value, err)
+	}
+
+	dsRef := prov.Datastore
+	if dsRef == nil {
+		if len(src.Datastore) == 0 {
+			return nil, fmt.Errorf("destination datastore of %v unknown", src.Name)
+		}
+		dsRef = &src.Datastore[0]
+	}
+
+	var ds mo.Datastore
+	err = pc.RetrieveOne(ctx, *dsRef, []string{"summary"}, &ds)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve datastore %v failed: %w", dsRef.Value, err)
+	}
+
+	// The copy is provisioned as large as the source.
+	var adding int64
+	if s := src.Summary.Storage; s != nil {
+		adding = s.Committed + s.Uncommitted
+	}
+
+	sum := ds.Summary
+	return &report{
+		Source:      src.Name,
+		Destination: prov.DestName,
+		Datastore:   sum.Name,
+		Capacity:    sum.Capacity,
+		Provisioned: sum.Capacity - sum.FreeSpace + sum.Uncommitted,
+		Adding:      adding,
+		Ratio:       overcommitRatio(sum, adding),
+	}, nil
+}
+
+// cancel cancels the running clone task of prov. Deployments from templates
+// are clone tasks of the template. Other clones of the same source, e.g. from
+// further deployments of the template, are left running: only the task of the
+// event chain of prov is cancelled.
+func (clt *vsClient) cancel(ctx context.Context, prov *provisioning) error {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var entity mo.ManagedEntity
+	err := pc.RetrieveOne(ctx, prov.Source, []string{"recentTask"}, &entity)
+	if err != nil {
+		return fmt.Errorf("retrieve tasks of %v failed: %w", prov.Source.Value, err)
+	}
+
+	if len(entity.RecentTask) == 0 {
+		return errNoCloneTask
+	}
+
+	var tasks []mo.Task
+	err = pc.Retrieve(ctx, entity.RecentTask, []string{"info"}, &tasks)
+	if err != nil {
+		return fmt.Errorf("retrieve task info failed: %w", err)
+	}
+
+	for _, t := range tasks {
+		if t.Info.DescriptionId != "VirtualMachine.clone" || t.Info.EventChainId != prov.ChainID {
+			continue
+		}
+		if t.Info.State != types.TaskInfoStateQueued && t.Info.State != types.TaskInfoStateRunning {
+			continue
+		}
+
+		err = object.NewTask(clt.govmomi.Client, t.Self).Cancel(ctx)
+		if err != nil {
+			return fmt.Errorf("cancel task %v failed: %w", t.Self.Value, err)
+		}
+
+		return nil
+	}
+
+	return errNoCloneTask
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	err := clt.govmomi.Logout(ctx)
+	if err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
+
+// notify posts rep as JSON to the webhook url.
+func notify(ctx context.Context, url string, rep *report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
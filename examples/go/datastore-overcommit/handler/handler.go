@@ -0,0 +1,409 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Actions on provisioning exceeding the overcommit threshold.
+const (
+	actionNotify = "notify"
+	actionCancel = "cancel"
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Overcommit struct {
+		// MaxRatio is the highest tolerated ratio of provisioned space to
+		// capacity of a datastore after provisioning, e.g. 1.5.
+		MaxRatio float64 `toml:"max_ratio"`
+		// Action is notify or cancel. Cancel also notifies.
+		Action string
+		// WebhookURL receives a JSON report when the threshold is exceeded.
+		WebhookURL string `toml:"webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string        `json:"subject,omitempty"`
+	Data    incomingEvent `json:"data,omitempty"`
+}
+
+// incomingEvent covers VmBeingDeployedEvent and VmBeingClonedEvent.
+type incomingEvent struct {
+	types.VmEvent
+	SrcTemplate *types.VmEventArgument
+	DestName    string
+}
+
+// provisioning is a deployment or clone in progress.
+type provisioning struct {
+	// Source is the template or VM being copied.
+	Source     types.ManagedObjectReference
+	SourceName string
+	// Datastore is the destination datastore, if the event names it.
+	Datastore *types.ManagedObjectReference
+	DestName  string
+	// ChainID is the event chain of the event, which is the event chain of
+	// its clone task too.
+	ChainID int32
+}
+
+// report describes the datastore before and after provisioning.
+type report struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination,omitempty"`
+	Datastore   string   `json:"datastore"`
+	Capacity    int64    `json:"capacity_bytes"`
+	Provisioned int64    `json:"provisioned_bytes"`
+	Adding      int64    `json:"adding_bytes"`
+	Ratio       float64  `json:"ratio"`
+	MaxRatio    float64  `json:"max_ratio"`
+	Exceeded    bool     `json:"exceeded"`
+	Actions     []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	prov, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing provisioning event failed: %w", err)
+		slog.Debug("parsing provisioning event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep, err := clt.evaluate(ctx, prov)
+	if err != nil {
+		wrapErr := fmt.Errorf("evaluating datastore overcommit failed: %w", err)
+		slog.Debug("evaluating datastore overcommit failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep.MaxRatio = cfg.Overcommit.MaxRatio
+	rep.Exceeded = rep.Ratio > rep.MaxRatio
+
+	var actionErr error
+	if rep.Exceeded {
+		actionErr = guard(ctx, clt, cfg, prov, rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("overcommit guard failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// guard cancels and notifies as configured. Completed actions are added to
+// rep, the joined errors of failed actions are returned.
+func guard(ctx context.Context, clt *vsClient, cfg *vcConfig, prov *provisioning, rep *report) error {
+	var errs []error
+
+	if cfg.Overcommit.Action == actionCancel {
+		if err := clt.cancel(ctx, prov); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "cancelled")
+		}
+	}
+
+	if cfg.Overcommit.WebhookURL != "" {
+		if err := notify(ctx, cfg.Overcommit.WebhookURL, rep); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// overcommitRatio returns the ratio of provisioned space to capacity of a
+// datastore after adding bytes. Provisioned space is the used space plus the
+// space thin provisioned disks may still grow by.
+func overcommitRatio(ds types.DatastoreSummary, adding int64) float64 {
+	if ds.Capacity <= 0 {
+		return 0
+	}
+
+	provisioned := ds.Capacity - ds.FreeSpace + ds.Uncommitted + adding
+
+	return float64(provisioned) / float64(ds.Capacity)
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	if cfg.Overcommit.Action == "" {
+		cfg.Overcommit.Action = actionNotify
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Overcommit.MaxRatio <= 0 {
+		return errors.New("overcommit max_ratio must be greater than 0")
+	}
+
+	switch cfg.Overcommit.Action {
+	case actionNotify, actionCancel:
+	default:
+		return fmt.Errorf("unsupported overcommit action %q", cfg.Overcommit.Action)
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns the provisioning described by a VmBeingDeployedEvent or
+// VmBeingClonedEvent. The source is the template of deployments and the VM of
+// clones.
+func parseEvent(req []byte) (*provisioning, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	var src *types.VmEventArgument
+	switch event.Subject {
+	case "VmBeingDeployedEvent":
+		src = event.Data.SrcTemplate
+	case "VmBeingClonedEvent":
+		src = event.Data.Vm
+	default:
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if src == nil || src.Vm.Value == "" {
+		return nil, errors.New("empty managed reference object")
+	}
+
+	prov := provisioning{
+		Source:     src.Vm,
+		SourceName: src.Name,
+		DestName:   event.Data.DestName,
+		ChainID:    event.Data.ChainId,
+	}
+
+	// The first event of a chain starts it.
+	if prov.ChainID == 0 {
+		prov.ChainID = event.Data.Key
+	}
+
+	if event.Data.Ds != nil && event.Data.Ds.Datastore.Value != "" {
+		prov.Datastore = &event.Data.Ds.Datastore
+	}
+
+	if event.Subject == "VmBeingDeployedEvent" && event.Data.Vm != nil {
+		prov.DestName = event.Data.Vm.Name
+	}
+
+	return &prov, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
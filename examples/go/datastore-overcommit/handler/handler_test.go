@@ -0,0 +1,281 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Overcommit.MaxRatio = 1.5
+	want.Overcommit.Action = actionNotify
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly and action defaults to notify",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml with unsupported action results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the source and destination of deployments and clones
+// are obtained from the event.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      [3]string // source, datastore, destination name
+	}{
+		{
+			"Test that the template is the source of deployments",
+			"testdata/event.json",
+			false,
+			[3]string{"vm-31", "datastore-12", "web-07"},
+		},
+		{
+			"Test that the VM is the source of clones",
+			"testdata/event2.json",
+			false,
+			[3]string{"vm-42", "", "db-01-copy"},
+		},
+		{
+			"Event should return error if the template is missing",
+			"testdata/eventErr1.json",
+			true,
+			[3]string{},
+		},
+		{
+			"Event should return error for unsupported events",
+			"testdata/eventErr2.json",
+			true,
+			[3]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		prov, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := [3]string{prov.Source.Value, "", prov.DestName}
+		if prov.Datastore != nil {
+			got[1] = prov.Datastore.Value
+		}
+
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestOvercommitRatio ensures thin provisioned space and the copy are counted.
+func TestOvercommitRatio(t *testing.T) {
+	const gb = 1 << 30
+
+	var tests = []struct {
+		testDesc string
+		ds       types.DatastoreSummary
+		adding   int64
+		want     float64
+	}{
+		{
+			"Test that used space of thick disks is counted",
+			types.DatastoreSummary{Capacity: 100 * gb, FreeSpace: 60 * gb},
+			20 * gb,
+			0.6,
+		},
+		{
+			"Test that uncommitted thin space is counted",
+			types.DatastoreSummary{Capacity: 100 * gb, FreeSpace: 60 * gb, Uncommitted: 90 * gb},
+			30 * gb,
+			1.6,
+		},
+		{
+			"Test that a datastore without capacity has no ratio",
+			types.DatastoreSummary{},
+			30 * gb,
+			0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := overcommitRatio(tc.ds, tc.adding)
+		if math.Abs(got-tc.want) < 1e-9 {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
+
+// cloneTask is a clone task for the simulator, which has no cancellable
+// tasks.
+type cloneTask struct {
+	mo.Task
+	cancelled bool
+}
+
+func (t *cloneTask) CancelTask(req *types.CancelTask) soap.HasFault {
+	t.cancelled = true
+	t.Info.State = types.TaskInfoStateError
+
+	return &methods.CancelTaskBody{Res: &types.CancelTaskResponse{}}
+}
+
+// TestCancel shows only the clone task of the event chain is cancelled, so
+// other clones of the same template keep running.
+func TestCancel(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		// Clones of other deployments of the template run alongside.
+		var tasks []*cloneTask
+		for i, chain := range []int32{9100, 9118, 9130} {
+			task := &cloneTask{}
+			task.Self = types.ManagedObjectReference{Type: "Task", Value: fmt.Sprintf("task-%d", i)}
+			task.Info.Key = task.Self.Value
+			task.Info.Task = task.Self
+			task.Info.DescriptionId = "VirtualMachine.clone"
+			task.Info.State = types.TaskInfoStateRunning
+			task.Info.EventChainId = chain
+			simulator.Map.Put(task)
+
+			tasks = append(tasks, task)
+			vm.RecentTask = append(vm.RecentTask, task.Self)
+		}
+
+		var tests = []struct {
+			testDesc  string
+			chainID   int32
+			want      []bool // cancelled tasks
+			expectErr bool
+		}{
+			{"Test that the clone task of the event chain is cancelled", 9118, []bool{false, true, false}, false},
+			{"Test that a cancelled clone task is not cancelled again", 9118, []bool{false, true, false}, true},
+			{"Test that no task is cancelled without clone task of the event chain", 9200, []bool{false, true, false}, true},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			err := clt.cancel(ctx, &provisioning{Source: vm.Self, ChainID: tc.chainID})
+
+			got := make([]bool, len(tasks))
+			for i, task := range tasks {
+				got[i] = task.cancelled
+			}
+
+			if reflect.DeepEqual(got, tc.want) && (err != nil) == tc.expectErr {
+				t.Logf("got expected: %v (%v). %v", got, err, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// webhookTimeout limits the delivery of a notification.
+const webhookTimeout = 10 * time.Second
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// inventory retrieves the VMs with files on the datastore ref, the hosts
+// mounting it and the HA configuration of their clusters.
+func (clt *vsClient) inventory(ctx context.Context, ref types.ManagedObjectReference) (*inventory, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var ds mo.Datastore
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "vm", "host"}, &ds)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve datastore %v failed: %w", ref.Value, err)
+	}
+
+	inv := inventory{Name: ds.Name}
+
+	if len(ds.Vm) > 0 {
+		var vms []mo.VirtualMachine
+		err = pc.Retrieve(ctx, ds.Vm, []string{"name", "runtime.powerState", "config.template"}, &vms)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve VMs of datastore %v failed: %w", ds.Name, err)
+		}
+
+		for _, vm := range vms {
+			info := vmInfo{
+				Ref:       vm.Reference(),
+				Name:      vm.Name,
+				PoweredOn: vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+			}
+			if vm.Config != nil {
+				info.Template = vm.Config.Template
+			}
+			inv.VMs = append(inv.VMs, info)
+		}
+	}
+
+	// Unmounted hosts do not block the maintenance.
+	var hostRefs []types.ManagedObjectReference
+	for _, m := range ds.Host {
+		if m.MountInfo.Mounted == nil || *m.MountInfo.Mounted {
+			hostRefs = append(hostRefs, m.Key)
+		}
+	}
+	if len(hostRefs) == 0 {
+		return &inv, nil
+	}
+
+	var hosts []mo.HostSystem
+	err = pc.Retrieve(ctx, hostRefs, []string{"name", "parent"}, &hosts)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve hosts of datastore %v failed: %w", ds.Name, err)
+	}
+
+	seen := map[types.ManagedObjectReference]bool{}
+	var clusterRefs []types.ManagedObjectReference
+	for _, h := range hosts {
+		inv.Hosts = append(inv.Hosts, h.Name)
+
+		if p := h.Parent; p != nil && p.Type == "ClusterComputeResource" && !seen[*p] {
+			seen[*p] = true
+			clusterRefs = append(clusterRefs, *p)
+		}
+	}
+	sort.Strings(inv.Hosts)
+
+	if len(clusterRefs) == 0 {
+		return &inv, nil
+	}
+
+	var clusters []mo.ClusterComputeResource
+	err = pc.Retrieve(ctx, clusterRefs, []string{"name", "configurationEx"}, &clusters)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve clusters of datastore %v failed: %w", ds.Name, err)
+	}
+
+	for _, c := range clusters {
+		info := clusterInfo{Ref: c.Reference(), Name: c.Name}
+
+		if cfg, ok := c.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+			das := cfg.DasConfig
+			info.HAEnabled = das.Enabled != nil && *das.Enabled
+			info.Policy = das.HBDatastoreCandidatePolicy
+			for _, hb := range das.HeartbeatDatastore {
+				if hb == ref {
+					info.Heartbeat = true
+				}
+			}
+		}
+
+		inv.Clusters = append(inv.Clusters, info)
+	}
+
+	return &inv, nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	err := clt.govmomi.Logout(ctx)
+	if err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
+
+// notify posts rep as JSON to the webhook url.
+func notify(ctx context.Context, url string, rep *report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,410 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// subjectTask is the subject of task events. Datastore maintenance and
+// unmounts are announced by the TaskEvent of their task.
+const subjectTask = "TaskEvent"
+
+// defaultTasks are the tasks checked without [precheck] tasks.
+var defaultTasks = []string{"Datastore.enterMaintenanceMode"}
+
+// Decisions of the report.
+const (
+	decisionGo   = "go"
+	decisionNoGo = "no-go"
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Precheck struct {
+		// Tasks are the description ids of the tasks announcing the
+		// maintenance or unmount of a datastore, e.g.
+		// Datastore.enterMaintenanceMode. Defaults to defaultTasks.
+		Tasks []string
+		// Warnings are the kinds of blockers reported as warnings, which
+		// do not make the report no-go. Defaults to ha-config.
+		Warnings []string
+	}
+	Notify struct {
+		// WebhookURL receives the JSON report of no-go datastores.
+		WebhookURL string `toml:"webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Key         int32     `json:"Key"`
+		CreatedTime time.Time `json:"CreatedTime"`
+		UserName    string    `json:"UserName"`
+		Info        *struct {
+			DescriptionId string                        `json:"DescriptionId"`
+			Entity        *types.ManagedObjectReference `json:"Entity,omitempty"`
+			EntityName    string                        `json:"EntityName"`
+		} `json:"Info,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// task returns the description id of the task of the event.
+func (event *incoming) task() string {
+	if event.Data.Info == nil {
+		return ""
+	}
+
+	return event.Data.Info.DescriptionId
+}
+
+// datastore returns the datastore the task runs on, nil if the task runs on
+// another entity.
+func (event *incoming) datastore() *types.ManagedObjectReference {
+	if info := event.Data.Info; info != nil && info.Entity != nil && info.Entity.Type == "Datastore" {
+		return info.Entity
+	}
+
+	return nil
+}
+
+// report is the go/no-go decision of a datastore maintenance or unmount with
+// its blockers.
+type report struct {
+	Event     string `json:"event"`
+	Task      string `json:"task,omitempty"`
+	Datastore string `json:"datastore,omitempty"`
+	Name      string `json:"name,omitempty"`
+	User      string `json:"user,omitempty"`
+	Decision  string `json:"decision,omitempty"`
+	// Hosts are the hosts mounting the datastore.
+	Hosts    []string  `json:"hosts,omitempty"`
+	Blockers []finding `json:"blockers,omitempty"`
+	Warnings []finding `json:"warnings,omitempty"`
+	Skipped  string    `json:"skipped,omitempty"`
+	Actions  []string  `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	rep := report{Event: event.Subject, Task: event.task(), User: event.Data.UserName}
+
+	// Other tasks are skipped before connecting.
+	ref := event.datastore()
+	switch {
+	case !cfg.checks(event.task()):
+		rep.Skipped = "not a datastore maintenance task"
+		return reportResponse(&rep, nil)
+	case ref == nil:
+		rep.Skipped = "task does not run on a datastore"
+		return reportResponse(&rep, nil)
+	}
+	rep.Datastore = ref.Value
+	rep.Name = event.Data.Info.EntityName
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	return reportResponse(&rep, precheck(ctx, clt, cfg, &rep, *ref))
+}
+
+// precheck enumerates the blockers of the datastore ref and posts no-go
+// reports to the webhook. Completed actions are added to rep.
+func precheck(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, ref types.ManagedObjectReference) error {
+	inv, err := clt.inventory(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	evaluate(cfg, inv, rep)
+
+	if rep.Decision == decisionNoGo && cfg.Notify.WebhookURL != "" {
+		if err := notify(ctx, cfg.Notify.WebhookURL, rep); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "notified")
+	}
+
+	return nil
+}
+
+// reportResponse returns rep as JSON, with status 500 if the check failed
+// with checkErr.
+func reportResponse(rep *report, checkErr error) (handler.Response, error) {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if checkErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("datastore precheck failed: %w", checkErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether the task announces a datastore maintenance.
+func (cfg *vcConfig) checks(task string) bool {
+	for _, t := range cfg.Precheck.Tasks {
+		if t == task {
+			return true
+		}
+	}
+
+	return false
+}
+
+// warns reports whether blockers of kind are reported as warnings.
+func (cfg *vcConfig) warns(kind string) bool {
+	for _, k := range cfg.Precheck.Warnings {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	if len(cfg.Precheck.Tasks) == 0 {
+		cfg.Precheck.Tasks = defaultTasks
+	}
+	if cfg.Precheck.Warnings == nil {
+		cfg.Precheck.Warnings = []string{kindHAConfig}
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	for _, k := range cfg.Precheck.Warnings {
+		if _, ok := remediations[k]; !ok {
+			return fmt.Errorf("unknown precheck warnings kind %q", k)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a task event. Whether the task is checked is decided by
+// the config.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Subject != subjectTask {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Info == nil {
+		return nil, errors.New("empty task info")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,350 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Precheck.Tasks = []string{"Datastore.enterMaintenanceMode"}
+	want.Precheck.Warnings = []string{"ha-config"}
+	want.Notify.WebhookURL = "https://hooks.local.corp/datastore-precheck"
+
+	want2 := vcConfig{}
+	want2.VCenter = want.VCenter
+	want2.Precheck.Tasks = []string{"Datastore.enterMaintenanceMode", "Datastore.destroy"}
+	want2.Precheck.Warnings = []string{"vm-registered", "ha-config"}
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly with default tasks and warnings",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that configured tasks and warnings replace the defaults",
+			"testdata/vcconfig2.toml",
+			false,
+			&want2,
+		},
+		{
+			"Test that toml file missing vCenter password results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an unknown warnings kind results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures task events are read with their datastore and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      [2]string
+	}{
+		{"Test that the datastore of a maintenance task is read", "testdata/event.json", false, [2]string{"Datastore.enterMaintenanceMode", "datastore-33"}},
+		{"Test that tasks of other entities have no datastore", "testdata/event2.json", false, [2]string{"HostSystem.enterMaintenanceMode", ""}},
+		{"Event should return error if it is no task event", "testdata/eventErr1.json", true, [2]string{}},
+		{"Event should return error if the task info is empty", "testdata/eventErr2.json", true, [2]string{}},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := [2]string{event.task(), ""}
+		if ds := event.datastore(); ds != nil {
+			got[1] = ds.Value
+		}
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestEvaluate ensures VMs and the HA configuration of clusters are reported
+// as blockers, unless their kind is configured as warning.
+func TestEvaluate(t *testing.T) {
+	ref := func(kind, value string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: kind, Value: value}
+	}
+	vm := func(value, name string, on, template bool) vmInfo {
+		return vmInfo{Ref: ref("VirtualMachine", value), Name: name, PoweredOn: on, Template: template}
+	}
+	cluster := func(value string, ha bool, policy string, heartbeat bool) clusterInfo {
+		return clusterInfo{Ref: ref("ClusterComputeResource", value), Name: value, HAEnabled: ha, Policy: policy, Heartbeat: heartbeat}
+	}
+
+	var tests = []struct {
+		testDesc     string
+		warnings     []string
+		inv          inventory
+		wantDecision string
+		wantBlockers string
+		wantWarnings string
+	}{
+		{
+			"Test that an unused datastore may go ahead",
+			[]string{kindHAConfig},
+			inventory{Clusters: []clusterInfo{cluster("c1", false, "", false)}},
+			decisionGo, "", "",
+		},
+		{
+			"Test that running and registered VMs block the maintenance",
+			[]string{kindHAConfig},
+			inventory{VMs: []vmInfo{vm("vm-2", "web-02", true, false), vm("vm-1", "web-01", false, false), vm("vm-3", "centos7", false, true)}},
+			decisionNoGo, "vm-registered centos7,vm-registered web-01,vm-running web-02", "",
+		},
+		{
+			"Test that a selected heartbeat datastore blocks the maintenance",
+			[]string{kindHAConfig},
+			inventory{Clusters: []clusterInfo{cluster("c1", true, policyUserSelected, true)}},
+			decisionNoGo, "ha-heartbeat c1", "",
+		},
+		{
+			"Test that a selection HA ignores is only a warning",
+			[]string{kindHAConfig},
+			inventory{Clusters: []clusterInfo{cluster("c1", true, policyAllFeasible, true)}},
+			decisionGo, "", "ha-config c1",
+		},
+		{
+			"Test that the default policy of HA is a warning",
+			[]string{kindHAConfig},
+			inventory{Clusters: []clusterInfo{cluster("c1", true, "", false)}},
+			decisionGo, "", "ha-config c1",
+		},
+		{
+			"Test that only selected other datastores are no finding",
+			[]string{kindHAConfig},
+			inventory{Clusters: []clusterInfo{cluster("c1", true, policyUserSelected, false)}},
+			decisionGo, "", "",
+		},
+		{
+			"Test that kinds configured as warnings do not block",
+			[]string{kindVMRegistered},
+			inventory{VMs: []vmInfo{vm("vm-1", "web-01", false, false)}, Clusters: []clusterInfo{cluster("c1", true, "", false)}},
+			decisionNoGo, "ha-config c1", "vm-registered web-01",
+		},
+	}
+
+	names := func(findings []finding) string {
+		var out []string
+		for _, f := range findings {
+			out = append(out, f.Kind+" "+f.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		var cfg vcConfig
+		cfg.Precheck.Warnings = tc.warnings
+
+		var rep report
+		evaluate(&cfg, &tc.inv, &rep)
+
+		gotBlockers, gotWarnings := names(rep.Blockers), names(rep.Warnings)
+		if rep.Decision == tc.wantDecision && gotBlockers == tc.wantBlockers && gotWarnings == tc.wantWarnings {
+			t.Logf("got expected: %v, blockers %q, warnings %q. %v", rep.Decision, gotBlockers, gotWarnings, passMark)
+		} else {
+			t.Logf("expected: %v, blockers %q, warnings %q, got: %v, %q, %q. %v",
+				tc.wantDecision, tc.wantBlockers, tc.wantWarnings, rep.Decision, gotBlockers, gotWarnings, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPrecheck shows the blockers of a datastore are found in the inventory
+// and no-go reports are posted to the webhook.
+func TestPrecheck(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		finder := find.NewFinder(c)
+		ds, err := finder.Datastore(ctx, "LocalDS_0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		cluster, err := finder.ClusterComputeResource(ctx, "DC0_C0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := vm.PowerOff(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		sim := simulator.Map.Get(cluster.Reference()).(*simulator.ClusterComputeResource)
+		das := &sim.ConfigurationEx.(*types.ClusterConfigInfoEx).DasConfig
+		das.Enabled = types.NewBool(true)
+		das.HBDatastoreCandidatePolicy = policyUserSelected
+		das.HeartbeatDatastore = []types.ManagedObjectReference{ds.Reference()}
+
+		var posted atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			posted.Add(1)
+		}))
+		defer srv.Close()
+
+		var tests = []struct {
+			testDesc     string
+			warnings     []string
+			wantDecision string
+			wantBlockers string
+			wantPosted   int32
+		}{
+			{
+				"Test that VMs and the heartbeat datastore block the maintenance",
+				[]string{kindHAConfig},
+				decisionNoGo,
+				"ha-heartbeat DC0_C0,vm-registered DC0_H0_VM1,vm-running DC0_C0_RP0_VM0,vm-running DC0_C0_RP0_VM1,vm-running DC0_H0_VM0",
+				1,
+			},
+			{
+				"Test that a report without blockers is not posted",
+				[]string{kindVMRunning, kindVMRegistered, kindHAHeartbeat},
+				decisionGo,
+				"",
+				1,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			var cfg vcConfig
+			cfg.Precheck.Warnings = tc.warnings
+			cfg.Notify.WebhookURL = srv.URL
+
+			rep := report{Datastore: ds.Reference().Value}
+			err := precheck(ctx, clt, &cfg, &rep, ds.Reference())
+
+			var blockers []string
+			for _, f := range rep.Blockers {
+				blockers = append(blockers, f.Kind+" "+f.Name)
+			}
+			got := strings.Join(blockers, ",")
+
+			if err == nil && rep.Name == "LocalDS_0" && len(rep.Hosts) > 0 && rep.Decision == tc.wantDecision &&
+				got == tc.wantBlockers && posted.Load() == tc.wantPosted {
+				t.Logf("got expected: %v, blockers %q. %v", rep.Decision, got, passMark)
+			} else {
+				t.Logf("expected: %v, blockers %q, %d posted, got: %+v, %d posted (%v). %v",
+					tc.wantDecision, tc.wantBlockers, tc.wantPosted, rep, posted.Load(), err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
@@ -0,0 +1,151 @@
+package function
+
+import (
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Kinds of blockers.
+const (
+	// kindVMRunning is a powered on VM, which holds files of the
+	// datastore open.
+	kindVMRunning = "vm-running"
+	// kindVMRegistered is a powered off VM or template with files on the
+	// datastore.
+	kindVMRegistered = "vm-registered"
+	// kindHAHeartbeat is a cluster which selected the datastore for HA
+	// heartbeating.
+	kindHAHeartbeat = "ha-heartbeat"
+	// kindHAConfig is a cluster whose HA configuration lets HA pick the
+	// datastore for heartbeating.
+	kindHAConfig = "ha-config"
+)
+
+// remediations suggest how to resolve the kinds of blockers.
+var remediations = map[string]string{
+	kindVMRunning:    "migrate the VM to another datastore with Storage vMotion or power it off",
+	kindVMRegistered: "migrate the VM to another datastore or unregister it",
+	kindHAHeartbeat:  "select other heartbeat datastores in the vSphere HA settings of the cluster",
+	kindHAConfig:     "select other heartbeat datastores with the policy to use only the selected ones or disable vSphere HA during the maintenance",
+}
+
+// Heartbeat datastore candidate policies of vSphere HA. With userSelectedDs,
+// HA only uses the selected datastores.
+const (
+	policyUserSelected         = "userSelectedDs"
+	policyAllFeasible          = "allFeasibleDs"
+	policyAllFeasiblePreferred = "allFeasibleDsWithUserPreference"
+)
+
+// finding is a blocker or warning of the maintenance.
+type finding struct {
+	Kind   string `json:"kind"`
+	Object string `json:"object"`
+	Name   string `json:"name"`
+	// Detail describes why the object blocks the maintenance.
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation"`
+}
+
+// inventory holds the objects of a datastore which may block its
+// maintenance.
+type inventory struct {
+	Name string
+	// Hosts are the names of the hosts mounting the datastore.
+	Hosts    []string
+	VMs      []vmInfo
+	Clusters []clusterInfo
+}
+
+// vmInfo is a VM with files on the datastore.
+type vmInfo struct {
+	Ref       types.ManagedObjectReference
+	Name      string
+	PoweredOn bool
+	Template  bool
+}
+
+// clusterInfo is the vSphere HA configuration of a cluster of hosts mounting
+// the datastore.
+type clusterInfo struct {
+	Ref       types.ManagedObjectReference
+	Name      string
+	HAEnabled bool
+	// Policy is the heartbeat datastore candidate policy.
+	Policy string
+	// Heartbeat reports whether the datastore is selected for heartbeating.
+	Heartbeat bool
+}
+
+// evaluate adds the blockers and warnings of inv to rep and decides whether
+// the maintenance may go ahead. Blockers of the kinds configured as warnings
+// do not make the report no-go.
+func evaluate(cfg *vcConfig, inv *inventory, rep *report) {
+	if inv.Name != "" {
+		rep.Name = inv.Name
+	}
+	rep.Hosts = inv.Hosts
+
+	var findings []finding
+
+	for _, vm := range inv.VMs {
+		switch {
+		case vm.PoweredOn:
+			findings = append(findings, newFinding(kindVMRunning, vm.Ref, vm.Name, "powered on VM with open files on the datastore"))
+		case vm.Template:
+			findings = append(findings, newFinding(kindVMRegistered, vm.Ref, vm.Name, "template with files on the datastore"))
+		default:
+			findings = append(findings, newFinding(kindVMRegistered, vm.Ref, vm.Name, "registered VM with files on the datastore"))
+		}
+	}
+
+	for _, c := range inv.Clusters {
+		if !c.HAEnabled {
+			continue
+		}
+		// vCenter defaults to the selected datastores with preference.
+		policy := c.Policy
+		if policy == "" {
+			policy = policyAllFeasiblePreferred
+		}
+
+		switch {
+		// HA ignores the selection with allFeasibleDs.
+		case c.Heartbeat && policy != policyAllFeasible:
+			findings = append(findings, newFinding(kindHAHeartbeat, c.Ref, c.Name, "vSphere HA heartbeat datastore of the cluster"))
+		case policy != policyUserSelected:
+			findings = append(findings, newFinding(kindHAConfig, c.Ref, c.Name, "vSphere HA may pick the datastore for heartbeating, policy "+policy))
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Kind != findings[j].Kind {
+			return findings[i].Kind < findings[j].Kind
+		}
+		return findings[i].Name < findings[j].Name
+	})
+
+	for _, f := range findings {
+		if cfg.warns(f.Kind) {
+			rep.Warnings = append(rep.Warnings, f)
+		} else {
+			rep.Blockers = append(rep.Blockers, f)
+		}
+	}
+
+	rep.Decision = decisionGo
+	if len(rep.Blockers) > 0 {
+		rep.Decision = decisionNoGo
+	}
+}
+
+func newFinding(kind string, ref types.ManagedObjectReference, name, detail string) finding {
+	return finding{
+		Kind:        kind,
+		Object:      ref.Value,
+		Name:        name,
+		Detail:      detail,
+		Remediation: remediations[kind],
+	}
+}
@@ -0,0 +1,278 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	"github.com/vmware/govmomi/pbm/methods"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// homeLabel labels the VM home, which holds the configuration files of a
+// VM, among its disks.
+const homeLabel = "VM home"
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+	pbm     *pbm.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	// The storage policy API shares the session of the govmomi api.
+	pc, err := pbm.NewClient(ctx, gc.Client)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to storage policy api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc, pbm: pc}, nil
+}
+
+// disk is a virtual disk of a VM.
+type disk struct {
+	Key   int32
+	Label string
+}
+
+// vmStorage holds the state of a VM and its disks.
+type vmStorage struct {
+	Name       string
+	Template   bool
+	PowerState types.VirtualMachinePowerState
+	Disks      []disk
+}
+
+// vmStorage retrieves the state of a VM and its disks.
+func (clt *vsClient) vmStorage(ctx context.Context, ref types.ManagedObjectReference) (*vmStorage, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "config.template", "config.hardware.device", "runtime.powerState"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve disks of %v failed: %w", ref.Value, err)
+	}
+
+	s := vmStorage{Name: vm.Name, PowerState: vm.Runtime.PowerState}
+	if vm.Config == nil {
+		return &s, nil
+	}
+	s.Template = vm.Config.Template
+
+	for _, d := range object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil)) {
+		dev := d.GetVirtualDevice()
+		label := "disk " + strconv.Itoa(int(dev.Key))
+		if dev.DeviceInfo != nil {
+			label = dev.DeviceInfo.GetDescription().Label
+		}
+		s.Disks = append(s.Disks, disk{Key: dev.Key, Label: label})
+	}
+
+	return &s, nil
+}
+
+// policies returns the names of the storage policies of the home and the
+// disks of a VM by their label, "none" for those without policy.
+func (clt *vsClient) policies(ctx context.Context, ref types.ManagedObjectReference, disks []disk) (map[string]string, error) {
+	labels := map[string]string{ref.Value: homeLabel}
+	entities := []pbmtypes.PbmServerObjectRef{{
+		ObjectType: string(pbmtypes.PbmObjectTypeVirtualMachine),
+		Key:        ref.Value,
+	}}
+	for _, d := range disks {
+		key := fmt.Sprintf("%v:%d", ref.Value, d.Key)
+		labels[key] = d.Label
+		entities = append(entities, pbmtypes.PbmServerObjectRef{
+			ObjectType: string(pbmtypes.PbmObjectTypeVirtualDiskId),
+			Key:        key,
+		})
+	}
+
+	res, err := methods.PbmQueryAssociatedProfiles(ctx, clt.pbm, &pbmtypes.PbmQueryAssociatedProfiles{
+		This:     clt.pbm.ServiceContent.ProfileManager,
+		Entities: entities,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query storage policies of %v failed: %w", ref.Value, err)
+	}
+
+	policies := map[string]string{}
+	for _, label := range labels {
+		policies[label] = "none"
+	}
+
+	byObject := map[string]pbmtypes.PbmProfileId{}
+	var ids []pbmtypes.PbmProfileId
+	for _, r := range res.Returnval {
+		if len(r.ProfileId) == 0 {
+			continue
+		}
+		byObject[r.Object.Key] = r.ProfileId[0]
+		ids = append(ids, r.ProfileId[0])
+	}
+	if len(ids) == 0 {
+		return policies, nil
+	}
+
+	names, err := clt.profileNames(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for key, id := range byObject {
+		if label, ok := labels[key]; ok {
+			policies[label] = names[id.UniqueId]
+		}
+	}
+
+	return policies, nil
+}
+
+// profileNames returns the names of the storage policies ids by their id.
+func (clt *vsClient) profileNames(ctx context.Context, ids []pbmtypes.PbmProfileId) (map[string]string, error) {
+	profiles, err := clt.pbm.RetrieveContent(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve storage policies failed: %w", err)
+	}
+
+	names := map[string]string{}
+	for _, p := range profiles {
+		profile := p.GetPbmProfile()
+		names[profile.ProfileId.UniqueId] = profile.Name
+	}
+
+	return names, nil
+}
+
+// reapply starts applying the storage policy name to the home and disks of a
+// VM and returns the reconfigure task.
+func (clt *vsClient) reapply(ctx context.Context, ref types.ManagedObjectReference, name string) (string, error) {
+	id, err := clt.pbm.ProfileIDByName(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("find storage policy %v failed: %w", name, err)
+	}
+
+	profile := func() []types.BaseVirtualMachineProfileSpec {
+		return []types.BaseVirtualMachineProfileSpec{&types.VirtualMachineDefinedProfileSpec{ProfileId: id}}
+	}
+
+	vm := object.NewVirtualMachine(clt.govmomi.Client, ref)
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return "", fmt.Errorf("retrieve disks of %v failed: %w", ref.Value, err)
+	}
+
+	spec := types.VirtualMachineConfigSpec{VmProfile: profile()}
+	for _, d := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		spec.DeviceChange = append(spec.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    d,
+			Profile:   profile(),
+		})
+	}
+
+	task, err := vm.Reconfigure(ctx, spec)
+	if err != nil {
+		return "", fmt.Errorf("reapply storage policy to %v failed: %w", ref.Value, err)
+	}
+
+	return task.Reference().Value, nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// nonCompliant returns the labels of the VM home and disks whose storage
+// policy in policies does not require encryption, the VM home first.
+func (cfg *vcConfig) nonCompliant(policies map[string]string) []string {
+	var labels []string
+	for label, name := range policies {
+		if !cfg.encrypts(name) {
+			labels = append(labels, label)
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i] == homeLabel || labels[j] == homeLabel {
+			return labels[i] == homeLabel
+		}
+		return labels[i] < labels[j]
+	})
+
+	return labels
+}
+
+// enforce checks whether the storage policies of the home and all disks of vm
+// require encryption. VMs which do not comply are tagged and get the
+// reapply policy, VMs which comply again are untagged. Completed actions are
+// added to rep, the joined errors of failed actions are returned.
+func enforce(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	s, err := clt.vmStorage(ctx, vm)
+	if err != nil {
+		return err
+	}
+	rep.Name = s.Name
+
+	// Templates cannot be reconfigured, their clones are checked when
+	// created.
+	if s.Template {
+		rep.Skipped = "template"
+		return nil
+	}
+
+	if urn := cfg.Encryption.ScopeTagURN; urn != "" {
+		scoped, err := clt.tagged(ctx, vm, urn)
+		if err != nil {
+			return err
+		}
+		if !scoped {
+			rep.Skipped = "out of scope"
+			return nil
+		}
+	}
+
+	rep.Policies, err = clt.policies(ctx, vm, s.Disks)
+	if err != nil {
+		return err
+	}
+	rep.NonCompliant = cfg.nonCompliant(rep.Policies)
+	rep.Compliant = len(rep.NonCompliant) == 0
+
+	if rep.Compliant {
+		return release(ctx, clt, cfg, rep, vm)
+	}
+
+	var errs []error
+	if err := mark(ctx, clt, cfg, rep, vm); err != nil {
+		errs = append(errs, err)
+	}
+	if err := reapply(ctx, clt, cfg, rep, vm, s); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// mark attaches the tag of non-compliant VMs to vm, if not attached.
+func mark(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	urn := cfg.Encryption.NonCompliantTagURN
+	if urn == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil {
+		return err
+	}
+	if tagged {
+		rep.Actions = append(rep.Actions, "already tagged")
+		return nil
+	}
+
+	if err := clt.tag(ctx, vm, urn); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "tagged")
+
+	return nil
+}
+
+// release detaches the tag of non-compliant VMs from vm, if attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	urn := cfg.Encryption.NonCompliantTagURN
+	if urn == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, urn); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+// reapply starts applying the reapply policy to the home and disks of vm.
+// vSphere only encrypts VMs which are powered off, so powered on VMs are
+// left to a later event. The task is not waited for, since encrypting the
+// disks takes long; its VmReconfiguredEvent checks the VM again.
+func reapply(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, s *vmStorage) error {
+	name := cfg.Encryption.ReapplyPolicy
+	if name == "" {
+		return nil
+	}
+
+	if s.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		rep.Actions = append(rep.Actions, "reapply needs power off")
+		return nil
+	}
+
+	task, err := clt.reapply(ctx, vm, name)
+	if err != nil {
+		return err
+	}
+	rep.ReapplyTask = task
+	rep.Actions = append(rep.Actions, "policy reapplied")
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents check the storage policies of their VM if no events are
+// configured.
+var defaultEvents = []string{"VmCreatedEvent", "VmReconfiguredEvent"}
+
+// defaultPolicies are the storage policies requiring encryption if no
+// policies are configured. The policy is created by vCenter.
+var defaultPolicies = []string{"VM Encryption Policy"}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Encryption struct {
+		// Events check the storage policies of their VM, by default
+		// defaultEvents.
+		Events []string
+		// Policies are the names of the storage policies requiring
+		// encryption, by default defaultPolicies. A VM complies if its
+		// home and all its disks have one of them.
+		Policies []string
+		// ScopeTagURN limits the check to the VMs carrying it, all VMs
+		// are checked without it.
+		ScopeTagURN string `toml:"scope_tag_urn"`
+		// NonCompliantTagURN is attached to VMs which do not comply and
+		// detached once they comply again.
+		NonCompliantTagURN string `toml:"non_compliant_tag_urn"`
+		// ReapplyPolicy is applied to the home and disks of VMs which do
+		// not comply, it must be one of Policies.
+		ReapplyPolicy string `toml:"reapply_policy"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Vm *types.VmEventArgument `json:"Vm,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the storage policies of a VM and the actions taken.
+type report struct {
+	Event string `json:"event,omitempty"`
+	VM    string `json:"vm"`
+	Name  string `json:"name,omitempty"`
+	// Policies are the storage policies of the VM home and its disks by
+	// their label, "none" if they have none.
+	Policies map[string]string `json:"policies,omitempty"`
+	// NonCompliant are the labels whose policy does not require
+	// encryption, the VM home first.
+	NonCompliant []string `json:"non_compliant,omitempty"`
+	Compliant    bool     `json:"compliant"`
+	ReapplyTask  string   `json:"reapply_task,omitempty"`
+	Skipped      string   `json:"skipped,omitempty"`
+	Actions      []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	vm := event.Data.Vm.Vm
+	rep := report{
+		Event: event.Subject,
+		VM:    vm.Value,
+	}
+
+	actionErr := enforce(ctx, clt, cfg, &rep, vm)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("enforcing encryption policy failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether event checks the storage policies of its VM.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Encryption.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policies returns the names of the storage policies requiring encryption.
+func (cfg *vcConfig) policies() []string {
+	if len(cfg.Encryption.Policies) > 0 {
+		return cfg.Encryption.Policies
+	}
+
+	return defaultPolicies
+}
+
+// encrypts reports whether the storage policy name requires encryption.
+func (cfg *vcConfig) encrypts(name string) bool {
+	for _, p := range cfg.policies() {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// A function which neither tags nor reapplies does nothing.
+	e := cfg.Encryption
+	if e.NonCompliantTagURN == "" && e.ReapplyPolicy == "" {
+		return errors.New("required field(s) missing, including encryption non_compliant_tag_urn or reapply_policy")
+	}
+
+	// Reapplying a policy without encryption would never make a VM comply.
+	if e.ReapplyPolicy != "" && !cfg.encrypts(e.ReapplyPolicy) {
+		return fmt.Errorf("encryption reapply_policy %q is not one of the policies", e.ReapplyPolicy)
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event of a VM.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty VM")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
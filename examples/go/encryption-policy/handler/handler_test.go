@@ -0,0 +1,336 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/pbm"
+	_ "github.com/vmware/govmomi/pbm/simulator"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Encryption.Events = []string{"VmCreatedEvent"}
+	tagged.Encryption.Policies = []string{"VM Encryption Policy", "Encrypted vSAN"}
+	tagged.Encryption.ScopeTagURN = "urn:vmomi:InventoryServiceTag:2f6d8e41-7c3a-4b95-9e1d-5a0c8b7f3e26:GLOBAL"
+	tagged.Encryption.NonCompliantTagURN = "urn:vmomi:InventoryServiceTag:9a4c1e7b-3d2f-4a68-b5e0-7c9f1d3b6a84:GLOBAL"
+	tagged.Encryption.ReapplyPolicy = "Encrypted vSAN"
+
+	reapplied := vcConfig{}
+	reapplied.VCenter = tagged.VCenter
+	reapplied.VCenter.Insecure = true
+	reapplied.Encryption.ReapplyPolicy = "VM Encryption Policy"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with scope, tag and reapply policy loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file reapplying the default policy only loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&reapplied,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml which neither tags nor reapplies results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml reapplying a policy without encryption results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a missing vcconfig.toml results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseEvent shows configured events of VMs are accepted.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig2.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that created VM is readable", "testdata/event.json", false, "vm-42"},
+		{"Test that reconfigured VM is readable", "testdata/event2.json", false, "vm-42"},
+		{"Event should return error if it has no VM", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.Data.Vm.Vm.Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestNonCompliant shows the VM home and disks without a policy requiring
+// encryption are reported, the VM home first.
+func TestNonCompliant(t *testing.T) {
+	var cfg vcConfig
+	cfg.Encryption.Policies = []string{"VM Encryption Policy", "Encrypted vSAN"}
+
+	var tests = []struct {
+		testDesc string
+		policies map[string]string
+		want     []string
+	}{
+		{
+			"Test that a VM whose home and disks are encrypted complies",
+			map[string]string{homeLabel: "VM Encryption Policy", "Hard disk 1": "Encrypted vSAN"},
+			nil,
+		},
+		{
+			"Test that a disk with another policy does not comply",
+			map[string]string{homeLabel: "VM Encryption Policy", "Hard disk 1": "vSAN Default Storage Policy"},
+			[]string{"Hard disk 1"},
+		},
+		{
+			"Test that objects without policy do not comply, the VM home first",
+			map[string]string{"Hard disk 2": "none", homeLabel: "none", "Hard disk 1": "VM Encryption Policy"},
+			[]string{homeLabel, "Hard disk 2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := cfg.nonCompliant(tc.policies)
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRemediate shows non-compliant VMs are tagged once and get the reapply
+// policy once powered off, VMs which comply again are untagged.
+func TestRemediate(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		pc, err := pbm.NewClient(ctx, c)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "encryption", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "not-encrypted", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, pbm: pc}
+
+		s, err := clt.vmStorage(ctx, vm.Reference())
+		if err != nil || len(s.Disks) == 0 {
+			t.Fatal("Test failing due to improper test setup.", failMark, s, err)
+		}
+
+		var cfg vcConfig
+		cfg.Encryption.NonCompliantTagURN = tagID
+		cfg.Encryption.ReapplyPolicy = "VM Encryption Policy"
+
+		powerOff := func() {
+			s.PowerState = types.VirtualMachinePowerStatePoweredOff
+		}
+
+		var tests = []struct {
+			testDesc    string
+			setup       func()
+			compliant   bool
+			wantActions string
+		}{
+			{"Test that a powered on VM is tagged, but not reapplied", nil, false, "tagged,reapply needs power off"},
+			{"Test that a powered off VM gets the policy reapplied", powerOff, false, "already tagged,policy reapplied"},
+			{"Test that a VM which complies again is untagged", nil, true, "untagged"},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			// The storage policies of VMs are not simulated, so the
+			// compliance of the VM is given.
+			rep := report{VM: vm.Reference().Value}
+			if tc.compliant {
+				err = release(ctx, clt, &cfg, &rep, vm.Reference())
+			} else {
+				err = mark(ctx, clt, &cfg, &rep, vm.Reference())
+				if err == nil {
+					err = reapply(ctx, clt, &cfg, &rep, vm.Reference(), s)
+				}
+			}
+			if err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if got == tc.wantActions && (rep.ReapplyTask != "") == strings.Contains(got, "reapplied") {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected actions %q, got: %+v. %v", tc.wantActions, rep, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that reapplying an unknown policy results in error ===========")
+		if _, err := clt.reapply(ctx, vm.Reference(), "Encrypted vSAN"); err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected an error for the unknown policy. %v", failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,5 @@
+module github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/functions
+
+go 1.22
+
+require github.com/openfaas/templates-sdk/go-http v0.0.0-20220408082716-5981c545cb03
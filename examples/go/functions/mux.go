@@ -0,0 +1,389 @@
+// Package functions composes several example functions into one OpenFaaS
+// function, so small environments deploy a single function instead of one per
+// example:
+//
+//	var mux = functions.NewMux()
+//
+//	func init() {
+//		mux.Register("tagger", tagging.Handle, "VmPoweredOnEvent")
+//		mux.Register("placement", placement.Handle, "DrsVmPoweredOnEvent")
+//		mux.Register("notifier", notifier.Handle, "VmPoweredOnEvent", "VmPoweredOffEvent")
+//	}
+//
+//	func Handle(req handler.Request) (handler.Response, error) {
+//		return mux.Handle(req)
+//	}
+//
+// Requests are dispatched by the name of a function in the query parameter
+// function, e.g. ?function=tagger, and otherwise by the type of the event, the
+// subject of the CloudEvent.
+package functions
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+// QueryFunction is the query parameter naming the function a request is
+// dispatched to. The golang-http template passes no path to functions, so
+// functions are addressed by query instead of path.
+const QueryFunction = "function"
+
+// subjectHeader carries the subject of CloudEvents in binary mode.
+const subjectHeader = "Ce-Subject"
+
+// maxEventSize limits the decompressed body read to route an event, as the
+// functions limit the bodies they decode.
+const maxEventSize = 1 << 20
+
+// HandlerFunc is the entry point of a function, e.g. the Handle of an example.
+type HandlerFunc func(req handler.Request) (handler.Response, error)
+
+// Mux dispatches requests to the registered functions. It implements
+// handler.FunctionHandler. The zero value is not usable, see NewMux.
+type Mux struct {
+	mu sync.RWMutex
+
+	handlers map[string]HandlerFunc
+	// events lists the functions of an event type in order of
+	// registration.
+	events map[string][]string
+}
+
+// NewMux returns a Mux without functions.
+func NewMux() *Mux {
+	return &Mux{
+		handlers: map[string]HandlerFunc{},
+		events:   map[string][]string{},
+	}
+}
+
+// Register adds the function h by name, invoked for the events of the given
+// types. Functions without events are only invoked by name. Several functions
+// may be registered for the same event type, e.g. a tagger and a notifier of
+// VmPoweredOnEvent; they are invoked in order of registration. Names must be
+// unique.
+func (m *Mux) Register(name string, h HandlerFunc, events ...string) error {
+	if name == "" {
+		return errors.New("empty function name")
+	}
+	if h == nil {
+		return fmt.Errorf("function %q without handler", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.handlers[name]; ok {
+		return fmt.Errorf("function %q is registered more than once", name)
+	}
+	m.handlers[name] = h
+
+	seen := map[string]bool{}
+	for _, e := range events {
+		if e == "" || seen[e] {
+			continue
+		}
+		seen[e] = true
+		m.events[e] = append(m.events[e], name)
+	}
+
+	return nil
+}
+
+// Events returns the registered event types, sorted, e.g. for the topic
+// annotation of the function.
+func (m *Mux) Events() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := make([]string, 0, len(m.events))
+	for e := range m.events {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+
+	return events
+}
+
+// Handle invokes the function named by QueryFunction or else the functions of
+// the event type of req. Requests which match no function fail with 404 Not
+// Found. The response of a single function is returned as is, see fanOut for
+// several.
+func (m *Mux) Handle(req handler.Request) (handler.Response, error) {
+	if name, ok := functionName(req); ok {
+		m.mu.RLock()
+		h := m.handlers[name]
+		m.mu.RUnlock()
+
+		if h == nil {
+			return notFound(fmt.Errorf("no function %q", name))
+		}
+
+		return h(req)
+	}
+
+	subject, err := eventType(req)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	m.mu.RLock()
+	names := m.events[subject]
+	handlers := make([]HandlerFunc, len(names))
+	for i, n := range names {
+		handlers[i] = m.handlers[n]
+	}
+	m.mu.RUnlock()
+
+	switch len(handlers) {
+	case 0:
+		return notFound(fmt.Errorf("no function for event %q", subject))
+	case 1:
+		return handlers[0](req)
+	}
+
+	return fanOut(req, names, handlers)
+}
+
+// result is the response of a function of several invoked for an event.
+type result struct {
+	Function   string          `json:"function"`
+	StatusCode int             `json:"status"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// fanOut invokes the handlers of names with req in order, each with its own
+// copy of the body, and responds with the results of all as JSON, e.g.
+// {"results":[{"function":"tagger","status":200,"body":{...}}]}. Bodies which
+// are no JSON are included as string. The status is the highest status of
+// the results, so a failed function fails the invocation, and the errors are
+// joined. The headers of the results are merged, see mergeHeaders.
+func fanOut(req handler.Request, names []string, handlers []HandlerFunc) (handler.Response, error) {
+	res := struct {
+		Results []result `json:"results"`
+	}{}
+
+	header := http.Header{}
+	status := 0
+	var errs []error
+	for i, h := range handlers {
+		r := req
+		r.Body = append([]byte(nil), req.Body...)
+
+		resp, err := h(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("function %v: %w", names[i], err))
+		}
+
+		out := result{Function: names[i], StatusCode: resp.StatusCode, Body: rawBody(resp.Body)}
+		if err != nil {
+			out.Error = err.Error()
+		}
+		res.Results = append(res.Results, out)
+		mergeHeaders(header, resp.Header)
+
+		if resp.StatusCode > status {
+			status = resp.StatusCode
+		}
+	}
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+
+	// Functions returning only an error have no status.
+	if status == 0 {
+		status = http.StatusOK
+		if len(errs) > 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	header.Set("Content-Type", "application/json")
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: status,
+		Header:     header,
+	}, errors.Join(errs...)
+}
+
+// mergeHeaders adds the values of from to the merged headers to, skipping
+// the headers describing the replaced body. Retry-After keeps the longest
+// delay, so the event processor backs off as long as the most saturated
+// function asks for.
+func mergeHeaders(to, from http.Header) {
+	for k, values := range from {
+		switch k = http.CanonicalHeaderKey(k); k {
+		case "Content-Type", "Content-Length", "Content-Encoding":
+			continue
+		case "Retry-After":
+			if retryAfter(from.Get(k)) > retryAfter(to.Get(k)) {
+				to.Set(k, from.Get(k))
+			}
+			continue
+		}
+
+		for _, v := range values {
+			if !contains(to.Values(k), v) {
+				to.Add(k, v)
+			}
+		}
+	}
+}
+
+// retryAfter returns the delay of a Retry-After value in seconds or as HTTP
+// date, 0 if there is none.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(value); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rawBody returns body as JSON: as is if valid, or else as string.
+func rawBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	if json.Valid(body) {
+		return body
+	}
+
+	s, _ := json.Marshal(strings.TrimSpace(string(body)))
+	return s
+}
+
+// functionName returns the function named by the query of req, if any.
+func functionName(req handler.Request) (string, bool) {
+	q, err := url.ParseQuery(req.QueryString)
+	if err != nil || !q.Has(QueryFunction) {
+		return "", false
+	}
+
+	return q.Get(QueryFunction), true
+}
+
+// eventType returns the subject of the CloudEvent of req, from the header of
+// binary mode or else from the structured body. Compressed bodies are
+// decompressed to read the subject, the functions get them as they are.
+func eventType(req handler.Request) (string, error) {
+	if s := req.Header.Get(subjectHeader); s != "" {
+		return s, nil
+	}
+
+	body, err := decompress(req)
+	if err != nil {
+		return "", fmt.Errorf("decoding request body failed: %w", err)
+	}
+
+	var event struct {
+		Subject string `json:"subject"`
+	}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Subject == "" {
+		return "", errors.New("event without subject")
+	}
+
+	return event.Subject, nil
+}
+
+// decompress returns the body of req without the gzip and deflate content
+// encodings the functions accept, at most maxEventSize bytes of it.
+func decompress(req handler.Request) ([]byte, error) {
+	encodings := strings.Split(req.Header.Get("Content-Encoding"), ",")
+
+	// Encodings are listed in the order they were applied.
+	var r io.Reader = bytes.NewReader(req.Body)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			r = zr
+		case "deflate":
+			// Like the functions, zlib wrapped data falls back to raw
+			// deflate data.
+			data, err := io.ReadAll(io.LimitReader(r, maxEventSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+				r = zr
+			} else {
+				r = flate.NewReader(bytes.NewReader(data))
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %v", enc)
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, maxEventSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxEventSize {
+		return nil, fmt.Errorf("event larger than %d bytes", maxEventSize)
+	}
+
+	return body, nil
+}
+
+// notFound responds to requests matching no function.
+func notFound(err error) (handler.Response, error) {
+	return handler.Response{
+		Body:       []byte(err.Error()),
+		StatusCode: http.StatusNotFound,
+	}, err
+}
@@ -0,0 +1,227 @@
+package functions
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// fn returns a function responding with status and body, and with err.
+func fn(status int, body string, err error) HandlerFunc {
+	return func(req handler.Request) (handler.Response, error) {
+		return handler.Response{StatusCode: status, Body: []byte(body)}, err
+	}
+}
+
+// TestRegister ensures functions are named once and their events are listed.
+func TestRegister(t *testing.T) {
+	m := NewMux()
+
+	var tests = []struct {
+		testDesc  string
+		name      string
+		h         HandlerFunc
+		events    []string
+		expectErr bool
+	}{
+		{"Test that a function is registered with its events", "tagger", fn(http.StatusOK, "", nil), []string{"VmPoweredOnEvent", "VmPoweredOnEvent"}, false},
+		{"Test that functions share event types", "notifier", fn(http.StatusOK, "", nil), []string{"VmPoweredOnEvent", "VmPoweredOffEvent"}, false},
+		{"Test that a function without events is registered", "report", fn(http.StatusOK, "", nil), nil, false},
+		{"Test that a name registered twice results in error", "tagger", fn(http.StatusOK, "", nil), nil, true},
+		{"Test that an empty name results in error", "", fn(http.StatusOK, "", nil), nil, true},
+		{"Test that a function without handler results in error", "placement", nil, nil, true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		err := m.Register(tc.name, tc.h, tc.events...)
+		switch {
+		case tc.expectErr && err != nil:
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		case !tc.expectErr && err == nil:
+			t.Logf("got expected: %v registered. %v", tc.name, passMark)
+		default:
+			t.Logf("expected error %v, got: %v. %v", tc.expectErr, err, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the events are listed once, sorted ===========")
+	want := []string{"VmPoweredOffEvent", "VmPoweredOnEvent"}
+	if got := m.Events(); reflect.DeepEqual(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+}
+
+// TestHandle ensures requests are dispatched by name and event type and
+// events of several functions are fanned out.
+func TestHandle(t *testing.T) {
+	m := NewMux()
+	for _, r := range []struct {
+		name   string
+		h      HandlerFunc
+		events []string
+	}{
+		{"tagger", fn(http.StatusOK, `{"tagged":true}`, nil), []string{"VmPoweredOnEvent"}},
+		{"notifier", fn(http.StatusAccepted, "notified", nil), []string{"VmPoweredOnEvent", "VmPoweredOffEvent"}},
+		{"placement", fn(http.StatusInternalServerError, "no host", errors.New("no host")), []string{"DrsVmPoweredOnEvent", "VmPoweredOffEvent"}},
+	} {
+		if err := m.Register(r.name, r.h, r.events...); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+	}
+
+	event := func(subject string) []byte {
+		return []byte(`{"id":"1","subject":"` + subject + `","data":{}}`)
+	}
+
+	var tests = []struct {
+		testDesc    string
+		req         handler.Request
+		expectErr   bool
+		wantStatus  int
+		wantResults []string
+	}{
+		{"Test that a function is invoked by name", handler.Request{QueryString: "function=notifier", Body: event("DrsVmPoweredOnEvent")}, false, http.StatusAccepted, nil},
+		{"Test that an unknown name results in 404", handler.Request{QueryString: "function=chargeback"}, true, http.StatusNotFound, nil},
+		{"Test that the function of an event is invoked", handler.Request{Body: event("DrsVmPoweredOnEvent")}, true, http.StatusInternalServerError, nil},
+		{"Test that the subject header of binary events dispatches", handler.Request{Header: http.Header{"Ce-Subject": {"VmPoweredOnEvent"}}, Body: []byte(`{}`)}, false, http.StatusAccepted, []string{"tagger", "notifier"}},
+		{"Test that the functions of an event are fanned out in order", handler.Request{Body: event("VmPoweredOnEvent")}, false, http.StatusAccepted, []string{"tagger", "notifier"}},
+		{"Test that a failed function of several fails the invocation", handler.Request{Body: event("VmPoweredOffEvent")}, true, http.StatusInternalServerError, []string{"notifier", "placement"}},
+		{"Test that an event without function results in 404", handler.Request{Body: event("VmRemovedEvent")}, true, http.StatusNotFound, nil},
+		{"Test that a malformed event results in 400", handler.Request{Body: []byte("{")}, true, http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		res, err := m.Handle(tc.req)
+
+		var got []string
+		if tc.wantResults != nil {
+			var body struct {
+				Results []result `json:"results"`
+			}
+			if err := json.Unmarshal(res.Body, &body); err != nil {
+				t.Logf("expected results, got: %s. %v", res.Body, failMark)
+				t.Fail()
+				continue
+			}
+			for _, r := range body.Results {
+				got = append(got, r.Function)
+			}
+		}
+
+		if (err != nil) == tc.expectErr && res.StatusCode == tc.wantStatus && reflect.DeepEqual(got, tc.wantResults) {
+			t.Logf("got expected: %v %s. %v", res.StatusCode, res.Body, passMark)
+		} else {
+			t.Logf("expected status %v, results %v, error %v, got: %v %s, %v. %v", tc.wantStatus, tc.wantResults, tc.expectErr, res.StatusCode, res.Body, err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestHandleHeaders ensures the headers of fanned out functions are merged
+// and the longest Retry-After is kept.
+func TestHandleHeaders(t *testing.T) {
+	withHeader := func(header http.Header) HandlerFunc {
+		return func(req handler.Request) (handler.Response, error) {
+			return handler.Response{StatusCode: http.StatusTooManyRequests, Header: header}, errors.New("saturated")
+		}
+	}
+
+	m := NewMux()
+	if err := m.Register("tagger", withHeader(http.Header{"Retry-After": {"5"}, "X-Rule": {"prod"}, "Content-Type": {"text/plain"}}), "VmPoweredOnEvent"); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	if err := m.Register("notifier", withHeader(http.Header{"Retry-After": {"30"}, "X-Rule": {"prod"}}), "VmPoweredOnEvent"); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	res, _ := m.Handle(handler.Request{Header: http.Header{"Ce-Subject": {"VmPoweredOnEvent"}}})
+
+	var tests = []struct {
+		testDesc string
+		header   string
+		want     []string
+	}{
+		{"Test that the longest Retry-After is kept", "Retry-After", []string{"30"}},
+		{"Test that other headers are merged once", "X-Rule", []string{"prod"}},
+		{"Test that the content type describes the merged body", "Content-Type", []string{"application/json"}},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if got := res.Header.Values(tc.header); reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestHandleEncoded ensures compressed structured events are routed.
+func TestHandleEncoded(t *testing.T) {
+	m := NewMux()
+	if err := m.Register("tagger", fn(http.StatusOK, "", nil), "VmPoweredOnEvent"); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	event := []byte(`{"id":"1","subject":"VmPoweredOnEvent","data":{}}`)
+
+	var gz, zl, fl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	zw := zlib.NewWriter(&zl)
+	fw, err := flate.NewWriter(&fl, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	for _, w := range []io.WriteCloser{gw, zw, fw} {
+		if _, err := w.Write(event); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+	}
+
+	var tests = []struct {
+		testDesc   string
+		encoding   string
+		body       []byte
+		expectErr  bool
+		wantStatus int
+	}{
+		{"Test that a gzip event is routed", "gzip", gz.Bytes(), false, http.StatusOK},
+		{"Test that a zlib deflate event is routed", "deflate", zl.Bytes(), false, http.StatusOK},
+		{"Test that a raw deflate event is routed", "deflate", fl.Bytes(), false, http.StatusOK},
+		{"Test that an unsupported encoding results in 400", "br", event, true, http.StatusBadRequest},
+		{"Test that a corrupt gzip event results in 400", "gzip", event, true, http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		res, err := m.Handle(handler.Request{Header: http.Header{"Content-Encoding": {tc.encoding}}, Body: tc.body})
+		if (err != nil) == tc.expectErr && res.StatusCode == tc.wantStatus {
+			t.Logf("got expected: %v. %v", res.StatusCode, passMark)
+		} else {
+			t.Logf("expected status %v, error %v, got: %v %s, %v. %v", tc.wantStatus, tc.expectErr, res.StatusCode, res.Body, err, failMark)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package function
+
+import (
+	"context"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Admission control policies.
+const (
+	policyResources     = "resources"      // percentage of cluster resources
+	policySlots         = "slots"          // host failures the cluster tolerates
+	policyFailoverHosts = "failover_hosts" // dedicated failover hosts
+)
+
+// level is a failover capacity and the capacity the admission control policy
+// requires.
+type level struct {
+	Current  int32 `json:"current"`
+	Required int32 `json:"required"`
+}
+
+// short reports whether the capacity is below the required capacity.
+func (l *level) short() bool {
+	return l != nil && l.Current < l.Required
+}
+
+// capacity is the failover capacity of a cluster under its admission control
+// policy. Only the fields of the policy are set.
+type capacity struct {
+	Policy        string `json:"policy"`
+	CPUPercent    *level `json:"cpu_percent,omitempty"`
+	MemoryPercent *level `json:"memory_percent,omitempty"`
+	FailoverLevel *level `json:"failover_level,omitempty"`
+	// UnavailableFailoverHosts are the dedicated failover hosts which
+	// cannot take over the VMs of a failed host.
+	UnavailableFailoverHosts []string `json:"unavailable_failover_hosts,omitempty"`
+}
+
+// breached reports whether the failover capacity is below the policy.
+func (c *capacity) breached() bool {
+	return c.CPUPercent.short() || c.MemoryPercent.short() || c.FailoverLevel.short() || len(c.UnavailableFailoverHosts) > 0
+}
+
+// hostUsage is a host of a cluster, the resources reserved by its powered on
+// VMs and why it does not provide failover capacity, if it does not.
+type hostUsage struct {
+	Host                string `json:"host"`
+	Name                string `json:"name"`
+	Reason              string `json:"reason,omitempty"`
+	CPUReservationMHz   int64  `json:"cpu_reservation_mhz"`
+	MemoryReservationMB int64  `json:"memory_reservation_mb"`
+}
+
+// vmUsage is a powered on VM of a cluster and the resources it reserves.
+type vmUsage struct {
+	VM                  string `json:"vm"`
+	Name                string `json:"name"`
+	HostName            string `json:"host_name,omitempty"`
+	CPUReservationMHz   int64  `json:"cpu_reservation_mhz"`
+	MemoryReservationMB int64  `json:"memory_reservation_mb"`
+}
+
+// assess returns the failover capacity of a cluster from its HA configuration
+// and summary. If the capacity cannot be assessed, e.g. because admission
+// control is disabled, it returns why instead.
+func assess(das *types.ClusterDasConfigInfo, summary *types.ClusterComputeResourceSummary) (*capacity, string) {
+	if das == nil || das.Enabled == nil || !*das.Enabled {
+		return nil, "HA disabled"
+	}
+	if das.AdmissionControlEnabled != nil && !*das.AdmissionControlEnabled {
+		return nil, "admission control disabled"
+	}
+	if summary == nil {
+		return nil, "no cluster summary"
+	}
+
+	switch p := das.AdmissionControlPolicy.(type) {
+	case *types.ClusterFailoverResourcesAdmissionControlPolicy:
+		info, ok := summary.AdmissionControlInfo.(*types.ClusterFailoverResourcesAdmissionControlInfo)
+		if !ok {
+			return nil, "failover capacity unknown"
+		}
+
+		return &capacity{
+			Policy:        policyResources,
+			CPUPercent:    &level{Current: info.CurrentCpuFailoverResourcesPercent, Required: p.CpuFailoverResourcesPercent},
+			MemoryPercent: &level{Current: info.CurrentMemoryFailoverResourcesPercent, Required: p.MemoryFailoverResourcesPercent},
+		}, ""
+
+	case *types.ClusterFailoverLevelAdmissionControlPolicy:
+		current := summary.CurrentFailoverLevel
+		if info, ok := summary.AdmissionControlInfo.(*types.ClusterFailoverLevelAdmissionControlInfo); ok {
+			current = info.CurrentFailoverLevel
+		}
+
+		return &capacity{
+			Policy:        policySlots,
+			FailoverLevel: &level{Current: current, Required: p.FailoverLevel},
+		}, ""
+
+	case *types.ClusterFailoverHostAdmissionControlPolicy:
+		info, ok := summary.AdmissionControlInfo.(*types.ClusterFailoverHostAdmissionControlInfo)
+		if !ok {
+			return nil, "failover capacity unknown"
+		}
+
+		c := capacity{Policy: policyFailoverHosts}
+		for _, s := range info.HostStatus {
+			// Yellow failover hosts run VMs, but still take over.
+			if s.Status == types.ManagedEntityStatusRed {
+				c.UnavailableFailoverHosts = append(c.UnavailableFailoverHosts, s.Host.Value)
+			}
+		}
+
+		return &c, ""
+	}
+
+	return nil, "unsupported admission control policy"
+}
+
+// rank orders hosts and VMs by their contribution to a breach and returns the
+// top of each. Hosts not providing failover capacity come first, then hosts
+// and VMs with the largest reservations, memory before CPU.
+func rank(hosts []hostUsage, vms []vmUsage, top int) ([]hostUsage, []vmUsage) {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		a, b := hosts[i], hosts[j]
+		if (a.Reason != "") != (b.Reason != "") {
+			return a.Reason != ""
+		}
+		if a.MemoryReservationMB != b.MemoryReservationMB {
+			return a.MemoryReservationMB > b.MemoryReservationMB
+		}
+		return a.CPUReservationMHz > b.CPUReservationMHz
+	})
+
+	// VMs without reservations only occupy the minimum slot and are not
+	// worth listing.
+	var reserving []vmUsage
+	for _, v := range vms {
+		if v.MemoryReservationMB > 0 || v.CPUReservationMHz > 0 {
+			reserving = append(reserving, v)
+		}
+	}
+	sort.SliceStable(reserving, func(i, j int) bool {
+		a, b := reserving[i], reserving[j]
+		if a.MemoryReservationMB != b.MemoryReservationMB {
+			return a.MemoryReservationMB > b.MemoryReservationMB
+		}
+		return a.CPUReservationMHz > b.CPUReservationMHz
+	})
+
+	if len(hosts) > top {
+		hosts = hosts[:top]
+	}
+	if len(reserving) > top {
+		reserving = reserving[:top]
+	}
+
+	return hosts, reserving
+}
+
+// check assesses the failover capacity of cluster. Breached clusters are
+// tagged and posted with the hosts and VMs contributing most to the breach,
+// restored clusters are untagged. Completed actions are added to rep.
+func check(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, cluster types.ManagedObjectReference) error {
+	c, err := clt.clusterHA(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	rep.Name = c.Name
+
+	fc, skipped := assess(c.DAS, c.Summary)
+	if fc == nil {
+		rep.Skipped = skipped
+		return nil
+	}
+	rep.Capacity = fc
+	rep.Breached = fc.breached()
+
+	if !rep.Breached {
+		return release(ctx, clt, cfg, rep, cluster)
+	}
+
+	hosts, vms, err := clt.usage(ctx, c.Hosts)
+	if err != nil {
+		return err
+	}
+	rep.Hosts, rep.VMs = rank(hosts, vms, cfg.top())
+
+	// The tag marks clusters already reported, so each breach is only
+	// posted once until the failover capacity is restored.
+	if cfg.Admission.TagURN != "" {
+		tagged, err := clt.tagged(ctx, cluster, cfg.Admission.TagURN)
+		if err != nil {
+			return err
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return nil
+		}
+
+		if err := clt.tag(ctx, cluster, cfg.Admission.TagURN); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "tagged")
+	}
+
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return nil
+	}
+
+	if err := notify(ctx, cfg, breachMessage(rep)); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "notified")
+
+	return nil
+}
+
+// release detaches the tag of breached clusters from cluster, if attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, cluster types.ManagedObjectReference) error {
+	if cfg.Admission.TagURN == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, cluster, cfg.Admission.TagURN)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, cluster, cfg.Admission.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// clusterHA holds the HA configuration and state of a cluster.
+type clusterHA struct {
+	Name    string
+	DAS     *types.ClusterDasConfigInfo
+	Summary *types.ClusterComputeResourceSummary
+	Hosts   []types.ManagedObjectReference
+}
+
+// clusterHA retrieves the HA configuration, the failover capacity and the
+// hosts of a cluster.
+func (clt *vsClient) clusterHA(ctx context.Context, ref types.ManagedObjectReference) (*clusterHA, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var cluster mo.ClusterComputeResource
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "configurationEx", "summary", "host"}, &cluster)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve HA state of cluster %v failed: %w", ref.Value, err)
+	}
+
+	c := clusterHA{Name: cluster.Name, Hosts: cluster.Host}
+
+	if cfg, ok := cluster.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+		c.DAS = &cfg.DasConfig
+	}
+	if s, ok := cluster.Summary.(*types.ClusterComputeResourceSummary); ok {
+		c.Summary = s
+	}
+
+	return &c, nil
+}
+
+// usage retrieves the resources reserved by the powered on VMs of hosts, per
+// host and per VM, and why a host does not provide failover capacity.
+func (clt *vsClient) usage(ctx context.Context, refs []types.ManagedObjectReference) ([]hostUsage, []vmUsage, error) {
+	if len(refs) == 0 {
+		return nil, nil, nil
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var hosts []mo.HostSystem
+	err := pc.Retrieve(ctx, refs, []string{"name", "runtime", "vm"}, &hosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieve hosts failed: %w", err)
+	}
+
+	var hu []hostUsage
+	var vu []vmUsage
+
+	for _, h := range hosts {
+		u := hostUsage{Host: h.Self.Value, Name: h.Name, Reason: unavailable(h.Runtime)}
+
+		if len(h.Vm) > 0 {
+			var vms []mo.VirtualMachine
+			err := pc.Retrieve(ctx, h.Vm, []string{"name", "runtime.powerState", "config.cpuAllocation", "config.memoryAllocation"}, &vms)
+			if err != nil {
+				return nil, nil, fmt.Errorf("retrieve reservations of the VMs of host %v failed: %w", h.Self.Value, err)
+			}
+
+			for _, vm := range vms {
+				// Only powered on VMs hold their reservations.
+				if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn || vm.Config == nil {
+					continue
+				}
+
+				v := vmUsage{
+					VM:                  vm.Self.Value,
+					Name:                vm.Name,
+					HostName:            h.Name,
+					CPUReservationMHz:   reservation(vm.Config.CpuAllocation),
+					MemoryReservationMB: reservation(vm.Config.MemoryAllocation),
+				}
+				u.CPUReservationMHz += v.CPUReservationMHz
+				u.MemoryReservationMB += v.MemoryReservationMB
+
+				vu = append(vu, v)
+			}
+		}
+
+		hu = append(hu, u)
+	}
+
+	return hu, vu, nil
+}
+
+// unavailable returns why a host does not provide failover capacity, empty if
+// it does.
+func unavailable(rt types.HostRuntimeInfo) string {
+	switch {
+	case rt.ConnectionState != types.HostSystemConnectionStateConnected:
+		return string(rt.ConnectionState)
+	case rt.InMaintenanceMode:
+		return "maintenance mode"
+	case rt.PowerState == types.HostSystemPowerStateStandBy:
+		return "standby"
+	case rt.PowerState == types.HostSystemPowerStatePoweredOff:
+		return "powered off"
+	}
+
+	return ""
+}
+
+// reservation returns the reservation of an allocation, in MHz for CPU and MB
+// for memory.
+func reservation(a *types.ResourceAllocationInfo) int64 {
+	if a == nil || a.Reservation == nil {
+		return 0
+	}
+
+	return *a.Reservation
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
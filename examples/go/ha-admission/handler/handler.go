@@ -0,0 +1,352 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents check the failover capacity of their cluster if no events are
+// configured.
+var defaultEvents = []string{"InsufficientFailoverResourcesEvent", "FailoverLevelRestored", "ClusterOvercommittedEvent", "DasHostFailedEvent"}
+
+// defaultTop is the number of hosts and VMs listed as contributors to a breach
+// if top is not configured.
+const defaultTop = 5
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Admission struct {
+		// Events check the failover capacity of their cluster, by default
+		// defaultEvents.
+		Events []string
+		// TagURN is attached to clusters whose failover capacity is below
+		// the admission control policy and detached once it is restored.
+		TagURN string `toml:"tag_urn"`
+		// Top limits the hosts and VMs listed as contributors to a breach,
+		// by default defaultTop.
+		Top int
+	}
+	Notify struct {
+		// Clusters whose failover capacity is breached are posted to the
+		// configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		ComputeResource *types.ComputeResourceEventArgument `json:"ComputeResource,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the failover capacity of a cluster, the hosts and VMs
+// contributing most to a breach and the actions taken.
+type report struct {
+	Event    string      `json:"event"`
+	Cluster  string      `json:"cluster"`
+	Name     string      `json:"name,omitempty"`
+	Capacity *capacity   `json:"capacity,omitempty"`
+	Breached bool        `json:"breached"`
+	Hosts    []hostUsage `json:"hosts,omitempty"`
+	VMs      []vmUsage   `json:"vms,omitempty"`
+	Skipped  string      `json:"skipped,omitempty"`
+	Actions  []string    `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	cr := event.Data.ComputeResource
+	rep := report{
+		Event:   event.Subject,
+		Cluster: cr.ComputeResource.Value,
+		Name:    cr.Name,
+	}
+
+	actionErr := check(ctx, clt, cfg, &rep, cr.ComputeResource)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("checking of failover capacity failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether event checks the failover capacity of its cluster.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Admission.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// top returns the number of hosts and VMs listed as contributors to a breach.
+func (cfg *vcConfig) top() int {
+	if cfg.Admission.Top > 0 {
+		return cfg.Admission.Top
+	}
+
+	return defaultTop
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// A breach nobody learns about is not worth checking.
+	if cfg.Admission.TagURN == "" && cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return errors.New("required field(s) missing, including admission tag_urn or a notify sink")
+	}
+
+	if cfg.Admission.Top < 0 {
+		return errors.New("admission top must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event of a cluster.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	cr := event.Data.ComputeResource
+	if cr == nil || cr.ComputeResource.Value == "" {
+		return nil, errors.New("empty cluster")
+	}
+
+	// Standalone hosts are compute resources too, but have no HA.
+	if cr.ComputeResource.Type != "ClusterComputeResource" {
+		return nil, fmt.Errorf("compute resource %v is not a cluster", cr.ComputeResource.Value)
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
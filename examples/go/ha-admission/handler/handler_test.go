@@ -0,0 +1,446 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Admission.Events = []string{"InsufficientFailoverResourcesEvent", "FailoverLevelRestored"}
+	tagged.Admission.TagURN = "urn:vmomi:InventoryServiceTag:3c7e9a51-2f4d-4b8e-a6c1-8d0b5e2f7a34:GLOBAL"
+	tagged.Admission.Top = 3
+	tagged.Notify.SlackWebhookURL = "https://hooks.slack.com/services/ha"
+
+	notified := vcConfig{}
+	notified.VCenter = tagged.VCenter
+	notified.VCenter.Insecure = true
+	notified.Notify.WebhookURL = "https://hooks.local.corp/ha"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a tag loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file with only a webhook loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&notified,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag or sinks results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with a negative top results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures configured events of a cluster are read and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that insufficient failover resources event is readable", "testdata/event.json", false, "domain-c7"},
+		{"Test that failover level restored event is readable", "testdata/event2.json", false, "domain-c7"},
+		{"Event should return error if cluster is empty", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+		{"Event should return error if compute resource is no cluster", "testdata/eventErr3.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.Data.ComputeResource.ComputeResource.Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestAssess shows the failover capacity is read for each admission control
+// policy and is breached when below the policy.
+func TestAssess(t *testing.T) {
+	das := func(policy types.BaseClusterDasAdmissionControlPolicy) *types.ClusterDasConfigInfo {
+		return &types.ClusterDasConfigInfo{
+			Enabled:                 types.NewBool(true),
+			AdmissionControlEnabled: types.NewBool(true),
+			AdmissionControlPolicy:  policy,
+		}
+	}
+	resources := &types.ClusterFailoverResourcesAdmissionControlPolicy{CpuFailoverResourcesPercent: 25, MemoryFailoverResourcesPercent: 25}
+	slots := &types.ClusterFailoverLevelAdmissionControlPolicy{FailoverLevel: 1}
+	hosts := &types.ClusterFailoverHostAdmissionControlPolicy{}
+
+	summary := func(info types.BaseClusterDasAdmissionControlInfo) *types.ClusterComputeResourceSummary {
+		return &types.ClusterComputeResourceSummary{AdmissionControlInfo: info}
+	}
+	percent := func(cpu, mem int32) *types.ClusterComputeResourceSummary {
+		return summary(&types.ClusterFailoverResourcesAdmissionControlInfo{CurrentCpuFailoverResourcesPercent: cpu, CurrentMemoryFailoverResourcesPercent: mem})
+	}
+	status := func(s types.ManagedEntityStatus) *types.ClusterComputeResourceSummary {
+		return summary(&types.ClusterFailoverHostAdmissionControlInfo{HostStatus: []types.ClusterFailoverHostAdmissionControlInfoHostStatus{
+			{Host: types.ManagedObjectReference{Type: "HostSystem", Value: "host-21"}, Status: s},
+		}})
+	}
+
+	disabled := das(resources)
+	disabled.AdmissionControlEnabled = types.NewBool(false)
+
+	var tests = []struct {
+		testDesc     string
+		das          *types.ClusterDasConfigInfo
+		summary      *types.ClusterComputeResourceSummary
+		wantSkipped  string
+		wantPolicy   string
+		wantBreached bool
+	}{
+		{"Test that a cluster without HA is skipped", &types.ClusterDasConfigInfo{}, percent(50, 50), "HA disabled", "", false},
+		{"Test that a cluster without admission control is skipped", disabled, percent(10, 10), "admission control disabled", "", false},
+		{"Test that enough failover resources are not breached", das(resources), percent(30, 25), "", policyResources, false},
+		{"Test that too little memory failover resources are breached", das(resources), percent(40, 18), "", policyResources, true},
+		{"Test that too little CPU failover resources are breached", das(resources), percent(12, 40), "", policyResources, true},
+		{"Test that unknown failover resources are skipped", das(resources), summary(nil), "failover capacity unknown", "", false},
+		{"Test that a tolerated host failure is not breached", das(slots), &types.ClusterComputeResourceSummary{CurrentFailoverLevel: 1}, "", policySlots, false},
+		{"Test that no tolerated host failure is breached", das(slots), summary(&types.ClusterFailoverLevelAdmissionControlInfo{CurrentFailoverLevel: 0}), "", policySlots, true},
+		{"Test that a failover host running VMs is not breached", das(hosts), status(types.ManagedEntityStatusYellow), "", policyFailoverHosts, false},
+		{"Test that an unavailable failover host is breached", das(hosts), status(types.ManagedEntityStatusRed), "", policyFailoverHosts, true},
+		{"Test that a cluster without policy is skipped", das(nil), percent(10, 10), "unsupported admission control policy", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		c, skipped := assess(tc.das, tc.summary)
+		if c == nil {
+			if skipped == tc.wantSkipped && tc.wantSkipped != "" {
+				t.Logf("got expected: skipped %q. %v", skipped, passMark)
+			} else {
+				t.Logf("expected policy %q, got: skipped %q. %v", tc.wantPolicy, skipped, failMark)
+				t.Fail()
+			}
+			continue
+		}
+
+		if c.Policy == tc.wantPolicy && c.breached() == tc.wantBreached && tc.wantSkipped == "" {
+			t.Logf("got expected: %+v. %v", c, passMark)
+		} else {
+			t.Logf("expected policy %q, breached %v, skipped %q, got: %+v. %v", tc.wantPolicy, tc.wantBreached, tc.wantSkipped, c, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRank shows hosts without failover capacity and the largest reservations
+// are listed first and VMs without reservations are not listed.
+func TestRank(t *testing.T) {
+	hosts := []hostUsage{
+		{Name: "esx-01", MemoryReservationMB: 4096},
+		{Name: "esx-02", MemoryReservationMB: 16384},
+		{Name: "esx-03", Reason: "maintenance mode"},
+		{Name: "esx-04", MemoryReservationMB: 16384, CPUReservationMHz: 8000},
+	}
+	vms := []vmUsage{
+		{Name: "web-01"},
+		{Name: "db-01", MemoryReservationMB: 16384},
+		{Name: "app-01", CPUReservationMHz: 2000},
+		{Name: "db-02", MemoryReservationMB: 16384, CPUReservationMHz: 4000},
+	}
+
+	var tests = []struct {
+		testDesc  string
+		top       int
+		wantHosts string
+		wantVMs   string
+	}{
+		{"Test that all hosts and reserving VMs are ranked", 5, "esx-03,esx-04,esx-02,esx-01", "db-02,db-01,app-01"},
+		{"Test that only the top hosts and VMs are listed", 2, "esx-03,esx-04", "db-02,db-01"},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		h, v := rank(append([]hostUsage(nil), hosts...), append([]vmUsage(nil), vms...), tc.top)
+
+		var hn, vn []string
+		for _, u := range h {
+			hn = append(hn, u.Name)
+		}
+		for _, u := range v {
+			vn = append(vn, u.Name)
+		}
+
+		gotHosts, gotVMs := strings.Join(hn, ","), strings.Join(vn, ",")
+		if gotHosts == tc.wantHosts && gotVMs == tc.wantVMs {
+			t.Logf("got expected: %v, %v. %v", gotHosts, gotVMs, passMark)
+		} else {
+			t.Logf("expected: %v, %v, got: %v, %v. %v", tc.wantHosts, tc.wantVMs, gotHosts, gotVMs, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestCheck ensures clusters whose failover capacity is breached are tagged
+// and posted once with their contributors and untagged once it is restored.
+func TestCheck(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		posts = append(posts, string(b))
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "ha", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "failover-capacity-breached", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		cluster, err := finder.ClusterComputeResource(ctx, "DC0_C0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vm, err := finder.VirtualMachine(ctx, "DC0_C0_RP0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		host, err := finder.HostSystem(ctx, "DC0_C0/DC0_C0_H1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Admission.TagURN = tagID
+		cfg.Notify.WebhookURL = srv.URL
+
+		cc := simulator.Map.Get(cluster.Reference()).(*simulator.ClusterComputeResource)
+		failover := func(cpu, mem int32) func() {
+			return func() {
+				cc.Summary = &types.ClusterComputeResourceSummary{
+					AdmissionControlInfo: &types.ClusterFailoverResourcesAdmissionControlInfo{
+						CurrentCpuFailoverResourcesPercent:    cpu,
+						CurrentMemoryFailoverResourcesPercent: mem,
+					},
+				}
+			}
+		}
+		enable := func() {
+			cc.ConfigurationEx.(*types.ClusterConfigInfoEx).DasConfig = types.ClusterDasConfigInfo{
+				Enabled:                 types.NewBool(true),
+				AdmissionControlEnabled: types.NewBool(true),
+				AdmissionControlPolicy: &types.ClusterFailoverResourcesAdmissionControlPolicy{
+					CpuFailoverResourcesPercent:    25,
+					MemoryFailoverResourcesPercent: 25,
+				},
+			}
+			failover(40, 40)()
+		}
+		breach := func() {
+			failover(35, 18)()
+
+			v := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine)
+			v.Config.MemoryAllocation = &types.ResourceAllocationInfo{Reservation: types.NewInt64(8192)}
+
+			h := simulator.Map.Get(host.Reference()).(*simulator.HostSystem)
+			h.Runtime.InMaintenanceMode = true
+		}
+
+		var tests = []struct {
+			testDesc     string
+			setup        func()
+			wantBreached bool
+			wantSkipped  bool
+			wantActions  string
+			wantPosts    int
+		}{
+			{"Test that a cluster without HA is skipped", nil, false, true, "", 0},
+			{"Test that a cluster with enough failover capacity is not tagged", enable, false, false, "", 0},
+			{"Test that a breached cluster is tagged and posted", breach, true, false, "tagged,notified", 1},
+			{"Test that a tagged cluster is not posted again", nil, true, false, "already tagged", 1},
+			{"Test that a restored cluster is untagged", failover(30, 30), false, false, "untagged", 1},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			var rep report
+			if err := check(ctx, clt, &cfg, &rep, cluster.Reference()); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if rep.Breached == tc.wantBreached && (rep.Skipped != "") == tc.wantSkipped && got == tc.wantActions && len(posts) == tc.wantPosts {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected breached %v, skipped %v, actions %q and %d posts, got: %+v, %d posts. %v", tc.wantBreached, tc.wantSkipped, tc.wantActions, tc.wantPosts, rep, len(posts), failMark)
+				t.Fail()
+			}
+		}
+
+		// The post lists the host in maintenance mode and the reserving VM.
+		if len(posts) > 0 && strings.Contains(posts[0], "DC0_C0_H1") && strings.Contains(posts[0], "maintenance mode") && strings.Contains(posts[0], "DC0_C0_RP0_VM0") {
+			t.Logf("got expected contributors: %v. %v", posts[0], passMark)
+		} else {
+			t.Logf("expected contributors DC0_C0_H1 and DC0_C0_RP0_VM0, got: %v. %v", posts, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// breachMessage returns the notification of a cluster whose failover capacity
+// is below its admission control policy, listing the hosts and VMs
+// contributing most to the breach and what to do about it.
+func breachMessage(rep *report) message {
+	name := rep.Cluster
+	if rep.Name != "" {
+		name = rep.Name
+	}
+
+	msg := message{
+		Title: "HA failover capacity breached",
+		Text:  fmt.Sprintf("Failover capacity of cluster %v is below its HA admission control policy, VMs may not restart after a host failure", name),
+		Fields: map[string]string{
+			"cluster": rep.Cluster,
+		},
+		Time: time.Now().UTC(),
+	}
+
+	if c := rep.Capacity; c != nil {
+		msg.Fields["policy"] = c.Policy
+		if c.CPUPercent != nil {
+			msg.Fields["cpu_percent"] = fmt.Sprintf("%d%% of %d%% required", c.CPUPercent.Current, c.CPUPercent.Required)
+		}
+		if c.MemoryPercent != nil {
+			msg.Fields["memory_percent"] = fmt.Sprintf("%d%% of %d%% required", c.MemoryPercent.Current, c.MemoryPercent.Required)
+		}
+		if c.FailoverLevel != nil {
+			msg.Fields["failover_level"] = fmt.Sprintf("%d of %d host failures tolerated", c.FailoverLevel.Current, c.FailoverLevel.Required)
+		}
+		if len(c.UnavailableFailoverHosts) > 0 {
+			msg.Fields["unavailable_failover_hosts"] = strings.Join(c.UnavailableFailoverHosts, ", ")
+		}
+	}
+
+	var down bool
+	for _, h := range rep.Hosts {
+		v := fmt.Sprintf("%d MB and %d MHz reserved", h.MemoryReservationMB, h.CPUReservationMHz)
+		if h.Reason != "" {
+			down = true
+			v = h.Reason + ", " + v
+		}
+		msg.Fields["host "+h.Name] = v
+	}
+	for _, v := range rep.VMs {
+		msg.Fields["vm "+v.Name] = fmt.Sprintf("%d MB and %d MHz reserved on %v", v.MemoryReservationMB, v.CPUReservationMHz, v.HostName)
+	}
+
+	var actions []string
+	if down {
+		actions = append(actions, "return the hosts in maintenance mode, standby or disconnected to the cluster")
+	}
+	if len(rep.VMs) > 0 {
+		actions = append(actions, "reduce the reservations of the listed VMs or move them out of the cluster")
+	}
+	actions = append(actions, "add hosts or lower the failover capacity of the admission control policy")
+	msg.Fields["action"] = strings.Join(actions, "; ")
+
+	return msg
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ntpService is the key of the NTP daemon in the host service system.
+const ntpService = "ntpd"
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// remediate restores time synchronization of a host or of all hosts in a
+// cluster. Per-host failures are collected in the report.
+func (clt *vsClient) remediate(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference) (*report, error) {
+	hosts := []types.ManagedObjectReference{ref}
+
+	if ref.Type == "ClusterComputeResource" {
+		var cluster mo.ClusterComputeResource
+		pc := property.DefaultCollector(clt.govmomi.Client)
+		err := pc.RetrieveOne(ctx, ref, []string{"host"}, &cluster)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve hosts of cluster %v failed: %w", ref.Value, err)
+		}
+		hosts = cluster.Host
+	}
+
+	rep := report{
+		Remediated: []string{},
+		Compliant:  []string{},
+		Failed:     map[string]string{},
+	}
+
+	for _, h := range hosts {
+		host := object.NewHostSystem(clt.govmomi.Client, h)
+
+		name, err := host.ObjectName(ctx)
+		if err != nil {
+			name = h.Value
+		}
+
+		changed, err := clt.remediateHost(ctx, cfg, host)
+		switch {
+		case err != nil:
+			rep.Failed[name] = err.Error()
+		case changed:
+			rep.Remediated = append(rep.Remediated, name)
+		default:
+			rep.Compliant = append(rep.Compliant, name)
+		}
+	}
+
+	return &rep, nil
+}
+
+// remediateHost configures the NTP servers, enables ntpd and restarts it if
+// the configuration changed or the host clock drifted. It reports whether the
+// host was changed.
+func (clt *vsClient) remediateHost(ctx context.Context, cfg *vcConfig, host *object.HostSystem) (bool, error) {
+	var props mo.HostSystem
+	err := host.Properties(ctx, host.Reference(), []string{"runtime.connectionState", "configManager.dateTimeSystem"}, &props)
+	if err != nil {
+		return false, fmt.Errorf("retrieve host properties failed: %w", err)
+	}
+
+	if props.Runtime.ConnectionState != types.HostSystemConnectionStateConnected {
+		return false, fmt.Errorf("host is %v", props.Runtime.ConnectionState)
+	}
+
+	if props.ConfigManager.DateTimeSystem == nil {
+		return false, fmt.Errorf("host has no date time system")
+	}
+
+	var dts mo.HostDateTimeSystem
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err = pc.RetrieveOne(ctx, *props.ConfigManager.DateTimeSystem, []string{"dateTimeInfo"}, &dts)
+	if err != nil {
+		return false, fmt.Errorf("retrieve date time info failed: %w", err)
+	}
+
+	restart := false
+
+	if dts.DateTimeInfo.NtpConfig == nil || !sameServers(dts.DateTimeInfo.NtpConfig.Server, cfg.NTP.Servers) {
+		s := object.NewHostDateTimeSystem(clt.govmomi.Client, *props.ConfigManager.DateTimeSystem)
+		err = s.UpdateConfig(ctx, types.HostDateTimeConfig{
+			NtpConfig: &types.HostNtpConfig{Server: cfg.NTP.Servers},
+		})
+		if err != nil {
+			return false, fmt.Errorf("update ntp servers failed: %w", err)
+		}
+		restart = true
+	}
+
+	if !restart && cfg.NTP.MaxDriftSeconds > 0 {
+		s := object.NewHostDateTimeSystem(clt.govmomi.Client, *props.ConfigManager.DateTimeSystem)
+		now, err := s.Query(ctx)
+		if err != nil {
+			return false, fmt.Errorf("query host time failed: %w", err)
+		}
+
+		drift := time.Since(*now)
+		if drift < 0 {
+			drift = -drift
+		}
+		restart = drift > time.Duration(cfg.NTP.MaxDriftSeconds)*time.Second
+	}
+
+	ss, err := host.ConfigManager().ServiceSystem(ctx)
+	if err != nil {
+		return false, fmt.Errorf("host service system failed: %w", err)
+	}
+
+	services, err := ss.Service(ctx)
+	if err != nil {
+		return false, fmt.Errorf("list host services failed: %w", err)
+	}
+
+	var ntpd *types.HostService
+	for i := range services {
+		if services[i].Key == ntpService {
+			ntpd = &services[i]
+		}
+	}
+
+	if ntpd == nil {
+		return false, fmt.Errorf("host has no %v service", ntpService)
+	}
+
+	if ntpd.Policy != "on" {
+		err = ss.UpdatePolicy(ctx, ntpService, "on")
+		if err != nil {
+			return false, fmt.Errorf("enable %v failed: %w", ntpService, err)
+		}
+		restart = true
+	}
+
+	switch {
+	case !ntpd.Running:
+		err = ss.Start(ctx, ntpService)
+	case restart:
+		err = ss.Restart(ctx, ntpService)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("start %v failed: %w", ntpService, err)
+	}
+
+	return true, nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	err := clt.govmomi.Logout(ctx)
+	if err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
+
+// sameServers reports whether both lists contain the same servers in order.
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,318 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.NTP.Servers = []string{"0.pool.ntp.org", "1.pool.ntp.org"}
+	want.NTP.MaxDriftSeconds = 5
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml without ntp servers results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEventMoRef ensures the alarmed host or cluster, or the host of
+// other events is obtained from the event.
+func TestParseEventMoRef(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{
+			"Test that the alarmed cluster is returned for alarm events",
+			"testdata/event.json",
+			false,
+			"domain-c7",
+		},
+		{
+			"Test that the host is returned for host events",
+			"testdata/event2.json",
+			false,
+			"host-11",
+		},
+		{
+			"Event should return error if alarm entity is not a host or cluster",
+			"testdata/eventErr1.json",
+			true,
+			"",
+		},
+		{
+			"Event should return error if host is null",
+			"testdata/eventErr2.json",
+			true,
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		moRef, err := parseEventMoRef(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if moRef.Value == tc.want {
+			t.Logf("got expected: '%s'. %v", moRef.Value, passMark)
+		} else {
+			t.Logf("expected: '%s', got: '%s'. %v", tc.want, moRef.Value, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestSameServers ensures NTP server lists are compared in order.
+func TestSameServers(t *testing.T) {
+	if !sameServers([]string{"a", "b"}, []string{"a", "b"}) {
+		t.Fatalf("expected equal server lists. %v", failMark)
+	}
+	if sameServers([]string{"a", "b"}, []string{"b", "a"}) || sameServers([]string{"a"}, nil) {
+		t.Fatalf("expected different server lists. %v", failMark)
+	}
+	t.Logf("server lists compared as expected. %v", passMark)
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
+
+// dateTimeSystem is a HostDateTimeSystem for vcsim, which has none. Its clock
+// is off by drift.
+type dateTimeSystem struct {
+	mo.HostDateTimeSystem
+
+	drift time.Duration
+}
+
+func (s *dateTimeSystem) UpdateDateTimeConfig(req *types.UpdateDateTimeConfig) soap.HasFault {
+	s.DateTimeInfo.NtpConfig = req.Config.NtpConfig
+
+	return &methods.UpdateDateTimeConfigBody{Res: &types.UpdateDateTimeConfigResponse{}}
+}
+
+func (s *dateTimeSystem) QueryDateTime(req *types.QueryDateTime) soap.HasFault {
+	return &methods.QueryDateTimeBody{Res: &types.QueryDateTimeResponse{Returnval: time.Now().Add(s.drift)}}
+}
+
+// serviceSystem is a HostServiceSystem for vcsim, which has none. It counts
+// the restarts of its services.
+type serviceSystem struct {
+	mo.HostServiceSystem
+
+	restarts int
+}
+
+// service returns the service with key.
+func (s *serviceSystem) service(key string) *types.HostService {
+	for i := range s.ServiceInfo.Service {
+		if s.ServiceInfo.Service[i].Key == key {
+			return &s.ServiceInfo.Service[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *serviceSystem) UpdateServicePolicy(req *types.UpdateServicePolicy) soap.HasFault {
+	s.service(req.Id).Policy = req.Policy
+
+	return &methods.UpdateServicePolicyBody{Res: &types.UpdateServicePolicyResponse{}}
+}
+
+func (s *serviceSystem) StartService(req *types.StartService) soap.HasFault {
+	s.service(req.Id).Running = true
+
+	return &methods.StartServiceBody{Res: &types.StartServiceResponse{}}
+}
+
+func (s *serviceSystem) RestartService(req *types.RestartService) soap.HasFault {
+	s.restarts++
+
+	return &methods.RestartServiceBody{Res: &types.RestartServiceResponse{}}
+}
+
+// TestRemediate shows hosts with drifted NTP servers get the configured ones
+// and ntpd restarted, while compliant hosts are left alone.
+func TestRemediate(t *testing.T) {
+	cfg := &vcConfig{}
+	cfg.NTP.Servers = []string{"0.pool.ntp.org", "1.pool.ntp.org"}
+	cfg.NTP.MaxDriftSeconds = 5
+
+	var tests = []struct {
+		testDesc     string
+		servers      []string
+		drift        time.Duration
+		wantChanged  bool
+		wantRestarts int
+	}{
+		{
+			"Test that drifted NTP servers are replaced and ntpd is restarted",
+			[]string{"10.0.0.1"},
+			0,
+			true,
+			1,
+		},
+		{
+			"Test that ntpd is restarted if the host clock drifted",
+			cfg.NTP.Servers,
+			time.Minute,
+			true,
+			1,
+		},
+		{
+			"Test that a compliant host is left alone",
+			cfg.NTP.Servers,
+			0,
+			false,
+			0,
+		},
+	}
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+		host := simulator.Map.Any("HostSystem").(*simulator.HostSystem)
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+
+			dts := &dateTimeSystem{drift: tc.drift}
+			dts.Self = *host.ConfigManager.DateTimeSystem
+			dts.DateTimeInfo.NtpConfig = &types.HostNtpConfig{Server: tc.servers}
+			simulator.Map.Put(dts)
+
+			ss := &serviceSystem{}
+			ss.Self = *host.ConfigManager.ServiceSystem
+			ss.ServiceInfo = types.HostServiceInfo{Service: []types.HostService{{Key: ntpService, Policy: "on", Running: true}}}
+			simulator.Map.Put(ss)
+
+			rep, err := clt.remediate(ctx, cfg, host.Reference())
+			if err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			want := &report{Remediated: []string{}, Compliant: []string{}, Failed: map[string]string{}}
+			if tc.wantChanged {
+				want.Remediated = []string{host.Name}
+			} else {
+				want.Compliant = []string{host.Name}
+			}
+			if reflect.DeepEqual(rep, want) {
+				t.Logf("got expected: %v. %v", *want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", *want, *rep, failMark)
+				t.Fail()
+			}
+
+			if got := dts.DateTimeInfo.NtpConfig.Server; !reflect.DeepEqual(got, cfg.NTP.Servers) {
+				t.Logf("expected servers: %v, got: %v. %v", cfg.NTP.Servers, got, failMark)
+				t.Fail()
+			}
+			if ss.restarts != tc.wantRestarts {
+				t.Logf("expected %d restart(s) of %v, got: %d. %v", tc.wantRestarts, ntpService, ss.restarts, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// fieldKey returns the key of the VM custom attribute name. It is created if
+// it does not exist and create is set, otherwise the key is -1.
+func (clt *vsClient) fieldKey(ctx context.Context, name string, create bool) (int32, error) {
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return 0, fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	key, err := m.FindKey(ctx, name)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, object.ErrKeyNameNotFound) {
+		return 0, fmt.Errorf("find custom attribute %v failed: %w", name, err)
+	}
+	if !create {
+		return -1, nil
+	}
+
+	def, err := m.Add(ctx, name, "VirtualMachine", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("create custom attribute %v failed: %w", name, err)
+	}
+
+	return def.Key, nil
+}
+
+// alarmState retrieves the name, the alarm actions, the marker in the custom
+// attribute field and the triggered alarms of a VM.
+func (clt *vsClient) alarmState(ctx context.Context, ref types.ManagedObjectReference, field string) (*alarmState, error) {
+	key, err := clt.fieldKey(ctx, field, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err = pc.RetrieveOne(ctx, ref, []string{"name", "alarmActionsEnabled", "triggeredAlarmState", "customValue"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve alarms of %v failed: %w", ref.Value, err)
+	}
+
+	// Unset means enabled, as for VMs never changed.
+	st := alarmState{
+		Name:           vm.Name,
+		ActionsEnabled: vm.AlarmActionsEnabled == nil || *vm.AlarmActionsEnabled,
+	}
+
+	for _, v := range vm.CustomValue {
+		if s, ok := v.(*types.CustomFieldStringValue); ok && s.Key == key {
+			st.Marker = s.Value
+		}
+	}
+
+	if len(vm.TriggeredAlarmState) == 0 {
+		return &st, nil
+	}
+
+	refs := make([]types.ManagedObjectReference, len(vm.TriggeredAlarmState))
+	for i, a := range vm.TriggeredAlarmState {
+		refs[i] = a.Alarm
+	}
+
+	var alarms []mo.Alarm
+	err = pc.Retrieve(ctx, refs, []string{"info.name"}, &alarms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve alarm names failed: %w", err)
+	}
+
+	names := make(map[types.ManagedObjectReference]string, len(alarms))
+	for _, a := range alarms {
+		names[a.Self] = a.Info.Name
+	}
+
+	for _, a := range vm.TriggeredAlarmState {
+		st.Triggered = append(st.Triggered, triggeredAlarm{
+			Alarm:        a.Alarm,
+			Name:         names[a.Alarm],
+			Status:       a.OverallStatus,
+			Acknowledged: a.Acknowledged != nil && *a.Acknowledged,
+		})
+	}
+
+	return &st, nil
+}
+
+// setAlarmActions enables or disables the alarm actions of a VM. Alarms are
+// still triggered, but their actions, e.g. emails or scripts, are not run.
+func (clt *vsClient) setAlarmActions(ctx context.Context, ref types.ManagedObjectReference, enabled bool) error {
+	c := clt.govmomi.Client
+
+	req := types.EnableAlarmActions{
+		This:    *c.ServiceContent.AlarmManager,
+		Entity:  ref,
+		Enabled: enabled,
+	}
+
+	_, err := methods.EnableAlarmActions(ctx, c, &req)
+	if err != nil {
+		return fmt.Errorf("set alarm actions of %v to %v failed: %w", ref.Value, enabled, err)
+	}
+
+	return nil
+}
+
+// acknowledge acknowledges a triggered alarm on a VM.
+func (clt *vsClient) acknowledge(ctx context.Context, alarm, ref types.ManagedObjectReference) error {
+	c := clt.govmomi.Client
+
+	req := types.AcknowledgeAlarm{
+		This:   *c.ServiceContent.AlarmManager,
+		Alarm:  alarm,
+		Entity: ref,
+	}
+
+	_, err := methods.AcknowledgeAlarm(ctx, c, &req)
+	if err != nil {
+		return fmt.Errorf("acknowledge alarm %v on %v failed: %w", alarm.Value, ref.Value, err)
+	}
+
+	return nil
+}
+
+// setMarker records task in the custom attribute field of a VM, an empty task
+// clears it. Custom attributes are set without reconfiguring the VM, so the
+// marker triggers no further reconfigure events.
+func (clt *vsClient) setMarker(ctx context.Context, ref types.ManagedObjectReference, field, task string) error {
+	key, err := clt.fieldKey(ctx, field, task != "")
+	if err != nil {
+		return err
+	}
+	if key == -1 {
+		// Nothing to clear.
+		return nil
+	}
+
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	err = m.Set(ctx, ref, key, task)
+	if err != nil {
+		return fmt.Errorf("mark %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// waitTask waits until a task succeeded or failed and returns its final
+// state.
+func (clt *vsClient) waitTask(ctx context.Context, ref types.ManagedObjectReference) (types.TaskInfoState, error) {
+	var state types.TaskInfoState
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := property.Wait(ctx, pc, ref, []string{"info.state"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if s, ok := c.Val.(types.TaskInfoState); ok {
+				state = s
+			}
+		}
+
+		return state == types.TaskInfoStateSuccess || state == types.TaskInfoStateError
+	})
+	if err != nil {
+		return "", fmt.Errorf("wait for task %v failed: %w", ref.Value, err)
+	}
+
+	return state, nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	if err := clt.govmomi.Logout(ctx); err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
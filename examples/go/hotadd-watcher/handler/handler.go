@@ -0,0 +1,415 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Defaults of vcconfig.toml.
+const (
+	// defaultField is the custom attribute marking VMs whose alarm actions
+	// were disabled by the function.
+	defaultField       = "veba.plannedResize"
+	defaultWaitSeconds = 120
+)
+
+// reconfigureTask is the description id of the tasks reconfiguring a VM.
+const reconfigureTask = "VirtualMachine.reconfigure"
+
+// defaultAlarms are acknowledged if no alarms are configured. They are the
+// vCenter default alarms a resize typically triggers.
+var defaultAlarms = []string{"Virtual machine CPU usage", "Virtual machine memory usage"}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Resize struct {
+		// Users are the vCenter users of the automation. Only their
+		// reconfigures are planned resizes.
+		Users []string
+		// Alarms are the names of the alarms acknowledged during a
+		// planned resize, by default defaultAlarms.
+		Alarms []string
+		// WaitSeconds is the maximum time waited for the reconfigure task
+		// before alarm actions are enabled again, by default
+		// defaultWaitSeconds.
+		WaitSeconds int `toml:"wait_seconds"`
+		// Field is the custom attribute marking VMs whose alarm actions
+		// were disabled, by default defaultField.
+		Field string
+	}
+}
+
+// Incoming is a subsection of a Cloud Event. The task info of TaskEvent is
+// decoded partially, since its reason and error cannot be decoded from JSON.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		types.Event
+
+		Info *taskInfo `json:"Info,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// taskInfo is the subset of types.TaskInfo describing the task.
+type taskInfo struct {
+	Task          types.ManagedObjectReference
+	DescriptionId string
+}
+
+// report describes a reconfigure of a VM and the actions taken.
+type report struct {
+	Event string `json:"event"`
+	VM    string `json:"vm"`
+	Name  string `json:"name,omitempty"`
+	User  string `json:"user"`
+	Task  string `json:"task,omitempty"`
+	// TaskState is the final state of the task, empty if the function did
+	// not wait for it.
+	TaskState string   `json:"task_state,omitempty"`
+	Skipped   string   `json:"skipped,omitempty"`
+	Actions   []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	rep := report{
+		Event: event.Subject,
+		VM:    event.Data.Vm.Vm.Value,
+		Name:  event.Data.Vm.Name,
+		User:  event.Data.UserName,
+	}
+	if event.Data.Info != nil {
+		rep.Task = event.Data.Info.Task.Value
+	}
+
+	rep.Skipped = skipReason(cfg, event)
+	if rep.Skipped != "" {
+		return respond(&rep, nil)
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	vm := event.Data.Vm.Vm
+	if event.Data.Info != nil {
+		err = planned(ctx, clt, cfg, &rep, vm, event.Data.Info.Task)
+	} else {
+		err = restore(ctx, clt, cfg, &rep, vm, "")
+	}
+
+	return respond(&rep, err)
+}
+
+// respond returns rep as JSON, with status 500 if actionErr is set.
+func respond(rep *report, actionErr error) (handler.Response, error) {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("handling of resize failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// skipReason returns why event is no planned resize, empty if it is one.
+func skipReason(cfg *vcConfig, event *incoming) string {
+	if event.Data.Info != nil && event.Data.Info.DescriptionId != reconfigureTask {
+		return fmt.Sprintf("task %v is no reconfigure", event.Data.Info.DescriptionId)
+	}
+
+	if !cfg.automation(event.Data.UserName) {
+		return fmt.Sprintf("user %q is no automation user", event.Data.UserName)
+	}
+
+	return ""
+}
+
+// wait returns the maximum time waited for a reconfigure task.
+func (cfg *vcConfig) wait() time.Duration {
+	if cfg.Resize.WaitSeconds == 0 {
+		return defaultWaitSeconds * time.Second
+	}
+
+	return time.Duration(cfg.Resize.WaitSeconds) * time.Second
+}
+
+// field returns the custom attribute marking VMs whose alarm actions were
+// disabled.
+func (cfg *vcConfig) field() string {
+	if cfg.Resize.Field == "" {
+		return defaultField
+	}
+
+	return cfg.Resize.Field
+}
+
+// alarms returns the names of the alarms acknowledged during a resize.
+func (cfg *vcConfig) alarms() []string {
+	if len(cfg.Resize.Alarms) == 0 {
+		return defaultAlarms
+	}
+
+	return cfg.Resize.Alarms
+}
+
+// automation reports whether user is a user of the automation. vCenter
+// reports users in different cases, e.g. VSPHERE.LOCAL\svc-resize.
+func (cfg *vcConfig) automation(user string) bool {
+	for _, u := range cfg.Resize.Users {
+		if strings.EqualFold(u, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// Alarms of resizes by operators must not be silenced.
+	if len(cfg.Resize.Users) == 0 {
+		return errors.New("required field(s) missing, including resize users")
+	}
+
+	if cfg.Resize.WaitSeconds < 0 {
+		return errors.New("resize wait_seconds must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a task or reconfigure event of a VM.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	switch event.Subject {
+	case "TaskEvent":
+		if event.Data.Info == nil || event.Data.Info.Task.Value == "" {
+			return nil, errors.New("empty task")
+		}
+	case "VmReconfiguredEvent":
+		// Only tasks carry their info.
+		event.Data.Info = nil
+	default:
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty virtual machine")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
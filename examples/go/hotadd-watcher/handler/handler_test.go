@@ -0,0 +1,391 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// fakeVCenter holds the alarms of a single VM and the state of a single task.
+type fakeVCenter struct {
+	st alarmState
+	// taskState is the final state of the task, empty if it keeps running.
+	taskState    types.TaskInfoState
+	failAck      bool
+	acknowledged []string
+}
+
+func (f *fakeVCenter) alarmState(context.Context, types.ManagedObjectReference, string) (*alarmState, error) {
+	st := f.st
+	return &st, nil
+}
+
+func (f *fakeVCenter) setAlarmActions(_ context.Context, _ types.ManagedObjectReference, enabled bool) error {
+	f.st.ActionsEnabled = enabled
+	return nil
+}
+
+func (f *fakeVCenter) acknowledge(_ context.Context, alarm, _ types.ManagedObjectReference) error {
+	if f.failAck {
+		return errors.New("acknowledge failed")
+	}
+	f.acknowledged = append(f.acknowledged, alarm.Value)
+	return nil
+}
+
+func (f *fakeVCenter) setMarker(_ context.Context, _ types.ManagedObjectReference, _, task string) error {
+	f.st.Marker = task
+	return nil
+}
+
+func (f *fakeVCenter) waitTask(ctx context.Context, _ types.ManagedObjectReference) (types.TaskInfoState, error) {
+	if f.taskState == "" {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return f.taskState, nil
+}
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Resize.Users = []string{`VSPHERE.LOCAL\svc-rightsizing`}
+	want.Resize.Alarms = []string{"Virtual machine CPU usage"}
+	want.Resize.WaitSeconds = 300
+	want.Resize.Field = "rightsizing.inProgress"
+
+	defaults := vcConfig{}
+	defaults.VCenter = want.VCenter
+	defaults.Resize.Users = want.Resize.Users
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that toml file with only users loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&defaults,
+		},
+		{
+			"Test that vcconfig.toml without resize users results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with negative wait results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+
+	t.Log("=========== Test that defaults apply to unset fields ===========")
+	if defaults.wait().Seconds() == defaultWaitSeconds && defaults.field() == defaultField &&
+		reflect.DeepEqual(defaults.alarms(), defaultAlarms) {
+		t.Logf("got expected defaults. %v", passMark)
+	} else {
+		t.Logf("expected defaults, got: %v, %v, %v. %v", defaults.wait(), defaults.field(), defaults.alarms(), failMark)
+		t.Fail()
+	}
+}
+
+// TestParseEvent ensures reconfigure tasks and events are read, tasks other
+// than reconfigures and users other than the automation are skipped and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig2.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		change    func(event *incoming)
+		expectErr bool
+		want      [3]string // vm, task, skipped
+	}{
+		{
+			"Test that reconfigure task of the automation is readable",
+			"testdata/event.json",
+			nil,
+			false,
+			[3]string{"vm-42", "task-1187", ""},
+		},
+		{
+			"Test that reconfigure event of the automation is readable",
+			"testdata/event2.json",
+			nil,
+			false,
+			[3]string{"vm-42", "", ""},
+		},
+		{
+			"Test that tasks other than reconfigures are skipped",
+			"testdata/event.json",
+			func(event *incoming) { event.Data.Info.DescriptionId = "VirtualMachine.powerOn" },
+			false,
+			[3]string{"vm-42", "task-1187", "task VirtualMachine.powerOn is no reconfigure"},
+		},
+		{
+			"Test that reconfigures of other users are skipped",
+			"testdata/event2.json",
+			func(event *incoming) { event.Data.UserName = `VSPHERE.LOCAL\operator` },
+			false,
+			[3]string{"vm-42", "", `user "VSPHERE.LOCAL\\operator" is no automation user`},
+		},
+		{
+			"Event should return error if task is null",
+			"testdata/eventErr1.json",
+			nil,
+			true,
+			[3]string{},
+		},
+		{
+			"Event should return error if it is no reconfigure event",
+			"testdata/eventErr2.json",
+			nil,
+			true,
+			[3]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if tc.change != nil {
+			tc.change(event)
+		}
+
+		got := [3]string{event.Data.Vm.Vm.Value, "", skipReason(cfg, event)}
+		if event.Data.Info != nil {
+			got[1] = event.Data.Info.Task.Value
+		}
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPlanned ensures alarm actions are disabled during a planned resize and
+// enabled again afterwards, unless an operator disabled them.
+func TestPlanned(t *testing.T) {
+	vm := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+	task := types.ManagedObjectReference{Type: "Task", Value: "task-1187"}
+
+	triggered := []triggeredAlarm{
+		{Alarm: types.ManagedObjectReference{Type: "Alarm", Value: "alarm-6"}, Name: "Virtual machine CPU usage", Status: types.ManagedEntityStatusRed},
+		{Alarm: types.ManagedObjectReference{Type: "Alarm", Value: "alarm-7"}, Name: "Virtual machine memory usage", Status: types.ManagedEntityStatusYellow, Acknowledged: true},
+		{Alarm: types.ManagedObjectReference{Type: "Alarm", Value: "alarm-9"}, Name: "Virtual machine error", Status: types.ManagedEntityStatusRed},
+	}
+
+	var tests = []struct {
+		testDesc    string
+		vc          fakeVCenter
+		expectErr   bool
+		wantActions []string
+		wantEnabled bool
+		wantMarker  string
+	}{
+		{
+			"Test that alarm actions are disabled and enabled again after the task",
+			fakeVCenter{st: alarmState{ActionsEnabled: true, Triggered: triggered}, taskState: types.TaskInfoStateSuccess},
+			false,
+			[]string{"disabled alarm actions", "acknowledged Virtual machine CPU usage", "enabled alarm actions"},
+			true,
+			"",
+		},
+		{
+			"Test that alarm actions stay disabled while the task is running",
+			fakeVCenter{st: alarmState{ActionsEnabled: true}},
+			false,
+			[]string{"disabled alarm actions", "task still running after 1s"},
+			false,
+			"task-1187",
+		},
+		{
+			"Test that alarm actions disabled by an operator stay disabled",
+			fakeVCenter{st: alarmState{}, taskState: types.TaskInfoStateError},
+			false,
+			[]string{"alarm actions disabled by an operator"},
+			false,
+			"",
+		},
+		{
+			"Test that alarm actions disabled for another resize are enabled after the last one",
+			fakeVCenter{st: alarmState{Marker: "task-1180"}, taskState: types.TaskInfoStateSuccess},
+			false,
+			[]string{"alarm actions already disabled for task-1180", "enabled alarm actions"},
+			true,
+			"",
+		},
+		{
+			"Test that alarm actions are enabled again if acknowledging fails",
+			fakeVCenter{st: alarmState{ActionsEnabled: true, Triggered: triggered}, taskState: types.TaskInfoStateSuccess, failAck: true},
+			true,
+			[]string{"disabled alarm actions", "enabled alarm actions"},
+			true,
+			"",
+		},
+	}
+
+	cfg := vcConfig{}
+	cfg.Resize.WaitSeconds = 1
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		vc := tc.vc
+
+		var rep report
+		err := planned(context.Background(), &vc, &cfg, &rep, vm, task)
+		if (err != nil) != tc.expectErr {
+			t.Logf("expected error: %v, got: %v. %v", tc.expectErr, err, failMark)
+			t.Fail()
+			continue
+		}
+
+		got := []interface{}{rep.Actions, vc.st.ActionsEnabled, vc.st.Marker}
+		want := []interface{}{tc.wantActions, tc.wantEnabled, tc.wantMarker}
+		if reflect.DeepEqual(got, want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRestore ensures the completion event enables only alarm actions the
+// function disabled.
+func TestRestore(t *testing.T) {
+	vm := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+
+	var tests = []struct {
+		testDesc    string
+		st          alarmState
+		wantActions []string
+		wantEnabled bool
+	}{
+		{"Test that alarm actions disabled by the function are enabled", alarmState{Marker: "task-1187"}, []string{"enabled alarm actions"}, true},
+		{"Test that alarm actions enabled meanwhile are left as they are", alarmState{ActionsEnabled: true, Marker: "task-1187"}, []string{"alarm actions enabled meanwhile"}, true},
+		{"Test that alarm actions disabled by an operator stay disabled", alarmState{}, nil, false},
+	}
+
+	cfg := vcConfig{}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		vc := fakeVCenter{st: tc.st}
+
+		var rep report
+		if err := restore(context.Background(), &vc, &cfg, &rep, vm, ""); err != nil {
+			t.Log(tc.testDesc, failMark, err)
+			t.Fail()
+			continue
+		}
+
+		got := []interface{}{rep.Actions, vc.st.ActionsEnabled, vc.st.Marker}
+		want := []interface{}{tc.wantActions, tc.wantEnabled, ""}
+		if reflect.DeepEqual(got, want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
@@ -0,0 +1,161 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vCenter reads and changes the alarms of VMs, it is replaced in tests.
+type vCenter interface {
+	alarmState(ctx context.Context, vm types.ManagedObjectReference, field string) (*alarmState, error)
+	setAlarmActions(ctx context.Context, vm types.ManagedObjectReference, enabled bool) error
+	acknowledge(ctx context.Context, alarm, vm types.ManagedObjectReference) error
+	setMarker(ctx context.Context, vm types.ManagedObjectReference, field, task string) error
+	waitTask(ctx context.Context, task types.ManagedObjectReference) (types.TaskInfoState, error)
+}
+
+// alarmState is the state of the alarms of a VM.
+type alarmState struct {
+	Name           string
+	ActionsEnabled bool
+	// Marker is the task whose resize disabled the alarm actions, empty if
+	// the function did not disable them.
+	Marker    string
+	Triggered []triggeredAlarm
+}
+
+// triggeredAlarm is an alarm triggered on a VM.
+type triggeredAlarm struct {
+	Alarm        types.ManagedObjectReference
+	Name         string
+	Status       types.ManagedEntityStatus
+	Acknowledged bool
+}
+
+// planned silences the alarms of vm during the planned resize of task: it
+// disables the alarm actions of vm, acknowledges the triggered alarms of the
+// resize and enables the alarm actions again once task is done. If task takes
+// longer than the configured wait, the alarm actions are enabled by the
+// completion event. Completed actions are added to rep.
+func planned(ctx context.Context, v vCenter, cfg *vcConfig, rep *report, vm, task types.ManagedObjectReference) error {
+	st, err := v.alarmState(ctx, vm, cfg.field())
+	if err != nil {
+		return err
+	}
+	if st.Name != "" {
+		rep.Name = st.Name
+	}
+
+	switch {
+	case st.ActionsEnabled:
+		// Mark the VM first, so actions disabled by a failed invocation
+		// are still enabled again.
+		if err := v.setMarker(ctx, vm, cfg.field(), task.Value); err != nil {
+			return err
+		}
+		if err := v.setAlarmActions(ctx, vm, false); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "disabled alarm actions")
+	case st.Marker != "":
+		// Overlapping resizes: the last one enables the actions again.
+		if err := v.setMarker(ctx, vm, cfg.field(), task.Value); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, fmt.Sprintf("alarm actions already disabled for %v", st.Marker))
+	default:
+		// Alarm actions disabled by an operator stay disabled.
+		rep.Actions = append(rep.Actions, "alarm actions disabled by an operator")
+	}
+
+	var errs []error
+
+	for _, a := range related(st.Triggered, cfg.alarms()) {
+		if err := v.acknowledge(ctx, a.Alarm, vm); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rep.Actions = append(rep.Actions, "acknowledged "+a.Name)
+	}
+
+	// Failed acknowledgements do not keep the alarm actions disabled.
+	waitCtx, cancel := context.WithTimeout(ctx, cfg.wait())
+	defer cancel()
+
+	state, err := v.waitTask(waitCtx, task)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			slog.Debug("resize still running", "vm", vm.Value, "task", task.Value, "wait", cfg.wait())
+			rep.Actions = append(rep.Actions, fmt.Sprintf("task still running after %v", cfg.wait()))
+			return errors.Join(errs...)
+		}
+		return errors.Join(append(errs, err)...)
+	}
+	rep.TaskState = string(state)
+
+	if err := restore(ctx, v, cfg, rep, vm, task.Value); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// restore enables the alarm actions of vm again, if the function disabled
+// them for task or, with an empty task, for any task. Actions enabled
+// meanwhile, e.g. by an operator, are left as they are. The marker is removed
+// last, so a failure is retried by the next event.
+func restore(ctx context.Context, v vCenter, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, task string) error {
+	st, err := v.alarmState(ctx, vm, cfg.field())
+	if err != nil {
+		return err
+	}
+	if st.Name != "" {
+		rep.Name = st.Name
+	}
+
+	if st.Marker == "" {
+		return nil
+	}
+
+	if task != "" && st.Marker != task {
+		rep.Actions = append(rep.Actions, fmt.Sprintf("alarm actions left disabled for %v", st.Marker))
+		return nil
+	}
+
+	if st.ActionsEnabled {
+		rep.Actions = append(rep.Actions, "alarm actions enabled meanwhile")
+	} else {
+		if err := v.setAlarmActions(ctx, vm, true); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "enabled alarm actions")
+	}
+
+	return v.setMarker(ctx, vm, cfg.field(), "")
+}
+
+// related returns the yellow or red alarms of triggered which are named in
+// names and not yet acknowledged.
+func related(triggered []triggeredAlarm, names []string) []triggeredAlarm {
+	var alarms []triggeredAlarm
+
+	for _, a := range triggered {
+		if a.Acknowledged || (a.Status != types.ManagedEntityStatusYellow && a.Status != types.ManagedEntityStatusRed) {
+			continue
+		}
+
+		for _, n := range names {
+			if strings.EqualFold(n, a.Name) {
+				alarms = append(alarms, a)
+				break
+			}
+		}
+	}
+
+	return alarms
+}
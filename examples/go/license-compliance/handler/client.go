@@ -0,0 +1,207 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+// usage is the license relevant capacity of a cluster.
+type usage struct {
+	Cluster string `json:"cluster"`
+	Name    string `json:"name"`
+	Hosts   int    `json:"hosts"`
+	Cores   int32  `json:"cores"`
+	VMs     int    `json:"powered_on_vms"`
+	VCPUs   int32  `json:"vcpus"`
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// clusters returns the references of all clusters.
+func (clt *vsClient) clusters(ctx context.Context) ([]types.ManagedObjectReference, error) {
+	c := clt.govmomi.Client
+	m := view.NewManager(c)
+
+	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"ClusterComputeResource"}, true)
+	if err != nil {
+		return nil, fmt.Errorf("create cluster view failed: %w", err)
+	}
+	defer v.Destroy(ctx)
+
+	refs, err := v.Find(ctx, []string{"ClusterComputeResource"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("find clusters failed: %w", err)
+	}
+
+	return refs, nil
+}
+
+// clusterUsage counts the physical cores of the hosts of a cluster and the
+// vCPUs of its powered on VMs.
+func (clt *vsClient) clusterUsage(ctx context.Context, ref types.ManagedObjectReference) (*usage, error) {
+	c := clt.govmomi.Client
+	pc := property.DefaultCollector(c)
+
+	var cluster mo.ClusterComputeResource
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "host"}, &cluster)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve cluster %v failed: %w", ref.Value, err)
+	}
+
+	u := usage{Cluster: ref.Value, Name: cluster.Name, Hosts: len(cluster.Host)}
+
+	var hosts []mo.HostSystem
+	if len(cluster.Host) > 0 {
+		err = pc.Retrieve(ctx, cluster.Host, []string{"summary.hardware"}, &hosts)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve hosts of %v failed: %w", ref.Value, err)
+		}
+	}
+
+	for _, h := range hosts {
+		if hw := h.Summary.Hardware; hw != nil {
+			u.Cores += int32(hw.NumCpuCores)
+		}
+	}
+
+	// The view of a cluster holds the VMs of its resource pools.
+	v, err := view.NewManager(c).CreateContainerView(ctx, ref, []string{"VirtualMachine"}, true)
+	if err != nil {
+		return nil, fmt.Errorf("create VM view of %v failed: %w", ref.Value, err)
+	}
+	defer v.Destroy(ctx)
+
+	var vms []mo.VirtualMachine
+	err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"config.hardware.numCPU", "runtime.powerState"}, &vms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VMs of %v failed: %w", ref.Value, err)
+	}
+
+	for _, vm := range vms {
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn || vm.Config == nil {
+			continue
+		}
+
+		u.VMs++
+		u.VCPUs += vm.Config.Hardware.NumCPU
+	}
+
+	return &u, nil
+}
+
+// tagged reports whether the tag is attached to ref.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	m := tags.NewManager(clt.rest)
+
+	ids, err := m.ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("list tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range ids {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to ref.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	m := tags.NewManager(clt.rest)
+
+	err := m.AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from ref.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	m := tags.NewManager(clt.rest)
+
+	err := m.DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ref returns the reference of the cluster of u.
+func (u usage) ref() types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "ClusterComputeResource", Value: u.Cluster}
+}
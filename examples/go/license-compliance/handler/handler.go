@@ -0,0 +1,445 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Defaults of vcconfig.toml.
+const (
+	defaultThresholdPercent = 90
+	defaultSummaryWeekday   = time.Monday
+)
+
+// summaryCheckInterval is how often the schedule of the weekly summary is
+// checked.
+const summaryCheckInterval = 10 * time.Minute
+
+// supportedEvents change the vCPUs of the powered on VMs of a cluster.
+var supportedEvents = map[string]bool{
+	"VmReconfiguredEvent":  true,
+	"VmPoweredOnEvent":     true,
+	"DrsVmPoweredOnEvent":  true,
+	"VmPoweredOffEvent":    true,
+	"VmSuspendedEvent":     true,
+	"VmGuestShutdownEvent": true,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	License struct {
+		// MaxVCPUs is the licensed number of vCPUs of the powered on VMs of a
+		// cluster. 0 does not limit vCPUs.
+		MaxVCPUs int32 `toml:"max_vcpus"`
+		// MaxCores is the licensed number of physical cores of the hosts of
+		// a cluster. 0 does not limit cores.
+		MaxCores int32 `toml:"max_cores"`
+		// ThresholdPercent of a limit marks a cluster as approaching it.
+		ThresholdPercent int32 `toml:"threshold_percent"`
+		// TagURN is attached to clusters approaching a limit and detached
+		// once they no longer are.
+		TagURN string `toml:"tag_urn"`
+	}
+	Summary struct {
+		// Weekday and Hour (UTC) of the weekly summary, by default Monday
+		// midnight.
+		Weekday string
+		Hour    int
+	}
+	Notify struct {
+		// The weekly summary is posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string        `json:"subject,omitempty"`
+	Data    types.VmEvent `json:"data,omitempty"`
+}
+
+// report describes the license usage of a cluster and the actions taken.
+type report struct {
+	Event       string   `json:"event"`
+	VM          string   `json:"vm,omitempty"`
+	Usage       usage    `json:"usage"`
+	Approaching bool     `json:"approaching"`
+	Reasons     []string `json:"reasons,omitempty"`
+	Actions     []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock        sync.Mutex // Lock protects client and lastUsed.
+	client      *vsClient  // Client persists vSphere connection.
+	lastUsed    time.Time  // LastUsed is when client was last handed out.
+	summaryOnce sync.Once  // For summaries() to be started once.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, cluster, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	summaryOnce.Do(func() {
+		go summaries(cfgPath)
+	})
+
+	rep := report{Event: event.Subject}
+	if event.Data.Vm != nil {
+		rep.VM = event.Data.Vm.Vm.Value
+	}
+
+	// VMs of standalone hosts are not counted.
+	if cluster == nil {
+		message := fmt.Sprintf("%v is not in a cluster, skipping", rep.VM)
+		slog.Info(message)
+
+		return handler.Response{
+			Body:       []byte(message),
+			StatusCode: http.StatusOK,
+		}, nil
+	}
+
+	u, err := clt.clusterUsage(ctx, *cluster)
+	if err != nil {
+		wrapErr := fmt.Errorf("counting license usage of %v failed: %w", cluster.Value, err)
+		slog.Debug("counting license usage failed", "cluster", cluster.Value, "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+	rep.Usage = *u
+	rep.Reasons = cfg.approaching(rep.Usage)
+	rep.Approaching = len(rep.Reasons) > 0
+
+	var actionErr error
+	if cfg.License.TagURN != "" {
+		actionErr = mark(ctx, clt, cfg, &rep)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("tagging of cluster failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// mark attaches the tag to a cluster approaching a license limit and detaches
+// it from a cluster which no longer is. Completed actions are added to rep.
+func mark(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report) error {
+	ref := rep.Usage.ref()
+
+	tagged, err := clt.tagged(ctx, ref, cfg.License.TagURN)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case rep.Approaching && !tagged:
+		if err := clt.tag(ctx, ref, cfg.License.TagURN); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "tagged")
+	case !rep.Approaching && tagged:
+		if err := clt.untag(ctx, ref, cfg.License.TagURN); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "untagged")
+	}
+
+	return nil
+}
+
+// approaching returns why a cluster with usage u approaches its license
+// limits, or nothing if it does not.
+func (cfg *vcConfig) approaching(u usage) []string {
+	var reasons []string
+
+	check := func(what string, count, limit int32) {
+		if limit <= 0 {
+			return
+		}
+
+		// Integer math, so 90% of 10 cores is 9 cores.
+		if count*100 >= limit*cfg.License.ThresholdPercent {
+			reasons = append(reasons, fmt.Sprintf("%d of %d licensed %v (%d%%)", count, limit, what, count*100/limit))
+		}
+	}
+
+	check("vCPUs", u.VCPUs, cfg.License.MaxVCPUs)
+	check("cores", u.Cores, cfg.License.MaxCores)
+
+	return reasons
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	if cfg.License.ThresholdPercent == 0 {
+		cfg.License.ThresholdPercent = defaultThresholdPercent
+	}
+	if cfg.Summary.Weekday == "" {
+		cfg.Summary.Weekday = defaultSummaryWeekday.String()
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.License.MaxVCPUs < 0 || cfg.License.MaxCores < 0 {
+		return errors.New("license limits must not be negative")
+	}
+
+	if t := cfg.License.ThresholdPercent; t < 0 || t > 100 {
+		return fmt.Errorf("license threshold_percent %d is not between 0 and 100", t)
+	}
+
+	if _, err := parseWeekday(cfg.Summary.Weekday); err != nil {
+		return err
+	}
+
+	if cfg.Summary.Hour < 0 || cfg.Summary.Hour > 23 {
+		return fmt.Errorf("summary hour %d is not between 0 and 23", cfg.Summary.Hour)
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a VM event and its cluster. The cluster is nil for VMs of
+// standalone hosts.
+func parseEvent(req []byte) (*incoming, *types.ManagedObjectReference, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !supportedEvents[event.Subject] {
+		return nil, nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	cr := event.Data.ComputeResource
+	if cr == nil || cr.ComputeResource.Value == "" {
+		return nil, nil, errors.New("empty compute resource")
+	}
+
+	if cr.ComputeResource.Type != "ClusterComputeResource" {
+		return &event, nil, nil
+	}
+
+	return &event, &cr.ComputeResource, nil
+}
+
+// parseWeekday returns the weekday named s, e.g. "monday".
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown summary weekday %q", s)
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
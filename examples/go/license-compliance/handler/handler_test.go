@@ -0,0 +1,389 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.License.MaxVCPUs = 256
+	want.License.MaxCores = 64
+	want.License.ThresholdPercent = 90
+	want.Summary.Weekday = "Monday"
+	want.Notify.SlackWebhookURL = "https://hooks.slack.com/services/T000/B000/XXXX"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly with default threshold and schedule",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml with unknown summary weekday results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the cluster of VM events is read and other events are
+// rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string // cluster
+	}{
+		{
+			"Test that the cluster of a reconfigured VM is readable",
+			"testdata/event.json",
+			false,
+			"domain-c7",
+		},
+		{
+			"Test that a VM of a standalone host has no cluster",
+			"testdata/event2.json",
+			false,
+			"",
+		},
+		{
+			"Event should return error if compute resource is null",
+			"testdata/eventErr1.json",
+			true,
+			"",
+		},
+		{
+			"Event should return error if it is no reconfigure or power event",
+			"testdata/eventErr2.json",
+			true,
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		_, cluster, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := ""
+		if cluster != nil {
+			got = cluster.Value
+		}
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestApproaching ensures clusters at or above the threshold of a limit are
+// reported.
+func TestApproaching(t *testing.T) {
+	cfg := &vcConfig{}
+	cfg.License.MaxVCPUs = 100
+	cfg.License.MaxCores = 10
+	cfg.License.ThresholdPercent = 90
+
+	var tests = []struct {
+		testDesc string
+		usage    usage
+		want     []string
+	}{
+		{"Test that a cluster below the thresholds is not approaching", usage{VCPUs: 89, Cores: 8}, nil},
+		{"Test that a cluster at the core threshold is approaching", usage{VCPUs: 10, Cores: 9}, []string{"9 of 10 licensed cores (90%)"}},
+		{
+			"Test that a cluster above both limits is approaching",
+			usage{VCPUs: 120, Cores: 12},
+			[]string{"120 of 100 licensed vCPUs (120%)", "12 of 10 licensed cores (120%)"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := cfg.approaching(tc.usage)
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestNextSummary ensures the weekly summary is scheduled at the configured
+// weekday and hour.
+func TestNextSummary(t *testing.T) {
+	cfg := &vcConfig{}
+	cfg.Summary.Weekday = "monday"
+	cfg.Summary.Hour = 8
+
+	// 2020-06-08 is a Monday.
+	var tests = []struct {
+		testDesc string
+		after    time.Time
+		want     time.Time
+	}{
+		{
+			"Test that the summary is later the same day",
+			time.Date(2020, 6, 8, 7, 59, 0, 0, time.UTC),
+			time.Date(2020, 6, 8, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			"Test that the summary is a week later if it was sent at the scheduled time",
+			time.Date(2020, 6, 8, 8, 0, 0, 0, time.UTC),
+			time.Date(2020, 6, 15, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			"Test that the summary is next Monday from a Friday",
+			time.Date(2020, 6, 12, 23, 0, 0, 0, time.UTC),
+			time.Date(2020, 6, 15, 8, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := nextSummary(tc.after, cfg)
+		if got.Equal(tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestClusterUsage shows the cores of the hosts of a cluster and the vCPUs of
+// its powered on VMs are counted.
+func TestClusterUsage(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		cluster := simulator.Map.Any("ClusterComputeResource").(*simulator.ClusterComputeResource)
+		var cores int32
+		for _, h := range cluster.Host {
+			cores += int32(simulator.Map.Get(h).(*simulator.HostSystem).Summary.Hardware.NumCpuCores)
+		}
+
+		t.Log("=========== Test that the hosts and powered on VMs of a cluster are counted ===========")
+		before, err := clt.clusterUsage(ctx, cluster.Reference())
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		if before.Name == cluster.Name && before.Hosts == len(cluster.Host) && before.Cores == cores && before.VMs > 0 && before.VCPUs >= int32(before.VMs) {
+			t.Logf("got expected: %+v. %v", *before, passMark)
+		} else {
+			t.Logf("expected %d hosts with %d cores and powered on VMs, got: %+v. %v", len(cluster.Host), cores, *before, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that powered off VMs are not counted ===========")
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_C0_RP0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := vm.PowerOff(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vcpus := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine).Config.Hardware.NumCPU
+
+		after, err := clt.clusterUsage(ctx, cluster.Reference())
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		if after.VMs == before.VMs-1 && after.VCPUs == before.VCPUs-vcpus {
+			t.Logf("got expected: %d VMs with %d vCPUs. %v", after.VMs, after.VCPUs, passMark)
+		} else {
+			t.Logf("expected: %d VMs with %d vCPUs, got: %+v. %v", before.VMs-1, before.VCPUs-vcpus, *after, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that an unknown cluster results in error ===========")
+		_, err = clt.clusterUsage(ctx, types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c404"})
+		if err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected error. %v", failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestMark shows clusters approaching a license limit are tagged once and
+// untagged when they no longer are.
+func TestMark(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "license", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "license-limit", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var cfg vcConfig
+		cfg.License.TagURN = tagID
+		cluster := simulator.Map.Any("ClusterComputeResource").Reference()
+
+		var tests = []struct {
+			testDesc    string
+			approaching bool
+			wantActions string
+			wantTagged  bool
+		}{
+			{"Test that a cluster approaching a limit is tagged", true, "tagged", true},
+			{"Test that a tagged cluster is not tagged again", true, "", true},
+			{"Test that a cluster no longer approaching a limit is untagged", false, "untagged", false},
+			{"Test that an untagged cluster within its limits is left alone", false, "", false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			rep := report{Usage: usage{Cluster: cluster.Value}, Approaching: tc.approaching}
+			if err := mark(ctx, clt, &cfg, &rep); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			tagged, err := clt.tagged(ctx, cluster, tagID)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			got := strings.Join(rep.Actions, ",")
+			if got == tc.wantActions && tagged == tc.wantTagged {
+				t.Logf("got expected: '%v', tagged %v. %v", got, tagged, passMark)
+			} else {
+				t.Logf("expected: '%v', tagged %v, got: '%v', tagged %v. %v", tc.wantActions, tc.wantTagged, got, tagged, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
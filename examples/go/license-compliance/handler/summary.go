@@ -0,0 +1,173 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// summaryTimeout limits the counting and delivery of a summary.
+const summaryTimeout = 5 * time.Minute
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// summaries posts the weekly summary at the configured time. The config is
+// reloaded before every check, so changing the schedule or the sinks does not
+// require a restart. Every replica posts its own summary.
+func summaries(path string) {
+	last := time.Now()
+
+	for {
+		time.Sleep(summaryCheckInterval)
+
+		cfg, err := loadTomlCfg(path)
+		if err != nil || (cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "") {
+			continue
+		}
+
+		now := time.Now()
+		if now.Before(nextSummary(last, cfg)) {
+			continue
+		}
+		last = now
+
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		if err := sendSummary(ctx, cfg, now); err != nil {
+			slog.Error("weekly summary failed", "err", err)
+		}
+		cancel()
+	}
+}
+
+// nextSummary returns the first scheduled summary after t.
+func nextSummary(t time.Time, cfg *vcConfig) time.Time {
+	// The weekday is validated when loading the config.
+	day, _ := parseWeekday(cfg.Summary.Weekday)
+
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month(), t.Day(), cfg.Summary.Hour, 0, 0, 0, time.UTC)
+	next = next.AddDate(0, 0, (int(day)-int(next.Weekday())+7)%7)
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 7)
+	}
+
+	return next
+}
+
+// sendSummary counts the license usage of all clusters and posts it to the
+// configured sinks.
+func sendSummary(ctx context.Context, cfg *vcConfig, now time.Time) error {
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	refs, err := clt.clusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	var usages []usage
+	for _, ref := range refs {
+		u, err := clt.clusterUsage(ctx, ref)
+		if err != nil {
+			return err
+		}
+		usages = append(usages, *u)
+	}
+
+	return notify(ctx, cfg, summary(cfg, usages, now))
+}
+
+// summary returns the weekly summary of usages. Each cluster is a field,
+// clusters approaching their limits are marked.
+func summary(cfg *vcConfig, usages []usage, now time.Time) message {
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Name < usages[j].Name })
+
+	msg := message{
+		Title:  "Weekly license summary",
+		Fields: map[string]string{},
+		Time:   now.UTC(),
+	}
+
+	approaching := 0
+	for _, u := range usages {
+		v := fmt.Sprintf("%d vCPUs of %d powered on VMs, %d cores of %d hosts", u.VCPUs, u.VMs, u.Cores, u.Hosts)
+
+		if reasons := cfg.approaching(u); len(reasons) > 0 {
+			approaching++
+			v += fmt.Sprintf(", approaching limits: %v", reasons)
+		}
+		msg.Fields[u.Name] = v
+	}
+	msg.Text = fmt.Sprintf("%d of %d cluster(s) approaching license limits", approaching, len(usages))
+
+	return msg
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,409 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Defaults of vcconfig.toml.
+const (
+	defaultMaxFailures   = 5
+	defaultWindowSeconds = 300
+)
+
+// supportedEvents are failed logins and logins of users without permission.
+var supportedEvents = map[string]bool{
+	"BadUsernameSessionEvent": true,
+	"NoAccessUserEvent":       true,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Watch struct {
+		// MaxFailures of a source within the window are tolerated, one more
+		// notifies the security channels.
+		MaxFailures int `toml:"max_failures"`
+		// WindowSeconds is the length of the sliding window failures are
+		// counted in.
+		WindowSeconds int `toml:"window_seconds"`
+		// TagURN is attached to the entity of the event exceeding the
+		// threshold, e.g. the host the logins failed on. vCenter settings
+		// are only required with a tag.
+		TagURN string `toml:"tag_urn"`
+	}
+	Notify struct {
+		// Sources exceeding the threshold are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event. BadUsernameSessionEvent and
+// NoAccessUserEvent have the same fields.
+type incoming struct {
+	Subject string                  `json:"subject,omitempty"`
+	Data    types.NoAccessUserEvent `json:"data,omitempty"`
+}
+
+// report describes the failures of a source and the actions taken.
+type report struct {
+	Event    string   `json:"event"`
+	User     string   `json:"user"`
+	IP       string   `json:"ip"`
+	Failures int      `json:"failures"`
+	Window   string   `json:"window"`
+	Exceeded bool     `json:"exceeded"`
+	Entity   string   `json:"entity,omitempty"`
+	Actions  []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+
+	// failures are counted across invocations of this replica.
+	failures = newWindow()
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Redelivered or delayed events are counted when they happened.
+	at := event.Data.CreatedTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	src := source{User: event.Data.UserName, IP: event.Data.IpAddress}
+	rep := report{
+		Event:    event.Subject,
+		User:     src.User,
+		IP:       src.IP,
+		Failures: failures.add(src, at, cfg.window()),
+		Window:   cfg.window().String(),
+	}
+	rep.Exceeded = rep.Failures > cfg.Watch.MaxFailures
+
+	entity := affectedEntity(&event.Data.Event)
+	if entity != nil {
+		rep.Entity = entity.Value
+	}
+
+	var actionErr error
+	// Each window, a source is only reported once.
+	if rep.Exceeded && failures.alert(src, at, cfg.window()) {
+		actionErr = act(ctx, cfg, &rep, entity)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("acting on exceeded threshold failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// act notifies the security channels of a source exceeding the threshold and
+// tags the affected entity, if configured. Completed actions are added to
+// rep, the joined errors of failed actions are returned.
+func act(ctx context.Context, cfg *vcConfig, rep *report, entity *types.ManagedObjectReference) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, alertMessage(rep, time.Now())); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	if cfg.Watch.TagURN != "" {
+		if err := tagEntity(ctx, cfg, rep, entity); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// tagEntity attaches the configured tag to the entity of the event. Events
+// without entity, e.g. of failed vCenter logins, are not tagged.
+func tagEntity(ctx context.Context, cfg *vcConfig, rep *report, entity *types.ManagedObjectReference) error {
+	if entity == nil {
+		rep.Actions = append(rep.Actions, "no entity to tag")
+		return nil
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := clt.tag(ctx, *entity, cfg.Watch.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "tagged")
+
+	return nil
+}
+
+// affectedEntity returns the most specific inventory object of an event, the
+// VM, host, cluster or datacenter, or nil if the event has none.
+func affectedEntity(e *types.Event) *types.ManagedObjectReference {
+	switch {
+	case e.Vm != nil && e.Vm.Vm.Value != "":
+		return &e.Vm.Vm
+	case e.Host != nil && e.Host.Host.Value != "":
+		return &e.Host.Host
+	case e.ComputeResource != nil && e.ComputeResource.ComputeResource.Value != "":
+		return &e.ComputeResource.ComputeResource
+	case e.Datacenter != nil && e.Datacenter.Datacenter.Value != "":
+		return &e.Datacenter.Datacenter
+	}
+
+	return nil
+}
+
+// window returns the length of the sliding window failures are counted in.
+func (cfg *vcConfig) window() time.Duration {
+	return time.Duration(cfg.Watch.WindowSeconds) * time.Second
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	if cfg.Watch.MaxFailures == 0 {
+		cfg.Watch.MaxFailures = defaultMaxFailures
+	}
+	if cfg.Watch.WindowSeconds == 0 {
+		cfg.Watch.WindowSeconds = defaultWindowSeconds
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	if cfg.Watch.MaxFailures < 0 || cfg.Watch.WindowSeconds < 0 {
+		return errors.New("watch max_failures and window_seconds must not be negative")
+	}
+
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" && cfg.Watch.TagURN == "" {
+		return errors.New("required field(s) missing, including a notify sink or watch tag_urn")
+	}
+
+	// vSphere is only needed for tagging.
+	if cfg.Watch.TagURN == "" {
+		return nil
+	}
+
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a failed login event.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !supportedEvents[event.Subject] {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.UserName == "" && event.Data.IpAddress == "" {
+		return nil, errors.New("empty user name and ip address")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
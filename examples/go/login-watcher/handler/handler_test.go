@@ -0,0 +1,343 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	notifyOnly := vcConfig{}
+	notifyOnly.Watch.MaxFailures = 5
+	notifyOnly.Watch.WindowSeconds = 300
+	notifyOnly.Notify.SlackWebhookURL = "https://hooks.slack.com/services/T000/B000/XXXX"
+
+	withTag := vcConfig{}
+	withTag.VCenter.Server = "veba.local.corp"
+	withTag.VCenter.User = "admin@vsphere.local"
+	withTag.VCenter.Password = "password1234"
+	withTag.Watch.MaxFailures = 3
+	withTag.Watch.WindowSeconds = 60
+	withTag.Watch.TagURN = "urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL"
+	withTag.Notify.WebhookURL = "https://hooks.local.corp/security"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file without vCenter loads correctly with default threshold and window",
+			"testdata/vcconfig.toml",
+			false,
+			&notifyOnly,
+		},
+		{
+			"Test that toml file with tag loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&withTag,
+		},
+		{
+			"Test that tagging without vCenter settings results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without notify sink and tag results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the source and affected entity of failed login events
+// are read and other events are rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      source
+		entity    string
+	}{
+		{
+			"Test that a failed vCenter login has a source, but no entity",
+			"testdata/event.json",
+			false,
+			source{User: "administrator@vsphere.local", IP: "192.168.10.77"},
+			"",
+		},
+		{
+			"Test that the host is the entity of a login without permission",
+			"testdata/event2.json",
+			false,
+			source{User: "root", IP: "192.168.10.77"},
+			"host-12",
+		},
+		{
+			"Event should return error if user and ip address are empty",
+			"testdata/eventErr1.json",
+			true,
+			source{},
+			"",
+		},
+		{
+			"Event should return error if it is no failed login event",
+			"testdata/eventErr2.json",
+			true,
+			source{},
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := source{User: event.Data.UserName, IP: event.Data.IpAddress}
+		entity := ""
+		if e := affectedEntity(&event.Data.Event); e != nil {
+			entity = e.Value
+		}
+		if got == tc.want && entity == tc.entity && !tc.expectErr {
+			t.Logf("got expected: %v, entity %q. %v", got, entity, passMark)
+		} else {
+			t.Logf("expected: %v, entity %q, got: %v, entity %q. %v", tc.want, tc.entity, got, entity, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestWindow ensures failures are counted per source within the sliding window
+// and a source is reported once per window.
+func TestWindow(t *testing.T) {
+	w := newWindow()
+	size := time.Minute
+	start := time.Date(2020, 6, 8, 14, 0, 0, 0, time.UTC)
+	admin := source{User: "administrator@vsphere.local", IP: "192.168.10.77"}
+	root := source{User: "root", IP: "192.168.10.77"}
+
+	var tests = []struct {
+		testDesc string
+		src      source
+		after    time.Duration
+		want     int
+	}{
+		{"Test that the first failure is counted", admin, 0, 1},
+		{"Test that failures within the window add up", admin, 30 * time.Second, 2},
+		{"Test that failures are counted per source", root, 40 * time.Second, 1},
+		{"Test that failures before the window are dropped", admin, 80 * time.Second, 2},
+		{"Test that sources without failures in the window start over", root, 3 * time.Minute, 1},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := w.add(tc.src, start.Add(tc.after), size)
+		if got == tc.want {
+			t.Logf("got expected: %d. %v", got, passMark)
+		} else {
+			t.Logf("expected: %d, got: %d. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that a source is reported once per window ===========")
+	alerts := []bool{
+		w.alert(admin, start, size),
+		w.alert(admin, start.Add(30*time.Second), size),
+		w.alert(admin, start.Add(90*time.Second), size),
+	}
+	if want := []bool{true, false, true}; reflect.DeepEqual(alerts, want) {
+		t.Logf("got expected: %v. %v", alerts, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, alerts, failMark)
+		t.Fail()
+	}
+}
+
+// TestAct shows sources exceeding the threshold are posted to the webhook and
+// the host the logins failed on is tagged, while events without entity are
+// only posted.
+func TestAct(t *testing.T) {
+	var posted []message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg message
+		json.NewDecoder(r.Body).Decode(&msg)
+		posted = append(posted, msg)
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "security", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "failed-logins", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// The tag is attached with the persisted client.
+		client = &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		defer func() { client = nil }()
+
+		host := simulator.Map.Any("HostSystem").Reference()
+
+		var cfg vcConfig
+		cfg.Watch.TagURN = tagID
+		cfg.Notify.WebhookURL = srv.URL
+
+		var tests = []struct {
+			testDesc    string
+			entity      *types.ManagedObjectReference
+			wantActions string
+			wantTagged  bool
+		}{
+			{"Test that the host of failed logins is tagged and the source posted", &host, "notified,tagged", true},
+			{"Test that failed vCenter logins without entity are only posted", nil, "notified,no entity to tag", false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			posted = nil
+			if err := m.DetachTag(ctx, tagID, host); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			rep := report{Event: "BadUsernameSessionEvent", User: "root", IP: "192.168.10.77", Failures: 6, Window: "5m0s", Exceeded: true}
+			if err := act(ctx, &cfg, &rep, tc.entity); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			attached, err := m.GetAttachedTags(ctx, host)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			tagged := len(attached) == 1 && attached[0].ID == tagID
+
+			got := strings.Join(rep.Actions, ",")
+			if got == tc.wantActions && tagged == tc.wantTagged && len(posted) == 1 && posted[0].Fields["user"] == rep.User {
+				t.Logf("got expected: %v, tagged %v, posted %v. %v", got, tagged, posted[0].Title, passMark)
+			} else {
+				t.Logf("expected: %v, tagged %v, got: %v, tagged %v, posted %v. %v", tc.wantActions, tc.wantTagged, got, tagged, posted, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
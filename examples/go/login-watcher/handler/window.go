@@ -0,0 +1,82 @@
+package function
+
+import (
+	"sync"
+	"time"
+)
+
+// source is where failed logins come from.
+type source struct {
+	User string
+	IP   string
+}
+
+// window counts the failures of each source within a sliding time window.
+// Sources without failures in the window are forgotten, so memory is bounded
+// by the sources failing within one window.
+type window struct {
+	mu       sync.Mutex
+	failures map[source][]time.Time
+	alerted  map[source]time.Time
+}
+
+func newWindow() *window {
+	return &window{
+		failures: map[source][]time.Time{},
+		alerted:  map[source]time.Time{},
+	}
+}
+
+// add records a failure of src at t and returns the number of failures of src
+// within the window of length size ending at t.
+func (w *window) add(src source, t time.Time, size time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.failures[src] = append(w.failures[src], t)
+	w.prune(t, size)
+
+	return len(w.failures[src])
+}
+
+// alert reports whether src, exceeding the threshold at t, is to be reported.
+// A source is reported at most once per window.
+func (w *window) alert(src source, t time.Time, size time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if last, ok := w.alerted[src]; ok && t.Sub(last) < size {
+		return false
+	}
+	w.alerted[src] = t
+
+	return true
+}
+
+// prune drops failures and alerts before the window ending at now. w.mu must
+// be held.
+func (w *window) prune(now time.Time, size time.Duration) {
+	start := now.Add(-size)
+
+	for src, times := range w.failures {
+		kept := times[:0]
+		for _, t := range times {
+			// Events may arrive out of order.
+			if t.After(start) {
+				kept = append(kept, t)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(w.failures, src)
+			continue
+		}
+		w.failures[src] = kept
+	}
+
+	for src, t := range w.alerted {
+		if !t.After(start) {
+			delete(w.alerted, src)
+		}
+	}
+}
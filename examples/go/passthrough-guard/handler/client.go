@@ -0,0 +1,203 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// vmDevices retrieves the passthrough devices of a VM and the host it is
+// placed on.
+func (clt *vsClient) vmDevices(ctx context.Context, ref types.ManagedObjectReference) (*vmDevices, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "runtime.powerState", "runtime.host", "config.hardware.device"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve devices of %v failed: %w", ref.Value, err)
+	}
+
+	v := vmDevices{Name: vm.Name, PowerState: vm.Runtime.PowerState, Host: vm.Runtime.Host}
+
+	// Inaccessible VMs have no config.
+	if vm.Config != nil {
+		v.Devices = passthroughDevices(vm.Config.Hardware.Device)
+	}
+
+	return &v, nil
+}
+
+// hostDevices retrieves the passthrough capabilities of a host and the PCI
+// devices passed through to its powered on VMs other than vm.
+func (clt *vsClient) hostDevices(ctx context.Context, ref, vm types.ManagedObjectReference) (*hostDevices, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var host mo.HostSystem
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "config.pciPassthruInfo", "config.sharedPassthruGpuTypes", "vm"}, &host)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve passthrough devices of host %v failed: %w", ref.Value, err)
+	}
+
+	h := hostDevices{
+		Name:     host.Name,
+		Passthru: map[string]*types.HostPciPassthruInfo{},
+		InUse:    map[string]string{},
+	}
+
+	if host.Config != nil {
+		for _, p := range host.Config.PciPassthruInfo {
+			info := p.GetHostPciPassthruInfo()
+			h.Passthru[info.Id] = info
+		}
+		h.GpuTypes = host.Config.SharedPassthruGpuTypes
+	}
+
+	var others []types.ManagedObjectReference
+	for _, r := range host.Vm {
+		if r != vm {
+			others = append(others, r)
+		}
+	}
+	if len(others) == 0 {
+		return &h, nil
+	}
+
+	var vms []mo.VirtualMachine
+	err = pc.Retrieve(ctx, others, []string{"name", "runtime.powerState", "config.hardware.device"}, &vms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve devices of the VMs of host %v failed: %w", ref.Value, err)
+	}
+
+	for _, o := range vms {
+		if o.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn || o.Config == nil {
+			continue
+		}
+
+		for _, d := range passthroughDevices(o.Config.Hardware.Device) {
+			if b, ok := d.Backing.(*types.VirtualPCIPassthroughDeviceBackingInfo); ok {
+				h.InUse[b.Id] = o.Name
+			}
+		}
+	}
+
+	return &h, nil
+}
+
+// passthroughDevices returns the PCI passthrough devices of devices.
+func passthroughDevices(devices []types.BaseVirtualDevice) []*types.VirtualPCIPassthrough {
+	var pt []*types.VirtualPCIPassthrough
+
+	for _, d := range devices {
+		if p, ok := d.(*types.VirtualPCIPassthrough); ok {
+			pt = append(pt, p)
+		}
+	}
+
+	return pt
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
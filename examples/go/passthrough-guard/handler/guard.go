@@ -0,0 +1,187 @@
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Kinds of passthrough devices.
+const (
+	kindPCI  = "pci"  // DirectPath I/O device of the host
+	kindVGPU = "vgpu" // shared vGPU profile of a host GPU
+)
+
+// deviceCheck is a passthrough device of a VM and why it is unavailable on the
+// host of the VM, if it is.
+type deviceCheck struct {
+	Label string `json:"label"`
+	Kind  string `json:"kind"`
+	// Device is the PCI id of the host device, e.g. 0000:3b:00.0, or the
+	// vGPU profile, e.g. grid_t4-4q.
+	Device  string `json:"device"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// vmDevices holds the passthrough devices of a VM and where it is placed.
+type vmDevices struct {
+	Name       string
+	PowerState types.VirtualMachinePowerState
+	Host       *types.ManagedObjectReference
+	Devices    []*types.VirtualPCIPassthrough
+}
+
+// hostDevices holds the passthrough capabilities of a host.
+type hostDevices struct {
+	Name string
+	// Passthru maps the PCI ids of the devices of the host to their
+	// passthrough state.
+	Passthru map[string]*types.HostPciPassthruInfo
+	// GpuTypes are the vGPU profiles the GPUs of the host support.
+	GpuTypes []string
+	// InUse maps the PCI ids of devices passed through to other powered on
+	// VMs of the host to the name of the VM.
+	InUse map[string]string
+}
+
+// assess checks the passthrough devices against the host they are placed on.
+// Devices of other backings, e.g. of dynamic DirectPath I/O, are not checked.
+func assess(devices []*types.VirtualPCIPassthrough, h *hostDevices) []deviceCheck {
+	var checks []deviceCheck
+
+	for _, d := range devices {
+		c := deviceCheck{Kind: kindPCI}
+		if info := d.GetVirtualDevice().DeviceInfo; info != nil {
+			c.Label = info.GetDescription().Label
+		}
+
+		switch b := d.Backing.(type) {
+		case *types.VirtualPCIPassthroughDeviceBackingInfo:
+			c.Device = b.Id
+
+			p, ok := h.Passthru[b.Id]
+			switch {
+			case !ok:
+				c.Problem = "device not found on host"
+			case !p.PassthruEnabled:
+				c.Problem = "passthrough not enabled on host"
+			case !p.PassthruActive:
+				c.Problem = "passthrough not active on host, host reboot pending"
+			case h.InUse[b.Id] != "":
+				c.Problem = fmt.Sprintf("device in use by %v", h.InUse[b.Id])
+			}
+
+		case *types.VirtualPCIPassthroughVmiopBackingInfo:
+			c.Kind = kindVGPU
+			c.Device = b.Vgpu
+
+			if !contains(h.GpuTypes, b.Vgpu) {
+				c.Problem = "vGPU profile not supported by host"
+			}
+
+		default:
+			continue
+		}
+
+		checks = append(checks, c)
+	}
+
+	return checks
+}
+
+// guard checks the passthrough devices of vm against its host. VMs whose
+// devices are unavailable are tagged and posted, VMs whose devices are
+// available again are untagged. Completed actions are added to rep.
+func guard(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	v, err := clt.vmDevices(ctx, vm)
+	if err != nil {
+		return err
+	}
+	rep.Name = v.Name
+	rep.PowerState = string(v.PowerState)
+
+	if len(v.Devices) == 0 {
+		rep.Skipped = "no passthrough devices"
+		return nil
+	}
+	if v.Host == nil {
+		rep.Skipped = "no host"
+		return nil
+	}
+	rep.Host = v.Host.Value
+
+	h, err := clt.hostDevices(ctx, *v.Host, vm)
+	if err != nil {
+		return err
+	}
+	rep.HostName = h.Name
+
+	rep.Devices = assess(v.Devices, h)
+	for _, c := range rep.Devices {
+		rep.Unavailable = rep.Unavailable || c.Problem != ""
+	}
+
+	if !rep.Unavailable {
+		return release(ctx, clt, cfg, rep, vm)
+	}
+
+	// The tag marks VMs already reported, so each VM is only posted once
+	// until its devices are available again.
+	if cfg.Guard.TagURN != "" {
+		tagged, err := clt.tagged(ctx, vm, cfg.Guard.TagURN)
+		if err != nil {
+			return err
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return nil
+		}
+
+		if err := clt.tag(ctx, vm, cfg.Guard.TagURN); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "tagged")
+	}
+
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return nil
+	}
+
+	if err := notify(ctx, cfg, unavailableMessage(rep)); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "notified")
+
+	return nil
+}
+
+// release detaches the tag of VMs with unavailable devices from vm, if
+// attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	if cfg.Guard.TagURN == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, cfg.Guard.TagURN)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, cfg.Guard.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,367 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Guard.Events = []string{"VmPoweredOnEvent", "VmReconfiguredEvent"}
+	tagged.Guard.TagURN = "urn:vmomi:InventoryServiceTag:5d2a8f1c-7e4b-4c9a-b3d6-1a8e0f7c2b95:GLOBAL"
+	tagged.Notify.SlackWebhookURL = "https://hooks.slack.com/services/gpu"
+
+	notified := vcConfig{}
+	notified.VCenter = tagged.VCenter
+	notified.VCenter.Insecure = true
+	notified.Notify.WebhookURL = "https://hooks.local.corp/passthrough"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a tag loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file with only a webhook loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&notified,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag or sinks results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures configured events of a VM are read and other events
+// are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that power on event is readable", "testdata/event.json", false, "vm-57"},
+		{"Test that reconfigure event is readable", "testdata/event2.json", false, "vm-57"},
+		{"Event should return error if VM is null", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.Data.Vm.Vm.Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestAssess shows passthrough devices are unavailable unless the host passes
+// the PCI device through and no other VM uses it, or supports the vGPU
+// profile.
+func TestAssess(t *testing.T) {
+	h := hostDevices{
+		Passthru: map[string]*types.HostPciPassthruInfo{
+			"0000:3b:00.0": {Id: "0000:3b:00.0", PassthruCapable: true, PassthruEnabled: true, PassthruActive: true},
+			"0000:5e:00.0": {Id: "0000:5e:00.0", PassthruCapable: true},
+			"0000:86:00.0": {Id: "0000:86:00.0", PassthruCapable: true, PassthruEnabled: true},
+			"0000:af:00.0": {Id: "0000:af:00.0", PassthruCapable: true, PassthruEnabled: true, PassthruActive: true},
+		},
+		GpuTypes: []string{"grid_t4-4q", "grid_t4-8q"},
+		InUse:    map[string]string{"0000:af:00.0": "ml-train-02"},
+	}
+
+	pci := func(id string) *types.VirtualPCIPassthrough {
+		return &types.VirtualPCIPassthrough{VirtualDevice: types.VirtualDevice{
+			Backing: &types.VirtualPCIPassthroughDeviceBackingInfo{Id: id},
+		}}
+	}
+	vgpu := func(profile string) *types.VirtualPCIPassthrough {
+		return &types.VirtualPCIPassthrough{VirtualDevice: types.VirtualDevice{
+			Backing: &types.VirtualPCIPassthroughVmiopBackingInfo{Vgpu: profile},
+		}}
+	}
+
+	var tests = []struct {
+		testDesc    string
+		device      *types.VirtualPCIPassthrough
+		wantChecked bool
+		wantProblem string
+	}{
+		{"Test that a passed through device is available", pci("0000:3b:00.0"), true, ""},
+		{"Test that a device missing on the host is unavailable", pci("0000:d8:00.0"), true, "device not found on host"},
+		{"Test that a device without passthrough is unavailable", pci("0000:5e:00.0"), true, "passthrough not enabled on host"},
+		{"Test that a device pending a reboot is unavailable", pci("0000:86:00.0"), true, "passthrough not active on host, host reboot pending"},
+		{"Test that a device of another VM is unavailable", pci("0000:af:00.0"), true, "device in use by ml-train-02"},
+		{"Test that a supported vGPU profile is available", vgpu("grid_t4-8q"), true, ""},
+		{"Test that an unsupported vGPU profile is unavailable", vgpu("grid_a100-10c"), true, "vGPU profile not supported by host"},
+		{"Test that devices of other backings are not checked", &types.VirtualPCIPassthrough{}, false, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		checks := assess([]*types.VirtualPCIPassthrough{tc.device}, &h)
+		if !tc.wantChecked {
+			if len(checks) == 0 {
+				t.Logf("got expected: no checks. %v", passMark)
+			} else {
+				t.Logf("expected no checks, got: %+v. %v", checks, failMark)
+				t.Fail()
+			}
+			continue
+		}
+
+		if len(checks) == 1 && checks[0].Problem == tc.wantProblem {
+			t.Logf("got expected: %+v. %v", checks[0], passMark)
+		} else {
+			t.Logf("expected problem %q, got: %+v. %v", tc.wantProblem, checks, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestGuard ensures VMs whose passthrough devices are unavailable on their
+// host are tagged and posted once and untagged once the devices are available.
+func TestGuard(t *testing.T) {
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		posts++
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "passthrough", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "device-unavailable", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		other, err := finder.VirtualMachine(ctx, "DC0_H0_VM1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		host, err := vm.HostSystem(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Guard.TagURN = tagID
+		cfg.Notify.WebhookURL = srv.URL
+
+		const id = "0000:3b:00.0"
+
+		passthrough := func(vm *object.VirtualMachine) func() error {
+			return func() error {
+				device := &types.VirtualPCIPassthrough{VirtualDevice: types.VirtualDevice{
+					Backing: &types.VirtualPCIPassthroughDeviceBackingInfo{Id: id},
+				}}
+				return vm.AddDevice(ctx, device)
+			}
+		}
+		// The host config of vcsim is shared by all hosts, so it is
+		// replaced rather than changed.
+		enable := func() error {
+			hs := simulator.Map.Get(host.Reference()).(*simulator.HostSystem)
+			config := *hs.Config
+			config.PciPassthruInfo = []types.BaseHostPciPassthruInfo{
+				&types.HostPciPassthruInfo{Id: id, PassthruCapable: true, PassthruEnabled: true, PassthruActive: true},
+			}
+			hs.Config = &config
+			return nil
+		}
+
+		var tests = []struct {
+			testDesc        string
+			setup           func() error
+			vm              types.ManagedObjectReference
+			wantUnavailable bool
+			wantSkipped     bool
+			wantActions     string
+			wantPosts       int
+		}{
+			{"Test that a VM without passthrough devices is skipped", nil, vm.Reference(), false, true, "", 0},
+			{"Test that a VM with a device missing on its host is tagged and posted", passthrough(vm), vm.Reference(), true, false, "tagged,notified", 1},
+			{"Test that a tagged VM is not posted again", nil, vm.Reference(), true, false, "already tagged", 1},
+			{"Test that a VM whose device is passed through is untagged", enable, vm.Reference(), false, false, "untagged", 1},
+			{"Test that a VM with a device of another powered on VM is tagged and posted", passthrough(other), vm.Reference(), true, false, "tagged,notified", 2},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				if err := tc.setup(); err != nil {
+					t.Fatal("Test failing due to improper test setup.", failMark, err)
+				}
+			}
+
+			var rep report
+			if err := guard(ctx, clt, &cfg, &rep, tc.vm); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if rep.Unavailable == tc.wantUnavailable && (rep.Skipped != "") == tc.wantSkipped && got == tc.wantActions && posts == tc.wantPosts {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected unavailable %v, skipped %v, actions %q and %d posts, got: %+v, %d posts. %v", tc.wantUnavailable, tc.wantSkipped, tc.wantActions, tc.wantPosts, rep, posts, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// resourcePool returns the resource pool of a VM, nil for templates.
+func (clt *vsClient) resourcePool(ctx context.Context, ref types.ManagedObjectReference) (*types.ManagedObjectReference, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"resourcePool"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve resource pool of %v failed: %w", ref.Value, err)
+	}
+
+	return vm.ResourcePool, nil
+}
+
+// poolUsage sums the CPU and memory reservations of the VMs of a resource
+// pool, including powered off VMs, which claim their reservations once powered
+// on. VMs of child resource pools are not included. Blocked is read from the
+// custom attribute field.
+func (clt *vsClient) poolUsage(ctx context.Context, ref types.ManagedObjectReference, field string) (*poolUsage, error) {
+	key, err := clt.fieldKey(ctx, field, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var pool mo.ResourcePool
+	err = pc.RetrieveOne(ctx, ref, []string{"name", "vm", "customValue"}, &pool)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve resource pool %v failed: %w", ref.Value, err)
+	}
+
+	u := poolUsage{Name: pool.Name}
+
+	// The last value of the field is the current one.
+	for _, v := range pool.CustomValue {
+		if s, ok := v.(*types.CustomFieldStringValue); ok && s.Key == key {
+			u.Blocked, _ = strconv.ParseBool(s.Value)
+		}
+	}
+
+	if len(pool.Vm) == 0 {
+		return &u, nil
+	}
+
+	var vms []mo.VirtualMachine
+	err = pc.Retrieve(ctx, pool.Vm, []string{"config.cpuAllocation", "config.memoryAllocation"}, &vms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve reservations of resource pool %v failed: %w", ref.Value, err)
+	}
+
+	for _, vm := range vms {
+		// Inaccessible VMs have no config.
+		if vm.Config == nil {
+			continue
+		}
+		if a := vm.Config.CpuAllocation; a != nil && a.Reservation != nil {
+			u.CPUMHz += *a.Reservation
+		}
+		if a := vm.Config.MemoryAllocation; a != nil && a.Reservation != nil {
+			u.MemoryMB += *a.Reservation
+		}
+	}
+
+	return &u, nil
+}
+
+// fieldKey returns the key of the resource pool custom attribute name. It is
+// created if it does not exist and create is set, otherwise the key is -1.
+func (clt *vsClient) fieldKey(ctx context.Context, name string, create bool) (int32, error) {
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return 0, fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	key, err := m.FindKey(ctx, name)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, object.ErrKeyNameNotFound) {
+		return 0, fmt.Errorf("find custom attribute %v failed: %w", name, err)
+	}
+	if !create {
+		return -1, nil
+	}
+
+	def, err := m.Add(ctx, name, "ResourcePool", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("create custom attribute %v failed: %w", name, err)
+	}
+
+	return def.Key, nil
+}
+
+// setBlocked marks a resource pool as blocked by the function in the custom
+// attribute field, or clears the mark.
+func (clt *vsClient) setBlocked(ctx context.Context, ref types.ManagedObjectReference, field string, blocked bool) error {
+	key, err := clt.fieldKey(ctx, field, true)
+	if err != nil {
+		return err
+	}
+
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	value := ""
+	if blocked {
+		value = strconv.FormatBool(blocked)
+	}
+
+	err = m.Set(ctx, ref, key, value)
+	if err != nil {
+		return fmt.Errorf("mark resource pool %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
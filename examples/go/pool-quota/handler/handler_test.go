@@ -0,0 +1,319 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Quota.TagURN = "urn:vmomi:InventoryServiceTag:7b1e4c2a-9d3f-4e8b-a5c6-0f2d8e1b3a47:GLOBAL"
+	tagged.Quota.PlacementTagURN = "urn:vmomi:InventoryServiceTag:3c9a5e7d-1b2f-4a6c-8e0d-5f7b9c1a2e64:GLOBAL"
+	tagged.Quota.Pools = []poolQuota{
+		{Pool: "prod", CPUMHz: 20000, MemoryMB: 65536},
+		{Pool: "dev", MemoryMB: 16384},
+	}
+
+	notified := vcConfig{}
+	notified.VCenter = tagged.VCenter
+	notified.Quota.Events = []string{"VmCreatedEvent", "VmReconfiguredEvent", "VmRelocatedEvent"}
+	notified.Quota.Field = "quota.blocked"
+	notified.Quota.Pools = []poolQuota{{Pool: "resgroup-42", CPUMHz: 8000}}
+	notified.Notify.WebhookURL = "https://hooks.local.corp/quota"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with tags and quotas by name loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file with a quota by id and a notify sink loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&notified,
+		},
+		{
+			"Test that toml file without quotas results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a quota without limits results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a negative quota results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that duplicate quotas of a pool result in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tags and notify sinks results in error",
+			"testdata/vcconfigErr5.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures configured events of VMs are read and other events
+// are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that created event is readable", "testdata/event.json", false, "vm-42"},
+		{"Test that reconfigured event is readable", "testdata/event2.json", false, "vm-42"},
+		{"Event should return error if vm is null", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.Data.Vm.Vm.Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestEnforce ensures resource pools over quota are tagged and blocked once
+// and released when their reservations are within quota again.
+func TestEnforce(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "quota", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "over-quota", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		placementID, err := m.CreateTag(ctx, &tags.Tag{Name: "placement", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		vm, err := finder.VirtualMachine(ctx, "DC0_C0_RP0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		other, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		pool, err := clt.resourcePool(ctx, vm.Reference())
+		if err != nil || pool == nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := clt.tag(ctx, *pool, placementID); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var cfg vcConfig
+		cfg.Quota.TagURN = tagID
+		cfg.Quota.PlacementTagURN = placementID
+		cfg.Quota.Pools = []poolQuota{{Pool: pool.Value, CPUMHz: 1000}}
+
+		reserve := func(mhz int64) func() error {
+			return func() error {
+				spec := types.VirtualMachineConfigSpec{
+					CpuAllocation: &types.ResourceAllocationInfo{Reservation: types.NewInt64(mhz)},
+				}
+				task, err := vm.Reconfigure(ctx, spec)
+				if err == nil {
+					err = task.Wait(ctx)
+				}
+				return err
+			}
+		}
+
+		var tests = []struct {
+			testDesc      string
+			setup         func() error
+			vm            types.ManagedObjectReference
+			wantExceeded  bool
+			wantSkipped   bool
+			wantActions   string
+			wantPlaceable bool
+		}{
+			{"Test that a pool within quota is left as it is", nil, vm.Reference(), false, false, "", true},
+			{"Test that a pool over quota is blocked and tagged", reserve(1500), vm.Reference(), true, false, "blocked placement,tagged", false},
+			{"Test that a tagged pool is not tagged again", nil, vm.Reference(), true, false, "already tagged", false},
+			{"Test that a pool within quota again is unblocked and untagged", reserve(500), vm.Reference(), false, false, "unblocked placement,untagged", true},
+			{"Test that a pool without quota is skipped", nil, other.Reference(), false, true, "", true},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				if err := tc.setup(); err != nil {
+					t.Fatal("Test failing due to improper test setup.", failMark, err)
+				}
+			}
+
+			var rep report
+			if err := enforce(ctx, clt, &cfg, &rep, tc.vm); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			placeable, err := clt.tagged(ctx, *pool, placementID)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if rep.Exceeded == tc.wantExceeded && (rep.Skipped != "") == tc.wantSkipped && got == tc.wantActions && placeable == tc.wantPlaceable {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected exceeded %v, skipped %v, actions %q and placeable %v, got: %+v, placeable %v. %v", tc.wantExceeded, tc.wantSkipped, tc.wantActions, tc.wantPlaceable, rep, placeable, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
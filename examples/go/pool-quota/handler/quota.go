@@ -0,0 +1,199 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// poolQuota limits the aggregate reservations of the VMs of a resource pool.
+type poolQuota struct {
+	// Pool is the name or managed object id of the resource pool, e.g.
+	// resgroup-42.
+	Pool string
+	// CPUMHz and MemoryMB limit the CPU and memory reservations, 0 is
+	// unlimited.
+	CPUMHz   int64 `toml:"cpu_mhz"`
+	MemoryMB int64 `toml:"memory_mb"`
+}
+
+// poolUsage holds the aggregate reservations of the VMs of a resource pool.
+type poolUsage struct {
+	Name     string
+	CPUMHz   int64
+	MemoryMB int64
+	// Blocked is set if the function detached the placement tag.
+	Blocked bool
+}
+
+// consumption is a reserved resource and its quota.
+type consumption struct {
+	Reserved int64 `json:"reserved"`
+	Quota    int64 `json:"quota"`
+}
+
+// quota returns the quota of the resource pool with the managed object id ref
+// and name, nil if it has none. Quotas by id take precedence over quotas by
+// name.
+func (cfg *vcConfig) quota(ref, name string) *poolQuota {
+	var byName *poolQuota
+
+	for i, q := range cfg.Quota.Pools {
+		switch q.Pool {
+		case ref:
+			return &cfg.Quota.Pools[i]
+		case name:
+			byName = &cfg.Quota.Pools[i]
+		}
+	}
+
+	return byName
+}
+
+// exceeded reports whether u is over quota q.
+func (q *poolQuota) exceeded(u *poolUsage) bool {
+	return (q.CPUMHz > 0 && u.CPUMHz > q.CPUMHz) || (q.MemoryMB > 0 && u.MemoryMB > q.MemoryMB)
+}
+
+// enforce checks the aggregate reservations of the resource pool of vm
+// against its quota. Pools over quota are tagged, blocked for placement and
+// posted, pools within quota again are untagged and unblocked. Completed
+// actions are added to rep, the joined errors of failed actions are returned.
+func enforce(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	pool, err := clt.resourcePool(ctx, vm)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		rep.Skipped = "no resource pool, e.g. a template"
+		return nil
+	}
+	rep.Pool = pool.Value
+
+	u, err := clt.poolUsage(ctx, *pool, cfg.field())
+	if err != nil {
+		return err
+	}
+	rep.PoolName = u.Name
+
+	q := cfg.quota(pool.Value, u.Name)
+	if q == nil {
+		rep.Skipped = fmt.Sprintf("no quota for pool %v", u.Name)
+		return nil
+	}
+
+	if q.CPUMHz > 0 {
+		rep.CPU = &consumption{Reserved: u.CPUMHz, Quota: q.CPUMHz}
+	}
+	if q.MemoryMB > 0 {
+		rep.Memory = &consumption{Reserved: u.MemoryMB, Quota: q.MemoryMB}
+	}
+
+	rep.Exceeded = q.exceeded(u)
+	if !rep.Exceeded {
+		return release(ctx, clt, cfg, rep, *pool, u)
+	}
+
+	var errs []error
+
+	// Blocking is repeated for pools already reported, in case the
+	// placement tag was attached again meanwhile.
+	if err := block(ctx, clt, cfg, rep, *pool); err != nil {
+		errs = append(errs, err)
+	}
+
+	// The tag marks pools already reported, so each pool over quota is only
+	// posted once until it is within quota again.
+	if cfg.Quota.TagURN != "" {
+		tagged, err := clt.tagged(ctx, *pool, cfg.Quota.TagURN)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return errors.Join(errs...)
+		}
+
+		if err := clt.tag(ctx, *pool, cfg.Quota.TagURN); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "tagged")
+		}
+	}
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, exceededMessage(rep)); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// block detaches the placement tag from pool, if attached, and marks pool as
+// blocked by the function in the custom attribute field.
+func block(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, pool types.ManagedObjectReference) error {
+	if cfg.Quota.PlacementTagURN == "" {
+		return nil
+	}
+
+	placeable, err := clt.tagged(ctx, pool, cfg.Quota.PlacementTagURN)
+	if err != nil || !placeable {
+		return err
+	}
+
+	// Mark first, so a failed detach is still unblocked once the pool is
+	// within quota again.
+	if err := clt.setBlocked(ctx, pool, cfg.field(), true); err != nil {
+		return err
+	}
+	if err := clt.untag(ctx, pool, cfg.Quota.PlacementTagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "blocked placement")
+
+	return nil
+}
+
+// release attaches the placement tag again to pool, if the function blocked
+// it, and detaches the tag of pools over quota, if attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, pool types.ManagedObjectReference, u *poolUsage) error {
+	if cfg.Quota.PlacementTagURN != "" && u.Blocked {
+		if err := clt.tag(ctx, pool, cfg.Quota.PlacementTagURN); err != nil {
+			return err
+		}
+		if err := clt.setBlocked(ctx, pool, cfg.field(), false); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "unblocked placement")
+	}
+
+	if cfg.Quota.TagURN == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, pool, cfg.Quota.TagURN)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, pool, cfg.Quota.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+// field returns the custom attribute marking pools blocked by the function.
+func (cfg *vcConfig) field() string {
+	if cfg.Quota.Field == "" {
+		return defaultField
+	}
+
+	return cfg.Quota.Field
+}
@@ -0,0 +1,321 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// webhookTimeout limits the delivery of a notification.
+const webhookTimeout = 10 * time.Second
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// gather returns the VM and the hosts of its cluster and of the additional
+// clusters named in the config as placement candidates.
+func (clt *vsClient) gather(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference) (*vmInfo, []candidate, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "config.hardware.memoryMB", "datastore", "runtime.host"}, &vm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieve VM %v failed: %w", ref.Value, err)
+	}
+
+	if vm.Runtime.Host == nil || vm.Config == nil {
+		return nil, nil, fmt.Errorf("VM %v has no host or config", vm.Name)
+	}
+
+	info := vmInfo{
+		Ref:        ref,
+		Name:       vm.Name,
+		MemoryMB:   int64(vm.Config.Hardware.MemoryMB),
+		Host:       *vm.Runtime.Host,
+		Datastores: vm.Datastore,
+	}
+
+	var host mo.HostSystem
+	err = pc.RetrieveOne(ctx, info.Host, []string{"parent"}, &host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieve cluster of VM %v failed: %w", vm.Name, err)
+	}
+
+	clusters := []types.ManagedObjectReference{*host.Parent}
+	if len(cfg.Placement.Clusters) > 0 {
+		extra, err := clt.clusters(ctx, cfg.Placement.Clusters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range extra {
+			if c != *host.Parent {
+				clusters = append(clusters, c)
+			}
+		}
+	}
+
+	var cands []candidate
+	for _, c := range clusters {
+		cc, err := clt.candidates(ctx, c, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		cands = append(cands, cc...)
+	}
+
+	return &info, cands, nil
+}
+
+// clusters returns the clusters with the given names.
+func (clt *vsClient) clusters(ctx context.Context, names []string) ([]types.ManagedObjectReference, error) {
+	m := view.NewManager(clt.govmomi.Client)
+	v, err := m.CreateContainerView(ctx, clt.govmomi.ServiceContent.RootFolder, []string{"ClusterComputeResource"}, true)
+	if err != nil {
+		return nil, fmt.Errorf("create cluster view failed: %w", err)
+	}
+	defer v.Destroy(ctx)
+
+	var all []mo.ClusterComputeResource
+	err = v.Retrieve(ctx, []string{"ClusterComputeResource"}, []string{"name"}, &all)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve clusters failed: %w", err)
+	}
+
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[n] = true
+	}
+
+	var refs []types.ManagedObjectReference
+	for _, c := range all {
+		if wanted[c.Name] {
+			refs = append(refs, c.Self)
+			delete(wanted, c.Name)
+		}
+	}
+
+	for n := range wanted {
+		return nil, fmt.Errorf("cluster %q not found", n)
+	}
+
+	return refs, nil
+}
+
+// candidates returns the hosts of the compute resource ref with the DRS rules
+// of the cluster which include vm.
+func (clt *vsClient) candidates(ctx context.Context, ref, vm types.ManagedObjectReference) ([]candidate, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	props := []string{"name", "host", "resourcePool"}
+	if ref.Type == "ClusterComputeResource" {
+		props = append(props, "configurationEx")
+	}
+
+	var cr mo.ClusterComputeResource
+	err := pc.RetrieveOne(ctx, ref, props, &cr)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve compute resource %v failed: %w", ref.Value, err)
+	}
+
+	if cr.ResourcePool == nil || len(cr.Host) == 0 {
+		return nil, nil
+	}
+
+	ccfg, _ := cr.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	running, err := clt.running(ctx, ruleVMs(ccfg))
+	if err != nil {
+		return nil, err
+	}
+	rules := rulesFor(ccfg, vm, running)
+
+	var hosts []mo.HostSystem
+	err = pc.Retrieve(ctx, cr.Host, []string{
+		"name", "datastore", "hardware.memorySize", "summary.quickStats.overallMemoryUsage",
+		"runtime.connectionState", "runtime.inMaintenanceMode",
+	}, &hosts)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve hosts of %v failed: %w", cr.Name, err)
+	}
+
+	var cands []candidate
+	for _, h := range hosts {
+		c := candidate{
+			Host:       h.Self,
+			Name:       h.Name,
+			Cluster:    ref,
+			Pool:       *cr.ResourcePool,
+			Usable:     h.Runtime.ConnectionState == types.HostSystemConnectionStateConnected && !h.Runtime.InMaintenanceMode,
+			Datastores: map[string]bool{},
+			Rules:      rules,
+		}
+
+		if h.Hardware != nil {
+			c.FreeMemoryMB = h.Hardware.MemorySize>>20 - int64(h.Summary.QuickStats.OverallMemoryUsage)
+		}
+
+		for _, ds := range h.Datastore {
+			c.Datastores[ds.Value] = true
+		}
+
+		cands = append(cands, c)
+	}
+
+	return cands, nil
+}
+
+// running maps the powered on VMs of refs to their host.
+func (clt *vsClient) running(ctx context.Context, refs []types.ManagedObjectReference) (map[string]string, error) {
+	running := map[string]string{}
+	if len(refs) == 0 {
+		return running, nil
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := pc.Retrieve(ctx, refs, []string{"runtime.host", "runtime.powerState"}, &vms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VMs of DRS rules failed: %w", err)
+	}
+
+	for _, vm := range vms {
+		if vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn && vm.Runtime.Host != nil {
+			running[vm.Self.Value] = vm.Runtime.Host.Value
+		}
+	}
+
+	return running, nil
+}
+
+// ruleVMs returns the VMs of the VM-VM rules of cfg.
+func ruleVMs(cfg *types.ClusterConfigInfoEx) []types.ManagedObjectReference {
+	if cfg == nil {
+		return nil
+	}
+
+	seen := map[types.ManagedObjectReference]bool{}
+	var refs []types.ManagedObjectReference
+	add := func(vms []types.ManagedObjectReference) {
+		for _, vm := range vms {
+			if !seen[vm] {
+				seen[vm] = true
+				refs = append(refs, vm)
+			}
+		}
+	}
+
+	for _, rule := range cfg.Rule {
+		switch rule := rule.(type) {
+		case *types.ClusterAntiAffinityRuleSpec:
+			add(rule.Vm)
+		case *types.ClusterAffinityRuleSpec:
+			add(rule.Vm)
+		}
+	}
+
+	return refs
+}
+
+// relocate moves the powered-off vm to the host and resource pool of c.
+func (clt *vsClient) relocate(ctx context.Context, vm *vmInfo, c *candidate) error {
+	v := object.NewVirtualMachine(clt.govmomi.Client, vm.Ref)
+
+	task, err := v.Relocate(ctx, types.VirtualMachineRelocateSpec{Host: &c.Host, Pool: &c.Pool}, types.VirtualMachineMovePriorityDefaultPriority)
+	if err != nil {
+		return fmt.Errorf("relocate to %v failed: %w", c.Name, err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		return fmt.Errorf("relocate to %v failed: %w", c.Name, err)
+	}
+
+	return nil
+}
+
+// powerOn powers on vm on its host c.
+func (clt *vsClient) powerOn(ctx context.Context, vm *vmInfo, c *candidate) error {
+	task, err := object.NewVirtualMachine(clt.govmomi.Client, vm.Ref).PowerOn(ctx)
+	if err != nil {
+		return fmt.Errorf("power-on on %v failed: %w", c.Name, err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		return fmt.Errorf("power-on on %v failed: %w", c.Name, err)
+	}
+
+	return nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	err := clt.govmomi.Logout(ctx)
+	if err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
+
+// notify posts rep as JSON to the webhook url.
+func notify(ctx context.Context, url string, rep *report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Placement struct {
+		// Clusters are considered in addition to the VM's cluster.
+		Clusters []string
+		// MinFreeMemoryMB is kept free on the chosen host in addition to
+		// the memory of the VM.
+		MinFreeMemoryMB int64 `toml:"min_free_memory_mb"`
+		// WebhookURL receives a JSON report when no placement is possible.
+		WebhookURL string `toml:"webhook_url"`
+		// MaxRelocationsPerCluster limits the concurrent relocations into
+		// a cluster, further ones are queued. 0 is unlimited.
+		MaxRelocationsPerCluster int `toml:"max_relocations_per_cluster"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Data types.NotEnoughResourcesToStartVmEvent `json:"data,omitempty"`
+}
+
+// report describes the placement of the VM.
+type report struct {
+	VM         string            `json:"vm"`
+	Reason     string            `json:"reason,omitempty"` // of the failed power-on
+	FailedHost string            `json:"failed_host"`
+	PlacedOn   string            `json:"placed_on,omitempty"`
+	PoweredOn  bool              `json:"powered_on"`
+	QueuedMS   int64             `json:"queued_ms,omitempty"` // waiting for a relocation slot
+	Rejected   map[string]string `json:"rejected,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Notified   bool              `json:"notified,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	moRef, reason, err := parseEventMoRef(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("retrieve managed reference object failed: %w", err)
+		slog.Debug("retrieve managed reference object failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	vm, cands, err := clt.gather(ctx, cfg, *moRef)
+	if err != nil {
+		wrapErr := fmt.Errorf("gathering placement candidates failed: %w", err)
+		slog.Debug("gathering placement candidates failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{VM: vm.Name, Reason: reason, FailedHost: vm.Host.Value}
+
+	target, rejected := choose(*vm, cands, cfg.Placement.MinFreeMemoryMB)
+	rep.Rejected = rejected
+
+	if target == nil {
+		err = errors.New("no host satisfies the capacity and DRS rules of the VM")
+	} else {
+		rep.PlacedOn = target.Name
+		err = place(ctx, clt, cfg, &rep, vm, target)
+		rep.PoweredOn = err == nil
+	}
+
+	// A VM which is still powered off needs a human.
+	if err != nil {
+		rep.Error = err.Error()
+		if cfg.Placement.WebhookURL != "" {
+			nerr := notify(ctx, cfg.Placement.WebhookURL, &rep)
+			if nerr != nil {
+				slog.Error("notification failed", "err", nerr)
+			}
+			rep.Notified = nerr == nil
+		}
+	}
+
+	body, merr := json.Marshal(rep)
+	if merr != nil {
+		return handler.Response{
+			Body:       []byte(merr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, merr
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if err != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("placement of %v failed: %w", vm.Name, err)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Placement.MinFreeMemoryMB < 0 {
+		return errors.New("placement min_free_memory_mb must not be negative")
+	}
+
+	if cfg.Placement.MaxRelocationsPerCluster < 0 {
+		return errors.New("placement max_relocations_per_cluster must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEventMoRef returns the VM which failed to power on and the reason.
+func parseEventMoRef(req []byte) (*types.ManagedObjectReference, string, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, "", errors.New("empty managed reference object")
+	}
+
+	return &event.Data.Vm.Vm, event.Data.Reason, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,379 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Placement.Clusters = []string{"overflow"}
+	want.Placement.MinFreeMemoryMB = 1024
+	want.Placement.MaxRelocationsPerCluster = 2
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEventMoRef ensures the VM and the reason of the failed power-on are
+// obtained from the event.
+func TestParseEventMoRef(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that event is readable", "testdata/event.json", false, "vm-53"},
+		{"Event should return error if VM is null", "testdata/eventErr1.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		moRef, reason, err := parseEventMoRef(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if moRef.Value == tc.want && reason != "" {
+			t.Logf("got expected: '%s' (%v). %v", moRef.Value, reason, passMark)
+		} else {
+			t.Logf("expected: '%s', got: '%s'. %v", tc.want, moRef.Value, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestChoose ensures hosts are chosen by capacity, datastore access and DRS
+// rules.
+func TestChoose(t *testing.T) {
+	ref := func(typ, v string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: typ, Value: v}
+	}
+	yes := true
+
+	vm := vmInfo{
+		Ref:        ref("VirtualMachine", "vm-53"),
+		Name:       "app-03",
+		MemoryMB:   8192,
+		Host:       ref("HostSystem", "host-11"),
+		Datastores: []types.ManagedObjectReference{ref("Datastore", "ds-1")},
+	}
+
+	cluster := &types.ClusterConfigInfoEx{
+		Rule: []types.BaseClusterRuleInfo{
+			&types.ClusterAntiAffinityRuleSpec{
+				ClusterRuleInfo: types.ClusterRuleInfo{Name: "spread-app", Enabled: &yes},
+				Vm:              []types.ManagedObjectReference{vm.Ref, ref("VirtualMachine", "vm-54")},
+			},
+			&types.ClusterVmHostRuleInfo{
+				ClusterRuleInfo:     types.ClusterRuleInfo{Name: "app-on-rack-a", Enabled: &yes},
+				VmGroupName:         "app",
+				AffineHostGroupName: "rack-a",
+			},
+		},
+		Group: []types.BaseClusterGroupInfo{
+			&types.ClusterVmGroup{ClusterGroupInfo: types.ClusterGroupInfo{Name: "app"}, Vm: []types.ManagedObjectReference{vm.Ref}},
+			&types.ClusterHostGroup{ClusterGroupInfo: types.ClusterGroupInfo{Name: "rack-a"}, Host: []types.ManagedObjectReference{ref("HostSystem", "host-14")}},
+		},
+	}
+	rules := rulesFor(cluster, vm.Ref, map[string]string{"vm-54": "host-12"})
+
+	host := func(name string, free int64, ds string) candidate {
+		return candidate{
+			Host:         ref("HostSystem", "host-"+name[len(name)-2:]),
+			Name:         name,
+			Usable:       true,
+			FreeMemoryMB: free,
+			Datastores:   map[string]bool{ds: true},
+			Rules:        rules,
+		}
+	}
+
+	var tests = []struct {
+		testDesc string
+		cands    []candidate
+		want     string // empty if no placement is possible
+	}{
+		{
+			"Test that the host running an anti-affine VM is rejected",
+			[]candidate{host("esx-12", 64000, "ds-1"), host("esx-13", 16000, "ds-1")},
+			"esx-13",
+		},
+		{
+			"Test that hosts of preferential rules come first",
+			[]candidate{host("esx-13", 64000, "ds-1"), host("esx-14", 16000, "ds-1")},
+			"esx-14",
+		},
+		{
+			"Test that hosts without the VM's datastores or memory are rejected",
+			[]candidate{host("esx-13", 64000, "ds-2"), host("esx-15", 8192, "ds-1"), host("esx-11", 64000, "ds-1")},
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, rejected := choose(vm, tc.cands, 1024)
+
+		name := ""
+		if got != nil {
+			name = got.Name
+		}
+
+		if name == tc.want {
+			t.Logf("got expected: %q, rejected: %v. %v", name, rejected, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q, rejected: %v. %v", tc.want, name, rejected, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestClusterLimiter ensures relocations beyond the limit of a cluster are
+// queued until a slot is released or their context ends.
+func TestClusterLimiter(t *testing.T) {
+	var tests = []struct {
+		testDesc   string
+		max        int
+		cancel     bool
+		wantQueued bool
+		wantErr    bool
+	}{
+		{"Test that relocations are unlimited with a limit of 0", 0, false, false, false},
+		{"Test that a queued relocation runs once a slot is released", 2, false, true, false},
+		{"Test that a queued relocation gives up when its context ends", 1, true, true, true},
+	}
+
+	type result struct {
+		release func()
+		queued  bool
+		err     error
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		l := newClusterLimiter()
+		cluster := "domain-c" + strconv.Itoa(tc.max)
+
+		// Take all slots of the cluster, or two if unlimited.
+		var held []func()
+		for i := 0; i < tc.max || (tc.max == 0 && i < 2); i++ {
+			release, _, err := l.acquire(context.Background(), cluster, tc.max)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			held = append(held, release)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan result, 1)
+		go func() {
+			release, queued, err := l.acquire(ctx, cluster, tc.max)
+			done <- result{release, queued, err}
+		}()
+
+		if tc.wantQueued {
+			select {
+			case <-done:
+				t.Logf("expected the relocation to be queued. %v", failMark)
+				t.Fail()
+				cancel()
+				continue
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			if tc.cancel {
+				cancel()
+			} else {
+				held[0]()
+			}
+		}
+
+		var got result
+		select {
+		case got = <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("the relocation did not proceed. %v", failMark)
+		}
+		cancel()
+
+		if got.queued == tc.wantQueued && (got.err != nil) == tc.wantErr {
+			t.Logf("got expected: queued %v, err %v. %v", got.queued, got.err, passMark)
+		} else {
+			t.Logf("expected: queued %v, err %v, got: queued %v, err %v. %v", tc.wantQueued, tc.wantErr, got.queued, got.err, failMark)
+			t.Fail()
+		}
+
+		if got.release != nil {
+			got.release()
+		}
+		for _, release := range held {
+			release()
+		}
+		if s := l.clusters[cluster]; s.running != 0 || len(s.waiting) != 0 {
+			t.Logf("expected all slots to be free, got %d running, %d waiting. %v", s.running, len(s.waiting), failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPlace shows a VM which failed to power on is relocated to a host of its
+// cluster with room for it and powered on there.
+func TestPlace(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_C0_RP0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := vm.PowerOff(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var cfg vcConfig
+
+		t.Log("=========== Test that the hosts of the cluster of the VM are candidates ===========")
+		info, cands, err := clt.gather(ctx, &cfg, vm.Reference())
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		cluster := simulator.Map.Get(*simulator.Map.Get(info.Host).(*simulator.HostSystem).Parent).(*simulator.ClusterComputeResource)
+		if len(cands) == len(cluster.Host) && info.Name == vm.Name() {
+			t.Logf("got expected: %d candidates. %v", len(cands), passMark)
+		} else {
+			t.Logf("expected: %d candidates of %v, got: %d of %v. %v", len(cluster.Host), vm.Name(), len(cands), info.Name, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that the VM is relocated to the chosen host and powered on ===========")
+		target, _ := choose(*info, cands, 0)
+		if target == nil || target.Host == info.Host {
+			t.Fatal("Test failing due to improper test setup.", failMark, target)
+		}
+		var rep report
+		if err := place(ctx, clt, &cfg, &rep, info, target); err != nil {
+			t.Fatal(failMark, err)
+		}
+		got := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine)
+		if *got.Runtime.Host == target.Host && got.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn {
+			t.Logf("got expected: powered on on %v. %v", target.Name, passMark)
+		} else {
+			t.Logf("expected: powered on on %v, got: %v on %v. %v", target.Host.Value, got.Runtime.PowerState, got.Runtime.Host.Value, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that an unknown additional cluster results in error ===========")
+		cfg.Placement.Clusters = []string{"DC0_C404"}
+		if _, _, err := clt.gather(ctx, &cfg, vm.Reference()); err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected error. %v", failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
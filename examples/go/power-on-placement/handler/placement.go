@@ -0,0 +1,229 @@
+package function
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vmInfo is the VM which failed to power on.
+type vmInfo struct {
+	Ref        types.ManagedObjectReference
+	Name       string
+	MemoryMB   int64
+	Host       types.ManagedObjectReference // host the power-on failed on
+	Datastores []types.ManagedObjectReference
+}
+
+// candidate is a host the VM may be placed on.
+type candidate struct {
+	Host         types.ManagedObjectReference
+	Name         string
+	Cluster      types.ManagedObjectReference
+	Pool         types.ManagedObjectReference
+	Usable       bool // connected and not in maintenance mode
+	FreeMemoryMB int64
+	Datastores   map[string]bool
+	Rules        *clusterRules
+}
+
+// clusterRules are the enabled DRS rules of a cluster which include the VM.
+type clusterRules struct {
+	// AntiAffine lists the other VMs of each VM-VM anti-affinity rule.
+	AntiAffine [][]types.ManagedObjectReference
+	// Affine lists the other VMs of each VM-VM affinity rule.
+	Affine [][]types.ManagedObjectReference
+	// MustRun and MustNotRun are the host groups of mandatory VM-host rules,
+	// ShouldRun the ones of preferential VM-host rules.
+	MustRun    []map[string]bool
+	MustNotRun []map[string]bool
+	ShouldRun  []map[string]bool
+	// Running maps the powered on VMs of the rules to their host.
+	Running map[string]string
+}
+
+// violation returns the first rule violated when the VM runs on host or "".
+func (r *clusterRules) violation(host string) string {
+	if r == nil {
+		return ""
+	}
+
+	for _, vms := range r.AntiAffine {
+		for _, vm := range vms {
+			if r.Running[vm.Value] == host {
+				return fmt.Sprintf("anti-affinity with %v", vm.Value)
+			}
+		}
+	}
+
+	for _, vms := range r.Affine {
+		for _, vm := range vms {
+			if h, ok := r.Running[vm.Value]; ok && h != host {
+				return fmt.Sprintf("affinity with %v on %v", vm.Value, h)
+			}
+		}
+	}
+
+	for _, hosts := range r.MustRun {
+		if !hosts[host] {
+			return "mandatory VM-host rule"
+		}
+	}
+
+	for _, hosts := range r.MustNotRun {
+		if hosts[host] {
+			return "mandatory VM-host anti-affinity rule"
+		}
+	}
+
+	return ""
+}
+
+// preferred reports whether host satisfies all preferential VM-host rules.
+func (r *clusterRules) preferred(host string) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, hosts := range r.ShouldRun {
+		if !hosts[host] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// choose returns the host to place vm on and the reasons the other hosts were
+// rejected. Hosts need access to all datastores of the VM, the VM's memory
+// plus minFreeMB of free memory and must not violate mandatory DRS rules.
+// Hosts satisfying preferential rules come first, then the ones with the most
+// free memory.
+func choose(vm vmInfo, cands []candidate, minFreeMB int64) (*candidate, map[string]string) {
+	rejected := map[string]string{}
+	var fit []candidate
+
+	for _, c := range cands {
+		reason := ""
+		switch {
+		case c.Host == vm.Host:
+			reason = "power-on failed on this host"
+		case !c.Usable:
+			reason = "not connected or in maintenance mode"
+		case !hasAll(c.Datastores, vm.Datastores):
+			reason = "datastores of the VM not accessible"
+		case c.FreeMemoryMB < vm.MemoryMB+minFreeMB:
+			reason = fmt.Sprintf("%d MB free memory, %d MB required", c.FreeMemoryMB, vm.MemoryMB+minFreeMB)
+		default:
+			reason = c.Rules.violation(c.Host.Value)
+		}
+
+		if reason != "" {
+			rejected[c.Name] = reason
+			continue
+		}
+
+		fit = append(fit, c)
+	}
+
+	if len(fit) == 0 {
+		return nil, rejected
+	}
+
+	sort.SliceStable(fit, func(i, j int) bool {
+		pi, pj := fit[i].Rules.preferred(fit[i].Host.Value), fit[j].Rules.preferred(fit[j].Host.Value)
+		if pi != pj {
+			return pi
+		}
+		return fit[i].FreeMemoryMB > fit[j].FreeMemoryMB
+	})
+
+	return &fit[0], rejected
+}
+
+// hasAll reports whether set contains all refs.
+func hasAll(set map[string]bool, refs []types.ManagedObjectReference) bool {
+	for _, r := range refs {
+		if !set[r.Value] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rulesFor returns the enabled rules of a cluster configuration which include
+// vm. running maps VMs to the host they are powered on.
+func rulesFor(cfg *types.ClusterConfigInfoEx, vm types.ManagedObjectReference, running map[string]string) *clusterRules {
+	r := clusterRules{Running: running}
+	if cfg == nil {
+		return &r
+	}
+
+	vmGroups := map[string][]types.ManagedObjectReference{}
+	hostGroups := map[string]map[string]bool{}
+	for _, g := range cfg.Group {
+		switch g := g.(type) {
+		case *types.ClusterVmGroup:
+			vmGroups[g.Name] = g.Vm
+		case *types.ClusterHostGroup:
+			hosts := map[string]bool{}
+			for _, h := range g.Host {
+				hosts[h.Value] = true
+			}
+			hostGroups[g.Name] = hosts
+		}
+	}
+
+	for _, rule := range cfg.Rule {
+		info := rule.GetClusterRuleInfo()
+		if info.Enabled != nil && !*info.Enabled {
+			continue
+		}
+		mandatory := info.Mandatory != nil && *info.Mandatory
+
+		switch rule := rule.(type) {
+		case *types.ClusterAntiAffinityRuleSpec:
+			if others, ok := without(rule.Vm, vm); ok {
+				r.AntiAffine = append(r.AntiAffine, others)
+			}
+		case *types.ClusterAffinityRuleSpec:
+			if others, ok := without(rule.Vm, vm); ok {
+				r.Affine = append(r.Affine, others)
+			}
+		case *types.ClusterVmHostRuleInfo:
+			if _, ok := without(vmGroups[rule.VmGroupName], vm); !ok {
+				continue
+			}
+			if hosts, ok := hostGroups[rule.AffineHostGroupName]; ok {
+				if mandatory {
+					r.MustRun = append(r.MustRun, hosts)
+				} else {
+					r.ShouldRun = append(r.ShouldRun, hosts)
+				}
+			}
+			if hosts, ok := hostGroups[rule.AntiAffineHostGroupName]; ok && mandatory {
+				r.MustNotRun = append(r.MustNotRun, hosts)
+			}
+		}
+	}
+
+	return &r
+}
+
+// without returns refs except vm and whether vm was included.
+func without(refs []types.ManagedObjectReference, vm types.ManagedObjectReference) ([]types.ManagedObjectReference, bool) {
+	var others []types.ManagedObjectReference
+	found := false
+
+	for _, r := range refs {
+		if r == vm {
+			found = true
+			continue
+		}
+		others = append(others, r)
+	}
+
+	return others, found
+}
@@ -0,0 +1,136 @@
+package function
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Relocation metrics by cluster, served at /debug/vars.
+var (
+	relocationsRunning = expvar.NewMap("relocations_running")
+	relocationsQueued  = expvar.NewMap("relocations_queued")
+	relocationsWaited  = expvar.NewMap("relocations_waited_total")
+)
+
+// relocations limits the concurrent relocations per cluster of all
+// invocations of the function replica.
+var relocations = newClusterLimiter()
+
+// clusterLimiter hands out relocation slots per cluster. Waiters are served
+// in order of arrival.
+type clusterLimiter struct {
+	mu       sync.Mutex
+	clusters map[string]*clusterSlots
+}
+
+type clusterSlots struct {
+	running int
+	waiting []chan struct{}
+}
+
+func newClusterLimiter() *clusterLimiter {
+	return &clusterLimiter{clusters: map[string]*clusterSlots{}}
+}
+
+// acquire waits for a relocation slot of cluster, of which there are max, and
+// returns the function releasing it. It reports whether the caller was queued.
+// A max of 0 is unlimited. If ctx ends while queued, its error is returned.
+func (l *clusterLimiter) acquire(ctx context.Context, cluster string, max int) (func(), bool, error) {
+	l.mu.Lock()
+	s := l.clusters[cluster]
+	if s == nil {
+		s = &clusterSlots{}
+		l.clusters[cluster] = s
+	}
+
+	if max <= 0 || s.running < max {
+		s.running++
+		l.mu.Unlock()
+		relocationsRunning.Add(cluster, 1)
+		return l.releaser(cluster, max), false, nil
+	}
+
+	ready := make(chan struct{})
+	s.waiting = append(s.waiting, ready)
+	l.mu.Unlock()
+	relocationsQueued.Add(cluster, 1)
+	relocationsWaited.Add(cluster, 1)
+
+	select {
+	case <-ready:
+		// The slot was handed over by release.
+		relocationsQueued.Add(cluster, -1)
+		relocationsRunning.Add(cluster, 1)
+		return l.releaser(cluster, max), true, nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	relocationsQueued.Add(cluster, -1)
+
+	for i, w := range s.waiting {
+		if w == ready {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return nil, true, ctx.Err()
+		}
+	}
+
+	// The slot was handed over while ctx ended: pass it on.
+	l.handOver(s, max)
+
+	return nil, true, ctx.Err()
+}
+
+// releaser returns the function releasing a slot of cluster once.
+func (l *clusterLimiter) releaser(cluster string, max int) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			relocationsRunning.Add(cluster, -1)
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.handOver(l.clusters[cluster], max)
+		})
+	}
+}
+
+// handOver passes a slot of s to the first waiter or frees it. Callers hold
+// l.mu.
+func (l *clusterLimiter) handOver(s *clusterSlots, max int) {
+	if len(s.waiting) > 0 && (max <= 0 || s.running <= max) {
+		close(s.waiting[0])
+		s.waiting = s.waiting[1:]
+		return
+	}
+
+	s.running--
+}
+
+// place relocates vm to c, within the relocation limit of the cluster of c,
+// and powers it on. The time spent queued for a slot is added to rep.
+func place(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm *vmInfo, c *candidate) error {
+	start := time.Now()
+	release, queued, err := relocations.acquire(ctx, c.Cluster.Value, cfg.Placement.MaxRelocationsPerCluster)
+	if queued {
+		rep.QueuedMS = time.Since(start).Milliseconds()
+		slog.Debug("relocation queued", "vm", vm.Name, "cluster", c.Cluster.Value, "ms", rep.QueuedMS)
+	}
+	if err != nil {
+		return fmt.Errorf("waiting for a relocation to %v failed: %w", c.Name, err)
+	}
+
+	err = clt.relocate(ctx, vm, c)
+	release()
+	if err != nil {
+		return err
+	}
+
+	return clt.powerOn(ctx, vm, c)
+}
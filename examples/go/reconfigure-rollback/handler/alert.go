@@ -0,0 +1,85 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// message is an alert, as posted by the notification sinks of the tagging
+// function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// alert posts the violations of rep and the actions taken to the alert
+// webhook. cause is the error of failed actions, if any.
+func alert(ctx context.Context, cfg *vcConfig, rep *report, cause error) error {
+	u := cfg.Alert.WebhookURL
+	if u == "" {
+		return nil
+	}
+
+	user := rep.User
+	if user == "" {
+		user = "unknown"
+	}
+
+	msg := message{
+		Title: "Suspicious VM reconfigure",
+		Text:  fmt.Sprintf("%v reconfigured %v (%v): %v", user, rep.Name, rep.VM, strings.Join(rep.Violations, ", ")),
+		Fields: map[string]string{
+			"vm":      rep.VM,
+			"name":    rep.Name,
+			"user":    user,
+			"actions": strings.Join(rep.Actions, ", "),
+		},
+		Time: time.Now().UTC(),
+	}
+	if len(rep.RolledBack) > 0 {
+		msg.Fields["rolled_back"] = strings.Join(rep.RolledBack, ", ")
+	}
+	if cause != nil {
+		msg.Fields["error"] = cause.Error()
+	}
+
+	if err := post(ctx, u, msg); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "alerted")
+
+	return nil
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding alert failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating alert failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending alert failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("alert rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// vmState holds the configuration of a VM checked against the policy.
+type vmState struct {
+	Name              string
+	Template          bool
+	PowerState        types.VirtualMachinePowerState
+	NumCPU            int32
+	NumCoresPerSocket int32
+	MemoryMB          int32
+	Devices           object.VirtualDeviceList
+}
+
+// vmState retrieves the configuration of a VM.
+func (clt *vsClient) vmState(ctx context.Context, ref types.ManagedObjectReference) (*vmState, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "config.template", "config.hardware", "runtime.powerState"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VM %v failed: %w", ref.Value, err)
+	}
+
+	// VMs being created or removed have no config.
+	if vm.Config == nil {
+		return nil, fmt.Errorf("VM %v has no config", ref.Value)
+	}
+
+	hw := vm.Config.Hardware
+	return &vmState{
+		Name:              vm.Name,
+		Template:          vm.Config.Template,
+		PowerState:        vm.Runtime.PowerState,
+		NumCPU:            hw.NumCPU,
+		NumCoresPerSocket: hw.NumCoresPerSocket,
+		MemoryMB:          hw.MemoryMB,
+		Devices:           object.VirtualDeviceList(hw.Device),
+	}, nil
+}
+
+// reconfigure starts reconfiguring a VM with spec and returns the task.
+func (clt *vsClient) reconfigure(ctx context.Context, ref types.ManagedObjectReference, spec types.VirtualMachineConfigSpec) (string, error) {
+	task, err := object.NewVirtualMachine(clt.govmomi.Client, ref).Reconfigure(ctx, spec)
+	if err != nil {
+		return "", fmt.Errorf("reconfigure %v failed: %w", ref.Value, err)
+	}
+
+	return task.Reference().Value, nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,347 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// reconfiguredEvent is the event checked by the function.
+const reconfiguredEvent = "VmReconfiguredEvent"
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Rollback struct {
+		// MaxCPUs and MaxMemoryMB limit the vCPUs and memory of VMs, 0
+		// does not limit them.
+		MaxCPUs     int32 `toml:"max_cpus"`
+		MaxMemoryMB int32 `toml:"max_memory_mb"`
+		// ForbiddenDevices are the kinds of devices VMs must not have,
+		// see deviceKinds.
+		ForbiddenDevices []string `toml:"forbidden_devices"`
+		// ExemptUsers may reconfigure VMs beyond the policy, e.g. the
+		// service account of a rightsizing automation. They are matched
+		// case-insensitively against the user of the event.
+		ExemptUsers []string `toml:"exempt_users"`
+		// TagURN is attached to VMs which violate the policy.
+		TagURN string `toml:"tag_urn"`
+		// ReportOnly tags and alerts, but does not roll back.
+		ReportOnly bool `toml:"report_only"`
+	}
+	Alert struct {
+		// WebhookURL receives violations as JSON, e.g. a security team
+		// channel or a SIEM.
+		WebhookURL string `toml:"webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Vm            *types.VmEventArgument          `json:"Vm,omitempty"`
+		UserName      string                          `json:"UserName,omitempty"`
+		ConfigChanges *types.ChangesInfoEventArgument `json:"ConfigChanges,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// report describes the violations of a VM and the actions taken.
+type report struct {
+	Event      string   `json:"event,omitempty"`
+	VM         string   `json:"vm"`
+	Name       string   `json:"name,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Violations []string `json:"violations,omitempty"`
+	// RolledBack lists the changes of the rollback, e.g. numCPU 8 -> 2.
+	RolledBack   []string `json:"rolled_back,omitempty"`
+	RollbackTask string   `json:"rollback_task,omitempty"`
+	Skipped      string   `json:"skipped,omitempty"`
+	Actions      []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	vm := event.Data.Vm.Vm
+	rep := report{
+		Event: event.Subject,
+		VM:    vm.Value,
+		User:  event.Data.UserName,
+	}
+
+	actionErr := enforce(ctx, clt, cfg, &rep, vm, event.Data.ConfigChanges)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("rolling back reconfigure failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// exempt reports whether user may reconfigure VMs beyond the policy.
+func (cfg *vcConfig) exempt(user string) bool {
+	for _, u := range cfg.Rollback.ExemptUsers {
+		if strings.EqualFold(u, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	r := cfg.Rollback
+	if r.MaxCPUs < 0 || r.MaxMemoryMB < 0 {
+		return errors.New("rollback max_cpus and max_memory_mb must not be negative")
+	}
+
+	// A function without policy finds no violations.
+	if r.MaxCPUs == 0 && r.MaxMemoryMB == 0 && len(r.ForbiddenDevices) == 0 {
+		return errors.New("required field(s) missing, including rollback max_cpus, max_memory_mb or forbidden_devices")
+	}
+
+	for _, kind := range r.ForbiddenDevices {
+		if _, ok := deviceKinds[kind]; !ok {
+			return fmt.Errorf("unsupported rollback forbidden_devices kind %q, expected one of %v", kind, strings.Join(kindNames(), ", "))
+		}
+	}
+
+	// A function which only reports to nobody does nothing.
+	if r.ReportOnly && r.TagURN == "" && cfg.Alert.WebhookURL == "" {
+		return errors.New("rollback report_only requires rollback tag_urn or alert webhook_url")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a reconfigure event of a VM.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Subject != reconfiguredEvent {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty VM")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,411 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.Rollback.MaxCPUs = 8
+	full.Rollback.MaxMemoryMB = 32768
+	full.Rollback.ForbiddenDevices = []string{"serial", "parallel", "usb"}
+	full.Rollback.ExemptUsers = []string{`VSPHERE.LOCAL\svc-rightsizing`}
+	full.Rollback.TagURN = "urn:vmomi:InventoryServiceTag:5e8b2c17-4f3a-4d96-a1c8-3b7e9d0f6a52:GLOBAL"
+	full.Alert.WebhookURL = "https://siem.local.corp/hooks/vsphere"
+
+	reportOnly := vcConfig{}
+	reportOnly.VCenter = full.VCenter
+	reportOnly.VCenter.Insecure = true
+	reportOnly.Rollback.ForbiddenDevices = []string{"serial"}
+	reportOnly.Rollback.TagURN = full.Rollback.TagURN
+	reportOnly.Rollback.ReportOnly = true
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with limits, devices, tag and alert loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&full,
+		},
+		{
+			"Test that toml file reporting forbidden devices only loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&reportOnly,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without policy results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with an unsupported device kind results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml reporting to nobody results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a missing vcconfig.toml results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseEvent shows reconfigure events of VMs are accepted with the values
+// before the reconfigure.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      map[string]string
+	}{
+		{
+			"Test that the reconfigured VM and its previous values are readable",
+			"testdata/event.json",
+			false,
+			map[string]string{propNumCPU: "2", propMemoryMB: "4096"},
+		},
+		{"Event should return error if it has no VM", "testdata/eventErr1.json", true, nil},
+		{"Event should return error if it is no reconfigure", "testdata/eventErr2.json", true, nil},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := previousValues(event.Data.ConfigChanges)
+		if reflect.DeepEqual(got, tc.want) && event.Data.Vm.Vm.Value == "vm-42" && event.Data.UserName == `VSPHERE.LOCAL\jdoe` {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v of %+v. %v", tc.want, got, event.Data, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRollbackSpec shows violating vCPUs and memory are set to their previous
+// values within the limits and forbidden devices are removed.
+func TestRollbackSpec(t *testing.T) {
+	var cfg vcConfig
+	cfg.Rollback.MaxCPUs = 8
+	cfg.Rollback.MaxMemoryMB = 16384
+	cfg.Rollback.ForbiddenDevices = []string{"serial"}
+
+	serial := &types.VirtualSerialPort{VirtualDevice: types.VirtualDevice{
+		Key:        9000,
+		DeviceInfo: &types.Description{Label: "Serial port 1"},
+	}}
+	state := func(cpus, cores, memory int32, devices ...types.BaseVirtualDevice) *vmState {
+		return &vmState{NumCPU: cpus, NumCoresPerSocket: cores, MemoryMB: memory, Devices: devices}
+	}
+
+	var tests = []struct {
+		testDesc       string
+		state          *vmState
+		prev           map[string]string
+		wantChanges    []string
+		wantViolations int
+	}{
+		{
+			"Test that a VM within the policy is not changed",
+			state(8, 4, 16384),
+			map[string]string{propNumCPU: "4"},
+			nil,
+			0,
+		},
+		{
+			"Test that vCPUs and memory are set to their previous values",
+			state(16, 4, 65536),
+			map[string]string{propNumCPU: "4", propMemoryMB: "8192"},
+			[]string{"numCPU 16 -> 4", "memoryMB 65536 -> 8192"},
+			2,
+		},
+		{
+			"Test that unknown or excessive previous values are set to the limit",
+			state(32, 16, 32768),
+			map[string]string{propNumCPU: "24"},
+			[]string{"numCPU 32 -> 8", "numCoresPerSocket 16 -> 1", "memoryMB 32768 -> 16384"},
+			2,
+		},
+		{
+			"Test that previous cores per socket are restored and forbidden devices removed",
+			state(16, 8, 4096, serial),
+			map[string]string{propNumCPU: "4", propNumCoresPerSocket: "2"},
+			[]string{"numCPU 16 -> 4", "numCoresPerSocket 8 -> 2", "removed Serial port 1"},
+			2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		_, changes, violations := cfg.rollbackSpec(tc.state, tc.prev)
+
+		if reflect.DeepEqual(changes, tc.wantChanges) && len(violations) == tc.wantViolations {
+			t.Logf("got expected: %v, violations %v. %v", changes, violations, passMark)
+		} else {
+			t.Logf("expected: %v, %d violations, got: %v, violations %v. %v", tc.wantChanges, tc.wantViolations, changes, violations, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestEnforce shows violating VMs are tagged, alerted on and rolled back once
+// powered off, unless the user is exempt.
+func TestEnforce(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "security", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "suspicious-reconfigure", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// Reconfigure the VM beyond the policy, as an operator would.
+		devices, err := vm.Device(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		serial, err := devices.CreateSerialPort()
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+			NumCPUs: 16,
+			DeviceChange: []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationAdd,
+				Device:    serial,
+			}},
+		})
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var alerts []message
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var msg message
+			if err := json.NewDecoder(r.Body).Decode(&msg); err == nil {
+				alerts = append(alerts, msg)
+			}
+		}))
+		defer srv.Close()
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Rollback.MaxCPUs = 8
+		cfg.Rollback.ForbiddenDevices = []string{"serial"}
+		cfg.Rollback.ExemptUsers = []string{`VSPHERE.LOCAL\svc-rightsizing`}
+		cfg.Rollback.TagURN = tagID
+		cfg.Alert.WebhookURL = srv.URL
+
+		changes := &types.ChangesInfoEventArgument{Modified: "config.hardware.numCPU: 2 -> 16; \n\n"}
+
+		powerOff := func() {
+			task, err := vm.PowerOff(ctx)
+			if err == nil {
+				err = task.Wait(ctx)
+			}
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+
+		var tests = []struct {
+			testDesc    string
+			setup       func()
+			user        string
+			wantActions string
+			wantAlerts  int
+		}{
+			{"Test that changes of exempt users are skipped", nil, `vsphere.local\SVC-RIGHTSIZING`, "", 0},
+			{"Test that a powered on VM is tagged and alerted on, but not rolled back", nil, `VSPHERE.LOCAL\jdoe`, "tagged,rollback needs power off,alerted", 1},
+			{"Test that a powered off VM is rolled back", powerOff, `VSPHERE.LOCAL\jdoe`, "already tagged,rolled back,alerted", 2},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			rep := report{VM: vm.Reference().Value, User: tc.user}
+			if err := enforce(ctx, clt, &cfg, &rep, vm.Reference(), changes); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if got == tc.wantActions && len(alerts) == tc.wantAlerts {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected actions %q and %d alerts, got: %+v, %d alerts. %v", tc.wantActions, tc.wantAlerts, rep, len(alerts), failMark)
+				t.Fail()
+			}
+
+			if rep.RollbackTask == "" {
+				continue
+			}
+
+			t.Log("=========== Test that the rollback restores the previous vCPUs and removes the serial port ===========")
+			task := object.NewTask(c, types.ManagedObjectReference{Type: "Task", Value: rep.RollbackTask})
+			if err := task.Wait(ctx); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			s, err := clt.vmState(ctx, vm.Reference())
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			serials := s.Devices.SelectByType((*types.VirtualSerialPort)(nil))
+			if s.NumCPU == 2 && len(serials) == 0 && alerts[1].Fields["rolled_back"] != "" {
+				t.Logf("got expected: %v vCPUs, rolled back %v. %v", s.NumCPU, alerts[1].Fields["rolled_back"], passMark)
+			} else {
+				t.Logf("expected 2 vCPUs and no serial port, got: %v vCPUs, %d serial ports. %v", s.NumCPU, len(serials), failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
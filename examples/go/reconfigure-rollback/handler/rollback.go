@@ -0,0 +1,245 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Properties of the config changes of an event.
+const (
+	propNumCPU            = "config.hardware.numCPU"
+	propNumCoresPerSocket = "config.hardware.numCoresPerSocket"
+	propMemoryMB          = "config.hardware.memoryMB"
+)
+
+// deviceKinds are the kinds of forbidden_devices by the device types they
+// match.
+var deviceKinds = map[string][]types.BaseVirtualDevice{
+	"serial":   {(*types.VirtualSerialPort)(nil)},
+	"parallel": {(*types.VirtualParallelPort)(nil)},
+	"usb":      {(*types.VirtualUSBController)(nil), (*types.VirtualUSBXHCIController)(nil), (*types.VirtualUSB)(nil)},
+	"pci":      {(*types.VirtualPCIPassthrough)(nil)},
+	"floppy":   {(*types.VirtualFloppy)(nil)},
+}
+
+// kindNames returns the kinds of forbidden_devices, sorted.
+func kindNames() []string {
+	names := make([]string, 0, len(deviceKinds))
+	for k := range deviceKinds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// changePattern matches a modified property of the config changes of a
+// VmReconfiguredEvent, e.g. "config.hardware.numCPU: 2 -> 8;".
+var changePattern = regexp.MustCompile(`([A-Za-z0-9_.()\[\]]+):\s*([^;\n]*?)\s*->\s*([^;\n]*?)\s*;`)
+
+// previousValues returns the values of the modified properties before the
+// reconfigure, by property. vCenter reports config changes since vSphere 6.7,
+// older events have none.
+func previousValues(changes *types.ChangesInfoEventArgument) map[string]string {
+	prev := map[string]string{}
+	if changes == nil {
+		return prev
+	}
+
+	for _, m := range changePattern.FindAllStringSubmatch(changes.Modified, -1) {
+		prev[m[1]] = m[2]
+	}
+
+	return prev
+}
+
+// forbidden returns the devices of s of the forbidden kinds, with the
+// violation each is.
+func (cfg *vcConfig) forbidden(s *vmState) ([]types.BaseVirtualDevice, []string) {
+	var devices []types.BaseVirtualDevice
+	var violations []string
+
+	for _, kind := range cfg.Rollback.ForbiddenDevices {
+		for _, t := range deviceKinds[kind] {
+			for _, d := range s.Devices.SelectByType(t) {
+				devices = append(devices, d)
+				violations = append(violations, fmt.Sprintf("%q is a forbidden %v device", label(s.Devices, d), kind))
+			}
+		}
+	}
+
+	return devices, violations
+}
+
+// label returns the label of device d of l as shown in vSphere, e.g. Serial
+// port 1, or its name if it has none.
+func label(l object.VirtualDeviceList, d types.BaseVirtualDevice) string {
+	if info := d.GetVirtualDevice().DeviceInfo; info != nil {
+		if desc := info.GetDescription(); desc != nil && desc.Label != "" {
+			return desc.Label
+		}
+	}
+
+	return l.Name(d)
+}
+
+// rollbackSpec returns the spec which brings s back within the policy, the
+// changes it makes and the violations of s. The vCPUs and memory are set to
+// their values before the reconfigure, or to the limit if these are unknown
+// or beyond it, and forbidden devices are removed.
+func (cfg *vcConfig) rollbackSpec(s *vmState, prev map[string]string) (types.VirtualMachineConfigSpec, []string, []string) {
+	var spec types.VirtualMachineConfigSpec
+	var changes, violations []string
+
+	r := cfg.Rollback
+	if r.MaxCPUs > 0 && s.NumCPU > r.MaxCPUs {
+		violations = append(violations, fmt.Sprintf("numCPU %v exceeds max_cpus %v", s.NumCPU, r.MaxCPUs))
+
+		spec.NumCPUs = within(prev[propNumCPU], r.MaxCPUs)
+		changes = append(changes, fmt.Sprintf("numCPU %v -> %v", s.NumCPU, spec.NumCPUs))
+
+		// The vCPUs must be a multiple of the cores per socket.
+		cores := s.NumCoresPerSocket
+		if p, ok := prev[propNumCoresPerSocket]; ok {
+			cores = within(p, spec.NumCPUs)
+		}
+		if cores < 1 || spec.NumCPUs%cores != 0 {
+			cores = 1
+		}
+		if cores != s.NumCoresPerSocket {
+			spec.NumCoresPerSocket = cores
+			changes = append(changes, fmt.Sprintf("numCoresPerSocket %v -> %v", s.NumCoresPerSocket, cores))
+		}
+	}
+
+	if r.MaxMemoryMB > 0 && s.MemoryMB > r.MaxMemoryMB {
+		violations = append(violations, fmt.Sprintf("memoryMB %v exceeds max_memory_mb %v", s.MemoryMB, r.MaxMemoryMB))
+
+		spec.MemoryMB = int64(within(prev[propMemoryMB], r.MaxMemoryMB))
+		changes = append(changes, fmt.Sprintf("memoryMB %v -> %v", s.MemoryMB, spec.MemoryMB))
+	}
+
+	devices, forbidden := cfg.forbidden(s)
+	violations = append(violations, forbidden...)
+	for _, d := range devices {
+		spec.DeviceChange = append(spec.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationRemove,
+			Device:    d,
+		})
+		changes = append(changes, fmt.Sprintf("removed %v", label(s.Devices, d)))
+	}
+
+	return spec, changes, violations
+}
+
+// within returns the previous value prev if it is a positive number up to
+// limit, or limit otherwise.
+func within(prev string, limit int32) int32 {
+	v, err := strconv.ParseInt(prev, 10, 32)
+	if err != nil || v < 1 || int32(v) > limit {
+		return limit
+	}
+
+	return int32(v)
+}
+
+// enforce checks the configuration of vm against the policy. VMs which
+// violate it are tagged, rolled back and alerted on. Completed actions are
+// added to rep, the joined errors of failed actions are returned.
+func enforce(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, changes *types.ChangesInfoEventArgument) error {
+	if cfg.exempt(rep.User) {
+		rep.Skipped = "exempt user"
+		return nil
+	}
+
+	s, err := clt.vmState(ctx, vm)
+	if err != nil {
+		return err
+	}
+	rep.Name = s.Name
+
+	// Templates cannot be reconfigured, so they are not rolled back.
+	if s.Template {
+		rep.Skipped = "template"
+		return nil
+	}
+
+	spec, rolledBack, violations := cfg.rollbackSpec(s, previousValues(changes))
+	if len(violations) == 0 {
+		return nil
+	}
+	rep.Violations = violations
+
+	var errs []error
+	if err := mark(ctx, clt, cfg, rep, vm); err != nil {
+		errs = append(errs, err)
+	}
+	if err := rollback(ctx, clt, cfg, rep, vm, s, spec, rolledBack); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Security is alerted even if tagging or the rollback failed, with
+	// the errors.
+	if err := alert(ctx, cfg, rep, errors.Join(errs...)); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// mark attaches the tag of violating VMs to vm, if not attached.
+func mark(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	urn := cfg.Rollback.TagURN
+	if urn == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil {
+		return err
+	}
+	if tagged {
+		rep.Actions = append(rep.Actions, "already tagged")
+		return nil
+	}
+
+	if err := clt.tag(ctx, vm, urn); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "tagged")
+
+	return nil
+}
+
+// rollback starts reconfiguring vm with spec. vSphere neither hot-removes
+// vCPUs and memory nor the forbidden devices, so powered on VMs are only
+// reported. The task is not waited for; its VmReconfiguredEvent checks the VM
+// again.
+func rollback(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, s *vmState, spec types.VirtualMachineConfigSpec, changes []string) error {
+	if cfg.Rollback.ReportOnly {
+		rep.Actions = append(rep.Actions, "report only")
+		return nil
+	}
+
+	if s.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		rep.Actions = append(rep.Actions, "rollback needs power off")
+		return nil
+	}
+
+	task, err := clt.reconfigure(ctx, vm, spec)
+	if err != nil {
+		return err
+	}
+	rep.RollbackTask = task
+	rep.RolledBack = changes
+	rep.Actions = append(rep.Actions, "rolled back")
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Extension keys set in config.managedBy of placeholder VMs by Site Recovery
+// Manager and vSphere Replication.
+var drExtensions = map[string]bool{
+	"com.vmware.vcDr":  true,
+	"com.vmware.vcHms": true,
+}
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	var clt vsClient
+
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+	clt.govmomi = gc
+
+	clt.rest = rest.NewClient(clt.govmomi.Client)
+	err = clt.rest.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &clt, nil
+}
+
+// syncPlaceholder copies the folder location and tags of a protected VM to its
+// placeholder VM in the recovery datacenter.
+func (clt *vsClient) syncPlaceholder(ctx context.Context, cfg *vcConfig, ev *vmEvent) (string, error) {
+	if ev.datacenter != cfg.Replication.RecoveryDatacenter {
+		return fmt.Sprintf("%v is not in recovery datacenter %v, skipping", ev.name, cfg.Replication.RecoveryDatacenter), nil
+	}
+
+	var placeholder mo.VirtualMachine
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := pc.RetrieveOne(ctx, ev.moRef, []string{"name", "parent", "config.managedBy"}, &placeholder)
+	if err != nil {
+		return "", fmt.Errorf("retrieve VM properties failed: %w", err)
+	}
+
+	if !isPlaceholder(placeholder) {
+		return fmt.Sprintf("%v is not a replication placeholder VM, skipping", ev.name), nil
+	}
+
+	protected, err := clt.findVMs(ctx, cfg.Replication.ProtectedDatacenter, placeholder.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(protected) != 1 {
+		return "", fmt.Errorf("expected one protected VM named %v, found %d", placeholder.Name, len(protected))
+	}
+
+	var done []string
+
+	if cfg.Replication.SyncFolders {
+		moved, err := clt.syncFolder(ctx, cfg, protected[0], placeholder)
+		if err != nil {
+			return "", fmt.Errorf("folder synchronization failed: %w", err)
+		}
+		if moved != "" {
+			done = append(done, "moved to "+moved)
+		}
+	}
+
+	if cfg.Replication.SyncTags {
+		n, err := clt.syncTags(ctx, protected[0], ev.moRef)
+		if err != nil {
+			return "", fmt.Errorf("tag synchronization failed: %w", err)
+		}
+		done = append(done, fmt.Sprintf("%d tag(s) attached", n))
+	}
+
+	if len(done) == 0 {
+		return fmt.Sprintf("placeholder %v is in sync", ev.name), nil
+	}
+
+	return fmt.Sprintf("placeholder %v synchronized: %v", ev.name, strings.Join(done, ", ")), nil
+}
+
+// unregisterOrphan unregisters the placeholder VMs of a protected VM which was
+// removed from the inventory.
+func (clt *vsClient) unregisterOrphan(ctx context.Context, cfg *vcConfig, ev *vmEvent) (string, error) {
+	if !cfg.Replication.UnregisterOrphans || ev.datacenter != cfg.Replication.ProtectedDatacenter {
+		return fmt.Sprintf("removal of %v requires no action", ev.name), nil
+	}
+
+	refs, err := clt.findVMs(ctx, cfg.Replication.RecoveryDatacenter, ev.name)
+	if err != nil {
+		return "", err
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	if len(refs) > 0 {
+		err = pc.Retrieve(ctx, refs, []string{"name", "config.managedBy"}, &vms)
+		if err != nil {
+			return "", fmt.Errorf("retrieve VM properties failed: %w", err)
+		}
+	}
+
+	n := 0
+	for _, vm := range vms {
+		if !isPlaceholder(vm) {
+			continue
+		}
+
+		err = object.NewVirtualMachine(clt.govmomi.Client, vm.Reference()).Unregister(ctx)
+		if err != nil {
+			return "", fmt.Errorf("unregister placeholder %v failed: %w", vm.Reference().Value, err)
+		}
+		n++
+	}
+
+	return fmt.Sprintf("%d orphaned placeholder(s) of %v unregistered", n, ev.name), nil
+}
+
+// findVMs returns the VMs with the given name in a datacenter.
+func (clt *vsClient) findVMs(ctx context.Context, datacenter, name string) ([]types.ManagedObjectReference, error) {
+	finder := find.NewFinder(clt.govmomi.Client)
+
+	dc, err := finder.Datacenter(ctx, datacenter)
+	if err != nil {
+		return nil, fmt.Errorf("find datacenter %v failed: %w", datacenter, err)
+	}
+
+	m := view.NewManager(clt.govmomi.Client)
+	v, err := m.CreateContainerView(ctx, dc.Reference(), []string{"VirtualMachine"}, true)
+	if err != nil {
+		return nil, fmt.Errorf("create container view failed: %w", err)
+	}
+	defer v.Destroy(ctx)
+
+	refs, err := v.Find(ctx, []string{"VirtualMachine"}, property.Filter{"name": name})
+	if err != nil {
+		return nil, fmt.Errorf("find VM %v failed: %w", name, err)
+	}
+
+	return refs, nil
+}
+
+// syncFolder moves the placeholder into the folder mirroring the protected
+// VM's folder, creating missing folders. It returns the folder path if the VM
+// was moved.
+func (clt *vsClient) syncFolder(ctx context.Context, cfg *vcConfig, protected types.ManagedObjectReference, placeholder mo.VirtualMachine) (string, error) {
+	finder := find.NewFinder(clt.govmomi.Client)
+
+	e, err := finder.Element(ctx, protected)
+	if err != nil {
+		return "", fmt.Errorf("inventory path of protected VM failed: %w", err)
+	}
+
+	// e.Path is /<datacenter>/vm/<folders...>/<vm>
+	prefix := path.Join("/", cfg.Replication.ProtectedDatacenter, "vm")
+	rel := strings.TrimPrefix(path.Dir(e.Path), prefix)
+
+	dc, err := finder.Datacenter(ctx, cfg.Replication.RecoveryDatacenter)
+	if err != nil {
+		return "", fmt.Errorf("find datacenter %v failed: %w", cfg.Replication.RecoveryDatacenter, err)
+	}
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		return "", fmt.Errorf("datacenter folders failed: %w", err)
+	}
+
+	target := folders.VmFolder
+	finder.SetDatacenter(dc)
+	for _, name := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		p := path.Join(target.InventoryPath, name)
+		f, err := finder.Folder(ctx, p)
+		if err != nil {
+			if _, ok := err.(*find.NotFoundError); !ok {
+				return "", fmt.Errorf("find folder %v failed: %w", p, err)
+			}
+
+			f, err = target.CreateFolder(ctx, name)
+			if err != nil {
+				return "", fmt.Errorf("create folder %v failed: %w", p, err)
+			}
+			f.InventoryPath = p
+		}
+		target = f
+	}
+
+	if placeholder.Parent != nil && *placeholder.Parent == target.Reference() {
+		return "", nil
+	}
+
+	task, err := target.MoveInto(ctx, []types.ManagedObjectReference{placeholder.Reference()})
+	if err != nil {
+		return "", err
+	}
+
+	err = task.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return target.InventoryPath, nil
+}
+
+// syncTags attaches the tags of the protected VM which are missing on the
+// placeholder. It returns the number of attached tags.
+func (clt *vsClient) syncTags(ctx context.Context, protected, placeholder types.ManagedObjectReference) (int, error) {
+	m := tags.NewManager(clt.rest)
+
+	want, err := m.ListAttachedTags(ctx, protected)
+	if err != nil {
+		return 0, fmt.Errorf("list tags of protected VM failed: %w", err)
+	}
+
+	have, err := m.ListAttachedTags(ctx, placeholder)
+	if err != nil {
+		return 0, fmt.Errorf("list tags of placeholder VM failed: %w", err)
+	}
+
+	attached := make(map[string]bool, len(have))
+	for _, id := range have {
+		attached[id] = true
+	}
+
+	n := 0
+	for _, id := range want {
+		if attached[id] {
+			continue
+		}
+
+		err = m.AttachTag(ctx, id, placeholder)
+		if err != nil {
+			return n, fmt.Errorf("attach tag %v failed: %w", id, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isPlaceholder reports whether vm is managed by a replication solution.
+func isPlaceholder(vm mo.VirtualMachine) bool {
+	if vm.Config == nil || vm.Config.ManagedBy == nil {
+		return false
+	}
+
+	return drExtensions[vm.Config.ManagedBy.ExtensionKey]
+}
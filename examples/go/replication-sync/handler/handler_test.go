@@ -0,0 +1,388 @@
+package function
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Replication.ProtectedDatacenter = "dc-site-a"
+	want.Replication.RecoveryDatacenter = "dc-site-b"
+	want.Replication.SyncTags = true
+	want.Replication.SyncFolders = true
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that vcconfig.toml missing the recovery datacenter results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if *cfg == *tc.want {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures that only supported events with a VM and datacenter
+// are accepted.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      *vmEvent
+	}{
+		{
+			"Test that registered event is readable",
+			"testdata/event.json",
+			false,
+			&vmEvent{kind: "VmRegisteredEvent", datacenter: "dc-site-b", name: "web-01"},
+		},
+		{
+			"Event should return error if event type is not supported",
+			"testdata/eventErr1.json",
+			true,
+			nil,
+		},
+		{
+			"Event should return error if datacenter is null",
+			"testdata/eventErr2.json",
+			true,
+			nil,
+		},
+		{
+			"Event should return error if VM is null",
+			"testdata/eventErr3.json",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		ev, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if ev.kind == tc.want.kind && ev.datacenter == tc.want.datacenter && ev.name == tc.want.name {
+			t.Logf("got expected: %+v. %v", *tc.want, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", *tc.want, *ev, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestSync shows placeholders are moved into the folder of the protected VM
+// and get its tags, and that only placeholders of removed VMs are unregistered.
+func TestSync(t *testing.T) {
+	model := simulator.VPX()
+	model.Datacenter = 2
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Replication.ProtectedDatacenter = "DC0"
+		cfg.Replication.RecoveryDatacenter = "DC1"
+		cfg.Replication.UnregisterOrphans = true
+
+		finder := find.NewFinder(c)
+		vm := func(p string) *object.VirtualMachine {
+			vm, err := finder.VirtualMachine(ctx, p)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			return vm
+		}
+		wait := func(task *object.Task, err error) {
+			if err == nil {
+				err = task.Wait(ctx)
+			}
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+		// placeholder makes vm a powered off placeholder named name.
+		placeholder := func(vm *object.VirtualMachine, name string) {
+			wait(vm.PowerOff(ctx))
+			wait(vm.Rename(ctx, name))
+			sim := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine)
+			sim.Config.ManagedBy = &types.ManagedByInfo{ExtensionKey: "com.vmware.vcDr", Type: "placeholderVm"}
+		}
+
+		// web-01 is protected in DC0/vm/apps/web with a placeholder in DC1.
+		protected := vm("/DC0/vm/DC0_H0_VM0")
+		wait(protected.Rename(ctx, "web-01"))
+		dc0, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		folders, err := dc0.Folders(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		apps, err := folders.VmFolder.CreateFolder(ctx, "apps")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		web, err := apps.CreateFolder(ctx, "web")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		wait(web.MoveInto(ctx, []types.ManagedObjectReference{protected.Reference()}))
+
+		ph := vm("/DC1/vm/DC1_H0_VM0")
+		placeholder(ph, "web-01")
+
+		// web-02 was removed from DC0. DC1 has its placeholder and a VM of
+		// the same name which is no placeholder.
+		orphan := vm("/DC1/vm/DC1_H0_VM1")
+		placeholder(orphan, "web-02")
+		kept := vm("/DC1/vm/DC1_C0_RP0_VM0")
+		wait(kept.PowerOff(ctx))
+		dc1, err := finder.Datacenter(ctx, "DC1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		folders1, err := dc1.Folders(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		lab, err := folders1.VmFolder.CreateFolder(ctx, "lab")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		wait(lab.MoveInto(ctx, []types.ManagedObjectReference{kept.Reference()}))
+		wait(kept.Rename(ctx, "web-02"))
+
+		m := tags.NewManager(rc)
+		catID, err := m.CreateCategory(ctx, &tags.Category{Name: "tier", Cardinality: "MULTIPLE", AssociableTypes: []string{"VirtualMachine"}})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		var tagIDs []string
+		for _, name := range []string{"gold", "frontend"} {
+			id, err := m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: catID})
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			tagIDs = append(tagIDs, id)
+		}
+		for _, id := range tagIDs {
+			if err := m.AttachTag(ctx, id, protected); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+		// One tag is already attached to the placeholder.
+		if err := m.AttachTag(ctx, tagIDs[0], ph); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		t.Log("=========== Test that the placeholder is moved into the folder of the protected VM ===========")
+		var phInfo mo.VirtualMachine
+		err = property.DefaultCollector(c).RetrieveOne(ctx, ph.Reference(), []string{"name", "parent"}, &phInfo)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		moved, err := clt.syncFolder(ctx, &cfg, protected.Reference(), phInfo)
+		if err == nil && moved == "/DC1/vm/apps/web" {
+			t.Logf("got expected: %v. %v", moved, passMark)
+		} else {
+			t.Logf("expected: /DC1/vm/apps/web, got: %v (%v). %v", moved, err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a placeholder in the folder is not moved again ===========")
+		err = property.DefaultCollector(c).RetrieveOne(ctx, ph.Reference(), []string{"name", "parent"}, &phInfo)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		moved, err = clt.syncFolder(ctx, &cfg, protected.Reference(), phInfo)
+		if err == nil && moved == "" {
+			t.Logf("got expected: not moved. %v", passMark)
+		} else {
+			t.Logf("expected: not moved, got: %v (%v). %v", moved, err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that only missing tags are attached to the placeholder ===========")
+		n, err := clt.syncTags(ctx, protected.Reference(), ph.Reference())
+		attached, lerr := m.ListAttachedTags(ctx, ph)
+		if err == nil && lerr == nil && n == 1 && len(attached) == 2 {
+			t.Logf("got expected: 1 attached, 2 on placeholder. %v", passMark)
+		} else {
+			t.Logf("expected: 1 attached, 2 on placeholder, got: %d, %d (%v, %v). %v", n, len(attached), err, lerr, failMark)
+			t.Fail()
+		}
+
+		var tests = []struct {
+			testDesc       string
+			ev             vmEvent
+			unregisterOff  bool
+			wantMsg        string
+			wantRegistered map[types.ManagedObjectReference]bool
+		}{
+			{
+				"Test that orphans are kept if unregistering is disabled",
+				vmEvent{datacenter: "DC0", name: "web-02"},
+				true,
+				"removal of web-02 requires no action",
+				map[types.ManagedObjectReference]bool{orphan.Reference(): true, kept.Reference(): true},
+			},
+			{
+				"Test that removals in the recovery datacenter require no action",
+				vmEvent{datacenter: "DC1", name: "web-02"},
+				false,
+				"removal of web-02 requires no action",
+				map[types.ManagedObjectReference]bool{orphan.Reference(): true, kept.Reference(): true},
+			},
+			{
+				"Test that only the placeholder of a removed VM is unregistered",
+				vmEvent{datacenter: "DC0", name: "web-02"},
+				false,
+				"1 orphaned placeholder(s) of web-02 unregistered",
+				map[types.ManagedObjectReference]bool{orphan.Reference(): false, kept.Reference(): true},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			cfg.Replication.UnregisterOrphans = !tc.unregisterOff
+
+			msg, err := clt.unregisterOrphan(ctx, &cfg, &tc.ev)
+
+			ok := err == nil && msg == tc.wantMsg
+			for ref, want := range tc.wantRegistered {
+				if registered := simulator.Map.Get(ref) != nil; registered != want {
+					t.Logf("expected %v registered: %v. %v", ref.Value, want, failMark)
+					ok = false
+				}
+			}
+			if ok {
+				t.Logf("got expected: %v. %v", msg, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.wantMsg, msg, err, failMark)
+				t.Fail()
+			}
+		}
+	}, model)
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
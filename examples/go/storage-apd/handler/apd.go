@@ -0,0 +1,176 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vmResult describes a VM impacted by a lost device and the actions taken.
+type vmResult struct {
+	VM   string `json:"vm"`
+	Name string `json:"name"`
+	// Reaction is the HA component protection of the VM for the lost
+	// device, e.g. restartConservative, if restarts are enabled.
+	Reaction string   `json:"reaction,omitempty"`
+	Actions  []string `json:"actions,omitempty"`
+}
+
+// respond acts on the VMs of the host of event which use a datastore on the
+// device of event and pages the on-call, also if acting failed. Completed
+// actions are added to rep, the joined errors of failed actions are returned.
+func respond(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, event *incoming) error {
+	err := act(ctx, clt, cfg, rep, event)
+
+	return errors.Join(err, page(ctx, cfg, rep))
+}
+
+// act tags the VMs impacted by a lost device, restarts them if configured and
+// untags them once the device is reachable again.
+func act(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, event *incoming) error {
+	host := *event.host()
+	hs, err := clt.hostStorage(ctx, host)
+	if err != nil {
+		return err
+	}
+	rep.HostName = hs.Name
+
+	stores := onDevice(hs.Datastores, event)
+	if len(stores) == 0 {
+		rep.Skipped = "no datastore of the host is on the device"
+		return nil
+	}
+	for _, ds := range stores {
+		rep.Datastores = append(rep.Datastores, datastore{Datastore: ds.Self.Value, Name: ds.Summary.Name})
+	}
+
+	vms, err := clt.vmStates(ctx, hs.VMs)
+	if err != nil {
+		return err
+	}
+	vms = impactedVMs(vms, stores)
+	if len(vms) == 0 {
+		rep.Skipped = "no VM of the host uses the datastores"
+		return nil
+	}
+
+	var errs []error
+	for _, vm := range vms {
+		res := vmResult{VM: vm.Self.Value, Name: vm.Name}
+
+		if urn := cfg.APD.TagURN; urn != "" {
+			if rep.Kind == kindCleared {
+				err = release(ctx, clt, urn, &res, vm.Self)
+			} else {
+				err = mark(ctx, clt, urn, &res, vm.Self)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		rep.VMs = append(rep.VMs, res)
+	}
+
+	if cfg.APD.Restart && (rep.Kind == kindAPDTimeout || rep.Kind == kindPDL) {
+		errs = append(errs, restart(ctx, clt, rep, hs, host, stores, vms))
+	}
+
+	return errors.Join(errs...)
+}
+
+// onDevice returns the datastores of the event: the datastore it names or
+// the VMFS datastores with an extent on the device named in its arguments or
+// message.
+func onDevice(stores []mo.Datastore, event *incoming) []mo.Datastore {
+	var out []mo.Datastore
+
+	if ds := event.Data.Ds; ds != nil && ds.Datastore.Value != "" {
+		for _, s := range stores {
+			if s.Self == ds.Datastore {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	texts := event.texts()
+	for _, s := range stores {
+		info, ok := s.Info.(*types.VmfsDatastoreInfo)
+		if !ok || info.Vmfs == nil {
+			continue
+		}
+
+	extents:
+		for _, e := range info.Vmfs.Extent {
+			for _, t := range texts {
+				if e.DiskName != "" && strings.Contains(t, e.DiskName) {
+					out = append(out, s)
+					break extents
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// impactedVMs returns the VMs of vms with files on one of stores, sorted.
+func impactedVMs(vms []mo.VirtualMachine, stores []mo.Datastore) []mo.VirtualMachine {
+	on := map[types.ManagedObjectReference]bool{}
+	for _, s := range stores {
+		on[s.Self] = true
+	}
+
+	var out []mo.VirtualMachine
+	for _, vm := range vms {
+		for _, ds := range vm.Datastore {
+			if on[ds] {
+				out = append(out, vm)
+				break
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Self.Value < out[j].Self.Value })
+
+	return out
+}
+
+// mark attaches the tag urn to vm, if not attached.
+func mark(ctx context.Context, clt *vsClient, urn string, res *vmResult, vm types.ManagedObjectReference) error {
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil {
+		return err
+	}
+	if tagged {
+		res.Actions = append(res.Actions, "already tagged")
+		return nil
+	}
+
+	if err := clt.tag(ctx, vm, urn); err != nil {
+		return err
+	}
+	res.Actions = append(res.Actions, "tagged")
+
+	return nil
+}
+
+// release detaches the tag urn from vm, if attached.
+func release(ctx context.Context, clt *vsClient, urn string, res *vmResult, vm types.ManagedObjectReference) error {
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, urn); err != nil {
+		return err
+	}
+	res.Actions = append(res.Actions, "untagged")
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// hostStorage holds the name, cluster, VMs and datastores of a host.
+type hostStorage struct {
+	Name string
+	// Cluster is nil for standalone hosts.
+	Cluster    *types.ManagedObjectReference
+	VMs        []types.ManagedObjectReference
+	Datastores []mo.Datastore
+}
+
+// hostStorage retrieves the VMs of a host and its datastores with their
+// extents and mounts.
+func (clt *vsClient) hostStorage(ctx context.Context, ref types.ManagedObjectReference) (*hostStorage, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var host mo.HostSystem
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "parent", "vm", "datastore"}, &host)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve host %v failed: %w", ref.Value, err)
+	}
+
+	hs := &hostStorage{Name: host.Name, VMs: host.Vm}
+	if p := host.Parent; p != nil && p.Type == "ClusterComputeResource" {
+		hs.Cluster = p
+	}
+
+	if len(host.Datastore) > 0 {
+		err = pc.Retrieve(ctx, host.Datastore, []string{"summary.name", "info", "host"}, &hs.Datastores)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve datastores of host %v failed: %w", ref.Value, err)
+		}
+	}
+
+	return hs, nil
+}
+
+// vmStates retrieves the names, datastores and power states of vms.
+func (clt *vsClient) vmStates(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+
+	var content []mo.VirtualMachine
+	err := property.DefaultCollector(clt.govmomi.Client).Retrieve(ctx, vms, []string{"name", "datastore", "runtime.powerState"}, &content)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve datastores of %d VMs failed: %w", len(vms), err)
+	}
+
+	return content, nil
+}
+
+// clusterConfig retrieves the HA configuration of a cluster.
+func (clt *vsClient) clusterConfig(ctx context.Context, ref types.ManagedObjectReference) (*types.ClusterConfigInfoEx, error) {
+	var cluster mo.ClusterComputeResource
+	err := property.DefaultCollector(clt.govmomi.Client).RetrieveOne(ctx, ref, []string{"configurationEx"}, &cluster)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve configuration of cluster %v failed: %w", ref.Value, err)
+	}
+
+	cfg, ok := cluster.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return nil, fmt.Errorf("unexpected configuration of cluster %v", ref.Value)
+	}
+
+	return cfg, nil
+}
+
+// hostStates retrieves the cluster, connection and maintenance state of hosts.
+func (clt *vsClient) hostStates(ctx context.Context, hosts []types.ManagedObjectReference) ([]mo.HostSystem, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	var content []mo.HostSystem
+	err := property.DefaultCollector(clt.govmomi.Client).Retrieve(ctx, hosts, []string{"name", "parent", "runtime.connectionState", "runtime.inMaintenanceMode"}, &content)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve state of %d hosts failed: %w", len(hosts), err)
+	}
+
+	return content, nil
+}
+
+// restartVM powers off vm and powers it on on host.
+func (clt *vsClient) restartVM(ctx context.Context, vm, host types.ManagedObjectReference) error {
+	c := clt.govmomi.Client
+
+	task, err := object.NewVirtualMachine(c, vm).PowerOff(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("power off of %v failed: %w", vm.Value, err)
+	}
+
+	res, err := methods.PowerOnVM_Task(ctx, c, &types.PowerOnVM_Task{This: vm, Host: &host})
+	if err == nil {
+		err = object.NewTask(c, res.Returnval).Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("power on of %v on %v failed: %w", vm.Value, host.Value, err)
+	}
+
+	return nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
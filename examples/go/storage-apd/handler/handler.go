@@ -0,0 +1,406 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Kinds of storage events.
+const (
+	kindAPD        = "apd"         // all paths of a device are down
+	kindAPDTimeout = "apd-timeout" // the APD timeout expired, I/O fails
+	kindPDL        = "pdl"         // the device is permanently lost
+	kindCleared    = "cleared"     // the device is reachable again
+)
+
+// eventKinds maps the events handled by the function to their kind.
+var eventKinds = map[string]string{
+	"esx.problem.storage.apd.start":                          kindAPD,
+	"esx.problem.storage.apd.timeout":                        kindAPDTimeout,
+	"esx.problem.scsi.device.state.permanentloss":            kindPDL,
+	"esx.clear.storage.apd.exit":                             kindCleared,
+	"esx.clear.scsi.device.state.permanentloss.deviceonline": kindCleared,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	APD struct {
+		// Events limits the handled events of eventKinds, all without
+		// it.
+		Events []string
+		// TagURN is attached to the VMs impacted by a lost device and
+		// detached once the device is reachable again.
+		TagURN string `toml:"tag_urn"`
+		// Restart restarts the VMs whose HA component protection
+		// restarts them for the lost device on another host, unless HA
+		// does so itself.
+		Restart bool
+	}
+	Notify struct {
+		// Lost and reachable devices are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+		// PagerDutyRoutingKey pages the storage on-call for lost
+		// devices, the incident is resolved once the device is
+		// reachable again.
+		PagerDutyRoutingKey string `toml:"pagerduty_routing_key"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Host *types.HostEventArgument      `json:"Host,omitempty"`
+		Ds   *types.DatastoreEventArgument `json:"Ds,omitempty"`
+		// ESX events name the device in their arguments and message.
+		Arguments            []argument `json:"Arguments,omitempty"`
+		Message              string     `json:"Message,omitempty"`
+		FullFormattedMessage string     `json:"FullFormattedMessage,omitempty"`
+		ObjectId             string     `json:"ObjectId,omitempty"`
+		ObjectType           string     `json:"ObjectType,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// argument is an argument of an ESX event, e.g. the device name.
+type argument struct {
+	Key   string      `json:"Key"`
+	Value interface{} `json:"Value"`
+}
+
+// host returns the host of the event, nil if it has none. Events of ESX name
+// their host as object.
+func (e *incoming) host() *types.ManagedObjectReference {
+	if h := e.Data.Host; h != nil && h.Host.Value != "" {
+		return &h.Host
+	}
+
+	if e.Data.ObjectType == "HostSystem" && e.Data.ObjectId != "" {
+		return &types.ManagedObjectReference{Type: "HostSystem", Value: e.Data.ObjectId}
+	}
+
+	return nil
+}
+
+// texts returns the text arguments and messages of the event, which name the
+// device.
+func (e *incoming) texts() []string {
+	var texts []string
+	for _, a := range e.Data.Arguments {
+		if s, ok := a.Value.(string); ok && s != "" {
+			texts = append(texts, s)
+		}
+	}
+
+	for _, m := range []string{e.Data.Message, e.Data.FullFormattedMessage} {
+		if m != "" {
+			texts = append(texts, m)
+		}
+	}
+
+	return texts
+}
+
+// report describes the impact of a lost or reachable device and the actions
+// taken.
+type report struct {
+	Event      string      `json:"event"`
+	Kind       string      `json:"kind"`
+	Host       string      `json:"host"`
+	HostName   string      `json:"host_name,omitempty"`
+	Datastores []datastore `json:"datastores,omitempty"`
+	VMs        []vmResult  `json:"vms,omitempty"`
+	// Skipped is the reason no VM was acted on.
+	Skipped string   `json:"skipped,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+}
+
+// datastore is a datastore on the lost device.
+type datastore struct {
+	Datastore string `json:"datastore"`
+	Name      string `json:"name"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{
+		Event: event.Subject,
+		Kind:  eventKinds[event.Subject],
+		Host:  event.host().Value,
+	}
+
+	actionErr := respond(ctx, clt, cfg, &rep, event)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("responding to storage event failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// handles reports whether the function handles event.
+func (cfg *vcConfig) handles(event string) bool {
+	if _, ok := eventKinds[event]; !ok {
+		return false
+	}
+	if len(cfg.APD.Events) == 0 {
+		return true
+	}
+
+	for _, e := range cfg.APD.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// A lost device nobody learns about is not worth handling.
+	n := cfg.Notify
+	if cfg.APD.TagURN == "" && !cfg.APD.Restart && n.WebhookURL == "" && n.SlackWebhookURL == "" && n.PagerDutyRoutingKey == "" {
+		return errors.New("required field(s) missing, including apd tag_urn, restart or a notify sink")
+	}
+
+	for _, e := range cfg.APD.Events {
+		if _, ok := eventKinds[e]; !ok {
+			return fmt.Errorf("unsupported apd event %q", e)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured storage event of a host.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.handles(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.host() == nil {
+		return nil, errors.New("empty host")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
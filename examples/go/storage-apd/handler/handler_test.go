@@ -0,0 +1,564 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.APD.Events = []string{"esx.problem.storage.apd.timeout", "esx.problem.scsi.device.state.permanentloss", "esx.clear.storage.apd.exit"}
+	full.APD.TagURN = "urn:vmomi:InventoryServiceTag:3d8f2a61-9c4e-4b17-a5d0-6e2f7b9c1a84:GLOBAL"
+	full.APD.Restart = true
+	full.Notify.SlackWebhookURL = "https://hooks.slack.com/services/storage"
+	full.Notify.PagerDutyRoutingKey = "R0UT1NGK3Y"
+
+	paged := vcConfig{}
+	paged.VCenter = full.VCenter
+	paged.VCenter.Insecure = true
+	paged.Notify.PagerDutyRoutingKey = "R0UT1NGK3Y"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with all sections loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&full,
+		},
+		{
+			"Test that toml file with only a PagerDuty routing key loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&paged,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag, restart or sinks results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with an unsupported event results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		got, err := loadTomlCfg(tc.cfgPath)
+		if (err != nil) != tc.expectErr {
+			t.Logf("expected error %v, got: %v. %v", tc.expectErr, err, failMark)
+			t.Fail()
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseEvent shows only configured storage events of a host are accepted.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		eventPath string
+		expectErr bool
+		wantHost  string
+		wantKind  string
+	}{
+		{
+			"Test that an APD timeout of a host is accepted",
+			"testdata/event.json",
+			false,
+			"host-12",
+			kindAPDTimeout,
+		},
+		{
+			"Test that an event naming its host as object is accepted",
+			"testdata/event2.json",
+			false,
+			"host-12",
+			kindCleared,
+		},
+		{
+			"Test that an unsupported event results in error",
+			"testdata/eventErr1.json",
+			true,
+			"",
+			"",
+		},
+		{
+			"Test that an event without host results in error",
+			"testdata/eventErr2.json",
+			true,
+			"",
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		body, err := os.ReadFile(tc.eventPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if (err != nil) != tc.expectErr {
+			t.Logf("expected error %v, got: %v. %v", tc.expectErr, err, failMark)
+			t.Fail()
+			continue
+		}
+		if err != nil {
+			t.Logf("got expected error: %v. %v", err, passMark)
+			continue
+		}
+
+		if got, kind := event.host().Value, eventKinds[event.Subject]; got == tc.wantHost && kind == tc.wantKind {
+			t.Logf("got expected: %v, %v. %v", got, kind, passMark)
+		} else {
+			t.Logf("expected: %v, %v, got: %v, %v. %v", tc.wantHost, tc.wantKind, got, kind, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that events not in events are rejected ===========")
+	cfg.APD.Events = []string{"esx.problem.storage.apd.start"}
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	if _, err := parseEvent(body, cfg); err != nil {
+		t.Logf("got expected error: %v. %v", err, passMark)
+	} else {
+		t.Log("expected an error. ", failMark)
+		t.Fail()
+	}
+}
+
+// TestOnDevice shows the datastores of a lost device are found by the device
+// named in the event or by the datastore of the event.
+func TestOnDevice(t *testing.T) {
+	vmfs := func(ref, disk string) mo.Datastore {
+		ds := mo.Datastore{Info: &types.VmfsDatastoreInfo{
+			Vmfs: &types.HostVmfsVolume{Extent: []types.HostScsiDiskPartition{{DiskName: disk}}},
+		}}
+		ds.Self = types.ManagedObjectReference{Type: "Datastore", Value: ref}
+		return ds
+	}
+	nfs := mo.Datastore{Info: &types.NasDatastoreInfo{}}
+	nfs.Self = types.ManagedObjectReference{Type: "Datastore", Value: "datastore-3"}
+
+	stores := []mo.Datastore{
+		vmfs("datastore-1", "naa.600a098038303053453f463045727a4b"),
+		vmfs("datastore-2", "naa.600a098038303053453f463045727a4c"),
+		nfs,
+	}
+
+	event := func(arg, msg string, ds string) *incoming {
+		var e incoming
+		if arg != "" {
+			e.Data.Arguments = []argument{{Key: "1", Value: arg}}
+		}
+		e.Data.FullFormattedMessage = msg
+		if ds != "" {
+			e.Data.Ds = &types.DatastoreEventArgument{Datastore: types.ManagedObjectReference{Type: "Datastore", Value: ds}}
+		}
+		return &e
+	}
+
+	var tests = []struct {
+		testDesc string
+		event    *incoming
+		want     []string
+	}{
+		{
+			"Test that the device of the arguments is found",
+			event("naa.600a098038303053453f463045727a4c", "", ""),
+			[]string{"datastore-2"},
+		},
+		{
+			"Test that the device of the message is found",
+			event("", "Device naa.600a098038303053453f463045727a4b has entered the All Paths Down state.", ""),
+			[]string{"datastore-1"},
+		},
+		{
+			"Test that the datastore of the event is used",
+			event("naa.600a098038303053453f463045727a4c", "", "datastore-3"),
+			[]string{"datastore-3"},
+		},
+		{
+			"Test that an unknown device has no datastore",
+			event("naa.600a098038303053453f463045727a4d", "", ""),
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		var got []string
+		for _, ds := range onDevice(stores, tc.event) {
+			got = append(got, ds.Self.Value)
+		}
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestReaction shows the HA component protection of a VM overrides the
+// default of its cluster.
+func TestReaction(t *testing.T) {
+	vm := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+	settings := func(apd, pdl string) *types.ClusterDasVmSettings {
+		return &types.ClusterDasVmSettings{VmComponentProtectionSettings: &types.ClusterVmComponentProtectionSettings{
+			VmStorageProtectionForAPD: apd,
+			VmStorageProtectionForPDL: pdl,
+		}}
+	}
+	cluster := func(def, override *types.ClusterDasVmSettings) *types.ClusterConfigInfoEx {
+		cc := &types.ClusterConfigInfoEx{}
+		cc.DasConfig.DefaultVmSettings = def
+		if override != nil {
+			cc.DasVmConfig = []types.ClusterDasVmConfigInfo{{Key: vm, DasSettings: override}}
+		}
+		return cc
+	}
+
+	var tests = []struct {
+		testDesc string
+		cluster  *types.ClusterConfigInfoEx
+		kind     string
+		want     string
+	}{
+		{
+			"Test that a VM without settings is not protected",
+			cluster(nil, nil),
+			kindAPDTimeout,
+			"disabled",
+		},
+		{
+			"Test that the default of the cluster applies to APD",
+			cluster(settings("restartConservative", "warning"), nil),
+			kindAPDTimeout,
+			"restartConservative",
+		},
+		{
+			"Test that the default of the cluster applies to PDL",
+			cluster(settings("restartConservative", "warning"), nil),
+			kindPDL,
+			"warning",
+		},
+		{
+			"Test that the setting of the VM overrides the cluster",
+			cluster(settings("warning", "warning"), settings("restartAggressive", "")),
+			kindAPDTimeout,
+			"restartAggressive",
+		},
+		{
+			"Test that a VM using the cluster default keeps it",
+			cluster(settings("warning", "restartAggressive"), settings("clusterDefault", "clusterDefault")),
+			kindPDL,
+			"restartAggressive",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		if got := reaction(tc.cluster, vm, tc.kind); got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRespond shows the VMs of a host on a lost datastore are tagged,
+// restarted on another host and the on-call is paged, and that the tag is
+// detached and the incident resolved once the datastore is reachable again.
+func TestRespond(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "storage", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "apd-impacted", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		vm, err := finder.VirtualMachine(ctx, "DC0_C0_RP0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		ds, err := finder.Datastore(ctx, "LocalDS_0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		host, err := vm.HostSystem(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// VM0 restarts for APD, the cluster default does not.
+		cluster, err := finder.ClusterComputeResource(ctx, "DC0_C0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// vcsim lists a single host mounting the datastore, which may be the
+		// host of the VM. All hosts of the cluster mount it, so the VM can
+		// be restarted on any of them.
+		simDS := simulator.Map.Get(ds.Reference()).(*simulator.Datastore)
+		mounted := map[types.ManagedObjectReference]bool{}
+		for _, m := range simDS.Host {
+			mounted[m.Key] = true
+		}
+		for _, h := range simulator.Map.Get(cluster.Reference()).(*simulator.ClusterComputeResource).Host {
+			if !mounted[h] {
+				simDS.Host = append(simDS.Host, types.DatastoreHostMount{
+					Key:       h,
+					MountInfo: types.HostMountInfo{Mounted: types.NewBool(true), Accessible: types.NewBool(true)},
+				})
+			}
+		}
+		task, err := cluster.Reconfigure(ctx, &types.ClusterConfigSpecEx{
+			DasVmConfigSpec: []types.ClusterDasVmConfigSpec{{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+				Info: &types.ClusterDasVmConfigInfo{
+					Key: vm.Reference(),
+					DasSettings: &types.ClusterDasVmSettings{VmComponentProtectionSettings: &types.ClusterVmComponentProtectionSettings{
+						VmStorageProtectionForAPD: "restartConservative",
+					}},
+				},
+			}},
+		}, true)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var mu sync.Mutex
+		var pages []pagerDutyEvent
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ev pagerDutyEvent
+			json.NewDecoder(r.Body).Decode(&ev)
+			mu.Lock()
+			pages = append(pages, ev)
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srv.Close()
+		defer func(u string) { pagerDutyURL = u }(pagerDutyURL)
+		pagerDutyURL = srv.URL
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.APD.TagURN = tagID
+		cfg.APD.Restart = true
+		cfg.Notify.PagerDutyRoutingKey = "R0UT1NGK3Y"
+
+		event := func(subject string) *incoming {
+			var e incoming
+			e.Subject = subject
+			e.Data.Host = &types.HostEventArgument{Host: host.Reference()}
+			e.Data.Ds = &types.DatastoreEventArgument{Datastore: ds.Reference()}
+			return &e
+		}
+
+		var tests = []struct {
+			testDesc    string
+			subject     string
+			wantActions string
+			wantPage    string
+		}{
+			{
+				"Test that an APD tags the VM without restart",
+				"esx.problem.storage.apd.start",
+				"tagged",
+				"trigger",
+			},
+			{
+				"Test that an APD timeout restarts the VM on another host",
+				"esx.problem.storage.apd.timeout",
+				"already tagged,restarted on ",
+				"trigger",
+			},
+			{
+				"Test that a reachable device untags the VM",
+				"esx.clear.storage.apd.exit",
+				"untagged",
+				"resolve",
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			mu.Lock()
+			pages = nil
+			mu.Unlock()
+
+			e := event(tc.subject)
+			rep := report{Event: tc.subject, Kind: eventKinds[tc.subject], Host: host.Reference().Value}
+			if err := respond(ctx, clt, &cfg, &rep, e); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			var got string
+			for _, v := range rep.VMs {
+				if v.VM == vm.Reference().Value {
+					got = strings.Join(v.Actions, ",")
+				}
+			}
+			if strings.HasPrefix(got, tc.wantActions) {
+				t.Logf("got expected: %q. %v", got, passMark)
+			} else {
+				t.Logf("expected actions %q, got: %q (%+v). %v", tc.wantActions, got, rep, failMark)
+				t.Fail()
+			}
+
+			mu.Lock()
+			if len(pages) == 1 && pages[0].EventAction == tc.wantPage && pages[0].DedupKey == "veba/apd/"+host.Reference().Value+"/"+ds.Reference().Value {
+				t.Logf("got expected page: %v %v. %v", pages[0].EventAction, pages[0].DedupKey, passMark)
+			} else {
+				t.Logf("expected a %v page, got: %+v. %v", tc.wantPage, pages, failMark)
+				t.Fail()
+			}
+			mu.Unlock()
+		}
+
+		t.Log("=========== Test that the restarted VM is powered on ===========")
+		state, err := vm.PowerState(ctx)
+		if err != nil || state != types.VirtualMachinePowerStatePoweredOn {
+			t.Fatalf("expected a powered on VM, got: %v (%v). %v", state, err, failMark)
+		}
+		t.Logf("got expected: %v. %v", state, passMark)
+
+		t.Log("=========== Test that HA component protection prevents restarts ===========")
+		sim := simulator.Map.Get(cluster.Reference()).(*simulator.ClusterComputeResource)
+		das := &sim.ConfigurationEx.(*types.ClusterConfigInfoEx).DasConfig
+		das.Enabled = types.NewBool(true)
+		das.VmComponentProtecting = "enabled"
+
+		rep := report{Kind: kindAPDTimeout, Host: host.Reference().Value}
+		if err := respond(ctx, clt, &cfg, &rep, event("esx.problem.storage.apd.timeout")); err != nil {
+			t.Fatal(failMark, err)
+		}
+		if got := strings.Join(rep.Actions, ","); strings.HasPrefix(got, "restart skipped, HA component protection") {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected restart to be skipped, got: %q. %v", got, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pagerDutyURL is the PagerDuty Events API v2 endpoint.
+var pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// titles describe the kinds of storage events.
+var titles = map[string]string{
+	kindAPD:        "All paths down",
+	kindAPDTimeout: "All paths down, timeout expired",
+	kindPDL:        "Permanent device loss",
+	kindCleared:    "Storage device reachable again",
+}
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// deviceMessage returns the notification of the lost or reachable device of
+// rep, listing the impacted VMs and the actions taken.
+func deviceMessage(rep *report) message {
+	host := rep.Host
+	if rep.HostName != "" {
+		host = rep.HostName
+	}
+
+	names := make([]string, 0, len(rep.Datastores))
+	for _, ds := range rep.Datastores {
+		names = append(names, ds.Name)
+	}
+
+	text := fmt.Sprintf("%v on host %v, %d VM(s) impacted", titles[rep.Kind], host, len(rep.VMs))
+	if rep.Kind == kindCleared {
+		text = fmt.Sprintf("%v on host %v", titles[rep.Kind], host)
+	}
+
+	msg := message{
+		Title: titles[rep.Kind],
+		Text:  text,
+		Fields: map[string]string{
+			"event": rep.Event,
+			"host":  host,
+		},
+		Time: time.Now().UTC(),
+	}
+	if len(names) > 0 {
+		msg.Fields["datastores"] = strings.Join(names, ", ")
+	}
+	if rep.Skipped != "" {
+		msg.Fields["skipped"] = rep.Skipped
+	}
+	if len(rep.Actions) > 0 {
+		msg.Fields["actions"] = strings.Join(rep.Actions, ", ")
+	}
+	for _, v := range rep.VMs {
+		actions := "impacted"
+		if len(v.Actions) > 0 {
+			actions = strings.Join(v.Actions, ", ")
+		}
+		msg.Fields["vm "+v.Name] = actions
+	}
+
+	return msg
+}
+
+// incidentKeys returns the deduplication keys of the incidents of rep, one per
+// datastore, so the incident of a datastore is resolved by the event of the
+// same device. Devices without datastore have one incident per host.
+func incidentKeys(rep *report) []string {
+	if len(rep.Datastores) == 0 {
+		return []string{"veba/apd/" + rep.Host}
+	}
+
+	keys := make([]string, 0, len(rep.Datastores))
+	for _, ds := range rep.Datastores {
+		keys = append(keys, "veba/apd/"+rep.Host+"/"+ds.Datastore)
+	}
+
+	return keys
+}
+
+// severity returns the PagerDuty severity of the kind of storage event.
+func severity(kind string) string {
+	if kind == kindAPD {
+		return "error"
+	}
+
+	return "critical"
+}
+
+// page posts rep to the configured webhook and Slack sinks and pages the
+// on-call in PagerDuty for lost devices, resolving the incidents once the
+// device is reachable again.
+func page(ctx context.Context, cfg *vcConfig, rep *report) error {
+	var errs []error
+	n := cfg.Notify
+
+	if n.WebhookURL != "" || n.SlackWebhookURL != "" {
+		err := notify(ctx, cfg, deviceMessage(rep))
+		if err == nil {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+		errs = append(errs, err)
+	}
+
+	if n.PagerDutyRoutingKey != "" {
+		msg := deviceMessage(rep)
+		action := "trigger"
+		if rep.Kind == kindCleared {
+			action = "resolve"
+		}
+
+		var failed bool
+		for _, key := range incidentKeys(rep) {
+			ev := pagerDutyEvent{RoutingKey: n.PagerDutyRoutingKey, EventAction: action, DedupKey: key}
+			if action == "trigger" {
+				ev.Payload = &pagerDutyPayload{
+					Summary:       msg.Text,
+					Source:        msg.Fields["host"],
+					Severity:      severity(rep.Kind),
+					CustomDetails: msg.Fields,
+				}
+			}
+
+			if err := post(ctx, pagerDutyURL, ev); err != nil {
+				failed = true
+				errs = append(errs, fmt.Errorf("paging %v failed: %w", key, err))
+			}
+		}
+		if !failed {
+			rep.Actions = append(rep.Actions, "paged: "+action)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// reaction returns the HA component protection of vm for the lost device of
+// kind, kindPDL or an APD kind: the setting of the VM, or the default of the
+// cluster if the VM has none. Without either, the reaction is disabled.
+func reaction(cc *types.ClusterConfigInfoEx, vm types.ManagedObjectReference, kind string) string {
+	of := func(s *types.ClusterDasVmSettings) string {
+		if s == nil || s.VmComponentProtectionSettings == nil {
+			return ""
+		}
+		if kind == kindPDL {
+			return s.VmComponentProtectionSettings.VmStorageProtectionForPDL
+		}
+		return s.VmComponentProtectionSettings.VmStorageProtectionForAPD
+	}
+
+	r := of(cc.DasConfig.DefaultVmSettings)
+	for _, c := range cc.DasVmConfig {
+		if c.Key != vm {
+			continue
+		}
+		if v := of(c.DasSettings); v != "" && v != string(types.ClusterVmComponentProtectionSettingsStorageVmReactionClusterDefault) {
+			r = v
+		}
+	}
+
+	if r == "" || r == string(types.ClusterVmComponentProtectionSettingsStorageVmReactionClusterDefault) {
+		return string(types.ClusterVmComponentProtectionSettingsStorageVmReactionDisabled)
+	}
+
+	return r
+}
+
+// restarts reports whether the reaction restarts the VM.
+func restarts(reaction string) bool {
+	switch types.ClusterVmComponentProtectionSettingsStorageVmReaction(reaction) {
+	case types.ClusterVmComponentProtectionSettingsStorageVmReactionRestartConservative,
+		types.ClusterVmComponentProtectionSettingsStorageVmReactionRestartAggressive:
+		return true
+	}
+
+	return false
+}
+
+// haProtects reports whether HA of the cluster protects VMs from lost
+// devices itself, so the function must not restart them.
+func haProtects(cc *types.ClusterConfigInfoEx) bool {
+	das := cc.DasConfig
+	return das.Enabled != nil && *das.Enabled && das.VmComponentProtecting == string(types.ClusterDasConfigInfoServiceStateEnabled)
+}
+
+// restart restarts the powered-on vms whose reaction to the lost device of
+// rep is a restart on another host of the cluster of host, which can access
+// all stores. The hosts are taken in turn, so the VMs are spread. Without such
+// a host, the VMs keep running, as HA would only restart them aggressively on
+// a host it cannot check. Restarts are added to the results of rep.
+func restart(ctx context.Context, clt *vsClient, rep *report, hs *hostStorage, host types.ManagedObjectReference, stores []mo.Datastore, vms []mo.VirtualMachine) error {
+	if hs.Cluster == nil {
+		rep.Actions = append(rep.Actions, "restart skipped, standalone host")
+		return nil
+	}
+
+	cc, err := clt.clusterConfig(ctx, *hs.Cluster)
+	if err != nil {
+		return err
+	}
+	if haProtects(cc) {
+		rep.Actions = append(rep.Actions, "restart skipped, HA component protection restarts the VMs")
+		return nil
+	}
+
+	var targets []mo.HostSystem
+	targetsRead := false
+
+	var errs []error
+	next := 0
+	for i, vm := range vms {
+		res := &rep.VMs[i]
+		res.Reaction = reaction(cc, vm.Self, rep.Kind)
+		if !restarts(res.Reaction) || vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			continue
+		}
+
+		// Hosts are only read if a VM is restarted.
+		if !targetsRead {
+			targets, err = healthyHosts(ctx, clt, *hs.Cluster, host, stores)
+			if err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			targetsRead = true
+		}
+		if len(targets) == 0 {
+			res.Actions = append(res.Actions, "restart skipped, no host can access the datastores")
+			continue
+		}
+
+		target := targets[next%len(targets)]
+		next++
+		if err := clt.restartVM(ctx, vm.Self, target.Self); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res.Actions = append(res.Actions, "restarted on "+target.Name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// healthyHosts returns the connected hosts of cluster, but not host and not
+// in maintenance, which mount all stores accessibly, sorted.
+func healthyHosts(ctx context.Context, clt *vsClient, cluster, host types.ManagedObjectReference, stores []mo.Datastore) ([]mo.HostSystem, error) {
+	mounts := map[types.ManagedObjectReference]int{}
+	for _, s := range stores {
+		for _, m := range s.Host {
+			info := m.MountInfo
+			if m.Key == host || (info.Mounted != nil && !*info.Mounted) || info.Accessible == nil || !*info.Accessible {
+				continue
+			}
+			mounts[m.Key]++
+		}
+	}
+
+	var candidates []types.ManagedObjectReference
+	for h, n := range mounts {
+		if n == len(stores) {
+			candidates = append(candidates, h)
+		}
+	}
+
+	states, err := clt.hostStates(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []mo.HostSystem
+	for _, h := range states {
+		if h.Parent == nil || *h.Parent != cluster || h.Runtime.InMaintenanceMode ||
+			h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected {
+			continue
+		}
+		out = append(out, h)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Self.Value < out[j].Self.Value })
+
+	return out, nil
+}
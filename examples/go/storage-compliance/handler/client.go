@@ -0,0 +1,280 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	"github.com/vmware/govmomi/pbm/methods"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// homeLabel labels the VM home, which holds the configuration files of a
+// VM, among its disks.
+const homeLabel = "VM home"
+
+// maxEntities limits the objects of a single compliance check, larger checks
+// are split.
+const maxEntities = 100
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+	pbm     *pbm.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	// The storage policy API shares the session of the govmomi api.
+	pc, err := pbm.NewClient(ctx, gc.Client)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to storage policy api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc, pbm: pc}, nil
+}
+
+// vmObjects holds the name of a VM and the labels of its storage objects,
+// the VM home and its disks, by their storage policy key, e.g. "vm-42" and
+// "vm-42:2000".
+type vmObjects struct {
+	Ref    types.ManagedObjectReference
+	Name   string
+	Labels map[string]string
+}
+
+// vmObjects retrieves the names and disks of refs with one call.
+func (clt *vsClient) vmObjects(ctx context.Context, refs []types.ManagedObjectReference) ([]vmObjects, error) {
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := pc.Retrieve(ctx, refs, []string{"name", "config.hardware.device"}, &vms)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve disks of %d VMs failed: %w", len(refs), err)
+	}
+
+	objects := make([]vmObjects, 0, len(vms))
+	for _, vm := range vms {
+		o := vmObjects{
+			Ref:    vm.Reference(),
+			Name:   vm.Name,
+			Labels: map[string]string{vm.Reference().Value: homeLabel},
+		}
+
+		if vm.Config != nil {
+			for _, d := range object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil)) {
+				dev := d.GetVirtualDevice()
+				label := "disk " + strconv.Itoa(int(dev.Key))
+				if dev.DeviceInfo != nil {
+					label = dev.DeviceInfo.GetDescription().Label
+				}
+				o.Labels[fmt.Sprintf("%v:%d", vm.Reference().Value, dev.Key)] = label
+			}
+		}
+
+		objects = append(objects, o)
+	}
+
+	return objects, nil
+}
+
+// policyVMs returns the VMs whose home or disks have one of the storage
+// policies names, or any storage policy without names, sorted.
+func (clt *vsClient) policyVMs(ctx context.Context, names []string) ([]types.ManagedObjectReference, error) {
+	var ids []pbmtypes.PbmProfileId
+	if len(names) == 0 {
+		var err error
+		ids, err = clt.pbm.QueryProfile(ctx, pbmtypes.PbmProfileResourceType{
+			ResourceType: string(pbmtypes.PbmProfileResourceTypeEnumSTORAGE),
+		}, string(pbmtypes.PbmProfileCategoryEnumREQUIREMENT))
+		if err != nil {
+			return nil, fmt.Errorf("query storage policies failed: %w", err)
+		}
+	}
+
+	for _, name := range names {
+		id, err := clt.pbm.ProfileIDByName(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("find storage policy %v failed: %w", name, err)
+		}
+		ids = append(ids, pbmtypes.PbmProfileId{UniqueId: id})
+	}
+
+	seen := map[string]bool{}
+	var vms []types.ManagedObjectReference
+	for _, id := range ids {
+		// Without entity type, the VM homes and the disks are returned.
+		entities, err := clt.pbm.QueryAssociatedEntity(ctx, id, "")
+		if err != nil {
+			return nil, fmt.Errorf("query objects of storage policy %v failed: %w", id.UniqueId, err)
+		}
+
+		for _, e := range entities {
+			switch e.ObjectType {
+			case string(pbmtypes.PbmObjectTypeVirtualMachine), string(pbmtypes.PbmObjectTypeVirtualDiskId):
+			default:
+				continue
+			}
+
+			// Disks are keyed by their VM and device key.
+			vm, _, _ := strings.Cut(e.Key, ":")
+			if !seen[vm] {
+				seen[vm] = true
+				vms = append(vms, types.ManagedObjectReference{Type: "VirtualMachine", Value: vm})
+			}
+		}
+	}
+
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Value < vms[j].Value })
+
+	return vms, nil
+}
+
+// checkCompliance checks the compliance of the storage objects of vms with
+// their storage policies, maxEntities objects per call.
+func (clt *vsClient) checkCompliance(ctx context.Context, vms []vmObjects) ([]pbmtypes.PbmComplianceResult, error) {
+	var entities []pbmtypes.PbmServerObjectRef
+	for _, vm := range vms {
+		for key, label := range vm.Labels {
+			objectType := pbmtypes.PbmObjectTypeVirtualDiskId
+			if label == homeLabel {
+				objectType = pbmtypes.PbmObjectTypeVirtualMachine
+			}
+			entities = append(entities, pbmtypes.PbmServerObjectRef{ObjectType: string(objectType), Key: key})
+		}
+	}
+
+	var results []pbmtypes.PbmComplianceResult
+	for start := 0; start < len(entities); start += maxEntities {
+		end := start + maxEntities
+		if end > len(entities) {
+			end = len(entities)
+		}
+
+		res, err := methods.PbmCheckCompliance(ctx, clt.pbm, &pbmtypes.PbmCheckCompliance{
+			This:     clt.pbm.ServiceContent.ComplianceManager,
+			Entities: entities[start:end],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("check compliance of %d objects failed: %w", end-start, err)
+		}
+		results = append(results, res.Returnval...)
+	}
+
+	return results, nil
+}
+
+// profileNames returns the names of the storage policies ids by their id.
+func (clt *vsClient) profileNames(ctx context.Context, ids []pbmtypes.PbmProfileId) (map[string]string, error) {
+	profiles, err := clt.pbm.RetrieveContent(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve storage policies failed: %w", err)
+	}
+
+	names := map[string]string{}
+	for _, p := range profiles {
+		profile := p.GetPbmProfile()
+		names[profile.ProfileId.UniqueId] = profile.Name
+	}
+
+	return names, nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
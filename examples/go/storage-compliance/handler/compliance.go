@@ -0,0 +1,307 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// statusRank orders the compliance states of storage objects, the state of a
+// VM is the highest of its home and disks.
+var statusRank = map[string]int{
+	string(pbmtypes.PbmComplianceStatusNotApplicable): 1,
+	string(pbmtypes.PbmComplianceStatusCompliant):     2,
+	string(pbmtypes.PbmComplianceStatusOutOfDate):     3,
+	string(pbmtypes.PbmComplianceStatusUnknown):       4,
+	string(pbmtypes.PbmComplianceStatusNonCompliant):  5,
+}
+
+// vmResult describes the compliance of a VM and the actions taken.
+type vmResult struct {
+	VM       string    `json:"vm"`
+	Name     string    `json:"name,omitempty"`
+	Status   string    `json:"status"`
+	Failures []failure `json:"failures,omitempty"`
+	// Errors are the reasons vCenter could not check objects.
+	Errors  []string `json:"errors,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+}
+
+// failure is a rule of a storage policy which a storage object violates.
+type failure struct {
+	Object string `json:"object"`
+	Policy string `json:"policy,omitempty"`
+	// Rule is the capability of the rule, e.g.
+	// VSAN.hostFailuresToTolerate.
+	Rule     string `json:"rule"`
+	Expected string `json:"expected"`
+	// Current is "unset" if the object lacks the capability.
+	Current string `json:"current"`
+}
+
+// recheck checks the compliance of vm, or of the VMs of the configured
+// storage policies if vm is nil, tags the VMs which do not comply and
+// untags those which comply again. Completed checks and actions are added to
+// rep, the joined errors of failed actions are returned.
+func recheck(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm *types.ManagedObjectReference) error {
+	var refs []types.ManagedObjectReference
+	if vm != nil {
+		refs = []types.ManagedObjectReference{*vm}
+	} else {
+		rep.Policies = cfg.Compliance.Policies
+
+		var err error
+		refs, err = clt.policyVMs(ctx, cfg.Compliance.Policies)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit := cfg.maxVMs(); len(refs) > limit {
+		rep.Skipped = len(refs) - limit
+		refs = refs[:limit]
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	vms, err := clt.vmObjects(ctx, refs)
+	if err != nil {
+		return err
+	}
+
+	results, err := clt.checkCompliance(ctx, vms)
+	if err != nil {
+		return err
+	}
+
+	var ids []pbmtypes.PbmProfileId
+	seen := map[string]bool{}
+	for _, r := range results {
+		if r.Profile != nil && !seen[r.Profile.UniqueId] {
+			seen[r.Profile.UniqueId] = true
+			ids = append(ids, *r.Profile)
+		}
+	}
+
+	names := map[string]string{}
+	if len(ids) > 0 {
+		names, err = clt.profileNames(ctx, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	rep.VMs = summarize(vms, results, names)
+	rep.Checked = len(rep.VMs)
+
+	var errs []error
+	for i := range rep.VMs {
+		res := &rep.VMs[i]
+		ref := vms[i].Ref
+
+		switch res.Status {
+		case string(pbmtypes.PbmComplianceStatusNonCompliant):
+			rep.NonCompliant++
+			err = mark(ctx, clt, cfg, res, ref)
+		case string(pbmtypes.PbmComplianceStatusCompliant), string(pbmtypes.PbmComplianceStatusNotApplicable):
+			err = release(ctx, clt, cfg, res, ref)
+		default:
+			// An unknown or outdated state is no reason to change
+			// the tag, the next check decides.
+			err = nil
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// summarize returns the compliance of vms, in their order, from the results
+// of their storage objects. names are the storage policy names by id.
+func summarize(vms []vmObjects, results []pbmtypes.PbmComplianceResult, names map[string]string) []vmResult {
+	byKey := map[string]pbmtypes.PbmComplianceResult{}
+	for _, r := range results {
+		byKey[r.Entity.Key] = r
+	}
+
+	out := make([]vmResult, 0, len(vms))
+	for _, vm := range vms {
+		res := vmResult{VM: vm.Ref.Value, Name: vm.Name}
+
+		for _, key := range objectKeys(vm.Labels) {
+			r, ok := byKey[key]
+			if !ok {
+				continue
+			}
+
+			if statusRank[r.ComplianceStatus] > statusRank[res.Status] {
+				res.Status = r.ComplianceStatus
+			}
+
+			policy := ""
+			if r.Profile != nil {
+				policy = names[r.Profile.UniqueId]
+			}
+			res.Failures = append(res.Failures, failures(vm.Labels[key], policy, r)...)
+
+			for _, e := range r.ErrorCause {
+				res.Errors = append(res.Errors, fmt.Sprintf("%v: %v", vm.Labels[key], e.LocalizedMessage))
+			}
+		}
+
+		if res.Status == "" {
+			res.Status = string(pbmtypes.PbmComplianceStatusUnknown)
+		}
+
+		out = append(out, res)
+	}
+
+	return out
+}
+
+// objectKeys returns the keys of labels, the VM home first and then the disks
+// by label.
+func objectKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := labels[keys[i]], labels[keys[j]]
+		if a == homeLabel || b == homeLabel {
+			return a == homeLabel
+		}
+		return a < b
+	})
+
+	return keys
+}
+
+// failures returns the rules of policy which the storage object label
+// violates according to r. The expected and current values of a rule are
+// paired by their property.
+func failures(label, policy string, r pbmtypes.PbmComplianceResult) []failure {
+	var out []failure
+	for _, v := range r.ViolatedPolicies {
+		rule := v.ExpectedValue.Id.Namespace + "." + v.ExpectedValue.Id.Id
+
+		current := map[string]string{}
+		if v.CurrentValue != nil {
+			for _, c := range v.CurrentValue.Constraint {
+				for _, p := range c.PropertyInstance {
+					current[p.Id] = propertyValue(p)
+				}
+			}
+		}
+
+		for _, c := range v.ExpectedValue.Constraint {
+			for _, p := range c.PropertyInstance {
+				f := failure{
+					Object:   label,
+					Policy:   policy,
+					Rule:     rule,
+					Expected: propertyValue(p),
+					Current:  "unset",
+				}
+				// Capabilities with several properties name the
+				// violated one.
+				if p.Id != v.ExpectedValue.Id.Id {
+					f.Rule += "." + p.Id
+				}
+				if c, ok := current[p.Id]; ok {
+					f.Current = c
+				}
+				out = append(out, f)
+			}
+		}
+	}
+
+	return out
+}
+
+// propertyValue returns the value of a rule property as text, e.g. "1",
+// "1-3" for ranges or "a,b" for sets. Negated values start with "NOT ".
+func propertyValue(p pbmtypes.PbmCapabilityPropertyInstance) string {
+	s := anyValue(p.Value)
+	if p.Operator != "" {
+		s = p.Operator + " " + s
+	}
+
+	return s
+}
+
+// anyValue returns a capability value as text.
+func anyValue(v types.AnyType) string {
+	switch v := v.(type) {
+	case pbmtypes.PbmCapabilityRange:
+		return anyValue(v.Min) + "-" + anyValue(v.Max)
+	case *pbmtypes.PbmCapabilityRange:
+		return anyValue(v.Min) + "-" + anyValue(v.Max)
+	case pbmtypes.PbmCapabilityDiscreteSet:
+		return setValue(v.Values)
+	case *pbmtypes.PbmCapabilityDiscreteSet:
+		return setValue(v.Values)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// setValue returns the values of a set as comma separated text.
+func setValue(values []types.AnyType) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = anyValue(v)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// mark attaches the tag of non-compliant VMs to vm, if not attached.
+func mark(ctx context.Context, clt *vsClient, cfg *vcConfig, res *vmResult, vm types.ManagedObjectReference) error {
+	urn := cfg.Compliance.NonCompliantTagURN
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil {
+		return err
+	}
+	if tagged {
+		res.Actions = append(res.Actions, "already tagged")
+		return nil
+	}
+
+	if err := clt.tag(ctx, vm, urn); err != nil {
+		return err
+	}
+	res.Actions = append(res.Actions, "tagged")
+
+	return nil
+}
+
+// release detaches the tag of non-compliant VMs from vm, if attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, res *vmResult, vm types.ManagedObjectReference) error {
+	urn := cfg.Compliance.NonCompliantTagURN
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, urn); err != nil {
+		return err
+	}
+	res.Actions = append(res.Actions, "untagged")
+
+	return nil
+}
@@ -0,0 +1,382 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents trigger a compliance check if no events are configured: the
+// status changes of alarms, e.g. the storage compliance alarm of a VM, and
+// changes of storage policies.
+var defaultEvents = []string{"AlarmStatusChangedEvent", "com.vmware.pbm.profile.update"}
+
+// defaultMaxVMs limits the VMs checked for a policy change if max_vms is not
+// configured.
+const defaultMaxVMs = 500
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Compliance struct {
+		// Events trigger a compliance check, by default defaultEvents.
+		Events []string
+		// Alarms are the names of the alarms whose status changes check
+		// their VM, all alarms of VMs without it.
+		Alarms []string
+		// Policies are the names of the storage policies whose VMs are
+		// checked for events without VM, e.g. a changed policy. All VMs
+		// with a storage policy are checked without it.
+		Policies []string
+		// MaxVMs limits the VMs checked for an event, by default
+		// defaultMaxVMs.
+		MaxVMs int `toml:"max_vms"`
+		// NonCompliantTagURN is attached to VMs which do not comply and
+		// detached once they comply again.
+		NonCompliantTagURN string `toml:"non_compliant_tag_urn"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Vm     *types.VmEventArgument            `json:"Vm,omitempty"`
+		Alarm  *types.AlarmEventArgument         `json:"Alarm,omitempty"`
+		Entity *types.ManagedEntityEventArgument `json:"Entity,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// vm returns the VM of the event or nil if the event is about storage
+// policies, not a VM. The VM of an alarm is its entity.
+func (e *incoming) vm() *types.ManagedObjectReference {
+	if e.Data.Alarm != nil {
+		if e.Data.Entity != nil && e.Data.Entity.Entity.Type == "VirtualMachine" {
+			return &e.Data.Entity.Entity
+		}
+		return nil
+	}
+
+	if e.Data.Vm != nil && e.Data.Vm.Vm.Value != "" {
+		return &e.Data.Vm.Vm
+	}
+
+	return nil
+}
+
+// report describes the compliance of the checked VMs and the actions taken.
+type report struct {
+	Event string `json:"event,omitempty"`
+	Alarm string `json:"alarm,omitempty"`
+	// Policies are the storage policies whose VMs were checked, for
+	// events without VM.
+	Policies     []string   `json:"policies,omitempty"`
+	Checked      int        `json:"checked"`
+	NonCompliant int        `json:"non_compliant"`
+	VMs          []vmResult `json:"vms,omitempty"`
+	// Skipped counts the VMs beyond max_vms which were not checked.
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{Event: event.Subject}
+	if event.Data.Alarm != nil {
+		rep.Alarm = event.Data.Alarm.Name
+	}
+
+	actionErr := recheck(ctx, clt, cfg, &rep, event.vm())
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("checking storage policy compliance failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether event triggers a compliance check.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Compliance.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watches reports whether the status changes of the alarm name trigger a
+// compliance check.
+func (cfg *vcConfig) watches(name string) bool {
+	if len(cfg.Compliance.Alarms) == 0 {
+		return true
+	}
+
+	for _, a := range cfg.Compliance.Alarms {
+		if a == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxVMs returns the limit of VMs checked for an event.
+func (cfg *vcConfig) maxVMs() int {
+	if cfg.Compliance.MaxVMs > 0 {
+		return cfg.Compliance.MaxVMs
+	}
+
+	return defaultMaxVMs
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":                   cfg.VCenter.Server,
+		"vcenter user":                     cfg.VCenter.User,
+		"vcenter password":                 cfg.VCenter.Password,
+		"compliance non_compliant_tag_urn": cfg.Compliance.NonCompliantTagURN,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Compliance.MaxVMs < 0 {
+		return fmt.Errorf("compliance max_vms must not be negative, got %d", cfg.Compliance.MaxVMs)
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event. Alarms must be configured and about
+// a VM.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if alarm := event.Data.Alarm; alarm != nil {
+		if !cfg.watches(alarm.Name) {
+			return nil, fmt.Errorf("unsupported alarm %q", alarm.Name)
+		}
+		if event.vm() == nil {
+			return nil, fmt.Errorf("alarm %q is not about a VM", alarm.Name)
+		}
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
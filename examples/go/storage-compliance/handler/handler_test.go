@@ -0,0 +1,333 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	full := vcConfig{}
+	full.VCenter.Server = "veba.local.corp"
+	full.VCenter.User = "admin@vsphere.local"
+	full.VCenter.Password = "password1234"
+	full.Compliance.Events = []string{"AlarmStatusChangedEvent", "com.vmware.pbm.profile.update", "com.vmware.pbm.profile.associate"}
+	full.Compliance.Alarms = []string{"VM storage compliance alarm"}
+	full.Compliance.Policies = []string{"vSAN Default Storage Policy", "Gold"}
+	full.Compliance.MaxVMs = 100
+	full.Compliance.NonCompliantTagURN = "urn:vmomi:InventoryServiceTag:5e2b9c71-4a3d-48f6-b1e0-9d7c3a6f2e58:GLOBAL"
+
+	minimal := vcConfig{}
+	minimal.VCenter = full.VCenter
+	minimal.VCenter.Insecure = true
+	minimal.Compliance.NonCompliantTagURN = full.Compliance.NonCompliantTagURN
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{"Test that toml file with alarms, policies and limit loads correctly", "testdata/vcconfig.toml", false, &full},
+		{"Test that toml file with the tag only loads correctly", "testdata/vcconfig2.toml", false, &minimal},
+		{"Test that vcconfig.toml missing essential information results in error", "testdata/vcconfigErr1.toml", true, nil},
+		{"Test that vcconfig.toml without tag results in error", "testdata/vcconfigErr2.toml", true, nil},
+		{"Test that vcconfig.toml with negative max_vms results in error", "testdata/vcconfigErr3.toml", true, nil},
+		{"Test that a missing vcconfig.toml results in error", "testdata/missing.toml", true, nil},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseEvent shows configured alarms of VMs and policy events are
+// accepted.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that the VM of a compliance alarm is readable", "testdata/event.json", false, "vm-42"},
+		{"Test that a policy update checks the VMs of the policies", "testdata/event2.json", false, ""},
+		{"Test that the VM of a policy association is readable", "testdata/event3.json", false, "vm-42"},
+		{"Event should return error if the alarm is not configured", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if the alarm is not about a VM", "testdata/eventErr2.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr3.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := ""
+		if vm := event.vm(); vm != nil {
+			got = vm.Value
+		}
+		if got == tc.want {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestSummarize shows the compliance of a VM is the worst of its objects and
+// the violated rules are reported with their expected and current values.
+func TestSummarize(t *testing.T) {
+	vm := vmObjects{
+		Ref:    types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"},
+		Name:   "web-01",
+		Labels: map[string]string{"vm-42": homeLabel, "vm-42:2000": "Hard disk 1", "vm-42:2001": "Hard disk 2"},
+	}
+	gold := &pbmtypes.PbmProfileId{UniqueId: "4d5f673c-536f-11e6-beb8-9e71128cae77"}
+	names := map[string]string{gold.UniqueId: "Gold"}
+
+	result := func(key, status string, violated ...pbmtypes.PbmCompliancePolicyStatus) pbmtypes.PbmComplianceResult {
+		return pbmtypes.PbmComplianceResult{
+			Entity:           pbmtypes.PbmServerObjectRef{Key: key},
+			Profile:          gold,
+			ComplianceStatus: status,
+			ViolatedPolicies: violated,
+		}
+	}
+	capability := func(id string, props ...pbmtypes.PbmCapabilityPropertyInstance) pbmtypes.PbmCapabilityInstance {
+		return pbmtypes.PbmCapabilityInstance{
+			Id:         pbmtypes.PbmCapabilityMetadataUniqueId{Namespace: "VSAN", Id: id},
+			Constraint: []pbmtypes.PbmCapabilityConstraintInstance{{PropertyInstance: props}},
+		}
+	}
+	ftt := func(v int32) pbmtypes.PbmCapabilityPropertyInstance {
+		return pbmtypes.PbmCapabilityPropertyInstance{Id: "hostFailuresToTolerate", Value: v}
+	}
+	ftt2 := capability("hostFailuresToTolerate", ftt(2))
+	ftt1 := capability("hostFailuresToTolerate", ftt(1))
+	stripes := capability("stripeWidth", pbmtypes.PbmCapabilityPropertyInstance{
+		Id:    "stripeWidth",
+		Value: pbmtypes.PbmCapabilityRange{Min: int32(2), Max: int32(4)},
+	})
+
+	var tests = []struct {
+		testDesc     string
+		results      []pbmtypes.PbmComplianceResult
+		wantStatus   string
+		wantFailures []failure
+	}{
+		{
+			"Test that a VM whose objects comply is compliant",
+			[]pbmtypes.PbmComplianceResult{result("vm-42", "compliant"), result("vm-42:2000", "compliant"), result("vm-42:2001", "notApplicable")},
+			"compliant",
+			nil,
+		},
+		{
+			"Test that a violated rule of a disk is reported with both values",
+			[]pbmtypes.PbmComplianceResult{result("vm-42", "compliant"), result("vm-42:2001", "nonCompliant", pbmtypes.PbmCompliancePolicyStatus{ExpectedValue: ftt2, CurrentValue: &ftt1})},
+			"nonCompliant",
+			[]failure{{Object: "Hard disk 2", Policy: "Gold", Rule: "VSAN.hostFailuresToTolerate", Expected: "2", Current: "1"}},
+		},
+		{
+			"Test that missing capabilities are unset, the VM home first",
+			[]pbmtypes.PbmComplianceResult{
+				result("vm-42:2000", "nonCompliant", pbmtypes.PbmCompliancePolicyStatus{ExpectedValue: stripes}),
+				result("vm-42", "unknown", pbmtypes.PbmCompliancePolicyStatus{ExpectedValue: ftt2, CurrentValue: &ftt1}),
+			},
+			"nonCompliant",
+			[]failure{
+				{Object: homeLabel, Policy: "Gold", Rule: "VSAN.hostFailuresToTolerate", Expected: "2", Current: "1"},
+				{Object: "Hard disk 1", Policy: "Gold", Rule: "VSAN.stripeWidth", Expected: "2-4", Current: "unset"},
+			},
+		},
+		{
+			"Test that a VM without results is unknown",
+			nil,
+			"unknown",
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := summarize([]vmObjects{vm}, tc.results, names)
+
+		if len(got) == 1 && got[0].Status == tc.wantStatus && reflect.DeepEqual(got[0].Failures, tc.wantFailures) {
+			t.Logf("got expected: %+v. %v", got[0], passMark)
+		} else {
+			t.Logf("expected status %v, failures %+v, got: %+v. %v", tc.wantStatus, tc.wantFailures, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestMark shows non-compliant VMs are tagged once and VMs which comply again
+// are untagged.
+func TestMark(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "storage", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "non-compliant", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		t.Log("=========== Test that the VM home and disks of a VM are labeled ===========")
+		objects, err := clt.vmObjects(ctx, []types.ManagedObjectReference{vm.Reference()})
+		if err != nil || len(objects) != 1 || len(objects[0].Labels) < 2 || objects[0].Labels[vm.Reference().Value] != homeLabel {
+			t.Fatalf("expected the VM home and disks, got: %+v (%v). %v", objects, err, failMark)
+		}
+		t.Logf("got expected: %v. %v", objects[0].Labels, passMark)
+
+		var cfg vcConfig
+		cfg.Compliance.NonCompliantTagURN = tagID
+
+		var tests = []struct {
+			testDesc    string
+			compliant   bool
+			wantActions string
+		}{
+			{"Test that a non-compliant VM is tagged", false, "tagged"},
+			{"Test that a tagged VM is tagged once", false, "already tagged"},
+			{"Test that a VM which complies again is untagged", true, "untagged"},
+			{"Test that a compliant VM without tag is left alone", true, ""},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+
+			// The compliance of VMs is not simulated, so it is given.
+			res := vmResult{VM: vm.Reference().Value}
+			if tc.compliant {
+				err = release(ctx, clt, &cfg, &res, vm.Reference())
+			} else {
+				err = mark(ctx, clt, &cfg, &res, vm.Reference())
+			}
+			if err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			if got := strings.Join(res.Actions, ","); got == tc.wantActions {
+				t.Logf("got expected: %q. %v", got, passMark)
+			} else {
+				t.Logf("expected actions %q, got: %q. %v", tc.wantActions, got, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/dump"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Comparisons of advisories.
+const (
+	opAbove    = ">"
+	opAtLeast  = ">="
+	opBelow    = "<"
+	opAtMost   = "<="
+	opEqual    = "=="
+	opNotEqual = "!="
+)
+
+// advisory attaches an advisory tag to VMs whose property matches a
+// comparison and detaches it from VMs whose property does not, e.g. tags VMs
+// with more than 8 cores per socket for review.
+type advisory struct {
+	// Property is the path of a scalar VM property, e.g.
+	// config.hardware.numCoresPerSocket or summary.storage.committed.
+	Property string `json:"property"`
+	// Op compares the property to Value: >, >=, <, <=, == or !=. Ordering
+	// comparisons are numeric, equality is numeric if both are numbers.
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	// TagURN is the advisory tag.
+	TagURN string `toml:"tag_urn" json:"tag_urn"`
+}
+
+// matches reports whether the property value v matches the comparison.
+func (a advisory) matches(v string) (bool, error) {
+	want, wantErr := strconv.ParseFloat(a.Value, 64)
+	got, gotErr := strconv.ParseFloat(v, 64)
+	numeric := wantErr == nil && gotErr == nil
+
+	switch a.Op {
+	case opEqual:
+		if numeric {
+			return got == want, nil
+		}
+		return v == a.Value, nil
+	case opNotEqual:
+		if numeric {
+			return got != want, nil
+		}
+		return v != a.Value, nil
+	}
+
+	if !numeric {
+		return false, fmt.Errorf("property %v is %q, which is no number", a.Property, v)
+	}
+
+	switch a.Op {
+	case opAbove:
+		return got > want, nil
+	case opAtLeast:
+		return got >= want, nil
+	case opBelow:
+		return got < want, nil
+	case opAtMost:
+		return got <= want, nil
+	}
+
+	// Advisories are validated when loading the config.
+	return false, fmt.Errorf("unsupported op %q", a.Op)
+}
+
+// advise attaches or detaches the advisory tags of a on the VM ref depending on
+// its properties, which are retrieved with one call. The returned text
+// describes the outcome of each advisory.
+func advise(ctx context.Context, cfg *vcConfig, a action, client *vsClient, ref types.ManagedObjectReference) (string, error) {
+	paths := make([]string, 0, len(a.Advisories))
+	for _, adv := range a.Advisories {
+		paths = append(paths, adv.Property)
+	}
+
+	var values map[string]string
+	err := limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+		values, err = client.vmProperties(ctx, ref, paths)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	outcomes := make([]string, 0, len(a.Advisories))
+	for _, adv := range a.Advisories {
+		// Unset properties, e.g. of VMs without storage summary, match
+		// no comparison.
+		v, ok := values[adv.Property]
+		matched := false
+		if ok {
+			matched, err = adv.matches(v)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if matched {
+			err = limit(ctx, cfg, opTag, func(ctx context.Context) error {
+				return client.moTag(ctx, ref, adv.TagURN)
+			})
+		} else {
+			err = limit(ctx, cfg, opTag, func(ctx context.Context) error {
+				return client.moUntag(ctx, ref, adv.TagURN)
+			})
+		}
+		if err != nil {
+			return "", fmt.Errorf("advisory %v %v %v: %w", adv.Property, adv.Op, adv.Value, err)
+		}
+
+		outcome := i18n.AdvisoryUntagged
+		if matched {
+			outcome = i18n.AdvisoryTagged
+		}
+		outcomes = append(outcomes, cfg.message(outcome, adv.Property, adv.Op, adv.Value))
+	}
+
+	return cfg.message(i18n.Advised, ref.Value, strings.Join(outcomes, ", ")), nil
+}
+
+// vmProperties returns the scalar properties at paths of a VM as strings by
+// path. Unset properties are missing.
+func (clt *vsClient) vmProperties(ctx context.Context, ref types.ManagedObjectReference, paths []string) (map[string]string, error) {
+	// The vAPI has no equivalent of arbitrary property paths.
+	if clt.govmomi == nil {
+		return nil, errSOAPRequired
+	}
+
+	var content []types.ObjectContent
+	start := time.Now()
+	err := property.DefaultCollector(clt.govmomi.Client).Retrieve(ctx, []types.ManagedObjectReference{ref}, paths, &content)
+	traceFrom(ctx).call("RetrieveProperties(advisories)", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve properties of %v failed: %w", ref.Value, err)
+	}
+	dump.FromContext(ctx).Objects(content)
+
+	values := map[string]string{}
+	for _, oc := range content {
+		for _, p := range oc.PropSet {
+			s, ok := scalarValue(p.Val)
+			if !ok {
+				return nil, fmt.Errorf("property %v of %v is no scalar, got %T", p.Name, ref.Value, p.Val)
+			}
+			values[p.Name] = s
+		}
+	}
+
+	return values, nil
+}
+
+// scalarValue returns v as string, if it is a number, string or bool. Enums,
+// e.g. the power state, are strings.
+func scalarValue(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 64), true
+	case reflect.String:
+		return rv.String(), true
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool()), true
+	default:
+		return "", false
+	}
+}
+
+// validateAdvisories ensures the advisories of an advise action of rule name
+// compare valid property paths with a supported op and have a tag.
+func validateAdvisories(name string, advisories []advisory) error {
+	if len(advisories) == 0 {
+		return fmt.Errorf("rule %v advises without advisories", name)
+	}
+
+	for _, adv := range advisories {
+		if adv.Property == "" {
+			return fmt.Errorf("rule %v has an advisory without property", name)
+		}
+		for _, key := range strings.Split(adv.Property, ".") {
+			if key == "" {
+				return fmt.Errorf("rule %v has invalid advisory property %q", name, adv.Property)
+			}
+		}
+
+		if adv.TagURN == "" {
+			return fmt.Errorf("rule %v has an advisory of %v without tag_urn", name, adv.Property)
+		}
+
+		switch adv.Op {
+		case opEqual, opNotEqual:
+		case opAbove, opAtLeast, opBelow, opAtMost:
+			if _, err := strconv.ParseFloat(adv.Value, 64); err != nil {
+				return fmt.Errorf("rule %v compares %v %v %q, which is no number", name, adv.Property, adv.Op, adv.Value)
+			}
+		default:
+			return fmt.Errorf("rule %v has advisory of %v with unsupported op %q", name, adv.Property, adv.Op)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package function
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+)
+
+// statusStaleEvent is returned for events older than [event] max_age_seconds,
+// e.g. events redelivered by the event router after an outage. It is a
+// success status, so the event is not redelivered again, but distinct from
+// the 200 of processed events.
+const statusStaleEvent = http.StatusAccepted
+
+// eventAge returns the age of the event ce at now. ok is false if the event
+// carries no time.
+func eventAge(ce *vevents.CloudEvent, now time.Time) (age time.Duration, ok bool) {
+	if ce == nil {
+		return 0, false
+	}
+
+	created := ce.Created()
+	if created.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(created), true
+}
+
+// stale reports whether an event of age is too old to act on.
+func (cfg *vcConfig) stale(age time.Duration) bool {
+	max := cfg.Event.MaxAgeSeconds
+	return max > 0 && age > time.Duration(max)*time.Second
+}
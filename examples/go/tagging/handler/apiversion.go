@@ -0,0 +1,94 @@
+package function
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25"
+)
+
+// defaultSDKPath is the path of the SOAP SDK on vCenter.
+const defaultSDKPath = "/sdk"
+
+// apiVersionPattern matches vSphere API versions, e.g. 6.7 or 7.0.3.0.
+var apiVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// sdkPath returns the path of the SOAP SDK, e.g. behind a reverse proxy.
+func (cfg *vcConfig) sdkPath() string {
+	if cfg.VCenter.SDKPath == "" {
+		return defaultSDKPath
+	}
+
+	return cfg.VCenter.SDKPath
+}
+
+// validateSOAPEndpoint ensures the SDK path and the pinned API version are
+// usable. Both only apply to the SOAP API.
+func validateSOAPEndpoint(cfg vcConfig) error {
+	v := cfg.VCenter
+	if v.SDKPath == "" && v.APIVersion == "" {
+		return nil
+	}
+
+	if cfg.restOnly() {
+		return errors.New(`vcenter sdk_path and api_version require vcenter api "soap"`)
+	}
+
+	if v.SDKPath != "" && !strings.HasPrefix(v.SDKPath, "/") {
+		return fmt.Errorf("vcenter sdk_path %q must start with /", v.SDKPath)
+	}
+
+	if v.APIVersion != "" && !apiVersionPattern.MatchString(v.APIVersion) {
+		return fmt.Errorf("vcenter api_version %q is no API version, e.g. 6.7", v.APIVersion)
+	}
+
+	return nil
+}
+
+// negotiate returns the API version to use with a vCenter serving the API
+// version server, as reported by RetrieveServiceContent. A pinned version is
+// used as is, unless vCenter does not serve it. Otherwise, the older of the
+// versions of vCenter and of the client is used, so an older vCenter is not
+// sent requests it does not know.
+func negotiate(server, pinned string) (string, error) {
+	if pinned != "" {
+		if server != "" && compareVersions(pinned, server) > 0 {
+			return "", fmt.Errorf("vcenter api_version %v is newer than the API version %v of vCenter", pinned, server)
+		}
+
+		return pinned, nil
+	}
+
+	if server != "" && compareVersions(server, vim25.Version) < 0 {
+		return server, nil
+	}
+
+	return vim25.Version, nil
+}
+
+// compareVersions compares the API versions a and b numerically, so 6.10 is
+// newer than 6.7. Missing parts count as 0.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,38 @@
+package function
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/tagaudit"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+)
+
+type eventIDKey struct{}
+
+// withEventID returns a context carrying the id of the CloudEvent ce, which
+// the audit records of created tags refer to.
+func withEventID(ctx context.Context, ce *vevents.CloudEvent) context.Context {
+	if ce == nil || ce.ID == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, eventIDKey{}, ce.ID)
+}
+
+// auditDescription returns the description of a tag created for value, which
+// replaces previous, if any. The description records the triggering event,
+// see package tagaudit.
+func auditDescription(ctx context.Context, value, previous string) string {
+	id, _ := ctx.Value(eventIDKey{}).(string)
+
+	desc, err := tagaudit.Record{Value: value, Previous: previous, EventID: id, Time: time.Now()}.Description()
+	if err != nil {
+		// The tag is still created, only without audit record.
+		slog.Error("encoding tag audit record failed", "value", value, "err", err)
+		return ""
+	}
+
+	return desc
+}
@@ -0,0 +1,56 @@
+package function
+
+import (
+	"errors"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+)
+
+// authenticate rejects requests failing the [auth] checks of vcconfig.toml
+// with 401 Unauthorized. Without checks configured, every request passes, e.g.
+// of the event router through the OpenFaaS gateway.
+var authenticate = middleware.Auth(func(req handler.Request) error {
+	// Admin requests are served with the config loaded last while
+	// vcconfig.toml is broken, so they are authenticated with it.
+	cfg, err := requestConfig(req)
+	if err != nil {
+		// The invocation fails with 500 on the same error, before anything
+		// is processed.
+		return nil
+	}
+
+	return cfg.authenticate(req)
+})
+
+// authenticate checks req against the configured bearer token and body
+// signature. If both are configured, both are required.
+func (cfg *vcConfig) authenticate(req handler.Request) error {
+	var errs []error
+
+	if cfg.Auth.Token != "" {
+		errs = append(errs, middleware.BearerToken(cfg.Auth.Token)(req))
+	}
+
+	if cfg.Auth.HMACKey != "" {
+		errs = append(errs, middleware.HMACSignature([]byte(cfg.Auth.HMACKey))(req))
+	}
+
+	return errors.Join(errs...)
+}
+
+// authMethods returns the kinds of the configured checks, without their
+// secrets.
+func (cfg *vcConfig) authMethods() []string {
+	methods := []string{}
+
+	if cfg.Auth.Token != "" {
+		methods = append(methods, "token")
+	}
+
+	if cfg.Auth.HMACKey != "" {
+		methods = append(methods, "hmac")
+	}
+
+	return methods
+}
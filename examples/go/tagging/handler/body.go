@@ -0,0 +1,153 @@
+package function
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+)
+
+// maxBodySize limits the size of the decoded request body to protect the
+// function from decompression bombs. vCenter events are a few KB.
+const maxBodySize = 1 << 20
+
+var (
+	errBodyTooLarge     = errors.New("request body too large")
+	errUnsupportedMedia = errors.New("unsupported media type")
+)
+
+// decodeBody returns the request body with any content encoding removed. The
+// event router or proxies in between may compress requests. Only JSON content
+// in UTF-8 is accepted; a missing Content-Type is treated as JSON.
+func decodeBody(req handler.Request) ([]byte, error) {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mediaType, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+		}
+
+		if mediaType != "application/json" && mediaType != "application/cloudevents+json" && mediaType != "text/plain" {
+			return nil, fmt.Errorf("%w: %v", errUnsupportedMedia, mediaType)
+		}
+
+		if cs := strings.ToLower(params["charset"]); cs != "" && cs != "utf-8" && cs != "us-ascii" {
+			return nil, fmt.Errorf("%w: charset %v", errUnsupportedMedia, cs)
+		}
+	}
+
+	// Bodies without content encoding are used as they are, without copy.
+	encodings := strings.Split(req.Header.Get("Content-Encoding"), ",")
+	if identity(encodings) {
+		if len(req.Body) > maxBodySize {
+			return nil, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, maxBodySize)
+		}
+		return req.Body, nil
+	}
+
+	// Decoders and their buffers are pooled, since compressed bodies of a
+	// storm of events would otherwise allocate them for every request.
+	var gzips []*gzip.Reader
+	var bufs []*bytes.Buffer
+	defer func() {
+		for _, zr := range gzips {
+			gzipReaders.Put(zr)
+		}
+		for _, buf := range bufs {
+			putBuffer(buf)
+		}
+	}()
+
+	// Encodings are listed in the order they were applied.
+	var r io.Reader = bytes.NewReader(req.Body)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			var zr *gzip.Reader
+			zr, err = getGzipReader(r)
+			if err == nil {
+				gzips = append(gzips, zr)
+				r = zr
+			}
+		case "deflate":
+			buf := getBuffer()
+			bufs = append(bufs, buf)
+			r, err = newDeflateReader(r, buf)
+		default:
+			err = fmt.Errorf("%w: content encoding %v", errUnsupportedMedia, enc)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding request body failed: %w", err)
+		}
+	}
+
+	buf := getBuffer()
+	bufs = append(bufs, buf)
+	if _, err := buf.ReadFrom(io.LimitReader(r, maxBodySize+1)); err != nil {
+		return nil, fmt.Errorf("decoding request body failed: %w", err)
+	}
+
+	if buf.Len() > maxBodySize {
+		return nil, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, maxBodySize)
+	}
+
+	// The body outlives the pooled buffer, so it gets an exact copy.
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// identity reports whether the Content-Encoding values encodings leave the
+// body as it is.
+func identity(encodings []string) bool {
+	for _, enc := range encodings {
+		if enc := strings.ToLower(strings.TrimSpace(enc)); enc != "" && enc != "identity" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newDeflateReader reads zlib wrapped deflate data as required by HTTP and
+// falls back to raw deflate data which some clients send instead. The
+// compressed data is read into buf, which must not be reused until the
+// returned reader is read. Compressed data decoded from another encoding is
+// limited to maxBodySize as well, rather than being cut off.
+func newDeflateReader(r io.Reader, buf *bytes.Buffer) (io.Reader, error) {
+	if _, err := buf.ReadFrom(io.LimitReader(r, maxBodySize+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxBodySize {
+		return nil, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, maxBodySize)
+	}
+	data := buf.Bytes()
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err == nil {
+		return zr, nil
+	}
+
+	return flate.NewReader(bytes.NewReader(data)), nil
+}
+
+// bodyErrorCode returns the error code of the response to a decodeBody error.
+func bodyErrorCode(err error) apierror.Code {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return apierror.BodyTooLarge
+	case errors.Is(err, errUnsupportedMedia):
+		return apierror.MediaUnsupported
+	default:
+		return apierror.BodyInvalid
+	}
+}
@@ -0,0 +1,381 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// sessionBrokerEnv enables the session broker mode: instead of serving events,
+// the function holds a single vCenter session and hands it out to the
+// replicas configured with [connection] broker_url, so scaling the function
+// out does not open a session per replica.
+const sessionBrokerEnv = "session_broker"
+
+// sessionBrokerListenEnv overrides the address the session broker listens
+// on.
+const sessionBrokerListenEnv = "session_broker_listen"
+
+const (
+	// defaultBrokerListen is the upstream port of the of-watchdog of the
+	// golang-http template, which serves the broker on port 8080.
+	defaultBrokerListen = ":8082"
+	brokerTicketPath    = "/ticket"
+	brokerTimeout       = 10 * time.Second
+	// restSessionCookieName is the cookie of the REST session, which the
+	// vapi client keeps internal.
+	restSessionCookieName = "vmware-api-session-id"
+)
+
+// brokerConn is the connection of the session broker. Unlike conn, it always
+// logs in with the [vcenter] credentials.
+var brokerConn = &connection{dial: dialDirect}
+
+// sessionTicket carries the session cookies of the broker. Clients presenting
+// them share the sessions of the broker instead of logging in.
+type sessionTicket struct {
+	SOAP string `json:"soap_session"`
+	// REST is empty if the REST API is disabled.
+	REST string `json:"rest_session,omitempty"`
+}
+
+// brokerClient fetches tickets from the session broker.
+var brokerClient = &http.Client{Timeout: brokerTimeout}
+
+// lastTicket is the SOAP session of the last ticket fetched by dialBrokered.
+// It is sent with the next fetch, so the broker verifies the session a
+// replica redials for instead of handing it out again.
+var lastTicket struct {
+	mu   sync.Mutex
+	soap string
+}
+
+// runSessionBroker serves tickets until SIGTERM and returns the exit code of
+// the process. The session is logged out on shutdown.
+func runSessionBroker() int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	addr := os.Getenv(sessionBrokerListenEnv)
+	if addr == "" {
+		addr = defaultBrokerListen
+	}
+
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(serveTicket), ReadHeaderTimeout: brokerTimeout}
+	go func() {
+		<-ctx.Done()
+
+		shutdown, cancel := context.WithTimeout(context.Background(), brokerTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			slog.Warn("session broker shutdown failed", "err", err)
+		}
+	}()
+
+	slog.Info("session broker listening", "addr", addr)
+	err := srv.ListenAndServe()
+	brokerConn.close("shutdown")
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("session broker failed", "err", err)
+		return 1
+	}
+
+	return 0
+}
+
+// serveTicket responds to GET /ticket with the current ticket of the broker as
+// JSON. Requests must carry [connection] broker_token as bearer token. The
+// query parameter previous is the SOAP session of a ticket a replica found no
+// longer active: if it is still handed out, the session is verified first and
+// replaced if vCenter no longer knows it.
+func serveTicket(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != brokerTicketPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		apierror.Write(w, apierror.MethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cfg, err := activeCfg(configPath())
+	if err != nil {
+		slog.Error("session broker config failed", "err", err)
+		apierror.Write(w, apierror.ConfigInvalid, "invalid vcconfig")
+		return
+	}
+
+	if err := middleware.BearerToken(cfg.Connection.BrokerToken)(handler.Request{Header: r.Header}); err != nil {
+		apierror.Write(w, apierror.Unauthorized, err.Error())
+		return
+	}
+
+	t, err := brokerTicketFor(r.Context(), cfg, r.URL.Query().Get("previous"))
+	if err != nil {
+		slog.Error("session broker ticket failed", "err", err)
+		apierror.Write(w, apierror.BrokerUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		slog.Warn("write ticket failed", "err", err)
+	}
+}
+
+// brokerTicketFor returns the ticket of the broker session, logging in on
+// first use and to the REST API unless disabled.
+func brokerTicketFor(ctx context.Context, cfg *vcConfig, previous string) (sessionTicket, error) {
+	if cfg.VCenter.User == "" || cfg.VCenter.Password == "" {
+		return sessionTicket{}, errors.New("session broker requires vcenter user and password")
+	}
+
+	clt, err := brokerConn.get(ctx, cfg)
+	if err != nil {
+		return sessionTicket{}, err
+	}
+
+	if previous != "" && previous == clt.sessionTicket().SOAP {
+		brokerConn.verify(ctx, clt)
+		if clt, err = brokerConn.get(ctx, cfg); err != nil {
+			return sessionTicket{}, err
+		}
+	}
+
+	if clt.rest != nil {
+		if _, err := clt.restClient(ctx); err != nil {
+			return sessionTicket{}, err
+		}
+	}
+
+	t := clt.sessionTicket()
+	if t.SOAP == "" {
+		return sessionTicket{}, errors.New("no vCenter session cookie")
+	}
+
+	return t, nil
+}
+
+// sessionTicket returns the session cookies of clt.
+func (clt *vsClient) sessionTicket() sessionTicket {
+	var t sessionTicket
+
+	if clt.govmomi != nil {
+		t.SOAP = cookie(clt.govmomi.Client.Client, soap.SessionCookieName)
+	}
+	if clt.restLoggedIn() {
+		t.REST = cookie(clt.rest.Client, restSessionCookieName)
+	}
+
+	return t
+}
+
+// cookie returns the value of the cookie name sent by c, if any.
+func cookie(c *soap.Client, name string) string {
+	for _, ck := range c.Jar.Cookies(c.URL()) {
+		if ck.Name == name {
+			return ck.Value
+		}
+	}
+
+	return ""
+}
+
+// setCookie sets the cookie name sent by c.
+func setCookie(c *soap.Client, name, value string) {
+	c.Jar.SetCookies(c.URL(), []*http.Cookie{{Name: name, Value: value}})
+}
+
+// fetchTicket fetches a ticket from the session broker of cfg. previous is
+// the SOAP session of a ticket found no longer active, if any.
+func fetchTicket(ctx context.Context, cfg *vcConfig, previous string) (sessionTicket, error) {
+	u, err := url.Parse(cfg.Connection.BrokerURL)
+	if err != nil {
+		return sessionTicket{}, fmt.Errorf("invalid broker url: %w", err)
+	}
+	u = u.JoinPath(brokerTicketPath)
+	if previous != "" {
+		u.RawQuery = url.Values{"previous": {previous}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return sessionTicket{}, fmt.Errorf("create ticket request failed: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Connection.BrokerToken)
+
+	res, err := brokerClient.Do(req)
+	if err != nil {
+		return sessionTicket{}, fmt.Errorf("fetch ticket failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		text := strings.TrimSpace(string(msg))
+		if e, ok := apierror.Parse(msg); ok {
+			text = string(e.Code) + ": " + e.Message
+		}
+		return sessionTicket{}, fmt.Errorf("fetch ticket failed: %v: %v", res.Status, text)
+	}
+
+	var t sessionTicket
+	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return sessionTicket{}, fmt.Errorf("decode ticket failed: %w", err)
+	}
+	if t.SOAP == "" {
+		return sessionTicket{}, errors.New("ticket without vCenter session")
+	}
+
+	return t, nil
+}
+
+// dialBrokered connects to vSphere with the session of the broker instead of
+// logging in, see newTicketClient.
+func dialBrokered(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lastTicket.mu.Lock()
+	previous := lastTicket.soap
+	lastTicket.mu.Unlock()
+
+	t, err := fetchTicket(ctx, cfg, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	lastTicket.mu.Lock()
+	lastTicket.soap = t.SOAP
+	lastTicket.mu.Unlock()
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   cfg.sdkPath(),
+	}
+
+	// Ticket fetches of the REST API refresh the ticket of the same broker.
+	fetch := func(ctx context.Context, previous string) (sessionTicket, error) {
+		return fetchTicket(ctx, cfg, previous)
+	}
+
+	clt, err := newTicketClient(ctx, u, cfg.VCenter.Insecure, cfg.VCenter.DisableREST, cfg.VCenter.APIVersion, t, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	clt.throttle(limiterFor(cfg))
+
+	return clt, nil
+}
+
+// newTicketClient creates a client sharing the sessions of ticket t. Like
+// newClient, the API version is negotiated with vCenter first. The SOAP
+// session is verified before the client is returned; the REST session of the
+// ticket is adopted as is, and renewed with fetch once vCenter no longer knows
+// it.
+func newTicketClient(ctx context.Context, u url.URL, insecure, disableREST bool, apiVersion string, t sessionTicket, fetch func(ctx context.Context, previous string) (sessionTicket, error)) (*vsClient, error) {
+	clt := &vsClient{ticket: fetch}
+
+	sc := soap.NewClient(&u, insecure)
+	setCookie(sc, soap.SessionCookieName, t.SOAP)
+
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	server := vc.ServiceContent.About.ApiVersion
+	vc.Version, err = negotiate(server, apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	clt.apiVersion = vc.Version
+
+	gc := &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}
+	s, err := gc.SessionManager.UserSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("verify brokered session failed: %w", err)
+	}
+	if s == nil {
+		return nil, errors.New("brokered session not active")
+	}
+	clt.govmomi = gc
+	clt.session = s.Key
+
+	if !disableREST {
+		clt.rest = rest.NewClient(vc)
+		if t.REST != "" {
+			setCookie(clt.rest.Client, restSessionCookieName, t.REST)
+			clt.restSession = true
+			clt.restUsed = time.Now()
+		}
+	}
+
+	slog.Info("connected to vSphere with brokered session", "sdk", u.Path, "api_version", clt.apiVersion, "vcenter_api_version", server, "session", clt.session)
+
+	return clt, nil
+}
+
+// renewREST replaces the REST session of a brokered client with the one of a
+// new ticket. The broker verifies its sessions first, since the client found
+// the REST session of its ticket no longer active. clt.restMu must be held.
+func (clt *vsClient) renewREST(ctx context.Context) error {
+	previous := cookie(clt.govmomi.Client.Client, soap.SessionCookieName)
+
+	t, err := clt.ticket(ctx, previous)
+	if err != nil {
+		return err
+	}
+	if t.REST == "" {
+		return errors.New("ticket without rest session")
+	}
+
+	setCookie(clt.rest.Client, restSessionCookieName, t.REST)
+	clt.restSession = true
+
+	return nil
+}
+
+// validateBroker ensures the session broker is reachable over HTTP(S) with a
+// token and its sessions can be shared.
+func validateBroker(cfg vcConfig) error {
+	c := cfg.Connection
+	if c.BrokerURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.BrokerURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("connection broker_url %q must be an http(s) url", c.BrokerURL)
+	}
+
+	if c.BrokerToken == "" {
+		return errors.New("required field(s) missing, including connection broker_token")
+	}
+
+	if cfg.restOnly() {
+		return errors.New(`connection broker_url requires vcenter api "soap"`)
+	}
+
+	return nil
+}
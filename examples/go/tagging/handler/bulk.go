@@ -0,0 +1,83 @@
+package function
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// defaultMaxDetails is the number of per-VM results included in responses of
+// bulk actions, unless configured otherwise.
+const defaultMaxDetails = 10
+
+// bulkResult collects the per-VM outcomes of acting on the VMs of an entity,
+// e.g. of a host alarm. Responses only include the counts and up to max
+// details, so they stay small for the event processor; the full results are
+// logged.
+type bulkResult struct {
+	done   []string
+	failed []error
+}
+
+// add records the outcome of acting on vm.
+func (r *bulkResult) add(vm string, err error) {
+	if err != nil {
+		r.failed = append(r.failed, fmt.Errorf("%v: %w", vm, err))
+		return
+	}
+
+	r.done = append(r.done, vm)
+}
+
+// total returns the number of VMs acted on.
+func (r *bulkResult) total() int {
+	return len(r.done) + len(r.failed)
+}
+
+// err returns the joined errors of all failed VMs or nil.
+func (r *bulkResult) err() error {
+	return errors.Join(r.failed...)
+}
+
+// details describes up to max per-VM results, failures first, and how many
+// were left out.
+func (r *bulkResult) details(max int) string {
+	var parts []string
+
+	left := max
+	list := func(label string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+
+		n := min(left, len(items))
+		left -= n
+
+		s := fmt.Sprintf("%v: %v", label, strings.Join(items[:n], ", "))
+		switch more := len(items) - n; {
+		case n == 0:
+			s = fmt.Sprintf("%v: %d VM(s)", label, len(items))
+		case more > 0:
+			s += fmt.Sprintf(" and %d more", more)
+		}
+		parts = append(parts, s)
+	}
+
+	failures := make([]string, len(r.failed))
+	for i, err := range r.failed {
+		failures[i] = err.Error()
+	}
+	list("failed", failures)
+	list("done", r.done)
+
+	return strings.Join(parts, "; ")
+}
+
+// maxDetails returns the number of per-VM results included in responses.
+func (cfg *vcConfig) maxDetails() int {
+	if cfg.Alarm.MaxDetails > 0 {
+		return cfg.Alarm.MaxDetails
+	}
+
+	return defaultMaxDetails
+}
@@ -0,0 +1,418 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Sources of the placeholders of derived tag values.
+const (
+	sourceEvent = "event" // a path into the event, e.g. {event.data.Alarm.Name}
+	sourceVM    = "vm"    // a scalar VM property, e.g. {vm.config.hardware.numCPU}
+	sourceTime  = "time"  // the time of the event, e.g. {time:2006-01-02}
+)
+
+// defaultTimeLayout formats {time} placeholders without layout.
+const defaultTimeLayout = "2006-01-02"
+
+// categorizedTag is a tag of a tag action named by a value derived from the
+// event, e.g. a sizing tag, a timestamp tag and an alarm-name tag applied from
+// one event.
+type categorizedTag struct {
+	// Category is the name of the category of the tag.
+	Category string `json:"category"`
+	// Value derives the tag name. Text in braces is a placeholder:
+	// {event.<path>} for a field of the event, {vm.<path>} for a scalar VM
+	// property and {time:<layout>} for the time of the event in UTC,
+	// formatted with a Go time layout. All other text is kept as is.
+	Value string `json:"value"`
+	// Create creates the tag in the category if no tag has the derived
+	// name yet.
+	Create bool `json:"create,omitempty"`
+	// History keeps the last names of the tag with the date they were
+	// applied, as tags of another category.
+	History *tagHistory `json:"history,omitempty"`
+}
+
+// segment is literal text or a placeholder of a derived value.
+type segment struct {
+	text   string
+	source string // empty for literal text
+	path   string // the path or, of time placeholders, the layout
+}
+
+// parseValue splits a derived value into its literal text and placeholders.
+func parseValue(value string) ([]segment, error) {
+	var segs []segment
+
+	for rest := value; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			segs = append(segs, segment{text: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("value %q has unbalanced }", value)
+		}
+		if open > 0 {
+			segs = append(segs, segment{text: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] == '{' {
+			return nil, fmt.Errorf("value %q has unbalanced {", value)
+		}
+		expr := rest[open+1 : open+1+end]
+		rest = rest[open+1+end+1:]
+
+		seg, err := parsePlaceholder(expr)
+		if err != nil {
+			return nil, fmt.Errorf("value %q: %w", value, err)
+		}
+		segs = append(segs, seg)
+	}
+
+	return segs, nil
+}
+
+// parsePlaceholder parses the expression of a placeholder without braces.
+func parsePlaceholder(expr string) (segment, error) {
+	if expr == sourceTime || strings.HasPrefix(expr, sourceTime+":") {
+		layout := strings.TrimPrefix(strings.TrimPrefix(expr, sourceTime), ":")
+		if layout == "" {
+			layout = defaultTimeLayout
+		}
+		return segment{source: sourceTime, path: layout}, nil
+	}
+
+	i := strings.Index(expr, ".")
+	if i < 0 {
+		return segment{}, fmt.Errorf("unsupported placeholder {%v}", expr)
+	}
+
+	source, path := expr[:i], expr[i+1:]
+	if source != sourceEvent && source != sourceVM {
+		return segment{}, fmt.Errorf("unsupported placeholder {%v}, expected event, vm or time", expr)
+	}
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return segment{}, fmt.Errorf("invalid path in placeholder {%v}", expr)
+		}
+	}
+
+	return segment{source: source, path: path}, nil
+}
+
+// sourcePaths returns the paths of the source the values of tags refer to,
+// e.g. the VM property paths of sourceVM.
+func sourcePaths(cts []categorizedTag, source string) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for _, t := range cts {
+		// Values are validated when loading the config.
+		segs, _ := parseValue(t.Value)
+		for _, s := range segs {
+			if s.source == source && !seen[s.path] {
+				seen[s.path] = true
+				paths = append(paths, s.path)
+			}
+		}
+	}
+
+	return paths
+}
+
+// derivation holds what placeholders are derived from.
+type derivation struct {
+	event interface{}       // the decoded event
+	props map[string]string // the VM properties by path
+	at    time.Time         // the time of the event
+}
+
+// derive returns the tag name the value of t derives to. Placeholders which
+// are not set fail the derivation, so no tag with a partial name is applied.
+func (t categorizedTag) derive(d derivation) (string, error) {
+	segs, err := parseValue(t.Value)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, s := range segs {
+		switch s.source {
+		case "":
+			b.WriteString(s.text)
+		case sourceTime:
+			b.WriteString(d.at.UTC().Format(s.path))
+		case sourceEvent:
+			v, ok := lookup(d.event, s.path)
+			if !ok {
+				return "", fmt.Errorf("event has no %v", s.path)
+			}
+			text, err := scalar(v)
+			if err != nil {
+				return "", fmt.Errorf("event field %v: %w", s.path, err)
+			}
+			b.WriteString(text)
+		case sourceVM:
+			v, ok := d.props[s.path]
+			if !ok {
+				return "", fmt.Errorf("VM property %v is not set", s.path)
+			}
+			b.WriteString(v)
+		}
+	}
+
+	name := strings.TrimSpace(b.String())
+	if name == "" {
+		return "", fmt.Errorf("value %q derives to an empty tag name", t.Value)
+	}
+
+	return name, nil
+}
+
+// newDerivation decodes the event fields at eventPaths of the body and
+// retrieves the VM properties at vmPaths. Only the fields at eventPaths are
+// kept, so large events are not decoded as a whole. The time is that of the
+// CloudEvent ce of the body; events which are no CloudEvent derive the time of
+// now.
+func newDerivation(ctx context.Context, cfg *vcConfig, client *vsClient, ref types.ManagedObjectReference, body []byte, ce *vevents.CloudEvent, eventPaths, vmPaths []string) (derivation, error) {
+	d := derivation{at: time.Now()}
+
+	event, err := decodePaths(bytes.NewReader(body), eventPaths)
+	if err != nil {
+		return d, fmt.Errorf("parsing of event for tag values failed: %w", err)
+	}
+	d.event = event
+	if ce != nil {
+		if created := ce.Created(); !created.IsZero() {
+			d.at = created
+		}
+	}
+
+	if len(vmPaths) == 0 {
+		return d, nil
+	}
+
+	err = limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+		d.props, err = client.vmProperties(ctx, ref, vmPaths)
+		return err
+	})
+
+	return d, err
+}
+
+// categorize attaches the categorized tags of a to the VM ref. The names of
+// all tags are derived before the first is attached. Tags with a history
+// record their name in the history category after they are attached. The
+// returned text lists the attached tags as category:name.
+func categorize(ctx context.Context, cfg *vcConfig, a action, client *vsClient, ref types.ManagedObjectReference, body []byte, ce *vevents.CloudEvent) (string, error) {
+	d, err := newDerivation(ctx, cfg, client, ref, body, ce, sourcePaths(a.Tags, sourceEvent), sourcePaths(a.Tags, sourceVM))
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(a.Tags))
+	for _, t := range a.Tags {
+		name, err := t.derive(d)
+		if err != nil {
+			return "", fmt.Errorf("tag of category %v: %w", t.Category, err)
+		}
+		names = append(names, name)
+	}
+
+	applied := make([]string, 0, len(a.Tags))
+	for i, t := range a.Tags {
+		err := limit(ctx, cfg, opTag, func(ctx context.Context) error {
+			return client.categoryTag(ctx, ref, t.Category, names[i], t.Create)
+		})
+		if err != nil {
+			return "", fmt.Errorf("tag %v:%v: %w", t.Category, names[i], err)
+		}
+		applied = append(applied, t.Category+":"+names[i])
+
+		if t.History == nil {
+			continue
+		}
+		var entry string
+		err = limit(ctx, cfg, opTag, func(ctx context.Context) (err error) {
+			entry, err = client.recordHistory(ctx, ref, *t.History, names[i], d.at)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("history of tag %v:%v: %w", t.Category, names[i], err)
+		}
+		if entry != "" {
+			applied = append(applied, t.History.Category+":"+entry)
+		}
+	}
+
+	return cfg.message(i18n.Tagged, ref.Value, strings.Join(applied, ", ")), nil
+}
+
+// categoryTag attaches the tag name of category to the VM, creating the tag
+// first if create is set. Categories of single cardinality hold one tag per
+// object, so other tags of the category are detached from the VM before. The
+// tags of the category and of the VM are read concurrently.
+func (clt *vsClient) categoryTag(ctx context.Context, vm types.ManagedObjectReference, category, name string, create bool) error {
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	c, err := m.GetCategory(ctx, category)
+	traceFrom(ctx).call("GetCategory", start, err)
+	if err != nil {
+		return fmt.Errorf("category %q not found: %w", category, err)
+	}
+
+	single := c.Cardinality == "SINGLE"
+
+	var id string
+	var attached []tags.Tag
+	err = readConcurrently(ctx,
+		func(ctx context.Context) (err error) {
+			id, err = tagInCategory(ctx, m, c, name)
+			return err
+		},
+		func(ctx context.Context) error {
+			if !single {
+				return nil
+			}
+
+			start := time.Now()
+			var err error
+			attached, err = m.GetAttachedTags(ctx, vm)
+			traceFrom(ctx).call("GetAttachedTags", start, err)
+			if err != nil {
+				return fmt.Errorf("list tags of VM failed: %w", err)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if id == "" {
+		if !create {
+			return fmt.Errorf("tag %q not found in category %v", name, c.Name)
+		}
+
+		// The audit record names the tag replaced in a single cardinality
+		// category.
+		var previous string
+		for _, t := range attached {
+			if t.CategoryID == c.ID {
+				previous = t.Name
+				break
+			}
+		}
+
+		start = time.Now()
+		id, err = m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: c.ID, Description: auditDescription(ctx, name, previous)})
+		traceFrom(ctx).call("CreateTag", start, err)
+		if err != nil {
+			return fmt.Errorf("create tag %q in category %v failed: %w", name, c.Name, err)
+		}
+	}
+
+	for _, t := range attached {
+		if t.CategoryID != c.ID || t.ID == id {
+			continue
+		}
+		start = time.Now()
+		err := m.DetachTag(ctx, t.ID, vm)
+		traceFrom(ctx).call("DetachTag", start, err)
+		if err != nil {
+			return fmt.Errorf("detach tag %v of single cardinality category failed: %w", t.Name, err)
+		}
+	}
+
+	if err := attachTag(ctx, m, id, vm); err != nil {
+		return fmt.Errorf("attach tag to VM failed: %w", err)
+	}
+
+	return nil
+}
+
+// errTagFound stops the reads of tagInCategory once the tag is found.
+var errTagFound = errors.New("tag found")
+
+// tagInCategory returns the id of the tag name of category c, empty if the
+// category has no such tag. The tags of the category are read concurrently
+// until the tag is found.
+func tagInCategory(ctx context.Context, m *tags.Manager, c *tags.Category, name string) (string, error) {
+	start := time.Now()
+	ids, err := m.ListTagsForCategory(ctx, c.ID)
+	traceFrom(ctx).call("ListTagsForCategory", start, err)
+	if err != nil {
+		return "", fmt.Errorf("list tags of category %v failed: %w", c.Name, err)
+	}
+
+	// Tag names are unique in a category, so a single read writes found.
+	var found string
+	reads := make([]func(ctx context.Context) error, 0, len(ids))
+	for _, id := range ids {
+		reads = append(reads, func(ctx context.Context) error {
+			start := time.Now()
+			t, err := m.GetTag(ctx, id)
+			traceFrom(ctx).call("GetTag", start, err)
+			if err != nil {
+				return fmt.Errorf("get tag %v failed: %w", id, err)
+			}
+			if t.Name == name {
+				found = id
+				return errTagFound
+			}
+			return nil
+		})
+	}
+
+	err = readConcurrently(ctx, reads...)
+	if errors.Is(err, errTagFound) {
+		return found, nil
+	}
+
+	return "", err
+}
+
+// validateTags ensures the categorized tags of the tag action a of rule name
+// have a category and a value with valid placeholders.
+func validateTags(name string, a action) error {
+	if a.TagURN != "" && len(a.Tags) > 0 {
+		return fmt.Errorf("rule %v has a tag action with tag_urn and tags, use one tag action each", name)
+	}
+
+	for _, t := range a.Tags {
+		if t.Category == "" {
+			return fmt.Errorf("rule %v has a tag without category", name)
+		}
+		if strings.TrimSpace(t.Value) == "" {
+			return fmt.Errorf("rule %v has a tag of category %v without value", name, t.Category)
+		}
+		if _, err := parseValue(t.Value); err != nil {
+			return fmt.Errorf("rule %v has a tag of category %v with invalid %w", name, t.Category, err)
+		}
+		if h := t.History; h != nil {
+			if h.Category == "" || h.Category == t.Category {
+				return fmt.Errorf("rule %v has a tag of category %v whose history needs a category of its own", name, t.Category)
+			}
+			if h.Keep < 1 {
+				return fmt.Errorf("rule %v has a tag of category %v whose history keeps no entries, set keep", name, t.Category)
+			}
+		}
+	}
+
+	return nil
+}
@@ -2,46 +2,274 @@ package function
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
 	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
 // vsClient is a client for vSphere.
 type vsClient struct {
 	govmomi *govmomi.Client
-	rest    *rest.Client
+	// rest is nil if the REST API is disabled. Use restClient, which
+	// logs in on first use.
+	rest *rest.Client
+	// session is the key of the SOAP session, logged when it is terminated.
+	session string
+	// apiVersion is the negotiated version of the SOAP API, recorded in
+	// audit records. It is empty for clients without SOAP API.
+	apiVersion string
+
+	restMu sync.Mutex
+	// restUser logs in to the REST API on first use and again once the
+	// session expired.
+	restUser *url.Userinfo
+	// restSession is set while a REST session is open, restUsed is the
+	// time it was last handed out.
+	restSession bool
+	restUsed    time.Time
+
+	// ticket fetches the sessions of the session broker for clients sharing
+	// them, see newTicketClient. It is nil for clients which log in
+	// themselves.
+	ticket func(ctx context.Context, previous string) (sessionTicket, error)
+
+	// managedBy caches the ids of managed-by tags by category:name, see
+	// managedByTag.
+	managedBy sync.Map
 }
 
-func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
-	var clt vsClient
+// restVerifyAfter is the idle time after which the REST session is verified
+// before it is reused. vCenter expires idle REST sessions after 30 minutes by
+// default, so a session in use is kept alive by the calls themselves.
+const restVerifyAfter = time.Minute
+
+// newClient logs in to the SOAP API with the API version negotiated with
+// vCenter, or apiVersion if pinned, see negotiate. The REST API is logged in
+// to by the first tag operation, unless disableREST, so REST failures never
+// prevent SOAP-only operations.
+func newClient(ctx context.Context, u url.URL, insecure, disableREST bool, apiVersion string) (*vsClient, error) {
+	clt := &vsClient{}
+
+	// The service content is retrieved before the login, with the version
+	// of the client.
+	vc, err := vim25.NewClient(ctx, soap.NewClient(&u, insecure))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
 
-	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	server := vc.ServiceContent.About.ApiVersion
+	vc.Version, err = negotiate(server, apiVersion)
 	if err != nil {
+		return nil, err
+	}
+	clt.apiVersion = vc.Version
+
+	gc := &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}
+	if err := gc.Login(ctx, u.User); err != nil {
 		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
 	}
 	clt.govmomi = gc
 
-	clt.rest = rest.NewClient(clt.govmomi.Client)
-	err = clt.rest.Login(ctx, u.User)
+	if !disableREST {
+		clt.rest = rest.NewClient(clt.govmomi.Client)
+		clt.restUser = u.User
+	}
+
+	// The session key only identifies the session in logs, it is no failure
+	// if it cannot be retrieved.
+	if s, err := gc.SessionManager.UserSession(ctx); err == nil && s != nil {
+		clt.session = s.Key
+	}
+
+	slog.Info("connected to vSphere", "sdk", u.Path, "api_version", clt.apiVersion, "vcenter_api_version", server, "session", clt.session)
+
+	return clt, nil
+}
+
+// restClient returns the REST client, logging in on first use. Functions
+// which never tag thus never open a REST session.
+//
+// The session is reused by all calls of the client: its cookie is sent with
+// each request over the kept-alive connections of the SOAP transport. A
+// session idle for longer than restVerifyAfter is verified first, and a
+// session vCenter no longer knows, e.g. after it expired or was terminated, is
+// replaced by a new login. A lost REST session thus neither fails tag
+// operations for good nor discards the SOAP session. A failed login is
+// returned to the caller only; the next call tries again.
+func (clt *vsClient) restClient(ctx context.Context) (*rest.Client, error) {
+	if clt.rest == nil {
+		return nil, errRESTDisabled
+	}
+
+	clt.restMu.Lock()
+	defer clt.restMu.Unlock()
+
+	now := time.Now()
+	if clt.restSession && now.Sub(clt.restUsed) > restVerifyAfter {
+		start := time.Now()
+		s, err := clt.rest.Session(ctx)
+		traceFrom(ctx).call("rest session", start, err)
+		// Errors, e.g. of an unavailable endpoint, are left to the call
+		// itself, only an unknown session is replaced.
+		if err == nil && s == nil {
+			slog.Info("rest session no longer active, logging in again")
+			clt.restSession = false
+		}
+	}
+
+	if !clt.restSession && clt.ticket != nil {
+		start := time.Now()
+		err := clt.renewREST(ctx)
+		traceFrom(ctx).call("rest ticket", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("renew brokered rest session failed: %w", err)
+		}
+	}
+
+	if !clt.restSession {
+		start := time.Now()
+		err := clt.rest.Login(ctx, clt.restUser)
+		traceFrom(ctx).call("rest login", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("log in to rest api failed: %w", err)
+		}
+		clt.restSession = true
+	}
+	clt.restUsed = now
+
+	return clt.rest, nil
+}
+
+// restLoggedIn reports whether clt has a REST session.
+func (clt *vsClient) restLoggedIn() bool {
+	clt.restMu.Lock()
+	defer clt.restMu.Unlock()
+
+	return clt.rest != nil && clt.restSession
+}
+
+// verifyREST drops the REST session of a SOAP client if vCenter no longer
+// knows it, so the next tag operation logs in again without affecting the SOAP
+// session. Clients of the REST API only are verified by active.
+func (clt *vsClient) verifyREST(ctx context.Context) {
+	if clt.govmomi == nil || !clt.restLoggedIn() {
+		return
+	}
+
+	if s, err := clt.rest.Session(ctx); err != nil || s != nil {
+		return
+	}
+
+	clt.restMu.Lock()
+	clt.restSession = false
+	clt.restMu.Unlock()
+}
+
+// maxConcurrentReads limits the vSphere reads of an invocation in flight at
+// once, so a single event cannot exhaust the sessions of vCenter.
+const maxConcurrentReads = 4
+
+type readSlotsKey struct{}
+
+// readConcurrently runs independent vSphere reads concurrently, at most
+// maxConcurrentReads at once. The first failing read cancels the context of
+// the others, reads not started yet are skipped and its error is returned.
+// Reads must only write their own results.
+//
+// Reads may read concurrently again, all share the slots of the outermost
+// call. A nested read finding no free slot runs in the slot of its caller
+// instead of waiting for one, which the reads holding the slots could wait
+// for in turn.
+func readConcurrently(ctx context.Context, reads ...func(ctx context.Context) error) error {
+	slots, nested := ctx.Value(readSlotsKey{}).(chan struct{})
+	if !nested {
+		slots = make(chan struct{}, maxConcurrentReads)
+		ctx = context.WithValue(ctx, readSlotsKey{}, slots)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	fail := func(err error) {
+		if err != nil {
+			once.Do(func() {
+				first = err
+				cancel()
+			})
+		}
+	}
+
+	for _, read := range reads {
+		if nested {
+			select {
+			case slots <- struct{}{}:
+			default:
+				if ctx.Err() == nil {
+					fail(read(ctx))
+				}
+				continue
+			}
+		} else {
+			slots <- struct{}{}
+		}
+
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fail(read(ctx))
+		}()
+	}
+	wg.Wait()
+
+	return first
+}
+
+// tagManager returns the tag manager of the REST client.
+func (clt *vsClient) tagManager(ctx context.Context) (*tags.Manager, error) {
+	rc, err := clt.restClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+		return nil, err
 	}
 
-	return &clt, nil
+	return tags.NewManager(rc), nil
 }
 
 // moTag adds an existing tag to a VirtualMachine.
 func (clt *vsClient) moTag(ctx context.Context, vm types.ManagedObjectReference, tagID string) error {
 	// Get the tag manager which does the tagging.
-	m := tags.NewManager(clt.rest)
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Attach tag to VM.
-	err := m.AttachTag(ctx, tagID, vm)
+	err = attachTag(ctx, m, tagID, vm)
 	if err != nil {
 		return fmt.Errorf("attach tag to VM failed: %w", err)
 	}
@@ -49,16 +277,173 @@ func (clt *vsClient) moTag(ctx context.Context, vm types.ManagedObjectReference,
 	return nil
 }
 
-func (clt *vsClient) logout(ctx context.Context) error {
-	err := clt.govmomi.Logout(ctx)
+// Tagging actions of the [tag] section.
+const (
+	tagAttach = "attach"
+	tagDetach = "detach"
+)
+
+// detaching reports whether the [tag] urn is detached instead of attached.
+func (cfg *vcConfig) detaching() bool {
+	return strings.EqualFold(cfg.Tag.Action, tagDetach)
+}
+
+// validateTagAction ensures the [tag] action is known, so a typo never
+// attaches a tag which was meant to be detached.
+func validateTagAction(cfg vcConfig) error {
+	switch strings.ToLower(cfg.Tag.Action) {
+	case "", tagAttach, tagDetach:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported tag action %q, must be %v or %v", cfg.Tag.Action, tagAttach, tagDetach)
+}
+
+// applyTag attaches the tag urn to the VM or, with [tag] action = "detach",
+// detaches it.
+func (clt *vsClient) applyTag(ctx context.Context, cfg *vcConfig, vm types.ManagedObjectReference, urn string) error {
+	if cfg.detaching() {
+		return clt.moUntag(ctx, vm, urn)
+	}
+
+	return clt.moTag(ctx, vm, urn)
+}
+
+// moUntag detaches a tag from a VirtualMachine. Detaching a tag which is not
+// attached succeeds.
+func (clt *vsClient) moUntag(ctx context.Context, vm types.ManagedObjectReference, tagID string) error {
+	m, err := clt.tagManager(ctx)
 	if err != nil {
-		return fmt.Errorf("govmomi api logout failed: %w", err)
+		return err
+	}
+
+	start := time.Now()
+	err = m.DetachTag(ctx, tagID, vm)
+	traceFrom(ctx).call("DetachTag", start, err)
+	if err != nil {
+		return fmt.Errorf("detach tag from VM failed: %w", err)
+	}
+
+	return nil
+}
+
+// attachTag attaches a tag to an object and treats an already attached tag as
+// success. Some vCenter versions fail AttachTag in that case, which breaks
+// retries of an invocation. The attached tags are only listed when the attach
+// failed, so the common path costs a single call.
+func attachTag(ctx context.Context, m *tags.Manager, tagID string, ref mo.Reference) error {
+	start := time.Now()
+	err := m.AttachTag(ctx, tagID, ref)
+	traceFrom(ctx).call("AttachTag", start, err)
+	if err == nil {
+		return nil
+	}
+
+	start = time.Now()
+	attached, listErr := m.ListAttachedTags(ctx, ref)
+	traceFrom(ctx).call("ListAttachedTags", start, listErr)
+	if listErr != nil {
+		return err
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			tagAlreadyAttached.Add(1)
+			traceFrom(ctx).step("tag %v already attached to %v", tagID, ref.Reference().Value)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// acknowledgeAlarm acknowledges a triggered alarm on an entity.
+func (clt *vsClient) acknowledgeAlarm(ctx context.Context, alarm, entity types.ManagedObjectReference) error {
+	if clt.govmomi == nil {
+		return errSOAPRequired
+	}
+	c := clt.govmomi.Client
+
+	req := types.AcknowledgeAlarm{
+		This:   *c.ServiceContent.AlarmManager,
+		Alarm:  alarm,
+		Entity: entity,
 	}
 
-	err = clt.rest.Logout(ctx)
+	start := time.Now()
+	_, err := methods.AcknowledgeAlarm(ctx, c, &req)
+	traceFrom(ctx).call("AcknowledgeAlarm", start, err)
 	if err != nil {
-		return fmt.Errorf("rest api logout failed: %w", err)
+		return fmt.Errorf("acknowledge alarm %v failed: %w", alarm.Value, err)
 	}
 
 	return nil
 }
+
+// reconfigure sets the advanced settings of a VM. Empty values remove a
+// setting.
+func (clt *vsClient) reconfigure(ctx context.Context, vm types.ManagedObjectReference, extraConfig map[string]string) error {
+	// The vAPI has no equivalent of advanced settings.
+	if clt.govmomi == nil {
+		return errSOAPRequired
+	}
+
+	var spec types.VirtualMachineConfigSpec
+	for k, v := range extraConfig {
+		spec.ExtraConfig = append(spec.ExtraConfig, &types.OptionValue{Key: k, Value: v})
+	}
+
+	start := time.Now()
+	task, err := object.NewVirtualMachine(clt.govmomi.Client, vm).Reconfigure(ctx, spec)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	traceFrom(ctx).call("ReconfigVM_Task", start, err)
+	if err != nil {
+		return fmt.Errorf("reconfigure %v failed: %w", vm.Value, err)
+	}
+
+	return nil
+}
+
+// logout logs out of both APIs, even if the first logout fails. APIs clt is
+// not logged in to are skipped, as are the sessions shared by the session
+// broker, which logs out of them itself.
+func (clt *vsClient) logout(ctx context.Context) error {
+	if clt == nil || clt.ticket != nil {
+		return nil
+	}
+
+	var errs []error
+
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.restLoggedIn() {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// active reports whether the session of clt is still valid: the SOAP session
+// or, for clients of the REST API only, the REST session. The REST session of
+// SOAP clients is renewed by restClient instead, see verifyREST.
+func (clt *vsClient) active(ctx context.Context) bool {
+	if clt.govmomi != nil {
+		s, err := clt.govmomi.SessionManager.UserSession(ctx)
+		return err == nil && s != nil
+	}
+
+	if !clt.restLoggedIn() {
+		return true
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	return err == nil && rs != nil
+}
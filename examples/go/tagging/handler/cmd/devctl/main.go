@@ -0,0 +1,223 @@
+// Command devctl invokes the tagging function in-process with canned or
+// captured CloudEvents and prints the response with its decision trace. It is
+// meant to try out a vcconfig during development without deploying the
+// function or capturing events first, e.g.:
+//
+//	go run ./cmd/devctl list
+//	go run ./cmd/devctl invoke -event alarm-red -config ../vcconfig.toml -dry-run
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	function "github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+)
+
+// traceMarker separates the response message from the trace.
+const traceMarker = "\n\n--- trace ---\n"
+
+//go:embed events/*.json
+var canned embed.FS
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "list":
+		list()
+	case "invoke":
+		invoke(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Printf("Usage of %s:\n\n", os.Args[0])
+	fmt.Println("  list      list the canned sample events")
+	fmt.Println("  invoke    invoke the handler with an event, see invoke -h")
+}
+
+// list prints the names and subjects of the canned events.
+func list() {
+	names, err := cannedNames()
+	if err != nil {
+		log.Fatalf("could not list events: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EVENT\tSUBJECT")
+	for _, n := range names {
+		b, _ := canned.ReadFile(path.Join("events", n+".json"))
+
+		var ce struct {
+			Subject string `json:"subject"`
+		}
+		json.Unmarshal(b, &ce)
+
+		fmt.Fprintf(w, "%v\t%v\n", n, ce.Subject)
+	}
+	w.Flush()
+}
+
+// invoke runs the handler with one event and prints the outcome.
+func invoke(args []string) {
+	var (
+		name    string
+		file    string
+		config  string
+		dryRun  bool
+		verbose bool
+		token   string
+		hmacKey string
+	)
+
+	fs := flag.NewFlagSet("invoke", flag.ExitOnError)
+	fs.StringVar(&name, "event", "", "name of a canned event, see list")
+	fs.StringVar(&file, "file", "", "path of a captured CloudEvent instead of a canned event")
+	fs.StringVar(&config, "config", "./vcconfig.toml", "path of the vcconfig")
+	fs.BoolVar(&dryRun, "dry-run", false, "ask the function not to change the inventory")
+	fs.BoolVar(&verbose, "verbose", false, "print the function logs to stderr")
+	fs.StringVar(&token, "token", os.Getenv("VEBA_AUTH_TOKEN"), "bearer token of the [auth] section, defaults to $VEBA_AUTH_TOKEN")
+	fs.StringVar(&hmacKey, "hmac-key", os.Getenv("VEBA_AUTH_HMAC_KEY"), "key signing the event for the [auth] section, defaults to $VEBA_AUTH_HMAC_KEY")
+	fs.Parse(args)
+
+	if (name == "") == (file == "") {
+		log.Fatal("either -event or -file is required")
+	}
+
+	body, err := load(name, file)
+	if err != nil {
+		log.Fatalf("could not load event: %v", err)
+	}
+
+	// The handler reads its config and trace settings on every invocation.
+	os.Setenv("vcconfig_path", config)
+	os.Setenv("write_debug", "true")
+	os.Setenv("response_trace", "true")
+
+	level := slog.LevelError + 1
+	if verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	req := handler.Request{
+		Body:   body,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Method: http.MethodPost,
+	}
+	if dryRun {
+		req.Header.Set("X-Dry-Run", "true")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if hmacKey != "" {
+		req.Header.Set(middleware.SignatureHeader, middleware.Sign([]byte(hmacKey), body))
+	}
+
+	start := time.Now()
+	res, err := function.Handle(req)
+	report(os.Stdout, res, err, time.Since(start))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		os.Exit(1)
+	}
+}
+
+// load returns the canned event name or the content of file. Canned events
+// are stamped with the current time, so they are not skipped as stale.
+func load(name, file string) ([]byte, error) {
+	if file != "" {
+		return os.ReadFile(file)
+	}
+
+	b, err := canned.ReadFile(path.Join("events", name+".json"))
+	if err != nil {
+		names, _ := cannedNames()
+		return nil, fmt.Errorf("unknown event %q, expected one of %v", name, strings.Join(names, ", "))
+	}
+
+	var ce map[string]json.RawMessage
+	if err := json.Unmarshal(b, &ce); err != nil {
+		return nil, fmt.Errorf("canned event %v is invalid: %w", name, err)
+	}
+	ce["time"], _ = json.Marshal(time.Now().UTC())
+
+	return json.MarshalIndent(ce, "", "  ")
+}
+
+// cannedNames returns the sorted names of the canned events.
+func cannedNames() ([]string, error) {
+	files, err := canned.ReadDir("events")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// report prints the status, the message and the decision trace of res. Failed
+// responses carry the trace as detail of their error.
+func report(w io.Writer, res handler.Response, err error, took time.Duration) {
+	message, steps, _ := bytes.Cut(res.Body, []byte(traceMarker))
+	e, failed := apierror.Parse(res.Body)
+	if failed {
+		message, steps = []byte(e.Message), []byte(e.Details["trace"])
+	}
+
+	fmt.Fprintf(w, "status:   %d %s\n", res.StatusCode, http.StatusText(res.StatusCode))
+	if failed {
+		fmt.Fprintf(w, "code:     %s (retryable: %v)\n", e.Code, e.Retryable)
+	}
+	fmt.Fprintf(w, "message:  %s\n", bytes.TrimSpace(message))
+	if err != nil && err.Error() != string(bytes.TrimSpace(message)) {
+		fmt.Fprintf(w, "error:    %v\n", err)
+	}
+	fmt.Fprintf(w, "duration: %v\n", took.Round(time.Millisecond))
+
+	lines := strings.Split(strings.TrimSpace(string(steps)), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		fmt.Fprintln(w, "\nno decision trace recorded")
+		return
+	}
+
+	fmt.Fprintln(w, "\ndecision trace:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, l := range lines {
+		// Entries are "+<offset> <step>".
+		offset, step, _ := strings.Cut(l, " ")
+		fmt.Fprintf(tw, "  %d.\t%v\t%v\n", i+1, offset, step)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,295 @@
+// Command replay sends captured CloudEvents to a locally running tagging
+// function and reports the aggregated results. It is meant to validate a new
+// vcconfig against real events before deploying it, e.g.:
+//
+//	faas-cli build -f stack.yml && docker run -p 8080:8080 ... vmware/veba-go-tagging
+//	go run ./cmd/replay -dry-run ./cmd/replay/corpus
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+)
+
+// event is a captured CloudEvent and where it was read from.
+type event struct {
+	origin  string
+	subject string
+	body    []byte
+}
+
+// Headers of the function naming the rule which matched an event and the
+// message key of the reason it was skipped.
+const (
+	ruleHeader   = "X-Rule"
+	reasonHeader = "X-Skip-Reason"
+)
+
+// options are the flags applied to every invocation.
+type options struct {
+	dryRun  bool
+	verbose bool
+	token   string
+	hmacKey string
+}
+
+// result aggregates the responses for one subject.
+type result struct {
+	total    int
+	byStatus map[int]int
+}
+
+// decision is what the function decided for an event: the rule which matched
+// and the reason it was skipped. Failed invocations have the status text as
+// reason.
+type decision struct {
+	rule   string
+	reason string
+}
+
+// summary aggregates the responses of a replay.
+type summary struct {
+	results   map[string]*result
+	decisions map[decision]int
+	failed    int
+}
+
+func main() {
+	var (
+		target  string
+		dryRun  bool
+		timeout time.Duration
+		verbose bool
+		token   string
+		hmacKey string
+	)
+
+	flag.StringVar(&target, "url", "http://127.0.0.1:8080/", "URL of the running function")
+	flag.BoolVar(&dryRun, "dry-run", false, "ask the function not to change the inventory")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout per invocation")
+	flag.BoolVar(&verbose, "verbose", false, "print the response of every invocation")
+	flag.StringVar(&token, "token", os.Getenv("VEBA_AUTH_TOKEN"), "bearer token of the [auth] section, defaults to $VEBA_AUTH_TOKEN")
+	flag.StringVar(&hmacKey, "hmac-key", os.Getenv("VEBA_AUTH_HMAC_KEY"), "key signing the events for the [auth] section, defaults to $VEBA_AUTH_HMAC_KEY")
+	flag.Usage = func() {
+		fmt.Printf("Usage of %s: [flags] <directory or .json/.ndjson file>...\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var events []event
+	for _, p := range flag.Args() {
+		evs, err := load(p)
+		if err != nil {
+			log.Fatalf("could not load events: %v", err)
+		}
+		events = append(events, evs...)
+	}
+
+	opts := options{dryRun: dryRun, verbose: verbose, token: token, hmacKey: hmacKey}
+	sum := replay(&http.Client{Timeout: timeout}, target, opts, events)
+
+	report(os.Stdout, sum, len(events))
+}
+
+// replay sends events to the function at target and aggregates the responses.
+func replay(client *http.Client, target string, opts options, events []event) *summary {
+	sum := &summary{results: map[string]*result{}, decisions: map[decision]int{}}
+
+	for _, ev := range events {
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(ev.body))
+		if err != nil {
+			log.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if opts.dryRun {
+			req.Header.Set("X-Dry-Run", "true")
+		}
+		if opts.token != "" {
+			req.Header.Set("Authorization", "Bearer "+opts.token)
+		}
+		if opts.hmacKey != "" {
+			req.Header.Set(middleware.SignatureHeader, middleware.Sign([]byte(opts.hmacKey), ev.body))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("%v: invocation failed: %v", ev.origin, err)
+			sum.failed++
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if opts.verbose {
+			log.Printf("%v: %d %s", ev.origin, resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		r, ok := sum.results[ev.subject]
+		if !ok {
+			r = &result{byStatus: map[int]int{}}
+			sum.results[ev.subject] = r
+		}
+		r.total++
+		r.byStatus[resp.StatusCode]++
+
+		d := decision{rule: resp.Header.Get(ruleHeader), reason: resp.Header.Get(reasonHeader)}
+		if d.reason == "" && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			d.reason = http.StatusText(resp.StatusCode)
+		}
+		sum.decisions[d]++
+	}
+
+	return sum
+}
+
+// load reads the events of a directory, a single CloudEvent .json file or a
+// .ndjson file with one CloudEvent per line.
+func load(path string) ([]event, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		var events []event
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			ext := filepath.Ext(f.Name())
+			if f.IsDir() || (ext != ".json" && ext != ".ndjson") {
+				continue
+			}
+
+			evs, err := load(filepath.Join(path, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, evs...)
+		}
+
+		return events, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) != ".ndjson" {
+		ev, err := newEvent(path, b)
+		if err != nil {
+			return nil, err
+		}
+		return []event{*ev}, nil
+	}
+
+	var events []event
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		ev, err := newEvent(fmt.Sprintf("%v:%d", path, line), append([]byte(nil), s.Bytes()...))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *ev)
+	}
+
+	return events, s.Err()
+}
+
+func newEvent(origin string, b []byte) (*event, error) {
+	var ce struct {
+		Subject string `json:"subject"`
+	}
+
+	if err := json.Unmarshal(b, &ce); err != nil {
+		return nil, fmt.Errorf("%v is not a CloudEvent: %w", origin, err)
+	}
+
+	return &event{origin: origin, subject: ce.Subject, body: b}, nil
+}
+
+// report prints the number of responses per subject and status code and per
+// decision of the function.
+func report(out io.Writer, sum *summary, total int) {
+	subjects := make([]string, 0, len(sum.results))
+	for s := range sum.results {
+		subjects = append(subjects, s)
+	}
+	sort.Strings(subjects)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBJECT\tEVENTS\tSTATUS")
+	for _, s := range subjects {
+		r := sum.results[s]
+
+		codes := make([]int, 0, len(r.byStatus))
+		for c := range r.byStatus {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+
+		var status []string
+		for _, c := range codes {
+			status = append(status, fmt.Sprintf("%d %s: %d", c, http.StatusText(c), r.byStatus[c]))
+		}
+
+		fmt.Fprintf(w, "%v\t%d\t%v\n", s, r.total, strings.Join(status, ", "))
+	}
+	w.Flush()
+
+	decisions := make([]decision, 0, len(sum.decisions))
+	for d := range sum.decisions {
+		decisions = append(decisions, d)
+	}
+	sort.Slice(decisions, func(i, j int) bool {
+		if decisions[i].rule != decisions[j].rule {
+			return decisions[i].rule < decisions[j].rule
+		}
+		return decisions[i].reason < decisions[j].reason
+	})
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(w, "RULE\tSKIP REASON\tEVENTS")
+	for _, d := range decisions {
+		fmt.Fprintf(w, "%v\t%v\t%d\n", orDash(d.rule), orDash(d.reason), sum.decisions[d])
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d event(s) replayed, %d invocation(s) failed\n", total, sum.failed)
+}
+
+// orDash returns s, or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
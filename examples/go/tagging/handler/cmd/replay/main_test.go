@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestReplay shows the responses are grouped by the rule and skip reason the
+// function decided on, and failed invocations by their status.
+func TestReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Dry-Run") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ev, err := newEvent("request", body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch ev.subject {
+		case "VmPoweredOnEvent":
+			w.Header().Set(ruleHeader, "power-on")
+			w.Header().Set(reasonHeader, "dry-run-rule")
+		case "DrsVmPoweredOnEvent":
+			w.Header().Set(reasonHeader, "skip-no-rule")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	var events []event
+	for _, subject := range []string{"VmPoweredOnEvent", "VmPoweredOnEvent", "DrsVmPoweredOnEvent", "VmRemovedEvent"} {
+		ev, err := newEvent(subject, []byte(`{"subject":"`+subject+`"}`))
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		events = append(events, *ev)
+	}
+
+	sum := replay(srv.Client(), srv.URL, options{dryRun: true}, events)
+
+	var tests = []struct {
+		testDesc string
+		decision decision
+		want     int
+	}{
+		{"Test that events of a rule are grouped by rule and reason", decision{rule: "power-on", reason: "dry-run-rule"}, 2},
+		{"Test that events without rule are grouped by reason", decision{reason: "skip-no-rule"}, 1},
+		{"Test that failed invocations are grouped by status", decision{reason: "Bad Request"}, 1},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if got := sum.decisions[tc.decision]; got == tc.want {
+			t.Logf("got expected: %d. %v", got, passMark)
+		} else {
+			t.Logf("expected: %d, got: %d. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the report lists the decisions ===========")
+	var out bytes.Buffer
+	report(&out, sum, len(events))
+	for _, line := range []string{
+		"RULE      SKIP REASON   EVENTS",
+		"-         Bad Request   1",
+		"-         skip-no-rule  1",
+		"power-on  dry-run-rule  2",
+		"4 event(s) replayed, 0 invocation(s) failed",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Logf("expected line %q in:\n%v %v", line, out.String(), failMark)
+			t.Fail()
+		}
+	}
+	t.Logf("got report:\n%v", out.String())
+}
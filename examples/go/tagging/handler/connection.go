@@ -0,0 +1,276 @@
+package function
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults of the [connection] section in vcconfig.toml.
+const (
+	defaultBackoffMax  = time.Minute
+	defaultVerifyAfter = 5 * time.Minute
+	logoutTimeout      = 5 * time.Second
+	dialTimeout        = 30 * time.Second
+	verifyTimeout      = 10 * time.Second
+)
+
+// connection holds the vSphere client shared by all invocations. Unlike a
+// client cached on first use, failed connection attempts are never cached:
+// invocations fail fast while a backoff is pending and reconnect afterwards.
+// A cached client is discarded when the vcconfig credentials change or its
+// session is no longer active. The state is exported as the expvar
+// vsphere_connection.
+type connection struct {
+	mu sync.Mutex
+
+	// dial creates a new client, it is replaced in tests.
+	dial func(ctx context.Context, cfg *vcConfig) (*vsClient, error)
+
+	client         *vsClient
+	key            [sha256.Size]byte // identifies the config client was created with
+	verified       time.Time         // last time the session was found active
+	connectedSince time.Time
+
+	failures int
+	lastErr  error
+	retryAt  time.Time
+}
+
+// conn is the connection shared by all invocations.
+var conn = &connection{dial: dialVSphere}
+
+// get returns a connected client, connecting if needed.
+func (c *connection) get(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Apply changed rate limits to the cached client, too.
+	limiterFor(cfg)
+
+	now := time.Now()
+	key := configKey(cfg)
+
+	if c.client != nil && c.key != key {
+		c.discard("vcconfig vCenter settings changed")
+	}
+
+	if c.client != nil && now.Sub(c.verified) > cfg.verifyAfter() {
+		vctx, cancel := detached(ctx, verifyTimeout)
+		active := c.client.active(vctx)
+		cancel()
+
+		if active {
+			c.verified = now
+		} else {
+			c.discard("session no longer active")
+		}
+	}
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	if now.Before(c.retryAt) {
+		return nil, fmt.Errorf("backing off until %v after %d failed attempt(s): %w", c.retryAt.Format(time.RFC3339), c.failures, c.lastErr)
+	}
+
+	slog.Debug("connect to vSphere")
+
+	// The client is shared, so a caller going away must neither abort the
+	// login nor count as a failed attempt backing off all invocations.
+	dctx, cancel := detached(ctx, dialTimeout)
+	defer cancel()
+
+	start := time.Now()
+	clt, err := c.dial(dctx, cfg)
+	traceFrom(ctx).call("login", start, err)
+	if err != nil {
+		c.failures++
+		c.lastErr = err
+		c.retryAt = now.Add(backoff(c.failures, cfg.backoffMax()))
+
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	c.client = clt
+	c.key = key
+	c.verified = now
+	c.connectedSince = now
+	c.failures = 0
+	c.lastErr = nil
+	c.retryAt = time.Time{}
+
+	// The caller gave up while waiting, the client is kept for the next one.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return clt, nil
+}
+
+// verify discards clt if its session is no longer active. It is called after
+// a vSphere call failed, so that the next invocation reconnects instead of
+// reusing a broken client.
+func (c *connection) verify(ctx context.Context, clt *vsClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != clt {
+		return
+	}
+
+	ctx, cancel := detached(ctx, verifyTimeout)
+	defer cancel()
+
+	// A lost REST session is renewed by the next tag operation.
+	clt.verifyREST(ctx)
+	if clt.active(ctx) {
+		return
+	}
+
+	c.discard("session no longer active")
+}
+
+// close logs out of the connected client, if any. It is safe to call on a nil
+// connection and more than once.
+func (c *connection) close(reason string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		c.discard(reason)
+	}
+}
+
+// discard drops the client and logs out on a best effort basis, waiting at
+// most logoutTimeout for vSphere. c.mu must be held.
+func (c *connection) discard(reason string) {
+	clt := c.client
+	c.client = nil
+
+	session := clt.session
+	if session == "" {
+		session = "unknown"
+	}
+	slog.Info("log out of vSphere", "session", session, "reason", reason)
+
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+
+	if err := clt.logout(ctx); err != nil {
+		slog.Warn("vSphere logout failed", "session", session, "err", err)
+	}
+}
+
+// health returns the connection state for expvar.
+func (c *connection) health() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := struct {
+		Connected      bool      `json:"connected"`
+		ConnectedSince time.Time `json:"connected_since,omitempty"`
+		Failures       int       `json:"failures"`
+		LastError      string    `json:"last_error,omitempty"`
+		RetryAt        time.Time `json:"retry_at,omitempty"`
+	}{
+		Connected: c.client != nil,
+		Failures:  c.failures,
+		RetryAt:   c.retryAt,
+	}
+
+	if c.client != nil {
+		h.ConnectedSince = c.connectedSince
+	}
+
+	if c.lastErr != nil {
+		h.LastError = c.lastErr.Error()
+	}
+
+	return h
+}
+
+// detached returns a context with the values of ctx, which is not cancelled
+// with ctx but after timeout.
+func detached(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
+
+// backoff returns the exponential delay after n failed attempts.
+func backoff(n int, max time.Duration) time.Duration {
+	d := time.Second
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		return max
+	}
+
+	return d
+}
+
+// configKey identifies the vCenter settings a client was created with.
+func configKey(cfg *vcConfig) [sha256.Size]byte {
+	v := cfg.VCenter
+	return sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v", v.Server, v.User, v.Password, v.Insecure, v.API, v.DisableREST, v.SDKPath, v.APIVersion, cfg.Connection.BrokerURL)))
+}
+
+// dialVSphere connects to vSphere using information from vcconfig.toml, with
+// the sessions of the session broker if [connection] broker_url is set.
+func dialVSphere(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	if cfg.Connection.BrokerURL != "" {
+		return dialBrokered(ctx, cfg)
+	}
+
+	return dialDirect(ctx, cfg)
+}
+
+// dialDirect logs in to vSphere with the [vcenter] credentials.
+func dialDirect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   cfg.sdkPath(),
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+
+	dial := newClient
+	if cfg.restOnly() {
+		dial = newRESTClient
+	}
+
+	clt, err := dial(ctx, u, cfg.VCenter.Insecure, cfg.VCenter.DisableREST, cfg.VCenter.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	clt.throttle(limiterFor(cfg))
+
+	return clt, nil
+}
+
+func (cfg *vcConfig) backoffMax() time.Duration {
+	if cfg.Connection.BackoffMaxSeconds > 0 {
+		return time.Duration(cfg.Connection.BackoffMaxSeconds) * time.Second
+	}
+
+	return defaultBackoffMax
+}
+
+func (cfg *vcConfig) verifyAfter() time.Duration {
+	if cfg.Connection.VerifyAfterSeconds > 0 {
+		return time.Duration(cfg.Connection.VerifyAfterSeconds) * time.Second
+	}
+
+	return defaultVerifyAfter
+}
@@ -0,0 +1,234 @@
+package function
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/deadletter"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/store"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+)
+
+// attemptsTTL is how long failed attempts of an event are counted.
+const attemptsTTL = 24 * time.Hour
+
+var attempts struct {
+	sync.Mutex
+	cfg   store.Config
+	store store.Store
+}
+
+// deadLetterSinks returns the sinks configured in the [deadletter] section.
+// The webhook and S3 sinks share one client built from the [outbound] section.
+func deadLetterSinks(cfg *vcConfig) ([]deadletter.Sink, error) {
+	d := cfg.DeadLetter
+
+	var sinks []deadletter.Sink
+	if d.File != "" {
+		sinks = append(sinks, &deadletter.File{Path: d.File})
+	}
+	if d.AMQP.URL != "" {
+		sinks = append(sinks, &deadletter.AMQP{URL: d.AMQP.URL, Exchange: d.AMQP.Exchange, RoutingKey: d.AMQP.RoutingKey})
+	}
+
+	if d.WebhookURL == "" && d.S3.Bucket == "" {
+		return sinks, nil
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.WebhookURL != "" {
+		sinks = append(sinks, &deadletter.Webhook{URL: d.WebhookURL, Client: clt})
+	}
+	if d.S3.Bucket != "" {
+		sinks = append(sinks, &deadletter.S3{
+			Endpoint:        d.S3.Endpoint,
+			Region:          d.S3.Region,
+			Bucket:          d.S3.Bucket,
+			Prefix:          d.S3.Prefix,
+			AccessKeyID:     d.S3.AccessKeyID,
+			SecretAccessKey: d.S3.SecretAccessKey,
+			Client:          clt,
+		})
+	}
+
+	return sinks, nil
+}
+
+// permanent reports whether a response status means the event will never be
+// processed, no matter how often it is retried.
+func permanent(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return true
+	}
+
+	return false
+}
+
+// deadLetters is a middleware writing the events of failed invocations to the
+// dead-letter sinks, see deadLetter.
+func deadLetters(next middleware.Func) middleware.Func {
+	return func(req handler.Request) (handler.Response, error) {
+		res, err := next(req)
+
+		// Without config, there are no sinks to write the event to.
+		if cfg, cfgErr := requestConfig(req); cfgErr == nil {
+			// Letters are written, even if the caller went away.
+			deadLetter(context.WithoutCancel(requestContext(&req)), cfg, req, res.StatusCode, err)
+		}
+
+		return res, err
+	}
+}
+
+// deadLetter writes the event of req to the dead-letter sinks if it is
+// malformed or its processing failed for the max_attempts time. Failed
+// attempts are counted by CloudEvent id in the configured store. Errors are
+// logged only, they must not mask the processing error.
+func deadLetter(ctx context.Context, cfg *vcConfig, req handler.Request, status int, cause error) {
+	sinks, err := deadLetterSinks(cfg)
+	if err != nil {
+		slog.Error("dead-letter sinks not available", "err", err)
+		return
+	}
+	if len(sinks) == 0 {
+		return
+	}
+
+	failed := cause != nil && status >= http.StatusBadRequest
+	if !failed && cfg.DeadLetter.MaxAttempts <= 1 {
+		return
+	}
+
+	// Letters keep the decoded event, unless the encoding is the problem.
+	body, err := decodeBody(req)
+	raw := err != nil
+	if raw {
+		body = req.Body
+	}
+
+	var id string
+	if ce, err := vevents.Parse(body); err == nil {
+		id = ce.ID
+	}
+
+	n := 1
+	if !permanent(status) && cfg.DeadLetter.MaxAttempts > 1 {
+		if n, err = countAttempt(ctx, cfg, attemptsKey(id, body), failed); err != nil {
+			slog.Error("counting failed attempts failed", "err", err)
+			return
+		}
+		if n < cfg.DeadLetter.MaxAttempts {
+			return
+		}
+	}
+	if !failed {
+		return
+	}
+
+	l := deadletter.New(body)
+	l.ID = id
+	if raw {
+		l.Headers = map[string]string{
+			"Content-Type":     req.Header.Get("Content-Type"),
+			"Content-Encoding": req.Header.Get("Content-Encoding"),
+		}
+	}
+	l.Function = cfg.functionName()
+	l.Status = status
+	l.Reason = cause.Error()
+	l.Attempts = n
+	l.Time = time.Now().UTC()
+
+	tr := traceFrom(ctx)
+	for _, s := range sinks {
+		start := time.Now()
+		err := s.Write(ctx, l)
+		tr.call("dead letter", start, err)
+		if err != nil {
+			slog.Error("dead letter failed", "event", id, "err", err)
+		}
+	}
+}
+
+// countAttempt records a failed attempt and returns the failed attempts of
+// key, including this one. A successful attempt resets the count. The count is
+// not atomic across replicas, so concurrent redeliveries may be counted once.
+func countAttempt(ctx context.Context, cfg *vcConfig, key string, failed bool) (int, error) {
+	s, err := attemptStore(cfg.DeadLetter.Store)
+	if err != nil {
+		return 0, err
+	}
+
+	if !failed {
+		return 0, s.Delete(ctx, key)
+	}
+
+	n := 0
+	v, err := s.Get(ctx, key)
+	switch err {
+	case nil:
+		n, _ = strconv.Atoi(string(v))
+	case store.ErrNotFound:
+	default:
+		return 0, err
+	}
+	n++
+
+	if err := s.Set(ctx, key, []byte(strconv.Itoa(n)), attemptsTTL); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// attemptStore returns the store of failed attempts, which is kept open while
+// its configuration is unchanged. It defaults to the memory of the replica.
+func attemptStore(c store.Config) (store.Store, error) {
+	if c.Type == "" {
+		c.Type = store.TypeMemory
+	}
+
+	attempts.Lock()
+	defer attempts.Unlock()
+
+	if attempts.store != nil && attempts.cfg == c {
+		return attempts.store, nil
+	}
+
+	s, err := store.Open(c)
+	if err != nil {
+		return nil, fmt.Errorf("open attempt store failed: %w", err)
+	}
+
+	if attempts.store != nil {
+		attempts.store.Close()
+	}
+	attempts.cfg, attempts.store = c, s
+
+	return s, nil
+}
+
+// attemptsKey returns the store key of an event, which is its CloudEvent id or,
+// without id, the hash of the body.
+func attemptsKey(id string, body []byte) string {
+	if id == "" {
+		sum := sha256.Sum256(body)
+		id = hex.EncodeToString(sum[:])
+	}
+
+	return "deadletter/attempts/" + id
+}
@@ -0,0 +1,106 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultFollowUpType is the type of follow-up CloudEvents of emit actions
+// without event_type.
+const defaultFollowUpType = "com.vmware.veba.function.remediation.v0"
+
+// followUpData is the data of a follow-up CloudEvent.
+type followUpData struct {
+	Rule    string `json:"rule"`
+	VM      string `json:"vm"`
+	Outcome string `json:"outcome"`
+	// Trigger is the event which caused the follow-up.
+	Trigger struct {
+		ID      string `json:"id"`
+		Type    string `json:"type"`
+		Subject string `json:"subject"`
+	} `json:"trigger"`
+}
+
+// emitFollowUp posts a follow-up CloudEvent of the remediation of ref by r to
+// the [emit] url and returns it. It is linked to the CloudEvent ce, which
+// caused it, by its causality extensions. outcome describes the actions
+// completed before.
+func emitFollowUp(ctx context.Context, cfg *vcConfig, r *rule, a action, ref types.ManagedObjectReference, ce *vevents.CloudEvent, outcome string) (*vevents.CloudEvent, error) {
+	if ce == nil {
+		return nil, errors.New("no cloud event to follow up")
+	}
+	if err := ce.Validate(); err != nil {
+		return nil, err
+	}
+
+	var data followUpData
+	data.Rule = r.Name
+	data.VM = ref.Value
+	data.Outcome = outcome
+	data.Trigger.ID = ce.ID
+	data.Trigger.Type = ce.Type
+	data.Trigger.Subject = ce.Subject
+
+	typ := a.EventType
+	if typ == "" {
+		typ = defaultFollowUpType
+	}
+
+	fu, err := ce.FollowUp("veba/function/"+cfg.functionName(), typ, ce.Subject, data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(fu)
+	if err != nil {
+		return nil, fmt.Errorf("encoding follow-up failed: %w", err)
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Emit.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("creating follow-up request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	// Receivers tracing HTTP requests join the trace of the chain.
+	req.Header.Set("traceparent", fu.TraceParent)
+
+	res, err := clt.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("sending follow-up failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("follow-up rejected: %v", res.Status)
+	}
+
+	slog.Debug("follow-up emitted", "id", fu.ID, "type", fu.Type, "causation", fu.CausationID, "correlation", fu.CorrelationID, "traceparent", fu.TraceParent)
+
+	return fu, nil
+}
+
+// traceChain records the position of the CloudEvent ce in a chain of events,
+// if it was emitted by a function as consequence of another event.
+func traceChain(ctx context.Context, ce *vevents.CloudEvent) {
+	if ce == nil || !ce.Chained() {
+		return
+	}
+
+	traceFrom(ctx).step("event %v was caused by %v, chain %v, trace %v", ce.ID, ce.CausationID, ce.Root(), ce.TraceID())
+	slog.Debug("chained event", "id", ce.ID, "causation", ce.CausationID, "correlation", ce.Root(), "trace", ce.TraceID())
+}
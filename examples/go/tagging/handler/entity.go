@@ -0,0 +1,167 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/props"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// alarmEntity returns the host or cluster of an alarm event ce or nil.
+func alarmEntity(ce *vevents.CloudEvent) *types.ManagedObjectReference {
+	if ce == nil || ce.Kind() != vevents.KindAlarm {
+		return nil
+	}
+
+	alarm, err := ce.Alarm()
+	if err != nil {
+		return nil
+	}
+
+	switch alarm.Entity.Entity.Type {
+	case "HostSystem", "ClusterComputeResource":
+		return &alarm.Entity.Entity
+	default:
+		return nil
+	}
+}
+
+// tagEntity tags all VMs of the host or cluster entity. System VMs are
+// skipped. The properties of all VMs are retrieved in batches instead of one
+// call per VM.
+func tagEntity(ctx context.Context, req handler.Request, cfg *vcConfig, client *vsClient, ce *vevents.CloudEvent, entity types.ManagedObjectReference) (handler.Response, error) {
+	tr := traceFrom(ctx)
+	tr.step("event refers to %v %v", entity.Type, entity.Value)
+
+	var vms []types.ManagedObjectReference
+	err := limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+		vms, err = props.VMs(ctx, client.govmomi.Client, entity)
+		return err
+	})
+	if err == nil {
+		var reasons map[string]string
+		err = limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+			reasons, err = client.systemVMs(ctx, cfg, vms)
+			return err
+		})
+
+		targets := vms[:0:0]
+		for _, vm := range vms {
+			if reasons[vm.Value] == "" {
+				targets = append(targets, vm)
+			}
+		}
+		tr.step("%d VM(s) of %v, %d system VM(s) skipped", len(vms), entity.Value, len(vms)-len(targets))
+		vms = targets
+	}
+	if err == nil && cfg.OptIn.Tag != "" && len(vms) > 0 {
+		var opted map[string]bool
+		err = limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+			opted, err = client.optedIn(ctx, cfg, vms)
+			return err
+		})
+
+		targets := vms[:0:0]
+		for _, vm := range vms {
+			if opted[vm.Value] {
+				targets = append(targets, vm)
+			}
+		}
+		tr.step("%d VM(s) not opted in skipped", len(vms)-len(targets))
+		vms = targets
+	}
+	if err != nil {
+		conn.verify(ctx, client)
+		wrapErr := fmt.Errorf("retrieve VMs of %v failed: %w", entity.Value, err)
+		slog.Debug("retrieve VMs failed", "entity", entity.Value, "err", err)
+
+		return tr.fail(apierror.LookupFailed, wrapErr.Error()), wrapErr
+	}
+
+	// Dry runs, e.g. by cmd/replay, report the decision without acting on it.
+	if strings.EqualFold(req.Header.Get("X-Dry-Run"), "true") {
+		logged, message := cfg.messages(i18n.DryRunEntity, len(vms), entity.Value, cfg.Tag.URN)
+		slog.Info(logged)
+
+		res := tr.skip(i18n.DryRunEntity, message, http.StatusOK)
+		if r := cfg.ruleFor(eventType(ce)); r != nil {
+			res.Header.Set(ruleHeader, r.Name)
+		}
+
+		return res, nil
+	}
+
+	if cfg.observing() {
+		return observeResponse(ctx, tr, cfg, cfg.ruleFor(eventType(ce)), entity, i18n.ObserveEntity, len(vms), entity.Value, cfg.Tag.URN), nil
+	}
+
+	// Expanded entities are scheduled like the VMs of the rule of the event.
+	release, err := schedule(ctx, cfg, cfg.ruleFor(eventType(ce)))
+	if err != nil {
+		return scheduleFailedResponse(tr, cfg, err)
+	}
+	defer release()
+
+	wclient, wconn, err := writer(ctx, cfg, client)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere with write identity failed: %w", err)
+		slog.Debug("connect to vSphere with write identity failed", "err", err)
+
+		return tr.fail(apierror.VSphereUnavailable, wrapErr.Error()), wrapErr
+	}
+
+	var res bulkResult
+	for _, vm := range vms {
+		err := limit(ctx, cfg, opTag, func(ctx context.Context) error {
+			return wclient.applyTag(ctx, cfg, vm, cfg.Tag.URN)
+		})
+		if err == nil {
+			markManaged(ctx, cfg, wclient, vm)
+		}
+		res.add(vm.Value, err)
+	}
+
+	// The response is limited to max_details results, the log has all.
+	slog.Info("tagged VMs of entity", "entity", entity.Value, "tag", cfg.Tag.URN,
+		"tagged", strings.Join(res.done, ","), "failed", len(res.failed), "err", res.err())
+
+	key := i18n.EntityTagged
+	if cfg.detaching() {
+		key = i18n.EntityUntagged
+	}
+	message := cfg.message(key, len(res.done), res.total(), entity.Value, cfg.Tag.URN)
+	if d := res.details(cfg.maxDetails()); d != "" {
+		message += "; " + d
+	}
+
+	if len(res.failed) > 0 {
+		wconn.verify(ctx, wclient)
+		wrapErr := fmt.Errorf("tagging VMs of %v failed: %w", entity.Value, res.err())
+		escalate(ctx, cfg, ce, entity, wrapErr)
+
+		return tr.fail(apierror.ActionFailed, message), wrapErr
+	}
+
+	escalate(ctx, cfg, ce, entity, nil)
+
+	if cfg.Alarm.Acknowledge {
+		if text, err := acknowledge(ctx, cfg, wclient, ce); err != nil {
+			slog.Error("acknowledging alarm failed", "err", err)
+			message += ", " + err.Error()
+		} else if text != "" {
+			message += ", " + text
+		}
+	}
+
+	slog.Info(message)
+
+	return tr.response(message, http.StatusOK), nil
+}
@@ -0,0 +1,138 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/props"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Built-in detection of vSphere system VMs, e.g. the vCLS agent VMs of vSphere
+// 7.0 U1 and later. Tagging or changing these VMs interferes with the cluster
+// services which deploy them.
+var (
+	// systemManagedBy lists extensions deploying system VMs. vCLS VMs are
+	// deployed by the ESX Agent Manager.
+	systemManagedBy = []string{"com.vmware.vim.eam"}
+	// systemNamePatterns matches the names of vCLS VMs, e.g. "vCLS-1a2b" or
+	// "vCLS (1)".
+	systemNamePatterns = []string{`^vCLS-`, `^vCLS \(\d+\)$`}
+	// systemResourcePools lists resource pools holding agent VMs.
+	systemResourcePools = []string{"ESX Agents"}
+)
+
+// systemVMReason returns why vm is excluded as system VM or "" if it is not.
+// pool is the name of the VM's resource pool.
+func systemVMReason(cfg *vcConfig, vm mo.VirtualMachine, pool string) string {
+	if cfg.Exclude.IncludeSystemVMs {
+		return ""
+	}
+
+	if vm.Config != nil && vm.Config.ManagedBy != nil {
+		key := vm.Config.ManagedBy.ExtensionKey
+		for _, k := range append(systemManagedBy, cfg.Exclude.ManagedBy...) {
+			if key == k {
+				return "managed by " + key
+			}
+		}
+	}
+
+	for _, p := range append(systemNamePatterns, cfg.Exclude.NamePatterns...) {
+		// Patterns are validated when the config is loaded.
+		if regexp.MustCompile(p).MatchString(vm.Name) {
+			return "name matches " + p
+		}
+	}
+
+	for _, rp := range append(systemResourcePools, cfg.Exclude.ResourcePools...) {
+		if pool != "" && pool == rp {
+			return "in resource pool " + rp
+		}
+	}
+
+	return ""
+}
+
+// systemVM returns why the VM is excluded from remediation as system VM or ""
+// if the VM may be changed.
+func (clt *vsClient) systemVM(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference) (string, error) {
+	reasons, err := clt.systemVMs(ctx, cfg, []types.ManagedObjectReference{ref})
+	if err != nil {
+		return "", err
+	}
+
+	return reasons[ref.Value], nil
+}
+
+// systemVMs returns why VMs of refs are excluded as system VMs by VM
+// reference value. VMs which may be changed are not included. The properties
+// of all VMs and of their resource pools are retrieved with one call each.
+func (clt *vsClient) systemVMs(ctx context.Context, cfg *vcConfig, refs []types.ManagedObjectReference) (map[string]string, error) {
+	reasons := map[string]string{}
+	if cfg.Exclude.IncludeSystemVMs {
+		return reasons, nil
+	}
+
+	var vmRefs []types.ManagedObjectReference
+	for _, r := range refs {
+		if r.Type == "VirtualMachine" {
+			vmRefs = append(vmRefs, r)
+		}
+	}
+
+	if len(vmRefs) == 0 {
+		return reasons, nil
+	}
+
+	if clt.govmomi == nil {
+		return clt.restSystemVMs(ctx, cfg, vmRefs)
+	}
+
+	var vms []mo.VirtualMachine
+	start := time.Now()
+	err := props.Retrieve(ctx, clt.govmomi.Client, vmRefs, []string{"name", "resourcePool", "config.managedBy"}, &vms)
+	traceFrom(ctx).call("RetrieveProperties(VirtualMachine)", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VM properties failed: %w", err)
+	}
+
+	// Templates have no resource pool.
+	var poolRefs []types.ManagedObjectReference
+	for _, vm := range vms {
+		if vm.ResourcePool != nil {
+			poolRefs = append(poolRefs, *vm.ResourcePool)
+		}
+	}
+
+	pools := map[types.ManagedObjectReference]string{}
+	if len(poolRefs) > 0 {
+		var rps []mo.ResourcePool
+		start = time.Now()
+		err = props.Retrieve(ctx, clt.govmomi.Client, poolRefs, []string{"name"}, &rps)
+		traceFrom(ctx).call("RetrieveProperties(ResourcePool)", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve resource pool properties failed: %w", err)
+		}
+
+		for _, rp := range rps {
+			pools[rp.Self] = rp.Name
+		}
+	}
+
+	for _, vm := range vms {
+		pool := ""
+		if vm.ResourcePool != nil {
+			pool = pools[*vm.ResourcePool]
+		}
+
+		if reason := systemVMReason(cfg, vm, pool); reason != "" {
+			reasons[vm.Self.Value] = reason
+		}
+	}
+
+	return reasons, nil
+}
@@ -0,0 +1,253 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// gcPollInterval is the time between checks whether garbage collection was
+// enabled in vcconfig.toml.
+const gcPollInterval = time.Minute
+
+var gcOnce sync.Once // For collectGarbage() to be started once.
+
+// gcResult lists the orphaned tags of a garbage collection run by name.
+type gcResult struct {
+	deleted []string
+	failed  []error
+}
+
+// collectGarbage removes orphaned tags every [gc] interval_seconds until ctx
+// is done. Like the heartbeat, the config is reloaded before every run, so
+// enabling, disabling or changing the interval does not require a restart.
+func collectGarbage(ctx context.Context, path string) {
+	for {
+		interval := gcPollInterval
+
+		cfg, err := activeCfg(path)
+		if err == nil && cfg.GC.IntervalSeconds > 0 {
+			interval = time.Duration(cfg.GC.IntervalSeconds) * time.Second
+
+			res, err := runGC(ctx, cfg)
+			if err != nil {
+				slog.Error("tag garbage collection failed", "err", err)
+			} else {
+				slog.Info("tag garbage collection completed", "dry_run", cfg.GC.DryRun || cfg.observing(),
+					"deleted", strings.Join(res.deleted, ","), "failed", len(res.failed), "err", errors.Join(res.failed...))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runGC connects to vSphere and deletes the orphaned tags of the configured
+// categories. Tags are deleted with the write identity, if configured.
+func runGC(ctx context.Context, cfg *vcConfig) (*gcResult, error) {
+	client, err := conn.get(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect to vSphere failed: %w", err)
+	}
+
+	orphaned, err := client.orphanedTags(ctx, cfg)
+	if err != nil {
+		conn.verify(ctx, client)
+		return nil, err
+	}
+
+	// Observe mode collects like a dry run.
+	var res gcResult
+	if cfg.GC.DryRun || cfg.observing() {
+		for _, t := range orphaned {
+			res.deleted = append(res.deleted, t.Name)
+		}
+		return &res, nil
+	}
+
+	wclient, wconn, err := writer(ctx, cfg, client)
+	if err != nil {
+		return nil, fmt.Errorf("connect to vSphere with write identity failed: %w", err)
+	}
+
+	m, err := wclient.tagManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orphaned {
+		t := &orphaned[i]
+
+		start := time.Now()
+		err := m.DeleteTag(ctx, t)
+		traceFrom(ctx).call("DeleteTag", start, err)
+		if err != nil {
+			res.failed = append(res.failed, fmt.Errorf("delete tag %v failed: %w", t.Name, err))
+			continue
+		}
+
+		tagsCollected.Add(1)
+		res.deleted = append(res.deleted, t.Name)
+	}
+
+	if len(res.failed) > 0 {
+		wconn.verify(ctx, wclient)
+	}
+
+	return &res, nil
+}
+
+// orphanedTags returns the tags of the configured categories which are
+// attached to no object or only to VMs which no longer exist. Tags referenced
+// by vcconfig.toml are never orphaned. Without SOAP API, the existing VMs are
+// unknown, so only tags attached to no object are returned.
+func (clt *vsClient) orphanedTags(ctx context.Context, cfg *vcConfig) ([]tags.Tag, error) {
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	categories, err := cfg.gcCategories(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	protected := clt.protectedTags(ctx, cfg)
+
+	var vms map[types.ManagedObjectReference]bool
+	if clt.govmomi != nil {
+		vms, err = clt.existingVMs(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var orphaned []tags.Tag
+	for _, category := range categories {
+		start := time.Now()
+		all, err := m.GetTagsForCategory(ctx, category)
+		traceFrom(ctx).call("GetTagsForCategory", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("list tags of category %v failed: %w", category, err)
+		}
+
+		for _, t := range all {
+			if protected[t.ID] {
+				continue
+			}
+
+			start := time.Now()
+			objs, err := m.ListAttachedObjects(ctx, t.ID)
+			traceFrom(ctx).call("ListAttachedObjects", start, err)
+			if err != nil {
+				return nil, fmt.Errorf("list objects of tag %v failed: %w", t.Name, err)
+			}
+
+			if !attachedToLive(objs, vms) {
+				orphaned = append(orphaned, t)
+			}
+		}
+	}
+
+	return orphaned, nil
+}
+
+// attachedToLive reports whether objs contains an object which still exists.
+// Only VMs are checked against vms, other objects and all objects without vms
+// are assumed to exist.
+func attachedToLive(objs []mo.Reference, vms map[types.ManagedObjectReference]bool) bool {
+	for _, o := range objs {
+		ref := o.Reference()
+		if vms == nil || ref.Type != "VirtualMachine" || vms[ref] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// existingVMs returns the references of all VMs of the inventory.
+func (clt *vsClient) existingVMs(ctx context.Context) (map[types.ManagedObjectReference]bool, error) {
+	c := clt.govmomi.Client
+
+	start := time.Now()
+	v, err := view.NewManager(c).CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
+	if err != nil {
+		traceFrom(ctx).call("CreateContainerView", start, err)
+		return nil, fmt.Errorf("list VMs failed: %w", err)
+	}
+	defer v.Destroy(ctx)
+
+	refs, err := v.Find(ctx, []string{"VirtualMachine"}, property.Filter{})
+	traceFrom(ctx).call("FindVMs", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("list VMs failed: %w", err)
+	}
+
+	vms := make(map[types.ManagedObjectReference]bool, len(refs))
+	for _, ref := range refs {
+		vms[ref] = true
+	}
+
+	return vms, nil
+}
+
+// protectedTags returns the ids of the tags referenced by cfg: the [tag] urn,
+// the tags of rules, the opt-in tag and the managed-by tag. An opt-in or
+// managed-by tag which does not exist cannot be collected, so it is no
+// failure.
+func (clt *vsClient) protectedTags(ctx context.Context, cfg *vcConfig) map[string]bool {
+	protected := map[string]bool{cfg.Tag.URN: true}
+
+	for _, r := range cfg.Rules {
+		for _, a := range r.Actions {
+			if a.TagURN != "" {
+				protected[a.TagURN] = true
+			}
+		}
+	}
+
+	if cfg.OptIn.Tag != "" {
+		if id, err := clt.optInTagID(ctx, cfg.OptIn.Tag); err == nil {
+			protected[id] = true
+		}
+	}
+
+	if cfg.ManagedByTag.Enabled {
+		if id, err := clt.managedByTagIDOf(ctx, cfg); err == nil {
+			protected[id] = true
+		}
+	}
+
+	return protected
+}
+
+// gcCategories returns the categories garbage collected, by default the
+// category of the [tag] urn.
+func (cfg *vcConfig) gcCategories(ctx context.Context, m *tags.Manager) ([]string, error) {
+	if len(cfg.GC.Categories) > 0 {
+		return cfg.GC.Categories, nil
+	}
+
+	start := time.Now()
+	t, err := m.GetTag(ctx, cfg.Tag.URN)
+	traceFrom(ctx).call("GetTag", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("category of tag %v not found: %w", cfg.Tag.URN, err)
+	}
+
+	return []string{t.CategoryID}, nil
+}
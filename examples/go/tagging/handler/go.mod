@@ -1,9 +1,27 @@
 module github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler
 
-go 1.13
+go 1.22
 
 require (
-	github.com/openfaas-incubator/go-function-sdk v0.0.0-20191017092257-70701da50a91
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/gomodule/redigo v1.8.2
+	github.com/openfaas/templates-sdk/go-http v0.0.0-20220408082716-5981c545cb03
 	github.com/pelletier/go-toml v1.6.0
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/streadway/amqp v1.0.0
 	github.com/vmware/govmomi v0.22.2
+	go.etcd.io/bbolt v1.3.5
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/google/uuid v0.0.0-20170306145142-6a5e28554805 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
@@ -2,151 +2,583 @@ package function
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"syscall"
+	"time"
 
-	handler "github.com/openfaas-incubator/go-function-sdk"
+	handler "github.com/openfaas/templates-sdk/go-http"
 	"github.com/pelletier/go-toml"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/dump"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/humanize"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/kafka"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/outbound"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/redact"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/store"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
-const cfgPath = "/var/openfaas/secrets/vcconfig"
+const defaultCfgPath = "/var/openfaas/secrets/vcconfig"
 
 // vcConfig represents the toml vcconfig file
 type vcConfig struct {
+	// Mode is remediate, the default, or observe. In observe mode, the
+	// rules only log and notify what they would do, see observing.
+	Mode    string
 	VCenter struct {
 		Server   string
 		User     string
 		Password string
 		Insecure bool
+		// API is "soap", the default, or "rest" to only use the vAPI REST
+		// endpoints, e.g. if the SOAP SDK port is blocked.
+		API string `toml:"api"`
+		// DisableREST never logs in to the REST API, for functions which
+		// do not tag. Otherwise, the REST API is logged in to by the
+		// first tag operation.
+		DisableREST bool `toml:"disable_rest"`
+		// SDKPath is the path of the SOAP SDK, e.g. behind a reverse
+		// proxy, defaults to /sdk. The REST API is always at /rest.
+		SDKPath string `toml:"sdk_path"`
+		// APIVersion pins the version of the SOAP API, e.g. 6.7. Without,
+		// the older of the versions of vCenter and of the client is used.
+		APIVersion string `toml:"api_version"`
+		// Write is the identity used for mutations. If not set, the
+		// identity above is used for reads and mutations.
+		Write struct {
+			User     string
+			Password string
+		}
+		// Identities are further identities by name, which rules use for
+		// their actions instead of the write identity.
+		Identities map[string]credentials
 	}
 	Tag struct {
 		URN    string
 		Action string
 	}
+	Alarm struct {
+		// Acknowledge the triggered alarm after the entity was tagged.
+		Acknowledge bool
+		// ExpandEntities tags all VMs of hosts and clusters of alarm
+		// events without VM.
+		ExpandEntities bool `toml:"expand_entities"`
+		// MaxDetails limits the per-VM results in responses of expanded
+		// entities, the log has all. Defaults to 10.
+		MaxDetails int `toml:"max_details"`
+	}
+	// Rules run a chain of actions on the VM of matching events. Without
+	// rules, VMs are tagged and alarms acknowledged as configured above.
+	Rules   []rule
+	Resolve struct {
+		// Order lists the strategies tried to find the VM of an event:
+		// vm, entity, name and dns. Defaults to vm and entity.
+		Order []string
+	}
+	OptIn struct {
+		// Tag limits remediation to VMs carrying it, themselves or on one
+		// of their folders, e.g. veba:auto-remediate. Without, every VM
+		// which is not excluded is remediated.
+		Tag string
+	} `toml:"optin"`
+	Exclude struct {
+		// IncludeSystemVMs disables the exclusion of vCLS and other system
+		// VMs. The lists below extend the built-in detection.
+		IncludeSystemVMs bool     `toml:"include_system_vms"`
+		NamePatterns     []string `toml:"name_patterns"`
+		ResourcePools    []string `toml:"resource_pools"`
+		ManagedBy        []string `toml:"managed_by"`
+	}
+	Connection struct {
+		// BackoffMaxSeconds caps the exponential backoff between failed
+		// connection attempts.
+		BackoffMaxSeconds int `toml:"backoff_max_seconds"`
+		// VerifyAfterSeconds is the idle time after which the session of
+		// the cached client is verified before it is reused.
+		VerifyAfterSeconds int `toml:"verify_after_seconds"`
+		// QPS limits the requests per second to the vCenter, shared by
+		// all invocations, 0 disables the limit. Burst is the number of
+		// requests which may be sent at once.
+		QPS   float64 `toml:"qps"`
+		Burst int     `toml:"burst"`
+		// BrokerURL is the session broker whose vCenter sessions are
+		// shared instead of logging in, authenticated with BrokerToken.
+		// The [vcenter] credentials are then only required by the
+		// broker itself.
+		BrokerURL   string `toml:"broker_url"`
+		BrokerToken string `toml:"broker_token"`
+	}
+	Scheduler struct {
+		// Workers limits the events acted on at once by this replica, 0
+		// disables the limit. Waiting events are queued by the priority of
+		// their rule, up to QueueSize per priority, defaults to 100.
+		// Rejected events are retried after RetryAfterSeconds plus
+		// jitter, defaults to 10.
+		Workers           int
+		QueueSize         int `toml:"queue_size"`
+		RetryAfterSeconds int `toml:"retry_after_seconds"`
+	}
+	Timeouts struct {
+		// Each limits an operation, so one slow operation cannot consume
+		// the whole invocation. RetrieveSeconds limits the retrieval of
+		// the properties deciding whether to act on a VM, the others the
+		// actions. 0 only limits operations by the invocation.
+		RetrieveSeconds    int `toml:"retrieve_seconds"`
+		TagSeconds         int `toml:"tag_seconds"`
+		ReconfigureSeconds int `toml:"reconfigure_seconds"`
+		NotifySeconds      int `toml:"notify_seconds"`
+	}
+	Event struct {
+		// MaxAgeSeconds skips events created longer ago, 0 disables the
+		// check.
+		MaxAgeSeconds int `toml:"max_age_seconds"`
+	}
+	// Mapping reads the fields of events from other paths, for events
+	// massaged by transformations on their way to the function.
+	Mapping   fieldMapping
+	Heartbeat struct {
+		// URL receives a liveness CloudEvent every IntervalSeconds.
+		URL             string
+		IntervalSeconds int    `toml:"interval_seconds"`
+		Function        string // name of the function, defaults to gotag-fn
+	}
+	Emit struct {
+		// URL receives the follow-up CloudEvents of emit actions, e.g. the
+		// event router webhook of the appliance.
+		URL string
+	}
+	Viewer struct {
+		// URL receives a summary CloudEvent of every event, whether it
+		// was remediated, skipped or failed, e.g. the event viewer
+		// endpoint of the appliance UI.
+		URL string
+	}
+	GC struct {
+		// IntervalSeconds between removals of orphaned tags, tags of the
+		// Categories attached to no object or only to deleted VMs. 0
+		// disables the garbage collection.
+		IntervalSeconds int `toml:"interval_seconds"`
+		// Categories by name or id, defaults to the category of the
+		// [tag] urn.
+		Categories []string
+		// DryRun only logs the orphaned tags.
+		DryRun bool `toml:"dry_run"`
+	} `toml:"gc"`
+	TagRetry struct {
+		// IntervalSeconds between attempts to attach the tags deferred
+		// while the vAPI endpoint was unavailable. With the retry
+		// enabled, tag actions failing for an unavailable endpoint are
+		// queued instead of failing the rule, so the remaining actions
+		// still run. 0 disables the retry.
+		IntervalSeconds int `toml:"interval_seconds"`
+		// Store holds the queue, defaults to the memory of the replica.
+		Store store.Config
+	} `toml:"tag_retry"`
+	ManagedByTag struct {
+		// Enabled attaches the tag veba-<function> of Category to every
+		// object the function changes, so the objects managed by the
+		// function can be found, cleaned up or excluded later. The
+		// function is the [heartbeat] function. Category defaults to
+		// managed-by, the category and the tag are created on first use.
+		Enabled  bool
+		Category string
+	} `toml:"managed_by_tag"`
+	Versions struct {
+		// Keep is the number of recently loaded configs kept for
+		// rollbacks, defaults to defaultKeptVersions.
+		Keep int
+	}
+	Incident struct {
+		// Failed tagging for alarms opens incidents, which are resolved
+		// when the alarm turns green.
+		PagerDutyRoutingKey string `toml:"pagerduty_routing_key"`
+		OpsgenieAPIKey      string `toml:"opsgenie_api_key"`
+		OpsgenieURL         string `toml:"opsgenie_url"`
+	}
+	DeadLetter struct {
+		// Events which are malformed or failed MaxAttempts times are
+		// written to the configured sinks. Up to 1, every failure is
+		// written.
+		MaxAttempts int `toml:"max_attempts"`
+		// Store counts failed attempts by event, defaults to the memory
+		// of the replica.
+		Store      store.Config
+		File       string
+		WebhookURL string `toml:"webhook_url"`
+		S3         struct {
+			Endpoint        string
+			Region          string
+			Bucket          string
+			Prefix          string
+			AccessKeyID     string `toml:"access_key_id"`
+			SecretAccessKey string `toml:"secret_access_key"`
+		}
+		AMQP struct {
+			URL        string
+			Exchange   string
+			RoutingKey string `toml:"routing_key"`
+		}
+	} `toml:"deadletter"`
+	Publish struct {
+		// Kafka receives a result record of every event on ResultsTopic
+		// and an audit record of every action of the rules on
+		// AuditTopic.
+		Kafka        kafka.Config
+		ResultsTopic string `toml:"results_topic"`
+		AuditTopic   string `toml:"audit_topic"`
+	}
+	Auth struct {
+		// Token is required as bearer token in the Authorization header
+		// of requests, e.g. if the function is invoked directly instead of
+		// through the OpenFaaS gateway.
+		Token string
+		// HMACKey is required to sign the body of requests, the signature
+		// is expected in the X-Signature-256 header as sha256=<hex>.
+		HMACKey string `toml:"hmac_key"`
+	}
+	// Outbound configures proxy, CAs and timeout of notification requests.
+	Outbound outbound.Config
+	Notify   struct {
+		// Tagging failures are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+	Messages struct {
+		// Locale of notifications and response messages: en, the default,
+		// de or ja. Logs and errors stay English.
+		Locale string
+	}
 }
 
-// Incoming is a subsection of a Cloud Event.
-type incoming struct {
-	Data types.Event `json:"data,omitempty"`
-}
-
-var (
-	lock   sync.Mutex // Lock protects client.
-	client *vsClient  // Client persists vSphere connection.
-	once   sync.Once  // For handleSignal() to be called once.
+// invoke is handle wrapped with the behavior shared by all invocations.
+// Unauthenticated requests are neither counted nor dead-lettered. A panic is
+// recovered before it is counted and dead-lettered as failure. Credentials are
+// masked in every response.
+var invoke = middleware.Chain(handle,
+	middleware.Redact(redactor),
+	middleware.Logging(),
+	loadConfig,
+	authenticate,
+	middleware.When(isEvent, middleware.Metrics(events)),
+	middleware.When(isEvent, deadLetters),
+	middleware.When(isEvent, publishResults),
+	middleware.When(isEvent, viewResults),
+	middleware.Recover(),
 )
 
 // Handle a function invocation
 func Handle(req handler.Request) (handler.Response, error) {
-	ctx := context.Background()
+	heartbeatOnce.Do(func() {
+		go heartbeat(context.Background(), configPath())
+	})
+	gcOnce.Do(func() {
+		go collectGarbage(context.Background(), configPath())
+	})
+	tagRetryOnce.Do(func() {
+		go reconcileTags(context.Background(), configPath())
+	})
+
+	return invoke(req)
+}
+
+// isEvent reports whether req carries an event. Policy introspection and
+// admin requests are not events.
+func isEvent(req handler.Request) bool {
+	return req.Method != http.MethodGet && !isAdmin(req)
+}
+
+// cfgKey is the context key of the config of an invocation.
+type cfgKey struct{}
+
+// loadedCfg is the config of an invocation, or the error loading it.
+type loadedCfg struct {
+	cfg *vcConfig
+	err error
+}
+
+// loadConfig is a middleware loading the config of an invocation once, so the
+// other middlewares and handle process it with the same config, see
+// requestConfig. A config failing to load is left to handle to fail the
+// invocation.
+func loadConfig(next middleware.Func) middleware.Func {
+	return func(req handler.Request) (handler.Response, error) {
+		cfg, err := configFor(req)
+		req.WithContext(context.WithValue(requestContext(&req), cfgKey{}, loadedCfg{cfg: cfg, err: err}))
+
+		return next(req)
+	}
+}
+
+// requestConfig returns the config loaded for req by loadConfig. Requests
+// which did not pass loadConfig, e.g. in tests, load it.
+func requestConfig(req handler.Request) (*vcConfig, error) {
+	if l, ok := requestContext(&req).Value(cfgKey{}).(loadedCfg); ok {
+		return l.cfg, l.err
+	}
 
+	return configFor(req)
+}
+
+// configFor loads the config in effect for req.
+func configFor(req handler.Request) (*vcConfig, error) {
 	// Load config every time, to ensure the most updated version is used.
-	cfg, err := loadTomlCfg(cfgPath)
+	cfg, err := activeCfg(configPath())
+	// Rolling back must work while vcconfig.toml is broken.
+	if err != nil && isAdmin(req) && latestCfg() != nil {
+		return latestCfg(), nil
+	}
+
+	return cfg, err
+}
+
+// handle processes an event.
+func handle(req handler.Request) (handler.Response, error) {
+	tr := newTrace()
+	ctx := withTrace(requestContext(&req), tr)
+	ctx = dump.WithDumper(ctx, objectDump())
+
+	cfg, err := requestConfig(req)
 	if err != nil {
 		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
-		log.Println(wrapErr.Error())
+		slog.Error("loading of vcconfig failed", "err", err)
 
-		return handler.Response{
-			Body:       []byte(wrapErr.Error()),
-			StatusCode: http.StatusInternalServerError,
-		}, wrapErr
+		return tr.fail(apierror.ConfigInvalid, wrapErr.Error()), wrapErr
 	}
 
-	// Connect to vSphere govmomi API once and persist connection with global variable.
-	err = vsConnect(ctx, cfg)
-	if err != nil {
-		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+	version := policyOf(cfg).Version
+	tr.setVersion(version)
+	tr.step("loaded vcconfig %v, tag %v, action %v", version, cfg.Tag.URN, cfg.Tag.Action)
 
-		if debug() {
-			log.Println(wrapErr)
-		}
+	if isAdmin(req) {
+		return adminResponse(req, cfg)
+	}
 
-		return handler.Response{
-			Body:       []byte(wrapErr.Error()),
-			StatusCode: http.StatusInternalServerError,
-		}, wrapErr
+	// GET requests introspect the policy instead of processing an event.
+	if req.Method == http.MethodGet {
+		return policyResponse(cfg)
 	}
 
-	once.Do(func() {
-		// Set up os signal handling to log out of vSphere.
-		go handleSignal(ctx)
-	})
+	body, err := decodeBody(req)
+	if err != nil {
+		wrapErr := fmt.Errorf("reading request failed: %w", err)
+		slog.Debug("reading request failed", "err", err)
+
+		return tr.fail(bodyErrorCode(err), wrapErr.Error()), wrapErr
+	}
 
-	// Retrieve the Managed Object Reference from the event.
-	moRef, err := parseEventMoRef(req.Body)
+	body, err = cfg.mapFields(body)
 	if err != nil {
-		wrapErr := fmt.Errorf("retrieve managed reference object failed: %w", err)
+		wrapErr := fmt.Errorf("mapping of event fields failed: %w", err)
+		slog.Debug("mapping of event fields failed", "err", err)
 
-		if debug() {
-			log.Println(wrapErr)
-		}
+		return tr.fail(apierror.MappingFailed, wrapErr.Error()), wrapErr
+	}
+
+	// The envelope is decoded once for all decisions. It is not validated,
+	// since rules without events also act on events lacking a subject.
+	ce, err := vevents.Unmarshal(body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of request failed: %w", err)
+		slog.Debug("parsing of request failed", "err", err)
 
-		return handler.Response{
-			Body:       []byte(wrapErr.Error()),
-			StatusCode: http.StatusBadRequest,
-		}, wrapErr
+		return tr.fail(apierror.EventInvalid, wrapErr.Error()), wrapErr
 	}
 
-	err = client.moTag(ctx, *moRef, cfg.Tag.URN)
+	traceChain(ctx, ce)
+	ctx = withEventID(ctx, ce)
+
+	// Events which are skipped whatever the state of their VM do not
+	// connect to vSphere.
+	if res, ok := skipUnconnected(tr, cfg, ce, time.Now()); ok {
+		skippedUnconnected.Add(1)
+		return res, nil
+	}
+
+	// Reuse the shared vSphere connection or (re)connect.
+	client, err := conn.get(ctx, cfg)
 	if err != nil {
-		wrapErr := fmt.Errorf("tagging managed reference object failed: %w", err)
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Debug("connect to vSphere failed", "err", err)
+
+		return tr.fail(apierror.VSphereUnavailable, wrapErr.Error()), wrapErr
+	}
 
-		if debug() {
-			log.Println(wrapErr)
+	// Retrieve the Managed Object Reference of the VM from the event.
+	moRef, err := resolveVMRef(ctx, cfg, client, ce)
+	if errors.Is(err, errNotResolved) && cfg.Alarm.ExpandEntities {
+		if entity := alarmEntity(ce); entity != nil {
+			return tagEntity(ctx, req, cfg, client, ce, *entity)
+		}
+	}
+	if err != nil {
+		wrapErr := fmt.Errorf("retrieve managed reference object failed: %w", err)
+		slog.Debug("retrieve managed reference object failed", "err", err)
+
+		// Events without VM are malformed, failed searches are not.
+		code := apierror.EventInvalid
+		var resolveErr *resolveError
+		if errors.As(err, &resolveErr) {
+			conn.verify(ctx, client)
+			code = apierror.LookupFailed
 		}
 
-		return handler.Response{
-			Body:       []byte(wrapErr.Error()),
-			StatusCode: http.StatusInternalServerError,
-		}, wrapErr
+		return tr.fail(code, wrapErr.Error()), wrapErr
 	}
 
-	message := fmt.Sprintf("%v was tagged with %v", moRef.Value, cfg.Tag.URN)
-	log.Println(message)
+	tr.step("event refers to %v %v", moRef.Type, moRef.Value)
 
-	return handler.Response{
-		Body:       []byte(message),
-		StatusCode: http.StatusOK,
-	}, nil
-}
+	// Events of deleted VMs are retried, but the VM will not come back.
+	if missingVMs.cached(moRef.Value, time.Now()) {
+		vmsNotFound.Add(1)
+		logged, message := cfg.messages(i18n.SkipNotFoundRecently, moRef.Value)
+		slog.Info(logged)
 
-// vsConnect connects to vSphere govmomi API using information from vcconfig.toml.
-func vsConnect(ctx context.Context, cfg *vcConfig) error {
-	lock.Lock()
-	defer lock.Unlock()
+		return tr.skip(i18n.SkipNotFoundRecently, message, statusVMNotFound), nil
+	}
+
+	var reason string
+	err = limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+		reason, err = client.systemVM(ctx, cfg, *moRef)
+		return err
+	})
+	if vmNotFound(err) {
+		return vmNotFoundResponse(cfg, tr, *moRef, err)
+	}
+	if err != nil {
+		conn.verify(ctx, client)
+		wrapErr := fmt.Errorf("system VM detection failed: %w", err)
+		slog.Debug("system VM detection failed", "err", err)
 
-	if client == nil {
-		u := url.URL{
-			Scheme: "https",
-			Host:   cfg.VCenter.Server,
-			Path:   "sdk",
+		return tr.fail(apierror.LookupFailed, wrapErr.Error()), wrapErr
+	}
+
+	if reason != "" {
+		logged, message := cfg.messages(i18n.SkipSystemVM, moRef.Value, reason)
+		slog.Info(logged)
+
+		return tr.skip(i18n.SkipSystemVM, message, http.StatusOK), nil
+	}
+
+	if cfg.OptIn.Tag != "" {
+		var opted map[string]bool
+		err := limit(ctx, cfg, opRetrieve, func(ctx context.Context) (err error) {
+			opted, err = client.optedIn(ctx, cfg, []types.ManagedObjectReference{*moRef})
+			return err
+		})
+		if vmNotFound(err) {
+			return vmNotFoundResponse(cfg, tr, *moRef, err)
 		}
-		u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
-		insecure := cfg.VCenter.Insecure
+		if err != nil {
+			conn.verify(ctx, client)
+			wrapErr := fmt.Errorf("opt-in detection failed: %w", err)
+			slog.Debug("opt-in detection failed", "err", err)
 
-		if debug() {
-			log.Println("connect to vSphere")
+			return tr.fail(apierror.LookupFailed, wrapErr.Error()), wrapErr
 		}
 
-		c, err := newClient(ctx, u, insecure)
-		if err != nil {
-			return fmt.Errorf("connection to vSphere API failed: %w", err)
+		if !opted[moRef.Value] {
+			logged, message := cfg.messages(i18n.SkipNotOptedIn, moRef.Value, cfg.OptIn.Tag)
+			slog.Info(logged)
+
+			return tr.skip(i18n.SkipNotOptedIn, message, http.StatusOK), nil
 		}
+	}
 
-		// Set global variable to persist connection.
-		client = c
+	event := eventType(ce)
+	r := cfg.ruleFor(event)
+	if r == nil {
+		logged, message := cfg.messages(i18n.SkipNoRule, event)
+		slog.Info(logged)
+
+		return tr.skip(i18n.SkipNoRule, message, http.StatusOK), nil
 	}
 
-	return nil
+	// Dry runs, e.g. by cmd/replay, report the decision without acting on it.
+	if strings.EqualFold(req.Header.Get("X-Dry-Run"), "true") {
+		logged, message := cfg.messages(i18n.DryRunRule, r.Name, strings.Join(r.actionTypes(), ", "), moRef.Value)
+		slog.Info(logged)
+
+		res := tr.skip(i18n.DryRunRule, message, http.StatusOK)
+		res.Header.Set(ruleHeader, r.Name)
+
+		return res, nil
+	}
+
+	if cfg.observing() {
+		return observeResponse(ctx, tr, cfg, r, *moRef, i18n.ObserveRule, r.Name, strings.Join(r.actionTypes(), ", "), moRef.Value), nil
+	}
+
+	release, err := schedule(ctx, cfg, r)
+	if err != nil {
+		return scheduleFailedResponse(tr, cfg, err)
+	}
+	defer release()
+
+	wclient, wconn, err := writer(ctx, cfg, client)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere with write identity failed: %w", err)
+		slog.Debug("connect to vSphere with write identity failed", "err", err)
+
+		return tr.fail(apierror.VSphereUnavailable, wrapErr.Error()), wrapErr
+	}
+
+	message, err := runChain(ctx, cfg, r, wclient, *moRef, body, ce)
+	if err != nil {
+		wconn.verify(ctx, wclient)
+		wrapErr := err
+		if message != "" {
+			wrapErr = fmt.Errorf("%v, %w", message, err)
+		}
+		slog.Debug("rule failed", "rule", r.Name, "policy", version, "err", err)
+
+		notifyFailure(ctx, cfg, *moRef, wrapErr)
+		escalate(ctx, cfg, ce, *moRef, wrapErr)
+
+		return tr.fail(apierror.ActionFailed, wrapErr.Error()), wrapErr
+	}
+
+	escalate(ctx, cfg, ce, *moRef, nil)
+	slog.Info(message, "policy", version)
+
+	return tr.response(message, http.StatusOK), nil
+}
+
+// skipUnconnected returns the skip response of an event which is skipped
+// without looking at vSphere: events older than [event] max_age_seconds at
+// now and events matching no rule. Events of alarms of hosts and clusters are
+// not skipped for lack of a rule if their VMs are tagged instead.
+func skipUnconnected(tr *trace, cfg *vcConfig, ce *vevents.CloudEvent, now time.Time) (handler.Response, bool) {
+	// Acting on stale state, e.g. of events redelivered after an outage, may
+	// undo changes made since.
+	if age, ok := eventAge(ce, now); ok && cfg.stale(age) {
+		staleEvents.Add(1)
+		maxAge := time.Duration(cfg.Event.MaxAgeSeconds) * time.Second
+		logged, message := cfg.messages(i18n.SkipStale, humanize.Duration(age), humanize.Duration(maxAge))
+		slog.Info(logged)
+
+		return tr.skip(i18n.SkipStale, message, statusStaleEvent), true
+	}
+
+	event := eventType(ce)
+	if cfg.ruleFor(event) == nil && (!cfg.Alarm.ExpandEntities || alarmEntity(ce) == nil) {
+		logged, message := cfg.messages(i18n.SkipNoRule, event)
+		slog.Info(logged)
+
+		return tr.skip(i18n.SkipNoRule, message, http.StatusOK), true
+	}
+
+	return handler.Response{}, false
 }
 
 func loadTomlCfg(path string) (*vcConfig, error) {
@@ -157,10 +589,17 @@ func loadTomlCfg(path string) (*vcConfig, error) {
 		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
 	}
 
+	// Secrets are mounted as files in the same directory as vcconfig.
+	err = resolveSecretRefs(secret, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve secret references: %w", err)
+	}
+
 	err = secret.Unmarshal(&cfg)
 	if err != nil {
 		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
 	}
+	redactor.SetSecrets(cfg.secrets()...)
 
 	err = validateConfig(cfg)
 	if err != nil {
@@ -173,11 +612,20 @@ func loadTomlCfg(path string) (*vcConfig, error) {
 // ValidateConfig ensures the bare minimum of information is in the config file.
 func validateConfig(cfg vcConfig) error {
 	reqFields := map[string]string{
-		"vcenter server":   cfg.VCenter.Server,
-		"vcenter user":     cfg.VCenter.User,
-		"vcenter password": cfg.VCenter.Password,
-		"tag URN":          cfg.Tag.URN,
-		"tag action":       cfg.Tag.Action,
+		"vcenter server": cfg.VCenter.Server,
+	}
+
+	// Replicas of a session broker share its session instead of logging
+	// in.
+	if cfg.Connection.BrokerURL == "" {
+		reqFields["vcenter user"] = cfg.VCenter.User
+		reqFields["vcenter password"] = cfg.VCenter.Password
+	}
+
+	// Functions without REST API never tag.
+	if !cfg.VCenter.DisableREST {
+		reqFields["tag URN"] = cfg.Tag.URN
+		reqFields["tag action"] = cfg.Tag.Action
 	}
 
 	// Multiple fields may be missing, but err on the first encountered.
@@ -187,9 +635,125 @@ func validateConfig(cfg vcConfig) error {
 		}
 	}
 
+	if err := validateMode(cfg); err != nil {
+		return err
+	}
+
+	if err := validateTagAction(cfg); err != nil {
+		return err
+	}
+
+	if err := validateIdentities(cfg); err != nil {
+		return err
+	}
+
+	if err := validateAPI(cfg); err != nil {
+		return err
+	}
+
+	if err := validateSOAPEndpoint(cfg); err != nil {
+		return err
+	}
+
+	if err := validateBroker(cfg); err != nil {
+		return err
+	}
+
+	if err := validateMessages(cfg); err != nil {
+		return err
+	}
+
+	if err := validateDisableREST(cfg); err != nil {
+		return err
+	}
+
+	if err := validateResolveOrder(cfg.Resolve.Order); err != nil {
+		return err
+	}
+
+	if err := validateRules(cfg); err != nil {
+		return err
+	}
+
+	if err := validateMapping(cfg.Mapping); err != nil {
+		return err
+	}
+
+	if err := validateTimeouts(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Alarm.MaxDetails < 0 {
+		return errors.New("alarm max_details must not be negative")
+	}
+
+	if cfg.GC.IntervalSeconds < 0 {
+		return errors.New("gc interval_seconds must not be negative")
+	}
+
+	if cfg.Versions.Keep < 0 {
+		return errors.New("versions keep must not be negative")
+	}
+
+	if cfg.TagRetry.IntervalSeconds < 0 {
+		return errors.New("tag_retry interval_seconds must not be negative")
+	}
+
+	if cfg.Scheduler.Workers < 0 || cfg.Scheduler.QueueSize < 0 || cfg.Scheduler.RetryAfterSeconds < 0 {
+		return errors.New("scheduler workers, queue_size and retry_after_seconds must not be negative")
+	}
+
+	if d := cfg.DeadLetter; d.S3.Bucket != "" && d.S3.Region == "" {
+		return errors.New("deadletter s3 region is required")
+	}
+
+	if err := validatePublish(cfg); err != nil {
+		return err
+	}
+
+	for _, p := range cfg.Exclude.NamePatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid exclude name pattern %q: %w", p, err)
+		}
+	}
+
 	return nil
 }
 
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(redact.Handler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}), redactor)))
+
+	// self_test checks the config and environment and exits instead of
+	// serving events.
+	if os.Getenv(selfTestEnv) == "true" {
+		os.Exit(runSelfTest())
+	}
+
+	// session_broker shares a vCenter session with the replicas instead of
+	// serving events.
+	if os.Getenv(sessionBrokerEnv) == "true" {
+		os.Exit(runSessionBroker())
+	}
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// configPath returns the path of the vcconfig, which vcconfig_path overrides
+// for running the handler outside of OpenFaaS, e.g. with cmd/devctl.
+func configPath() string {
+	if p := os.Getenv("vcconfig_path"); p != "" {
+		return p
+	}
+
+	return defaultCfgPath
+}
+
 // Debug determines verbose logging
 func debug() bool {
 	verbose := os.Getenv("write_debug")
@@ -201,44 +765,53 @@ func debug() bool {
 	return false
 }
 
-func parseEventMoRef(req []byte) (*types.ManagedObjectReference, error) {
-	var event incoming
-	var moRef types.ManagedObjectReference
+// acknowledge acknowledges the alarm of an alarm event which turned yellow or
+// red, so operators can tell it is already handled by automation. Other events
+// are no failure, there is just nothing to acknowledge. The returned text
+// describes the outcome for the response message.
+func acknowledge(ctx context.Context, cfg *vcConfig, client *vsClient, ce *vevents.CloudEvent) (string, error) {
+	if ce == nil || ce.Kind() != vevents.KindAlarm {
+		return "", nil
+	}
 
-	err := json.Unmarshal(req, &event)
+	alarm, err := ce.Alarm()
 	if err != nil {
-		return nil, fmt.Errorf("parsing of request failed: %w", err)
+		return "", fmt.Errorf("alarm not acknowledged: %w", err)
 	}
 
-	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
-		return nil, errors.New("empty managed reference object")
+	if alarm.Turned(types.ManagedEntityStatusGreen) || alarm.Turned(types.ManagedEntityStatusGray) {
+		traceFrom(ctx).step("alarm %v turned %v, nothing to acknowledge", alarm.Alarm.Name, alarm.To)
+		return "", nil
 	}
 
-	// Fill information in the request into a govmomi type.
-	moRef.Type = event.Data.Vm.Vm.Type
-	moRef.Value = event.Data.Vm.Vm.Value
+	err = client.acknowledgeAlarm(ctx, alarm.Alarm.Alarm, alarm.Entity.Entity)
+	if err != nil {
+		return "", fmt.Errorf("alarm %q not acknowledged: %w", alarm.Alarm.Name, err)
+	}
 
-	return &moRef, nil
+	return cfg.message(i18n.Acknowledged, alarm.Alarm.Name), nil
 }
 
-func handleSignal(ctx context.Context) {
-	var sigCh = make(chan os.Signal, 2)
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	slog.Debug("got signal, log out of vSphere")
 
-	s := <-sigCh
-	verbose := debug()
-
-	if verbose {
-		log.Printf("got signal: %v, log out of vSphere", s)
+	// Connections without client are skipped, each logout is bounded by
+	// logoutTimeout.
+	for _, c := range append([]*connection{conn, writeConn}, identityConnections()...) {
+		c.close("shutdown")
 	}
+}
 
-	err := client.logout(ctx)
-	if verbose {
-		if err != nil {
-			log.Printf("vSphere logout failed: %v", err)
-			return
-		}
-		log.Println("logged out of govmomi and rest APIs")
+// requestContext returns the context of req. Requests which were not received
+// by the template, e.g. in tests, carry none.
+func requestContext(req *handler.Request) context.Context {
+	if ctx := req.Context(); ctx != nil {
+		return ctx
 	}
+
+	return context.Background()
 }
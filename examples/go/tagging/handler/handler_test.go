@@ -1,15 +1,114 @@
 package function
 
 import (
-	"io/ioutil"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/deadletter"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/incident"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/notify"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/redact"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/scheduler"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/simfixtures"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/tagaudit"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 const passMark = "\u2713"
 const failMark = "\u2717"
 
+// newCfg returns the vcConfig expected from the testdata vcconfig files.
+func newCfg(password string, insecure bool, action string) *vcConfig {
+	var cfg vcConfig
+
+	cfg.VCenter.Server = "veba.local.corp"
+	cfg.VCenter.User = "admin@vsphere.local"
+	cfg.VCenter.Password = password
+	cfg.VCenter.Insecure = insecure
+	cfg.Tag.URN = "urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL"
+	cfg.Tag.Action = action
+
+	return &cfg
+}
+
 // TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
 func TestLoadTomlCfg(t *testing.T) {
+	withWriter := newCfg("password1234", false, "attach")
+	withWriter.VCenter.Write.User = "tagger@vsphere.local"
+	withWriter.VCenter.Write.Password = "password5678"
+	withWriter.VCenter.Identities = map[string]credentials{"notifier": {User: "notifier@vsphere.local", Password: "password9012"}}
+	withWriter.Rules = []rule{{
+		Name:     "notify",
+		Identity: "notifier",
+		Actions:  []action{{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.seen": "true"}}},
+	}}
+
+	withRules := newCfg("password1234", false, "attach")
+	withRules.Notify.WebhookURL = "https://hooks.local.corp/tagging"
+	withRules.Scheduler.Workers = 4
+	withRules.Timeouts.TagSeconds = 10
+	withRules.Timeouts.NotifySeconds = 5
+	withRules.Rules = []rule{{
+		Name:     "powered-on",
+		Events:   []string{"VmPoweredOnEvent", "DrsVmPoweredOnEvent"},
+		Priority: "high",
+		Actions: []action{
+			{Type: actionTag},
+			{Type: actionNotify, ContinueOnError: true},
+			{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.tagged": "true"}},
+		},
+	}}
+
+	restOnly := newCfg("password1234", false, "attach")
+	restOnly.VCenter.API = apiREST
+
+	withoutREST := &vcConfig{}
+	withoutREST.VCenter.Server = "veba.local.corp"
+	withoutREST.VCenter.User = "admin@vsphere.local"
+	withoutREST.VCenter.Password = "password1234"
+	withoutREST.VCenter.DisableREST = true
+	withoutREST.Rules = []rule{{
+		Name:    "mark",
+		Actions: []action{{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.seen": "true"}}},
+	}}
+
 	var tests = []struct {
 		testDesc  string
 		cfgPath   string
@@ -20,51 +119,127 @@ func TestLoadTomlCfg(t *testing.T) {
 			"Test that toml file loads correctly",
 			"testdata/vcconfig.toml",
 			false,
-			&vcConfig{
-				struct {
-					Server   string
-					User     string
-					Password string
-					Insecure bool
-				}{
-					"veba.local.corp",
-					"admin@vsphere.local",
-					"password1234",
-					false,
-				},
-				struct {
-					URN    string
-					Action string
-				}{
-					"urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL",
-					"attach",
-				},
-			},
+			newCfg("password1234", false, "attach"),
 		},
 		{
 			"Test that toml file loads, even with more info than needed, and defaults are set",
 			"testdata/vcconfig2.toml",
 			false,
-			&vcConfig{
-				struct {
-					Server   string
-					User     string
-					Password string
-					Insecure bool
-				}{
-					"veba.local.corp",
-					"admin@vsphere.local",
-					"password1234",
-					true,
-				},
-				struct {
-					URN    string
-					Action string
-				}{
-					"urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL",
-					"detach",
-				},
-			},
+			newCfg("password1234", true, "detach"),
+		},
+		{
+			"Test that secretRef values are resolved from secret files",
+			"testdata/vcconfig3.toml",
+			false,
+			newCfg("password5678", false, "attach"),
+		},
+		{
+			"Test that a secretRef to a missing secret results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a write identity and rule identities are loaded",
+			"testdata/vcconfig4.toml",
+			false,
+			withWriter,
+		},
+		{
+			"Test that a write identity without password results in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that rules with action chains, priority and scheduler are loaded",
+			"testdata/vcconfig5.toml",
+			false,
+			withRules,
+		},
+		{
+			"Test that a rule notifying without notify sink results in error",
+			"testdata/vcconfigErr5.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a rule with unknown priority results in error",
+			"testdata/vcconfigErr7.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that the REST only api is loaded",
+			"testdata/vcconfig6.toml",
+			false,
+			restOnly,
+		},
+		{
+			"Test that acknowledging alarms with the REST only api results in error",
+			"testdata/vcconfigErr6.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a config without REST API and tag is loaded",
+			"testdata/vcconfig7.toml",
+			false,
+			withoutREST,
+		},
+		{
+			"Test that tagging without REST API results in error",
+			"testdata/vcconfigErr8.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an advisory comparing with no number results in error",
+			"testdata/vcconfigErr9.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that kafka SASL without password results in error",
+			"testdata/vcconfigErr10.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a categorized tag with an unbalanced placeholder results in error",
+			"testdata/vcconfigErr11.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an sdk_path without leading slash results in error",
+			"testdata/vcconfigErr12.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a tag history keeping no entries results in error",
+			"testdata/vcconfigErr13.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an unsupported messages locale results in error",
+			"testdata/vcconfigErr14.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a rule with unknown identity results in error",
+			"testdata/vcconfigErr15.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an unsupported tag action results in error",
+			"testdata/vcconfigErr16.toml",
+			true,
+			nil,
 		},
 		{
 			"Test that misconfigured toml file ends in error",
@@ -98,7 +273,7 @@ func TestLoadTomlCfg(t *testing.T) {
 				t.Fail()
 			}
 		} else {
-			if *cfg == *tc.want {
+			if reflect.DeepEqual(cfg, tc.want) {
 				t.Logf("got expected: %v. %v", tc.want, passMark)
 			} else {
 				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
@@ -109,9 +284,9 @@ func TestLoadTomlCfg(t *testing.T) {
 	}
 }
 
-// TestParseEventMoRef ensures that managed object reference value and type are
-// obtained by the event json that meets Cloud Event specifications.
-func TestParseEventMoRef(t *testing.T) {
+// TestResolveEventMoRef ensures that managed object reference value and type
+// are obtained by the event json that meets Cloud Event specifications.
+func TestResolveEventMoRef(t *testing.T) {
 	type vm struct {
 		vmType string
 		Value  string
@@ -163,12 +338,13 @@ func TestParseEventMoRef(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Logf("=========== %v ===========", tc.testDesc)
-		body, err := ioutil.ReadFile(tc.jsonPath)
+		body, err := os.ReadFile(tc.jsonPath)
 		if err != nil {
 			t.Fatal("Test failing due to improper test setup.", failMark, err)
 		}
 
-		moRef, err := parseEventMoRef(body)
+		// The default strategies do not call vSphere.
+		moRef, err := resolveVMRef(context.Background(), &vcConfig{}, nil, cloudEvent(t, body))
 		if err != nil {
 			if tc.expectErr {
 				// An error is expected.
@@ -195,3 +371,3160 @@ func TestParseEventMoRef(t *testing.T) {
 		}
 	}
 }
+
+// TestTraceResponse ensures the decision trace is only appended when enabled.
+func TestTraceResponse(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		debug    string
+		trace    string
+		want     bool
+	}{
+		{"Test that trace is appended with debug and response_trace", "true", "true", true},
+		{"Test that trace is not appended without debug", "false", "true", false},
+		{"Test that trace is not appended without response_trace", "true", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		os.Setenv("write_debug", tc.debug)
+		os.Setenv("response_trace", tc.trace)
+
+		tr := newTrace()
+		tr.step("event refers to %v", "vm-1")
+		body := string(tr.response("done", 200).Body)
+
+		if strings.Contains(body, "--- trace ---") == tc.want {
+			t.Logf("got expected trace presence: %v. %v", tc.want, passMark)
+		} else {
+			t.Logf("expected trace presence: %v, got body: %q. %v", tc.want, body, failMark)
+			t.Fail()
+		}
+	}
+
+	os.Unsetenv("write_debug")
+	os.Unsetenv("response_trace")
+}
+
+// TestErrorResponse ensures failed responses carry the error body with the
+// trace as detail, and every code is published in the README.
+func TestErrorResponse(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		debug     string
+		wantTrace bool
+	}{
+		{"Test that the trace is a detail of the error with debug and response_trace", "true", true},
+		{"Test that the error has no details without debug", "false", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		os.Setenv("write_debug", tc.debug)
+		os.Setenv("response_trace", "true")
+
+		tr := newTrace()
+		tr.setVersion("3f1c9a0d5e7b2c48")
+		tr.step("event refers to %v", "vm-1")
+		res := tr.fail(apierror.LookupFailed, "system VM detection failed")
+
+		e, ok := apierror.Parse(res.Body)
+		if ok && res.StatusCode == http.StatusInternalServerError && e.Code == apierror.LookupFailed && e.Retryable &&
+			strings.Contains(e.Details["trace"], "vm-1") == tc.wantTrace && res.Header.Get("X-Policy-Version") == "3f1c9a0d5e7b2c48" {
+			t.Logf("got expected: %s. %v", res.Body, passMark)
+		} else {
+			t.Logf("expected a %v error, trace %v, got: %d %s %v. %v", apierror.LookupFailed, tc.wantTrace, res.StatusCode, res.Body, res.Header, failMark)
+			t.Fail()
+		}
+	}
+
+	os.Unsetenv("write_debug")
+	os.Unsetenv("response_trace")
+
+	t.Log("=========== Test that every error code is published in the README ===========")
+	readme, err := os.ReadFile("../README.MD")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	for _, i := range apierror.Codes() {
+		if !strings.Contains(string(readme), fmt.Sprintf("| `%v` | %d |", i.Code, i.Status)) {
+			t.Fatalf("expected %v with status %d in the README. %v", i.Code, i.Status, failMark)
+		}
+	}
+	t.Logf("got expected: all codes published. %v", passMark)
+}
+
+// TestDecodeBody ensures compressed bodies are decoded and unsupported content
+// is rejected with the matching status.
+func TestDecodeBody(t *testing.T) {
+	event, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(event)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(event)
+	zw.Close()
+
+	// Bombs expand from a few KB to more than maxBodySize. Inside a gzip
+	// encoding, the stored deflate data expands past maxBodySize already.
+	var bomb, zlBomb, stored, layeredBomb bytes.Buffer
+	gw = gzip.NewWriter(&bomb)
+	gw.Write(bytes.Repeat([]byte(" "), 4*maxBodySize))
+	gw.Close()
+	zw = zlib.NewWriter(&zlBomb)
+	zw.Write(bytes.Repeat([]byte(" "), 4*maxBodySize))
+	zw.Close()
+	zw, _ = zlib.NewWriterLevel(&stored, zlib.NoCompression)
+	zw.Write(bytes.Repeat([]byte(" "), maxBodySize))
+	zw.Close()
+	gw = gzip.NewWriter(&layeredBomb)
+	gw.Write(stored.Bytes())
+	gw.Close()
+
+	var tests = []struct {
+		testDesc string
+		header   http.Header
+		body     []byte
+		status   int // 0 means no error is expected
+	}{
+		{
+			"Test that plain JSON with charset is accepted",
+			http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+			event,
+			0,
+		},
+		{
+			"Test that gzip encoded body is decoded",
+			http.Header{"Content-Encoding": {"gzip"}},
+			gz.Bytes(),
+			0,
+		},
+		{
+			"Test that pooled gzip reader decodes another body",
+			http.Header{"Content-Encoding": {"x-gzip"}},
+			gz.Bytes(),
+			0,
+		},
+		{
+			"Test that deflate encoded body is decoded",
+			http.Header{"Content-Encoding": {"deflate"}},
+			zl.Bytes(),
+			0,
+		},
+		{
+			"Test that non UTF-8 charset is rejected",
+			http.Header{"Content-Type": {"application/json; charset=ISO-8859-1"}},
+			event,
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			"Test that unknown content encoding is rejected",
+			http.Header{"Content-Encoding": {"br"}},
+			event,
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			"Test that oversized body is rejected",
+			http.Header{},
+			bytes.Repeat([]byte(" "), maxBodySize+1),
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"Test that a gzip bomb expanding past the limit is rejected",
+			http.Header{"Content-Encoding": {"gzip"}},
+			bomb.Bytes(),
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"Test that a deflate bomb expanding past the limit is rejected",
+			http.Header{"Content-Encoding": {"deflate"}},
+			zlBomb.Bytes(),
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"Test that deflate data decoded past the limit is rejected, not cut off",
+			http.Header{"Content-Encoding": {"deflate, gzip"}},
+			layeredBomb.Bytes(),
+			http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := decodeBody(handler.Request{Header: tc.header, Body: tc.body})
+		if err != nil {
+			if status := apierror.Lookup(bodyErrorCode(err)).Status; status == tc.status {
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Logf("expected status %d, got %d: %v. %v", tc.status, status, err, failMark)
+				t.Fail()
+			}
+			continue
+		}
+
+		if tc.status == 0 && bytes.Equal(body, event) {
+			t.Logf("got expected decoded body. %v", passMark)
+		} else {
+			t.Logf("expected status %d, got decoded body %q. %v", tc.status, body, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestDecodePaths ensures only the values at the paths of an event are
+// decoded, as json.Unmarshal would decode them.
+func TestDecodePaths(t *testing.T) {
+	event := `{"subject":"AlarmStatusChangedEvent","data":{"Key":42,"Alarm":{"Name":"cpu-high","Alarm":{"Value":"alarm-1"}},"Arguments":[{"Key":"a"},{"Key":"b"},{"Key":"c"}],"Big":[1,2,3]}}`
+
+	var tests = []struct {
+		testDesc  string
+		body      string
+		paths     []string
+		want      string
+		expectErr bool
+	}{
+		{"Test that a nested field is kept", event, []string{"data.Alarm.Name"}, `{"data":{"Alarm":{"Name":"cpu-high"}}}`, false},
+		{"Test that a shorter path keeps the whole value", event, []string{"data.Alarm.Name", "data.Alarm"}, `{"data":{"Alarm":{"Alarm":{"Value":"alarm-1"},"Name":"cpu-high"}}}`, false},
+		{"Test that array elements are kept by index", event, []string{"data.Arguments.1.Key", "subject"}, `{"data":{"Arguments":[null,{"Key":"b"}]},"subject":"AlarmStatusChangedEvent"}`, false},
+		{"Test that numbers are kept as they are", event, []string{"data.Key"}, `{"data":{"Key":42}}`, false},
+		{"Test that missing paths are skipped", event, []string{"data.Vm.Name"}, `{"data":{}}`, false},
+		{"Test that no paths validate the event", event, nil, `{}`, false},
+		{"Test that a malformed event is an error", `{"data":{"Big":[1,2}}`, nil, "", true},
+		{"Test that trailing data is an error", `{} {}`, nil, "", true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		v, err := decodePaths(strings.NewReader(tc.body), tc.paths)
+		if err != nil {
+			if tc.expectErr {
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Logf("expected no error, got: %v. %v", err, failMark)
+				t.Fail()
+			}
+			continue
+		}
+
+		got, _ := json.Marshal(v)
+		if !tc.expectErr && string(got) == tc.want {
+			t.Logf("got expected: %s. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %s. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// largeEvent returns the event of testdata with n device changes added, as
+// a reconfigure of a VM with many disks would carry.
+func largeEvent(tb testing.TB, n int) []byte {
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		tb.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		tb.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	changes := make([]interface{}, n)
+	for i := range changes {
+		changes[i] = map[string]interface{}{
+			"Operation": "add",
+			"Device":    map[string]interface{}{"Key": 2000 + i, "Label": fmt.Sprintf("Hard disk %d", i+1), "CapacityInKB": 16777216},
+		}
+	}
+	event["data"].(map[string]interface{})["ConfigSpec"] = map[string]interface{}{"DeviceChange": changes}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		tb.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	return b
+}
+
+// BenchmarkDecodeBody compares decoding request bodies with the pooled
+// buffers and gzip readers to reading them with a new reader and io.ReadAll.
+// At 1k events/sec, the allocated bytes per op times 1000 is the allocation
+// rate of the function for bodies only.
+func BenchmarkDecodeBody(b *testing.B) {
+	event := largeEvent(b, 200)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(event)
+	gw.Close()
+
+	plain := handler.Request{Header: http.Header{}, Body: event}
+	gzipped := handler.Request{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: gz.Bytes()}
+
+	readAll := func(req handler.Request) ([]byte, error) {
+		var r io.Reader = bytes.NewReader(req.Body)
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			r = zr
+		}
+		return io.ReadAll(io.LimitReader(r, maxBodySize+1))
+	}
+
+	for _, bc := range []struct {
+		name   string
+		req    handler.Request
+		decode func(handler.Request) ([]byte, error)
+	}{
+		{"plain/readall", plain, readAll},
+		{"plain/pooled", plain, decodeBody},
+		{"gzip/readall", gzipped, readAll},
+		{"gzip/pooled", gzipped, decodeBody},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(event)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := bc.decode(bc.req); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkDecodeEvent compares decoding the whole event for the placeholders
+// of categorized tags to decoding only their paths.
+func BenchmarkDecodeEvent(b *testing.B) {
+	event := largeEvent(b, 2000)
+	paths := []string{"data.Vm.Name", "data.Host.Name"}
+
+	for _, bc := range []struct {
+		name   string
+		decode func() (interface{}, error)
+	}{
+		{"full", func() (interface{}, error) {
+			var v interface{}
+			dec := json.NewDecoder(bytes.NewReader(event))
+			dec.UseNumber()
+			err := dec.Decode(&v)
+			return v, err
+		}},
+		{"paths", func() (interface{}, error) {
+			return decodePaths(bytes.NewReader(event), paths)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(event)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := bc.decode(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestSystemVMReason ensures vCLS and other system VMs are detected by name,
+// resource pool and managing extension.
+func TestSystemVMReason(t *testing.T) {
+	vm := func(name, managedBy string) mo.VirtualMachine {
+		v := mo.VirtualMachine{ManagedEntity: mo.ManagedEntity{Name: name}}
+		if managedBy != "" {
+			v.Config = &types.VirtualMachineConfigInfo{ManagedBy: &types.ManagedByInfo{ExtensionKey: managedBy}}
+		}
+		return v
+	}
+
+	cfg := newCfg("password1234", false, "attach")
+	custom := newCfg("password1234", false, "attach")
+	custom.Exclude.NamePatterns = []string{`^infra-`}
+	optOut := newCfg("password1234", false, "attach")
+	optOut.Exclude.IncludeSystemVMs = true
+
+	var tests = []struct {
+		testDesc string
+		cfg      *vcConfig
+		vm       mo.VirtualMachine
+		pool     string
+		excluded bool
+	}{
+		{"Test that vCLS VM is excluded by name", cfg, vm("vCLS-8a3f2c1e", ""), "Resources", true},
+		{"Test that vCLS VM is excluded by ESX Agent Manager", cfg, vm("agent", "com.vmware.vim.eam"), "Resources", true},
+		{"Test that VM in ESX Agents pool is excluded", cfg, vm("agent", ""), "ESX Agents", true},
+		{"Test that regular VM is not excluded", cfg, vm("web-01", ""), "Resources", false},
+		{"Test that configured name pattern excludes VM", custom, vm("infra-dns", ""), "Resources", true},
+		{"Test that system VMs are included when opted out", optOut, vm("vCLS-8a3f2c1e", ""), "ESX Agents", false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		reason := systemVMReason(tc.cfg, tc.vm, tc.pool)
+		if (reason != "") == tc.excluded {
+			t.Logf("got expected exclusion %v (%v). %v", tc.excluded, reason, passMark)
+		} else {
+			t.Logf("expected exclusion %v, got reason %q. %v", tc.excluded, reason, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestConnectionBackoff ensures failed connection attempts are not cached and
+// are retried only after the backoff expired.
+func TestConnectionBackoff(t *testing.T) {
+	var dials int
+	fail := true
+	c := &connection{dial: func(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+		dials++
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return &vsClient{}, nil
+	}}
+
+	cfg := newCfg("password1234", false, "attach")
+	ctx := context.Background()
+
+	t.Logf("=========== %v ===========", "Test that a failed attempt returns the error")
+	if _, err := c.get(ctx, cfg); err != nil && dials == 1 {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Fatalf("expected error after 1 dial, got %v after %d dials. %v", err, dials, failMark)
+	}
+
+	t.Logf("=========== %v ===========", "Test that invocations fail fast during backoff")
+	fail = false
+	if _, err := c.get(ctx, cfg); err != nil && dials == 1 {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Fatalf("expected backoff error without dial, got %v after %d dials. %v", err, dials, failMark)
+	}
+
+	t.Logf("=========== %v ===========", "Test that connection is retried after backoff")
+	c.retryAt = time.Now().Add(-time.Second)
+	if clt, err := c.get(ctx, cfg); err == nil && clt != nil && c.failures == 0 {
+		t.Logf("got expected client after %d dials. %v", dials, passMark)
+	} else {
+		t.Fatalf("expected client, got %v. %v", err, failMark)
+	}
+
+	t.Logf("=========== %v ===========", "Test that backoff grows exponentially up to the maximum")
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := backoff(i+1, 10*time.Second); got != w {
+			t.Logf("expected backoff %v after %d failures, got %v. %v", w, i+1, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestConnectionCancel shows a request cancelled while connecting neither
+// aborts the login nor backs off the connection, so the next request gets the
+// client.
+func TestConnectionCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var dials int
+	var dialErr error
+	c := &connection{dial: func(dctx context.Context, cfg *vcConfig) (*vsClient, error) {
+		dials++
+		// The request goes away during the login.
+		cancel()
+		select {
+		case <-dctx.Done():
+			dialErr = dctx.Err()
+			return nil, dialErr
+		case <-time.After(50 * time.Millisecond):
+		}
+		return &vsClient{}, nil
+	}}
+
+	cfg := newCfg("password1234", false, "attach")
+
+	t.Log("=========== Test that the cancelled request gets its error ===========")
+	if _, err := c.get(ctx, cfg); errors.Is(err, context.Canceled) {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Fatalf("expected %v, got: %v. %v", context.Canceled, err, failMark)
+	}
+
+	t.Log("=========== Test that the login completes and is not backed off ===========")
+	if dialErr == nil && c.client != nil && c.failures == 0 && c.retryAt.IsZero() {
+		t.Logf("got expected: connected. %v", passMark)
+	} else {
+		t.Fatalf("expected connection, got: %v after %d failures. %v", dialErr, c.failures, failMark)
+	}
+
+	t.Log("=========== Test that the next request reuses the client ===========")
+	if clt, err := c.get(context.Background(), cfg); err == nil && clt == c.client && dials == 1 {
+		t.Logf("got expected client after %d dial. %v", dials, passMark)
+	} else {
+		t.Fatalf("expected client after 1 dial, got: %v after %d dials. %v", err, dials, failMark)
+	}
+}
+
+// TestConnectionClose ensures closing logs out of the session of the connected
+// client and is safe without connection or client.
+func TestConnectionClose(t *testing.T) {
+	t.Log("=========== Test that closing without connection or client does not panic ===========")
+	var none *connection
+	none.close("shutdown")
+	(&connection{}).close("shutdown")
+	c := &connection{client: &vsClient{}}
+	c.close("shutdown")
+	if c.client != nil {
+		t.Fatalf("expected client to be dropped. %v", failMark)
+	}
+	t.Logf("got expected: no panic. %v", passMark)
+
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		t.Log("=========== Test that closing logs out of the session ===========")
+		u := *vc.URL()
+		u.User = simulator.DefaultLogin
+
+		clt, err := newClient(ctx, u, true, false, "")
+		if err == nil {
+			_, err = clt.restClient(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if clt.session == "" {
+			t.Fatalf("expected session key of the new client. %v", failMark)
+		}
+
+		c := &connection{client: clt}
+		c.close("shutdown")
+		if c.client == nil && !clt.active(ctx) {
+			t.Logf("got expected: session %v terminated. %v", clt.session, passMark)
+		} else {
+			t.Logf("expected session %v to be terminated. %v", clt.session, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestNegotiate shows the API version is the older of vCenter and client,
+// unless pinned to a version vCenter serves.
+func TestNegotiate(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		server    string
+		pinned    string
+		expectErr bool
+		want      string
+	}{
+		{"Test that an older vCenter gets its own version", "6.5", "", false, "6.5"},
+		{"Test that a newer vCenter gets the version of the client", "8.0.2.0", "", false, vim25.Version},
+		{"Test that versions are compared numerically", "6.10", "", false, vim25.Version},
+		{"Test that a pinned version served by vCenter is used", "6.5", "6.0", false, "6.0"},
+		{"Test that a pinned version newer than vCenter results in error", "6.5", "7.0", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := negotiate(tc.server, tc.pinned)
+		if err != nil {
+			if tc.expectErr {
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		u := *vc.URL()
+		u.User = simulator.DefaultLogin
+
+		t.Log("=========== Test that the client logs in with the negotiated version ===========")
+		clt, err := newClient(ctx, u, true, true, "")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		defer clt.logout(ctx)
+
+		server := vc.ServiceContent.About.ApiVersion
+		if clt.apiVersion == server && clt.govmomi.Client.Version == server && clt.active(ctx) {
+			t.Logf("got expected: %v. %v", clt.apiVersion, passMark)
+		} else {
+			t.Logf("expected active session with version %v, got: %v. %v", server, clt.apiVersion, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a pinned version vCenter does not serve results in error ===========")
+		if _, err := newClient(ctx, u, true, true, "99.0"); err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected an error for api_version 99.0. %v", failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestLazyREST ensures the REST API is only logged in to by the first tag
+// operation, never if it is disabled, and again once its session was lost.
+func TestLazyREST(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		u := *vc.URL()
+		u.User = simulator.DefaultLogin
+
+		var tests = []struct {
+			testDesc    string
+			disableREST bool
+			expectErr   bool
+		}{
+			{"Test that the first tag operation logs in to the REST API", false, false},
+			{"Test that tag operations fail with the REST API disabled", true, true},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			clt, err := newClient(ctx, u, true, tc.disableREST, "")
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			if clt.restLoggedIn() || !clt.active(ctx) {
+				t.Logf("expected an active client without REST session. %v", failMark)
+				t.Fail()
+			}
+
+			_, err = clt.tagManager(ctx)
+			switch {
+			case tc.expectErr && errors.Is(err, errRESTDisabled) && !clt.restLoggedIn():
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			case !tc.expectErr && err == nil && clt.restLoggedIn() && clt.active(ctx):
+				t.Logf("got expected: logged in. %v", passMark)
+			default:
+				t.Logf("expected error %v, got: %v, logged in %v. %v", tc.expectErr, err, clt.restLoggedIn(), failMark)
+				t.Fail()
+			}
+
+			if err := clt.logout(ctx); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that a lost REST session is renewed without the SOAP session ===========")
+		clt, err := newClient(ctx, u, true, false, "")
+		if err == nil {
+			_, err = clt.restClient(ctx)
+		}
+		if err == nil {
+			err = clt.rest.Logout(ctx)
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		c := &connection{client: clt}
+		c.verify(ctx, clt)
+		dropped := !clt.restLoggedIn()
+
+		_, err = clt.tagManager(ctx)
+		if c.client == clt && dropped && err == nil && clt.restLoggedIn() {
+			t.Logf("got expected: logged in again, SOAP session %v kept. %v", clt.session, passMark)
+		} else {
+			t.Logf("expected the client kept and a new REST session, got: kept %v, dropped %v, %v. %v", c.client == clt, dropped, err, failMark)
+			t.Fail()
+		}
+		c.close("shutdown")
+	})
+}
+
+// TestAuthenticate ensures requests are checked against the configured token
+// and body signature and pass without any configured.
+func TestAuthenticate(t *testing.T) {
+	body := []byte(`{"id":"event-1"}`)
+	token := http.Header{"Authorization": []string{"Bearer s3cret"}}
+	signed := http.Header{middleware.SignatureHeader: []string{middleware.Sign([]byte("k3y"), body)}}
+	both := http.Header{"Authorization": token["Authorization"], middleware.SignatureHeader: signed[middleware.SignatureHeader]}
+
+	var tests = []struct {
+		testDesc  string
+		token     string
+		key       string
+		header    http.Header
+		expectErr bool
+	}{
+		{"Test that requests pass without checks configured", "", "", nil, false},
+		{"Test that a request with token passes", "s3cret", "", token, false},
+		{"Test that a request without token is rejected", "s3cret", "", signed, true},
+		{"Test that a signed request passes", "", "k3y", signed, false},
+		{"Test that a request without signature is rejected", "", "k3y", token, true},
+		{"Test that a request with token and signature passes both checks", "s3cret", "k3y", both, false},
+		{"Test that a signed request without token is rejected if both are configured", "s3cret", "k3y", signed, true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg := newCfg("password1234", false, "attach")
+		cfg.Auth.Token = tc.token
+		cfg.Auth.HMACKey = tc.key
+
+		err := cfg.authenticate(handler.Request{Body: body, Header: tc.header})
+		if (err != nil) == tc.expectErr {
+			t.Logf("got expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected error: %v, got: %v. %v", tc.expectErr, err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestMapFields ensures mapped fields of massaged events are found where the
+// function expects them and events without the mapped paths are unchanged.
+func TestMapFields(t *testing.T) {
+	massaged, err := os.ReadFile("testdata/eventMapped.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	standard, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	mapping := fieldMapping{Event: "data.kind", VM: "data.targets.0.id", Alarm: "data.alarm.name", Status: "data.alarm.to"}
+
+	var tests = []struct {
+		testDesc  string
+		mapping   fieldMapping
+		body      []byte
+		expectErr bool
+		subject   string
+		vm        string
+	}{
+		{"Test that mapped fields of a massaged event are copied", mapping, massaged, false, "AlarmStatusChangedEvent", "vm-10000"},
+		{"Test that a standard event is unchanged", mapping, standard, false, "VmPoweredOffEvent", "vm-10000"},
+		{"Test that events are unchanged without mapping", fieldMapping{}, standard, false, "VmPoweredOffEvent", "vm-10000"},
+		{"Test that a mapped object results in error", fieldMapping{VM: "data.alarm"}, massaged, true, "", ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg := newCfg("password1234", false, "attach")
+		cfg.Mapping = tc.mapping
+
+		body, err := cfg.mapFields(tc.body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		ce := cloudEvent(t, body)
+		ref, err := resolveVMRef(context.Background(), cfg, nil, ce)
+		if err == nil && eventType(ce) == tc.subject && ref.Value == tc.vm && !tc.expectErr {
+			t.Logf("got expected: %v of %v. %v", tc.subject, ref.Value, passMark)
+		} else {
+			t.Logf("expected: %v of %v, got: %v of %v (%v). %v", tc.subject, tc.vm, eventType(ce), ref, err, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the mapped alarm name and status are read ===========")
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Mapping = mapping
+	body, err := cfg.mapFields(massaged)
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	var ev struct {
+		Data struct {
+			Alarm struct{ Name string }
+			To    string
+		}
+	}
+	if err := json.Unmarshal(body, &ev); err == nil && ev.Data.Alarm.Name == "VM CPU Usage" && ev.Data.To == "red" {
+		t.Logf("got expected: %+v. %v", ev.Data, passMark)
+	} else {
+		t.Logf("expected alarm VM CPU Usage turned red, got: %+v (%v). %v", ev.Data, err, failMark)
+		t.Fail()
+	}
+}
+
+// TestMissingVMs ensures lookups of deleted VMs are detected and cached with
+// a lifetime doubling with every failed lookup.
+func TestMissingVMs(t *testing.T) {
+	c := newMissingCache()
+	now := time.Date(2020, 6, 8, 14, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		testDesc string
+		after    time.Duration
+		want     time.Duration
+	}{
+		{"Test that the first failed lookup is cached briefly", 0, 30 * time.Second},
+		{"Test that the next failed lookup doubles the lifetime", time.Minute, time.Minute},
+		{"Test that the lifetime keeps doubling", 3 * time.Minute, 2 * time.Minute},
+		{"Test that the lifetime doubles again", 6 * time.Minute, 4 * time.Minute},
+		{"Test that the lifetime doubles once more", 11 * time.Minute, 8 * time.Minute},
+		{"Test that the lifetime is capped", 20 * time.Minute, 10 * time.Minute},
+		{"Test that a VM not looked up for long starts over", 2 * time.Hour, 30 * time.Second},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := c.add("vm-42", now.Add(tc.after))
+		if got == tc.want && c.cached("vm-42", now.Add(tc.after)) && !c.cached("vm-42", now.Add(tc.after+got)) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		client := &vsClient{govmomi: &govmomi.Client{Client: vc}}
+		cfg := newCfg("password1234", false, "attach")
+
+		t.Log("=========== Test that the lookup of a deleted VM is detected ===========")
+		_, err := client.systemVM(ctx, cfg, types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-deleted"})
+		if vmNotFound(err) {
+			t.Logf("got expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected a not found error, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that other errors are not taken for deleted VMs ===========")
+		if err := errors.New("connection refused"); !vmNotFound(err) {
+			t.Logf("got expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected %v not to be a not found error. %v", err, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestWriteIdentity ensures mutations use the write identity only when it is
+// configured.
+func TestWriteIdentity(t *testing.T) {
+	cfg := newCfg("password1234", false, "attach")
+
+	t.Log("=========== Test that no write identity is used by default ===========")
+	if w := cfg.writeIdentity(); w != nil {
+		t.Fatalf("expected no write identity, got: %v. %v", w.VCenter.User, failMark)
+	}
+	t.Logf("got expected: no write identity. %v", passMark)
+
+	t.Log("=========== Test that the write identity replaces the credentials ===========")
+	cfg.VCenter.Write.User = "tagger@vsphere.local"
+	cfg.VCenter.Write.Password = "password5678"
+	w := cfg.writeIdentity()
+	if w == nil || w.VCenter.User != "tagger@vsphere.local" || w.VCenter.Password != "password5678" || w.VCenter.Server != cfg.VCenter.Server {
+		t.Fatalf("expected write credentials, got: %+v. %v", w, failMark)
+	}
+	if cfg.VCenter.User != "admin@vsphere.local" {
+		t.Fatalf("expected read identity to be unchanged, got: %v. %v", cfg.VCenter.User, failMark)
+	}
+	t.Logf("got expected: %v. %v", w.VCenter.User, passMark)
+}
+
+// TestRuleIdentity shows the actions of rules run as their identity and
+// rules without identity use the client of the event.
+func TestRuleIdentity(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		var dialed []string
+		dial := identities.dial
+		identities.dial = func(_ context.Context, cfg *vcConfig) (*vsClient, error) {
+			dialed = append(dialed, cfg.VCenter.User)
+			return &vsClient{govmomi: &govmomi.Client{Client: c}}, nil
+		}
+		defer func() {
+			identities.dial = dial
+			identities.conns = map[string]*connection{}
+		}()
+
+		cfg := newCfg("password1234", false, "attach")
+		cfg.VCenter.Identities = map[string]credentials{
+			"notifier": {User: "notifier@vsphere.local", Password: "password5678"},
+			"operator": {User: "operator@vsphere.local", Password: "password9012"},
+		}
+
+		reconfigure := action{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.tagged": "true"}}
+		var tests = []struct {
+			testDesc string
+			rule     rule
+			want     []string
+		}{
+			{"Test that a rule without identity uses the client of the event", rule{Name: "default"}, nil},
+			{"Test that a rule acts as its identity", rule{Name: "notify", Identity: "notifier"}, []string{"notifier@vsphere.local"}},
+			{"Test that another rule acts as another identity", rule{Name: "operate", Identity: "operator"}, []string{"notifier@vsphere.local", "operator@vsphere.local"}},
+			{"Test that the connection of an identity is reused", rule{Name: "notify", Identity: "notifier"}, []string{"notifier@vsphere.local", "operator@vsphere.local"}},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			_, err := runAction(ctx, cfg, &tc.rule, reconfigure, client, vm.Self, nil, nil, nil)
+			if err == nil && reflect.DeepEqual(dialed, tc.want) {
+				t.Logf("got expected: %v. %v", dialed, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v, %v. %v", tc.want, dialed, err, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that the audit record names the identity of the rule ===========")
+		if got := cfg.identityUser(&rule{Identity: "operator"}); got != "operator@vsphere.local" {
+			t.Fatalf("expected: operator@vsphere.local, got: %v. %v", got, failMark)
+		}
+		if got := cfg.identityUser(&rule{}); got != cfg.VCenter.User {
+			t.Fatalf("expected: %v, got: %v. %v", cfg.VCenter.User, got, failMark)
+		}
+		t.Logf("got expected identities. %v", passMark)
+	})
+}
+
+// TestRedactIdentities ensures the passwords of the identities of rules are
+// masked in the logs once the config is loaded.
+func TestRedactIdentities(t *testing.T) {
+	if _, err := loadTomlCfg("testdata/vcconfig4.toml"); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer redactor.SetSecrets()
+
+	var out bytes.Buffer
+	logger := slog.New(redact.Handler(slog.NewTextHandler(&out, nil), redactor))
+
+	t.Log("=========== Test that the password of an identity is masked ===========")
+	logger.Error("login failed", "err", errors.New("rejected notifier@vsphere.local with password9012"))
+	if got := out.String(); !strings.Contains(got, redact.Mask) || strings.Contains(got, "password9012") {
+		t.Fatalf("expected masked password, got: %v. %v", got, failMark)
+	}
+	t.Logf("got expected: %v. %v", strings.TrimSpace(out.String()), passMark)
+}
+
+// TestEventAge ensures events older than the configured max age are stale and
+// the age is taken from the vCenter creation time.
+func TestEventAge(t *testing.T) {
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	created := time.Date(2020, 3, 13, 21, 9, 40, 984999000, time.UTC)
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Event.MaxAgeSeconds = 600
+	unlimited := newCfg("password1234", false, "attach")
+
+	var tests = []struct {
+		testDesc string
+		cfg      *vcConfig
+		now      time.Time
+		want     bool
+	}{
+		{"Test that a recent event is not stale", cfg, created.Add(time.Minute), false},
+		{"Test that an event older than max age is stale", cfg, created.Add(2 * time.Hour), true},
+		{"Test that events are never stale without max age", unlimited, created.Add(48 * time.Hour), false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		age, ok := eventAge(cloudEvent(t, body), tc.now)
+		if !ok || age != tc.now.Sub(created) {
+			t.Fatalf("expected age %v, got: %v (%v). %v", tc.now.Sub(created), age, ok, failMark)
+		}
+
+		if got := tc.cfg.stale(age); got == tc.want {
+			t.Logf("got expected stale %v for age %v. %v", got, age, passMark)
+		} else {
+			t.Logf("expected stale %v, got %v for age %v. %v", tc.want, got, age, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that an event without time has no age ===========")
+	if _, ok := eventAge(cloudEvent(t, []byte(`{"subject":"VmPoweredOnEvent","data":{"Key":1}}`)), time.Now()); ok {
+		t.Fatalf("expected no age. %v", failMark)
+	}
+	t.Logf("got expected: no age. %v", passMark)
+}
+
+// TestSkipUnconnected shows stale events and events matching no rule are
+// skipped before connecting to vSphere, which is unreachable here.
+func TestSkipUnconnected(t *testing.T) {
+	defer func() {
+		versions.history, versions.current, versions.pinned, versions.over = nil, "", nil, ""
+	}()
+
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	config := func(section string) string {
+		return `[vcenter]
+server = "127.0.0.1:1"
+user = "admin@vsphere.local"
+password = "password1234"
+
+[tag]
+urn = "urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL"
+action = "attach"
+` + section
+	}
+
+	var tests = []struct {
+		testDesc   string
+		cfg        string
+		wantStatus int
+		wantReason i18n.Key
+	}{
+		{
+			"Test that a stale event is skipped without connecting",
+			config("\n[event]\nmax_age_seconds = 600\n"),
+			statusStaleEvent,
+			i18n.SkipStale,
+		},
+		{
+			"Test that an event matching no rule is skipped without connecting",
+			config("\n[[rules]]\nname = \"powered-on\"\nevents = [\"VmPoweredOnEvent\"]\n[[rules.actions]]\ntype = \"tag\"\n"),
+			http.StatusOK,
+			i18n.SkipNoRule,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		path := filepath.Join(t.TempDir(), "vcconfig.toml")
+		if err := os.WriteFile(path, []byte(tc.cfg), 0o600); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		t.Setenv("vcconfig_path", path)
+
+		before := skippedUnconnected.Value()
+		res, err := handle(handler.Request{Method: http.MethodPost, Body: body})
+		if err == nil && res.StatusCode == tc.wantStatus && res.Header.Get(reasonHeader) == string(tc.wantReason) &&
+			skippedUnconnected.Value() == before+1 {
+			t.Logf("got expected: %d %s. %v", res.StatusCode, res.Body, passMark)
+		} else {
+			t.Logf("expected %d %v, got: %d %s %v (%v). %v", tc.wantStatus, tc.wantReason, res.StatusCode, res.Body, res.Header, err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPolicy ensures the introspected policy includes built-in exclusions,
+// never exposes credentials and changes its version with the behavior.
+func TestPolicy(t *testing.T) {
+	cfg := newCfg("password1234", false, "attach")
+	cfg.VCenter.Write.User = "tagger@vsphere.local"
+	cfg.VCenter.Write.Password = "password5678"
+	cfg.Notify.SlackWebhookURL = "https://hooks.slack.com/services/T0/B0/token1234"
+	cfg.Auth.Token = "s3cret-token"
+	cfg.Auth.HMACKey = "s3cret-key"
+
+	res, err := policyResponse(cfg)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	body := string(res.Body)
+
+	t.Log("=========== Test that secrets are not exposed ===========")
+	for _, secret := range []string{"password1234", "password5678", "token1234", "s3cret-token", "s3cret-key"} {
+		if strings.Contains(body, secret) {
+			t.Fatalf("expected %q not to be exposed, got: %v. %v", secret, body, failMark)
+		}
+	}
+	t.Logf("got expected: no secrets. %v", passMark)
+
+	t.Log("=========== Test that built-in exclusions and sinks are listed ===========")
+	p := policyOf(cfg)
+	if p.Filters.ResourcePools[0] != "ESX Agents" || p.Targets.Notifications[0] != "slack" || p.Targets.WriteUser != "tagger@vsphere.local" {
+		t.Fatalf("expected built-in exclusions, slack and write user, got: %+v. %v", p, failMark)
+	}
+	t.Logf("got expected: %v. %v", p.Filters.ResourcePools, passMark)
+
+	t.Log("=========== Test that the version changes with the behavior ===========")
+	changed := newCfg("password1234", false, "detach")
+	if v := policyOf(changed).Version; v == p.Version || res.Header.Get("Etag") != `"`+p.Version+`"` {
+		t.Fatalf("expected a new version and matching ETag, got: %v, %v. %v", v, res.Header.Get("Etag"), failMark)
+	}
+	samePassword := newCfg("password0000", false, "attach")
+	samePassword.VCenter.Identities = map[string]credentials{"tagger": {User: "tagger@vsphere.local", Password: "password0000"}}
+	rotated := newCfg("password1234", false, "attach")
+	rotated.VCenter.Identities = map[string]credentials{"tagger": {User: "tagger@vsphere.local", Password: "password1234"}}
+	if policyOf(samePassword).Version != policyOf(rotated).Version {
+		t.Fatalf("expected credentials not to change the version. %v", failMark)
+	}
+	if _, ok := rotated.VCenter.Identities["tagger"]; !ok || rotated.VCenter.Identities["tagger"].Password != "password1234" {
+		t.Fatalf("expected the config not to be changed by the version, got: %+v. %v", rotated.VCenter.Identities, failMark)
+	}
+	for _, change := range []func(cfg *vcConfig){
+		func(cfg *vcConfig) { cfg.Alarm.ExpandEntities = true },
+		func(cfg *vcConfig) { cfg.Messages.Locale = "de" },
+		func(cfg *vcConfig) { cfg.DeadLetter.MaxAttempts = 3 },
+	} {
+		changed := newCfg("password1234", false, "attach")
+		change(changed)
+		if policyOf(changed).Version == p.Version {
+			t.Fatalf("expected settings outside the policy to change the version, got: %v. %v", p.Version, failMark)
+		}
+	}
+	t.Logf("got expected: version %v. %v", p.Version, passMark)
+}
+
+// TestLoadConfig ensures the config is loaded once per invocation, so the
+// middlewares and the handler see the same config even if vcconfig.toml
+// changes meanwhile.
+func TestLoadConfig(t *testing.T) {
+	defer func() {
+		versions.history, versions.current, versions.pinned, versions.over = nil, "", nil, ""
+	}()
+
+	path := filepath.Join(t.TempDir(), "vcconfig.toml")
+	t.Setenv("vcconfig_path", path)
+
+	config := func(action string) []byte {
+		return []byte(fmt.Sprintf(`[vcenter]
+server = "veba.local.corp"
+user = "admin@vsphere.local"
+password = "password1234"
+
+[tag]
+urn = "urn:vmomi:InventoryServiceTag:019c0a9e-0672-4f6d-a1b0-7e5b8f3c2d14:GLOBAL"
+action = %q
+`, action))
+	}
+	if err := os.WriteFile(path, config("attach"), 0o600); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var got []string
+	seen := func(next middleware.Func) middleware.Func {
+		return func(req handler.Request) (handler.Response, error) {
+			cfg, err := requestConfig(req)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			got = append(got, cfg.Tag.Action)
+
+			return next(req)
+		}
+	}
+	change := func(next middleware.Func) middleware.Func {
+		return func(req handler.Request) (handler.Response, error) {
+			if err := os.WriteFile(path, config("detach"), 0o600); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			return next(req)
+		}
+	}
+	last := func(req handler.Request) (handler.Response, error) {
+		return handler.Response{StatusCode: http.StatusOK}, nil
+	}
+
+	t.Log("=========== Test that a changed vcconfig.toml is seen by the next invocation only ===========")
+	middleware.Chain(last, loadConfig, seen, change, seen)(handler.Request{})
+	middleware.Chain(last, loadConfig, seen)(handler.Request{})
+
+	if want := []string{"attach", "attach", "detach"}; reflect.DeepEqual(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+}
+
+// TestVersions shows the kept configs can be rolled back to with the admin
+// requests, also while vcconfig.toml is broken, until vcconfig.toml changes.
+func TestVersions(t *testing.T) {
+	defer func() {
+		versions.history, versions.current, versions.pinned, versions.over = nil, "", nil, ""
+	}()
+
+	path := filepath.Join(t.TempDir(), "vcconfig.toml")
+	t.Setenv("vcconfig_path", path)
+
+	config := func(action, auth string, extra ...string) string {
+		return fmt.Sprintf(`[vcenter]
+server = "veba.local.corp"
+user = "admin@vsphere.local"
+password = "password1234"
+
+[tag]
+urn = "urn:vmomi:InventoryServiceTag:019c0a9e-0672-4f6d-a1b0-7e5b8f3c2d14:GLOBAL"
+action = %q
+
+[auth]
+token = %q
+%v`, action, auth, strings.Join(extra, "\n"))
+	}
+	write := func(content string) func() {
+		return func() {
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+	}
+
+	// The version of the first config is known once it is loaded.
+	var attachVersion string
+
+	request := func(method, query string) handler.Request {
+		return handler.Request{
+			Method:      method,
+			QueryString: query,
+			Header:      http.Header{"Authorization": {"Bearer s3cret-token"}},
+		}
+	}
+	rollbackTo := func(v *string) func() handler.Request {
+		return func() handler.Request { return request(http.MethodPost, "rollback="+*v) }
+	}
+	get := func() handler.Request { return request(http.MethodGet, "") }
+	unknown := "0000000000000000"
+
+	var tests = []struct {
+		testDesc   string
+		setup      func()
+		req        func() handler.Request
+		wantStatus int
+		wantAction string
+	}{
+		{
+			"Test that the loaded config is in effect",
+			write(config("attach", "s3cret-token")),
+			get,
+			http.StatusOK, "attach",
+		},
+		{
+			"Test that a changed config is in effect",
+			write(config("detach", "s3cret-token")),
+			get,
+			http.StatusOK, "detach",
+		},
+		{
+			"Test that rolling back to a kept version succeeds",
+			nil,
+			rollbackTo(&attachVersion),
+			http.StatusOK, "attach",
+		},
+		{
+			"Test that the rollback holds while vcconfig.toml is broken",
+			write("[vcenter"),
+			get,
+			http.StatusOK, "attach",
+		},
+		{
+			"Test that rolling back to an unknown version fails",
+			nil,
+			rollbackTo(&unknown),
+			http.StatusNotFound, "attach",
+		},
+		{
+			"Test that rolling back again succeeds",
+			nil,
+			rollbackTo(&attachVersion),
+			http.StatusOK, "attach",
+		},
+		{
+			"Test that a changed setting outside the policy lifts the rollback",
+			write(config("detach", "s3cret-token", "[messages]", `locale = "de"`)),
+			get,
+			http.StatusOK, "detach",
+		},
+		{
+			"Test that a changed config lifts the rollback",
+			write(config("detach", "")),
+			get,
+			http.StatusOK, "detach",
+		},
+		{
+			"Test that rolling back without auth checks is forbidden",
+			nil,
+			rollbackTo(&attachVersion),
+			http.StatusForbidden, "detach",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if tc.setup != nil {
+			tc.setup()
+		}
+
+		res, _ := invoke(tc.req())
+
+		// The policy tells which config is in effect.
+		p, _ := invoke(get())
+		var got policy
+		if err := json.Unmarshal(p.Body, &got); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err, string(p.Body))
+		}
+		if attachVersion == "" {
+			attachVersion = got.Version
+		}
+
+		if res.StatusCode == tc.wantStatus && got.Tag.Action == tc.wantAction {
+			t.Logf("got expected: %v, action %v. %v", res.StatusCode, got.Tag.Action, passMark)
+		} else {
+			t.Logf("expected: %v, action %v, got: %v %s, action %v. %v", tc.wantStatus, tc.wantAction, res.StatusCode, res.Body, got.Tag.Action, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the kept versions are listed ===========")
+	res, _ := invoke(request(http.MethodGet, "versions"))
+	var l versionList
+	if err := json.Unmarshal(res.Body, &l); err != nil || l.RolledBack || len(l.Versions) != 4 || l.Versions[3].Version != attachVersion {
+		t.Fatalf("expected 4 versions, the oldest %v, got: %s (%v). %v", attachVersion, res.Body, err, failMark)
+	}
+	t.Logf("got expected: %s. %v", res.Body, passMark)
+}
+
+// cloudEvent decodes the envelope of body like handle does.
+func cloudEvent(t *testing.T, body []byte) *vevents.CloudEvent {
+	t.Helper()
+
+	ce, err := vevents.Unmarshal(body)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	return ce
+}
+
+// expvarInt returns the value of an expvar.Int, 0 if v is not set.
+func expvarInt(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+
+	return 0
+}
+
+// TestLimit ensures operations are limited by their timeout, which is only
+// reported if it was exceeded before the deadline of the invocation.
+func TestLimit(t *testing.T) {
+	var cfg vcConfig
+	cfg.Timeouts.NotifySeconds = 1
+
+	// wait blocks until the context of the operation is done.
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var tests = []struct {
+		testDesc    string
+		ctx         context.Context
+		op          string
+		f           func(context.Context) error
+		wantErr     string
+		wantTimeout bool
+	}{
+		{"Test that an operation within its timeout succeeds", context.Background(), opNotify, func(context.Context) error { return nil }, "", false},
+		{"Test that an operation exceeding its timeout is reported", context.Background(), opNotify, wait, "notify timed out after 1s", true},
+		{"Test that an exceeded invocation deadline is not reported as timeout", expired, opNotify, wait, context.DeadlineExceeded.Error(), false},
+		{"Test that an operation without timeout is only limited by the invocation", expired, opTag, wait, context.DeadlineExceeded.Error(), false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		before := expvarInt(timeouts.Get(tc.op))
+
+		err := limit(tc.ctx, &cfg, tc.op, tc.f)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		counted := expvarInt(timeouts.Get(tc.op)) > before
+
+		if strings.HasPrefix(got, tc.wantErr) && counted == tc.wantTimeout {
+			t.Logf("got expected: %q, counted %v. %v", got, counted, passMark)
+		} else {
+			t.Logf("expected: %q, counted %v, got: %q, counted %v. %v", tc.wantErr, tc.wantTimeout, got, counted, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestScheduleFailed shows events which got no worker are rejected with a
+// Retry-After of at least retry_after_seconds and less than twice of it.
+func TestScheduleFailed(t *testing.T) {
+	var configured vcConfig
+	configured.Scheduler.RetryAfterSeconds = 1
+
+	var tests = []struct {
+		testDesc   string
+		cfg        *vcConfig
+		err        error
+		wantStatus int
+		wantMin    int
+		wantMax    int
+	}{
+		{"Test that a full queue is rejected as too many requests", &vcConfig{}, scheduler.ErrQueueFull, http.StatusTooManyRequests, 10, 19},
+		{"Test that a timeout while waiting is rejected as unavailable", &vcConfig{}, context.DeadlineExceeded, http.StatusServiceUnavailable, 10, 19},
+		{"Test that retry_after_seconds replaces the default", &configured, scheduler.ErrQueueFull, http.StatusTooManyRequests, 1, 1},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		res, err := scheduleFailedResponse(&trace{}, tc.cfg, tc.err)
+		after, convErr := strconv.Atoi(res.Header.Get("Retry-After"))
+
+		if errors.Is(err, tc.err) && res.StatusCode == tc.wantStatus && convErr == nil && after >= tc.wantMin && after <= tc.wantMax {
+			t.Logf("got expected: %d, Retry-After %d. %v", res.StatusCode, after, passMark)
+		} else {
+			t.Logf("expected: %d, Retry-After %d-%d, got: %d, Retry-After %q, err %v. %v", tc.wantStatus, tc.wantMin, tc.wantMax, res.StatusCode, res.Header.Get("Retry-After"), err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestObserve shows observe mode only reports and notifies what the rule would
+// do, and unknown modes are rejected.
+func TestObserve(t *testing.T) {
+	var posted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted.Add(1)
+	}))
+	defer srv.Close()
+
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Mode = "Observe"
+	cfg.Notify.WebhookURL = srv.URL
+	ref := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+
+	var tests = []struct {
+		testDesc   string
+		r          *rule
+		wantPosted int32
+	}{
+		{"Test that a rule without notify action is only logged", &rule{Name: "tag", Actions: []action{{Type: actionTag}}}, 0},
+		{"Test that a rule with notify action posts the observed decision", &rule{Name: "notify", Actions: []action{{Type: actionTag}, {Type: actionNotify}}}, 1},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		posted.Store(0)
+
+		res := observeResponse(context.Background(), &trace{}, cfg, tc.r, ref, i18n.ObserveRule, tc.r.Name, strings.Join(tc.r.actionTypes(), ", "), ref.Value)
+		if cfg.observing() && res.StatusCode == http.StatusOK && outcome(res, nil) == outcomeSkipped &&
+			res.Header.Get(ruleHeader) == tc.r.Name && posted.Load() == tc.wantPosted && strings.HasPrefix(string(res.Body), "observe mode:") {
+			t.Logf("got expected: %s, %d notification(s). %v", res.Body, posted.Load(), passMark)
+		} else {
+			t.Logf("expected skipped rule %v, %d notification(s), got: %d %s %v, %d. %v", tc.r.Name, tc.wantPosted, res.StatusCode, res.Body, res.Header, posted.Load(), failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that an unknown mode results in error ===========")
+	cfg.Mode = "obsrve"
+	if err := validateConfig(*cfg); err != nil {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected an error for mode %q. %v", cfg.Mode, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that the policy shows the mode ===========")
+	cfg.Mode = ""
+	remediating := policyOf(cfg)
+	cfg.Mode = modeObserve
+	observing := policyOf(cfg)
+	if remediating.Mode == modeRemediate && observing.Mode == modeObserve && remediating.Version != observing.Version {
+		t.Logf("got expected: %v %v, %v %v. %v", remediating.Mode, remediating.Version, observing.Mode, observing.Version, passMark)
+	} else {
+		t.Logf("expected modes with different versions, got: %v %v, %v %v. %v", remediating.Mode, remediating.Version, observing.Mode, observing.Version, failMark)
+		t.Fail()
+	}
+}
+
+// TestReadConcurrently shows independent reads overlap, at most
+// maxConcurrentReads at once, and the first failing read cancels the others.
+func TestReadConcurrently(t *testing.T) {
+	errRead := errors.New("read failed")
+
+	var tests = []struct {
+		testDesc    string
+		reads       int
+		fail        bool
+		wantMaxBusy int
+		expectErr   error
+	}{
+		{"Test that two reads run concurrently", 2, false, 2, nil},
+		{"Test that reads are limited to maxConcurrentReads", maxConcurrentReads + 3, false, maxConcurrentReads, nil},
+		{"Test that a failing read cancels the others", 3, true, 3, errRead},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		var mu sync.Mutex
+		var busy, maxBusy int
+		var wg sync.WaitGroup
+		wg.Add(min(tc.reads, maxConcurrentReads))
+
+		reads := make([]func(ctx context.Context) error, 0, tc.reads)
+		for i := 0; i < tc.reads; i++ {
+			reads = append(reads, func(ctx context.Context) error {
+				mu.Lock()
+				busy++
+				maxBusy = max(maxBusy, busy)
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					busy--
+					mu.Unlock()
+				}()
+
+				// The first reads wait for each other, so they only
+				// complete if they run concurrently.
+				if i < maxConcurrentReads {
+					wg.Done()
+					wg.Wait()
+				}
+
+				if tc.fail && i == 0 {
+					return errRead
+				}
+				if tc.fail {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			})
+		}
+
+		err := readConcurrently(context.Background(), reads...)
+		if errors.Is(err, tc.expectErr) && (err == nil) == (tc.expectErr == nil) && maxBusy == tc.wantMaxBusy {
+			t.Logf("got expected: %v, %d concurrent reads. %v", err, maxBusy, passMark)
+		} else {
+			t.Logf("expected: %v, %d concurrent reads, got: %v, %d. %v", tc.expectErr, tc.wantMaxBusy, err, maxBusy, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that nested reads share the limit ===========")
+	var mu sync.Mutex
+	var busy, maxBusy, done int
+	leaf := func(ctx context.Context) error {
+		mu.Lock()
+		busy++
+		maxBusy = max(maxBusy, busy)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		busy--
+		done++
+		mu.Unlock()
+		return nil
+	}
+	nested := func(ctx context.Context) error {
+		return readConcurrently(ctx, leaf, leaf, leaf, leaf)
+	}
+	err := readConcurrently(context.Background(), nested, nested, nested)
+	if err == nil && done == 12 && maxBusy <= maxConcurrentReads {
+		t.Logf("got expected: %d reads, %d concurrent reads. %v", done, maxBusy, passMark)
+	} else {
+		t.Logf("expected: 12 reads, at most %d concurrent reads, got: %v, %d reads, %d. %v", maxConcurrentReads, err, done, maxBusy, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that reads after a failure are not started ===========")
+	var started int
+	reads := []func(ctx context.Context) error{func(ctx context.Context) error {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		return errRead
+	}}
+	for i := 0; i < maxConcurrentReads+3; i++ {
+		reads = append(reads, func(ctx context.Context) error {
+			mu.Lock()
+			started++
+			mu.Unlock()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+	err = readConcurrently(context.Background(), reads...)
+	if errors.Is(err, errRead) && started <= maxConcurrentReads {
+		t.Logf("got expected: %v, %d started reads. %v", err, started, passMark)
+	} else {
+		t.Logf("expected: %v, at most %d started reads, got: %v, %d. %v", errRead, maxConcurrentReads, err, started, failMark)
+		t.Fail()
+	}
+}
+
+// TestLimiter ensures the token bucket allows bursts and then limits requests
+// to the configured rate.
+func TestLimiter(t *testing.T) {
+	l := &limiter{}
+	l.set(2, 3)
+	now := l.last
+
+	t.Log("=========== Test that a burst is sent without delay ===========")
+	for i := 0; i < 3; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("expected request %d of burst without delay, got: %v. %v", i+1, d, failMark)
+		}
+	}
+	t.Logf("got expected: burst of 3. %v", passMark)
+
+	t.Log("=========== Test that requests after the burst are delayed ===========")
+	if d := l.reserve(now); d != 500*time.Millisecond {
+		t.Fatalf("expected delay of 500ms at 2 qps, got: %v. %v", d, failMark)
+	}
+	if d := l.reserve(now.Add(500 * time.Millisecond)); d != 0 {
+		t.Fatalf("expected a new token after 500ms, got delay: %v. %v", d, failMark)
+	}
+	t.Logf("got expected: 2 qps. %v", passMark)
+
+	t.Log("=========== Test that a zero rate disables the limiter ===========")
+	l.set(0, 0)
+	if d := l.reserve(now); d != 0 {
+		t.Fatalf("expected no delay, got: %v. %v", d, failMark)
+	}
+	t.Logf("got expected: no delay. %v", passMark)
+}
+
+// TestHeartbeat ensures the heartbeat CloudEvent identifies the function and
+// carries its counters.
+func TestHeartbeat(t *testing.T) {
+	var got heartbeatEvent
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Heartbeat.URL = srv.URL
+	events.Add("200", 1)
+
+	t.Log("=========== Test that the heartbeat is posted as CloudEvent ===========")
+	if err := sendHeartbeat(context.Background(), cfg, time.Now()); err != nil {
+		t.Fatal(failMark, err)
+	}
+
+	if contentType != "application/cloudevents+json" || got.Type != heartbeatType || got.Source != "veba/function/gotag-fn" || got.ID == "" {
+		t.Fatalf("expected heartbeat CloudEvent of gotag-fn, got: %q %+v. %v", contentType, got, failMark)
+	}
+	if _, ok := got.Data.Counters["events_total"]; !ok {
+		t.Fatalf("expected events_total counter, got: %v. %v", got.Data.Counters, failMark)
+	}
+	if _, ok := got.Data.Counters["memstats"]; ok {
+		t.Fatalf("expected memstats to be left out. %v", failMark)
+	}
+	t.Logf("got expected: %v from %v. %v", got.Type, got.Source, passMark)
+}
+
+// TestEmit ensures emit actions post follow-up CloudEvents linked to the
+// event which caused them.
+func TestEmit(t *testing.T) {
+	var got vevents.CloudEvent
+	var traceParent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get("traceparent")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Emit.URL = srv.URL
+	cfg.Rules = []rule{{Name: "power", Actions: []action{{Type: actionEmit}}}}
+	if err := validateRules(*cfg); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	r := &cfg.Rules[0]
+	ref := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+
+	t.Log("=========== Test that the follow-up is linked to the event which caused it ===========")
+	text, err := runAction(context.Background(), cfg, r, r.Actions[0], nil, ref, body, cloudEvent(t, body), []string{"vm-42 was tagged"})
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+
+	var data followUpData
+	json.Unmarshal(got.Data, &data)
+
+	trigger := "9f284e17-f688-408f-a439-e5e06f564c82"
+	if got.Type != defaultFollowUpType || got.CausationID != trigger || got.CorrelationID != trigger ||
+		got.TraceParent == "" || traceParent != got.TraceParent || data.Trigger.ID != trigger || data.Outcome != "vm-42 was tagged" {
+		t.Fatalf("expected follow-up of %v, got: %+v, %+v, header %q. %v", trigger, got, data, traceParent, failMark)
+	}
+	if text != fmt.Sprintf("emitted %v %v", got.Type, got.ID) {
+		t.Fatalf("expected outcome of emitted event, got: %q. %v", text, failMark)
+	}
+	t.Logf("got expected: %v %v. %v", got.ID, got.TraceParent, passMark)
+
+	t.Log("=========== Test that emit actions without url are rejected ===========")
+	cfg.Emit.URL = ""
+	if err := validateRules(*cfg); err != nil {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Fatalf("expected an error for emit action without url. %v", failMark)
+	}
+}
+
+// TestViewer shows a summary of every event is posted to the event viewer,
+// classified as remediated, skipped or failed.
+func TestViewer(t *testing.T) {
+	var got viewerEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	body, err := os.ReadFile("testdata/event.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Viewer.URL = srv.URL
+	tr := &trace{enabled: true, start: time.Now()}
+	tr.step("event refers to VirtualMachine vm-42")
+
+	var tests = []struct {
+		testDesc string
+		res      handler.Response
+		cause    error
+		want     string
+	}{
+		{
+			"Test that a tagged VM is remediated",
+			tr.response("vm-42 was tagged with urn:vmomi:InventoryServiceTag:11f16f36", http.StatusOK),
+			nil,
+			outcomeRemediated,
+		},
+		{
+			"Test that a skipped VM is skipped, even if the response is no success",
+			tr.skip(i18n.SkipNotFound, "vm-42 not found, skipping", statusVMNotFound),
+			nil,
+			outcomeSkipped,
+		},
+		{
+			"Test that a failed event is failed",
+			tr.response("attach tag to VM failed", http.StatusInternalServerError),
+			errors.New("attach tag to VM failed"),
+			outcomeFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		req := handler.Request{Body: body, Method: http.MethodPost}
+
+		if err := sendSummary(context.Background(), cfg, req, tc.res, tc.cause); err != nil {
+			t.Fatal(failMark, err)
+		}
+
+		// The message is the first line of the response, without trace.
+		message, _, _ := strings.Cut(string(tc.res.Body), "\n")
+		if got.Type == viewerType && got.Data.Outcome == tc.want && got.Data.Status == tc.res.StatusCode &&
+			got.Data.EventID == "9f284e17-f688-408f-a439-e5e06f564c82" && got.Subject == "VmPoweredOffEvent" && got.Data.Message == message {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected outcome %v of %q, got: %+v. %v", tc.want, message, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestDeadLetter shows malformed events are dead-lettered at once and failed
+// events after max_attempts failures.
+func TestDeadLetter(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l struct {
+			ID       string
+			Status   int
+			Attempts int
+		}
+		json.NewDecoder(r.Body).Decode(&l)
+		got = append(got, fmt.Sprintf("%v/%v/%v", l.ID, l.Status, l.Attempts))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	cfg := newCfg("password1234", false, "attach")
+	cfg.DeadLetter.WebhookURL = srv.URL
+	cfg.DeadLetter.MaxAttempts = 2
+
+	event := func(id string) handler.Request {
+		return handler.Request{Body: []byte(`{"id":"` + id + `","subject":"VmPoweredOnEvent","data":{}}`)}
+	}
+	cause := errors.New("failed")
+
+	var tests = []struct {
+		testDesc string
+		req      handler.Request
+		status   int
+		cause    error
+	}{
+		{"Test that a malformed event is dead-lettered at once", handler.Request{Body: []byte(`{"id":`)}, http.StatusBadRequest, cause},
+		{"Test that the first failure is not dead-lettered", event("e1"), http.StatusInternalServerError, cause},
+		{"Test that a success resets the failed attempts", event("e1"), http.StatusOK, nil},
+		{"Test that the first failure after success is not dead-lettered", event("e1"), http.StatusInternalServerError, cause},
+		{"Test that the second failure is dead-lettered", event("e1"), http.StatusInternalServerError, cause},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		deadLetter(ctx, cfg, tc.req, tc.status, tc.cause)
+	}
+
+	want := []string{"/400/1", "e1/500/2"}
+	if reflect.DeepEqual(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+}
+
+// TestResolveVMRef shows the strategies are tried in the configured order and
+// events without resolvable VM are not resolved.
+func TestResolveVMRef(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		byObjectName := `{"data":{"ObjectName":"` + vm.Name + `"}}`
+		var tests = []struct {
+			testDesc string
+			order    []string
+			body     string
+			want     string // VM id, empty if not resolved
+		}{
+			{"Test that Vm is resolved by default", nil, `{"data":{"Vm":{"Vm":{"Type":"VirtualMachine","Value":"vm-1"}}}}`, "vm-1"},
+			{"Test that a VM entity is resolved by default", nil, `{"data":{"Entity":{"Name":"db-01","Entity":{"Type":"VirtualMachine","Value":"vm-2"}}}}`, "vm-2"},
+			{"Test that a host entity is not resolved", nil, `{"data":{"Entity":{"Name":"esx-01","Entity":{"Type":"HostSystem","Value":"host-1"}}}}`, ""},
+			{"Test that an object name is not searched by default", nil, byObjectName, ""},
+			{"Test that an object name is searched if configured", []string{resolveVM, resolveName}, byObjectName, vm.Self.Value},
+			{"Test that an unknown name is not resolved", []string{resolveName}, `{"data":{"ObjectName":"missing"}}`, ""},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			cfg := newCfg("password1234", false, "attach")
+			cfg.Resolve.Order = tc.order
+
+			ref, err := resolveVMRef(ctx, cfg, client, cloudEvent(t, []byte(tc.body)))
+			got := ""
+			if err == nil {
+				got = ref.Value
+			} else if !errors.Is(err, errNotResolved) {
+				t.Fatal(failMark, err)
+			}
+
+			if got == tc.want {
+				t.Logf("got expected: %q. %v", got, passMark)
+			} else {
+				t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that unknown strategies are rejected ===========")
+		if err := validateResolveOrder([]string{resolveVM, "ldap"}); err == nil {
+			t.Fatalf("expected an error. %v", failMark)
+		}
+		t.Logf("got an error, as expected. %v", passMark)
+	})
+}
+
+// TestRunChain shows actions run in order, failures of actions which continue
+// on error are reported and other failures stop the chain.
+func TestRunChain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		cfg := newCfg("password1234", false, "attach")
+		cfg.Notify.WebhookURL = srv.URL
+
+		reconfigure := action{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.tagged": "true"}}
+		var tests = []struct {
+			testDesc  string
+			actions   []action
+			want      string
+			expectErr bool
+		}{
+			{
+				"Test that a failed action continuing on error is reported and the chain continues",
+				[]action{{Type: actionNotify, ContinueOnError: true}, reconfigure},
+				"action notify of rule test failed: notification rejected: 503 Service Unavailable, " + vm.Self.Value + " was reconfigured",
+				false,
+			},
+			{
+				"Test that a failed action stops the chain",
+				[]action{reconfigure, {Type: actionNotify}, reconfigure},
+				vm.Self.Value + " was reconfigured",
+				true,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			r := &rule{Name: "test", Actions: tc.actions}
+
+			got, err := runChain(ctx, cfg, r, client, vm.Self, nil, nil)
+			if got == tc.want && (err != nil) == tc.expectErr {
+				t.Logf("got expected: %q, %v. %v", got, err, passMark)
+			} else {
+				t.Logf("expected: %q, got: %q, %v. %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that the first matching rule applies ===========")
+		cfg.Rules = []rule{
+			{Name: "power", Events: []string{"VmPoweredOnEvent"}, Actions: []action{{Type: actionTag}}},
+			{Name: "any", Actions: []action{reconfigure}},
+		}
+		if r := cfg.ruleFor("VmPoweredOnEvent"); r == nil || r.Name != "power" {
+			t.Fatalf("expected rule power, got: %+v. %v", r, failMark)
+		}
+		if r := cfg.ruleFor("VmPoweredOffEvent"); r == nil || r.Name != "any" {
+			t.Fatalf("expected rule any, got: %+v. %v", r, failMark)
+		}
+		t.Logf("got expected rules. %v", passMark)
+	})
+}
+
+// TestAdvise shows advisory tags are attached to VMs whose properties match
+// and detached once they do not.
+func TestAdvise(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "advisory", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "review-sizing", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		cfg := newCfg("password1234", false, "attach")
+
+		advise := func(adv advisory) action {
+			adv.TagURN = tagID
+			return action{Type: actionAdvise, Advisories: []advisory{adv}}
+		}
+
+		var tests = []struct {
+			testDesc   string
+			action     action
+			want       string
+			expectErr  bool
+			wantTagged bool
+		}{
+			{
+				"Test that a VM whose property matches is tagged",
+				advise(advisory{Property: "config.hardware.numCPU", Op: opAtLeast, Value: "1"}),
+				vm.Self.Value + " advised: config.hardware.numCPU >= 1 tagged",
+				false, true,
+			},
+			{
+				"Test that a VM whose property no longer matches is untagged",
+				advise(advisory{Property: "config.hardware.numCPU", Op: opAbove, Value: "64"}),
+				vm.Self.Value + " advised: config.hardware.numCPU > 64 untagged",
+				false, false,
+			},
+			{
+				"Test that enums compare as strings",
+				advise(advisory{Property: "runtime.powerState", Op: opEqual, Value: string(vm.Runtime.PowerState)}),
+				vm.Self.Value + " advised: runtime.powerState == " + string(vm.Runtime.PowerState) + " tagged",
+				false, true,
+			},
+			{
+				"Test that a property which is no scalar results in error",
+				advise(advisory{Property: "config.hardware", Op: opEqual, Value: "1"}),
+				"",
+				true, true,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			r := &rule{Name: "sizing", Actions: []action{tc.action}}
+
+			got, err := runChain(ctx, cfg, r, client, vm.Self, nil, nil)
+
+			attached, listErr := m.ListAttachedTags(ctx, vm.Self)
+			if listErr != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, listErr)
+			}
+			tagged := false
+			for _, id := range attached {
+				tagged = tagged || id == tagID
+			}
+
+			if got == tc.want && (err != nil) == tc.expectErr && tagged == tc.wantTagged {
+				t.Logf("got expected: %q, %v, tagged %v. %v", got, err, tagged, passMark)
+			} else {
+				t.Logf("expected: %q, tagged %v, got: %q, %v, tagged %v. %v", tc.want, tc.wantTagged, got, err, tagged, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestCategorize shows one tag action applies tags of several categories
+// whose names are derived from the event, the VM and the event time.
+func TestCategorize(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		for _, name := range []string{"sizing", "alarm"} {
+			if _, err := m.CreateCategory(ctx, &tags.Category{Name: name, Cardinality: "SINGLE"}); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+		if _, err := m.CreateCategory(ctx, &tags.Category{Name: "seen", Cardinality: "MULTIPLE"}); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		cpus := fmt.Sprint(vm.Config.Hardware.NumCPU)
+		cfg := newCfg("password1234", false, "attach")
+
+		body := func(alarm string) []byte {
+			return []byte(`{"id":"` + alarm + `-1","subject":"AlarmStatusChangedEvent","time":"2020-03-13T21:11:53Z","data":{"Alarm":{"Name":"` + alarm + `"}}}`)
+		}
+		tagAction := func(cts ...categorizedTag) action {
+			return action{Type: actionTag, Tags: cts}
+		}
+		sizing := categorizedTag{Category: "sizing", Value: "{vm.config.hardware.numCPU}cpu", Create: true}
+		seen := categorizedTag{Category: "seen", Value: "{time:2006-01}", Create: true}
+		alarm := categorizedTag{Category: "alarm", Value: "{event.data.Alarm.Name}", Create: true}
+
+		var tests = []struct {
+			testDesc  string
+			action    action
+			body      []byte
+			want      string
+			expectErr bool
+			wantTags  []string
+		}{
+			{
+				"Test that tags of several categories are derived and created",
+				tagAction(sizing, seen, alarm),
+				body("cpu-high"),
+				vm.Self.Value + " was tagged with sizing:" + cpus + "cpu, seen:2020-03, alarm:cpu-high",
+				false,
+				[]string{"alarm:cpu-high", "seen:2020-03", "sizing:" + cpus + "cpu"},
+			},
+			{
+				"Test that a category of single cardinality replaces the tag of the VM",
+				tagAction(alarm),
+				body("memory-high"),
+				vm.Self.Value + " was tagged with alarm:memory-high",
+				false,
+				[]string{"alarm:memory-high", "seen:2020-03", "sizing:" + cpus + "cpu"},
+			},
+			{
+				"Test that a missing tag is not created without create",
+				tagAction(categorizedTag{Category: "alarm", Value: "{event.data.Alarm.Name}"}),
+				body("disk-high"),
+				"",
+				true,
+				[]string{"alarm:memory-high", "seen:2020-03", "sizing:" + cpus + "cpu"},
+			},
+			{
+				"Test that a placeholder missing in the event results in error",
+				tagAction(sizing, categorizedTag{Category: "alarm", Value: "{event.data.Alarm.Key}", Create: true}),
+				body("cpu-high"),
+				"",
+				true,
+				[]string{"alarm:memory-high", "seen:2020-03", "sizing:" + cpus + "cpu"},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			r := &rule{Name: "categorize", Actions: []action{tc.action}}
+
+			ce := cloudEvent(t, tc.body)
+			got, err := runChain(withEventID(ctx, ce), cfg, r, client, vm.Self, tc.body, ce)
+
+			attached, listErr := m.GetAttachedTags(ctx, vm.Self)
+			if listErr != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, listErr)
+			}
+			var gotTags []string
+			for _, tag := range attached {
+				category, catErr := m.GetCategory(ctx, tag.CategoryID)
+				if catErr != nil {
+					t.Fatal("Test failing due to improper test setup.", failMark, catErr)
+				}
+				gotTags = append(gotTags, category.Name+":"+tag.Name)
+			}
+			sort.Strings(gotTags)
+
+			if got == tc.want && (err != nil) == tc.expectErr && reflect.DeepEqual(gotTags, tc.wantTags) {
+				t.Logf("got expected: %q, %v, tags %v. %v", got, err, gotTags, passMark)
+			} else {
+				t.Logf("expected: %q, tags %v, got: %q, %v, tags %v. %v", tc.want, tc.wantTags, got, err, gotTags, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that a created tag records the event and the tag it replaced ===========")
+		category, err := m.GetCategory(ctx, "alarm")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tag, err := m.GetTag(ctx, "memory-high")
+		if err != nil || tag.CategoryID != category.ID {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		rec, err := tagaudit.Parse(tag.Description)
+		if err != nil || rec.Value != "memory-high" || rec.Previous != "cpu-high" || rec.EventID != "memory-high-1" || rec.Time.IsZero() {
+			t.Fatalf("expected audit record of memory-high replacing cpu-high by memory-high-1, got: %+v (%v). %v", rec, err, failMark)
+		}
+		t.Logf("got expected audit record: %+v. %v", rec, passMark)
+	})
+}
+
+// TestTagHistory shows categorized tags with a history record changed names
+// with their date and keep the newest entries.
+func TestTagHistory(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		for name, cardinality := range map[string]string{"sizing": "SINGLE", "sizing-history": "MULTIPLE", "single-history": "SINGLE"} {
+			if _, err := m.CreateCategory(ctx, &tags.Category{Name: name, Cardinality: cardinality}); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		cfg := newCfg("password1234", false, "attach")
+
+		body := func(size, date string) []byte {
+			return []byte(`{"id":"` + date + `","subject":"VmReconfiguredEvent","time":"` + date + `T08:00:00Z","data":{"Size":"` + size + `"}}`)
+		}
+		sizing := func(history string) action {
+			return action{Type: actionTag, Tags: []categorizedTag{{
+				Category: "sizing",
+				Value:    "{event.data.Size}",
+				Create:   true,
+				History:  &tagHistory{Category: history, Keep: 2},
+			}}}
+		}
+
+		var tests = []struct {
+			testDesc  string
+			action    action
+			body      []byte
+			want      string
+			expectErr bool
+			wantTags  []string
+		}{
+			{
+				"Test that the first name is recorded with its date",
+				sizing("sizing-history"),
+				body("cpu-2", "2024-05-01"),
+				vm.Self.Value + " was tagged with sizing:cpu-2, sizing-history:cpu-2@2024-05-01",
+				false,
+				[]string{"sizing-history:cpu-2@2024-05-01", "sizing:cpu-2"},
+			},
+			{
+				"Test that an unchanged name is not recorded again",
+				sizing("sizing-history"),
+				body("cpu-2", "2024-05-08"),
+				vm.Self.Value + " was tagged with sizing:cpu-2",
+				false,
+				[]string{"sizing-history:cpu-2@2024-05-01", "sizing:cpu-2"},
+			},
+			{
+				"Test that a changed name is recorded",
+				sizing("sizing-history"),
+				body("cpu-4", "2024-06-01"),
+				vm.Self.Value + " was tagged with sizing:cpu-4, sizing-history:cpu-4@2024-06-01",
+				false,
+				[]string{"sizing-history:cpu-2@2024-05-01", "sizing-history:cpu-4@2024-06-01", "sizing:cpu-4"},
+			},
+			{
+				"Test that the oldest entries beyond keep are detached",
+				sizing("sizing-history"),
+				body("cpu-8", "2024-07-01"),
+				vm.Self.Value + " was tagged with sizing:cpu-8, sizing-history:cpu-8@2024-07-01",
+				false,
+				[]string{"sizing-history:cpu-4@2024-06-01", "sizing-history:cpu-8@2024-07-01", "sizing:cpu-8"},
+			},
+			{
+				"Test that a history category of single cardinality results in error",
+				sizing("single-history"),
+				body("cpu-16", "2024-08-01"),
+				"",
+				true,
+				[]string{"sizing-history:cpu-4@2024-06-01", "sizing-history:cpu-8@2024-07-01", "sizing:cpu-16"},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			r := &rule{Name: "sizing", Actions: []action{tc.action}}
+
+			ce := cloudEvent(t, tc.body)
+			got, err := runChain(withEventID(ctx, ce), cfg, r, client, vm.Self, tc.body, ce)
+
+			attached, listErr := m.GetAttachedTags(ctx, vm.Self)
+			if listErr != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, listErr)
+			}
+			var gotTags []string
+			for _, tag := range attached {
+				category, catErr := m.GetCategory(ctx, tag.CategoryID)
+				if catErr != nil {
+					t.Fatal("Test failing due to improper test setup.", failMark, catErr)
+				}
+				gotTags = append(gotTags, category.Name+":"+tag.Name)
+			}
+			sort.Strings(gotTags)
+
+			if got == tc.want && (err != nil) == tc.expectErr && reflect.DeepEqual(gotTags, tc.wantTags) {
+				t.Logf("got expected: %q, %v, tags %v. %v", got, err, gotTags, passMark)
+			} else {
+				t.Logf("expected: %q, tags %v, got: %q, %v, tags %v. %v", tc.want, tc.wantTags, got, err, gotTags, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that a history entry records the event and the entry it follows ===========")
+		tag, err := m.GetTag(ctx, "cpu-4@2024-06-01")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		rec, err := tagaudit.Parse(tag.Description)
+		if err != nil || rec.Value != "cpu-4" || rec.Previous != "cpu-2" || rec.EventID != "2024-06-01" || rec.Time.IsZero() {
+			t.Fatalf("expected audit record of cpu-4 following cpu-2 by 2024-06-01, got: %+v (%v). %v", rec, err, failMark)
+		}
+		t.Logf("got expected audit record: %+v. %v", rec, passMark)
+	})
+}
+
+// unavailableTransport answers every request like a vAPI endpoint which is
+// down.
+type unavailableTransport struct{}
+
+func (unavailableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// TestTagRetry shows tags failing while the vAPI endpoint is unavailable are
+// deferred without failing the remediation, and attached once the endpoint is
+// available again. Other tag failures still fail the chain.
+func TestTagRetry(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "veba", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "remediated", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		available := rc.Client.Client.Transport
+
+		cfg := newCfg("password1234", false, "attach")
+		cfg.Tag.URN = tagID
+		r := &rule{Name: "test", Actions: []action{
+			{Type: actionTag},
+			{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.remediated": "true"}},
+		}}
+		defer updateRetryQueue(ctx, cfg, func(q map[string]deferredTag) { clear(q) })
+
+		queued := func() int {
+			q, err := loadRetryQueue(ctx, cfg)
+			if err != nil {
+				t.Fatal(failMark, err)
+			}
+			return len(q)
+		}
+
+		var tests = []struct {
+			testDesc  string
+			retry     bool
+			down      bool
+			tagURN    string
+			want      string
+			expectErr bool
+			wantQueue int
+		}{
+			{
+				"Test that an unavailable vAPI fails the chain without retry",
+				false, true, "",
+				"",
+				true, 0,
+			},
+			{
+				"Test that the tag is deferred and the remediation runs with retry",
+				true, true, "",
+				"tag " + tagID + " of " + vm.Self.Value + " deferred, vAPI unavailable, " + vm.Self.Value + " was reconfigured",
+				false, 1,
+			},
+			{
+				"Test that a missing tag is not deferred",
+				true, false, "urn:vmomi:InventoryServiceTag:missing:GLOBAL",
+				"",
+				true, 1,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			cfg.TagRetry.IntervalSeconds = 0
+			if tc.retry {
+				cfg.TagRetry.IntervalSeconds = 60
+			}
+			rc.Client.Client.Transport = available
+			if tc.down {
+				rc.Client.Client.Transport = unavailableTransport{}
+			}
+			r.Actions[0].TagURN = tc.tagURN
+
+			got, err := runChain(ctx, cfg, r, client, vm.Self, nil, nil)
+			if n := queued(); got == tc.want && (err != nil) == tc.expectErr && n == tc.wantQueue {
+				t.Logf("got expected: %q, %v, %d queued. %v", got, err, n, passMark)
+			} else {
+				t.Logf("expected: %q, %d queued, got: %q, %v, %d queued. %v", tc.want, tc.wantQueue, got, err, n, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that deferred tags stay queued while the vAPI is unavailable ===========")
+		rc.Client.Client.Transport = unavailableTransport{}
+		err = retryTags(ctx, cfg, client, time.Now())
+		if err == nil || queued() != 1 {
+			t.Fatalf("expected an error and 1 queued tag, got: %v, %d. %v", err, queued(), failMark)
+		}
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+
+		t.Log("=========== Test that deferred tags are attached once the vAPI is available ===========")
+		rc.Client.Client.Transport = available
+		if err := retryTags(ctx, cfg, client, time.Now()); err != nil || queued() != 0 {
+			t.Fatalf("expected no error and no queued tag, got: %v, %d. %v", err, queued(), failMark)
+		}
+		attached, err := m.ListAttachedTags(ctx, vm.Self)
+		if err != nil || len(attached) != 1 || attached[0] != tagID {
+			t.Fatalf("expected tag %v, got: %v, %v. %v", tagID, attached, err, failMark)
+		}
+		t.Logf("got expected tags: %v. %v", attached, passMark)
+
+		t.Log("=========== Test that deferred tags expire ===========")
+		_, err = deferTag(ctx, cfg, r, vm.Self, tagID, nil, errors.New("503 Service Unavailable"))
+		if err == nil {
+			err = retryTags(ctx, cfg, client, time.Now().Add(deferredTagTTL+time.Minute))
+		}
+		if err != nil || queued() != 0 {
+			t.Fatalf("expected no error and no queued tag, got: %v, %d. %v", err, queued(), failMark)
+		}
+		t.Logf("got expected empty queue. %v", passMark)
+	})
+}
+
+// TestManagedBy shows objects changed by a rule carry the managed-by tag,
+// whose category and tag are created on first use and reused after, and that
+// the tag is protected from the garbage collection.
+func TestManagedBy(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+		m := tags.NewManager(rc)
+
+		cfg := newCfg("password1234", false, "attach")
+		cfg.ManagedByTag.Enabled = true
+		cfg.Heartbeat.Function = "audit-fn"
+		r := &rule{Name: "test", Actions: []action{
+			{Type: actionReconfigure, ExtraConfig: map[string]string{"veba.remediated": "true"}},
+		}}
+
+		var vms []types.ManagedObjectReference
+		for _, obj := range simulator.Map.All("VirtualMachine") {
+			vms = append(vms, obj.Reference())
+		}
+		if len(vms) < 2 {
+			t.Fatal("Test failing due to improper test setup.", failMark, vms)
+		}
+
+		var tests = []struct {
+			testDesc string
+			vm       types.ManagedObjectReference
+		}{
+			{"Test that the category and tag are created and attached", vms[0]},
+			{"Test that the tag is reused for the next object", vms[1]},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			ctx := withEventID(ctx, cloudEvent(t, []byte(`{"id":"`+tc.vm.Value+`","subject":"VmPoweredOnEvent","data":{}}`)))
+			if _, err := runChain(ctx, cfg, r, client, tc.vm, nil, nil); err != nil {
+				t.Fatal(failMark, err)
+			}
+
+			attached, err := m.GetAttachedTags(ctx, tc.vm)
+			if err == nil && len(attached) == 1 && attached[0].Name == "veba-audit-fn" {
+				t.Logf("got expected tag: %v. %v", attached[0].Name, passMark)
+			} else {
+				t.Logf("expected tag veba-audit-fn, got: %v, %v. %v", attached, err, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that one tag exists in the managed-by category ===========")
+		category, err := m.GetCategory(ctx, defaultManagedByCategory)
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		ids, err := m.ListTagsForCategory(ctx, category.ID)
+		if err != nil || len(ids) != 1 || category.Cardinality != "MULTIPLE" {
+			t.Fatalf("expected 1 tag in a MULTIPLE category, got: %v, %v, %v. %v", ids, category.Cardinality, err, failMark)
+		}
+		t.Logf("got expected tag: %v. %v", ids, passMark)
+
+		t.Log("=========== Test that the managed-by tag records the event which created it ===========")
+		tag, err := m.GetTag(ctx, ids[0])
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		rec, err := tagaudit.Parse(tag.Description)
+		if err != nil || rec.Value != "veba-audit-fn" || rec.EventID != vms[0].Value || rec.Time.IsZero() {
+			t.Fatalf("expected audit record of %v by %v, got: %+v (%v). %v", "veba-audit-fn", vms[0].Value, rec, err, failMark)
+		}
+		t.Logf("got expected audit record: %+v. %v", rec, passMark)
+
+		t.Log("=========== Test that the managed-by tag is protected ===========")
+		if client.protectedTags(ctx, cfg)[ids[0]] {
+			t.Logf("got expected protected tag. %v", passMark)
+		} else {
+			t.Logf("expected tag %v to be protected. %v", ids[0], failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestSelfTest shows the self-test reports the failed checks and runs the
+// checks independent of them.
+func TestSelfTest(t *testing.T) {
+	t.Log("=========== Test that privileges follow the configured actions ===========")
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Alarm.Acknowledge = true
+	cfg.GC.IntervalSeconds = 60
+	want := []string{"Alarm.Acknowledge", "InventoryService.Tagging.AttachTag", "InventoryService.Tagging.DeleteTag"}
+	if got := cfg.requiredPrivileges(); reflect.DeepEqual(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+
+	var notified notify.Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&notified)
+	}))
+	defer srv.Close()
+
+	err := simfixtures.Test(simfixtures.Default(), func(ctx context.Context, inv *simfixtures.Inventory) {
+		u := inv.Client.URL()
+		user := simulator.DefaultLogin.Username()
+		password, _ := simulator.DefaultLogin.Password()
+
+		// Only notify, so no privileges are required, which the
+		// simulator cannot check.
+		config := func(urn string) string {
+			return fmt.Sprintf(`[vcenter]
+server = %q
+user = %q
+password = %q
+insecure = true
+
+[tag]
+urn = %q
+action = "attach"
+
+[notify]
+webhook_url = %q
+
+[[rules]]
+name = "notify"
+
+  [[rules.actions]]
+  type = "notify"
+`, u.Host, user, password, urn, srv.URL)
+		}
+
+		var tests = []struct {
+			testDesc string
+			config   string
+			wantErr  string
+		}{
+			{"Test that a valid config and environment pass", config(inv.Tags["veba:remediated"]), ""},
+			{"Test that a missing tag fails only the categories", config("urn:vmomi:InventoryServiceTag:00000000-0000-0000-0000-000000000000:GLOBAL"), "self-test failed: categories"},
+			{"Test that an invalid config stops the self-test", "[vcenter]", "self-test failed: config"},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			path := filepath.Join(t.TempDir(), "vcconfig.toml")
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			notified = notify.Message{}
+
+			err := selfTest(ctx, path)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			wantNotified := tc.wantErr != "self-test failed: config"
+			if got == tc.wantErr && (notified.Title == "Self-test") == wantNotified {
+				t.Logf("got expected: %q, notified %v. %v", got, wantNotified, passMark)
+			} else {
+				t.Logf("expected: %q, got: %q, notification %+v. %v", tc.wantErr, got, notified, failMark)
+				t.Fail()
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// TestOptedIn shows VMs are opted in by the tag on themselves or on one of
+// their folders.
+func TestOptedIn(t *testing.T) {
+	// web-01 is tagged itself, web-02 by its folder.
+	err := simfixtures.Test(simfixtures.Default(), func(ctx context.Context, inv *simfixtures.Inventory) {
+		client := &vsClient{govmomi: &govmomi.Client{Client: inv.Client}, rest: inv.REST, restSession: true}
+
+		refs := []types.ManagedObjectReference{inv.VMs["web-01"], inv.VMs["web-02"], inv.VMs["web-03"]}
+		want := map[string]bool{refs[0].Value: true, refs[1].Value: true}
+
+		for _, tag := range []string{"veba:auto-remediate", inv.Tags["veba:auto-remediate"]} {
+			t.Logf("=========== Test that tagged VMs and VMs of tagged folders are opted in by %v ===========", tag)
+			cfg := newCfg("password1234", false, "attach")
+			cfg.OptIn.Tag = tag
+
+			got, err := client.optedIn(ctx, cfg, refs)
+			if err != nil {
+				t.Fatal(failMark, err)
+			}
+
+			if reflect.DeepEqual(got, want) {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+				t.Fail()
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// TestRESTClient ensures a client of the vAPI REST endpoints only detects
+// system VMs by name and rejects operations which require the SOAP API.
+func TestRESTClient(t *testing.T) {
+	vms := map[string]string{
+		"vm-1": `{"value":{"name":"vCLS-1a2b","power_state":"POWERED_ON","cpu":{"count":1},"memory":{"size_MiB":128}}}`,
+		"vm-2": `{"value":{"name":"web-01","power_state":"POWERED_ON","cpu":{"count":2},"memory":{"size_MiB":4096}}}`,
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/rest/com/vmware/cis/session" && r.URL.Query().Get("~action") == "get":
+			fmt.Fprint(w, `{"value":{"user":"admin@vsphere.local"}}`)
+		case r.URL.Path == "/rest/com/vmware/cis/session":
+			fmt.Fprint(w, `{"value":"session-1"}`)
+		case strings.HasPrefix(r.URL.Path, "/rest/vcenter/vm/") && vms[r.URL.Path[len("/rest/vcenter/vm/"):]] != "":
+			fmt.Fprint(w, vms[r.URL.Path[len("/rest/vcenter/vm/"):]])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	u := url.URL{Scheme: "https", Host: srv.Listener.Addr().String(), Path: "sdk", User: url.UserPassword("admin@vsphere.local", "password1234")}
+
+	clt, err := newRESTClient(ctx, u, true, false, "")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	t.Log("=========== Test that the REST session is active ===========")
+	if clt.active(ctx) {
+		t.Logf("got expected: active session. %v", passMark)
+	} else {
+		t.Logf("expected active session. %v", failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that system VMs are detected by name ===========")
+	refs := []types.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+	reasons, err := clt.systemVMs(ctx, &vcConfig{}, refs)
+	if err == nil && reasons["vm-1"] != "" && reasons["vm-2"] == "" {
+		t.Logf("got expected: %v. %v", reasons, passMark)
+	} else {
+		t.Logf("expected vm-1 to be a system VM, got: %v, %v. %v", reasons, err, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that reconfiguring requires the SOAP API ===========")
+	err = clt.reconfigure(ctx, refs[1], map[string]string{"veba.tagged": "true"})
+	if errors.Is(err, errSOAPRequired) {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected %v, got: %v. %v", errSOAPRequired, err, failMark)
+		t.Fail()
+	}
+}
+
+// TestSessionBroker ensures replicas share the sessions of the broker instead
+// of logging in and redial once the broker session was lost.
+func TestSessionBroker(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		srv := httptest.NewServer(http.HandlerFunc(serveTicket))
+		defer srv.Close()
+		defer brokerConn.close("shutdown")
+
+		password, _ := simulator.DefaultLogin.Password()
+		path := filepath.Join(t.TempDir(), "vcconfig.toml")
+		toml := fmt.Sprintf(`[vcenter]
+server = %q
+user = %q
+password = %q
+insecure = true
+
+[tag]
+urn = "urn:vmomi:InventoryServiceTag:11f16f36-f5c4-4c29-b7d3-d9c7d12babe6:GLOBAL"
+action = "attach"
+
+[connection]
+broker_url = %q
+broker_token = "s3cret"
+`, vc.URL().Host, simulator.DefaultLogin.Username(), password, srv.URL)
+		if err := os.WriteFile(path, []byte(toml), 0o600); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		t.Setenv("vcconfig_path", path)
+
+		cfg, err := loadTomlCfg(path)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		t.Log("=========== Test that tickets require the broker token ===========")
+		wrong := *cfg
+		wrong.Connection.BrokerToken = "wrong"
+		if _, err := fetchTicket(ctx, &wrong, ""); err != nil && strings.Contains(err.Error(), "401") {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected 401, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that replicas share the session of the broker ===========")
+		var replicas []*vsClient
+		for i := 0; i < 2; i++ {
+			clt, err := dialVSphere(ctx, cfg)
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			replicas = append(replicas, clt)
+		}
+		broker := brokerConn.client
+		if broker != nil && replicas[0].session == broker.session && replicas[1].session == broker.session {
+			t.Logf("got expected: session %v shared. %v", broker.session, passMark)
+		} else {
+			t.Logf("expected the session of the broker, got: %v, %v. %v", replicas[0].session, replicas[1].session, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that replicas tag with the REST session of the broker ===========")
+		m, err := replicas[0].tagManager(ctx)
+		if err == nil {
+			_, err = m.GetCategories(ctx)
+		}
+		if err == nil {
+			t.Logf("got expected: categories listed. %v", passMark)
+		} else {
+			t.Logf("expected categories listed, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that replicas do not log out of the shared session ===========")
+		if err := replicas[0].logout(ctx); err == nil && broker.active(ctx) && replicas[1].active(ctx) {
+			t.Logf("got expected: session still active. %v", passMark)
+		} else {
+			t.Logf("expected the session kept, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that replicas redial once the broker session was lost ===========")
+		if err := broker.govmomi.Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		lost := !replicas[1].active(ctx)
+		clt, err := dialVSphere(ctx, cfg)
+		if lost && err == nil && clt.active(ctx) && clt.session != broker.session {
+			t.Logf("got expected: new session %v. %v", clt.session, passMark)
+		} else {
+			t.Logf("expected a new active session, got: lost %v, %v. %v", lost, err, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestBulkResult ensures responses of bulk actions count all VMs, but only
+// include up to max per-VM results, failures first.
+func TestBulkResult(t *testing.T) {
+	var res bulkResult
+	for i := 1; i <= 5; i++ {
+		res.add(fmt.Sprintf("vm-%d", i), nil)
+	}
+	res.add("vm-6", errors.New("not found"))
+	res.add("vm-7", errors.New("not found"))
+
+	var tests = []struct {
+		testDesc string
+		max      int
+		want     string
+	}{
+		{"Test that all results are included up to max", 10, "failed: vm-6: not found, vm-7: not found; done: vm-1, vm-2, vm-3, vm-4, vm-5"},
+		{"Test that results beyond max are counted", 4, "failed: vm-6: not found, vm-7: not found; done: vm-1, vm-2 and 3 more"},
+		{"Test that failures are included first", 1, "failed: vm-6: not found and 1 more; done: 5 VM(s)"},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := res.details(tc.max)
+		if got == tc.want && res.total() == 7 {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the error has all failures ===========")
+	if err := res.err(); err != nil && strings.Contains(err.Error(), "vm-6") && strings.Contains(err.Error(), "vm-7") {
+		t.Logf("got expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected error of vm-6 and vm-7, got: %v. %v", err, failMark)
+		t.Fail()
+	}
+}
+
+// TestOrphanedTags shows tags of the category of the configured tag are
+// orphaned if they are attached to no object or only to deleted VMs, unless
+// vcconfig.toml references them.
+func TestOrphanedTags(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "veba", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		ids := map[string]string{}
+		for _, name := range []string{"configured", "attached", "host", "unused", "stale"} {
+			ids[name], err = m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: categoryID})
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+		}
+
+		vms, err := find.NewFinder(c).VirtualMachineList(ctx, "*")
+		if err != nil || len(vms) < 2 {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		hosts, err := find.NewFinder(c).HostSystemList(ctx, "*")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// The stale tag is only attached to a VM which is deleted afterwards.
+		err = m.AttachTag(ctx, ids["attached"], vms[0])
+		if err == nil {
+			err = m.AttachTag(ctx, ids["host"], hosts[0])
+		}
+		if err == nil {
+			err = m.AttachTag(ctx, ids["stale"], vms[1])
+		}
+		if err == nil {
+			var task *object.Task
+			task, err = vms[1].PowerOff(ctx)
+			if err == nil {
+				err = task.Wait(ctx)
+			}
+		}
+		if err == nil {
+			var task *object.Task
+			task, err = vms[1].Destroy(ctx)
+			if err == nil {
+				err = task.Wait(ctx)
+			}
+		}
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		cfg := newCfg("password1234", false, "attach")
+		cfg.Tag.URN = ids["configured"]
+
+		t.Log("=========== Test that unused tags and tags of deleted VMs are orphaned ===========")
+		orphaned, err := client.orphanedTags(ctx, cfg)
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+
+		var got []string
+		for _, tag := range orphaned {
+			got = append(got, tag.Name)
+		}
+		sort.Strings(got)
+
+		if want := []string{"stale", "unused"}; reflect.DeepEqual(got, want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// alarmManager is an AlarmManager for vcsim, which has none. It acknowledges
+// the alarms it knows and counts the acknowledgements.
+type alarmManager struct {
+	mo.AlarmManager
+
+	alarms map[string]bool
+	acked  map[string]int
+}
+
+func (m *alarmManager) AcknowledgeAlarm(req *types.AcknowledgeAlarm) soap.HasFault {
+	if !m.alarms[req.Alarm.Value] {
+		return &methods.AcknowledgeAlarmBody{Fault_: simulator.Fault("", &types.ManagedObjectNotFound{Obj: req.Alarm})}
+	}
+	m.acked[req.Alarm.Value]++
+
+	return &methods.AcknowledgeAlarmBody{Res: &types.AcknowledgeAlarmResponse{}}
+}
+
+// TestAcknowledge shows alarms which turned yellow or red are acknowledged,
+// also repeatedly, and unknown alarms result in error.
+func TestAcknowledge(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		m := &alarmManager{alarms: map[string]bool{"alarm-1": true}, acked: map[string]int{}}
+		m.Self = *c.ServiceContent.AlarmManager
+		simulator.Map.Put(m)
+
+		body := func(alarm, to string) []byte {
+			return []byte(`{"subject":"AlarmStatusChangedEvent","data":{"Alarm":{"Name":"cpu-high","Alarm":{"Type":"Alarm","Value":"` + alarm +
+				`"}},"Entity":{"Name":"` + vm.Name + `","Entity":{"Type":"VirtualMachine","Value":"` + vm.Self.Value + `"}},"To":"` + to + `"}}`)
+		}
+
+		var tests = []struct {
+			testDesc  string
+			body      []byte
+			expectErr bool
+			want      string
+			wantAcked int
+		}{
+			{"Test that an alarm which turned red is acknowledged", body("alarm-1", "red"), false, `alarm "cpu-high" acknowledged`, 1},
+			{"Test that an acknowledged alarm can be acknowledged again", body("alarm-1", "yellow"), false, `alarm "cpu-high" acknowledged`, 2},
+			{"Test that an alarm which turned green is not acknowledged", body("alarm-1", "green"), false, "", 2},
+			{"Test that an unknown alarm results in error", body("alarm-2", "red"), true, "", 2},
+			{"Test that other events are not acknowledged", []byte(`{"subject":"VmPoweredOnEvent","data":{}}`), false, "", 2},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			cfg := newCfg("password1234", false, "acknowledge")
+
+			got, err := acknowledge(ctx, cfg, client, cloudEvent(t, tc.body))
+			if (err != nil) == tc.expectErr && got == tc.want && m.acked["alarm-1"] == tc.wantAcked {
+				t.Logf("got expected: %q, %d acknowledged (%v). %v", got, m.acked["alarm-1"], err, passMark)
+			} else {
+				t.Logf("expected: %q, %d acknowledged, got: %q, %d (%v). %v", tc.want, tc.wantAcked, got, m.acked["alarm-1"], err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// rejectAttachTransport fails AttachTag like vCenter versions which reject
+// attaching an already attached tag, and passes other requests to next.
+type rejectAttachTransport struct {
+	next http.RoundTripper
+}
+
+func (rt rejectAttachTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.RawQuery, "action=attach") {
+		return &http.Response{
+			Status:     "400 Bad Request",
+			StatusCode: http.StatusBadRequest,
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// TestTagAction shows the tag action attaches the tag and, with [tag] action
+// = "detach", detaches it.
+func TestTagAction(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		client := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc, restSession: true}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "veba", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "remediated", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		r := &rule{Name: defaultRuleName, Actions: []action{{Type: actionTag}}}
+
+		var tests = []struct {
+			testDesc string
+			action   string
+			want     string
+			attached int
+		}{
+			{"Test that the tag is attached", "attach", vm.Self.Value + " was tagged with " + tagID, 1},
+			{"Test that the tag is detached with action detach", "detach", tagID + " was detached from " + vm.Self.Value, 0},
+			{"Test that detaching a detached tag succeeds", "detach", tagID + " was detached from " + vm.Self.Value, 0},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			cfg := newCfg("password1234", false, tc.action)
+			cfg.Tag.URN = tagID
+
+			got, err := runAction(ctx, cfg, r, r.Actions[0], client, vm.Self, nil, nil, nil)
+			attached, listErr := m.GetAttachedTags(ctx, vm.Self)
+			if listErr != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, listErr)
+			}
+
+			if err == nil && got == tc.want && len(attached) == tc.attached {
+				t.Logf("got expected: %q, %d attached tag(s). %v", got, len(attached), passMark)
+			} else {
+				t.Logf("expected: %q, %d attached tag(s), got: %q, %d (%v). %v", tc.want, tc.attached, got, len(attached), err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestAttachTagTwice shows attaching an already attached tag succeeds and is
+// counted, while failures of tags which are not attached are returned.
+func TestAttachTagTwice(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "veba", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		var tagIDs []string
+		for _, name := range []string{"remediated", "reviewed"} {
+			id, err := m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: categoryID})
+			if err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+			tagIDs = append(tagIDs, id)
+		}
+
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		available := rc.Client.Client.Transport
+		defer func() { rc.Client.Client.Transport = available }()
+
+		var tests = []struct {
+			testDesc    string
+			reject      bool
+			tagID       string
+			expectErr   bool
+			wantCounted int64
+		}{
+			{"Test that a tag is attached", false, tagIDs[0], false, 0},
+			{"Test that attaching the tag again succeeds and is counted", true, tagIDs[0], false, 1},
+			{"Test that a rejected tag which is not attached results in error", true, tagIDs[1], true, 0},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			rc.Client.Client.Transport = available
+			if tc.reject {
+				rc.Client.Client.Transport = rejectAttachTransport{next: available}
+			}
+
+			before := tagAlreadyAttached.Value()
+			err := attachTag(ctx, m, tc.tagID, vm)
+			counted := tagAlreadyAttached.Value() - before
+
+			rc.Client.Client.Transport = available
+			attached, lerr := m.ListAttachedTags(ctx, vm)
+			if lerr != nil {
+				t.Fatal(failMark, lerr)
+			}
+			found := false
+			for _, id := range attached {
+				found = found || id == tc.tagID
+			}
+
+			if (err != nil) == tc.expectErr && found == !tc.expectErr && counted == tc.wantCounted {
+				t.Logf("got expected: attached %v, %d counted (%v). %v", found, counted, err, passMark)
+			} else {
+				t.Logf("expected: attached %v, %d counted, got: %v, %d (%v). %v", !tc.expectErr, tc.wantCounted, found, counted, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestOutboundClient shows the sinks of all invocations share one client while
+// the [outbound] section is unchanged.
+func TestOutboundClient(t *testing.T) {
+	cfg := newCfg("password1234", false, "attach")
+	cfg.Notify.WebhookURL = "https://hooks.local.corp/veba"
+	cfg.Incident.PagerDutyRoutingKey = "r1"
+	cfg.DeadLetter.WebhookURL = "https://hooks.local.corp/deadletter"
+
+	client := func() *http.Client {
+		sinks, err := notifiers(cfg)
+		if err != nil || len(sinks) != 1 {
+			t.Fatal(failMark, err)
+		}
+		return sinks[0].(*notify.Webhook).Client
+	}
+
+	t.Log("=========== Test that invocations reuse the client ===========")
+	first := client()
+	incidents, err := incidentSinks(cfg)
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	deadLetters, err := deadLetterSinks(cfg)
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	if client() != first || incidents[0].(*incident.PagerDuty).Client != first || deadLetters[0].(*deadletter.Webhook).Client != first {
+		t.Fatalf("expected the sinks to share one client. %v", failMark)
+	}
+	t.Logf("got expected: one client. %v", passMark)
+
+	t.Log("=========== Test that a changed [outbound] section builds a new client ===========")
+	cfg.Outbound.TimeoutSeconds = 3
+	if second := client(); second == first || second.Timeout != 3*time.Second {
+		t.Fatalf("expected a new client with timeout 3s. %v", failMark)
+	}
+	t.Logf("got expected: new client. %v", passMark)
+}
@@ -0,0 +1,156 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Defaults of the [heartbeat] section in vcconfig.toml.
+const (
+	defaultHeartbeatInterval = time.Minute
+	defaultFunctionName      = "gotag-fn"
+	heartbeatType            = "com.vmware.veba.function.heartbeat.v0"
+)
+
+var (
+	heartbeatOnce sync.Once // For heartbeat() to be started once.
+	started       = time.Now()
+)
+
+// heartbeatData is the data of a heartbeat CloudEvent.
+type heartbeatData struct {
+	Function      string                     `json:"function"`
+	Instance      string                     `json:"instance"`
+	UptimeSeconds int64                      `json:"uptime_seconds"`
+	Counters      map[string]json.RawMessage `json:"counters"`
+}
+
+// heartbeatEvent is a liveness CloudEvent.
+type heartbeatEvent struct {
+	ID              string        `json:"id"`
+	Source          string        `json:"source"`
+	SpecVersion     string        `json:"specversion"`
+	Type            string        `json:"type"`
+	Time            time.Time     `json:"time"`
+	DataContentType string        `json:"datacontenttype"`
+	Data            heartbeatData `json:"data"`
+}
+
+// heartbeat posts a liveness CloudEvent to the configured URL until ctx is
+// done. The config is reloaded before every heartbeat, so enabling,
+// disabling or changing the interval does not require a restart.
+func heartbeat(ctx context.Context, path string) {
+	for {
+		interval := defaultHeartbeatInterval
+
+		cfg, err := activeCfg(path)
+		if err == nil {
+			if cfg.Heartbeat.IntervalSeconds > 0 {
+				interval = time.Duration(cfg.Heartbeat.IntervalSeconds) * time.Second
+			}
+
+			if cfg.Heartbeat.URL != "" {
+				if err := sendHeartbeat(ctx, cfg, time.Now()); err != nil {
+					slog.Debug("heartbeat failed", "err", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sendHeartbeat posts a heartbeat for now to the configured URL.
+func sendHeartbeat(ctx context.Context, cfg *vcConfig, now time.Time) error {
+	body, err := json.Marshal(newHeartbeat(cfg, now))
+	if err != nil {
+		return fmt.Errorf("encoding heartbeat failed: %w", err)
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Heartbeat.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating heartbeat request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+
+	res, err := clt.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending heartbeat failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("heartbeat rejected: %v", res.Status)
+	}
+
+	return nil
+}
+
+// newHeartbeat returns the heartbeat at now with the counters of the function.
+func newHeartbeat(cfg *vcConfig, now time.Time) heartbeatEvent {
+	name := cfg.functionName()
+
+	// The pod name distinguishes the replicas of the function.
+	instance, _ := os.Hostname()
+
+	counters := map[string]json.RawMessage{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch kv.Key {
+		case "cmdline", "memstats":
+			return
+		}
+		counters[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+
+	return heartbeatEvent{
+		ID:              newID(),
+		Source:          "veba/function/" + name,
+		SpecVersion:     "1.0",
+		Type:            heartbeatType,
+		Time:            now.UTC(),
+		DataContentType: "application/json",
+		Data: heartbeatData{
+			Function:      name,
+			Instance:      instance,
+			UptimeSeconds: int64(now.Sub(started).Seconds()),
+			Counters:      counters,
+		},
+	}
+}
+
+// functionName returns the name of the function, which identifies it in
+// heartbeats and dead letters.
+func (cfg *vcConfig) functionName() string {
+	if cfg.Heartbeat.Function == "" {
+		return defaultFunctionName
+	}
+
+	return cfg.Heartbeat.Function
+}
+
+// newID returns a random CloudEvent ID.
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
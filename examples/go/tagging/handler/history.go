@@ -0,0 +1,135 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// History tags are named <name>@<date>, e.g. 4cpu@2024-05-01.
+const (
+	historySeparator = "@"
+	historyLayout    = "2006-01-02"
+)
+
+// tagHistory keeps the last names of a categorized tag as tags of another
+// category, so the growth of a VM shows in vSphere.
+type tagHistory struct {
+	// Category is the name of the history category. It must have multiple
+	// cardinality, since a VM carries several entries.
+	Category string `json:"category"`
+	// Keep is the number of entries kept per VM, older entries are
+	// detached.
+	Keep int `json:"keep"`
+}
+
+// historyEntry is a history tag attached to a VM.
+type historyEntry struct {
+	tag  tags.Tag
+	name string    // the name of the categorized tag
+	at   time.Time // the date the name was applied
+}
+
+// parseHistoryTag splits the history tag t into the name and the date it was
+// applied. Tags of other names are no entries.
+func parseHistoryTag(t tags.Tag) (historyEntry, bool) {
+	i := strings.LastIndex(t.Name, historySeparator)
+	if i <= 0 {
+		return historyEntry{}, false
+	}
+
+	at, err := time.Parse(historyLayout, t.Name[i+len(historySeparator):])
+	if err != nil {
+		return historyEntry{}, false
+	}
+
+	return historyEntry{tag: t, name: t.Name[:i], at: at}, true
+}
+
+// recordHistory attaches the history tag of name, applied at, to the VM and
+// detaches the oldest entries beyond h.Keep. Nothing is recorded if name is
+// the newest entry already, so the history lists changes only. It returns the
+// name of the attached history tag, empty if none was attached.
+func (clt *vsClient) recordHistory(ctx context.Context, vm types.ManagedObjectReference, h tagHistory, name string, at time.Time) (string, error) {
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	c, err := m.GetCategory(ctx, h.Category)
+	traceFrom(ctx).call("GetCategory", start, err)
+	if err != nil {
+		return "", fmt.Errorf("history category %q not found: %w", h.Category, err)
+	}
+	if c.Cardinality == "SINGLE" {
+		return "", fmt.Errorf("history category %v must have multiple cardinality", c.Name)
+	}
+
+	start = time.Now()
+	attached, err := m.GetAttachedTags(ctx, vm)
+	traceFrom(ctx).call("GetAttachedTags", start, err)
+	if err != nil {
+		return "", fmt.Errorf("list tags of VM failed: %w", err)
+	}
+
+	var entries []historyEntry
+	for _, t := range attached {
+		if t.CategoryID != c.ID {
+			continue
+		}
+		if e, ok := parseHistoryTag(t); ok {
+			entries = append(entries, e)
+		}
+	}
+	// Newest first. Entries of the same date keep their order, the newest
+	// entry of a date cannot be told apart by its name.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.After(entries[j].at) })
+
+	if len(entries) > 0 && entries[0].name == name {
+		return "", nil
+	}
+
+	entryName := name + historySeparator + at.UTC().Format(historyLayout)
+	id, err := tagInCategory(ctx, m, c, entryName)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		var previous string
+		if len(entries) > 0 {
+			previous = entries[0].name
+		}
+
+		start = time.Now()
+		id, err = m.CreateTag(ctx, &tags.Tag{Name: entryName, CategoryID: c.ID, Description: auditDescription(ctx, name, previous)})
+		traceFrom(ctx).call("CreateTag", start, err)
+		if err != nil {
+			return "", fmt.Errorf("create history tag %q in category %v failed: %w", entryName, c.Name, err)
+		}
+	}
+
+	if err := attachTag(ctx, m, id, vm); err != nil {
+		return "", fmt.Errorf("attach history tag to VM failed: %w", err)
+	}
+
+	// The new entry is kept, so h.Keep-1 of the older entries remain.
+	for i, e := range entries {
+		if i < h.Keep-1 || e.tag.ID == id {
+			continue
+		}
+		start = time.Now()
+		err := m.DetachTag(ctx, e.tag.ID, vm)
+		traceFrom(ctx).call("DetachTag", start, err)
+		if err != nil {
+			return "", fmt.Errorf("detach history tag %v failed: %w", e.tag.Name, err)
+		}
+	}
+
+	return entryName, nil
+}
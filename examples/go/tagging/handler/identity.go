@@ -0,0 +1,154 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// writeConn is the connection of the write identity. It is only used when
+// [vcenter.write] credentials are configured, so that vCenter audit logs
+// attribute mutations, e.g. attaching tags or acknowledging alarms, to a
+// different principal than the reads deciding about them.
+var writeConn = &connection{dial: dialVSphere}
+
+// credentials are the user and password of an identity.
+type credentials struct {
+	User     string
+	Password string
+}
+
+// identities are the connections of the [vcenter.identities] by name, created
+// when a rule first uses them.
+var identities = struct {
+	sync.Mutex
+	conns map[string]*connection
+	// dial creates the clients of new connections, it is replaced in tests.
+	dial func(ctx context.Context, cfg *vcConfig) (*vsClient, error)
+}{conns: map[string]*connection{}, dial: dialVSphere}
+
+// writeIdentity returns cfg with the credentials of the write identity or nil
+// if none are configured. The write identity always logs in itself, the
+// session broker only shares the session of the read identity.
+func (cfg *vcConfig) writeIdentity() *vcConfig {
+	if cfg.VCenter.Write.User == "" {
+		return nil
+	}
+
+	w := *cfg
+	w.VCenter.User = cfg.VCenter.Write.User
+	w.VCenter.Password = cfg.VCenter.Write.Password
+	w.Connection.BrokerURL = ""
+
+	return &w
+}
+
+// writer returns the client and connection for mutations. Without a write
+// identity, the read client is used.
+func writer(ctx context.Context, cfg *vcConfig, reader *vsClient) (*vsClient, *connection, error) {
+	w := cfg.writeIdentity()
+	if w == nil {
+		return reader, conn, nil
+	}
+
+	clt, err := writeConn.get(ctx, w)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clt, writeConn, nil
+}
+
+// identity returns cfg with the credentials of the identity name or nil if
+// there is no such identity. Like the write identity, it logs in itself.
+func (cfg *vcConfig) identity(name string) *vcConfig {
+	c, ok := cfg.VCenter.Identities[name]
+	if !ok {
+		return nil
+	}
+
+	id := *cfg
+	id.VCenter.User = c.User
+	id.VCenter.Password = c.Password
+	id.Connection.BrokerURL = ""
+
+	return &id
+}
+
+// identityUser returns the user actions of r run as.
+func (cfg *vcConfig) identityUser(r *rule) string {
+	if r != nil && r.Identity != "" {
+		return cfg.VCenter.Identities[r.Identity].User
+	}
+	if w := cfg.writeIdentity(); w != nil {
+		return w.VCenter.User
+	}
+
+	return cfg.VCenter.User
+}
+
+// ruleClient returns the client and connection of the identity of r. Rules
+// without identity use client, whose connection is managed by the caller, so
+// the returned connection is nil.
+func ruleClient(ctx context.Context, cfg *vcConfig, r *rule, client *vsClient) (*vsClient, *connection, error) {
+	if r == nil || r.Identity == "" {
+		return client, nil, nil
+	}
+
+	id := cfg.identity(r.Identity)
+	if id == nil {
+		return nil, nil, fmt.Errorf("unknown identity %q", r.Identity)
+	}
+
+	identities.Lock()
+	c, ok := identities.conns[r.Identity]
+	if !ok {
+		c = &connection{dial: identities.dial}
+		identities.conns[r.Identity] = c
+	}
+	identities.Unlock()
+
+	clt, err := c.get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clt, c, nil
+}
+
+// identityConnections returns the connections of the identities of rules.
+func identityConnections() []*connection {
+	identities.Lock()
+	defer identities.Unlock()
+
+	names := make([]string, 0, len(identities.conns))
+	for name := range identities.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conns := make([]*connection, 0, len(names))
+	for _, name := range names {
+		conns = append(conns, identities.conns[name])
+	}
+
+	return conns
+}
+
+// validateIdentities ensures the write identity and the identities of rules
+// are complete.
+func validateIdentities(cfg vcConfig) error {
+	if cfg.VCenter.Write.User != "" && cfg.VCenter.Write.Password == "" {
+		return errors.New("required field(s) missing, including vcenter write password")
+	}
+
+	for name, c := range cfg.VCenter.Identities {
+		if c.User == "" || c.Password == "" {
+			return fmt.Errorf("required field(s) missing, including user and password of vcenter identity %q", name)
+		}
+	}
+
+	return nil
+}
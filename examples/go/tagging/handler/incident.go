@@ -0,0 +1,100 @@
+package function
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/incident"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// incidentSinks returns the sinks configured in the [incident] section. All
+// sinks share one client built from the [outbound] section.
+func incidentSinks(cfg *vcConfig) ([]incident.Sink, error) {
+	c := cfg.Incident
+	if c.PagerDutyRoutingKey == "" && c.OpsgenieAPIKey == "" {
+		return nil, nil
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []incident.Sink
+	if c.PagerDutyRoutingKey != "" {
+		sinks = append(sinks, &incident.PagerDuty{RoutingKey: c.PagerDutyRoutingKey, Client: clt})
+	}
+	if c.OpsgenieAPIKey != "" {
+		sinks = append(sinks, &incident.Opsgenie{APIKey: c.OpsgenieAPIKey, URL: c.OpsgenieURL, Client: clt})
+	}
+
+	return sinks, nil
+}
+
+// escalate opens an incident if tagging for an alarm failed and resolves it
+// once the alarm turned green or gray. Other events are not escalated, as
+// their incidents would never be resolved. Errors of the sinks are logged
+// only.
+func escalate(ctx context.Context, cfg *vcConfig, ce *vevents.CloudEvent, ref types.ManagedObjectReference, cause error) {
+	if ce == nil || ce.Kind() != vevents.KindAlarm {
+		return
+	}
+
+	alarm, err := ce.Alarm()
+	if err != nil {
+		return
+	}
+
+	resolve := alarm.Turned(types.ManagedEntityStatusGreen) || alarm.Turned(types.ManagedEntityStatusGray)
+	if !resolve && cause == nil {
+		return
+	}
+
+	sinks, err := incidentSinks(cfg)
+	if err != nil {
+		slog.Error("incident sinks not available", "err", err)
+		return
+	}
+
+	key := incident.Key(ref.Value, alarm.Alarm.Alarm.Value)
+	tr := traceFrom(ctx)
+
+	for _, s := range sinks {
+		start := time.Now()
+		if resolve {
+			err = s.Resolve(ctx, key)
+			tr.call("resolve incident", start, err)
+		} else {
+			err = s.Trigger(ctx, incident.Incident{
+				Key:      key,
+				Summary:  "Automated tagging of " + ref.Value + " for alarm " + alarm.Alarm.Name + " failed",
+				Source:   ref.Value,
+				Severity: severityOf(alarm),
+				Details: map[string]string{
+					"alarm":  alarm.Alarm.Name,
+					"status": alarm.To,
+					"tag":    cfg.Tag.URN,
+					"action": cfg.Tag.Action,
+					"error":  cause.Error(),
+				},
+			})
+			tr.call("trigger incident", start, err)
+		}
+
+		if err != nil {
+			slog.Error("incident failed", "key", key, "err", err)
+		}
+	}
+}
+
+// severityOf maps the alarm status to the incident severity.
+func severityOf(a *vevents.Alarm) string {
+	if a.Turned(types.ManagedEntityStatusRed) {
+		return incident.SeverityCritical
+	}
+
+	return incident.SeverityWarning
+}
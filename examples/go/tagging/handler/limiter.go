@@ -0,0 +1,152 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// limiter is a token bucket limiting the requests to one vCenter. It is shared
+// by all clients and goroutines of the function talking to that vCenter, so
+// event storms do not trip the session and task limits of vCenter.
+type limiter struct {
+	mu     sync.Mutex
+	qps    float64 // 0 disables the limiter
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*limiter{} // by vCenter server
+)
+
+// limiterFor returns the limiter of the vCenter of cfg, configured with the
+// current [connection] qps and burst.
+func limiterFor(cfg *vcConfig) *limiter {
+	limitersMu.Lock()
+	l, ok := limiters[cfg.VCenter.Server]
+	if !ok {
+		l = &limiter{}
+		limiters[cfg.VCenter.Server] = l
+	}
+	limitersMu.Unlock()
+
+	l.set(cfg.Connection.QPS, cfg.Connection.Burst)
+
+	return l
+}
+
+// set changes the rate, a burst below 1 defaults to 1.
+func (l *limiter) set(qps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	if l.qps == 0 && qps > 0 {
+		// Start with a full bucket.
+		l.tokens = float64(burst)
+		l.last = time.Now()
+	}
+
+	l.qps = qps
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+// wait blocks until a request may be sent or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	throttled := false
+
+	for {
+		d := l.reserve(time.Now())
+		if d == 0 {
+			return nil
+		}
+
+		if !throttled {
+			throttled = true
+			vsphereThrottled.Add(1)
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// reserve takes a token at now and returns 0, or returns how long to wait for
+// the next token.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.qps <= 0 {
+		return 0
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.qps
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / l.qps * float64(time.Second))
+}
+
+// throttledSOAP limits the requests of the govmomi client.
+type throttledSOAP struct {
+	soap.RoundTripper
+	l *limiter
+}
+
+func (t *throttledSOAP) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	if err := t.l.wait(ctx); err != nil {
+		return err
+	}
+
+	return t.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+// throttledHTTP limits the requests of the rest client.
+type throttledHTTP struct {
+	http.RoundTripper
+	l *limiter
+}
+
+func (t *throttledHTTP) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.l.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// throttle sends all requests of clt through l. The rest client must already
+// be created, since creating it requires the unwrapped transport.
+func (clt *vsClient) throttle(l *limiter) {
+	if clt.govmomi != nil {
+		clt.govmomi.Client.RoundTripper = &throttledSOAP{RoundTripper: clt.govmomi.Client.RoundTripper, l: l}
+	}
+	if clt.rest != nil {
+		clt.rest.Client.Client.Transport = &throttledHTTP{RoundTripper: clt.rest.Client.Client.Transport, l: l}
+	}
+}
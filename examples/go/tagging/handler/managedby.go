@@ -0,0 +1,179 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultManagedByCategory is the category of the managed-by tag if
+// managed_by_tag category is not configured.
+const defaultManagedByCategory = "managed-by"
+
+// mutatingActions change the object they act on, unlike notifications and
+// follow-up events.
+var mutatingActions = map[string]bool{
+	actionTag:         true,
+	actionReconfigure: true,
+	actionAcknowledge: true,
+	actionAdvise:      true,
+}
+
+// managedByCategory returns the category of the managed-by tag.
+func (cfg *vcConfig) managedByCategory() string {
+	if cfg.ManagedByTag.Category == "" {
+		return defaultManagedByCategory
+	}
+
+	return cfg.ManagedByTag.Category
+}
+
+// managedByName returns the name of the managed-by tag, veba-<function>, which
+// stays the same across replicas and config changes of the function.
+func (cfg *vcConfig) managedByName() string {
+	return "veba-" + cfg.functionName()
+}
+
+// markManaged attaches the managed-by tag to ref if enabled. The tag only
+// serves finding the objects of the function later, so failures are logged
+// and counted but never fail the event.
+func markManaged(ctx context.Context, cfg *vcConfig, client *vsClient, ref types.ManagedObjectReference) {
+	if !cfg.ManagedByTag.Enabled {
+		return
+	}
+
+	err := limit(ctx, cfg, opTag, func(ctx context.Context) error {
+		return client.managedByTag(ctx, cfg, ref)
+	})
+	if err != nil {
+		managedByFailures.Add(1)
+		slog.Error("attaching managed-by tag failed", "ref", ref.Value, "err", err)
+		return
+	}
+
+	traceFrom(ctx).step("managed-by tag %v:%v attached to %v", cfg.managedByCategory(), cfg.managedByName(), ref.Value)
+}
+
+// managedByTag attaches the managed-by tag to ref, creating its category and
+// the tag on first use. The id of the tag is cached, and looked up again after
+// a failed attach in case the tag was deleted.
+func (clt *vsClient) managedByTag(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference) error {
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	category, name := cfg.managedByCategory(), cfg.managedByName()
+	key := category + ":" + name
+
+	var id string
+	if v, ok := clt.managedBy.Load(key); ok {
+		id = v.(string)
+	} else {
+		id, err = managedByTagID(ctx, m, category, name)
+		if err != nil {
+			return err
+		}
+		clt.managedBy.Store(key, id)
+	}
+
+	if err := attachTag(ctx, m, id, ref); err != nil {
+		clt.managedBy.Delete(key)
+		return fmt.Errorf("attach managed-by tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// managedByTagID returns the id of the tag name of category, creating the
+// category and the tag if missing. Another replica may create them at the
+// same time, so a failed create is followed by another lookup.
+func managedByTagID(ctx context.Context, m *tags.Manager, category, name string) (string, error) {
+	c, err := ensureCategory(ctx, m, category)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := tagInCategory(ctx, m, c, name)
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	start := time.Now()
+	id, err = m.CreateTag(ctx, &tags.Tag{
+		Name:        name,
+		Description: auditDescription(ctx, name, ""),
+		CategoryID:  c.ID,
+	})
+	traceFrom(ctx).call("CreateTag", start, err)
+	if err == nil {
+		return id, nil
+	}
+
+	if id, lookupErr := tagInCategory(ctx, m, c, name); lookupErr == nil && id != "" {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("create tag %q in category %v failed: %w", name, c.Name, err)
+}
+
+// ensureCategory returns the category name, creating it with multiple
+// cardinality if missing, so the tags of several functions can be attached
+// to one object.
+func ensureCategory(ctx context.Context, m *tags.Manager, name string) (*tags.Category, error) {
+	start := time.Now()
+	c, err := m.GetCategory(ctx, name)
+	traceFrom(ctx).call("GetCategory", start, err)
+	if err == nil {
+		return c, nil
+	}
+
+	start = time.Now()
+	id, err := m.CreateCategory(ctx, &tags.Category{
+		Name:        name,
+		Description: "Objects changed by event functions",
+		Cardinality: "MULTIPLE",
+	})
+	traceFrom(ctx).call("CreateCategory", start, err)
+	if err != nil {
+		if c, lookupErr := m.GetCategory(ctx, name); lookupErr == nil {
+			return c, nil
+		}
+		return nil, fmt.Errorf("create category %q failed: %w", name, err)
+	}
+
+	start = time.Now()
+	c, err = m.GetCategory(ctx, id)
+	traceFrom(ctx).call("GetCategory", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("get created category %q failed: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// managedByTagIDOf returns the id of the existing managed-by tag.
+func (clt *vsClient) managedByTagIDOf(ctx context.Context, cfg *vcConfig) (string, error) {
+	category, name := cfg.managedByCategory(), cfg.managedByName()
+	if v, ok := clt.managedBy.Load(category + ":" + name); ok {
+		return v.(string), nil
+	}
+
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	t, err := m.GetTagForCategory(ctx, name, category)
+	traceFrom(ctx).call("GetTagForCategory", start, err)
+	if err != nil {
+		return "", fmt.Errorf("managed-by tag %v:%v not found: %w", category, name, err)
+	}
+
+	return t.ID, nil
+}
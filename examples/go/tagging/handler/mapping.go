@@ -0,0 +1,157 @@
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fieldMapping configures where the fields of events massaged by a
+// transformation, e.g. of a message broker in between, are found. Paths are
+// dot-separated keys and array indices of the payload, e.g. payload.vm.id.
+type fieldMapping struct {
+	Event  string `json:"event,omitempty"`        // the event type, copied to the CloudEvent subject
+	VM     string `toml:"vm" json:"vm,omitempty"` // the VM reference value, e.g. vm-42
+	Alarm  string `json:"alarm,omitempty"`        // the alarm name
+	Status string `json:"status,omitempty"`       // the status the alarm turned to, e.g. red
+}
+
+// mapFields copies the mapped fields of body to where the function expects
+// them in events of the event router. Fields whose path is not in body are
+// left as they are, so standard and massaged events can be mixed.
+func (cfg *vcConfig) mapFields(body []byte) ([]byte, error) {
+	m := cfg.Mapping
+	if m == (fieldMapping{}) {
+		return body, nil
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing of event for field mapping failed: %w", err)
+	}
+
+	copied := false
+	copyField := func(from string, to []string, value func(string) interface{}) error {
+		if from == "" {
+			return nil
+		}
+
+		v, ok := lookup(doc, from)
+		if !ok {
+			return nil
+		}
+
+		s, err := scalar(v)
+		if err != nil {
+			return fmt.Errorf("mapped field %v: %w", from, err)
+		}
+
+		set(doc, to, value(s))
+		copied = true
+
+		return nil
+	}
+
+	text := func(s string) interface{} { return s }
+	vm := func(s string) interface{} {
+		return map[string]interface{}{"Type": "VirtualMachine", "Value": s}
+	}
+
+	for _, err := range []error{
+		copyField(m.Event, []string{"subject"}, text),
+		copyField(m.VM, []string{"data", "Vm", "Vm"}, vm),
+		copyField(m.Alarm, []string{"data", "Alarm", "Name"}, text),
+		copyField(m.Status, []string{"data", "To"}, text),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Alarms of mapped VMs are on the VM itself.
+	if _, ok := lookup(doc, "data.Entity.Entity"); m.VM != "" && !ok {
+		if v, ok := lookup(doc, "data.Vm.Vm"); ok {
+			set(doc, []string{"data", "Entity", "Entity"}, v)
+		}
+	}
+
+	if !copied {
+		return body, nil
+	}
+
+	return json.Marshal(doc)
+}
+
+// lookup returns the value at path in doc.
+func lookup(doc interface{}, path string) (interface{}, bool) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, v != nil
+}
+
+// set sets the value at path in doc, creating missing objects on the way.
+// Values on the way which are no objects are replaced.
+func set(doc map[string]interface{}, path []string, v interface{}) {
+	node := doc
+	for _, key := range path[:len(path)-1] {
+		next, ok := node[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			node[key] = next
+		}
+		node = next
+	}
+
+	node[path[len(path)-1]] = v
+}
+
+// scalar returns v as string, if it is a string or number.
+func scalar(v interface{}) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case json.Number:
+		return s.String(), nil
+	default:
+		return "", fmt.Errorf("expected a string or number, got %T", v)
+	}
+}
+
+// validateMapping ensures the mapped paths have no empty keys.
+func validateMapping(m fieldMapping) error {
+	for name, path := range map[string]string{"event": m.Event, "vm": m.VM, "alarm": m.Alarm, "status": m.Status} {
+		if path == "" {
+			continue
+		}
+
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return fmt.Errorf("invalid mapping %v path %q", name, path)
+			}
+		}
+	}
+
+	return nil
+}
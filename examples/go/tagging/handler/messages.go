@@ -0,0 +1,29 @@
+package function
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+)
+
+// message formats the message key with args in the [messages] locale, for
+// responses and notifications.
+func (cfg *vcConfig) message(key i18n.Key, args ...interface{}) string {
+	return i18n.Sprintf(cfg.Messages.Locale, key, args...)
+}
+
+// messages formats the message key with args in English, for the logs, and
+// in the [messages] locale, for the response.
+func (cfg *vcConfig) messages(key i18n.Key, args ...interface{}) (string, string) {
+	return i18n.Sprintf(i18n.English, key, args...), cfg.message(key, args...)
+}
+
+// validateMessages ensures the [messages] locale has a catalog.
+func validateMessages(cfg vcConfig) error {
+	if !i18n.Supported(cfg.Messages.Locale) {
+		return fmt.Errorf("unsupported messages locale %q, expected one of %v", cfg.Messages.Locale, strings.Join(i18n.Locales(), ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package function
+
+import "expvar"
+
+// Counters of the function. expvar registers the /debug/vars endpoint on the
+// default mux, which the golang-http template serves, so the counters can be
+// scraped from the function's service.
+var (
+	// tagAlreadyAttached counts attach operations which found the tag
+	// already attached.
+	tagAlreadyAttached = expvar.NewInt("tag_already_attached_total")
+	// staleEvents counts events skipped for exceeding the max age.
+	staleEvents = expvar.NewInt("events_stale_total")
+	// skippedUnconnected counts events skipped before connecting to
+	// vSphere, e.g. stale events and events matching no rule.
+	skippedUnconnected = expvar.NewInt("events_skipped_unconnected_total")
+	// vmsNotFound counts events skipped for VMs which no longer exist.
+	vmsNotFound = expvar.NewInt("events_vm_not_found_total")
+	// vsphereThrottled counts vSphere requests delayed by the rate limit.
+	vsphereThrottled = expvar.NewInt("vsphere_throttled_total")
+	// queueFull counts events rejected while the queue of their priority
+	// was full.
+	queueFull = expvar.NewInt("events_queue_full_total")
+	// tagsDeferred counts tag actions queued while the vAPI endpoint was
+	// unavailable, tagsReconciled the deferred tags attached later.
+	tagsDeferred   = expvar.NewInt("tags_deferred_total")
+	tagsReconciled = expvar.NewInt("tags_reconciled_total")
+	// tagsCollected counts orphaned tags deleted by the garbage collection.
+	tagsCollected = expvar.NewInt("tags_collected_total")
+	// timeouts counts operations which exceeded their timeout of the
+	// [timeouts] section, by operation.
+	timeouts = expvar.NewMap("timeouts_total")
+	// publishFailures counts result and audit records which could not be
+	// published.
+	publishFailures = expvar.NewInt("publish_failures_total")
+	// viewerFailures counts summaries which could not be posted to the
+	// event viewer.
+	viewerFailures = expvar.NewInt("viewer_failures_total")
+	// managedByFailures counts managed-by tags which could not be
+	// attached to changed objects.
+	managedByFailures = expvar.NewInt("managed_by_failures_total")
+	// events counts processed events by response status code.
+	events = expvar.NewMap("events_total")
+)
+
+func init() {
+	// vsphere_connection and vsphere_connection_write report the state of
+	// the shared vSphere connections of the read and write identity,
+	// including the last connection error and the next retry.
+	expvar.Publish("vsphere_connection", expvar.Func(conn.health))
+	expvar.Publish("vsphere_connection_write", expvar.Func(writeConn.health))
+	// scheduler reports the workers, running and queued events.
+	expvar.Publish("scheduler", expvar.Func(func() interface{} { return sched.Stats() }))
+}
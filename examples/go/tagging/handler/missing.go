@@ -0,0 +1,121 @@
+package function
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/humanize"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// statusVMNotFound is returned for events of VMs which no longer exist. It is
+// a client error, so the event processor does not retry the event, and it is
+// not dead-lettered, as there is nothing left to process.
+const statusVMNotFound = http.StatusNotFound
+
+// Lifetimes of cached failed lookups. Each further failed lookup of a VM
+// doubles the lifetime up to the max.
+const (
+	missingBaseTTL = 30 * time.Second
+	missingMaxTTL  = 10 * time.Minute
+)
+
+// missingVMs caches the VMs which were not found, so events of deleted VMs
+// and their retries do not look them up again and again.
+var missingVMs = newMissingCache()
+
+// missingEntry is a VM which was not found.
+type missingEntry struct {
+	misses int
+	until  time.Time
+}
+
+// missingCache holds the VMs which were not found by reference value.
+type missingCache struct {
+	mu      sync.Mutex
+	entries map[string]missingEntry
+}
+
+func newMissingCache() *missingCache {
+	return &missingCache{entries: map[string]missingEntry{}}
+}
+
+// add records a failed lookup of vm at now and returns how long it is cached.
+func (c *missingCache) add(vm string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune(now)
+
+	e := c.entries[vm]
+	e.misses++
+
+	ttl := missingBaseTTL
+	for i := 1; i < e.misses && ttl < missingMaxTTL; i++ {
+		ttl *= 2
+	}
+	ttl = min(ttl, missingMaxTTL)
+	e.until = now.Add(ttl)
+	c.entries[vm] = e
+
+	return ttl
+}
+
+// cached reports whether vm was not found within its lifetime at now.
+func (c *missingCache) cached(vm string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[vm]
+	return ok && now.Before(e.until)
+}
+
+// prune forgets VMs whose lifetime ended more than the max lifetime ago, so
+// VM reference values reused by vCenter start over. c.mu must be held.
+func (c *missingCache) prune(now time.Time) {
+	for vm, e := range c.entries {
+		if now.Sub(e.until) > missingMaxTTL {
+			delete(c.entries, vm)
+		}
+	}
+}
+
+// vmNotFoundResponse caches vm as not found and responds with the terminal
+// statusVMNotFound.
+func vmNotFoundResponse(cfg *vcConfig, tr *trace, vm types.ManagedObjectReference, err error) (handler.Response, error) {
+	ttl := missingVMs.add(vm.Value, time.Now())
+	vmsNotFound.Add(1)
+
+	logged, message := cfg.messages(i18n.SkipNotFound, vm.Value, err)
+	slog.Info(logged, "cached", humanize.Duration(ttl))
+
+	return tr.skip(i18n.SkipNotFound, message, statusVMNotFound), nil
+}
+
+// vmNotFound reports whether err is caused by a VM which does not exist: the
+// SOAP fault ManagedObjectNotFound or a vAPI 404 response.
+func vmNotFound(err error) bool {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if soap.IsSoapFault(e) {
+			if _, ok := soap.ToSoapFault(e).VimFault().(types.ManagedObjectNotFound); ok {
+				return true
+			}
+		}
+		if soap.IsVimFault(e) {
+			if _, ok := soap.ToVimFault(e).(*types.ManagedObjectNotFound); ok {
+				return true
+			}
+		}
+	}
+
+	// The vAPI client returns no typed errors, but its status errors end
+	// with the response status.
+	return err != nil && strings.HasSuffix(err.Error(), "404 Not Found")
+}
@@ -0,0 +1,73 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Modes of the function.
+const (
+	modeRemediate = "remediate" // run the actions of the rules, the default
+	modeObserve   = "observe"   // only log and notify what the rules would do
+)
+
+// observing reports whether the function is in observe mode: whatever the
+// rules say, nothing is changed in vCenter and no follow-up events are
+// emitted. Flipping mode in the secret is the emergency brake of all rules.
+func (cfg *vcConfig) observing() bool {
+	return strings.EqualFold(cfg.Mode, modeObserve)
+}
+
+// validateMode ensures mode is known, so a typo never leaves the brake
+// released.
+func validateMode(cfg vcConfig) error {
+	switch strings.ToLower(cfg.Mode) {
+	case "", modeRemediate, modeObserve:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported mode %q, must be %v or %v", cfg.Mode, modeRemediate, modeObserve)
+}
+
+// notifies reports whether r has a notify action.
+func (r *rule) notifies() bool {
+	for _, a := range r.Actions {
+		if a.Type == actionNotify {
+			return true
+		}
+	}
+
+	return false
+}
+
+// observeResponse logs the decision on ref described by the message key and
+// args instead of acting on it and, if the rule r notifies, posts it to the
+// notify sinks. Failed notifications are logged only, so observed events are
+// not retried.
+func observeResponse(ctx context.Context, tr *trace, cfg *vcConfig, r *rule, ref types.ManagedObjectReference, key i18n.Key, args ...interface{}) handler.Response {
+	logged, message := cfg.messages(key, args...)
+	slog.Info(logged, "mode", modeObserve)
+
+	if r != nil && r.notifies() {
+		err := limit(ctx, cfg, opNotify, func(ctx context.Context) error {
+			return notifyOutcome(ctx, cfg, ref, r.Name, message)
+		})
+		if err != nil {
+			slog.Error("notification of observed event failed", "rule", r.Name, "err", err)
+		}
+	}
+
+	res := tr.skip(key, message, http.StatusOK)
+	if r != nil {
+		res.Header.Set(ruleHeader, r.Name)
+	}
+
+	return res
+}
@@ -0,0 +1,106 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/notify"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// notifiers returns the sinks configured in the [notify] section. All sinks
+// share one client built from the [outbound] section.
+func notifiers(cfg *vcConfig) ([]notify.Notifier, error) {
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return nil, nil
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []notify.Notifier
+	if cfg.Notify.WebhookURL != "" {
+		sinks = append(sinks, &notify.Webhook{URL: cfg.Notify.WebhookURL, Client: clt})
+	}
+	if cfg.Notify.SlackWebhookURL != "" {
+		sinks = append(sinks, &notify.Slack{URL: cfg.Notify.SlackWebhookURL, Client: clt})
+	}
+
+	return sinks, nil
+}
+
+// notifyFailure posts a failed tagging operation to the configured sinks.
+// Delivery errors are logged only, they must not mask the tagging error.
+func notifyFailure(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference, cause error) {
+	sinks, err := notifiers(cfg)
+	if err != nil {
+		slog.Error("notification sinks not available", "err", err)
+		return
+	}
+
+	msg := notify.Message{
+		Title: cfg.message(i18n.TaggingFailed),
+		Text:  cause.Error(),
+		Fields: map[string]string{
+			"object": ref.Value,
+			"tag":    cfg.Tag.URN,
+			"action": cfg.Tag.Action,
+		},
+		Time: time.Now().UTC(),
+	}
+
+	tr := traceFrom(ctx)
+	err = limit(ctx, cfg, opNotify, func(ctx context.Context) error {
+		var errs []error
+		for _, s := range sinks {
+			start := time.Now()
+			err := s.Notify(ctx, msg)
+			tr.call("notify", start, err)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+	if err != nil {
+		slog.Error("notification failed", "err", err)
+	}
+}
+
+// notifyOutcome posts the outcome of the rule so far to the configured sinks.
+// Unlike failure notifications, it is an action of a rule chain, so delivery
+// errors are returned.
+func notifyOutcome(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference, rule, text string) error {
+	sinks, err := notifiers(cfg)
+	if err != nil {
+		return err
+	}
+
+	msg := notify.Message{
+		Title: cfg.message(i18n.EventHandled),
+		Text:  text,
+		Fields: map[string]string{
+			"object": ref.Value,
+			"rule":   rule,
+		},
+		Time: time.Now().UTC(),
+	}
+
+	tr := traceFrom(ctx)
+	var errs []error
+	for _, s := range sinks {
+		start := time.Now()
+		err := s.Notify(ctx, msg)
+		tr.call("notify", start, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
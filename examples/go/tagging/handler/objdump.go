@@ -0,0 +1,58 @@
+package function
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/dump"
+)
+
+// Environment of the object dumps, which require write_debug.
+const (
+	// objectDumpEnv enables dumps of the retrieved properties.
+	objectDumpEnv = "object_dump"
+	// objectDumpFileEnv writes the dumps to a file instead of stderr.
+	objectDumpFileEnv = "object_dump_file"
+	// objectDumpMaxBytesEnv and objectDumpKeepEnv limit the dump file and
+	// its rotated copies.
+	objectDumpMaxBytesEnv = "object_dump_max_bytes"
+	objectDumpKeepEnv     = "object_dump_keep"
+)
+
+var (
+	objectDumperOnce sync.Once
+	// objectDumper is shared by all invocations, so only properties changed
+	// since the previous invocation are dumped.
+	objectDumper *dump.Dumper
+)
+
+// objectDump returns the Dumper of the process or nil if dumps are disabled.
+// A dump file which cannot be opened falls back to stderr.
+func objectDump() *dump.Dumper {
+	objectDumperOnce.Do(func() {
+		if !debug() || os.Getenv(objectDumpEnv) != "true" {
+			return
+		}
+
+		path := os.Getenv(objectDumpFileEnv)
+		if path == "" {
+			objectDumper = dump.New(os.Stderr)
+			return
+		}
+
+		maxBytes, _ := strconv.ParseInt(os.Getenv(objectDumpMaxBytesEnv), 10, 64)
+		keep, _ := strconv.Atoi(os.Getenv(objectDumpKeepEnv))
+
+		f, err := dump.OpenRotatingFile(path, maxBytes, keep)
+		if err != nil {
+			slog.Warn("object dumps are written to stderr", "err", err)
+			objectDumper = dump.New(os.Stderr)
+			return
+		}
+		objectDumper = dump.New(f)
+	})
+
+	return objectDumper
+}
@@ -0,0 +1,130 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/props"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// optInTagID returns the id of the opt-in tag, which is configured as URN,
+// as category:name, e.g. veba:auto-remediate, or as name.
+func (clt *vsClient) optInTagID(ctx context.Context, tag string) (string, error) {
+	if strings.HasPrefix(tag, "urn:") {
+		return tag, nil
+	}
+
+	category, name := "", tag
+	if i := strings.Index(tag, ":"); i > 0 {
+		category, name = tag[:i], tag[i+1:]
+	}
+
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	t, err := m.GetTagForCategory(ctx, name, category)
+	traceFrom(ctx).call("GetTagForCategory", start, err)
+	if err != nil {
+		return "", fmt.Errorf("opt-in tag %q not found: %w", tag, err)
+	}
+
+	return t.ID, nil
+}
+
+// optedIn reports by VM reference value which VMs of refs carry the opt-in
+// tag, themselves or on one of their folders. The tagged objects and the
+// parents of each level of the inventory are retrieved with one call each,
+// the tagged objects concurrently with the parents.
+func (clt *vsClient) optedIn(ctx context.Context, cfg *vcConfig, refs []types.ManagedObjectReference) (map[string]bool, error) {
+	id, err := clt.optInTagID(ctx, cfg.OptIn.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tagged objects and the parents are independent reads.
+	var objs []mo.Reference
+	parents := map[types.ManagedObjectReference]*types.ManagedObjectReference{}
+	err = readConcurrently(ctx,
+		func(ctx context.Context) error {
+			start := time.Now()
+			var err error
+			objs, err = m.ListAttachedObjects(ctx, id)
+			traceFrom(ctx).call("ListAttachedObjects", start, err)
+			if err != nil {
+				return fmt.Errorf("list objects with opt-in tag failed: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) (err error) {
+			// Without SOAP API, only VMs tagged themselves are opted in.
+			if clt.govmomi == nil {
+				return nil
+			}
+			parents, err = clt.parents(ctx, refs)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := map[types.ManagedObjectReference]bool{}
+	for _, o := range objs {
+		tagged[o.Reference()] = true
+	}
+
+	opted := map[string]bool{}
+	for _, ref := range refs {
+		for r := &ref; r != nil; r = parents[*r] {
+			if tagged[*r] {
+				opted[ref.Value] = true
+				break
+			}
+		}
+	}
+
+	return opted, nil
+}
+
+// parents returns the parent of refs and of all their ancestors up to the
+// root folder, which has none.
+func (clt *vsClient) parents(ctx context.Context, refs []types.ManagedObjectReference) (map[types.ManagedObjectReference]*types.ManagedObjectReference, error) {
+	parents := map[types.ManagedObjectReference]*types.ManagedObjectReference{}
+
+	level := refs
+	for len(level) > 0 {
+		var entities []mo.ManagedEntity
+		start := time.Now()
+		err := props.Retrieve(ctx, clt.govmomi.Client, level, []string{"parent"}, &entities)
+		traceFrom(ctx).call("RetrieveProperties(parent)", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("retrieve parents failed: %w", err)
+		}
+
+		level = nil
+		for _, e := range entities {
+			parents[e.Self] = e.Parent
+			if e.Parent == nil {
+				continue
+			}
+
+			if _, seen := parents[*e.Parent]; !seen {
+				level = append(level, *e.Parent)
+			}
+		}
+	}
+
+	return parents, nil
+}
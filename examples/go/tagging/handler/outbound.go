@@ -0,0 +1,40 @@
+package function
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/outbound"
+)
+
+// clients keeps the client of the [outbound] section, so connections to the
+// sinks are reused across invocations.
+var clients struct {
+	sync.Mutex
+	cfg    outbound.Config
+	client *http.Client
+}
+
+// outboundClient returns the client of the [outbound] section, which is kept
+// while its configuration is unchanged. Idle connections of a replaced client
+// are closed.
+func outboundClient(c outbound.Config) (*http.Client, error) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.client != nil && clients.cfg == c {
+		return clients.client, nil
+	}
+
+	clt, err := outbound.New(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if clients.client != nil {
+		clients.client.CloseIdleConnections()
+	}
+	clients.cfg, clients.client = c, clt
+
+	return clt, nil
+}
@@ -0,0 +1,158 @@
+// Package apierror defines the body of every failed response of the function,
+// so automation can branch on a machine-readable code instead of parsing the
+// message:
+//
+//	{"code":"vsphere_unavailable","message":"connect to vSphere failed: ...","retryable":true}
+//
+// The status of the response and whether retrying the unchanged request may
+// succeed follow from the code, see Codes. Codes are only added, never
+// renamed or removed, so automation branching on them keeps working.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+// Code identifies the cause of a failed response.
+type Code string
+
+// Codes of failed responses. The list is published in the README of the
+// function, keep both in sync.
+const (
+	// Internal is an unexpected failure, e.g. a panic.
+	Internal Code = "internal"
+	// ConfigInvalid means vcconfig.toml cannot be loaded.
+	ConfigInvalid Code = "config_invalid"
+	// Unauthorized means the request failed the [auth] checks.
+	Unauthorized Code = "unauthorized"
+	// Forbidden means the request is not allowed with the config.
+	Forbidden Code = "forbidden"
+	// MethodNotAllowed means the method is not supported for the request.
+	MethodNotAllowed Code = "method_not_allowed"
+	// BodyInvalid means the request body cannot be read or decoded.
+	BodyInvalid Code = "body_invalid"
+	// BodyTooLarge means the request body exceeds the size limit.
+	BodyTooLarge Code = "body_too_large"
+	// MediaUnsupported means the body has an unsupported encoding.
+	MediaUnsupported Code = "media_unsupported"
+	// MappingFailed means the [mapping] of the event fields failed.
+	MappingFailed Code = "mapping_failed"
+	// EventInvalid means the event does not refer to a VM.
+	EventInvalid Code = "event_invalid"
+	// VSphereUnavailable means the function cannot connect to vCenter.
+	VSphereUnavailable Code = "vsphere_unavailable"
+	// LookupFailed means retrieving the VM or its properties failed.
+	LookupFailed Code = "lookup_failed"
+	// QueueFull means no worker is available and the queue is full.
+	QueueFull Code = "queue_full"
+	// WorkerTimeout means the request timed out waiting for a worker.
+	WorkerTimeout Code = "worker_timeout"
+	// ActionFailed means an action of the rule failed.
+	ActionFailed Code = "action_failed"
+	// VersionNotFound means the config version to roll back to is not kept.
+	VersionNotFound Code = "version_not_found"
+	// BrokerUnavailable means the session broker has no ticket to hand out.
+	BrokerUnavailable Code = "broker_unavailable"
+)
+
+// Info describes a code.
+type Info struct {
+	Code        Code   `json:"code"`
+	Status      int    `json:"status"`
+	Retryable   bool   `json:"retryable"`
+	Description string `json:"description"`
+}
+
+var codes = []Info{
+	{Internal, http.StatusInternalServerError, true, "unexpected failure, e.g. a panic"},
+	{ConfigInvalid, http.StatusInternalServerError, true, "vcconfig.toml cannot be loaded, retried once it is fixed"},
+	{Unauthorized, http.StatusUnauthorized, false, "the request failed the [auth] checks"},
+	{Forbidden, http.StatusForbidden, false, "the request is not allowed with the config, e.g. a rollback without [auth]"},
+	{MethodNotAllowed, http.StatusMethodNotAllowed, false, "the method is not supported for the request"},
+	{BodyInvalid, http.StatusBadRequest, false, "the body cannot be read or decoded"},
+	{BodyTooLarge, http.StatusRequestEntityTooLarge, false, "the body exceeds the size limit"},
+	{MediaUnsupported, http.StatusUnsupportedMediaType, false, "the body has an unsupported Content-Encoding"},
+	{MappingFailed, http.StatusBadRequest, false, "the [mapping] of the event fields failed"},
+	{EventInvalid, http.StatusBadRequest, false, "the event does not refer to a VM"},
+	{VSphereUnavailable, http.StatusInternalServerError, true, "connecting to vCenter failed"},
+	{LookupFailed, http.StatusInternalServerError, true, "retrieving the VM or its properties failed"},
+	{QueueFull, http.StatusTooManyRequests, true, "no worker is available and the queue is full"},
+	{WorkerTimeout, http.StatusServiceUnavailable, true, "the request timed out waiting for a worker"},
+	{ActionFailed, http.StatusInternalServerError, true, "an action of the rule failed"},
+	{VersionNotFound, http.StatusNotFound, false, "the config version to roll back to is not kept"},
+	{BrokerUnavailable, http.StatusBadGateway, true, "the session broker cannot hand out a ticket"},
+}
+
+// Codes returns all codes.
+func Codes() []Info {
+	return append([]Info(nil), codes...)
+}
+
+// Lookup returns the description of c. Unknown codes are described as
+// Internal.
+func Lookup(c Code) Info {
+	for _, i := range codes {
+		if i.Code == c {
+			return i
+		}
+	}
+
+	return Lookup(Internal)
+}
+
+// Error is the body of a failed response.
+type Error struct {
+	Code      Code              `json:"code"`
+	Message   string            `json:"message"`
+	Retryable bool              `json:"retryable"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// New returns the body of a failed response with code and message.
+func New(code Code, message string) Error {
+	return Error{Code: code, Message: message, Retryable: Lookup(code).Retryable}
+}
+
+// Response returns the failed response with the JSON body of e and the
+// status of its code.
+func (e Error) Response() handler.Response {
+	body, err := json.Marshal(e)
+	if err != nil {
+		// Strings always encode.
+		body = []byte(e.Message)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: Lookup(e.Code).Status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}
+}
+
+// Response returns the failed response with code and message.
+func Response(code Code, message string) handler.Response {
+	return New(code, message).Response()
+}
+
+// Write writes the failed response with code and message to w.
+func Write(w http.ResponseWriter, code Code, message string) {
+	res := Response(code, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+// Parse returns the error of a failed response body. It reports false if body
+// is not an error.
+func Parse(body []byte) (Error, bool) {
+	var e Error
+	if err := json.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return Error{}, false
+	}
+
+	return e, true
+}
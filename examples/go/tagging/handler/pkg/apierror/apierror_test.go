@@ -0,0 +1,74 @@
+package apierror
+
+import (
+	"net/http"
+	"testing"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestResponse ensures failed responses carry the status and retryability of
+// their code and their body parses back into the error.
+func TestResponse(t *testing.T) {
+	var tests = []struct {
+		testDesc      string
+		code          Code
+		wantStatus    int
+		wantRetryable bool
+	}{
+		{"Test that malformed events are not retryable", EventInvalid, http.StatusBadRequest, false},
+		{"Test that a full queue is retryable", QueueFull, http.StatusTooManyRequests, true},
+		{"Test that failed actions are retryable", ActionFailed, http.StatusInternalServerError, true},
+		{"Test that unknown codes are reported as internal", Code("unknown"), http.StatusInternalServerError, true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		res := Response(tc.code, "failed")
+
+		e, ok := Parse(res.Body)
+		if ok && res.StatusCode == tc.wantStatus && e.Code == tc.code && e.Message == "failed" &&
+			e.Retryable == tc.wantRetryable && res.Header.Get("Content-Type") == "application/json" {
+			t.Logf("got expected: %d %s. %v", res.StatusCode, res.Body, passMark)
+		} else {
+			t.Logf("expected: %d %v retryable %v, got: %d %s. %v", tc.wantStatus, tc.code, tc.wantRetryable, res.StatusCode, res.Body, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParse ensures only error bodies are parsed as errors.
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		body     string
+		want     bool
+	}{
+		{"Test that an error body is parsed", `{"code":"queue_full","message":"full","retryable":true}`, true},
+		{"Test that a message is not an error", "vm-42 was tagged", false},
+		{"Test that JSON without code is not an error", `{"version":"3f1c9a0d5e7b2c48"}`, false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if _, ok := Parse([]byte(tc.body)); ok == tc.want {
+			t.Logf("got expected: %v. %v", ok, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, ok, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestCodes ensures codes are unique and describe error statuses.
+func TestCodes(t *testing.T) {
+	seen := map[Code]bool{}
+	for _, i := range Codes() {
+		if seen[i.Code] || i.Status < http.StatusBadRequest || i.Description == "" {
+			t.Fatalf("expected a unique code with error status and description, got: %+v. %v", i, failMark)
+		}
+		seen[i.Code] = true
+	}
+	t.Logf("got expected: %d codes. %v", len(seen), passMark)
+}
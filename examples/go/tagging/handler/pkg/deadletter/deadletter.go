@@ -0,0 +1,168 @@
+// Package deadletter keeps events a function gave up on. Events which are
+// malformed or failed permanently are written in full, together with the
+// reason, to a file, an S3 bucket, a webhook or an AMQP exchange, so no event
+// which triggered a function is lost silently and it can be replayed once the
+// cause is fixed.
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Letter is an event which was given up on.
+type Letter struct {
+	// Event is the request body if it is JSON, Raw holds any other body.
+	Event json.RawMessage `json:"event,omitempty"`
+	Raw   []byte          `json:"raw,omitempty"`
+	// ID is the CloudEvent id, if known.
+	ID string `json:"id,omitempty"`
+	// Headers holds the request headers needed to decode the body.
+	Headers  map[string]string `json:"headers,omitempty"`
+	Function string            `json:"function"`
+	Status   int               `json:"status"`
+	Reason   string            `json:"reason"`
+	Attempts int               `json:"attempts"`
+	Time     time.Time         `json:"time"`
+}
+
+// New returns a letter of body. A body which is no valid JSON is kept as Raw.
+func New(body []byte) Letter {
+	if json.Valid(body) {
+		return Letter{Event: append(json.RawMessage(nil), body...)}
+	}
+
+	return Letter{Raw: append([]byte(nil), body...)}
+}
+
+// Sink stores letters.
+type Sink interface {
+	Write(ctx context.Context, l Letter) error
+}
+
+// File appends letters as JSON lines to a file, e.g. on a persistent volume.
+type File struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Write implements Sink.
+func (f *File) Write(_ context.Context, l Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding letter failed: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fh, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open dead-letter file failed: %w", err)
+	}
+
+	_, err = fh.Write(append(b, '\n'))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write dead-letter file failed: %w", err)
+	}
+
+	return nil
+}
+
+// Webhook posts letters as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Write implements Sink.
+func (w *Webhook) Write(ctx context.Context, l Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding letter failed: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating dead-letter request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(ctx, w.Client, req)
+}
+
+// AMQP publishes letters as persistent messages to an exchange. An empty
+// exchange is the default exchange, which routes to the queue named by the
+// routing key.
+type AMQP struct {
+	URL        string
+	Exchange   string
+	RoutingKey string
+}
+
+// Write implements Sink. A connection is opened per letter, as letters are
+// rare.
+func (a *AMQP) Write(_ context.Context, l Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding letter failed: %w", err)
+	}
+
+	conn, err := amqp.Dial(a.URL)
+	if err != nil {
+		return fmt.Errorf("connecting to amqp broker failed: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("opening amqp channel failed: %w", err)
+	}
+	defer ch.Close()
+
+	err = ch.Publish(a.Exchange, a.RoutingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    l.ID,
+		Timestamp:    l.Time,
+		Body:         b,
+	})
+	if err != nil {
+		return fmt.Errorf("publishing dead letter failed: %w", err)
+	}
+
+	return nil
+}
+
+// do sends req and expects a 2xx response.
+func do(ctx context.Context, clt *http.Client, req *http.Request) error {
+	if clt == nil {
+		clt = http.DefaultClient
+	}
+
+	res, err := clt.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending dead letter failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("dead letter rejected: %v: %s", res.Status, msg)
+	}
+
+	return nil
+}
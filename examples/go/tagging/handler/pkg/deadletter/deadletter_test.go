@@ -0,0 +1,123 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestNew ensures JSON bodies are kept as JSON and other bodies as raw bytes.
+func TestNew(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		body     string
+		wantRaw  bool
+	}{
+		{"Test that a JSON body is kept as event", `{"id":"1"}`, false},
+		{"Test that a truncated body is kept as raw bytes", `{"id":`, true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		l := New([]byte(tc.body))
+		if (l.Raw != nil) == tc.wantRaw && (l.Event != nil) == !tc.wantRaw {
+			t.Logf("got expected letter. %v", passMark)
+		} else {
+			t.Logf("expected raw: %v, got: %+v. %v", tc.wantRaw, l, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestFile shows letters are appended as JSON lines.
+func TestFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deadletter")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	f := &File{Path: filepath.Join(dir, "letters.jsonl")}
+
+	t.Log("=========== Test that two letters are appended ===========")
+	for _, id := range []string{"a", "b"} {
+		l := New([]byte(`{"id":"` + id + `"}`))
+		l.ID, l.Reason = id, "tagging failed"
+		if err := f.Write(ctx, l); err != nil {
+			t.Fatal(failMark, err)
+		}
+	}
+
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	defer fh.Close()
+
+	var ids []string
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		var l Letter
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			t.Fatal(failMark, err)
+		}
+		ids = append(ids, l.ID)
+	}
+
+	if strings.Join(ids, ",") != "a,b" {
+		t.Fatalf("expected: a,b, got: %v. %v", ids, failMark)
+	}
+	t.Logf("got expected: %v. %v", ids, passMark)
+}
+
+// TestS3 ensures objects are put signed into the bucket under the prefix.
+func TestS3(t *testing.T) {
+	var path, auth, hash string
+	var got Letter
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, hash = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	s := &S3{
+		Endpoint:        srv.URL,
+		Region:          "eu-central-1",
+		Bucket:          "veba",
+		Prefix:          "tagging/",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}
+
+	l := New([]byte(`{"id":"e1"}`))
+	l.ID = "e1"
+	l.Time = time.Date(2020, 6, 1, 9, 15, 2, 0, time.UTC)
+
+	t.Log("=========== Test that the letter is put signed under the prefix ===========")
+	if err := s.Write(context.Background(), l); err != nil {
+		t.Fatal(failMark, err)
+	}
+
+	if path != "/veba/tagging/20200601T091502.000Z-e1.json" {
+		t.Fatalf("expected object key under prefix, got: %v. %v", path, failMark)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(auth, "/eu-central-1/s3/aws4_request") || len(hash) != 64 {
+		t.Fatalf("expected signed request, got: %q. %v", auth, failMark)
+	}
+	if got.ID != "e1" {
+		t.Fatalf("expected letter e1, got: %+v. %v", got, failMark)
+	}
+	t.Logf("got expected: %v. %v", path, passMark)
+}
@@ -0,0 +1,117 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3 stores every letter as an object in a bucket of S3 or an S3 compatible
+// store, e.g. MinIO. Requests are signed with AWS Signature Version 4 and use
+// path-style addressing, which all S3 compatible stores support.
+type S3 struct {
+	// Endpoint defaults to the AWS endpoint of Region.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+// Write implements Sink. The object key is the prefix, the time of the letter
+// and its id, so objects list in order of failure.
+func (s *S3) Write(ctx context.Context, l Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding letter failed: %w", err)
+	}
+
+	id := l.ID
+	if id == "" {
+		sum := sha256.Sum256(b)
+		id = hex.EncodeToString(sum[:8])
+	}
+	key := s.Prefix + l.Time.UTC().Format("20060102T150405.000Z") + "-" + id + ".json"
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + s.Bucket + "/" + key)
+	if err != nil {
+		return fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating dead-letter request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, b, time.Now())
+
+	return do(ctx, s.Client, req)
+}
+
+// sign adds the AWS Signature Version 4 of req with payload to its headers.
+func (s *S3) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
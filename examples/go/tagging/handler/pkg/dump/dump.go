@@ -0,0 +1,137 @@
+// Package dump writes the properties retrieved from vCenter as JSON lines for
+// debugging. Only the retrieved property paths are written, not whole managed
+// objects, and only the paths whose value changed since the object was last
+// dumped, so the same VMs retrieved by every invocation do not flood the
+// output:
+//
+//	{"time":"...","object":"VirtualMachine:vm-42","changed":{"name":"web-01","resourcePool":{"Type":"ResourcePool","Value":"resgroup-8"}},"unchanged":1}
+//
+// A Dumper is carried by the context of an invocation, see WithDumper. The
+// methods of a nil Dumper do nothing, so callers dump unconditionally.
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// MaxTracked limits the property values remembered to find the changed ones.
+// Beyond, all values are forgotten and the next dump of each object is
+// complete again.
+const MaxTracked = 10000
+
+// dumperKey is the context key of the Dumper.
+type dumperKey struct{}
+
+// key identifies a property of an object.
+type key struct {
+	ref  types.ManagedObjectReference
+	path string
+}
+
+// line is a dumped object.
+type line struct {
+	Time      time.Time                  `json:"time"`
+	Object    string                     `json:"object"`
+	Changed   map[string]json.RawMessage `json:"changed,omitempty"`
+	Missing   []string                   `json:"missing,omitempty"`
+	Unchanged int                        `json:"unchanged,omitempty"`
+}
+
+// Dumper writes the changed properties of retrieved objects to a writer. It
+// is safe for concurrent use.
+type Dumper struct {
+	mu     sync.Mutex
+	w      io.Writer
+	last   map[key]string
+	failed bool
+}
+
+// New returns a Dumper writing to w, e.g. os.Stderr or a RotatingFile.
+func New(w io.Writer) *Dumper {
+	return &Dumper{w: w, last: map[key]string{}}
+}
+
+// WithDumper returns a context carrying d.
+func WithDumper(ctx context.Context, d *Dumper) context.Context {
+	return context.WithValue(ctx, dumperKey{}, d)
+}
+
+// FromContext returns the Dumper carried by ctx or nil.
+func FromContext(ctx context.Context) *Dumper {
+	d, _ := ctx.Value(dumperKey{}).(*Dumper)
+	return d
+}
+
+// Objects writes a line per object of content, with the values of the
+// properties which changed since the last dump of the object and the paths of
+// missing properties, e.g. unset or not readable by the user. Objects whose
+// properties are unchanged are written with their count only. Failed writes
+// are logged once and otherwise ignored, dumps never fail retrievals.
+func (d *Dumper) Objects(content []types.ObjectContent) {
+	if d == nil || len(content) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, oc := range content {
+		l := line{Time: now, Object: oc.Obj.Type + ":" + oc.Obj.Value}
+
+		for _, p := range oc.PropSet {
+			v, err := json.Marshal(p.Val)
+			if err != nil {
+				v, _ = json.Marshal(err.Error())
+			}
+
+			k := key{ref: oc.Obj, path: p.Name}
+			if d.last[k] == string(v) {
+				l.Unchanged++
+				continue
+			}
+			d.remember(k, string(v))
+
+			if l.Changed == nil {
+				l.Changed = map[string]json.RawMessage{}
+			}
+			l.Changed[p.Name] = v
+		}
+
+		for _, m := range oc.MissingSet {
+			l.Missing = append(l.Missing, m.Path)
+		}
+		sort.Strings(l.Missing)
+
+		d.write(l)
+	}
+}
+
+// remember records the value v of k. d.mu must be held.
+func (d *Dumper) remember(k key, v string) {
+	if _, ok := d.last[k]; !ok && len(d.last) >= MaxTracked {
+		d.last = map[key]string{}
+	}
+	d.last[k] = v
+}
+
+// write writes l as JSON line. d.mu must be held.
+func (d *Dumper) write(l line) {
+	b, err := json.Marshal(l)
+	if err == nil {
+		_, err = d.w.Write(append(b, '\n'))
+	}
+
+	if err != nil && !d.failed {
+		d.failed = true
+		slog.Warn("object dump failed, further failures are not logged", "err", err)
+	}
+}
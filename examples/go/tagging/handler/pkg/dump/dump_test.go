@@ -0,0 +1,126 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// content returns the content of vm-42 with the given name and power state.
+// An empty power state is missing.
+func content(name, power string) []types.ObjectContent {
+	oc := types.ObjectContent{
+		Obj:     types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"},
+		PropSet: []types.DynamicProperty{{Name: "name", Val: name}},
+	}
+
+	if power == "" {
+		oc.MissingSet = []types.MissingProperty{{Path: "runtime.powerState"}}
+	} else {
+		oc.PropSet = append(oc.PropSet, types.DynamicProperty{Name: "runtime.powerState", Val: power})
+	}
+
+	return []types.ObjectContent{oc}
+}
+
+// TestObjects ensures only the properties changed since the last dump are
+// written.
+func TestObjects(t *testing.T) {
+	var out bytes.Buffer
+	d := New(&out)
+
+	var tests = []struct {
+		testDesc      string
+		content       []types.ObjectContent
+		wantChanged   []string
+		wantMissing   []string
+		wantUnchanged int
+	}{
+		{"Test that the first dump of an object is complete", content("web-01", "poweredOn"), []string{"name", "runtime.powerState"}, nil, 0},
+		{"Test that unchanged properties are counted only", content("web-01", "poweredOn"), nil, nil, 2},
+		{"Test that changed properties are written", content("web-01", "poweredOff"), []string{"runtime.powerState"}, nil, 1},
+		{"Test that missing properties are listed", content("web-02", ""), []string{"name"}, []string{"runtime.powerState"}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		out.Reset()
+		d.Objects(tc.content)
+
+		var got line
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Logf("expected a JSON line, got: %q (%v). %v", out.String(), err, failMark)
+			t.Fail()
+			continue
+		}
+
+		var changed []string
+		for p := range got.Changed {
+			changed = append(changed, p)
+		}
+		if len(changed) > 1 && changed[0] > changed[1] {
+			changed[0], changed[1] = changed[1], changed[0]
+		}
+
+		if got.Object == "VirtualMachine:vm-42" && reflect.DeepEqual(changed, tc.wantChanged) && reflect.DeepEqual(got.Missing, tc.wantMissing) && got.Unchanged == tc.wantUnchanged {
+			t.Logf("got expected: %s. %v", strings.TrimSpace(out.String()), passMark)
+		} else {
+			t.Logf("expected changed %v, missing %v, unchanged %d, got: %s. %v", tc.wantChanged, tc.wantMissing, tc.wantUnchanged, out.String(), failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that a nil Dumper does nothing ===========")
+	var none *Dumper
+	none.Objects(content("web-01", "poweredOn"))
+	t.Logf("got expected: no panic. %v", passMark)
+}
+
+// TestRotatingFile ensures the dump file is rotated at its size limit and
+// only the configured number of rotated files is kept.
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer f.Close()
+
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal("Test failing due to failed write.", failMark, err)
+		}
+	}
+
+	var tests = []struct {
+		testDesc string
+		path     string
+		want     string
+	}{
+		{"Test that the latest write is in the file", path, "dddddddd\n"},
+		{"Test that the previous file is rotated to .1", path + ".1", "cccccccc\n"},
+		{"Test that older files are shifted to .2", path + ".2", "bbbbbbbb\n"},
+		{"Test that files beyond keep are dropped", path + ".3", ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		b, _ := os.ReadFile(tc.path)
+		if string(b) == tc.want {
+			t.Logf("got expected: %q. %v", b, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, b, failMark)
+			t.Fail()
+		}
+	}
+}
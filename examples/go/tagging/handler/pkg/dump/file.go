@@ -0,0 +1,125 @@
+package dump
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Defaults of RotatingFile.
+const (
+	DefaultMaxBytes = 10 << 20
+	DefaultKeep     = 3
+)
+
+// RotatingFile is a file which is rotated once it would exceed MaxBytes: the
+// file is renamed to path.1, path.1 to path.2 and so on, keeping at most Keep
+// rotated files, so dumps left enabled cannot fill the disk.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the file at path for appending. maxBytes and keep
+// default to DefaultMaxBytes and DefaultKeep if not positive.
+func OpenRotatingFile(path string, maxBytes int64, keep int) (*RotatingFile, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+
+	r := &RotatingFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Write appends p, rotating the file first if p would exceed the size limit.
+// Writes larger than the limit are written to a file of their own.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+
+	return err
+}
+
+// open opens the file at r.path. r.mu must be held or r unshared.
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open dump file failed: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat dump file failed: %w", err)
+	}
+
+	r.f = f
+	r.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest, and opens a new file.
+// r.mu must be held.
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("close dump file failed: %w", err)
+	}
+	r.f = nil
+
+	for i := r.keep - 1; i > 0; i-- {
+		from := fmt.Sprintf("%v.%d", r.path, i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, fmt.Sprintf("%v.%d", r.path, i+1)); err != nil {
+			return fmt.Errorf("rotate dump file failed: %w", err)
+		}
+	}
+
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return fmt.Errorf("rotate dump file failed: %w", err)
+	}
+
+	return r.open()
+}
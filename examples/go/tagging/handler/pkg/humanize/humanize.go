@@ -0,0 +1,153 @@
+// Package humanize renders sizes, percentages and durations for people, in
+// responses, logs and notifications:
+//
+//	fmt.Sprintf("%v of memory", humanize.MiB(vm.MemoryMB)) // 1.5 GiB of memory
+//	slog.Info("cached", "ttl", humanize.Duration(ttl))      // ttl="2m 30s"
+//
+// Values are types of their own implementing fmt.Stringer and slog.LogValuer,
+// so they plug into both without further conversion. Numbers always use a
+// decimal point and no digit grouping, independent of the locale of the
+// host, so rendered values can be matched and parsed by tools.
+package humanize
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Size is a number of bytes, rendered in the largest binary unit of which it
+// is at least one, e.g. 1.5 GiB.
+type Size int64
+
+// Bytes returns n bytes as Size.
+func Bytes(n int64) Size {
+	return Size(n)
+}
+
+// MiB returns n mebibytes as Size. vSphere reports memory in MB, which are
+// mebibytes.
+func MiB(n int64) Size {
+	return Size(n << 20)
+}
+
+// sizeUnits are the binary units of sizes, smallest first.
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+func (s Size) String() string {
+	v := float64(s)
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+
+	i := 0
+	for v >= 1024 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+
+	// 1023.96 MiB rounds to 1024 MiB, which is 1 GiB.
+	if round(v) >= 1024 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+
+	return sign + number(v) + " " + sizeUnits[i]
+}
+
+// LogValue renders s in log records.
+func (s Size) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// Percent is a percentage, rendered with up to one decimal, e.g. 12.5%.
+type Percent float64
+
+// Ratio returns part of whole as Percent, 0 if whole is 0.
+func Ratio(part, whole float64) Percent {
+	if whole == 0 {
+		return 0
+	}
+
+	return Percent(part / whole * 100)
+}
+
+func (p Percent) String() string {
+	return number(float64(p)) + "%"
+}
+
+// LogValue renders p in log records.
+func (p Percent) LogValue() slog.Value {
+	return slog.StringValue(p.String())
+}
+
+// Duration is a time.Duration, rendered in its two largest units, e.g.
+// 3d 4h, 1h 2m or 45s. Durations below a second are rendered in
+// milliseconds.
+type Duration time.Duration
+
+// durationUnits are the units of durations, largest first.
+var durationUnits = []struct {
+	d    time.Duration
+	name string
+}{
+	{24 * time.Hour, "d"},
+	{time.Hour, "h"},
+	{time.Minute, "m"},
+	{time.Second, "s"},
+}
+
+func (d Duration) String() string {
+	v := time.Duration(d)
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+
+	if v < time.Second {
+		return sign + strconv.FormatInt(v.Milliseconds(), 10) + "ms"
+	}
+
+	// The largest unit of v, with v rounded to the unit after it, e.g.
+	// 1h 59m 45s is 2h.
+	v = v.Round(time.Second)
+	i := 0
+	for v < durationUnits[i].d {
+		i++
+	}
+	if i+1 < len(durationUnits) {
+		v = v.Round(durationUnits[i+1].d)
+	}
+	// Rounding may carry into the unit above, e.g. 23h 59m 45s is 1d.
+	if i > 0 && v >= durationUnits[i-1].d {
+		i--
+	}
+
+	u := durationUnits[i]
+	s := sign + strconv.FormatInt(int64(v/u.d), 10) + u.name
+	if i+1 < len(durationUnits) {
+		next := durationUnits[i+1]
+		if rest := v % u.d / next.d; rest > 0 {
+			s += " " + strconv.FormatInt(int64(rest), 10) + next.name
+		}
+	}
+
+	return s
+}
+
+// LogValue renders d in log records.
+func (d Duration) LogValue() slog.Value {
+	return slog.StringValue(d.String())
+}
+
+// round rounds v to one decimal.
+func round(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// number renders v with up to one decimal and a decimal point.
+func number(v float64) string {
+	return strconv.FormatFloat(round(v), 'f', -1, 64)
+}
@@ -0,0 +1,69 @@
+package humanize
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestString ensures sizes, percentages and durations are rendered in their
+// largest unit with up to one decimal or two units.
+func TestString(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		in       fmt.Stringer
+		want     string
+	}{
+		{"Test that bytes below a KiB are rendered in bytes", Bytes(512), "512 B"},
+		{"Test that MB are rendered in GiB", MiB(1536), "1.5 GiB"},
+		{"Test that whole units have no decimal", MiB(4096), "4 GiB"},
+		{"Test that sizes are rounded to one decimal", Bytes(1126), "1.1 KiB"},
+		{"Test that rounding carries into the next unit", MiB(1024*1024 - 1), "1 TiB"},
+		{"Test that negative sizes keep their sign", MiB(-2048), "-2 GiB"},
+		{"Test that zero is rendered in bytes", Bytes(0), "0 B"},
+		{"Test that percentages have up to one decimal", Percent(12.345), "12.3%"},
+		{"Test that ratios are rendered as percentages", Ratio(18, 24), "75%"},
+		{"Test that a ratio of nothing is 0%", Ratio(3, 0), "0%"},
+		{"Test that durations below a second are rendered in ms", Duration(850 * time.Millisecond), "850ms"},
+		{"Test that seconds are rendered alone", Duration(45 * time.Second), "45s"},
+		{"Test that durations are rendered in two units", Duration(time.Hour + 2*time.Minute + 3*time.Second), "1h 2m"},
+		{"Test that a zero second unit is omitted", Duration(2 * time.Hour), "2h"},
+		{"Test that the second unit is rounded", Duration(time.Hour + 59*time.Minute + 45*time.Second), "2h"},
+		{"Test that rounding carries into the unit above", Duration(23*time.Hour + 59*time.Minute + 45*time.Second), "1d"},
+		{"Test that days are rendered with hours", Duration(76 * time.Hour), "3d 4h"},
+		{"Test that negative durations keep their sign", Duration(-90 * time.Second), "-1m 30s"},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		if got := tc.in.String(); got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestLogValue ensures values are rendered humanized in log records.
+func TestLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+
+	log.Info("reserved", "memory", MiB(8192), "share", Percent(18), "since", Duration(150*time.Second))
+
+	want := `memory="8 GiB" share=18% since="2m 30s"`
+	if got := buf.String(); strings.Contains(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+}
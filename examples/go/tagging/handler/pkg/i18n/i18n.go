@@ -0,0 +1,200 @@
+// Package i18n translates the notifications and response messages of a
+// function:
+//
+//	i18n.Sprintf("de", i18n.Tagged, "vm-42", urn) // vm-42 wurde mit urn:... getaggt
+//
+// Messages are identified by keys. The catalog of a locale maps keys to fmt
+// formats whose arguments are indexed, e.g. %[1]v, so translations may
+// reorder them. Keys missing in a catalog and unsupported locales fall back
+// to English. Logs and errors are not translated, so they can be searched
+// independent of the locale.
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Supported locales.
+const (
+	English  = "en"
+	German   = "de"
+	Japanese = "ja"
+)
+
+// Key identifies a message.
+type Key string
+
+// Titles and texts of notifications.
+const (
+	TaggingFailed Key = "tagging-failed"
+	EventHandled  Key = "event-handled"
+	SelfTest      Key = "self-test"
+	SelfTestText  Key = "self-test-text"
+)
+
+// Outcomes of actions.
+const (
+	Tagged           Key = "tagged"
+	EntityTagged     Key = "entity-tagged"
+	Untagged         Key = "untagged"
+	EntityUntagged   Key = "entity-untagged"
+	TagDeferred      Key = "tag-deferred"
+	Reconfigured     Key = "reconfigured"
+	RuleMatched      Key = "rule-matched"
+	Notified         Key = "notified"
+	Emitted          Key = "emitted"
+	Advised          Key = "advised"
+	AdvisoryTagged   Key = "advisory-tagged"
+	AdvisoryUntagged Key = "advisory-untagged"
+	Acknowledged     Key = "acknowledged"
+)
+
+// Reasons of skipped events.
+const (
+	SkipStale            Key = "skip-stale"
+	SkipNotFoundRecently Key = "skip-not-found-recently"
+	SkipNotFound         Key = "skip-not-found"
+	SkipSystemVM         Key = "skip-system-vm"
+	SkipNotOptedIn       Key = "skip-not-opted-in"
+	SkipNoRule           Key = "skip-no-rule"
+	DryRunRule           Key = "dry-run-rule"
+	DryRunEntity         Key = "dry-run-entity"
+	ObserveRule          Key = "observe-rule"
+	ObserveEntity        Key = "observe-entity"
+)
+
+// catalogs maps the supported locales to their messages. English has every
+// key.
+var catalogs = map[string]map[Key]string{
+	English: {
+		TaggingFailed:        "Tagging failed",
+		EventHandled:         "Event handled",
+		SelfTest:             "Self-test",
+		SelfTestText:         "%[1]v can reach this sink",
+		Tagged:               "%[1]v was tagged with %[2]v",
+		EntityTagged:         "%[1]d of %[2]d VM(s) of %[3]v were tagged with %[4]v",
+		Untagged:             "%[2]v was detached from %[1]v",
+		EntityUntagged:       "%[4]v was detached from %[1]d of %[2]d VM(s) of %[3]v",
+		TagDeferred:          "tag %[1]v of %[2]v deferred, vAPI unavailable",
+		Reconfigured:         "%[1]v was reconfigured",
+		RuleMatched:          "rule %[1]v matched %[2]v",
+		Notified:             "notified",
+		Emitted:              "emitted %[1]v %[2]v",
+		Advised:              "%[1]v advised: %[2]v",
+		AdvisoryTagged:       "%[1]v %[2]v %[3]v tagged",
+		AdvisoryUntagged:     "%[1]v %[2]v %[3]v untagged",
+		Acknowledged:         "alarm %[1]q acknowledged",
+		SkipStale:            "event is %[1]v old, exceeding max age of %[2]v, skipping",
+		SkipNotFoundRecently: "%[1]v was not found recently, skipping",
+		SkipNotFound:         "%[1]v not found, skipping: %[2]v",
+		SkipSystemVM:         "%[1]v is a system VM (%[2]v), skipping",
+		SkipNotOptedIn:       "%[1]v is not opted in with tag %[2]v, skipping",
+		SkipNoRule:           "no rule matches %[1]v, skipping",
+		DryRunRule:           "dry run: rule %[1]v would run %[2]v on %[3]v",
+		DryRunEntity:         "dry run: %[1]d VM(s) of %[2]v would be tagged with %[3]v",
+		ObserveRule:          "observe mode: rule %[1]v would run %[2]v on %[3]v",
+		ObserveEntity:        "observe mode: %[1]d VM(s) of %[2]v would be tagged with %[3]v",
+	},
+	German: {
+		TaggingFailed:        "Tagging fehlgeschlagen",
+		EventHandled:         "Ereignis verarbeitet",
+		SelfTest:             "Selbsttest",
+		SelfTestText:         "%[1]v kann dieses Ziel erreichen",
+		Tagged:               "%[1]v wurde mit %[2]v getaggt",
+		EntityTagged:         "%[1]d von %[2]d VM(s) von %[3]v wurden mit %[4]v getaggt",
+		Untagged:             "%[2]v wurde von %[1]v entfernt",
+		EntityUntagged:       "%[4]v wurde von %[1]d von %[2]d VM(s) von %[3]v entfernt",
+		TagDeferred:          "Tag %[1]v von %[2]v zurückgestellt, vAPI nicht verfügbar",
+		Reconfigured:         "%[1]v wurde neu konfiguriert",
+		RuleMatched:          "Regel %[1]v trifft auf %[2]v zu",
+		Notified:             "benachrichtigt",
+		Emitted:              "%[1]v %[2]v gesendet",
+		Advised:              "%[1]v bewertet: %[2]v",
+		AdvisoryTagged:       "%[1]v %[2]v %[3]v getaggt",
+		AdvisoryUntagged:     "%[1]v %[2]v %[3]v Tag entfernt",
+		Acknowledged:         "Alarm %[1]q bestätigt",
+		SkipStale:            "Ereignis ist %[1]v alt und überschreitet das Höchstalter von %[2]v, übersprungen",
+		SkipNotFoundRecently: "%[1]v wurde kürzlich nicht gefunden, übersprungen",
+		SkipNotFound:         "%[1]v nicht gefunden, übersprungen: %[2]v",
+		SkipSystemVM:         "%[1]v ist eine System-VM (%[2]v), übersprungen",
+		SkipNotOptedIn:       "%[1]v ist nicht mit Tag %[2]v angemeldet, übersprungen",
+		SkipNoRule:           "keine Regel trifft auf %[1]v zu, übersprungen",
+		DryRunRule:           "Probelauf: Regel %[1]v würde %[2]v auf %[3]v ausführen",
+		DryRunEntity:         "Probelauf: %[1]d VM(s) von %[2]v würden mit %[3]v getaggt",
+		ObserveRule:          "Beobachtungsmodus: Regel %[1]v würde %[2]v auf %[3]v ausführen",
+		ObserveEntity:        "Beobachtungsmodus: %[1]d VM(s) von %[2]v würden mit %[3]v getaggt",
+	},
+	Japanese: {
+		TaggingFailed:        "タグ付けに失敗しました",
+		EventHandled:         "イベントを処理しました",
+		SelfTest:             "セルフテスト",
+		SelfTestText:         "%[1]v はこの通知先に到達できます",
+		Tagged:               "%[1]v に %[2]v をタグ付けしました",
+		EntityTagged:         "%[3]v の %[2]d 台中 %[1]d 台の VM に %[4]v をタグ付けしました",
+		Untagged:             "%[1]v から %[2]v のタグを解除しました",
+		EntityUntagged:       "%[3]v の %[2]d 台中 %[1]d 台の VM から %[4]v のタグを解除しました",
+		TagDeferred:          "vAPI が利用できないため、%[2]v のタグ %[1]v を保留しました",
+		Reconfigured:         "%[1]v を再構成しました",
+		RuleMatched:          "ルール %[1]v が %[2]v に一致しました",
+		Notified:             "通知しました",
+		Emitted:              "%[1]v %[2]v を送信しました",
+		Advised:              "%[1]v の推奨: %[2]v",
+		AdvisoryTagged:       "%[1]v %[2]v %[3]v タグ付け",
+		AdvisoryUntagged:     "%[1]v %[2]v %[3]v タグ解除",
+		Acknowledged:         "アラーム %[1]q を確認しました",
+		SkipStale:            "イベントは %[1]v 前のもので最大経過時間 %[2]v を超えているため、スキップしました",
+		SkipNotFoundRecently: "%[1]v は最近見つからなかったため、スキップしました",
+		SkipNotFound:         "%[1]v が見つからないため、スキップしました: %[2]v",
+		SkipSystemVM:         "%[1]v はシステム VM (%[2]v) のため、スキップしました",
+		SkipNotOptedIn:       "%[1]v はタグ %[2]v でオプトインされていないため、スキップしました",
+		SkipNoRule:           "%[1]v に一致するルールがないため、スキップしました",
+		DryRunRule:           "ドライラン: ルール %[1]v は %[3]v に対して %[2]v を実行します",
+		DryRunEntity:         "ドライラン: %[2]v の %[1]d 台の VM に %[3]v をタグ付けします",
+		ObserveRule:          "監視モード: ルール %[1]v は %[3]v に対して %[2]v を実行します",
+		ObserveEntity:        "監視モード: %[2]v の %[1]d 台の VM に %[3]v をタグ付けします",
+	},
+}
+
+// language returns the language of locale, e.g. de of de-DE or de_DE.UTF-8.
+func language(locale string) string {
+	l := strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(l, "-_."); i >= 0 {
+		l = l[:i]
+	}
+
+	return l
+}
+
+// Supported reports whether locale has a catalog. The empty locale is
+// English.
+func Supported(locale string) bool {
+	if locale == "" {
+		return true
+	}
+
+	_, ok := catalogs[language(locale)]
+	return ok
+}
+
+// Locales returns the supported locales, sorted.
+func Locales() []string {
+	list := make([]string, 0, len(catalogs))
+	for l := range catalogs {
+		list = append(list, l)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// Sprintf formats the message key with args in locale.
+func Sprintf(locale string, key Key, args ...interface{}) string {
+	format, ok := catalogs[language(locale)][key]
+	if !ok {
+		format = catalogs[English][key]
+	}
+
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,75 @@
+package i18n
+
+import (
+	"testing"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestSprintf ensures messages are formatted in the language of the locale
+// and fall back to English.
+func TestSprintf(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		locale   string
+		key      Key
+		args     []interface{}
+		want     string
+	}{
+		{"Test that the empty locale is English", "", Tagged, []interface{}{"vm-42", "ops"}, "vm-42 was tagged with ops"},
+		{"Test that German messages are translated", German, Tagged, []interface{}{"vm-42", "ops"}, "vm-42 wurde mit ops getaggt"},
+		{"Test that the region of a locale is ignored", "de_DE.UTF-8", SkipNoRule, []interface{}{"VmPoweredOnEvent"}, "keine Regel trifft auf VmPoweredOnEvent zu, übersprungen"},
+		{"Test that translations reorder arguments", Japanese, EntityTagged, []interface{}{2, 3, "group-d1", "ops"}, "group-d1 の 3 台中 2 台の VM に ops をタグ付けしました"},
+		{"Test that unsupported locales fall back to English", "fr", Notified, nil, "notified"},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := Sprintf(tc.locale, tc.key, tc.args...)
+
+		if got == tc.want {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that keys missing in a catalog fall back to English ===========")
+	const missing Key = "missing"
+	catalogs[English][missing] = "%[1]v is English"
+	defer delete(catalogs[English], missing)
+
+	if got := Sprintf(German, missing, "fallback"); got == "fallback is English" {
+		t.Logf("got expected: %q. %v", got, passMark)
+	} else {
+		t.Logf("expected the English message, got: %q. %v", got, failMark)
+		t.Fail()
+	}
+}
+
+// TestCatalogs ensures every translation has an English message, which it
+// falls back to.
+func TestCatalogs(t *testing.T) {
+	for _, locale := range Locales() {
+		t.Logf("=========== Test that the %v catalog only has English keys ===========", locale)
+		for key := range catalogs[locale] {
+			if _, ok := catalogs[English][key]; !ok {
+				t.Logf("key %v of %v has no English message. %v", key, locale, failMark)
+				t.Fail()
+			}
+		}
+	}
+
+	for _, locale := range []string{"", "en", "DE", "ja-JP"} {
+		if !Supported(locale) {
+			t.Logf("locale %q is not supported. %v", locale, failMark)
+			t.Fail()
+		}
+	}
+	if Supported("fr") {
+		t.Logf("locale fr is supported. %v", failMark)
+		t.Fail()
+	}
+}
@@ -0,0 +1,233 @@
+// Package incident opens and resolves incidents in incident management
+// services, so failed automated remediations escalate to humans. Incidents are
+// deduplicated by key: triggering an open incident again updates it and
+// resolving a key resolves the incident opened for it.
+package incident
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Severities of an incident.
+const (
+	SeverityCritical = "critical"
+	SeverityError    = "error"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Incident describes a problem requiring human attention.
+type Incident struct {
+	// Key deduplicates incidents, see Key.
+	Key      string
+	Summary  string
+	Source   string // e.g. the affected VM
+	Severity string
+	Details  map[string]string
+}
+
+// Sink opens and resolves incidents.
+type Sink interface {
+	// Trigger opens the incident or updates the open incident with the same
+	// key.
+	Trigger(ctx context.Context, inc Incident) error
+	// Resolve resolves the open incident with key. Resolving a key without
+	// open incident is not an error.
+	Resolve(ctx context.Context, key string) error
+}
+
+// Key returns the deduplication key of the incident of alarm on entity, e.g.
+// of the VM vm-42 and the alarm alarm-7.
+func Key(entity, alarm string) string {
+	return "veba/" + entity + "/" + alarm
+}
+
+// PagerDutyURL is the PagerDuty Events API v2 endpoint.
+const PagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty is a Sink for the PagerDuty Events API v2.
+type PagerDuty struct {
+	RoutingKey string
+	URL        string // defaults to PagerDutyURL
+	Client     *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// Trigger implements Sink.
+func (p *PagerDuty) Trigger(ctx context.Context, inc Incident) error {
+	return p.send(ctx, pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    inc.Key,
+		Payload: &pagerDutyPayload{
+			Summary:       inc.Summary,
+			Source:        inc.Source,
+			Severity:      severity(inc.Severity),
+			CustomDetails: inc.Details,
+		},
+	})
+}
+
+// Resolve implements Sink.
+func (p *PagerDuty) Resolve(ctx context.Context, key string) error {
+	return p.send(ctx, pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "resolve",
+		DedupKey:    key,
+	})
+}
+
+func (p *PagerDuty) send(ctx context.Context, ev pagerDutyEvent) error {
+	u := p.URL
+	if u == "" {
+		u = PagerDutyURL
+	}
+
+	_, err := do(ctx, p.Client, u, nil, ev)
+	return err
+}
+
+// OpsgenieURL is the Opsgenie Alert API endpoint, use
+// https://api.eu.opsgenie.com/v2/alerts for the EU instance.
+const OpsgenieURL = "https://api.opsgenie.com/v2/alerts"
+
+// Opsgenie is a Sink for the Opsgenie Alert API. The key of an incident is
+// used as alias of the alert.
+type Opsgenie struct {
+	APIKey string
+	URL    string // defaults to OpsgenieURL
+	Client *http.Client
+}
+
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Priority    string            `json:"priority"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// Trigger implements Sink.
+func (o *Opsgenie) Trigger(ctx context.Context, inc Incident) error {
+	// Opsgenie limits the message to 130 characters.
+	msg := inc.Summary
+	if len(msg) > 130 {
+		msg = msg[:127] + "..."
+	}
+
+	_, err := do(ctx, o.Client, o.url(), o.header(), opsgenieAlert{
+		Message:     msg,
+		Alias:       inc.Key,
+		Description: inc.Summary,
+		Source:      inc.Source,
+		Priority:    priority(inc.Severity),
+		Details:     inc.Details,
+	})
+
+	return err
+}
+
+// Resolve implements Sink by closing the alert.
+func (o *Opsgenie) Resolve(ctx context.Context, key string) error {
+	u := o.url() + "/" + url.PathEscape(key) + "/close?identifierType=alias"
+
+	status, err := do(ctx, o.Client, u, o.header(), struct{}{})
+	if status == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (o *Opsgenie) url() string {
+	if o.URL == "" {
+		return OpsgenieURL
+	}
+
+	return strings.TrimSuffix(o.URL, "/")
+}
+
+func (o *Opsgenie) header() http.Header {
+	return http.Header{"Authorization": {"GenieKey " + o.APIKey}}
+}
+
+// severity maps s to a PagerDuty severity, which defaults to error.
+func severity(s string) string {
+	switch s {
+	case SeverityCritical, SeverityError, SeverityWarning, SeverityInfo:
+		return s
+	default:
+		return SeverityError
+	}
+}
+
+// priority maps the severity s to an Opsgenie priority.
+func priority(s string) string {
+	switch s {
+	case SeverityCritical:
+		return "P1"
+	case SeverityWarning:
+		return "P3"
+	case SeverityInfo:
+		return "P5"
+	default:
+		return "P2"
+	}
+}
+
+// do posts v as JSON to url and expects a 2xx response. The response status
+// is returned with the error.
+func do(ctx context.Context, clt *http.Client, url string, header http.Header, v interface{}) (int, error) {
+	if clt == nil {
+		clt = http.DefaultClient
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("encoding incident failed: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("creating incident request failed: %w", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := clt.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("sending incident failed: %w", err)
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("incident rejected: %v: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,80 @@
+package incident
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestPagerDuty shows incidents are triggered and resolved with the same
+// deduplication key.
+func TestPagerDuty(t *testing.T) {
+	var got []pagerDutyEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev pagerDutyEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		got = append(got, ev)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	pd := &PagerDuty{RoutingKey: "r1", URL: srv.URL}
+	key := Key("vm-42", "alarm-7")
+
+	t.Log("=========== Test that an incident is triggered and resolved ===========")
+	if err := pd.Trigger(ctx, Incident{Key: key, Summary: "tagging failed", Source: "vm-42", Severity: "fatal"}); err != nil {
+		t.Fatal(failMark, err)
+	}
+	if err := pd.Resolve(ctx, key); err != nil {
+		t.Fatal(failMark, err)
+	}
+
+	if len(got) != 2 || got[0].EventAction != "trigger" || got[1].EventAction != "resolve" ||
+		got[0].DedupKey != key || got[1].DedupKey != key || got[0].RoutingKey != "r1" {
+		t.Fatalf("expected trigger and resolve of %v, got: %+v. %v", key, got, failMark)
+	}
+	if got[0].Payload.Severity != SeverityError {
+		t.Fatalf("expected unknown severity to map to %v, got: %v. %v", SeverityError, got[0].Payload.Severity, failMark)
+	}
+	t.Logf("got expected events for %v. %v", key, passMark)
+}
+
+// TestOpsgenie ensures alerts are authenticated and closing an unknown alert
+// is not an error.
+func TestOpsgenie(t *testing.T) {
+	var auth, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+		if r.URL.Query().Get("identifierType") == "alias" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	og := &Opsgenie{APIKey: "k1", URL: srv.URL + "/v2/alerts/"}
+
+	t.Log("=========== Test that an alert is created with the API key ===========")
+	if err := og.Trigger(ctx, Incident{Key: "veba/vm-42/alarm-7", Summary: "tagging failed"}); err != nil {
+		t.Fatal(failMark, err)
+	}
+	if auth != "GenieKey k1" || path != "/v2/alerts" {
+		t.Fatalf("expected authenticated request to /v2/alerts, got: %q %q. %v", auth, path, failMark)
+	}
+	t.Logf("got expected: %v. %v", path, passMark)
+
+	t.Log("=========== Test that closing an unknown alert succeeds ===========")
+	if err := og.Resolve(ctx, "veba/vm-42/alarm-7"); err != nil {
+		t.Fatalf("expected no error, got: %v. %v", err, failMark)
+	}
+	t.Logf("got expected: no error. %v", passMark)
+}
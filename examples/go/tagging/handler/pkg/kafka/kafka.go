@@ -0,0 +1,187 @@
+// Package kafka publishes records of a function as JSON messages to Kafka
+// topics, so the results of automation land in the streaming platform an
+// enterprise already runs. Brokers are reached over plain TCP or TLS, with
+// optional SASL PLAIN or SCRAM authentication.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/outbound"
+)
+
+// DefaultTimeout limits the publishing of a record, including the connection
+// to the brokers, when Config.TimeoutSeconds is not set.
+const DefaultTimeout = 10 * time.Second
+
+// SASL mechanisms.
+const (
+	MechanismPlain       = "PLAIN"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	MechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// Config configures the producer returned by New.
+type Config struct {
+	// Brokers are the host:port of the bootstrap brokers.
+	Brokers []string
+	// ClientID identifies the producer in the logs and quotas of the
+	// brokers.
+	ClientID string `toml:"client_id"`
+	SASL     struct {
+		// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Empty
+		// disables SASL.
+		Mechanism string
+		User      string
+		Password  string
+	} `toml:"sasl"`
+	TLS struct {
+		Enabled bool
+		// CABundle is the path of a PEM file with CAs trusted in addition
+		// to the system roots.
+		CABundle string `toml:"ca_bundle"`
+		// Insecure disables TLS certificate verification.
+		Insecure bool
+	} `toml:"tls"`
+	// TimeoutSeconds limits the publishing of a record, defaults to
+	// DefaultTimeout.
+	TimeoutSeconds int `toml:"timeout_seconds"`
+}
+
+// Validate reports missing or contradicting settings.
+func (c Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("kafka brokers missing")
+	}
+
+	if c.TimeoutSeconds < 0 {
+		return errors.New("kafka timeout_seconds must not be negative")
+	}
+
+	switch strings.ToUpper(c.SASL.Mechanism) {
+	case "":
+		return nil
+	case MechanismPlain, MechanismSCRAMSHA256, MechanismSCRAMSHA512:
+	default:
+		return fmt.Errorf("unsupported kafka sasl mechanism %q", c.SASL.Mechanism)
+	}
+
+	if c.SASL.User == "" || c.SASL.Password == "" {
+		return fmt.Errorf("kafka sasl %v requires user and password", c.SASL.Mechanism)
+	}
+
+	return nil
+}
+
+// writer writes messages to the brokers, it is replaced in tests.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Producer publishes records. It is safe for concurrent use.
+type Producer struct {
+	w       writer
+	timeout time.Duration
+}
+
+// New returns a producer configured by c. The brokers are connected to by the
+// first record published.
+func New(c Config) (*Producer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	timeout := DefaultTimeout
+	if c.TimeoutSeconds > 0 {
+		timeout = time.Duration(c.TimeoutSeconds) * time.Second
+	}
+
+	transport := &kafka.Transport{
+		ClientID:    c.ClientID,
+		DialTimeout: timeout,
+	}
+
+	if c.TLS.Enabled {
+		tlsCfg, err := outbound.TLSConfig(outbound.Config{CABundle: c.TLS.CABundle, Insecure: c.TLS.Insecure})
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsCfg
+	}
+
+	mechanism, err := saslMechanism(c)
+	if err != nil {
+		return nil, err
+	}
+	transport.SASL = mechanism
+
+	w := &kafka.Writer{
+		Addr: kafka.TCP(c.Brokers...),
+		// Records of the same key, e.g. of a VM, keep their order.
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Records are published one at a time, waiting for a batch to
+		// fill would delay every invocation.
+		BatchTimeout: time.Millisecond,
+		WriteTimeout: timeout,
+		Transport:    transport,
+	}
+
+	return &Producer{w: w, timeout: timeout}, nil
+}
+
+// saslMechanism returns the SASL mechanism of c, nil without SASL.
+func saslMechanism(c Config) (sasl.Mechanism, error) {
+	switch strings.ToUpper(c.SASL.Mechanism) {
+	case "":
+		return nil, nil
+	case MechanismPlain:
+		return plain.Mechanism{Username: c.SASL.User, Password: c.SASL.Password}, nil
+	case MechanismSCRAMSHA256:
+		return scram.Mechanism(scram.SHA256, c.SASL.User, c.SASL.Password)
+	case MechanismSCRAMSHA512:
+		return scram.Mechanism(scram.SHA512, c.SASL.User, c.SASL.Password)
+	}
+
+	return nil, fmt.Errorf("unsupported kafka sasl mechanism %q", c.SASL.Mechanism)
+}
+
+// Publish writes v as JSON message with key to topic and waits until all
+// in-sync replicas have it.
+func (p *Producer) Publish(ctx context.Context, topic, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding record failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	msg := kafka.Message{
+		Topic:   topic,
+		Key:     []byte(key),
+		Value:   b,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/json")}},
+	}
+
+	if err := p.w.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("publishing record to %v failed: %w", topic, err)
+	}
+
+	return nil
+}
+
+// Close closes the connections to the brokers.
+func (p *Producer) Close() error {
+	return p.w.Close()
+}
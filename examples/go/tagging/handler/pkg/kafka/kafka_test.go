@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestNew ensures producers are only created with consistent SASL and TLS
+// settings.
+func TestNew(t *testing.T) {
+	brokers := []string{"kafka-1.local.corp:9093"}
+
+	withSASL := func(mechanism, user, password string) Config {
+		c := Config{Brokers: brokers}
+		c.SASL.Mechanism, c.SASL.User, c.SASL.Password = mechanism, user, password
+		return c
+	}
+	withCA := func(path string) Config {
+		c := Config{Brokers: brokers}
+		c.TLS.Enabled, c.TLS.CABundle = true, path
+		return c
+	}
+
+	var tests = []struct {
+		testDesc  string
+		cfg       Config
+		expectErr bool
+	}{
+		{"Test that a producer without SASL and TLS is created", Config{Brokers: brokers}, false},
+		{"Test that a producer with SASL PLAIN is created", withSASL("PLAIN", "veba", "secret"), false},
+		{"Test that a producer with SCRAM is created", withSASL("scram-sha-512", "veba", "secret"), false},
+		{"Test that a producer with TLS is created", withCA(""), false},
+		{"Test that brokers are required", Config{}, true},
+		{"Test that an unknown mechanism results in error", withSASL("GSSAPI", "veba", "secret"), true},
+		{"Test that SASL without password results in error", withSASL("SCRAM-SHA-256", "veba", ""), true},
+		{"Test that a missing CA bundle results in error", withCA("testdata/missing.pem"), true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		_, err := New(tc.cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else if tc.expectErr {
+			t.Logf("expected an error, got none. %v", failMark)
+			t.Fail()
+		} else {
+			t.Logf("got expected producer. %v", passMark)
+		}
+	}
+}
+
+// fakeWriter records the messages written.
+type fakeWriter struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (f *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.msgs = append(f.msgs, msgs...)
+	return nil
+}
+
+func (f *fakeWriter) Close() error { return nil }
+
+// TestPublish ensures records are written as JSON messages with their topic
+// and key, and failed writes are returned.
+func TestPublish(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		writeErr  error
+		expectErr bool
+	}{
+		{"Test that a record is written as JSON message", nil, false},
+		{"Test that a failed write results in error", errors.New("leader not available"), true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		w := &fakeWriter{err: tc.writeErr}
+		p := &Producer{w: w, timeout: time.Second}
+
+		err := p.Publish(context.Background(), "veba.audit", "vm-42", map[string]string{"action": "tag"})
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		var got map[string]string
+		if len(w.msgs) == 1 {
+			_ = json.Unmarshal(w.msgs[0].Value, &got)
+		}
+		if len(w.msgs) == 1 && w.msgs[0].Topic == "veba.audit" && string(w.msgs[0].Key) == "vm-42" && got["action"] == "tag" {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected a message of vm-42 to veba.audit, got: %+v. %v", w.msgs, failMark)
+			t.Fail()
+		}
+	}
+}
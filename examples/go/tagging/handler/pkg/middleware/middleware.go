@@ -0,0 +1,211 @@
+// Package middleware wraps the handler of a function with cross-cutting
+// behavior, e.g. logging, metrics, panic recovery, redaction and
+// authentication. A function assembles its chain once, outermost first:
+//
+//	var chain = middleware.Chain(handle,
+//		middleware.Recover(),
+//		middleware.Logging(),
+//		middleware.When(isEvent, middleware.Metrics(events)),
+//	)
+//
+//	func Handle(req handler.Request) (handler.Response, error) {
+//		return chain(req)
+//	}
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+)
+
+// Func is the signature of the Handle function of the golang-http template.
+type Func func(handler.Request) (handler.Response, error)
+
+// Middleware wraps a Func with additional behavior.
+type Middleware func(Func) Func
+
+// Redactor masks credentials in strings and errors, e.g. *redact.Redactor.
+type Redactor interface {
+	String(s string) string
+	Error(err error) error
+}
+
+// SignatureHeader carries the HMAC-SHA256 signature of the request body, as
+// created by Sign.
+const SignatureHeader = "X-Signature-256"
+
+// ErrUnauthorized is returned for invocations rejected by Auth.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Chain wraps h with m. The first middleware is the outermost, it sees the
+// request first and the response last.
+func Chain(h Func, m ...Middleware) Func {
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+
+	return h
+}
+
+// When applies m only to requests cond reports true for.
+func When(cond func(handler.Request) bool, m Middleware) Middleware {
+	return func(next Func) Func {
+		wrapped := m(next)
+
+		return func(req handler.Request) (handler.Response, error) {
+			if cond(req) {
+				return wrapped(req)
+			}
+			return next(req)
+		}
+	}
+}
+
+// Logging logs every invocation with its status and duration. Failed
+// invocations are logged as errors, others with debug level.
+func Logging() Middleware {
+	return func(next Func) Func {
+		return func(req handler.Request) (handler.Response, error) {
+			start := time.Now()
+			res, err := next(req)
+
+			attrs := []any{"method", req.Method, "status", res.StatusCode, "duration", time.Since(start).Round(time.Millisecond)}
+			if err != nil {
+				slog.Error("invocation failed", append(attrs, "err", err)...)
+			} else {
+				slog.Debug("invocation completed", attrs...)
+			}
+
+			return res, err
+		}
+	}
+}
+
+// Metrics counts invocations by response status code in counts, e.g. an
+// expvar map published as events_total.
+func Metrics(counts *expvar.Map) Middleware {
+	return func(next Func) Func {
+		return func(req handler.Request) (handler.Response, error) {
+			res, err := next(req)
+			counts.Add(strconv.Itoa(res.StatusCode), 1)
+
+			return res, err
+		}
+	}
+}
+
+// Recover turns a panic of the wrapped handler into a 500 response with code
+// internal, so one bad event does not terminate the function process with all
+// its invocations.
+func Recover() Middleware {
+	return func(next Func) Func {
+		return func(req handler.Request) (res handler.Response, err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					slog.Error("invocation panicked", "panic", p, "stack", string(debug.Stack()))
+
+					err = fmt.Errorf("invocation panicked: %v", p)
+					res = apierror.Response(apierror.Internal, err.Error())
+				}
+			}()
+
+			return next(req)
+		}
+	}
+}
+
+// Redact masks credentials in the response body and the error with r, so e.g.
+// a password embedded in a connection error is neither returned to the caller
+// nor logged by the template. The error keeps its chain, if r does.
+func Redact(r Redactor) Middleware {
+	return func(next Func) Func {
+		return func(req handler.Request) (handler.Response, error) {
+			res, err := next(req)
+
+			if e, ok := apierror.Parse(res.Body); ok {
+				// Escaping by JSON must not hide credentials from r.
+				e.Message = r.String(e.Message)
+				for k, v := range e.Details {
+					e.Details[k] = r.String(v)
+				}
+				res.Body = e.Response().Body
+			} else if len(res.Body) > 0 {
+				res.Body = []byte(r.String(string(res.Body)))
+			}
+
+			return res, r.Error(err)
+		}
+	}
+}
+
+// Auth rejects invocations check returns an error for with 401 Unauthorized
+// and code unauthorized.
+func Auth(check func(handler.Request) error) Middleware {
+	return func(next Func) Func {
+		return func(req handler.Request) (handler.Response, error) {
+			if err := check(req); err != nil {
+				err = fmt.Errorf("%w: %v", ErrUnauthorized, err)
+				return apierror.Response(apierror.Unauthorized, ErrUnauthorized.Error()), err
+			}
+
+			return next(req)
+		}
+	}
+}
+
+// BearerToken returns a check for Auth which requires the Authorization
+// header to carry token.
+func BearerToken(token string) func(handler.Request) error {
+	return func(req handler.Request) error {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return errors.New("missing bearer token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return errors.New("invalid bearer token")
+		}
+
+		return nil
+	}
+}
+
+// Sign returns the HMAC-SHA256 signature of body with key, as expected in the
+// SignatureHeader by HMACSignature, e.g. sha256=5d4a...
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HMACSignature returns a check for Auth which requires the SignatureHeader
+// to carry the signature of the request body with key, so a captured request
+// cannot be replayed with a different body.
+func HMACSignature(key []byte) func(handler.Request) error {
+	return func(req handler.Request) error {
+		got := req.Header.Get(SignatureHeader)
+		if got == "" {
+			return errors.New("missing signature")
+		}
+
+		if !hmac.Equal([]byte(got), []byte(Sign(key, req.Body))) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+}
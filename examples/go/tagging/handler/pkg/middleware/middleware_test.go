@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// status returns a Func responding with code and counting its calls.
+func status(code int, calls *int) Func {
+	return func(req handler.Request) (handler.Response, error) {
+		*calls++
+
+		var err error
+		if code >= http.StatusBadRequest {
+			err = errors.New(http.StatusText(code))
+		}
+
+		return handler.Response{StatusCode: code}, err
+	}
+}
+
+// masker masks a single secret.
+type masker string
+
+func (m masker) String(s string) string { return strings.ReplaceAll(s, string(m), "***") }
+
+func (m masker) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(m.String(err.Error()))
+}
+
+// TestChain ensures middlewares are applied outermost first and When only
+// applies them to matching requests.
+func TestChain(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next Func) Func {
+			return func(req handler.Request) (handler.Response, error) {
+				order = append(order, name)
+				return next(req)
+			}
+		}
+	}
+
+	var calls int
+	isPost := func(req handler.Request) bool { return req.Method == http.MethodPost }
+	h := Chain(status(http.StatusOK, &calls), record("a"), When(isPost, record("b")), record("c"))
+
+	var tests = []struct {
+		testDesc string
+		method   string
+		want     string
+	}{
+		{"Test that middlewares run outermost first", http.MethodPost, "a,b,c"},
+		{"Test that When skips requests not matching", http.MethodGet, "a,c"},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		order = nil
+		h(handler.Request{Method: tc.method})
+
+		if got := strings.Join(order, ","); got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestMiddlewares ensures each middleware responds as documented.
+func TestMiddlewares(t *testing.T) {
+	counts := new(expvar.Map).Init()
+	panics := func(handler.Request) (handler.Response, error) { panic("boom") }
+
+	var calls int
+	body := []byte(`{"id":"event-1"}`)
+
+	var tests = []struct {
+		testDesc string
+		h        Func
+		req      handler.Request
+		want     int
+	}{
+		{"Test that a panic results in 500", Chain(panics, Recover()), handler.Request{}, http.StatusInternalServerError},
+		{"Test that statuses are counted", Chain(status(http.StatusAccepted, &calls), Metrics(counts)), handler.Request{}, http.StatusAccepted},
+		{"Test that a request without token results in 401", Chain(status(http.StatusOK, &calls), Auth(BearerToken("s3cret"))), handler.Request{}, http.StatusUnauthorized},
+		{
+			"Test that a request with token is processed",
+			Chain(status(http.StatusOK, &calls), Auth(BearerToken("s3cret"))),
+			handler.Request{Header: http.Header{"Authorization": []string{"Bearer s3cret"}}},
+			http.StatusOK,
+		},
+		{"Test that a request without signature results in 401", Chain(status(http.StatusOK, &calls), Auth(HMACSignature([]byte("k3y")))), handler.Request{Body: body}, http.StatusUnauthorized},
+		{
+			"Test that a request with signature of another body results in 401",
+			Chain(status(http.StatusOK, &calls), Auth(HMACSignature([]byte("k3y")))),
+			handler.Request{Body: []byte(`{"id":"event-2"}`), Header: http.Header{SignatureHeader: []string{Sign([]byte("k3y"), body)}}},
+			http.StatusUnauthorized,
+		},
+		{
+			"Test that a request with signature is processed",
+			Chain(status(http.StatusOK, &calls), Auth(HMACSignature([]byte("k3y")))),
+			handler.Request{Body: body, Header: http.Header{SignatureHeader: []string{Sign([]byte("k3y"), body)}}},
+			http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		res, _ := tc.h(tc.req)
+		if res.StatusCode == tc.want {
+			t.Logf("got expected: %d. %v", res.StatusCode, passMark)
+		} else {
+			t.Logf("expected: %d, got: %d. %v", tc.want, res.StatusCode, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that the status was counted ===========")
+	if v := counts.Get("202"); v != nil && v.String() == "1" {
+		t.Logf("got expected: 202 counted once. %v", passMark)
+	} else {
+		t.Logf("expected 202 to be counted once, got: %v. %v", v, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that the body and error of a response are redacted ===========")
+	leaks := func(handler.Request) (handler.Response, error) {
+		err := fmt.Errorf("login failed: %w", errors.New("password s3cret rejected"))
+		return handler.Response{Body: []byte(err.Error()), StatusCode: http.StatusInternalServerError}, err
+	}
+	res, err := Chain(leaks, Redact(masker("s3cret")))(handler.Request{})
+	if err != nil && !strings.Contains(err.Error(), "s3cret") && !strings.Contains(string(res.Body), "s3cret") {
+		t.Logf("got expected: %s. %v", res.Body, passMark)
+	} else {
+		t.Logf("expected a redacted response, got: %s (%v). %v", res.Body, err, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that credentials escaped in an error body are redacted ===========")
+	escapes := func(handler.Request) (handler.Response, error) {
+		err := errors.New(`password s3"cret rejected`)
+		return apierror.Response(apierror.VSphereUnavailable, err.Error()), err
+	}
+	res, _ = Chain(escapes, Redact(masker(`s3"cret`)))(handler.Request{})
+	if e, ok := apierror.Parse(res.Body); ok && e.Message == "password *** rejected" {
+		t.Logf("got expected: %s. %v", res.Body, passMark)
+	} else {
+		t.Logf("expected a redacted error body, got: %s. %v", res.Body, failMark)
+		t.Fail()
+	}
+}
@@ -0,0 +1,88 @@
+// Package notify sends short notifications about the actions of a function to
+// chat and webhook sinks. The sinks use clients from package outbound, so they
+// honor the proxy and CA settings of the function.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Message is a notification.
+type Message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// Notifier delivers messages to a sink.
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// Webhook posts messages as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (w *Webhook) Notify(ctx context.Context, msg Message) error {
+	return post(ctx, w.Client, w.URL, msg)
+}
+
+// Slack posts messages to a Slack incoming webhook.
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (s *Slack) Notify(ctx context.Context, msg Message) error {
+	text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+	for k, v := range msg.Fields {
+		text += fmt.Sprintf("\n- %s: %s", k, v)
+	}
+
+	return post(ctx, s.Client, s.URL, struct {
+		Text string `json:"text"`
+	}{text})
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, clt *http.Client, url string, v interface{}) error {
+	if clt == nil {
+		clt = http.DefaultClient
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification request failed: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := clt.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
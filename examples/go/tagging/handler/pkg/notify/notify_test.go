@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// request is a request received by a sink.
+type request struct {
+	contentType string
+	body        map[string]interface{}
+}
+
+// sink returns a server answering with status and the requests it received.
+func sink(status int) (*httptest.Server, *[]request) {
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{contentType: r.Header.Get("Content-Type")}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		got = append(got, req)
+		w.WriteHeader(status)
+	}))
+
+	return srv, &got
+}
+
+var msg = Message{
+	Title:  "Tagging failed",
+	Text:   "tag not found",
+	Fields: map[string]string{"object": "vm-42"},
+	Time:   time.Date(2020, 3, 13, 21, 11, 53, 0, time.UTC),
+}
+
+// TestWebhook shows messages are posted as JSON and rejections are errors.
+func TestWebhook(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		status    int
+		expectErr bool
+	}{
+		{"Test that a message is posted as JSON", http.StatusOK, false},
+		{"Test that an accepted message is no error", http.StatusAccepted, false},
+		{"Test that a rejected message results in error", http.StatusBadRequest, true},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		srv, got := sink(tc.status)
+
+		err := (&Webhook{URL: srv.URL, Client: srv.Client()}).Notify(context.Background(), msg)
+		srv.Close()
+
+		ok := (err != nil) == tc.expectErr && len(*got) == 1
+		if ok {
+			r := (*got)[0]
+			fields, _ := r.body["fields"].(map[string]interface{})
+			ok = r.contentType == "application/json" && r.body["title"] == msg.Title && r.body["text"] == msg.Text &&
+				r.body["time"] == "2020-03-13T21:11:53Z" && fields["object"] == "vm-42"
+		}
+
+		if ok {
+			t.Logf("got expected: %+v (%v). %v", *got, err, passMark)
+		} else {
+			t.Logf("expected message %+v, got: %+v (%v). %v", msg, *got, err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestSlack shows messages are posted as Slack text and rejections are
+// errors.
+func TestSlack(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		status    int
+		expectErr bool
+	}{
+		{"Test that a message is posted as Slack text", http.StatusOK, false},
+		{"Test that a rejected message results in error", http.StatusForbidden, true},
+	}
+
+	want := "*Tagging failed*\ntag not found\n- object: vm-42"
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		srv, got := sink(tc.status)
+
+		err := (&Slack{URL: srv.URL, Client: srv.Client()}).Notify(context.Background(), msg)
+		srv.Close()
+
+		if (err != nil) == tc.expectErr && len(*got) == 1 && (*got)[0].body["text"] == want && len((*got)[0].body) == 1 {
+			t.Logf("got expected: %q (%v). %v", want, err, passMark)
+		} else {
+			t.Logf("expected: %q, got: %+v (%v). %v", want, *got, err, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPostUnreachable ensures unreachable sinks result in error.
+func TestPostUnreachable(t *testing.T) {
+	srv, _ := sink(http.StatusOK)
+	url := srv.URL
+	srv.Close()
+
+	t.Log("=========== Test that an unreachable sink results in error ===========")
+	if err := (&Webhook{URL: url}).Notify(context.Background(), msg); err == nil {
+		t.Fatalf("expected an error. %v", failMark)
+	}
+	t.Logf("got an error, as expected. %v", passMark)
+}
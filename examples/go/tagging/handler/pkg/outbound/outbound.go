@@ -0,0 +1,110 @@
+// Package outbound builds the HTTP clients used for calls leaving the
+// function, e.g. to notification sinks or secrets providers. Clients honor
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY unless a proxy is configured
+// explicitly, and trust additional CAs for air-gapped environments with an
+// internal PKI.
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultTimeout limits a request, including reading the response body, when
+// Config.Timeout is not set.
+const DefaultTimeout = 10 * time.Second
+
+// Config configures the clients returned by New.
+type Config struct {
+	// Proxy is the URL of the proxy for all requests. If empty, the proxy is
+	// taken from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+	// variables.
+	Proxy string `toml:"proxy"`
+	// CABundle is the path of a PEM file with CAs trusted in addition to the
+	// system roots.
+	CABundle string `toml:"ca_bundle"`
+	// Insecure disables TLS certificate verification.
+	Insecure bool `toml:"insecure"`
+	// TimeoutSeconds limits a request, defaults to DefaultTimeout.
+	TimeoutSeconds int `toml:"timeout_seconds"`
+}
+
+// New returns an HTTP client configured by cfg.
+func New(cfg Config) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", cfg.Proxy, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: scheme and host required", cfg.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsCfg, err := TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := DefaultTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsCfg,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// TLSConfig returns the TLS config of the clients returned by New, for
+// connections which are not HTTP, e.g. to message brokers.
+func TLSConfig(cfg Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.Insecure} // #nosec G402 opt-in
+	if cfg.CABundle != "" {
+		pool, err := caPool(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	return tlsCfg, nil
+}
+
+// caPool returns the system roots extended by the CAs in the PEM file path.
+func caPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle failed: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("CA bundle contains no PEM certificates")
+	}
+
+	return pool, nil
+}
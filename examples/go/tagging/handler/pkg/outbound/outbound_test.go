@@ -0,0 +1,84 @@
+package outbound
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestCABundle shows servers with certificates from a private CA are trusted
+// once the CA bundle is configured.
+func TestCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := os.MkdirTemp("", "outbound")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0600); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	t.Log("=========== Test that an unknown CA is rejected ===========")
+	clt, err := New(Config{})
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	if _, err := clt.Get(srv.URL); err == nil {
+		t.Fatalf("expected certificate error. %v", failMark)
+	}
+	t.Logf("got an error, as expected. %v", passMark)
+
+	t.Log("=========== Test that the CA bundle is trusted ===========")
+	clt, err = New(Config{CABundle: bundle})
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	res, err := clt.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected success, got: %v. %v", err, failMark)
+	}
+	res.Body.Close()
+	t.Logf("got expected: %v. %v", res.Status, passMark)
+}
+
+// TestProxy ensures requests are sent through the configured proxy.
+func TestProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	t.Log("=========== Test that requests use the configured proxy ===========")
+	clt, err := New(Config{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	res, err := clt.Get("http://hooks.example.invalid/notify")
+	if err != nil {
+		t.Fatalf("expected success, got: %v. %v", err, failMark)
+	}
+	res.Body.Close()
+	if proxied != "http://hooks.example.invalid/notify" {
+		t.Fatalf("expected request via proxy, got: %q. %v", proxied, failMark)
+	}
+	t.Logf("got expected: %v. %v", proxied, passMark)
+
+	t.Log("=========== Test that an invalid proxy ends in error ===========")
+	if _, err := New(Config{Proxy: "proxy:3128"}); err == nil {
+		t.Fatalf("expected error. %v", failMark)
+	}
+	t.Logf("got an error, as expected. %v", passMark)
+}
@@ -0,0 +1,329 @@
+// Package policytest tests the policy of a vcconfig.toml against golden
+// CloudEvents, so changes to rules, exclusions or the opt-in are caught before
+// the config is deployed:
+//
+//	func TestPolicy(t *testing.T) {
+//		policytest.Run(t, "../vcconfig.toml", "testdata/events", map[string]policytest.Decision{
+//			"cpu-red":      {Reason: i18n.DryRunRule, Rule: "cpu-alarm"},
+//			"vcls-powered": {Reason: i18n.SkipSystemVM},
+//			"malformed":    {Status: http.StatusBadRequest},
+//		})
+//	}
+//
+// Every event is a dry run of the function against the govmomi simulator with
+// the inventory of simfixtures.Default(), so the decisions depending on the
+// VM, e.g. system VMs and the opt-in tag, are made as in vCenter while
+// nothing is acted on.
+package policytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	function "github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/simfixtures"
+	"github.com/vmware/govmomi/simulator"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// Headers of the responses of skipped events, see the function.
+const (
+	reasonHeader = "X-Skip-Reason"
+	ruleHeader   = "X-Rule"
+)
+
+// secretRefPrefix marks values referencing other OpenFaaS secrets, see the
+// function.
+const secretRefPrefix = "secretRef:"
+
+// sinks are the sections of the config which send to other services
+// regardless of the dry run, or, like auth, reject the invocations of Run.
+// They do not change decisions and are removed.
+var sinks = []string{"auth", "heartbeat", "viewer", "gc", "tag_retry", "deadletter", "publish"}
+
+// Decision is what the policy decides for an event.
+type Decision struct {
+	// Reason is the message key of skipped events, e.g. i18n.SkipNoRule,
+	// or i18n.DryRunRule and i18n.DryRunEntity for events the policy acts
+	// on. Failed events have no reason.
+	Reason i18n.Key
+	// Rule is the rule which would run, if any.
+	Rule string
+	// Status is the status of the response, only checked if not 0, e.g.
+	// http.StatusBadRequest for malformed events.
+	Status int
+}
+
+func (d Decision) String() string {
+	s := string(d.Reason)
+	if s == "" {
+		s = "failed"
+	}
+	if d.Rule != "" {
+		s += " rule " + d.Rule
+	}
+	if d.Status != 0 {
+		s += fmt.Sprintf(" status %d", d.Status)
+	}
+
+	return s
+}
+
+// matches reports whether got is the decision d, ignoring the status if d
+// has none.
+func (d Decision) matches(got Decision) bool {
+	return d.Reason == got.Reason && d.Rule == got.Rule && (d.Status == 0 || d.Status == got.Status)
+}
+
+// Run invokes the function with the policy policyFile for every .json
+// CloudEvent in eventsDir and checks the decision against expected, keyed by
+// the file name without extension. Events without expected decision and
+// expected decisions without event fail the test, so the golden files and
+// the decisions are kept in sync.
+//
+// The [vcenter] section of the policy is replaced by the simulator and
+// secret references by placeholders. Events refer to VMs of the inventory by
+// name, e.g. web-01: the references of data.Vm, data.Entity and data.ObjectId
+// are replaced by the references of the VMs of these names. Events are
+// stamped with the current time, keeping the time between their creation and
+// delivery, so [event] max_age_seconds skips the events delivered late.
+//
+// The function is invoked in-process, so state it keeps between invocations
+// is shared by the Runs of a test binary, e.g. VMs not found are skipped as
+// i18n.SkipNotFoundRecently by later Runs.
+func Run(t *testing.T, policyFile, eventsDir string, expected map[string]Decision) {
+	t.Helper()
+
+	events, err := load(eventsDir)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	for name := range expected {
+		if _, ok := events[name]; !ok {
+			t.Logf("expected decision of %v, but %v has no event %v.json. %v", name, eventsDir, name, failMark)
+			t.Fail()
+		}
+	}
+
+	names := make([]string, 0, len(events))
+	for name := range events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err = simfixtures.Test(simfixtures.Default(), func(ctx context.Context, inv *simfixtures.Inventory) {
+		path, err := policy(policyFile, inv, t.TempDir())
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		// The function reads its config from vcconfig_path outside of
+		// OpenFaaS.
+		t.Setenv("vcconfig_path", path)
+
+		for _, name := range names {
+			t.Logf("=========== %v ===========", name)
+
+			want, ok := expected[name]
+			if !ok {
+				t.Logf("event %v has no expected decision. %v", name, failMark)
+				t.Fail()
+				continue
+			}
+
+			body, err := stamp(events[name], inv, time.Now())
+			if err != nil {
+				t.Logf("event %v is invalid: %v. %v", name, err, failMark)
+				t.Fail()
+				continue
+			}
+
+			got, message := decide(body)
+			if want.matches(got) {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v: %v. %v", want, got, message, failMark)
+				t.Fail()
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// decide invokes the function with body as dry run and returns the decision
+// and the response message.
+func decide(body []byte) (Decision, string) {
+	req := handler.Request{
+		Body:   body,
+		Header: http.Header{"Content-Type": {"application/json"}, "X-Dry-Run": {"true"}},
+		Method: http.MethodPost,
+	}
+
+	res, err := function.Handle(req)
+
+	d := Decision{Status: res.StatusCode}
+	if err == nil {
+		d.Reason = i18n.Key(res.Header.Get(reasonHeader))
+		d.Rule = res.Header.Get(ruleHeader)
+	}
+
+	message := strings.TrimSpace(string(res.Body))
+	if err != nil {
+		message = err.Error()
+	}
+
+	return d, message
+}
+
+// load returns the content of the .json files in dir by name without
+// extension.
+func load(dir string) (map[string][]byte, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read events failed: %w", err)
+	}
+
+	events := map[string][]byte{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read event failed: %w", err)
+		}
+		events[strings.TrimSuffix(f.Name(), ".json")] = b
+	}
+
+	return events, nil
+}
+
+// policy writes the policy of path to dir, connected to the simulator of inv
+// and without sinks, and returns the path of the copy.
+func policy(path string, inv *simfixtures.Inventory, dir string) (string, error) {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("load policy failed: %w", err)
+	}
+
+	for _, s := range sinks {
+		if tree.Has(s) {
+			if err := tree.Delete(s); err != nil {
+				return "", fmt.Errorf("remove [%v] failed: %w", s, err)
+			}
+		}
+	}
+	replaceSecretRefs(tree)
+
+	u := inv.Client.URL()
+	user := simulator.DefaultLogin.Username()
+	password, _ := simulator.DefaultLogin.Password()
+
+	tree.SetPath([]string{"vcenter", "server"}, u.Host)
+	tree.SetPath([]string{"vcenter", "user"}, user)
+	tree.SetPath([]string{"vcenter", "password"}, password)
+	tree.SetPath([]string{"vcenter", "insecure"}, true)
+	if tree.HasPath([]string{"vcenter", "sdk_path"}) {
+		if err := tree.DeletePath([]string{"vcenter", "sdk_path"}); err != nil {
+			return "", fmt.Errorf("remove sdk_path failed: %w", err)
+		}
+	}
+	if tree.HasPath([]string{"vcenter", "write"}) {
+		tree.SetPath([]string{"vcenter", "write", "user"}, user)
+		tree.SetPath([]string{"vcenter", "write", "password"}, password)
+	}
+
+	s, err := tree.ToTomlString()
+	if err != nil {
+		return "", fmt.Errorf("encode policy failed: %w", err)
+	}
+
+	copied := filepath.Join(dir, "vcconfig.toml")
+	if err := os.WriteFile(copied, []byte(s), 0o600); err != nil {
+		return "", fmt.Errorf("write policy failed: %w", err)
+	}
+
+	return copied, nil
+}
+
+// replaceSecretRefs replaces the secret references of tree by placeholders.
+// The secrets are not mounted next to the copy of the policy and are only
+// used by the sinks and actions, which dry runs do not reach.
+func replaceSecretRefs(tree *toml.Tree) {
+	for _, key := range tree.Keys() {
+		switch v := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			replaceSecretRefs(v)
+		case []*toml.Tree:
+			for _, t := range v {
+				replaceSecretRefs(t)
+			}
+		case string:
+			if strings.HasPrefix(v, secretRefPrefix) {
+				tree.SetPath([]string{key}, "policytest")
+			}
+		}
+	}
+}
+
+// stamp returns body with the references of its VMs replaced by the VMs of
+// inv of the same name and delivered at now. VMs not in inv are kept, e.g.
+// to test deleted VMs.
+func stamp(body []byte, inv *simfixtures.Inventory, now time.Time) ([]byte, error) {
+	var ce map[string]interface{}
+	if err := json.Unmarshal(body, &ce); err != nil {
+		return nil, err
+	}
+
+	data, _ := ce["data"].(map[string]interface{})
+	if data == nil {
+		// Events without data are malformed, which is tested as is.
+		return body, nil
+	}
+
+	// The reference of the arguments Vm and Entity is named like them.
+	for _, field := range []string{"Vm", "Entity"} {
+		arg, _ := data[field].(map[string]interface{})
+		name, _ := arg["Name"].(string)
+		vm, ok := inv.VMs[name]
+		if !ok {
+			continue
+		}
+		arg[field] = map[string]interface{}{"Type": vm.Type, "Value": vm.Value}
+	}
+	if name, _ := data["ObjectName"].(string); data["ObjectType"] == "VirtualMachine" {
+		if vm, ok := inv.VMs[name]; ok {
+			data["ObjectId"] = vm.Value
+		}
+	}
+
+	// The age of the event is the time it was delivered after its creation.
+	delivered, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(ce["time"]))
+	created, err := time.Parse(time.RFC3339Nano, fmt.Sprint(data["CreatedTime"]))
+	if err == nil {
+		lag := time.Duration(0)
+		if !delivered.IsZero() {
+			lag = delivered.Sub(created)
+		}
+		data["CreatedTime"] = now.Add(-lag).UTC()
+	}
+	ce["time"] = now.UTC()
+
+	return json.Marshal(ce)
+}
@@ -0,0 +1,23 @@
+package policytest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+)
+
+// TestRun shows the decisions of a policy with opt-in, event age and a rule
+// are checked against golden events. Sinks and secret references of the
+// policy do not prevent the dry runs.
+func TestRun(t *testing.T) {
+	Run(t, "testdata/vcconfig.toml", "testdata/events", map[string]Decision{
+		"cpu-red":      {Reason: i18n.DryRunRule, Rule: "cpu-alarm", Status: http.StatusOK},
+		"not-opted-in": {Reason: i18n.SkipNotOptedIn},
+		"system-vm":    {Reason: i18n.SkipSystemVM},
+		"no-rule":      {Reason: i18n.SkipNoRule},
+		"late":         {Reason: i18n.SkipStale, Status: http.StatusAccepted},
+		"deleted":      {Reason: i18n.SkipNotFound, Status: http.StatusNotFound},
+		"malformed":    {Status: http.StatusBadRequest},
+	})
+}
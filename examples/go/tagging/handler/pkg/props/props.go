@@ -0,0 +1,107 @@
+// Package props retrieves properties of many managed objects with as few
+// property collector calls as possible. Events about hosts or clusters affect
+// all their VMs; retrieving the VMs one by one costs a round trip per VM.
+package props
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/dump"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// MaxObjects limits the objects of a single RetrieveProperties call, larger
+// requests are split, so responses stay within vCenter's size limits.
+const MaxObjects = 500
+
+// Retrieve loads props of refs into dst, a pointer to a slice of mo types,
+// e.g. *[]mo.VirtualMachine, with one RetrieveProperties call per MaxObjects
+// objects. Duplicate refs are retrieved once. The retrieved properties are
+// dumped to the dump.Dumper of ctx, if any.
+func Retrieve(ctx context.Context, c *vim25.Client, refs []types.ManagedObjectReference, props []string, dst interface{}) error {
+	out := reflect.ValueOf(dst)
+	if out.Kind() != reflect.Ptr || out.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("dst must be a pointer to a slice, got %T", dst)
+	}
+
+	refs = unique(refs)
+	pc := property.DefaultCollector(c)
+
+	for start := 0; start < len(refs); start += MaxObjects {
+		end := start + MaxObjects
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		var content []types.ObjectContent
+		err := pc.Retrieve(ctx, refs[start:end], props, &content)
+		if err != nil {
+			return fmt.Errorf("retrieve properties of %d objects failed: %w", end-start, err)
+		}
+		dump.FromContext(ctx).Objects(content)
+
+		chunk := reflect.New(out.Elem().Type())
+		if err := mo.LoadObjectContent(content, chunk.Interface()); err != nil {
+			return fmt.Errorf("load properties of %d objects failed: %w", end-start, err)
+		}
+
+		out.Elem().Set(reflect.AppendSlice(out.Elem(), chunk.Elem()))
+	}
+
+	return nil
+}
+
+// VMs returns the VMs of entity: the VM itself, the VMs of a host or the VMs
+// of all hosts of a cluster.
+func VMs(ctx context.Context, c *vim25.Client, entity types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	pc := property.DefaultCollector(c)
+
+	switch entity.Type {
+	case "VirtualMachine":
+		return []types.ManagedObjectReference{entity}, nil
+	case "HostSystem":
+		var host mo.HostSystem
+		if err := pc.RetrieveOne(ctx, entity, []string{"vm"}, &host); err != nil {
+			return nil, fmt.Errorf("retrieve VMs of %v failed: %w", entity.Value, err)
+		}
+		return host.Vm, nil
+	case "ClusterComputeResource":
+		var cluster mo.ClusterComputeResource
+		if err := pc.RetrieveOne(ctx, entity, []string{"host"}, &cluster); err != nil {
+			return nil, fmt.Errorf("retrieve hosts of %v failed: %w", entity.Value, err)
+		}
+
+		var hosts []mo.HostSystem
+		if err := Retrieve(ctx, c, cluster.Host, []string{"vm"}, &hosts); err != nil {
+			return nil, err
+		}
+
+		var vms []types.ManagedObjectReference
+		for _, h := range hosts {
+			vms = append(vms, h.Vm...)
+		}
+		return vms, nil
+	default:
+		return nil, fmt.Errorf("unsupported entity type %q", entity.Type)
+	}
+}
+
+// unique returns refs without duplicates in their original order.
+func unique(refs []types.ManagedObjectReference) []types.ManagedObjectReference {
+	seen := make(map[types.ManagedObjectReference]bool, len(refs))
+	out := make([]types.ManagedObjectReference, 0, len(refs))
+
+	for _, r := range refs {
+		if !seen[r] {
+			seen[r] = true
+			out = append(out, r)
+		}
+	}
+
+	return out
+}
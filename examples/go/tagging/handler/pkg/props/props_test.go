@@ -0,0 +1,64 @@
+package props
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/dump"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestVMs shows the VMs of a cluster are resolved and their properties are
+// retrieved in one batch.
+func TestVMs(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		cluster := simulator.Map.Any("ClusterComputeResource").Reference()
+		host := simulator.Map.Any("HostSystem").(*simulator.HostSystem)
+
+		t.Log("=========== Test that the VMs of a cluster are resolved ===========")
+		vms, err := VMs(ctx, c, cluster)
+		if err != nil || len(vms) == 0 {
+			t.Fatalf("expected VMs of %v, got: %v (%v). %v", cluster.Value, vms, err, failMark)
+		}
+		t.Logf("got expected: %d VMs. %v", len(vms), passMark)
+
+		t.Log("=========== Test that duplicate VMs are retrieved once ===========")
+		var got []mo.VirtualMachine
+		err = Retrieve(ctx, c, append(vms, vms[0]), []string{"name"}, &got)
+		if err != nil || len(got) != len(vms) || got[0].Name == "" {
+			t.Fatalf("expected %d named VMs, got: %d (%v). %v", len(vms), len(got), err, failMark)
+		}
+		t.Logf("got expected: %d VMs. %v", len(got), passMark)
+
+		t.Log("=========== Test that retrieved properties are dumped ===========")
+		var out bytes.Buffer
+		got = nil
+		err = Retrieve(dump.WithDumper(ctx, dump.New(&out)), c, vms, []string{"name"}, &got)
+		if n := strings.Count(out.String(), "\n"); err != nil || n != len(vms) || !strings.Contains(out.String(), got[0].Name) {
+			t.Fatalf("expected %d dumped VMs, got: %s (%v). %v", len(vms), out.String(), err, failMark)
+		}
+		t.Logf("got expected: %d dumped VMs. %v", len(vms), passMark)
+
+		t.Log("=========== Test that the VMs of a host are resolved ===========")
+		vms, err = VMs(ctx, c, host.Reference())
+		if err != nil || len(vms) != len(host.Vm) {
+			t.Fatalf("expected %d VMs, got: %v (%v). %v", len(host.Vm), vms, err, failMark)
+		}
+		t.Logf("got expected: %d VMs. %v", len(vms), passMark)
+
+		t.Log("=========== Test that unsupported entities end in error ===========")
+		if _, err = VMs(ctx, c, types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}); err == nil {
+			t.Fatalf("expected error. %v", failMark)
+		}
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	})
+}
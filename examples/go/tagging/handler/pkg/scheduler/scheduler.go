@@ -0,0 +1,195 @@
+// Package scheduler limits how many invocations of a function work at once.
+// Invocations waiting for a worker are kept in two bounded queues, one per
+// priority. A freed worker is handed to the oldest waiting high priority
+// invocation first, so e.g. alarms of production clusters are not stuck behind
+// a storm of routine events:
+//
+//	s := scheduler.New(4, 100)
+//
+//	release, err := s.Acquire(ctx, scheduler.High)
+//	if err != nil {
+//		return err // scheduler.ErrQueueFull or ctx.Err()
+//	}
+//	defer release()
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Priority of an invocation.
+type Priority int
+
+// Priorities, from lowest to highest.
+const (
+	Normal Priority = iota
+	High
+)
+
+// String returns the name of p, as parsed by ParsePriority.
+func (p Priority) String() string {
+	if p == High {
+		return "high"
+	}
+
+	return "normal"
+}
+
+// ParsePriority returns the priority named s, normal if s is empty.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "", "normal":
+		return Normal, nil
+	case "high":
+		return High, nil
+	default:
+		return Normal, fmt.Errorf("unknown priority %q", s)
+	}
+}
+
+// ErrQueueFull is returned by Acquire if the queue of the priority is full.
+var ErrQueueFull = errors.New("scheduler queue full")
+
+// Scheduler hands out a limited number of workers. The zero value is not
+// usable, create schedulers with New.
+type Scheduler struct {
+	mu      sync.Mutex
+	workers int // 0 disables the limit
+	size    int // capacity of each queue
+	running int
+	queues  [2][]chan struct{} // waiting invocations by priority, oldest first
+}
+
+// Stats is a snapshot of a Scheduler.
+type Stats struct {
+	Workers int            `json:"workers"`
+	Running int            `json:"running"`
+	Queued  map[string]int `json:"queued"`
+}
+
+// New returns a Scheduler running up to workers invocations at once, with up
+// to size invocations waiting per priority. Without workers, invocations are
+// never limited.
+func New(workers, size int) *Scheduler {
+	s := &Scheduler{}
+	s.Resize(workers, size)
+
+	return s
+}
+
+// Resize changes the number of workers and the capacity of the queues, e.g.
+// after the configuration was reloaded. Waiting invocations are started if
+// workers were added. Queues shrunk below their length are not truncated, they
+// only reject invocations until they drained.
+func (s *Scheduler) Resize(workers, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.workers = workers
+	s.size = size
+
+	for s.waiting() > 0 && (s.workers <= 0 || s.running < s.workers) {
+		s.running++
+		s.handOver()
+	}
+}
+
+// Acquire blocks until a worker is free for an invocation of priority p and
+// returns the function to release the worker. It fails with ErrQueueFull if
+// the queue of p is full, or with the error of ctx if ctx is done before a
+// worker is free.
+func (s *Scheduler) Acquire(ctx context.Context, p Priority) (func(), error) {
+	s.mu.Lock()
+
+	if s.workers <= 0 || (s.running < s.workers && s.waiting() == 0) {
+		s.running++
+		s.mu.Unlock()
+
+		return s.release, nil
+	}
+
+	if len(s.queues[p]) >= s.size {
+		s.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	ready := make(chan struct{})
+	s.queues[p] = append(s.queues[p], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.queues[p] {
+		if c == ready {
+			s.queues[p] = append(s.queues[p][:i], s.queues[p][i+1:]...)
+			return nil, ctx.Err()
+		}
+	}
+
+	// The worker was handed over while ctx was done, pass it on.
+	s.free()
+
+	return nil, ctx.Err()
+}
+
+// release frees a worker, which is handed to the next waiting invocation.
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.free()
+}
+
+// free hands a worker to the next waiting invocation, unless workers were
+// removed by Resize. s.mu must be held.
+func (s *Scheduler) free() {
+	if s.waiting() > 0 && (s.workers <= 0 || s.running <= s.workers) {
+		s.handOver()
+		return
+	}
+
+	s.running--
+}
+
+// handOver starts the oldest waiting invocation of the highest priority with
+// a worker already counted as running. s.mu must be held.
+func (s *Scheduler) handOver() {
+	for p := High; p >= Normal; p-- {
+		if len(s.queues[p]) > 0 {
+			close(s.queues[p][0])
+			s.queues[p] = s.queues[p][1:]
+			return
+		}
+	}
+}
+
+// waiting returns the number of waiting invocations. s.mu must be held.
+func (s *Scheduler) waiting() int {
+	return len(s.queues[High]) + len(s.queues[Normal])
+}
+
+// Stats returns the current workers, running and waiting invocations.
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{
+		Workers: s.workers,
+		Running: s.running,
+		Queued: map[string]int{
+			High.String():   len(s.queues[High]),
+			Normal.String(): len(s.queues[Normal]),
+		},
+	}
+}
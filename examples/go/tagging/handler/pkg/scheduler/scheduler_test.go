@@ -0,0 +1,188 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// waitQueued waits until s has n waiting invocations.
+func waitQueued(t *testing.T, s *Scheduler, n int) {
+	for i := 0; i < 1000; i++ {
+		st := s.Stats()
+		if st.Queued["high"]+st.Queued["normal"] == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiting invocations. %v", n, failMark)
+}
+
+// TestAcquire ensures freed workers are handed to high priority invocations
+// first and full queues reject invocations.
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	s := New(1, 2)
+
+	release, err := s.Acquire(ctx, Normal)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	// Invocations record their name once they got the worker.
+	started := make(chan string, 4)
+	enqueue := func(name string, p Priority) {
+		go func() {
+			release, err := s.Acquire(ctx, p)
+			if err != nil {
+				started <- "error"
+				return
+			}
+			started <- name
+			time.Sleep(time.Millisecond)
+			release()
+		}()
+	}
+
+	enqueue("normal-1", Normal)
+	waitQueued(t, s, 1)
+	enqueue("normal-2", Normal)
+	waitQueued(t, s, 2)
+	enqueue("high-1", High)
+	waitQueued(t, s, 3)
+
+	t.Log("=========== Test that a full queue rejects invocations ===========")
+	if _, err := s.Acquire(ctx, Normal); errors.Is(err, ErrQueueFull) {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected %v, got: %v. %v", ErrQueueFull, err, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that high priority invocations start first ===========")
+	release()
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		order = append(order, <-started)
+	}
+
+	want := "high-1,normal-1,normal-2"
+	if got := strings.Join(order, ","); got == want {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that all workers are released ===========")
+	waitQueued(t, s, 0)
+	for i := 0; i < 1000 && s.Stats().Running > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.Stats(); st.Running == 0 {
+		t.Logf("got expected: %+v. %v", st, passMark)
+	} else {
+		t.Logf("expected no running invocations, got: %+v. %v", st, failMark)
+		t.Fail()
+	}
+}
+
+// TestAcquireCanceled ensures invocations stop waiting once their context is
+// done and workers added by Resize start waiting invocations.
+func TestAcquireCanceled(t *testing.T) {
+	s := New(1, 1)
+
+	release, err := s.Acquire(context.Background(), High)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer release()
+
+	t.Log("=========== Test that a waiting invocation stops once its context is done ===========")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.Acquire(ctx, High); errors.Is(err, context.DeadlineExceeded) && s.Stats().Queued["high"] == 0 {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Logf("expected %v and an empty queue, got: %v, %+v. %v", context.DeadlineExceeded, err, s.Stats(), failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that an added worker starts a waiting invocation ===========")
+	done := make(chan error, 1)
+	go func() {
+		release, err := s.Acquire(context.Background(), Normal)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	waitQueued(t, s, 1)
+	s.Resize(2, 1)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Logf("got expected: started. %v", passMark)
+		} else {
+			t.Log(failMark, err)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Logf("expected the invocation to start. %v", failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that without workers invocations are not limited ===========")
+	s.Resize(0, 0)
+	if release, err := s.Acquire(context.Background(), Normal); err == nil {
+		release()
+		t.Logf("got expected: started. %v", passMark)
+	} else {
+		t.Log(failMark, err)
+		t.Fail()
+	}
+}
+
+// TestParsePriority ensures priorities are parsed by name.
+func TestParsePriority(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		name      string
+		expectErr bool
+		want      Priority
+	}{
+		{"Test that an empty priority is normal", "", false, Normal},
+		{"Test that priorities are case insensitive", "High", false, High},
+		{"Test that an unknown priority results in error", "urgent", true, Normal},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := ParsePriority(tc.name)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
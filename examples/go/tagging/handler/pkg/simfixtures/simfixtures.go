@@ -0,0 +1,485 @@
+// Package simfixtures configures the govmomi simulator (vcsim) with the
+// synthetic inventory the example functions are tested against: tag
+// categories and tags, VMs in folders and resource pools, system VMs and
+// triggered alarms. Functions built on the examples can be tested against the
+// same inventory:
+//
+//	err := simfixtures.Test(simfixtures.Default(), func(ctx context.Context, inv *simfixtures.Inventory) {
+//		vm := inv.VMs["web-01"]
+//		body, _ := inv.AlarmEvent("VM CPU Usage")
+//		// invoke the function with body and check vm
+//	})
+//
+// The inventory is created in the default vCenter model of the simulator,
+// below the first datacenter and cluster.
+package simfixtures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	// Register the vAPI endpoints, e.g. tagging, with the simulator.
+	_ "github.com/vmware/govmomi/vapi/simulator"
+)
+
+// Fixture describes the inventory created by Setup in addition to the
+// inventory of the simulator model.
+type Fixture struct {
+	Categories []Category
+	Folders    []Folder
+	VMs        []VM
+	Alarms     []Alarm
+}
+
+// Category is a tag category with its tags.
+type Category struct {
+	Name string
+	// Cardinality is SINGLE or MULTIPLE, the default.
+	Cardinality string
+	Tags        []string
+}
+
+// Folder is a VM folder below the VM folder of the datacenter.
+type Folder struct {
+	Name string
+	// Tags attached to the folder as category:name.
+	Tags []string
+}
+
+// VM is a VM created on the cluster of the datacenter.
+type VM struct {
+	Name string
+	// Folder of the VM, by default the VM folder of the datacenter.
+	Folder string
+	// ResourcePool of the VM below the cluster, created if it does not
+	// exist, by default the root pool of the cluster.
+	ResourcePool string
+	// ManagedBy is the key of the extension managing the VM, e.g.
+	// com.vmware.vim.eam for vCLS VMs.
+	ManagedBy string
+	// Tags attached to the VM as category:name.
+	Tags []string
+	// PoweredOff VMs are powered off, the others are powered on.
+	PoweredOff bool
+}
+
+// Alarm is an alarm triggered on a VM.
+type Alarm struct {
+	Name string
+	VM   string
+	// Status is the status the alarm turned to, e.g. red.
+	Status types.ManagedEntityStatus
+}
+
+// Inventory references the objects created by Setup by name.
+type Inventory struct {
+	Client *vim25.Client
+	REST   *rest.Client
+
+	Categories map[string]string // ids by name
+	Tags       map[string]string // ids by category:name
+	Folders    map[string]types.ManagedObjectReference
+	VMs        map[string]types.ManagedObjectReference
+	Alarms     map[string]types.ManagedObjectReference
+
+	alarms map[string]Alarm
+}
+
+// Default returns the inventory the examples expect:
+//
+//   - the category veba with the tags auto-remediate and remediated
+//   - web-01 tagged veba:auto-remediate, web-02 in the folder opted-in tagged
+//     veba:auto-remediate and web-03 without tag
+//   - the system VMs vCLS-1 (by name), agent-01 (in the resource pool ESX
+//     Agents) and eam-01 (managed by the ESX Agent Manager)
+//   - the alarm VM CPU Usage turned red on web-01 and VM Memory Usage turned
+//     yellow on web-03
+func Default() Fixture {
+	return Fixture{
+		Categories: []Category{{Name: "veba", Tags: []string{"auto-remediate", "remediated"}}},
+		Folders:    []Folder{{Name: "opted-in", Tags: []string{"veba:auto-remediate"}}},
+		VMs: []VM{
+			{Name: "web-01", Tags: []string{"veba:auto-remediate"}},
+			{Name: "web-02", Folder: "opted-in"},
+			{Name: "web-03"},
+			{Name: "vCLS-1", PoweredOff: true},
+			{Name: "agent-01", ResourcePool: "ESX Agents"},
+			{Name: "eam-01", ManagedBy: "com.vmware.vim.eam"},
+		},
+		Alarms: []Alarm{
+			{Name: "VM CPU Usage", VM: "web-01", Status: types.ManagedEntityStatusRed},
+			{Name: "VM Memory Usage", VM: "web-03", Status: types.ManagedEntityStatusYellow},
+		},
+	}
+}
+
+// Test runs fn against a new simulator configured with f. Failures to set up
+// the inventory are returned, fn is not run then.
+func Test(f Fixture, fn func(ctx context.Context, inv *Inventory)) error {
+	var err error
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		var inv *Inventory
+		inv, err = Setup(ctx, c, f)
+		if err != nil {
+			return
+		}
+
+		fn(ctx, inv)
+	})
+
+	return err
+}
+
+// Setup creates f in the simulator of c. Alarms are set on the VMs in the
+// memory of the simulator, so Setup must run in the process of the simulator,
+// e.g. in Test or simulator.Test.
+func Setup(ctx context.Context, c *vim25.Client, f Fixture) (*Inventory, error) {
+	rc := rest.NewClient(c)
+	if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	inv := &Inventory{
+		Client:     c,
+		REST:       rc,
+		Categories: map[string]string{},
+		Tags:       map[string]string{},
+		Folders:    map[string]types.ManagedObjectReference{},
+		VMs:        map[string]types.ManagedObjectReference{},
+		Alarms:     map[string]types.ManagedObjectReference{},
+		alarms:     map[string]Alarm{},
+	}
+
+	for _, step := range []func(context.Context, Fixture) error{inv.createTags, inv.createFolders, inv.createVMs, inv.triggerAlarms} {
+		if err := step(ctx, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return inv, nil
+}
+
+// createTags creates the categories and their tags.
+func (inv *Inventory) createTags(ctx context.Context, f Fixture) error {
+	m := tags.NewManager(inv.REST)
+
+	for _, cat := range f.Categories {
+		cardinality := cat.Cardinality
+		if cardinality == "" {
+			cardinality = "MULTIPLE"
+		}
+
+		id, err := m.CreateCategory(ctx, &tags.Category{Name: cat.Name, Cardinality: cardinality})
+		if err != nil {
+			return fmt.Errorf("create category %v failed: %w", cat.Name, err)
+		}
+		inv.Categories[cat.Name] = id
+
+		for _, name := range cat.Tags {
+			tagID, err := m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: id})
+			if err != nil {
+				return fmt.Errorf("create tag %v:%v failed: %w", cat.Name, name, err)
+			}
+			inv.Tags[cat.Name+":"+name] = tagID
+		}
+	}
+
+	return nil
+}
+
+// createFolders creates the VM folders and tags them.
+func (inv *Inventory) createFolders(ctx context.Context, f Fixture) error {
+	vmFolder, err := find.NewFinder(inv.Client).DefaultFolder(ctx)
+	if err != nil {
+		return fmt.Errorf("find VM folder failed: %w", err)
+	}
+
+	for _, spec := range f.Folders {
+		folder, err := vmFolder.CreateFolder(ctx, spec.Name)
+		if err != nil {
+			return fmt.Errorf("create folder %v failed: %w", spec.Name, err)
+		}
+		inv.Folders[spec.Name] = folder.Reference()
+
+		if err := inv.attach(ctx, folder.Reference(), spec.Tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createVMs creates the VMs on the first host of the cluster and tags them.
+func (inv *Inventory) createVMs(ctx context.Context, f Fixture) error {
+	finder := find.NewFinder(inv.Client)
+
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		return fmt.Errorf("find datacenter failed: %w", err)
+	}
+	finder.SetDatacenter(dc)
+
+	cluster, err := finder.DefaultClusterComputeResource(ctx)
+	if err != nil {
+		return fmt.Errorf("find cluster failed: %w", err)
+	}
+	root, err := cluster.ResourcePool(ctx)
+	if err != nil {
+		return fmt.Errorf("find resource pool of cluster failed: %w", err)
+	}
+	vmFolder, err := finder.DefaultFolder(ctx)
+	if err != nil {
+		return fmt.Errorf("find VM folder failed: %w", err)
+	}
+	ds, err := finder.DefaultDatastore(ctx)
+	if err != nil {
+		return fmt.Errorf("find datastore failed: %w", err)
+	}
+
+	pools := map[string]*object.ResourcePool{"": root}
+
+	for _, spec := range f.VMs {
+		pool, ok := pools[spec.ResourcePool]
+		if !ok {
+			pool, err = root.Create(ctx, spec.ResourcePool, types.DefaultResourceConfigSpec())
+			if err != nil {
+				return fmt.Errorf("create resource pool %v failed: %w", spec.ResourcePool, err)
+			}
+			pools[spec.ResourcePool] = pool
+		}
+
+		folder := vmFolder
+		if spec.Folder != "" {
+			ref, ok := inv.Folders[spec.Folder]
+			if !ok {
+				return fmt.Errorf("folder %v of VM %v is not in the fixture", spec.Folder, spec.Name)
+			}
+			folder = object.NewFolder(inv.Client, ref)
+		}
+
+		config := types.VirtualMachineConfigSpec{
+			Name:    spec.Name,
+			GuestId: string(types.VirtualMachineGuestOsIdentifierOtherGuest),
+			Files:   &types.VirtualMachineFileInfo{VmPathName: fmt.Sprintf("[%v]", ds.Name())},
+		}
+		if spec.ManagedBy != "" {
+			config.ManagedBy = &types.ManagedByInfo{ExtensionKey: spec.ManagedBy, Type: "VirtualMachine"}
+		}
+
+		vm, err := inv.createVM(ctx, folder, pool, config, !spec.PoweredOff)
+		if err != nil {
+			return err
+		}
+		inv.VMs[spec.Name] = vm.Reference()
+
+		if err := inv.attach(ctx, vm.Reference(), spec.Tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createVM creates a VM and powers it on.
+func (inv *Inventory) createVM(ctx context.Context, folder *object.Folder, pool *object.ResourcePool, config types.VirtualMachineConfigSpec, powerOn bool) (*object.VirtualMachine, error) {
+	task, err := folder.CreateVM(ctx, config, pool, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create VM %v failed: %w", config.Name, err)
+	}
+
+	res, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create VM %v failed: %w", config.Name, err)
+	}
+	vm := object.NewVirtualMachine(inv.Client, res.Result.(types.ManagedObjectReference))
+
+	if powerOn {
+		task, err := vm.PowerOn(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("power on VM %v failed: %w", config.Name, err)
+		}
+	}
+
+	return vm, nil
+}
+
+// attach attaches the tags named category:name to ref.
+func (inv *Inventory) attach(ctx context.Context, ref types.ManagedObjectReference, names []string) error {
+	m := tags.NewManager(inv.REST)
+
+	for _, name := range names {
+		id, ok := inv.Tags[name]
+		if !ok {
+			return fmt.Errorf("tag %v of %v is not in the fixture", name, ref.Value)
+		}
+
+		if err := m.AttachTag(ctx, id, ref); err != nil {
+			return fmt.Errorf("attach tag %v to %v failed: %w", name, ref.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// triggerAlarms adds the alarms to the triggered alarm states of their VMs.
+// The simulator has no alarm manager, so the alarms are references without
+// definition.
+func (inv *Inventory) triggerAlarms(ctx context.Context, f Fixture) error {
+	for i, a := range f.Alarms {
+		ref, ok := inv.VMs[a.VM]
+		if !ok {
+			return fmt.Errorf("VM %v of alarm %v is not in the fixture", a.VM, a.Name)
+		}
+
+		vm, ok := simulator.Map.Get(ref).(*simulator.VirtualMachine)
+		if !ok {
+			return fmt.Errorf("VM %v of alarm %v is not in the simulator", a.VM, a.Name)
+		}
+
+		alarm := types.ManagedObjectReference{Type: "Alarm", Value: fmt.Sprintf("alarm-fixture-%d", i+1)}
+		state := types.AlarmState{
+			Key:           fmt.Sprintf("%v.%v", alarm.Value, ref.Value),
+			Entity:        ref,
+			Alarm:         alarm,
+			OverallStatus: a.Status,
+			Time:          time.Now(),
+		}
+
+		simulator.Map.WithLock(vm, func() {
+			vm.TriggeredAlarmState = append(vm.TriggeredAlarmState, state)
+			vm.OverallStatus = a.Status
+		})
+
+		inv.Alarms[a.Name] = alarm
+		inv.alarms[a.Name] = a
+	}
+
+	return nil
+}
+
+// AlarmEvent returns the CloudEvent of the AlarmStatusChangedEvent of the
+// alarm name turning from green to its status, as sent by the event router.
+func (inv *Inventory) AlarmEvent(name string) ([]byte, error) {
+	a, ok := inv.alarms[name]
+	if !ok {
+		return nil, fmt.Errorf("alarm %v is not in the fixture", name)
+	}
+
+	vm := inv.VMs[a.VM]
+	data := types.AlarmStatusChangedEvent{
+		AlarmEvent: types.AlarmEvent{
+			Event: types.Event{
+				CreatedTime:          time.Now().UTC(),
+				Vm:                   &types.VmEventArgument{EntityEventArgument: types.EntityEventArgument{Name: a.VM}, Vm: vm},
+				FullFormattedMessage: fmt.Sprintf("Alarm '%v' on %v changed from Green to %v", name, a.VM, strings.ToUpper(string(a.Status[:1]))+string(a.Status[1:])),
+			},
+			Alarm: types.AlarmEventArgument{EntityEventArgument: types.EntityEventArgument{Name: name}, Alarm: inv.Alarms[name]},
+		},
+		Source: types.ManagedEntityEventArgument{EntityEventArgument: types.EntityEventArgument{Name: a.VM}, Entity: vm},
+		Entity: types.ManagedEntityEventArgument{EntityEventArgument: types.EntityEventArgument{Name: a.VM}, Entity: vm},
+		From:   string(types.ManagedEntityStatusGreen),
+		To:     string(a.Status),
+	}
+
+	return cloudEvent("AlarmStatusChangedEvent", data)
+}
+
+// VMEvent returns the CloudEvent of a VM event, e.g. VmPoweredOnEvent, of the
+// VM name, as sent by the event router.
+func (inv *Inventory) VMEvent(subject, name string) ([]byte, error) {
+	vm, ok := inv.VMs[name]
+	if !ok {
+		return nil, fmt.Errorf("VM %v is not in the fixture", name)
+	}
+
+	data := types.VmEvent{
+		Event: types.Event{
+			CreatedTime:          time.Now().UTC(),
+			Vm:                   &types.VmEventArgument{EntityEventArgument: types.EntityEventArgument{Name: name}, Vm: vm},
+			FullFormattedMessage: fmt.Sprintf("%v of %v", subject, name),
+		},
+	}
+
+	return cloudEvent(subject, data)
+}
+
+// cloudEvent wraps data in the CloudEvent envelope of the event router.
+func cloudEvent(subject string, data interface{}) ([]byte, error) {
+	now := time.Now().UTC()
+
+	return json.Marshal(map[string]interface{}{
+		"id":              fmt.Sprintf("simfixtures-%d", now.UnixNano()),
+		"source":          "https://vcsim/sdk",
+		"specversion":     "1.0",
+		"type":            "com.vmware.event.router/event",
+		"subject":         subject,
+		"time":            now,
+		"datacontenttype": "application/json",
+		"data":            data,
+	})
+}
+
+// VM returns the VM name with its name, config, runtime and triggered alarms,
+// e.g. to check the effects of a function.
+func (inv *Inventory) VM(ctx context.Context, name string) (*mo.VirtualMachine, error) {
+	ref, ok := inv.VMs[name]
+	if !ok {
+		return nil, fmt.Errorf("VM %v is not in the fixture", name)
+	}
+
+	var vm mo.VirtualMachine
+	err := object.NewVirtualMachine(inv.Client, ref).Properties(ctx, ref, []string{"name", "config", "runtime", "triggeredAlarmState"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VM %v failed: %w", name, err)
+	}
+
+	return &vm, nil
+}
+
+// Attached returns the tags attached to the VM or folder name as
+// category:name, e.g. to check the effects of a function.
+func (inv *Inventory) Attached(ctx context.Context, name string) ([]string, error) {
+	ref, ok := inv.VMs[name]
+	if !ok {
+		if ref, ok = inv.Folders[name]; !ok {
+			return nil, fmt.Errorf("object %v is not in the fixture", name)
+		}
+	}
+
+	ids, err := tags.NewManager(inv.REST).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("list tags of %v failed: %w", name, err)
+	}
+
+	byID := make(map[string]string, len(inv.Tags))
+	for name, id := range inv.Tags {
+		byID[id] = name
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := byID[id]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, id)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,169 @@
+package simfixtures
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestDefault ensures the default fixture creates the inventory the examples
+// expect.
+func TestDefault(t *testing.T) {
+	err := Test(Default(), func(ctx context.Context, inv *Inventory) {
+		t.Log("=========== Test that tags are attached to VMs and folders ===========")
+		for name, want := range map[string][]string{
+			"web-01":   {"veba:auto-remediate"},
+			"web-02":   {},
+			"opted-in": {"veba:auto-remediate"},
+		} {
+			got, err := inv.Attached(ctx, name)
+			if err != nil {
+				t.Log(failMark, err)
+				t.Fail()
+				continue
+			}
+			sort.Strings(got)
+
+			if reflect.DeepEqual(got, want) {
+				t.Logf("got expected tags of %v: %v. %v", name, got, passMark)
+			} else {
+				t.Logf("expected tags of %v: %v, got: %v. %v", name, want, got, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that VMs are placed and managed as specified ===========")
+		vm, err := inv.VM(ctx, "eam-01")
+		if err == nil && vm.Config.ManagedBy != nil && vm.Config.ManagedBy.ExtensionKey == "com.vmware.vim.eam" {
+			t.Logf("got expected: eam-01 managed by %v. %v", vm.Config.ManagedBy.ExtensionKey, passMark)
+		} else {
+			t.Logf("expected eam-01 managed by com.vmware.vim.eam, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		pool, err := object.NewVirtualMachine(inv.Client, inv.VMs["agent-01"]).ResourcePool(ctx)
+		var name string
+		if err == nil {
+			name, err = pool.ObjectName(ctx)
+		}
+		if err == nil && name == "ESX Agents" {
+			t.Logf("got expected: agent-01 in %v. %v", name, passMark)
+		} else {
+			t.Logf("expected agent-01 in ESX Agents, got: %v, %v. %v", name, err, failMark)
+			t.Fail()
+		}
+
+		vm, err = inv.VM(ctx, "vCLS-1")
+		if err == nil && vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOff {
+			t.Logf("got expected: vCLS-1 %v. %v", vm.Runtime.PowerState, passMark)
+		} else {
+			t.Logf("expected vCLS-1 powered off, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that alarms are triggered on their VMs ===========")
+		vm, err = inv.VM(ctx, "web-01")
+		if err == nil && len(vm.TriggeredAlarmState) == 1 &&
+			vm.TriggeredAlarmState[0].Alarm == inv.Alarms["VM CPU Usage"] &&
+			vm.TriggeredAlarmState[0].OverallStatus == types.ManagedEntityStatusRed {
+			t.Logf("got expected: %v. %v", vm.TriggeredAlarmState[0].Alarm, passMark)
+		} else {
+			t.Logf("expected VM CPU Usage red on web-01, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// TestEvents ensures events are built for the fixture objects only.
+func TestEvents(t *testing.T) {
+	err := Test(Default(), func(ctx context.Context, inv *Inventory) {
+		var tests = []struct {
+			testDesc  string
+			event     func() ([]byte, error)
+			expectErr bool
+			subject   string
+			vm        string
+		}{
+			{"Test that an alarm event references the alarm and VM", func() ([]byte, error) { return inv.AlarmEvent("VM CPU Usage") }, false, "AlarmStatusChangedEvent", "web-01"},
+			{"Test that a VM event references the VM", func() ([]byte, error) { return inv.VMEvent("VmPoweredOnEvent", "web-03") }, false, "VmPoweredOnEvent", "web-03"},
+			{"Test that an unknown alarm results in error", func() ([]byte, error) { return inv.AlarmEvent("Host CPU Usage") }, true, "", ""},
+			{"Test that an unknown VM results in error", func() ([]byte, error) { return inv.VMEvent("VmPoweredOnEvent", "web-99") }, true, "", ""},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			body, err := tc.event()
+			if err != nil {
+				if tc.expectErr {
+					// An error is expected.
+					t.Logf("got an error, as expected: %v. %v", err, passMark)
+				} else {
+					t.Log(tc.testDesc, failMark, err)
+					t.Fail()
+				}
+				continue
+			}
+
+			var event struct {
+				Subject string
+				Data    struct {
+					Vm struct {
+						Name string
+						Vm   types.ManagedObjectReference
+					}
+				}
+			}
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			if !tc.expectErr && event.Subject == tc.subject && event.Data.Vm.Name == tc.vm && event.Data.Vm.Vm == inv.VMs[tc.vm] {
+				t.Logf("got expected: %+v. %v", event, passMark)
+			} else {
+				t.Logf("expected: %v of %v, got: %+v. %v", tc.subject, tc.vm, event, failMark)
+				t.Fail()
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+}
+
+// TestSetupErr ensures references to objects missing from the fixture result
+// in error.
+func TestSetupErr(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		fixture  Fixture
+	}{
+		{"Test that an unknown tag results in error", Fixture{VMs: []VM{{Name: "vm", Tags: []string{"veba:unknown"}}}}},
+		{"Test that an unknown folder results in error", Fixture{VMs: []VM{{Name: "vm", Folder: "unknown"}}}},
+		{"Test that an alarm on an unknown VM results in error", Fixture{Alarms: []Alarm{{Name: "alarm", VM: "unknown"}}}},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		ran := false
+		err := Test(tc.fixture, func(context.Context, *Inventory) { ran = true })
+		if err != nil && !ran {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected an error, got: %v. %v", err, failMark)
+			t.Fail()
+		}
+	}
+}
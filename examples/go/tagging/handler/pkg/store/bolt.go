@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("veba")
+
+// Bolt is a Store backed by an embedded BoltDB file. It is meant for single
+// pod deployments where the file lives on a (persistent) volume.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens (or creates) the BoltDB file at path.
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database failed: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bolt bucket failed: %w", err)
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+// Get implements Store. Expired keys are removed lazily.
+func (b *Bolt) Get(_ context.Context, key string) ([]byte, error) {
+	var value []byte
+	expired := false
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucket).Get([]byte(key))
+		if raw == nil {
+			return ErrNotFound
+		}
+
+		v, ok := decode(raw, time.Now())
+		if !ok {
+			expired = true
+			return ErrNotFound
+		}
+
+		// Bolt values are only valid during the transaction.
+		value = append([]byte(nil), v...)
+		return nil
+	})
+
+	if expired {
+		_ = b.deleteExpired(key)
+	}
+
+	return value, err
+}
+
+// deleteExpired removes key if it is still expired. The expiry is checked
+// again in the write transaction, as the key may have been set since it was
+// read.
+func (b *Bolt) deleteExpired(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+
+		raw := bkt.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		if _, ok := decode(raw, time.Now()); ok {
+			return nil
+		}
+
+		return bkt.Delete([]byte(key))
+	})
+}
+
+// Set implements Store.
+func (b *Bolt) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), encode(value, ttl))
+	})
+}
+
+// SetNX implements Store.
+func (b *Bolt) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	stored := false
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+
+		if raw := bkt.Get([]byte(key)); raw != nil {
+			if _, ok := decode(raw, time.Now()); ok {
+				return nil
+			}
+		}
+
+		stored = true
+		return bkt.Put([]byte(key), encode(value, ttl))
+	})
+
+	return stored, err
+}
+
+// Delete implements Store.
+func (b *Bolt) Delete(_ context.Context, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// Close implements Store.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// encode prefixes value with its expiry as unix nanoseconds (0 = no expiry).
+func encode(value []byte, ttl time.Duration) []byte {
+	var expiry int64
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl).UnixNano()
+	}
+
+	raw := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(raw, uint64(expiry))
+	copy(raw[8:], value)
+
+	return raw
+}
+
+// decode returns the value in raw and whether it is still valid at now.
+func decode(raw []byte, now time.Time) ([]byte, bool) {
+	if len(raw) < 8 {
+		return nil, false
+	}
+
+	expiry := int64(binary.BigEndian.Uint64(raw))
+	if expiry != 0 && now.UnixNano() >= expiry {
+		return nil, false
+	}
+
+	return raw[8:], true
+}
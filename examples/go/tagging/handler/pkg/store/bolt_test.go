@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestBolt shows values can be stored, expire and are only set once with SetNX.
+func TestBolt(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "store")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(Config{Type: TypeBolt, Path: filepath.Join(dir, "veba.db")})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer s.Close()
+
+	t.Log("=========== Test that a stored value can be read back ===========")
+	if err := s.Set(ctx, "a", []byte("1"), 0); err != nil {
+		t.Fatal(failMark, err)
+	}
+	v, err := s.Get(ctx, "a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("expected: '1', got: '%s' (%v). %v", v, err, failMark)
+	}
+	t.Logf("got expected: '1'. %v", passMark)
+
+	t.Log("=========== Test that an expired value is not found ===========")
+	if err := s.Set(ctx, "b", []byte("2"), time.Millisecond); err != nil {
+		t.Fatal(failMark, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Get(ctx, "b"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v. %v", ErrNotFound, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", ErrNotFound, passMark)
+
+	t.Log("=========== Test that SetNX does not overwrite a live key ===========")
+	ok, err := s.SetNX(ctx, "a", []byte("3"), 0)
+	if err != nil || ok {
+		t.Fatalf("expected SetNX to be rejected, got: %v (%v). %v", ok, err, failMark)
+	}
+	ok, err = s.SetNX(ctx, "b", []byte("3"), 0)
+	if err != nil || !ok {
+		t.Fatalf("expected SetNX on expired key to succeed, got: %v (%v). %v", ok, err, failMark)
+	}
+	t.Logf("got expected SetNX results. %v", passMark)
+
+	t.Log("=========== Test that a deleted value is not found ===========")
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatal(failMark, err)
+	}
+	if _, err := s.Get(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v. %v", ErrNotFound, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", ErrNotFound, passMark)
+}
+
+// TestBoltExpiredRace ensures the lazy removal of an expired key does not
+// delete a value set after the expired one was read.
+func TestBoltExpiredRace(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "store")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewBolt(filepath.Join(dir, "veba.db"))
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer b.Close()
+
+	t.Log("=========== Test that a key set after it expired is kept ===========")
+	if err := b.Set(ctx, "a", []byte("1"), time.Millisecond); err != nil {
+		t.Fatal(failMark, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// A Set between the read of the expired key and its removal.
+	if err := b.Set(ctx, "a", []byte("2"), 0); err != nil {
+		t.Fatal(failMark, err)
+	}
+	if err := b.deleteExpired("a"); err != nil {
+		t.Fatal(failMark, err)
+	}
+	v, err := b.Get(ctx, "a")
+	if err != nil || string(v) != "2" {
+		t.Fatalf("expected: '2', got: '%s' (%v). %v", v, err, failMark)
+	}
+	t.Logf("got expected: '2'. %v", passMark)
+
+	t.Log("=========== Test that a key still expired is removed ===========")
+	if err := b.Set(ctx, "b", []byte("3"), time.Millisecond); err != nil {
+		t.Fatal(failMark, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := b.deleteExpired("b"); err != nil {
+		t.Fatal(failMark, err)
+	}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucket).Get([]byte("b")) != nil {
+			return errors.New("expired key not removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err, failMark)
+	}
+	t.Logf("got expected: removed. %v", passMark)
+}
+
+// TestOpen ensures incomplete store configurations are rejected.
+func TestOpen(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		cfg      Config
+	}{
+		{"Test that bolt without path ends in error", Config{Type: TypeBolt}},
+		{"Test that redis without address ends in error", Config{Type: TypeRedis}},
+		{"Test that unknown store type ends in error", Config{Type: "etcd"}},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		_, err := Open(tc.cfg)
+		if err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Log(tc.testDesc, failMark)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Store which keeps values in the memory of the process. Values
+// are lost on restart and not shared between replicas, so it is meant for
+// state which is cheap to lose.
+type Memory struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+}
+
+type memoryValue struct {
+	value   []byte
+	expires time.Time // zero if the value does not expire
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{values: map[string]memoryValue{}}
+}
+
+// Get implements Store.
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.live(key, time.Now())
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), v.value...), nil
+}
+
+// Set implements Store. Expired keys are removed on every Set, so the memory
+// held is bounded by the live keys.
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.prune(now)
+	m.values[key] = newMemoryValue(value, ttl, now)
+
+	return nil
+}
+
+// SetNX implements Store.
+func (m *Memory) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := m.live(key, now); ok {
+		return false, nil
+	}
+
+	m.prune(now)
+	m.values[key] = newMemoryValue(value, ttl, now)
+
+	return true, nil
+}
+
+// Delete implements Store.
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+
+	return nil
+}
+
+// Close implements Store.
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) live(key string, now time.Time) (memoryValue, bool) {
+	v, ok := m.values[key]
+	if !ok || (!v.expires.IsZero() && !now.Before(v.expires)) {
+		return memoryValue{}, false
+	}
+
+	return v, true
+}
+
+func (m *Memory) prune(now time.Time) {
+	for k, v := range m.values {
+		if !v.expires.IsZero() && !now.Before(v.expires) {
+			delete(m.values, k)
+		}
+	}
+}
+
+func newMemoryValue(value []byte, ttl time.Duration, now time.Time) memoryValue {
+	v := memoryValue{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+
+	return v
+}
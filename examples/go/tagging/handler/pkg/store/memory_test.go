@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestMemory shows the memory store honors TTLs and SetNX like the other
+// stores.
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := Open(Config{Type: TypeMemory})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer s.Close()
+
+	t.Log("=========== Test that an expired value is not found and replaced by SetNX ===========")
+	if err := s.Set(ctx, "a", []byte("1"), time.Millisecond); err != nil {
+		t.Fatal(failMark, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Get(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v. %v", ErrNotFound, err, failMark)
+	}
+	ok, err := s.SetNX(ctx, "a", []byte("2"), 0)
+	if err != nil || !ok {
+		t.Fatalf("expected SetNX on expired key to succeed, got: %v (%v). %v", ok, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", ErrNotFound, passMark)
+
+	t.Log("=========== Test that SetNX does not overwrite a live key ===========")
+	ok, err = s.SetNX(ctx, "a", []byte("3"), 0)
+	if err != nil || ok {
+		t.Fatalf("expected SetNX to be rejected, got: %v (%v). %v", ok, err, failMark)
+	}
+	v, err := s.Get(ctx, "a")
+	if err != nil || string(v) != "2" {
+		t.Fatalf("expected: '2', got: '%s' (%v). %v", v, err, failMark)
+	}
+	t.Logf("got expected: '2'. %v", passMark)
+}
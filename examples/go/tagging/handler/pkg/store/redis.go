@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redis is a Store backed by a Redis server. It is meant for deployments with
+// multiple function replicas sharing state.
+type Redis struct {
+	pool *redis.Pool
+}
+
+// NewRedis returns a Redis store. Connections are established lazily.
+func NewRedis(address, password string, db int) *Redis {
+	pool := &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address,
+				redis.DialPassword(password),
+				redis.DialDatabase(db),
+				redis.DialConnectTimeout(5*time.Second),
+			)
+		},
+	}
+
+	return &Redis{pool: pool}
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("redis connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get failed: %w", err)
+	}
+
+	return value, nil
+}
+
+// Set implements Store.
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("redis connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(key, value)
+	if ttl > 0 {
+		args = args.Add("PX", milliseconds(ttl))
+	}
+
+	_, err = conn.Do("SET", args...)
+	if err != nil {
+		return fmt.Errorf("redis set failed: %w", err)
+	}
+
+	return nil
+}
+
+// SetNX implements Store.
+func (r *Redis) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("redis connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(key, value, "NX")
+	if ttl > 0 {
+		args = args.Add("PX", milliseconds(ttl))
+	}
+
+	// SET with NX replies nil if the key already exists.
+	reply, err := conn.Do("SET", args...)
+	if err != nil {
+		return false, fmt.Errorf("redis setnx failed: %w", err)
+	}
+
+	return reply != nil, nil
+}
+
+// Delete implements Store.
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("redis connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", key)
+	if err != nil {
+		return fmt.Errorf("redis delete failed: %w", err)
+	}
+
+	return nil
+}
+
+// milliseconds returns ttl in milliseconds for PX, at least 1: Redis rejects
+// PX 0 as invalid expire time.
+func milliseconds(ttl time.Duration) int64 {
+	if ms := ttl.Milliseconds(); ms > 0 {
+		return ms
+	}
+
+	return 1
+}
+
+// Close implements Store.
+func (r *Redis) Close() error {
+	return r.pool.Close()
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestRedis shows the redis store honors TTLs and SetNX like the other
+// stores, including TTLs below the millisecond resolution of Redis.
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer srv.Close()
+
+	s, err := Open(Config{Type: TypeRedis, Address: srv.Addr()})
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	defer s.Close()
+
+	t.Log("=========== Test that a value is read back ===========")
+	if err := s.Set(ctx, "a", []byte("1"), time.Minute); err != nil {
+		t.Fatal(failMark, err)
+	}
+	v, err := s.Get(ctx, "a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("expected: '1', got: '%s' (%v). %v", v, err, failMark)
+	}
+	t.Logf("got expected: '1'. %v", passMark)
+
+	var tests = []struct {
+		testDesc string
+		ttl      time.Duration
+	}{
+		{"Test that an expired value is not found", time.Millisecond},
+		{"Test that a TTL below a millisecond is accepted and expires", time.Microsecond},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if err := s.Set(ctx, "b", []byte("1"), tc.ttl); err != nil {
+			t.Fatalf("expected TTL %v to be accepted, got: %v. %v", tc.ttl, err, failMark)
+		}
+		if ok, err := s.SetNX(ctx, "c", []byte("1"), tc.ttl); err != nil || !ok {
+			t.Fatalf("expected SetNX with TTL %v to succeed, got: %v (%v). %v", tc.ttl, ok, err, failMark)
+		}
+		srv.FastForward(5 * time.Millisecond)
+
+		_, errB := s.Get(ctx, "b")
+		_, errC := s.Get(ctx, "c")
+		if errB == ErrNotFound && errC == ErrNotFound {
+			t.Logf("got expected: %v. %v", ErrNotFound, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v, %v. %v", ErrNotFound, errB, errC, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that SetNX does not overwrite a live key ===========")
+	ok, err := s.SetNX(ctx, "a", []byte("2"), 0)
+	if err != nil || ok {
+		t.Fatalf("expected SetNX to be rejected, got: %v (%v). %v", ok, err, failMark)
+	}
+	t.Logf("got expected: rejected. %v", passMark)
+
+	t.Log("=========== Test that a deleted value is not found ===========")
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatal(failMark, err)
+	}
+	if _, err := s.Get(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v. %v", ErrNotFound, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", ErrNotFound, passMark)
+}
@@ -0,0 +1,65 @@
+// Package store provides a small key/value persistence interface with TTL
+// semantics. It backs the features of the function which need to keep state
+// between invocations, e.g. deduplication, cooldowns or session caching.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Supported store types.
+const (
+	TypeBolt   = "bolt"
+	TypeRedis  = "redis"
+	TypeMemory = "memory"
+)
+
+// ErrNotFound is returned when a key does not exist or is expired.
+var ErrNotFound = errors.New("key not found")
+
+// Store persists values by key. A ttl of zero means the value never expires.
+type Store interface {
+	// Get returns the value stored under key or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key, overwriting any existing value.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX stores value under key only if the key does not exist yet. It
+	// reports whether the value was stored.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Config selects and configures a Store implementation.
+type Config struct {
+	Type     string // bolt, redis or memory
+	Path     string // bolt: database file path
+	Address  string // redis: host:port
+	Password string // redis: optional password
+	DB       int    // redis: database number
+}
+
+// Open returns the Store described by cfg.
+func Open(cfg Config) (Store, error) {
+	switch cfg.Type {
+	case TypeBolt:
+		if cfg.Path == "" {
+			return nil, errors.New("bolt store requires a path")
+		}
+		return NewBolt(cfg.Path)
+	case TypeRedis:
+		if cfg.Address == "" {
+			return nil, errors.New("redis store requires an address")
+		}
+		return NewRedis(cfg.Address, cfg.Password, cfg.DB), nil
+	case TypeMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported store type %q", cfg.Type)
+	}
+}
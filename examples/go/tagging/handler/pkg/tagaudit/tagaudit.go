@@ -0,0 +1,57 @@
+// Package tagaudit stores audit context in the description of tags which are
+// created automatically, so a tag carries why and when it was created. The
+// description holds a small JSON document which Parse reads back.
+package tagaudit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// version identifies descriptions written by this package.
+const version = 1
+
+// ErrNoRecord is returned by Parse for descriptions without an audit record,
+// e.g. descriptions of tags created manually.
+var ErrNoRecord = errors.New("tag description holds no audit record")
+
+// Record is the audit context of a tag.
+type Record struct {
+	Version  int       `json:"veba_audit"`
+	Previous string    `json:"previous,omitempty"` // value replaced by the tag, if any
+	Value    string    `json:"value"`              // value the tag represents
+	EventID  string    `json:"event_id,omitempty"` // ID of the triggering event
+	Time     time.Time `json:"time"`
+}
+
+// Description returns r encoded for a tag description.
+func (r Record) Description() (string, error) {
+	r.Version = version
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC().Truncate(time.Second)
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("encoding audit record failed: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// Parse returns the audit record of a tag description or ErrNoRecord.
+func Parse(description string) (Record, error) {
+	var r Record
+	if err := json.Unmarshal([]byte(description), &r); err != nil || r.Version == 0 {
+		return Record{}, ErrNoRecord
+	}
+
+	if r.Version > version {
+		return Record{}, fmt.Errorf("unsupported audit record version %d", r.Version)
+	}
+
+	return r, nil
+}
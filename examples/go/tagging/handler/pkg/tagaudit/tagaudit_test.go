@@ -0,0 +1,51 @@
+package tagaudit
+
+import (
+	"testing"
+	"time"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestParse shows audit records survive the round trip through a tag
+// description and other descriptions are recognized.
+func TestParse(t *testing.T) {
+	want := Record{
+		Version:  version,
+		Previous: "4 vCPU",
+		Value:    "8 vCPU",
+		EventID:  "b4e6c0a2-1c3f-4a4e-8f7c-6d1e2a9b0c31",
+		Time:     time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	t.Log("=========== Test that a record is read back from its description ===========")
+	desc, err := want.Description()
+	if err != nil {
+		t.Fatal(failMark, err)
+	}
+	got, err := Parse(desc)
+	if err != nil || got != want {
+		t.Fatalf("expected: %+v, got: %+v (%v). %v", want, got, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", desc, passMark)
+
+	var tests = []struct {
+		testDesc    string
+		description string
+	}{
+		{"Test that a manual description holds no record", "Production web servers"},
+		{"Test that JSON without version holds no record", `{"value":"8 vCPU"}`},
+		{"Test that an empty description holds no record", ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		if _, err := Parse(tc.description); err == ErrNoRecord {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", ErrNoRecord, err, failMark)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package vevents
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// traceParent matches the version 00 traceparent of W3C Trace Context:
+// version, trace id, parent id and flags.
+var traceParent = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// Causality holds the CloudEvent extensions linking an event to the chain of
+// events it belongs to. TraceParent and TraceState are those of the CloudEvents
+// distributed tracing extension, CausationID is the id of the event which
+// caused this one and CorrelationID the id of the first event of the chain.
+// Events of vCenter carry none of them.
+type Causality struct {
+	TraceParent   string `json:"traceparent,omitempty"`
+	TraceState    string `json:"tracestate,omitempty"`
+	CausationID   string `json:"causationid,omitempty"`
+	CorrelationID string `json:"correlationid,omitempty"`
+}
+
+// TraceID returns the trace id of the traceparent, empty if there is no
+// valid traceparent.
+func (c Causality) TraceID() string {
+	m := traceParent.FindStringSubmatch(c.TraceParent)
+	if m == nil || m[1] == "00000000000000000000000000000000" {
+		return ""
+	}
+
+	return m[1]
+}
+
+// Root returns the id of the first event of the chain of ce, which is ce
+// itself unless it was caused by another event.
+func (ce *CloudEvent) Root() string {
+	if ce.CorrelationID != "" {
+		return ce.CorrelationID
+	}
+
+	return ce.ID
+}
+
+// Chained reports whether ce was caused by another event or carries a trace.
+func (ce *CloudEvent) Chained() bool {
+	return ce.CausationID != "" || ce.TraceID() != ""
+}
+
+// Child returns the causality of an event caused by ce. The trace of ce is
+// continued with a new parent id. Without a trace, the trace id is derived
+// from the root of the chain, so all events of a chain share it, even if its
+// first event carries no trace.
+func (ce *CloudEvent) Child() Causality {
+	trace := ce.TraceID()
+	if trace == "" {
+		sum := sha256.Sum256([]byte(ce.Root()))
+		trace = hex.EncodeToString(sum[:16])
+	}
+
+	return Causality{
+		TraceParent:   fmt.Sprintf("00-%v-%v-01", trace, randomHex(8)),
+		TraceState:    ce.TraceState,
+		CausationID:   ce.ID,
+		CorrelationID: ce.Root(),
+	}
+}
+
+// FollowUp returns a CloudEvent of type typ with data, emitted by source as
+// consequence of ce.
+func (ce *CloudEvent) FollowUp(source, typ, subject string, data interface{}, now time.Time) (*CloudEvent, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding follow-up data failed: %w", err)
+	}
+
+	return &CloudEvent{
+		ID:              randomHex(16),
+		Source:          source,
+		SpecVersion:     "1.0",
+		Type:            typ,
+		Subject:         subject,
+		Time:            now.UTC(),
+		DataContentType: "application/json",
+		Data:            b,
+		Causality:       ce.Child(),
+	}, nil
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
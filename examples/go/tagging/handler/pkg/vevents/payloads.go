@@ -0,0 +1,166 @@
+package vevents
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Alarm is the payload of an AlarmStatusChangedEvent.
+type Alarm struct {
+	types.AlarmStatusChangedEvent
+}
+
+// Validate ensures the alarm, the alarmed entity and the new status are set.
+func (a *Alarm) Validate() error {
+	return missing(map[string]bool{
+		"Alarm.Alarm":   a.AlarmStatusChangedEvent.Alarm.Alarm.Value == "",
+		"Entity.Entity": a.Entity.Entity.Value == "",
+		"To":            a.To == "",
+	})
+}
+
+// Turned reports whether the alarm changed to status, e.g. "red".
+func (a *Alarm) Turned(status types.ManagedEntityStatus) bool {
+	return a.To == string(status)
+}
+
+// Power is the payload of a VM power state change event.
+type Power struct {
+	types.VmEvent
+
+	// Name is the vCenter event name, e.g. VmPoweredOnEvent.
+	Name string `json:"-"`
+}
+
+// Validate ensures the VM is set.
+func (p *Power) Validate() error {
+	return validateVM(&p.Event)
+}
+
+// State returns the power state of the VM after the event.
+func (p *Power) State() types.VirtualMachinePowerState {
+	switch p.Name {
+	case "VmPoweredOnEvent", "DrsVmPoweredOnEvent":
+		return types.VirtualMachinePowerStatePoweredOn
+	case "VmSuspendedEvent":
+		return types.VirtualMachinePowerStateSuspended
+	default:
+		return types.VirtualMachinePowerStatePoweredOff
+	}
+}
+
+// Migration is the payload of VmMigratedEvent, DrsVmMigratedEvent and
+// VmRelocatedEvent, which share the source fields.
+type Migration struct {
+	types.VmMigratedEvent
+}
+
+// Validate ensures the VM and the source host are set.
+func (m *Migration) Validate() error {
+	if err := validateVM(&m.Event); err != nil {
+		return err
+	}
+
+	return missing(map[string]bool{
+		"SourceHost.Host": m.SourceHost.Host.Value == "",
+	})
+}
+
+// Reconfigure is the payload of a VmReconfiguredEvent. ConfigSpec only mirrors
+// the scalar fields of types.VirtualMachineConfigSpec.
+type Reconfigure struct {
+	types.VmEvent
+	ConfigSpec    ConfigSpec
+	ConfigChanges *types.ChangesInfoEventArgument
+}
+
+// ConfigSpec is the subset of types.VirtualMachineConfigSpec which can be
+// decoded from JSON without knowing the concrete vSphere types.
+type ConfigSpec struct {
+	Name                string
+	Annotation          string
+	NumCPUs             int32
+	NumCoresPerSocket   int32
+	MemoryMB            int64
+	CpuHotAddEnabled    *bool
+	MemoryHotAddEnabled *bool
+}
+
+// Validate ensures the VM is set.
+func (r *Reconfigure) Validate() error {
+	return validateVM(&r.Event)
+}
+
+// Snapshot is the payload of snapshot revert events and snapshot tasks.
+type Snapshot struct {
+	types.Event
+
+	// EventTypeId is set for EventEx snapshot events.
+	EventTypeId string
+	// Info is set for snapshot tasks.
+	Info *TaskInfo
+}
+
+// TaskInfo is the subset of types.TaskInfo describing the task.
+type TaskInfo struct {
+	Key           string
+	Task          types.ManagedObjectReference
+	Name          string
+	DescriptionId string
+	State         types.TaskInfoState
+}
+
+// Validate ensures the VM is set.
+func (s *Snapshot) Validate() error {
+	return validateVM(&s.Event)
+}
+
+// Operation returns the snapshot operation, e.g. createSnapshot or revert.
+func (s *Snapshot) Operation() string {
+	if s.Info != nil {
+		// e.g. VirtualMachine.createSnapshot
+		parts := strings.Split(s.Info.DescriptionId, ".")
+		return parts[len(parts)-1]
+	}
+
+	if strings.Contains(s.EventTypeId, "Revert") {
+		return "revertToSnapshot"
+	}
+
+	return s.EventTypeId
+}
+
+// VM returns the reference of the VM an event refers to or nil.
+func VM(e *types.Event) *types.ManagedObjectReference {
+	if e.Vm == nil || e.Vm.Vm.Value == "" {
+		return nil
+	}
+
+	return &e.Vm.Vm
+}
+
+func validateVM(e *types.Event) error {
+	return missing(map[string]bool{
+		"Vm.Vm": VM(e) == nil,
+	})
+}
+
+// missing returns an error naming all fields which are missing.
+func missing(fields map[string]bool) error {
+	var names []string
+	for name, isMissing := range fields {
+		if isMissing {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("required field(s) missing: %v", strings.Join(names, ", "))
+}
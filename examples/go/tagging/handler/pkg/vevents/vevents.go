@@ -0,0 +1,222 @@
+// Package vevents provides typed access to the vCenter event payloads the
+// VMware Event Router delivers to functions as CloudEvents.
+//
+// The event router marshals the govmomi event types to JSON, so the payloads
+// below are decoded into the govmomi types wherever these can be decoded
+// without custom unmarshalling. Payloads containing vSphere interface types,
+// e.g. VirtualMachineConfigSpec, are mirrored by smaller structs instead.
+package vevents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kind groups related vCenter event types.
+type Kind string
+
+// Supported kinds of events.
+const (
+	KindUnknown     Kind = "unknown"
+	KindAlarm       Kind = "alarm"
+	KindPower       Kind = "power"
+	KindMigration   Kind = "migration"
+	KindReconfigure Kind = "reconfigure"
+	KindSnapshot    Kind = "snapshot"
+)
+
+// kinds maps the CloudEvent subject, i.e. the vCenter event name, to its kind.
+var kinds = map[string]Kind{
+	"AlarmStatusChangedEvent": KindAlarm,
+
+	"VmPoweredOnEvent":    KindPower,
+	"DrsVmPoweredOnEvent": KindPower,
+	"VmPoweredOffEvent":   KindPower,
+	"VmSuspendedEvent":    KindPower,
+
+	"VmMigratedEvent":    KindMigration,
+	"DrsVmMigratedEvent": KindMigration,
+	"VmRelocatedEvent":   KindMigration,
+
+	"VmReconfiguredEvent": KindReconfigure,
+
+	"com.vmware.vc.vm.VmStateRevertedToSnapshot":       KindSnapshot,
+	"com.vmware.vc.vm.VmStateFailedToRevertToSnapshot": KindSnapshot,
+	"TaskEvent": KindSnapshot, // only snapshot tasks, see CloudEvent.Kind
+}
+
+// ErrKind is returned when a payload is requested for an event of another kind.
+var ErrKind = errors.New("event is of a different kind")
+
+// CloudEvent is the CloudEvent envelope sent by the VMware Event Router. Events
+// emitted by functions may carry causality extensions.
+type CloudEvent struct {
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+
+	Causality
+}
+
+// Parse decodes a CloudEvent and ensures it carries a subject and data.
+func Parse(b []byte) (*CloudEvent, error) {
+	ce, err := Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ce.Validate(); err != nil {
+		return nil, err
+	}
+
+	return ce, nil
+}
+
+// Unmarshal decodes a CloudEvent without validating it, e.g. to decode the
+// envelope once for events which may lack a subject or data.
+func Unmarshal(b []byte) (*CloudEvent, error) {
+	var ce CloudEvent
+
+	err := json.Unmarshal(b, &ce)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of cloud event failed: %w", err)
+	}
+
+	return &ce, nil
+}
+
+// Validate ensures ce carries a subject and data.
+func (ce *CloudEvent) Validate() error {
+	if ce.Subject == "" {
+		return errors.New("cloud event has no subject")
+	}
+
+	if len(ce.Data) == 0 || string(ce.Data) == "null" {
+		return errors.New("cloud event has no data")
+	}
+
+	return nil
+}
+
+// Kind returns the kind of the event based on its subject. Task events are only
+// of KindSnapshot if the task is a snapshot operation.
+func (ce *CloudEvent) Kind() Kind {
+	k, ok := kinds[ce.Subject]
+	if !ok {
+		return KindUnknown
+	}
+
+	if ce.Subject == "TaskEvent" {
+		s, err := ce.decodeSnapshot()
+		if err != nil || s.Info == nil || !strings.Contains(s.Info.DescriptionId, "Snapshot") {
+			return KindUnknown
+		}
+	}
+
+	return k
+}
+
+// Created returns when vCenter created the event. It is taken from the
+// CreatedTime of the data and falls back to the CloudEvent time, which is zero
+// if neither is set.
+func (ce *CloudEvent) Created() time.Time {
+	var e struct {
+		CreatedTime time.Time
+	}
+
+	if err := json.Unmarshal(ce.Data, &e); err == nil && !e.CreatedTime.IsZero() {
+		return e.CreatedTime
+	}
+
+	return ce.Time
+}
+
+// Decode unmarshals the event data into v.
+func (ce *CloudEvent) Decode(v interface{}) error {
+	err := json.Unmarshal(ce.Data, v)
+	if err != nil {
+		return fmt.Errorf("parsing of %v data failed: %w", ce.Subject, err)
+	}
+
+	return nil
+}
+
+// Alarm returns the validated payload of an alarm event.
+func (ce *CloudEvent) Alarm() (*Alarm, error) {
+	var a Alarm
+	if err := ce.decode(KindAlarm, &a); err != nil {
+		return nil, err
+	}
+
+	return &a, a.Validate()
+}
+
+// Power returns the validated payload of a power event.
+func (ce *CloudEvent) Power() (*Power, error) {
+	var p Power
+	if err := ce.decode(KindPower, &p); err != nil {
+		return nil, err
+	}
+	p.Name = ce.Subject
+
+	return &p, p.Validate()
+}
+
+// Migration returns the validated payload of a migration event.
+func (ce *CloudEvent) Migration() (*Migration, error) {
+	var m Migration
+	if err := ce.decode(KindMigration, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, m.Validate()
+}
+
+// Reconfigure returns the validated payload of a reconfigure event.
+func (ce *CloudEvent) Reconfigure() (*Reconfigure, error) {
+	var r Reconfigure
+	if err := ce.decode(KindReconfigure, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, r.Validate()
+}
+
+// Snapshot returns the validated payload of a snapshot event.
+func (ce *CloudEvent) Snapshot() (*Snapshot, error) {
+	if ce.Kind() != KindSnapshot {
+		return nil, fmt.Errorf("%v: %w", ce.Subject, ErrKind)
+	}
+
+	s, err := ce.decodeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.Validate()
+}
+
+func (ce *CloudEvent) decodeSnapshot() (*Snapshot, error) {
+	var s Snapshot
+	if err := ce.Decode(&s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (ce *CloudEvent) decode(k Kind, v interface{}) error {
+	if ce.Kind() != k {
+		return fmt.Errorf("%v is not a %v event: %w", ce.Subject, k, ErrKind)
+	}
+
+	return ce.Decode(v)
+}
@@ -0,0 +1,202 @@
+package vevents
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+func load(t *testing.T, path string) *CloudEvent {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	ce, err := Parse(body)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	return ce
+}
+
+// TestKind ensures events are grouped by their subject.
+func TestKind(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		jsonPath string
+		want     Kind
+	}{
+		{"Test that alarm event is of kind alarm", "testdata/alarm.json", KindAlarm},
+		{"Test that power off event is of kind power", "testdata/power.json", KindPower},
+		{"Test that DRS migration is of kind migration", "testdata/migration.json", KindMigration},
+		{"Test that reconfigure event is of kind reconfigure", "testdata/reconfigure.json", KindReconfigure},
+		{"Test that snapshot task is of kind snapshot", "testdata/snapshot.json", KindSnapshot},
+		{"Test that other task is of kind unknown", "testdata/task.json", KindUnknown},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := load(t, tc.jsonPath).Kind()
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", tc.want, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPayloads shows typed payloads are decoded and validated.
+func TestPayloads(t *testing.T) {
+	t.Log("=========== Test that alarm payload is decoded ===========")
+	a, err := load(t, "testdata/alarm.json").Alarm()
+	if err != nil || !a.Turned(types.ManagedEntityStatusRed) || a.Entity.Entity.Value != "vm-42" {
+		t.Fatalf("expected red alarm on vm-42, got: %+v (%v). %v", a, err, failMark)
+	}
+	t.Logf("got expected alarm. %v", passMark)
+
+	t.Log("=========== Test that alarm payload without entity is invalid ===========")
+	_, err = load(t, "testdata/alarmErr.json").Alarm()
+	if err == nil {
+		t.Fatalf("expected an error. %v", failMark)
+	}
+	t.Logf("got an error, as expected: %v. %v", err, passMark)
+
+	t.Log("=========== Test that power payload reports the resulting state ===========")
+	p, err := load(t, "testdata/power.json").Power()
+	if err != nil || p.State() != types.VirtualMachinePowerStatePoweredOff {
+		t.Fatalf("expected poweredOff, got: %+v (%v). %v", p, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", p.State(), passMark)
+
+	t.Log("=========== Test that migration payload carries the source host ===========")
+	m, err := load(t, "testdata/migration.json").Migration()
+	if err != nil || m.SourceHost.Host.Value != "host-11" {
+		t.Fatalf("expected source host-11, got: %+v (%v). %v", m, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", m.SourceHost.Host.Value, passMark)
+
+	t.Log("=========== Test that reconfigure payload with devices is decoded ===========")
+	r, err := load(t, "testdata/reconfigure.json").Reconfigure()
+	if err != nil || r.ConfigSpec.NumCPUs != 4 || r.ConfigSpec.MemoryMB != 8192 {
+		t.Fatalf("expected 4 CPUs and 8192 MB, got: %+v (%v). %v", r, err, failMark)
+	}
+	t.Logf("got expected config spec. %v", passMark)
+
+	t.Log("=========== Test that snapshot task reports its operation ===========")
+	s, err := load(t, "testdata/snapshot.json").Snapshot()
+	if err != nil || s.Operation() != "createSnapshot" {
+		t.Fatalf("expected createSnapshot, got: %+v (%v). %v", s, err, failMark)
+	}
+	t.Logf("got expected: %v. %v", s.Operation(), passMark)
+
+	t.Log("=========== Test that requesting another kind fails ===========")
+	_, err = load(t, "testdata/alarm.json").Power()
+	if !errors.Is(err, ErrKind) {
+		t.Fatalf("expected: %v, got: %v. %v", ErrKind, err, failMark)
+	}
+	t.Logf("got an error, as expected: %v. %v", err, passMark)
+}
+
+// TestParse ensures events without data are rejected.
+func TestParse(t *testing.T) {
+	body, err := os.ReadFile("testdata/nodata.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	_, err = Parse(body)
+	if err != nil {
+		t.Logf("got an error, as expected: %v. %v", err, passMark)
+	} else {
+		t.Log("expected an error for event without data", failMark)
+		t.Fail()
+	}
+
+	t.Log("=========== Test that an event without data is decoded unvalidated ===========")
+	ce, err := Unmarshal(body)
+	if err == nil && ce.Validate() != nil {
+		t.Logf("got expected: %v, invalid. %v", ce.Subject, passMark)
+	} else {
+		t.Logf("expected an invalid event, got: %v. %v", err, failMark)
+		t.Fail()
+	}
+}
+
+// TestFollowUp ensures follow-up events are linked to the event which caused
+// them and continue its chain.
+func TestFollowUp(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		chained   bool
+		wantTrace string
+		wantRoot  string
+		wantState string
+	}{
+		{
+			"Test that follow-up of a vCenter event starts a chain",
+			"testdata/alarm.json",
+			false,
+			"",
+			"0a46b9a6-8b4a-4c4f-8f4e-4ad2b0c8a2c5",
+			"",
+		},
+		{
+			"Test that follow-up of a chained event continues its trace and chain",
+			"testdata/chained.json",
+			true,
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+			"0a46b9a6-8b4a-4c4f-8f4e-4ad2b0c8a2c5",
+			"veba=1",
+		},
+	}
+
+	now := time.Date(2020, 3, 13, 21, 12, 0, 0, time.UTC)
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		ce := load(t, tc.jsonPath)
+
+		if ce.Chained() != tc.chained {
+			t.Logf("expected chained: %v, got: %v. %v", tc.chained, ce.Chained(), failMark)
+			t.Fail()
+		}
+
+		fu, err := ce.FollowUp("veba/function/gotag-fn", "com.vmware.veba.function.remediation.v0", ce.Subject, map[string]string{"vm": "vm-42"}, now)
+		if err != nil {
+			t.Log(tc.testDesc, failMark, err)
+			t.Fail()
+			continue
+		}
+
+		// Without trace, the trace id is derived from the root.
+		trace := fu.TraceID()
+		if tc.wantTrace != "" && trace != tc.wantTrace || trace == "" {
+			t.Logf("expected trace: %q, got: %q. %v", tc.wantTrace, fu.TraceParent, failMark)
+			t.Fail()
+		}
+
+		again, _ := ce.FollowUp("veba/function/gotag-fn", "com.vmware.veba.function.remediation.v0", ce.Subject, nil, now)
+		if again.TraceID() != trace || again.TraceParent == fu.TraceParent || again.ID == fu.ID {
+			t.Logf("expected same trace with new parent and id, got: %v, %v. %v", fu.TraceParent, again.TraceParent, failMark)
+			t.Fail()
+		}
+
+		got := [3]string{fu.CausationID, fu.CorrelationID, fu.TraceState}
+		want := [3]string{ce.ID, tc.wantRoot, tc.wantState}
+		if got == want && fu.Chained() {
+			t.Logf("got expected: %v, %v. %v", fu.TraceParent, got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+			t.Fail()
+		}
+	}
+}
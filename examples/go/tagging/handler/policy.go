@@ -0,0 +1,241 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/store"
+)
+
+// policy is the effective behavior of the function derived from vcconfig.toml
+// and the built-in defaults. It never holds credentials or sink URLs, which
+// often embed tokens; configured sinks are only listed by kind.
+type policy struct {
+	// Version identifies the config, see versionOf.
+	Version string `json:"version"`
+	// Mode is remediate or observe.
+	Mode string `json:"mode"`
+
+	Tag struct {
+		URN    string `json:"urn"`
+		Action string `json:"action"`
+	} `json:"tag"`
+
+	Filters struct {
+		MaxEventAgeSeconds int      `json:"max_event_age_seconds"`
+		IncludeSystemVMs   bool     `json:"include_system_vms"`
+		NamePatterns       []string `json:"exclude_name_patterns"`
+		ResourcePools      []string `json:"exclude_resource_pools"`
+		ManagedBy          []string `json:"exclude_managed_by"`
+		OptInTag           string   `json:"opt_in_tag"`
+	} `json:"filters"`
+
+	Alarm struct {
+		Acknowledge bool `json:"acknowledge"`
+	} `json:"alarm"`
+
+	GC struct {
+		IntervalSeconds int      `json:"interval_seconds"`
+		Categories      []string `json:"categories"`
+		DryRun          bool     `json:"dry_run"`
+	} `json:"gc"`
+
+	// TagRetry is the reconciliation of tags deferred while the vAPI
+	// endpoint was unavailable.
+	TagRetry struct {
+		IntervalSeconds int    `json:"interval_seconds"`
+		Store           string `json:"store"`
+	} `json:"tag_retry"`
+
+	// ManagedByTag is the category:name of the tag attached to changed
+	// objects, empty if disabled.
+	ManagedByTag string `json:"managed_by_tag,omitempty"`
+
+	// Mapping lists the paths mapped fields are read from.
+	Mapping fieldMapping `json:"mapping"`
+
+	// Resolve lists the strategies tried to find the VM of an event.
+	Resolve []string `json:"resolve_order"`
+
+	// Rules lists the action chains, including the default rule.
+	Rules []rule `json:"rules"`
+
+	// Auth lists the checks of requests, token and hmac.
+	Auth []string `json:"auth"`
+
+	Targets struct {
+		VCenter        string   `json:"vcenter"`
+		API            string   `json:"api"`
+		SDKPath        string   `json:"sdk_path,omitempty"`
+		APIVersion     string   `json:"api_version,omitempty"`
+		RESTDisabled   bool     `json:"rest_disabled"`
+		ReadUser       string   `json:"read_user"`
+		WriteUser      string   `json:"write_user"`
+		SessionBroker  bool     `json:"session_broker"`
+		Notifications  []string `json:"notifications"`
+		FollowUps      bool     `json:"follow_ups"`
+		EventViewer    bool     `json:"event_viewer"`
+		IncidentSinks  []string `json:"incident_sinks"`
+		DeadLetter     []string `json:"dead_letter_sinks"`
+		KafkaTopics    []string `json:"kafka_topics"`
+		OutboundProxy  bool     `json:"outbound_proxy"`
+		OutboundCAFile bool     `json:"outbound_ca_bundle"`
+	} `json:"targets"`
+
+	Limits struct {
+		BackoffMaxSeconds  float64 `json:"backoff_max_seconds"`
+		VerifyAfterSeconds float64 `json:"verify_after_seconds"`
+		MaxBodyBytes       int     `json:"max_body_bytes"`
+		QPS                float64 `json:"qps"`
+		Burst              int     `json:"burst"`
+		MaxDetails         int     `json:"max_details"`
+		KeptVersions       int     `json:"kept_versions"`
+		Workers            int     `json:"workers"`
+		QueueSize          int     `json:"queue_size"`
+		RetryAfterSeconds  float64 `json:"retry_after_seconds"`
+		// Timeouts of operations in seconds, 0 if only limited by the
+		// invocation.
+		Timeouts map[string]float64 `json:"timeouts"`
+	} `json:"limits"`
+}
+
+// policyOf returns the policy of cfg. Built-in exclusions are included, so
+// the lists show everything the function skips.
+func policyOf(cfg *vcConfig) policy {
+	var p policy
+
+	p.Mode = modeRemediate
+	if cfg.observing() {
+		p.Mode = modeObserve
+	}
+
+	p.Tag.URN = cfg.Tag.URN
+	p.Tag.Action = cfg.Tag.Action
+
+	p.Filters.MaxEventAgeSeconds = cfg.Event.MaxAgeSeconds
+	p.Filters.IncludeSystemVMs = cfg.Exclude.IncludeSystemVMs
+	p.Filters.NamePatterns = cfg.Exclude.NamePatterns
+	p.Filters.ResourcePools = cfg.Exclude.ResourcePools
+	p.Filters.ManagedBy = cfg.Exclude.ManagedBy
+	p.Filters.OptInTag = cfg.OptIn.Tag
+	if !cfg.Exclude.IncludeSystemVMs {
+		p.Filters.NamePatterns = append(append([]string{}, systemNamePatterns...), cfg.Exclude.NamePatterns...)
+		p.Filters.ResourcePools = append(append([]string{}, systemResourcePools...), cfg.Exclude.ResourcePools...)
+		p.Filters.ManagedBy = append(append([]string{}, systemManagedBy...), cfg.Exclude.ManagedBy...)
+	}
+
+	p.Alarm.Acknowledge = cfg.Alarm.Acknowledge
+	p.GC.IntervalSeconds = cfg.GC.IntervalSeconds
+	p.GC.Categories = cfg.GC.Categories
+	p.GC.DryRun = cfg.GC.DryRun
+	p.TagRetry.IntervalSeconds = cfg.TagRetry.IntervalSeconds
+	p.TagRetry.Store = cfg.TagRetry.Store.Type
+	if p.TagRetry.Store == "" {
+		p.TagRetry.Store = store.TypeMemory
+	}
+	if cfg.ManagedByTag.Enabled {
+		p.ManagedByTag = cfg.managedByCategory() + ":" + cfg.managedByName()
+	}
+	p.Mapping = cfg.Mapping
+	p.Resolve = cfg.resolveOrder()
+	p.Rules = cfg.rules()
+
+	p.Auth = cfg.authMethods()
+
+	p.Targets.VCenter = cfg.VCenter.Server
+	p.Targets.API = apiSOAP
+	if cfg.restOnly() {
+		p.Targets.API = apiREST
+	}
+	p.Targets.RESTDisabled = cfg.VCenter.DisableREST
+	if !cfg.restOnly() {
+		p.Targets.SDKPath = cfg.sdkPath()
+		p.Targets.APIVersion = cfg.VCenter.APIVersion
+	}
+	p.Targets.ReadUser = cfg.VCenter.User
+	p.Targets.WriteUser = cfg.VCenter.User
+	if w := cfg.writeIdentity(); w != nil {
+		p.Targets.WriteUser = w.VCenter.User
+	}
+	p.Targets.Notifications = []string{}
+	if cfg.Notify.WebhookURL != "" {
+		p.Targets.Notifications = append(p.Targets.Notifications, "webhook")
+	}
+	if cfg.Notify.SlackWebhookURL != "" {
+		p.Targets.Notifications = append(p.Targets.Notifications, "slack")
+	}
+	p.Targets.FollowUps = cfg.Emit.URL != ""
+	p.Targets.EventViewer = cfg.Viewer.URL != ""
+	p.Targets.IncidentSinks = []string{}
+	if cfg.Incident.PagerDutyRoutingKey != "" {
+		p.Targets.IncidentSinks = append(p.Targets.IncidentSinks, "pagerduty")
+	}
+	if cfg.Incident.OpsgenieAPIKey != "" {
+		p.Targets.IncidentSinks = append(p.Targets.IncidentSinks, "opsgenie")
+	}
+	p.Targets.DeadLetter = []string{}
+	if cfg.DeadLetter.File != "" {
+		p.Targets.DeadLetter = append(p.Targets.DeadLetter, "file")
+	}
+	if cfg.DeadLetter.WebhookURL != "" {
+		p.Targets.DeadLetter = append(p.Targets.DeadLetter, "webhook")
+	}
+	if cfg.DeadLetter.S3.Bucket != "" {
+		p.Targets.DeadLetter = append(p.Targets.DeadLetter, "s3")
+	}
+	if cfg.DeadLetter.AMQP.URL != "" {
+		p.Targets.DeadLetter = append(p.Targets.DeadLetter, "amqp")
+	}
+	p.Targets.KafkaTopics = []string{}
+	for _, t := range []string{cfg.Publish.ResultsTopic, cfg.Publish.AuditTopic} {
+		if t != "" {
+			p.Targets.KafkaTopics = append(p.Targets.KafkaTopics, t)
+		}
+	}
+	p.Targets.OutboundProxy = cfg.Outbound.Proxy != ""
+	p.Targets.SessionBroker = cfg.Connection.BrokerURL != ""
+	p.Targets.OutboundCAFile = cfg.Outbound.CABundle != ""
+
+	p.Limits.BackoffMaxSeconds = cfg.backoffMax().Seconds()
+	p.Limits.VerifyAfterSeconds = cfg.verifyAfter().Seconds()
+	p.Limits.MaxBodyBytes = maxBodySize
+	p.Limits.QPS = cfg.Connection.QPS
+	p.Limits.Burst = cfg.Connection.Burst
+	p.Limits.MaxDetails = cfg.maxDetails()
+	p.Limits.KeptVersions = cfg.keptVersions()
+	p.Limits.Workers = cfg.Scheduler.Workers
+	p.Limits.QueueSize = cfg.queueSize()
+	p.Limits.RetryAfterSeconds = cfg.retryAfter().Seconds()
+	p.Limits.Timeouts = map[string]float64{}
+	for _, op := range []string{opRetrieve, opTag, opReconfigure, opNotify} {
+		p.Limits.Timeouts[op] = cfg.timeout(op).Seconds()
+	}
+
+	p.Version = versionOf(p, cfg)
+
+	return p
+}
+
+// policyResponse returns the policy of cfg as JSON. The version is also set as
+// ETag, so clients can detect changes cheaply.
+func policyResponse(cfg *vcConfig) (handler.Response, error) {
+	p := policyOf(cfg)
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		wrapErr := fmt.Errorf("encoding policy failed: %w", err)
+		return apierror.Response(apierror.Internal, wrapErr.Error()), wrapErr
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			"Etag":         {`"` + p.Version + `"`},
+		},
+	}, nil
+}
@@ -0,0 +1,202 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/kafka"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// resultRecord is published to the [publish] results_topic for every event,
+// whether it was remediated, skipped or failed. Failed events carry the code
+// of their error response.
+type resultRecord struct {
+	Function  string    `json:"function"`
+	Policy    string    `json:"policy,omitempty"`
+	EventID   string    `json:"event_id,omitempty"`
+	EventType string    `json:"event_type,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	Code      string    `json:"code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// auditRecord is published to the [publish] audit_topic for every action a
+// rule ran on a VM, so changes made by the function can be attributed to the
+// event, rule and identity which caused them.
+type auditRecord struct {
+	Function string `json:"function"`
+	Policy   string `json:"policy,omitempty"`
+	EventID  string `json:"event_id,omitempty"`
+	Rule     string `json:"rule"`
+	Action   string `json:"action"`
+	VM       string `json:"vm"`
+	// Identity is the vCenter user the action ran as.
+	Identity string `json:"identity"`
+	// APIVersion is the negotiated SOAP API version of the client.
+	APIVersion string    `json:"api_version,omitempty"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+var publisher struct {
+	sync.Mutex
+	cfg      kafka.Config
+	producer *kafka.Producer
+}
+
+// producer returns the Kafka producer of the [publish] section, nil if none
+// is configured. It is kept while its configuration is unchanged.
+func producer(cfg *vcConfig) (*kafka.Producer, error) {
+	c := cfg.Publish.Kafka
+	if len(c.Brokers) == 0 {
+		return nil, nil
+	}
+
+	publisher.Lock()
+	defer publisher.Unlock()
+
+	if publisher.producer != nil && reflect.DeepEqual(publisher.cfg, c) {
+		return publisher.producer, nil
+	}
+
+	p, err := kafka.New(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if publisher.producer != nil {
+		publisher.producer.Close()
+	}
+	publisher.cfg, publisher.producer = c, p
+
+	return p, nil
+}
+
+// publishResults is a middleware publishing a result record of every event,
+// see publishResult.
+func publishResults(next middleware.Func) middleware.Func {
+	return func(req handler.Request) (handler.Response, error) {
+		res, err := next(req)
+
+		// Without config, there is no topic to publish to.
+		if cfg, cfgErr := requestConfig(req); cfgErr == nil && cfg.Publish.ResultsTopic != "" {
+			// Records are published, even if the caller went away.
+			publishResult(context.WithoutCancel(requestContext(&req)), cfg, req, res, err)
+		}
+
+		return res, err
+	}
+}
+
+// publishResult publishes the outcome of the event of req to the results
+// topic, keyed by CloudEvent id. Errors are logged only, they must not mask
+// the outcome of the event.
+func publishResult(ctx context.Context, cfg *vcConfig, req handler.Request, res handler.Response, cause error) {
+	rec := resultRecord{
+		Function: cfg.functionName(),
+		Policy:   res.Header.Get("X-Policy-Version"),
+		Status:   res.StatusCode,
+		Outcome:  string(res.Body),
+		Time:     time.Now().UTC(),
+	}
+	if e, ok := apierror.Parse(res.Body); ok {
+		rec.Outcome, rec.Code = e.Message, string(e.Code)
+	}
+	if cause != nil {
+		rec.Error = cause.Error()
+	}
+
+	if body, err := decodeBody(req); err == nil {
+		if ce, err := vevents.Parse(body); err == nil {
+			rec.EventID = ce.ID
+			rec.Subject = ce.Subject
+			rec.EventType = eventType(ce)
+		}
+	}
+
+	publish(ctx, cfg, cfg.Publish.ResultsTopic, rec.EventID, rec)
+}
+
+// auditAction publishes an action of rule r on ref to the audit topic, keyed
+// by VM, so the records of a VM keep their order. cause is the error of a
+// failed action of client. Errors are logged only.
+func auditAction(ctx context.Context, cfg *vcConfig, r *rule, a action, client *vsClient, ref types.ManagedObjectReference, ce *vevents.CloudEvent, outcome string, cause error) {
+	if cfg.Publish.AuditTopic == "" {
+		return
+	}
+
+	rec := auditRecord{
+		Function: cfg.functionName(),
+		Policy:   traceFrom(ctx).version,
+		Rule:     r.Name,
+		Action:   a.Type,
+		VM:       ref.Value,
+		Identity: cfg.identityUser(r),
+		Outcome:  outcome,
+		Time:     time.Now().UTC(),
+	}
+	if client != nil {
+		rec.APIVersion = client.apiVersion
+	}
+	if cause != nil {
+		rec.Error = cause.Error()
+	}
+	if ce != nil {
+		rec.EventID = ce.ID
+	}
+
+	publish(context.WithoutCancel(ctx), cfg, cfg.Publish.AuditTopic, ref.Value, rec)
+}
+
+// publish writes rec with key to topic.
+func publish(ctx context.Context, cfg *vcConfig, topic, key string, rec interface{}) {
+	p, err := producer(cfg)
+	if err != nil {
+		publishFailures.Add(1)
+		slog.Error("kafka producer not available", "err", err)
+		return
+	}
+	if p == nil {
+		return
+	}
+
+	start := time.Now()
+	err = p.Publish(ctx, topic, key, rec)
+	traceFrom(ctx).call("publish", start, err)
+	if err != nil {
+		publishFailures.Add(1)
+		slog.Error("publishing record failed", "topic", topic, "key", key, "err", err)
+	}
+}
+
+// validatePublish ensures records have a producer and a topic.
+func validatePublish(cfg vcConfig) error {
+	p := cfg.Publish
+	topics := p.ResultsTopic != "" || p.AuditTopic != ""
+
+	if len(p.Kafka.Brokers) == 0 {
+		if topics {
+			return errors.New("publish topics require publish kafka brokers")
+		}
+		return nil
+	}
+
+	if !topics {
+		return errors.New("publish kafka requires results_topic or audit_topic")
+	}
+
+	return p.Kafka.Validate()
+}
@@ -0,0 +1,255 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Strategies of the [resolve] order to find the VM an event refers to.
+const (
+	resolveVM     = "vm"     // Data.Vm of VM events
+	resolveEntity = "entity" // Data.Entity or Data.ObjectId, if it is a VM
+	resolveName   = "name"   // VM named like Data.ObjectName or Data.Entity.Name
+	resolveDNS    = "dns"    // VM with the guest host name or IP of the name
+)
+
+// defaultResolveOrder only uses the references in the event, which cost no
+// vCenter calls.
+var defaultResolveOrder = []string{resolveVM, resolveEntity}
+
+// errNotResolved is returned if no strategy found the VM of an event.
+var errNotResolved = errors.New("empty managed reference object")
+
+// resolveError is a failed vCenter call of a strategy. Unlike errNotResolved,
+// it does not mean the event is malformed.
+type resolveError struct {
+	strategy string
+	err      error
+}
+
+func (e *resolveError) Error() string {
+	return fmt.Sprintf("resolve strategy %v failed: %v", e.strategy, e.err)
+}
+
+func (e *resolveError) Unwrap() error {
+	return e.err
+}
+
+// resolveEvent holds the fields of an event which may identify its VM.
+type resolveEvent struct {
+	Vm         *types.VmEventArgument
+	Entity     *types.ManagedEntityEventArgument
+	ObjectType string
+	ObjectId   string
+	ObjectName string
+}
+
+// resolver returns the VM of ev or errNotResolved if the strategy does not
+// apply to ev.
+type resolver func(ctx context.Context, client *vsClient, ev *resolveEvent) (*types.ManagedObjectReference, error)
+
+var resolvers = map[string]resolver{
+	resolveVM:     byVM,
+	resolveEntity: byEntity,
+	resolveName:   byName,
+	resolveDNS:    byDNS,
+}
+
+// resolveOrder returns the configured strategies or the default order.
+func (cfg *vcConfig) resolveOrder() []string {
+	if len(cfg.Resolve.Order) == 0 {
+		return defaultResolveOrder
+	}
+
+	return cfg.Resolve.Order
+}
+
+// validateResolveOrder ensures only known strategies are configured.
+func validateResolveOrder(order []string) error {
+	for _, s := range order {
+		if _, ok := resolvers[s]; !ok {
+			return fmt.Errorf("unsupported resolve strategy %q", s)
+		}
+	}
+
+	return nil
+}
+
+// resolveVMRef returns the VM the event ce refers to, trying the strategies
+// in the configured order. It returns errNotResolved if no strategy found the
+// VM and a *resolveError for the first failed vSphere call.
+func resolveVMRef(ctx context.Context, cfg *vcConfig, client *vsClient, ce *vevents.CloudEvent) (*types.ManagedObjectReference, error) {
+	var data resolveEvent
+	if ce != nil && len(ce.Data) > 0 {
+		if err := json.Unmarshal(ce.Data, &data); err != nil {
+			return nil, fmt.Errorf("parsing of request failed: %w", err)
+		}
+	}
+
+	tr := traceFrom(ctx)
+	for _, s := range cfg.resolveOrder() {
+		ref, err := resolvers[s](ctx, client, &data)
+		if errors.Is(err, errNotResolved) {
+			continue
+		}
+		if err != nil {
+			return nil, &resolveError{strategy: s, err: err}
+		}
+
+		tr.step("VM %v resolved by %v", ref.Value, s)
+		return ref, nil
+	}
+
+	return nil, errNotResolved
+}
+
+func byVM(_ context.Context, _ *vsClient, ev *resolveEvent) (*types.ManagedObjectReference, error) {
+	if ev.Vm == nil || ev.Vm.Vm.Value == "" {
+		return nil, errNotResolved
+	}
+
+	return &ev.Vm.Vm, nil
+}
+
+func byEntity(_ context.Context, _ *vsClient, ev *resolveEvent) (*types.ManagedObjectReference, error) {
+	if e := ev.Entity; e != nil && e.Entity.Type == "VirtualMachine" && e.Entity.Value != "" {
+		return &e.Entity, nil
+	}
+
+	if ev.ObjectType == "VirtualMachine" && ev.ObjectId != "" {
+		return &types.ManagedObjectReference{Type: "VirtualMachine", Value: ev.ObjectId}, nil
+	}
+
+	return nil, errNotResolved
+}
+
+// byName searches the inventory for the VM with the object or entity name.
+// Names are only unique within a folder, so ambiguous names are not resolved.
+func byName(ctx context.Context, client *vsClient, ev *resolveEvent) (*types.ManagedObjectReference, error) {
+	name := ev.name()
+	if name == "" {
+		return nil, errNotResolved
+	}
+
+	c := client.govmomi.Client
+	m := view.NewManager(c)
+
+	start := time.Now()
+	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
+	if err != nil {
+		traceFrom(ctx).call("CreateContainerView", start, err)
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+
+	refs, err := v.Find(ctx, []string{"VirtualMachine"}, property.Filter{"name": name})
+	traceFrom(ctx).call("FindByName", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return single(refs)
+}
+
+// byDNS searches the VM whose guest reports the name as host name or IP. If
+// the guest does not report the name, the name is resolved in DNS and searched
+// by its addresses.
+func byDNS(ctx context.Context, client *vsClient, ev *resolveEvent) (*types.ManagedObjectReference, error) {
+	name := ev.name()
+	if name == "" {
+		return nil, errNotResolved
+	}
+
+	si := object.NewSearchIndex(client.govmomi.Client)
+	tr := traceFrom(ctx)
+
+	if net.ParseIP(name) != nil {
+		start := time.Now()
+		found, err := si.FindAllByIp(ctx, nil, name, true)
+		tr.call("FindAllByIp", start, err)
+		if err != nil {
+			return nil, err
+		}
+		return single(references(found))
+	}
+
+	start := time.Now()
+	found, err := si.FindAllByDnsName(ctx, nil, name, true)
+	tr.call("FindAllByDnsName", start, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) > 0 {
+		return single(references(found))
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		// Names which are not in DNS do not resolve, that is no failure.
+		return nil, errNotResolved
+	}
+
+	for _, a := range addrs {
+		start := time.Now()
+		found, err := si.FindAllByIp(ctx, nil, a, true)
+		tr.call("FindAllByIp", start, err)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 {
+			return single(references(found))
+		}
+	}
+
+	return nil, errNotResolved
+}
+
+// name returns the object name of ev or, without, the name of its entity.
+// Names of entities other than VMs, e.g. of the host of an alarm, are not
+// used, as a VM of the same name is a different object.
+func (ev *resolveEvent) name() string {
+	if n := strings.TrimSpace(ev.ObjectName); n != "" {
+		return n
+	}
+
+	if e := ev.Entity; e != nil && (e.Entity.Type == "" || e.Entity.Type == "VirtualMachine") {
+		return strings.TrimSpace(e.Name)
+	}
+
+	return ""
+}
+
+// single returns the only VM of refs or errNotResolved.
+func single(refs []types.ManagedObjectReference) (*types.ManagedObjectReference, error) {
+	if len(refs) != 1 {
+		return nil, errNotResolved
+	}
+
+	return &refs[0], nil
+}
+
+func references(found []object.Reference) []types.ManagedObjectReference {
+	seen := map[types.ManagedObjectReference]bool{}
+	var refs []types.ManagedObjectReference
+
+	for _, f := range found {
+		ref := f.Reference()
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
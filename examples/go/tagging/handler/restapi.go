@@ -0,0 +1,161 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// APIs of the [vcenter] api setting.
+const (
+	apiSOAP = "soap" // SOAP SDK for inventory and alarms, vAPI for tags (default)
+	apiREST = "rest" // vAPI REST endpoints only, for when the SDK port is blocked
+)
+
+// vcenterVMPath is the vAPI resource of VMs.
+const vcenterVMPath = "/vcenter/vm"
+
+// errSOAPRequired is returned by operations without vAPI equivalent when only
+// the REST endpoints are used.
+var errSOAPRequired = errors.New(`requires the SOAP API, which is not used with [vcenter] api = "rest"`)
+
+// errRESTDisabled is returned by tag operations when the REST API is disabled.
+var errRESTDisabled = errors.New("requires the REST API, which is disabled with [vcenter] disable_rest")
+
+// restVM is the VM information returned by the vAPI.
+type restVM struct {
+	Name       string `json:"name"`
+	PowerState string `json:"power_state"`
+	CPU        struct {
+		Count int32 `json:"count"`
+	} `json:"cpu"`
+	Memory struct {
+		SizeMiB int64 `json:"size_MiB"`
+	} `json:"memory"`
+}
+
+// restOnly reports whether only the vAPI REST endpoints may be used.
+func (cfg *vcConfig) restOnly() bool {
+	return cfg.VCenter.API == apiREST
+}
+
+// newRESTClient logs in to the vAPI REST endpoints only. The SOAP client just
+// provides the transport, it is never logged in. The REST API cannot be
+// disabled with it, which is rejected with the config.
+func newRESTClient(ctx context.Context, u url.URL, insecure, _ bool, _ string) (*vsClient, error) {
+	sc := soap.NewClient(&u, insecure)
+
+	rc := rest.NewClient(&vim25.Client{Client: sc})
+	err := rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{rest: rc, restUser: u.User, restSession: true, restUsed: time.Now()}, nil
+}
+
+// vmInfo returns the vAPI information of a VM.
+func (clt *vsClient) vmInfo(ctx context.Context, ref types.ManagedObjectReference) (*restVM, error) {
+	// Unlike the tagging resources, VM ids are not prefixed with "id:".
+	req := clt.rest.Resource(vcenterVMPath + "/" + ref.Value).Request(http.MethodGet)
+
+	var vm restVM
+	start := time.Now()
+	err := clt.rest.Do(ctx, req, &vm)
+	traceFrom(ctx).call("GET "+vcenterVMPath, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("get VM %v failed: %w", ref.Value, err)
+	}
+
+	return &vm, nil
+}
+
+// restSystemVMs is systemVMs for clients without SOAP API. The vAPI neither
+// returns the extension managing a VM nor its resource pool, so system VMs
+// are only detected by name.
+func (clt *vsClient) restSystemVMs(ctx context.Context, cfg *vcConfig, refs []types.ManagedObjectReference) (map[string]string, error) {
+	reasons := map[string]string{}
+
+	for _, ref := range refs {
+		info, err := clt.vmInfo(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		vm := mo.VirtualMachine{ManagedEntity: mo.ManagedEntity{Name: info.Name}}
+		if reason := systemVMReason(cfg, vm, ""); reason != "" {
+			reasons[ref.Value] = reason
+		}
+	}
+
+	return reasons, nil
+}
+
+// validateAPI ensures only features with vAPI equivalent are configured if
+// only the REST endpoints may be used.
+func validateAPI(cfg vcConfig) error {
+	switch cfg.VCenter.API {
+	case "", apiSOAP:
+		return nil
+	case apiREST:
+	default:
+		return fmt.Errorf("unsupported vcenter api %q", cfg.VCenter.API)
+	}
+
+	if cfg.Alarm.Acknowledge || cfg.Alarm.ExpandEntities {
+		return errors.New(`alarm acknowledge and expand_entities require vcenter api "soap"`)
+	}
+
+	for _, s := range cfg.resolveOrder() {
+		if s == resolveName || s == resolveDNS {
+			return fmt.Errorf(`resolve strategy %q requires vcenter api "soap"`, s)
+		}
+	}
+
+	for _, r := range cfg.Rules {
+		for _, a := range r.Actions {
+			if a.Type == actionAcknowledge || a.Type == actionReconfigure || a.Type == actionAdvise {
+				return fmt.Errorf(`action %v of rule %v requires vcenter api "soap"`, a.Type, r.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateDisableREST ensures nothing requires the REST API if it is disabled.
+func validateDisableREST(cfg vcConfig) error {
+	if !cfg.VCenter.DisableREST {
+		return nil
+	}
+
+	switch {
+	case cfg.restOnly():
+		return errors.New(`vcenter disable_rest requires vcenter api "soap"`)
+	case cfg.Alarm.ExpandEntities:
+		return errors.New("alarm expand_entities tags VMs, which requires the rest api")
+	case cfg.OptIn.Tag != "":
+		return errors.New("optin tag requires the rest api")
+	case cfg.GC.IntervalSeconds > 0:
+		return errors.New("gc of tags requires the rest api")
+	}
+
+	for _, r := range cfg.rules() {
+		for _, a := range r.Actions {
+			if a.Type == actionTag || a.Type == actionAdvise {
+				return fmt.Errorf("action %v of rule %v requires the rest api", a.Type, r.Name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/scheduler"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Actions of a rule chain.
+const (
+	actionTag         = "tag"         // attach the tag_urn, the [tag] urn or the categorized tags
+	actionNotify      = "notify"      // post the outcome so far to the [notify] sinks
+	actionReconfigure = "reconfigure" // set the extra_config of the VM
+	actionAcknowledge = "acknowledge" // acknowledge the alarm of alarm events
+	actionEmit        = "emit"        // post a follow-up CloudEvent to the [emit] url
+	actionAdvise      = "advise"      // attach or detach advisory tags by VM properties
+)
+
+// defaultRuleName names the rule derived from the [tag] and [alarm] sections
+// if no rules are configured.
+const defaultRuleName = "default"
+
+// rule is a [[rules]] section. The first rule matching an event runs its
+// actions in order.
+type rule struct {
+	Name string `json:"name"`
+	// Events lists the event types, e.g. VmPoweredOnEvent, the rule applies
+	// to. Without events, the rule applies to every event.
+	Events []string `json:"events,omitempty"`
+	// Priority is high or normal, the default. With [scheduler] workers,
+	// events of high priority rules are processed first while all workers
+	// are busy.
+	Priority string `json:"priority,omitempty"`
+	// Identity names the identity of [vcenter.identities] the actions run
+	// as. Without, they run as the write identity, if configured.
+	Identity string   `json:"identity,omitempty"`
+	Actions  []action `json:"actions"`
+}
+
+// action is a step of a rule chain.
+type action struct {
+	Type string `json:"type"`
+	// ContinueOnError runs the next actions if this one fails. The failure
+	// is reported in the response, but does not fail the invocation.
+	ContinueOnError bool `toml:"continue_on_error" json:"continue_on_error"`
+	// TagURN of tag actions, defaults to the [tag] urn.
+	TagURN string `toml:"tag_urn" json:"tag_urn,omitempty"`
+	// Tags of tag actions replace the tag_urn with tags of several
+	// categories, whose names are derived from the event.
+	Tags []categorizedTag `json:"tags,omitempty"`
+	// ExtraConfig of reconfigure actions, set as advanced settings of the VM.
+	ExtraConfig map[string]string `toml:"extra_config" json:"extra_config,omitempty"`
+	// EventType of emit actions, defaults to defaultFollowUpType.
+	EventType string `toml:"event_type" json:"event_type,omitempty"`
+	// Advisories of advise actions, each tags the VM by a property.
+	Advisories []advisory `json:"advisories,omitempty"`
+}
+
+// rules returns the configured rules or, without, the default rule which tags
+// and acknowledges alarms if configured.
+func (cfg *vcConfig) rules() []rule {
+	if len(cfg.Rules) > 0 {
+		return cfg.Rules
+	}
+
+	r := rule{Name: defaultRuleName, Actions: []action{{Type: actionTag}}}
+	if cfg.Alarm.Acknowledge {
+		r.Actions = append(r.Actions, action{Type: actionAcknowledge, ContinueOnError: true})
+	}
+
+	return []rule{r}
+}
+
+// ruleFor returns the first rule matching the event type or nil.
+func (cfg *vcConfig) ruleFor(event string) *rule {
+	for _, r := range cfg.rules() {
+		if len(r.Events) == 0 {
+			return &r
+		}
+
+		for _, e := range r.Events {
+			if e == event {
+				return &r
+			}
+		}
+	}
+
+	return nil
+}
+
+// eventType returns the type of the event ce, which is empty if the event is
+// no CloudEvent.
+func eventType(ce *vevents.CloudEvent) string {
+	if ce == nil {
+		return ""
+	}
+
+	return ce.Subject
+}
+
+// actionTypes returns the types of the actions of r in order.
+func (r *rule) actionTypes() []string {
+	names := make([]string, 0, len(r.Actions))
+	for _, a := range r.Actions {
+		names = append(names, a.Type)
+	}
+
+	return names
+}
+
+// validateRules ensures the rules only use known actions with their settings.
+func validateRules(cfg vcConfig) error {
+	for i, r := range cfg.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("rule %v has no actions", name)
+		}
+
+		if _, err := scheduler.ParsePriority(r.Priority); err != nil {
+			return fmt.Errorf("rule %v: %w", name, err)
+		}
+
+		if _, ok := cfg.VCenter.Identities[r.Identity]; r.Identity != "" && !ok {
+			return fmt.Errorf("rule %v uses unknown identity %q", name, r.Identity)
+		}
+
+		for _, a := range r.Actions {
+			switch a.Type {
+			case actionAcknowledge:
+			case actionTag:
+				if err := validateTags(name, a); err != nil {
+					return err
+				}
+			case actionNotify:
+				if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+					return fmt.Errorf("rule %v notifies, but no notify sink is configured", name)
+				}
+			case actionReconfigure:
+				if len(a.ExtraConfig) == 0 {
+					return fmt.Errorf("rule %v reconfigures without extra_config", name)
+				}
+			case actionEmit:
+				if cfg.Emit.URL == "" {
+					return fmt.Errorf("rule %v emits, but no emit url is configured", name)
+				}
+			case actionAdvise:
+				if err := validateAdvisories(name, a.Advisories); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("rule %v has unsupported action %q", name, a.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// runChain runs the actions of r in order on the VM ref. A failed action stops
+// the chain, unless it continues on error. The returned message describes the
+// completed and tolerated failed actions, the error is that of the action which
+// stopped the chain.
+func runChain(ctx context.Context, cfg *vcConfig, r *rule, client *vsClient, ref types.ManagedObjectReference, body []byte, ce *vevents.CloudEvent) (string, error) {
+	tr := traceFrom(ctx)
+
+	// Objects changed by the chain carry the managed-by tag, even if a
+	// later action fails.
+	mutated := false
+	defer func() {
+		if mutated {
+			markManaged(ctx, cfg, client, ref)
+		}
+	}()
+
+	var done []string
+	for _, a := range r.Actions {
+		text, err := runAction(ctx, cfg, r, a, client, ref, body, ce, done)
+		auditAction(ctx, cfg, r, a, client, ref, ce, text, err)
+		if err != nil {
+			err = fmt.Errorf("action %v of rule %v failed: %w", a.Type, r.Name, err)
+			if !a.ContinueOnError {
+				return strings.Join(done, ", "), err
+			}
+
+			slog.Error("action failed, continuing", "rule", r.Name, "action", a.Type, "err", err)
+			done = append(done, err.Error())
+			continue
+		}
+
+		tr.step("rule %v: %v", r.Name, a.Type)
+		if mutatingActions[a.Type] {
+			mutated = true
+		}
+		if text != "" {
+			done = append(done, text)
+		}
+	}
+
+	return strings.Join(done, ", "), nil
+}
+
+// runAction runs a single action as the identity of r and returns the
+// description of its outcome. Rules without identity run as client. done
+// describes the actions completed before.
+func runAction(ctx context.Context, cfg *vcConfig, r *rule, a action, client *vsClient, ref types.ManagedObjectReference, body []byte, ce *vevents.CloudEvent, done []string) (string, error) {
+	client, c, err := ruleClient(ctx, cfg, r, client)
+	if err != nil {
+		return "", fmt.Errorf("connect to vSphere as identity %v failed: %w", r.Identity, err)
+	}
+
+	text, err := doAction(ctx, cfg, r, a, client, ref, body, ce, done)
+	if err != nil && c != nil {
+		c.verify(ctx, client)
+	}
+
+	return text, err
+}
+
+// doAction runs a single action with client.
+func doAction(ctx context.Context, cfg *vcConfig, r *rule, a action, client *vsClient, ref types.ManagedObjectReference, body []byte, ce *vevents.CloudEvent, done []string) (string, error) {
+	switch a.Type {
+	case actionTag:
+		if len(a.Tags) > 0 {
+			return categorize(ctx, cfg, a, client, ref, body, ce)
+		}
+
+		urn := a.TagURN
+		if urn == "" {
+			urn = cfg.Tag.URN
+		}
+
+		err := limit(ctx, cfg, opTag, func(ctx context.Context) error {
+			return client.applyTag(ctx, cfg, ref, urn)
+		})
+		if cfg.detaching() {
+			if err != nil {
+				return "", err
+			}
+			return cfg.message(i18n.Untagged, ref.Value, urn), nil
+		}
+		// Only the tag waits for the endpoint, the remediation does not.
+		if err != nil && cfg.TagRetry.IntervalSeconds > 0 && vapiUnavailable(err) && ctx.Err() == nil {
+			return deferTag(ctx, cfg, r, ref, urn, ce, err)
+		}
+		if err != nil {
+			return "", err
+		}
+		return cfg.message(i18n.Tagged, ref.Value, urn), nil
+
+	case actionNotify:
+		text := strings.Join(done, ", ")
+		if text == "" {
+			text = cfg.message(i18n.RuleMatched, r.Name, ref.Value)
+		}
+
+		err := limit(ctx, cfg, opNotify, func(ctx context.Context) error {
+			return notifyOutcome(ctx, cfg, ref, r.Name, text)
+		})
+		if err != nil {
+			return "", err
+		}
+		return cfg.message(i18n.Notified), nil
+
+	case actionReconfigure:
+		err := limit(ctx, cfg, opReconfigure, func(ctx context.Context) error {
+			return client.reconfigure(ctx, ref, a.ExtraConfig)
+		})
+		if err != nil {
+			return "", err
+		}
+		return cfg.message(i18n.Reconfigured, ref.Value), nil
+
+	case actionAcknowledge:
+		return acknowledge(ctx, cfg, client, ce)
+
+	case actionEmit:
+		var fu *vevents.CloudEvent
+		err := limit(ctx, cfg, opNotify, func(ctx context.Context) (err error) {
+			fu, err = emitFollowUp(ctx, cfg, r, a, ref, ce, strings.Join(done, ", "))
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		return cfg.message(i18n.Emitted, fu.Type, fu.ID), nil
+
+	case actionAdvise:
+		return advise(ctx, cfg, a, client, ref)
+	}
+
+	// Rules are validated when loading the config.
+	return "", errors.New("unsupported action")
+}
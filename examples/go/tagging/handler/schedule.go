@@ -0,0 +1,107 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/scheduler"
+)
+
+// defaultQueueSize is the capacity of each priority queue of the scheduler.
+const defaultQueueSize = 100
+
+// defaultRetryAfterSeconds is the least time the event processor is asked to
+// wait before retrying an event which got no worker.
+const defaultRetryAfterSeconds = 10
+
+// sched limits the events acted on at once by this replica. It is resized to
+// the [scheduler] section by every invocation.
+var sched = scheduler.New(0, defaultQueueSize)
+
+// queueSize returns the capacity of each priority queue.
+func (cfg *vcConfig) queueSize() int {
+	if cfg.Scheduler.QueueSize == 0 {
+		return defaultQueueSize
+	}
+
+	return cfg.Scheduler.QueueSize
+}
+
+// retryAfter returns the least time the event processor is asked to wait
+// before retrying an event which got no worker.
+func (cfg *vcConfig) retryAfter() time.Duration {
+	if cfg.Scheduler.RetryAfterSeconds == 0 {
+		return defaultRetryAfterSeconds * time.Second
+	}
+
+	return time.Duration(cfg.Scheduler.RetryAfterSeconds) * time.Second
+}
+
+// retryAfterSeconds returns the Retry-After seconds of a rejected event, at
+// least the seconds of least and less than twice them. The jitter spreads the retries of a
+// storm of rejected events, instead of queueing them all again at once.
+func retryAfterSeconds(least time.Duration) int {
+	secs := int(least.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+
+	return secs + rand.IntN(secs)
+}
+
+// priority returns the priority of events of r, normal without rule.
+func (r *rule) priority() scheduler.Priority {
+	if r == nil {
+		return scheduler.Normal
+	}
+
+	// Priorities are validated with the config.
+	p, _ := scheduler.ParsePriority(r.Priority)
+
+	return p
+}
+
+// schedule waits for a worker to act on an event of rule r and returns the
+// function to release it.
+func schedule(ctx context.Context, cfg *vcConfig, r *rule) (func(), error) {
+	sched.Resize(cfg.Scheduler.Workers, cfg.queueSize())
+
+	p := r.priority()
+	start := time.Now()
+
+	release, err := sched.Acquire(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	traceFrom(ctx).step("waited %v for a worker with %v priority", time.Since(start).Round(time.Millisecond), p)
+
+	return release, nil
+}
+
+// scheduleFailedResponse returns the response to an event which got no
+// worker. Both are retried by the event processor: a full queue is reported
+// like an exceeded rate limit, a request which timed out while waiting as
+// unavailable. Retry-After asks the event processor to back off, rather than
+// to retry into the saturated queue at once.
+func scheduleFailedResponse(tr *trace, cfg *vcConfig, err error) (handler.Response, error) {
+	code := apierror.WorkerTimeout
+	if errors.Is(err, scheduler.ErrQueueFull) {
+		queueFull.Add(1)
+		code = apierror.QueueFull
+	}
+
+	wrapErr := fmt.Errorf("waiting for a worker failed: %w", err)
+	slog.Info("waiting for a worker failed", "err", err)
+
+	res := tr.fail(code, wrapErr.Error())
+	res.Header.Set("Retry-After", strconv.Itoa(retryAfterSeconds(cfg.retryAfter())))
+
+	return res, wrapErr
+}
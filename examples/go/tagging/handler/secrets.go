@@ -0,0 +1,120 @@
+package function
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/redact"
+)
+
+// secretRefPrefix marks a vcconfig.toml string value which references another
+// OpenFaaS secret, e.g. password = "secretRef:vc-password". The secret must be
+// listed in the function's stack.yml to be mounted next to vcconfig.
+const secretRefPrefix = "secretRef:"
+
+// resolveSecretRefs replaces all secretRef values in tree with the content of
+// the referenced secret file in dir. Surrounding whitespace, e.g. a trailing
+// newline from "faas-cli secret create --from-file", is trimmed.
+func resolveSecretRefs(tree *toml.Tree, dir string) error {
+	for _, key := range tree.Keys() {
+		switch v := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			if err := resolveSecretRefs(v, dir); err != nil {
+				return err
+			}
+		case []*toml.Tree:
+			for _, t := range v {
+				if err := resolveSecretRefs(t, dir); err != nil {
+					return err
+				}
+			}
+		case string:
+			if !strings.HasPrefix(v, secretRefPrefix) {
+				continue
+			}
+
+			secret, err := readSecret(dir, strings.TrimPrefix(v, secretRefPrefix))
+			if err != nil {
+				return fmt.Errorf("resolving %v failed: %w", key, err)
+			}
+			tree.SetPath([]string{key}, secret)
+		}
+	}
+
+	return nil
+}
+
+// readSecret returns the content of the secret name in dir.
+func readSecret(dir, name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	// Only allow references to secrets mounted next to vcconfig.
+	if name == "" || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid secret reference %q", name)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %v: %w", name, err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// redactor masks credentials in the logs and responses of the function. The
+// secrets of the config are registered whenever it is loaded.
+var redactor = redact.New()
+
+// secrets returns the credentials of cfg, which are masked wherever they
+// appear. Webhook URLs are included since e.g. Slack URLs carry a token.
+func (cfg *vcConfig) secrets() []string {
+	secrets := []string{
+		cfg.VCenter.Password,
+		cfg.VCenter.Write.Password,
+		cfg.Auth.Token,
+		cfg.Connection.BrokerToken,
+		cfg.Auth.HMACKey,
+		cfg.Notify.SlackWebhookURL,
+		cfg.Incident.PagerDutyRoutingKey,
+		cfg.Incident.OpsgenieAPIKey,
+		cfg.DeadLetter.Store.Password,
+		cfg.DeadLetter.S3.SecretAccessKey,
+		cfg.TagRetry.Store.Password,
+		cfg.Publish.Kafka.SASL.Password,
+	}
+
+	for _, c := range cfg.VCenter.Identities {
+		secrets = append(secrets, c.Password)
+	}
+
+	return secrets
+}
+
+// withoutSecrets returns a copy of cfg with the credentials of secrets
+// cleared.
+func (cfg *vcConfig) withoutSecrets() *vcConfig {
+	c := *cfg
+	c.VCenter.Password = ""
+	c.VCenter.Write.Password = ""
+	c.Auth.Token = ""
+	c.Connection.BrokerToken = ""
+	c.Auth.HMACKey = ""
+	c.Notify.SlackWebhookURL = ""
+	c.Incident.PagerDutyRoutingKey = ""
+	c.Incident.OpsgenieAPIKey = ""
+	c.DeadLetter.Store.Password = ""
+	c.DeadLetter.S3.SecretAccessKey = ""
+	c.TagRetry.Store.Password = ""
+	c.Publish.Kafka.SASL.Password = ""
+
+	c.VCenter.Identities = make(map[string]credentials, len(cfg.VCenter.Identities))
+	for name, id := range cfg.VCenter.Identities {
+		id.Password = ""
+		c.VCenter.Identities[name] = id
+	}
+
+	return &c
+}
@@ -0,0 +1,320 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/notify"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// selfTestEnv enables the self-test mode: the function checks its config and
+// environment on startup and exits, e.g. as initContainer, instead of serving
+// events.
+const selfTestEnv = "self_test"
+
+// selfTestTimeout limits the whole self-test.
+const selfTestTimeout = 2 * time.Minute
+
+// errSelfTest is returned if a check of the self-test failed.
+var errSelfTest = errors.New("self-test failed")
+
+// runSelfTest runs the self-test with the config of the function and returns
+// the exit code of the process.
+func runSelfTest() int {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	if err := selfTest(ctx, configPath()); err != nil {
+		slog.Error("self-test failed", "err", err)
+		return 1
+	}
+	slog.Info("self-test passed")
+
+	return 0
+}
+
+// selfTest validates the config at path, connects to vSphere, verifies the
+// privileges of the actions, lists the target categories and sends a test
+// notification. Checks which do not depend on a failed check still run, so a
+// single run reports all problems. The returned error lists the failed
+// checks.
+func selfTest(ctx context.Context, path string) error {
+	var failed []string
+	check := func(name string, f func() (string, error)) bool {
+		result, err := f()
+		if err != nil {
+			slog.Error("self-test check failed", "check", name, "err", err)
+			failed = append(failed, name)
+			return false
+		}
+		slog.Info("self-test check passed", "check", name, "result", result)
+		return true
+	}
+	done := func() error {
+		if len(failed) > 0 {
+			return fmt.Errorf("%w: %v", errSelfTest, strings.Join(failed, ", "))
+		}
+		return nil
+	}
+
+	var cfg *vcConfig
+	ok := check("config", func() (string, error) {
+		var err error
+		cfg, err = loadTomlCfg(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d rule(s): %v", len(cfg.rules()), ruleNames(cfg.rules())), nil
+	})
+	if !ok {
+		return done()
+	}
+
+	check("notify", func() (string, error) {
+		return sendTestNotification(ctx, cfg)
+	})
+
+	var reader, writer *vsClient
+	ok = check("connect", func() (string, error) {
+		var err error
+		reader, err = dialVSphere(ctx, cfg)
+		if err != nil {
+			return "", err
+		}
+
+		writer = reader
+		if w := cfg.writeIdentity(); w != nil {
+			writer, err = dialVSphere(ctx, w)
+			if err != nil {
+				return "", fmt.Errorf("write identity: %w", err)
+			}
+		}
+		return fmt.Sprintf("%v as %v", cfg.VCenter.Server, cfg.VCenter.User), nil
+	})
+	if !ok {
+		logoutSelfTest(ctx, reader, writer)
+		return done()
+	}
+	defer logoutSelfTest(ctx, reader, writer)
+
+	check("privileges", func() (string, error) {
+		return writer.verifyPrivileges(ctx, cfg.requiredPrivileges())
+	})
+
+	check("categories", func() (string, error) {
+		return reader.targetCategories(ctx, cfg)
+	})
+
+	return done()
+}
+
+// logoutSelfTest logs out of the sessions of the self-test.
+func logoutSelfTest(ctx context.Context, reader, writer *vsClient) {
+	for _, clt := range []*vsClient{reader, writer} {
+		if clt == nil || (clt == writer && writer == reader) {
+			continue
+		}
+		if err := clt.logout(ctx); err != nil {
+			slog.Debug("vSphere logout failed", "err", err)
+		}
+	}
+}
+
+// ruleNames returns the names of rules.
+func ruleNames(rules []rule) []string {
+	names := make([]string, 0, len(rules))
+	for _, r := range rules {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+// requiredPrivileges returns the privileges the actions configured in cfg
+// need, sorted.
+func (cfg *vcConfig) requiredPrivileges() []string {
+	set := map[string]bool{}
+
+	for _, r := range cfg.rules() {
+		for _, a := range r.Actions {
+			switch a.Type {
+			case actionTag:
+				set["InventoryService.Tagging.AttachTag"] = true
+				for _, t := range a.Tags {
+					if t.Create || t.History != nil {
+						set["InventoryService.Tagging.CreateTag"] = true
+					}
+				}
+			case actionAcknowledge:
+				set["Alarm.Acknowledge"] = true
+			case actionReconfigure:
+				set["VirtualMachine.Config.AdvancedConfig"] = true
+			}
+		}
+	}
+
+	// The category and the managed-by tag are created on first use.
+	if cfg.ManagedByTag.Enabled {
+		set["InventoryService.Tagging.AttachTag"] = true
+		set["InventoryService.Tagging.CreateCategory"] = true
+		set["InventoryService.Tagging.CreateTag"] = true
+	}
+
+	if cfg.GC.IntervalSeconds > 0 && !cfg.GC.DryRun {
+		set["InventoryService.Tagging.DeleteTag"] = true
+	}
+
+	privs := make([]string, 0, len(set))
+	for p := range set {
+		privs = append(privs, p)
+	}
+	sort.Strings(privs)
+
+	return privs
+}
+
+// verifyPrivileges ensures the session of clt holds privs on the root folder,
+// where the roles of service accounts are usually assigned to propagate.
+func (clt *vsClient) verifyPrivileges(ctx context.Context, privs []string) (string, error) {
+	if len(privs) == 0 {
+		return "no privileges required", nil
+	}
+	if clt.govmomi == nil {
+		return "not verified, the REST API cannot check privileges", nil
+	}
+	c := clt.govmomi.Client
+
+	req := types.HasPrivilegeOnEntities{
+		This:      *c.ServiceContent.AuthorizationManager,
+		Entity:    []types.ManagedObjectReference{c.ServiceContent.RootFolder},
+		SessionId: clt.session,
+		PrivId:    privs,
+	}
+
+	res, err := methods.HasPrivilegeOnEntities(ctx, c, &req)
+	if err != nil {
+		return "", fmt.Errorf("check privileges failed: %w", err)
+	}
+
+	var missing []string
+	for _, e := range res.Returnval {
+		for _, p := range e.PrivAvailability {
+			if !p.IsGranted {
+				missing = append(missing, p.PrivId)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing privilege(s) on the root folder: %v", strings.Join(missing, ", "))
+	}
+
+	return strings.Join(privs, ", "), nil
+}
+
+// targetCategories returns the categories of the tags referenced by cfg and
+// the categories garbage collected. It fails if a tag or category does not
+// exist.
+func (clt *vsClient) targetCategories(ctx context.Context, cfg *vcConfig) (string, error) {
+	if cfg.VCenter.DisableREST {
+		return "none, the REST API is disabled", nil
+	}
+
+	m, err := clt.tagManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ids := map[string]bool{}
+	for urn := range clt.protectedTags(ctx, cfg) {
+		if urn == "" {
+			continue
+		}
+		t, err := m.GetTag(ctx, urn)
+		if err != nil {
+			return "", fmt.Errorf("tag %v not found: %w", urn, err)
+		}
+		ids[t.CategoryID] = true
+	}
+
+	// Categorized tags name their category, their tags are derived later.
+	for _, r := range cfg.Rules {
+		for _, a := range r.Actions {
+			for _, t := range a.Tags {
+				c, err := m.GetCategory(ctx, t.Category)
+				if err != nil {
+					return "", fmt.Errorf("category %v not found: %w", t.Category, err)
+				}
+				ids[c.ID] = true
+
+				if t.History == nil {
+					continue
+				}
+				c, err = m.GetCategory(ctx, t.History.Category)
+				if err != nil {
+					return "", fmt.Errorf("history category %v not found: %w", t.History.Category, err)
+				}
+				ids[c.ID] = true
+			}
+		}
+	}
+
+	if cfg.GC.IntervalSeconds > 0 {
+		gc, err := cfg.gcCategories(ctx, m)
+		if err != nil {
+			return "", err
+		}
+		for _, id := range gc {
+			ids[id] = true
+		}
+	}
+
+	var names []string
+	for id := range ids {
+		c, err := m.GetCategory(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("category %v not found: %w", id, err)
+		}
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", "), nil
+}
+
+// sendTestNotification posts a test message to the [notify] sinks.
+func sendTestNotification(ctx context.Context, cfg *vcConfig) (string, error) {
+	sinks, err := notifiers(cfg)
+	if err != nil {
+		return "", err
+	}
+	if len(sinks) == 0 {
+		return "no notify sinks configured", nil
+	}
+
+	msg := notify.Message{
+		Title:  cfg.message(i18n.SelfTest),
+		Text:   cfg.message(i18n.SelfTestText, cfg.functionName()),
+		Fields: map[string]string{"tag": cfg.Tag.URN},
+		Time:   time.Now().UTC(),
+	}
+
+	var errs []error
+	for _, s := range sinks {
+		if err := s.Notify(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d sink(s) notified", len(sinks)), nil
+}
@@ -0,0 +1,205 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer kept for reuse. Buffers grown by a
+// rare large event are dropped, so the pool does not pin up to maxBodySize per
+// idle buffer.
+const maxPooledBuffer = 64 << 10
+
+var (
+	buffers     = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	gzipReaders sync.Pool // of *gzip.Reader
+)
+
+// getBuffer returns an empty buffer of the pool.
+func getBuffer() *bytes.Buffer {
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	return buf
+}
+
+// putBuffer returns buf to the pool. Its content must no longer be used.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buffers.Put(buf)
+}
+
+// getGzipReader returns a gzip reader of the pool reading from r.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	zr, ok := gzipReaders.Get().(*gzip.Reader)
+	if !ok {
+		return gzip.NewReader(r)
+	}
+
+	if err := zr.Reset(r); err != nil {
+		gzipReaders.Put(zr)
+		return nil, err
+	}
+
+	return zr, nil
+}
+
+// pathTree holds the keys of the paths to decode by level. A nil subtree
+// decodes the whole value.
+type pathTree map[string]pathTree
+
+func newPathTree(paths []string) pathTree {
+	root := pathTree{}
+	for _, p := range paths {
+		node := root
+		keys := strings.Split(p, ".")
+		for i, key := range keys {
+			sub, ok := node[key]
+			if ok && sub == nil {
+				// A shorter path already decodes the whole value.
+				break
+			}
+			if i == len(keys)-1 {
+				node[key] = nil
+				break
+			}
+			if !ok {
+				sub = pathTree{}
+				node[key] = sub
+			}
+			node = sub
+		}
+	}
+
+	return root
+}
+
+// lastIndex returns the largest array index of the keys of t, or -1.
+func (t pathTree) lastIndex() int {
+	last := -1
+	for key := range t {
+		if i, err := strconv.Atoi(key); err == nil && i > last {
+			last = i
+		}
+	}
+
+	return last
+}
+
+// decodePaths streams the JSON document of r and decodes only the values at
+// paths, e.g. data.Alarm.Name, into objects and arrays as json.Unmarshal
+// would, with numbers as json.Number. Other values are skipped token by token,
+// so large events are not held in memory as a whole. Array elements which are
+// skipped are nil, arrays end after the last index of paths.
+func decodePaths(r io.Reader, paths []string) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	v, err := decodePruned(dec, newPathTree(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	// Trailing data is malformed, as for json.Unmarshal.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+
+	return v, nil
+}
+
+// decodePruned decodes the next value of dec, keeping only the paths of t.
+func decodePruned(dec *json.Decoder, t pathTree) (interface{}, error) {
+	if t == nil {
+		var v interface{}
+		err := dec.Decode(&v)
+		return v, err
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := map[string]interface{}{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := tok.(string)
+
+			sub, ok := t[key]
+			if !ok {
+				if err := skipValue(dec); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if obj[key], err = decodePruned(dec, sub); err != nil {
+				return nil, err
+			}
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		var arr []interface{}
+		last := t.lastIndex()
+		for i := 0; dec.More(); i++ {
+			sub, ok := t[strconv.Itoa(i)]
+			if !ok {
+				if err := skipValue(dec); err != nil {
+					return nil, err
+				}
+				if i < last {
+					arr = append(arr, nil)
+				}
+				continue
+			}
+
+			v, err := decodePruned(dec, sub)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token()
+		return arr, err
+	default:
+		// Scalars have no paths below them.
+		return tok, nil
+	}
+}
+
+// skipValue consumes the next value of dec without decoding it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/store"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// tagRetryKey is the store key of the queue of deferred tags.
+const tagRetryKey = "tagging/retry/queue"
+
+// deferredTagTTL is how long a deferred tag is retried before it is dropped,
+// e.g. because its VM was deleted meanwhile.
+const deferredTagTTL = 24 * time.Hour
+
+// tagRetryPollInterval is the time between checks whether the retry queue was
+// enabled in vcconfig.toml.
+const tagRetryPollInterval = time.Minute
+
+// unavailableStatus matches the response status at the end of vAPI errors of
+// an endpoint which is down or overloaded.
+var unavailableStatus = regexp.MustCompile(`\b50[0234] [A-Za-z ]+$`)
+
+var (
+	tagRetryOnce sync.Once // For reconcileTags() to be started once.
+
+	retryQueue struct {
+		// update serializes the updates of the queue by this replica.
+		update sync.Mutex
+		// mu protects the store, which is kept open while its
+		// configuration is unchanged.
+		mu    sync.Mutex
+		cfg   store.Config
+		store store.Store
+	}
+)
+
+// deferredTag is a tag which could not be attached while the vAPI endpoint
+// was unavailable.
+type deferredTag struct {
+	VM    string `json:"vm"`
+	URN   string `json:"urn"`
+	Rule  string `json:"rule"`
+	Event string `json:"event,omitempty"`
+	// Since is the time the tag was deferred first.
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+}
+
+// key identifies the tag of a VM in the queue.
+func (d deferredTag) key() string {
+	return d.VM + "/" + d.URN
+}
+
+// vapiUnavailable reports whether err is caused by a vAPI endpoint which
+// cannot be reached or responds with a server error, as opposed to a failure
+// retrying does not fix, e.g. a missing tag or privilege.
+func vapiUnavailable(err error) bool {
+	if err == nil || errors.Is(err, errRESTDisabled) {
+		return false
+	}
+
+	var ue *url.Error
+	var ne net.Error
+	if errors.As(err, &ue) || errors.As(err, &ne) {
+		return true
+	}
+
+	// The vAPI client returns no typed errors, but its status errors end
+	// with the response status.
+	return unavailableStatus.MatchString(err.Error())
+}
+
+// deferTag queues the tag urn of ref for reconciliation after the tag action
+// of rule r failed with cause. The returned text describes the outcome for the
+// response message.
+func deferTag(ctx context.Context, cfg *vcConfig, r *rule, ref types.ManagedObjectReference, urn string, ce *vevents.CloudEvent, cause error) (string, error) {
+	d := deferredTag{VM: ref.Value, URN: urn, Rule: r.Name, Since: time.Now().UTC()}
+	if ce != nil {
+		d.Event = ce.ID
+	}
+
+	err := updateRetryQueue(ctx, cfg, func(q map[string]deferredTag) {
+		// A tag deferred before keeps its age.
+		if old, ok := q[d.key()]; ok {
+			d.Since = old.Since
+			d.Attempts = old.Attempts
+		}
+		q[d.key()] = d
+	})
+	if err != nil {
+		return "", fmt.Errorf("deferring tag failed: %w, tag failed: %w", err, cause)
+	}
+
+	tagsDeferred.Add(1)
+	traceFrom(ctx).step("vAPI unavailable, tag %v of %v deferred", urn, ref.Value)
+	slog.Warn("vAPI unavailable, tag deferred", "vm", ref.Value, "tag", urn, "err", cause)
+
+	return cfg.message(i18n.TagDeferred, urn, ref.Value), nil
+}
+
+// reconcileTags attaches the deferred tags every [tag_retry]
+// interval_seconds until ctx is done. Like the garbage collection, the config
+// is reloaded before every run, so enabling, disabling or changing the
+// interval does not require a restart.
+func reconcileTags(ctx context.Context, path string) {
+	for {
+		interval := tagRetryPollInterval
+
+		cfg, err := activeCfg(path)
+		if err == nil && cfg.TagRetry.IntervalSeconds > 0 {
+			interval = time.Duration(cfg.TagRetry.IntervalSeconds) * time.Second
+
+			// Deferred tags stay queued while observing.
+			if cfg.observing() {
+				slog.Debug("reconciliation of deferred tags paused in observe mode")
+			} else if err := runTagRetry(ctx, cfg, time.Now()); err != nil {
+				slog.Error("reconciliation of deferred tags failed", "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runTagRetry attaches the deferred tags with the write identity, if
+// configured.
+func runTagRetry(ctx context.Context, cfg *vcConfig, now time.Time) error {
+	q, err := loadRetryQueue(ctx, cfg)
+	if err != nil || len(q) == 0 {
+		return err
+	}
+
+	reader, err := conn.get(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("connect to vSphere failed: %w", err)
+	}
+	client, wconn, err := writer(ctx, cfg, reader)
+	if err != nil {
+		return fmt.Errorf("connect to vSphere with write identity failed: %w", err)
+	}
+
+	if err := retryTags(ctx, cfg, client, now); err != nil {
+		// The next run reconnects if the REST session was lost with the
+		// endpoint.
+		wconn.verify(ctx, client)
+		return err
+	}
+
+	return nil
+}
+
+// retryTags attaches the deferred tags with client. Tags attached, of deleted
+// VMs or deferred longer than deferredTagTTL at now leave the queue. The run
+// stops at the first tag which fails since the vAPI endpoint is still
+// unavailable. The returned error reports it and the tags which failed
+// otherwise.
+func retryTags(ctx context.Context, cfg *vcConfig, client *vsClient, now time.Time) error {
+	q, err := loadRetryQueue(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	done := map[string]bool{}
+	var failed []string
+	var errs []error
+	for _, k := range keys {
+		d := q[k]
+
+		if now.Sub(d.Since) > deferredTagTTL {
+			slog.Error("deferred tag dropped", "vm", d.VM, "tag", d.URN, "rule", d.Rule, "since", d.Since, "attempts", d.Attempts)
+			done[k] = true
+			continue
+		}
+
+		ref := types.ManagedObjectReference{Type: "VirtualMachine", Value: d.VM}
+		err := limit(ctx, cfg, opTag, func(ctx context.Context) error {
+			return client.moTag(ctx, ref, d.URN)
+		})
+		if err == nil {
+			tagsReconciled.Add(1)
+			markManaged(ctx, cfg, client, ref)
+			slog.Info("deferred tag attached", "vm", d.VM, "tag", d.URN, "rule", d.Rule, "since", d.Since)
+			done[k] = true
+			continue
+		}
+		if vmNotFound(err) {
+			slog.Info("deferred tag dropped, VM not found", "vm", d.VM, "tag", d.URN)
+			done[k] = true
+			continue
+		}
+		if vapiUnavailable(err) {
+			errs = append(errs, fmt.Errorf("vAPI still unavailable: %w", err))
+			break
+		}
+
+		failed = append(failed, k)
+		errs = append(errs, fmt.Errorf("deferred tag %v of %v failed: %w", d.URN, d.VM, err))
+	}
+
+	err = updateRetryQueue(ctx, cfg, func(q map[string]deferredTag) {
+		for k := range done {
+			delete(q, k)
+		}
+		for _, k := range failed {
+			if d, ok := q[k]; ok {
+				d.Attempts++
+				q[k] = d
+			}
+		}
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// loadRetryQueue returns the deferred tags by key.
+func loadRetryQueue(ctx context.Context, cfg *vcConfig) (map[string]deferredTag, error) {
+	s, err := retryStore(cfg.TagRetry.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	q := map[string]deferredTag{}
+	v, err := s.Get(ctx, tagRetryKey)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(v, &q); err != nil {
+			return nil, fmt.Errorf("decoding retry queue failed: %w", err)
+		}
+	case store.ErrNotFound:
+	default:
+		return nil, fmt.Errorf("reading retry queue failed: %w", err)
+	}
+
+	return q, nil
+}
+
+// updateRetryQueue applies f to the deferred tags and stores them. Updates
+// are serialized within a replica, but not atomic across replicas sharing a
+// store, so concurrent updates may lose a deferred tag.
+func updateRetryQueue(ctx context.Context, cfg *vcConfig, f func(map[string]deferredTag)) error {
+	retryQueue.update.Lock()
+	defer retryQueue.update.Unlock()
+
+	q, err := loadRetryQueue(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	f(q)
+
+	s, err := retryStore(cfg.TagRetry.Store)
+	if err != nil {
+		return err
+	}
+
+	if len(q) == 0 {
+		return s.Delete(ctx, tagRetryKey)
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("encoding retry queue failed: %w", err)
+	}
+
+	if err := s.Set(ctx, tagRetryKey, b, 0); err != nil {
+		return fmt.Errorf("writing retry queue failed: %w", err)
+	}
+
+	return nil
+}
+
+// retryStore returns the store of the retry queue, which is kept open while
+// its configuration is unchanged. It defaults to the memory of the replica.
+func retryStore(c store.Config) (store.Store, error) {
+	if c.Type == "" {
+		c.Type = store.TypeMemory
+	}
+
+	retryQueue.mu.Lock()
+	defer retryQueue.mu.Unlock()
+
+	if retryQueue.store != nil && retryQueue.cfg == c {
+		return retryQueue.store, nil
+	}
+
+	s, err := store.Open(c)
+	if err != nil {
+		return nil, fmt.Errorf("open retry store failed: %w", err)
+	}
+
+	if retryQueue.store != nil {
+		retryQueue.store.Close()
+	}
+	retryQueue.cfg, retryQueue.store = c, s
+
+	return s, nil
+}
@@ -0,0 +1,70 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/humanize"
+)
+
+// Operations limited by the [timeouts] section.
+const (
+	opRetrieve    = "retrieve"
+	opTag         = "tag"
+	opReconfigure = "reconfigure"
+	opNotify      = "notify"
+)
+
+// timeout returns the limit of op, 0 if op is only limited by the invocation.
+func (cfg *vcConfig) timeout(op string) time.Duration {
+	var seconds int
+
+	switch op {
+	case opRetrieve:
+		seconds = cfg.Timeouts.RetrieveSeconds
+	case opTag:
+		seconds = cfg.Timeouts.TagSeconds
+	case opReconfigure:
+		seconds = cfg.Timeouts.ReconfigureSeconds
+	case opNotify:
+		seconds = cfg.Timeouts.NotifySeconds
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// limit runs f with the timeout of op, so e.g. a slow notification sink
+// cannot consume the time of the invocation left for the vSphere action. An
+// exceeded timeout of op is counted and reported in the returned error, an
+// exceeded deadline of ctx is returned as is.
+func limit(ctx context.Context, cfg *vcConfig, op string, f func(context.Context) error) error {
+	d := cfg.timeout(op)
+	if d <= 0 {
+		return f(ctx)
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	err := f(lctx)
+	if err != nil && errors.Is(lctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		timeouts.Add(op, 1)
+		traceFrom(ctx).step("%v timed out after %v", op, humanize.Duration(d))
+
+		return fmt.Errorf("%v timed out after %v: %w", op, humanize.Duration(d), err)
+	}
+
+	return err
+}
+
+// validateTimeouts ensures the timeouts are not negative.
+func validateTimeouts(cfg vcConfig) error {
+	t := cfg.Timeouts
+	if t.RetrieveSeconds < 0 || t.TagSeconds < 0 || t.ReconfigureSeconds < 0 || t.NotifySeconds < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+
+	return nil
+}
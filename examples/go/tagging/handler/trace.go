@@ -0,0 +1,144 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+)
+
+// traceKey is the context key of the invocation's trace.
+type traceKey struct{}
+
+// trace records the decisions and vSphere calls of a single invocation. With
+// write_debug and response_trace enabled, the trace is appended to the
+// response body so "faas-cli invoke" shows why the function acted as it did
+// without having to read the function logs.
+type trace struct {
+	enabled bool
+	start   time.Time
+	// mu protects entries, which concurrent reads of an invocation
+	// append to.
+	mu      sync.Mutex
+	entries []string
+	// version of the policy the decisions were made with, returned in
+	// the X-Policy-Version header.
+	version string
+}
+
+func newTrace() *trace {
+	return &trace{
+		enabled: debug() && os.Getenv("response_trace") == "true",
+		start:   time.Now(),
+	}
+}
+
+// withTrace returns a context carrying t.
+func withTrace(ctx context.Context, t *trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the trace carried by ctx or a disabled trace.
+func traceFrom(ctx context.Context) *trace {
+	if t, ok := ctx.Value(traceKey{}).(*trace); ok {
+		return t
+	}
+
+	return &trace{}
+}
+
+// step records a decision.
+func (t *trace) step(format string, args ...interface{}) {
+	if !t.enabled {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	t.mu.Lock()
+	t.entries = append(t.entries, fmt.Sprintf("+%v %v", time.Since(t.start).Round(time.Millisecond), msg))
+	t.mu.Unlock()
+	slog.Debug(msg)
+}
+
+// setVersion records the version of the policy of the invocation.
+func (t *trace) setVersion(v string) {
+	t.version = v
+}
+
+// call records the outcome and duration of a vSphere API call started at start.
+func (t *trace) call(name string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	t.step("vSphere call %v took %v: %v", name, time.Since(start).Round(time.Millisecond), result)
+}
+
+// response returns a response with the trace appended to body.
+func (t *trace) response(body string, status int) handler.Response {
+	res := handler.Response{
+		Body:       t.appendTo([]byte(body)),
+		StatusCode: status,
+	}
+	if t.version != "" {
+		res.Header = http.Header{"X-Policy-Version": {t.version}}
+	}
+
+	return res
+}
+
+// fail returns the failed response with code and message. The trace is
+// returned as detail "trace", so the body stays a valid apierror.Error.
+func (t *trace) fail(code apierror.Code, message string) handler.Response {
+	e := apierror.New(code, message)
+	if steps := t.text(); steps != "" {
+		e.Details = map[string]string{"trace": steps}
+	}
+
+	res := e.Response()
+	if t.version != "" {
+		res.Header.Set("X-Policy-Version", t.version)
+	}
+
+	return res
+}
+
+// text returns the entries of the trace, one per line, or "" if disabled.
+func (t *trace) text() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.enabled {
+		return ""
+	}
+
+	return strings.Join(t.entries, "\n")
+}
+
+func (t *trace) appendTo(body []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.enabled || len(t.entries) == 0 {
+		return body
+	}
+
+	var buf bytes.Buffer
+	buf.Write(body)
+	buf.WriteString("\n\n--- trace ---\n")
+	for _, e := range t.entries {
+		buf.WriteString(e)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
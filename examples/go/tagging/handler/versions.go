@@ -0,0 +1,266 @@
+package function
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+)
+
+// defaultKeptVersions is the number of configs kept for rollbacks if [versions]
+// keep is not set.
+const defaultKeptVersions = 5
+
+// latestVersion rolls back to the config of vcconfig.toml, lifting a rollback.
+const latestVersion = "latest"
+
+// Query parameters of the admin requests.
+const (
+	queryVersions = "versions" // GET lists the kept configs
+	queryRollback = "rollback" // POST rolls back to the config of the version
+)
+
+// errRollbackUnauthenticated is returned by rollbacks without [auth] checks,
+// since everyone able to invoke the function could change its behavior.
+var errRollbackUnauthenticated = errors.New("rollback requires an [auth] token or hmac_key")
+
+// configVersion is a config loaded from vcconfig.toml, identified by the
+// version of its policy.
+type configVersion struct {
+	Version string `json:"version"`
+	// LoadedAt is the time the version was loaded first.
+	LoadedAt time.Time `json:"loaded_at"`
+	cfg      *vcConfig
+}
+
+// versions keeps the configs recently loaded by this replica for rollbacks.
+var versions struct {
+	mu sync.Mutex
+	// history holds the kept configs, the most recently loaded last.
+	history []configVersion
+	// current is the version of vcconfig.toml when it was loaded last, empty
+	// if it failed to load.
+	current string
+	// pinned is the config rolled back to, over the version of vcconfig.toml
+	// at the time. The rollback is lifted once vcconfig.toml changes.
+	pinned *configVersion
+	over   string
+}
+
+// activeCfg loads vcconfig.toml at path and returns the config in effect: the
+// config rolled back to while vcconfig.toml is unchanged since the rollback,
+// otherwise the loaded one. While rolled back, a vcconfig.toml failing to load
+// does not fail the caller.
+func activeCfg(path string) (*vcConfig, error) {
+	cfg, err := loadTomlCfg(path)
+
+	versions.mu.Lock()
+	defer versions.mu.Unlock()
+
+	if err != nil {
+		versions.current = ""
+		if p := versions.pinned; p != nil {
+			return p.cfg, nil
+		}
+		return nil, err
+	}
+
+	v := policyOf(cfg).Version
+	versions.current = v
+	remember(cfg, v, time.Now())
+
+	p := versions.pinned
+	if p == nil {
+		return cfg, nil
+	}
+
+	if v != versions.over {
+		slog.Info("vcconfig changed, rollback lifted", "version", v, "rolled_back_to", p.Version)
+		versions.pinned = nil
+		return cfg, nil
+	}
+
+	// Responses may still carry the secrets of either config.
+	redactor.SetSecrets(append(cfg.secrets(), p.cfg.secrets()...)...)
+
+	return p.cfg, nil
+}
+
+// remember keeps cfg of version v as the most recently loaded config and
+// drops the oldest configs beyond the [versions] keep of cfg. versions.mu must
+// be held.
+func remember(cfg *vcConfig, v string, now time.Time) {
+	loadedAt := now
+	for i, h := range versions.history {
+		if h.Version == v {
+			loadedAt = h.LoadedAt
+			versions.history = append(versions.history[:i], versions.history[i+1:]...)
+			break
+		}
+	}
+
+	// Configs of the same version only differ in credentials, see
+	// versionOf, the newest are kept.
+	versions.history = append(versions.history, configVersion{Version: v, LoadedAt: loadedAt, cfg: cfg})
+
+	if n := len(versions.history) - cfg.keptVersions(); n > 0 {
+		versions.history = versions.history[n:]
+	}
+}
+
+// versionOf returns a short hash of the policy p of cfg without its version
+// and of cfg without its credentials. It changes whenever vcconfig.toml
+// changes other than in credentials, so rotating a password neither makes a
+// new version nor lifts a rollback.
+func versionOf(p policy, cfg *vcConfig) string {
+	p.Version = ""
+
+	b, err := json.Marshal(struct {
+		Policy policy
+		Config *vcConfig
+	}{p, cfg.withoutSecrets()})
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// keptVersions returns the number of configs kept for rollbacks.
+func (cfg *vcConfig) keptVersions() int {
+	if cfg.Versions.Keep == 0 {
+		return defaultKeptVersions
+	}
+
+	return cfg.Versions.Keep
+}
+
+// rollback makes the kept config of version v the config in effect until
+// vcconfig.toml changes. The version latestVersion, or that of vcconfig.toml,
+// lifts a rollback.
+func rollback(v string) error {
+	versions.mu.Lock()
+	defer versions.mu.Unlock()
+
+	if v == latestVersion || (v == versions.current && v != "") {
+		versions.pinned = nil
+		return nil
+	}
+
+	for _, h := range versions.history {
+		if h.Version == v {
+			pinned := h
+			versions.pinned = &pinned
+			versions.over = versions.current
+			return nil
+		}
+	}
+
+	return fmt.Errorf("version %q is not kept", v)
+}
+
+// latestCfg returns the config loaded last, for admin requests while
+// vcconfig.toml fails to load.
+func latestCfg() *vcConfig {
+	versions.mu.Lock()
+	defer versions.mu.Unlock()
+
+	if n := len(versions.history); n > 0 {
+		return versions.history[n-1].cfg
+	}
+
+	return nil
+}
+
+// versionList is the response listing the kept configs.
+type versionList struct {
+	// Active is the version in effect.
+	Active     string `json:"active"`
+	RolledBack bool   `json:"rolled_back"`
+	// Versions are the kept configs, the most recently loaded first.
+	Versions []configVersion `json:"versions"`
+}
+
+// listVersions returns the kept configs.
+func listVersions() versionList {
+	versions.mu.Lock()
+	defer versions.mu.Unlock()
+
+	l := versionList{Active: versions.current, Versions: []configVersion{}}
+	if versions.pinned != nil {
+		l.Active = versions.pinned.Version
+		l.RolledBack = true
+	}
+
+	for i := len(versions.history) - 1; i >= 0; i-- {
+		l.Versions = append(l.Versions, versions.history[i])
+	}
+
+	return l
+}
+
+// isAdmin reports whether req lists or rolls back the kept configs instead of
+// carrying an event.
+func isAdmin(req handler.Request) bool {
+	q, err := url.ParseQuery(req.QueryString)
+	if err != nil {
+		return false
+	}
+
+	return q.Has(queryVersions) || q.Has(queryRollback)
+}
+
+// adminResponse lists the kept configs on GET and rolls back on POST. cfg is
+// the config in effect, whose [auth] checks the request passed.
+func adminResponse(req handler.Request, cfg *vcConfig) (handler.Response, error) {
+	q, _ := url.ParseQuery(req.QueryString)
+
+	switch {
+	case req.Method == http.MethodGet && q.Has(queryVersions):
+		return versionsResponse()
+
+	case req.Method == http.MethodPost && q.Has(queryRollback):
+		if len(cfg.authMethods()) == 0 {
+			return apierror.Response(apierror.Forbidden, errRollbackUnauthenticated.Error()), errRollbackUnauthenticated
+		}
+
+		v := q.Get(queryRollback)
+		if err := rollback(v); err != nil {
+			wrapErr := fmt.Errorf("rollback failed: %w", err)
+			return apierror.Response(apierror.VersionNotFound, wrapErr.Error()), wrapErr
+		}
+
+		slog.Warn("rolled back vcconfig", "version", v)
+
+		return versionsResponse()
+	}
+
+	err := fmt.Errorf("unsupported admin request %v ?%v", req.Method, req.QueryString)
+	return apierror.Response(apierror.MethodNotAllowed, err.Error()), err
+}
+
+// versionsResponse returns the kept configs as JSON.
+func versionsResponse() (handler.Response, error) {
+	body, err := json.Marshal(listVersions())
+	if err != nil {
+		wrapErr := fmt.Errorf("encoding versions failed: %w", err)
+		return apierror.Response(apierror.Internal, wrapErr.Error()), wrapErr
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
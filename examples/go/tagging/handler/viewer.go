@@ -0,0 +1,184 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/apierror"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/i18n"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/middleware"
+	"github.com/vmware-samples/vcenter-event-broker-appliance/examples/go/tagging/handler/pkg/vevents"
+)
+
+// viewerType is the type of the summary CloudEvents posted to the [viewer]
+// url.
+const viewerType = "com.vmware.veba.function.result.v0"
+
+// Outcomes of an event, as shown by the event viewer.
+const (
+	outcomeRemediated = "remediated"
+	outcomeSkipped    = "skipped"
+	outcomeFailed     = "failed"
+)
+
+// outcomeHeader marks responses of skipped events, which succeed without
+// acting on the VM.
+const outcomeHeader = "X-Outcome"
+
+// Headers of skipped events, so tests like pkg/policytest need not match the
+// translated messages: the message key of the reason and, for dry runs, the
+// rule which would run.
+const (
+	reasonHeader = "X-Skip-Reason"
+	ruleHeader   = "X-Rule"
+)
+
+// viewerData is the data of a summary CloudEvent.
+type viewerData struct {
+	Function  string `json:"function"`
+	Policy    string `json:"policy,omitempty"`
+	EventID   string `json:"event_id,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	Outcome   string `json:"outcome"`
+	Status    int    `json:"status"`
+	// Message is the first line of the response, without the trace.
+	Message string `json:"message"`
+}
+
+// viewerEvent is a summary CloudEvent of a processed event.
+type viewerEvent struct {
+	ID              string     `json:"id"`
+	Source          string     `json:"source"`
+	SpecVersion     string     `json:"specversion"`
+	Type            string     `json:"type"`
+	Subject         string     `json:"subject,omitempty"`
+	Time            time.Time  `json:"time"`
+	DataContentType string     `json:"datacontenttype"`
+	Data            viewerData `json:"data"`
+}
+
+// skip returns a response with the trace appended to message, marked as
+// skipped for the event viewer and with the key of the reason.
+func (t *trace) skip(reason i18n.Key, message string, status int) handler.Response {
+	res := t.response(message, status)
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	res.Header.Set(outcomeHeader, outcomeSkipped)
+	res.Header.Set(reasonHeader, string(reason))
+
+	return res
+}
+
+// outcome classifies the response res and error err of an event. Responses
+// of skipped events are marked by skip, all other successful responses
+// remediated the event.
+func outcome(res handler.Response, err error) string {
+	switch {
+	case err == nil && res.Header.Get(outcomeHeader) == outcomeSkipped:
+		return outcomeSkipped
+	case err != nil || res.StatusCode >= http.StatusBadRequest:
+		return outcomeFailed
+	default:
+		return outcomeRemediated
+	}
+}
+
+// viewResults is a middleware posting a summary of every event to the
+// [viewer] url, see sendSummary.
+func viewResults(next middleware.Func) middleware.Func {
+	return func(req handler.Request) (handler.Response, error) {
+		res, err := next(req)
+
+		// Without config, there is no url to post to.
+		if cfg, cfgErr := requestConfig(req); cfgErr == nil && cfg.Viewer.URL != "" {
+			// Summaries are posted, even if the caller went away.
+			if postErr := sendSummary(context.WithoutCancel(requestContext(&req)), cfg, req, res, err); postErr != nil {
+				viewerFailures.Add(1)
+				slog.Error("posting summary to event viewer failed", "err", postErr)
+			}
+		}
+
+		return res, err
+	}
+}
+
+// sendSummary posts the summary of the event of req to the [viewer] url.
+// Errors must not mask the outcome of the event, so the caller only logs
+// them.
+func sendSummary(ctx context.Context, cfg *vcConfig, req handler.Request, res handler.Response, cause error) error {
+	body, err := json.Marshal(newSummary(cfg, req, res, cause, time.Now()))
+	if err != nil {
+		return fmt.Errorf("encoding summary failed: %w", err)
+	}
+
+	clt, err := outboundClient(cfg.Outbound)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, cfg.Viewer.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating summary request failed: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/cloudevents+json")
+
+	resp, err := clt.Do(r.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending summary failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("summary rejected: %v", resp.Status)
+	}
+
+	return nil
+}
+
+// newSummary returns the summary at now of the event of req, answered with
+// res and cause.
+func newSummary(cfg *vcConfig, req handler.Request, res handler.Response, cause error, now time.Time) viewerEvent {
+	name := cfg.functionName()
+
+	message, _, _ := strings.Cut(string(res.Body), "\n")
+	if e, ok := apierror.Parse(res.Body); ok {
+		message = e.Message
+	}
+	if cause != nil && message == "" {
+		message = cause.Error()
+	}
+
+	ev := viewerEvent{
+		ID:              newID(),
+		Source:          "veba/function/" + name,
+		SpecVersion:     "1.0",
+		Type:            viewerType,
+		Time:            now.UTC(),
+		DataContentType: "application/json",
+		Data: viewerData{
+			Function: name,
+			Policy:   res.Header.Get("X-Policy-Version"),
+			Outcome:  outcome(res, cause),
+			Status:   res.StatusCode,
+			Message:  message,
+		},
+	}
+
+	if body, err := decodeBody(req); err == nil {
+		if ce, err := vevents.Parse(body); err == nil {
+			ev.Data.EventID = ce.ID
+			ev.Subject = ce.Subject
+			ev.Data.EventType = eventType(ce)
+		}
+	}
+
+	return ev
+}
@@ -0,0 +1,78 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// taskInfo waits until a task succeeded or failed and returns its info. If ctx
+// is done first, the info of the task still running is returned. vCenter only
+// keeps recent tasks, so older tasks are not found.
+func (clt *vsClient) taskInfo(ctx context.Context, ref types.ManagedObjectReference) (*types.TaskInfo, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var info *types.TaskInfo
+	err := property.Wait(ctx, pc, ref, []string{"info"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if ti, ok := c.Val.(types.TaskInfo); ok {
+				info = &ti
+			}
+		}
+
+		return info != nil && (info.State == types.TaskInfoStateSuccess || info.State == types.TaskInfoStateError)
+	})
+	if err != nil && info == nil {
+		return nil, fmt.Errorf("retrieve task %v failed: %w", ref.Value, err)
+	}
+
+	return info, nil
+}
+
+// instanceUUID returns the instance UUID of the connected vCenter.
+func (clt *vsClient) instanceUUID() string {
+	return clt.govmomi.ServiceContent.About.InstanceUuid
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	if err := clt.govmomi.Logout(ctx); err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
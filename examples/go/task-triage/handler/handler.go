@@ -0,0 +1,429 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultWaitSeconds is the default maximum time waited for a task which is
+// still running when its event arrives.
+const defaultWaitSeconds = 60
+
+var (
+	// defaultEvents are triaged if no events are configured.
+	defaultEvents = []string{"TaskEvent", "TaskFailedEvent"}
+	// defaultTasks are the description ids of the tasks triaged if no
+	// tasks are configured.
+	defaultTasks = []string{"VirtualMachine.relocate", "VirtualMachine.reconfigure", "VirtualMachine.clone"}
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Triage struct {
+		// Events carry the task info of the triaged tasks, by default
+		// defaultEvents.
+		Events []string
+		// Tasks are the description ids of the triaged tasks, e.g.
+		// VirtualMachine.relocate, by default defaultTasks.
+		Tasks []string
+		// WaitSeconds is the maximum time waited for a task which is still
+		// running when its event arrives, by default defaultWaitSeconds.
+		WaitSeconds int `toml:"wait_seconds"`
+		// Classes group faults and route them to their sinks, by default
+		// defaultClasses.
+		Classes []faultClass
+	}
+	Notify struct {
+		// Faults of classes without sinks of their own and unclassified
+		// faults are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+	Links struct {
+		// Enabled adds the link to the task entity in the vSphere Client
+		// to reports and notifications.
+		Enabled bool
+		// UIURL is the address of the vSphere Client, by default
+		// https://<vcenter server>, e.g. if users reach vCenter by
+		// another name than the function.
+		UIURL string `toml:"ui_url"`
+		// InstanceUUID is the instance UUID of vCenter, by default
+		// retrieved from vCenter, which needs a connection for events
+		// carrying the fault of their task.
+		InstanceUUID string `toml:"instance_uuid"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		UserName string    `json:"UserName,omitempty"`
+		Info     *taskInfo `json:"Info,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// taskInfo is the subsection of the task info of task events the function
+// reads. The fault is an interface the event only carries the type name of, if
+// at all.
+type taskInfo struct {
+	Task          types.ManagedObjectReference  `json:"Task"`
+	DescriptionId string                        `json:"DescriptionId,omitempty"`
+	Entity        *types.ManagedObjectReference `json:"Entity,omitempty"`
+	EntityName    string                        `json:"EntityName,omitempty"`
+	State         types.TaskInfoState           `json:"State,omitempty"`
+	Error         *taskError                    `json:"Error,omitempty"`
+	Reason        *taskReason                   `json:"Reason,omitempty"`
+}
+
+// taskError is the error of a failed task.
+type taskError struct {
+	LocalizedMessage string `json:"LocalizedMessage,omitempty"`
+	Fault            struct {
+		TypeName string `json:"_typeName,omitempty"`
+	} `json:"Fault"`
+}
+
+// taskReason is the reason of a task, which names the user of tasks started
+// by users.
+type taskReason struct {
+	UserName string `json:"UserName,omitempty"`
+}
+
+// report describes the failed task, its fault class and where it was routed.
+type report struct {
+	Event      string `json:"event"`
+	Task       string `json:"task"`
+	TaskType   string `json:"task_type,omitempty"`
+	Entity     string `json:"entity,omitempty"`
+	EntityName string `json:"entity_name,omitempty"`
+	// Link is the link to the entity in the vSphere Client.
+	Link      string `json:"link,omitempty"`
+	Initiator string `json:"initiator,omitempty"`
+	Fault     string `json:"fault,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Class     string `json:"class,omitempty"`
+	// LookupError reports why the task could not be retrieved from
+	// vCenter, its fault is then classified by the event alone.
+	LookupError string   `json:"lookup_error,omitempty"`
+	Skipped     string   `json:"skipped,omitempty"`
+	Routed      []string `json:"routed,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	rep := report{
+		Event:     event.Subject,
+		Task:      event.Data.Info.Task.Value,
+		Initiator: event.Data.UserName,
+	}
+
+	actionErr := triage(ctx, cfg, &rep, event.Data.Info)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("triage of task failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// triages reports whether event carries the info of triaged tasks.
+func (cfg *vcConfig) triages(event string) bool {
+	events := cfg.Triage.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// triagesTask reports whether tasks of the description id are triaged.
+func (cfg *vcConfig) triagesTask(descriptionID string) bool {
+	tasks := cfg.Triage.Tasks
+	if len(tasks) == 0 {
+		tasks = defaultTasks
+	}
+
+	for _, t := range tasks {
+		if t == descriptionID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wait returns the maximum time waited for a running task.
+func (cfg *vcConfig) wait() time.Duration {
+	if cfg.Triage.WaitSeconds == 0 {
+		return defaultWaitSeconds * time.Second
+	}
+
+	return time.Duration(cfg.Triage.WaitSeconds) * time.Second
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	if cfg.Triage.WaitSeconds < 0 {
+		return errors.New("triage wait_seconds must not be negative")
+	}
+
+	routed := cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != ""
+
+	seen := map[string]bool{unclassified: true}
+	for i, c := range cfg.Triage.Classes {
+		if c.Name == "" {
+			return fmt.Errorf("required field(s) missing, including name of triage classes[%d]", i)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate or reserved triage class %v", c.Name)
+		}
+		seen[c.Name] = true
+
+		if len(c.Faults) == 0 {
+			return fmt.Errorf("required field(s) missing, including faults of triage class %v", c.Name)
+		}
+
+		routed = routed || c.sinks()
+	}
+
+	if u := cfg.Links.UIURL; u != "" {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("links ui_url %q is no http(s) URL", u)
+		}
+	}
+
+	// A triaged failure nobody learns about is not worth triaging.
+	if !routed {
+		return errors.New("required field(s) missing, including a notify sink or a triage class with sinks")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event carrying a task info.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.triages(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Info == nil || event.Data.Info.Task.Value == "" {
+		return nil, errors.New("empty task")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,387 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	classified := vcConfig{}
+	classified.VCenter.Server = "veba.local.corp"
+	classified.VCenter.User = "admin@vsphere.local"
+	classified.VCenter.Password = "password1234"
+	classified.Triage.Tasks = []string{"VirtualMachine.relocate", "VirtualMachine.clone"}
+	classified.Triage.Classes = []faultClass{
+		{Name: "capacity", Faults: []string{"InsufficientResourcesFault", "NoDiskSpace"}, SlackWebhookURL: "https://hooks.slack.com/services/capacity"},
+		{Name: "permission", Faults: []string{"NoPermission"}},
+	}
+	classified.Notify.WebhookURL = "https://hooks.local.corp/tasks"
+
+	defaults := vcConfig{}
+	defaults.VCenter = classified.VCenter
+	defaults.VCenter.Insecure = true
+	defaults.Triage.Events = []string{"TaskEvent"}
+	defaults.Triage.WaitSeconds = 10
+	defaults.Notify.SlackWebhookURL = "https://hooks.slack.com/services/tasks"
+	defaults.Links.Enabled = true
+	defaults.Links.UIURL = "https://vcenter.local.corp/"
+	defaults.Links.InstanceUUID = "6f1c2d7e-3a4b-4c5d-8e9f-0a1b2c3d4e5f"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with classes loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&classified,
+		},
+		{
+			"Test that toml file with the default classes loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&defaults,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without sinks results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a class without faults results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that duplicate classes result in error",
+			"testdata/vcconfigErr4.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a negative wait results in error",
+			"testdata/vcconfigErr5.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a links ui_url without scheme results in error",
+			"testdata/vcconfigErr6.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures configured events with a task are read and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that failed task event is readable", "testdata/event.json", false, "task-1207"},
+		{"Test that running task event is readable", "testdata/event2.json", false, "task-1215"},
+		{"Event should return error if info is null", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.Data.Info.Task.Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestClassify shows faults are classified by their most specific type
+// matching a default class.
+func TestClassify(t *testing.T) {
+	var cfg vcConfig
+
+	var tests = []struct {
+		testDesc string
+		fault    types.BaseMethodFault
+		want     string
+	}{
+		{"Test that a fault matches the class of the fault it derives from", &types.InvalidPowerState{}, "conflict"},
+		{"Test that the most specific fault decides", &types.NoDiskSpace{}, "capacity"},
+		{"Test that other file faults are storage faults", &types.CannotAccessFile{}, "storage"},
+		{"Test that insufficient memory is a capacity fault", &types.InsufficientMemoryResourcesFault{}, "capacity"},
+		{"Test that a failed login is a permission fault", &types.InvalidLogin{}, "permission"},
+		{"Test that other faults are unclassified", &types.SystemError{}, unclassified},
+		{"Test that an unknown fault is unclassified", nil, unclassified},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		var ft reflect.Type
+		if tc.fault != nil {
+			ft = reflect.TypeOf(tc.fault)
+		}
+
+		got := unclassified
+		if c := cfg.classify(faultNames(ft)); c != nil {
+			got = c.Name
+		}
+
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, faultNames(ft), failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestObjectLink ensures objects are linked to their view in the vSphere
+// Client and objects without view are not.
+func TestObjectLink(t *testing.T) {
+	const instance = "6f1c2d7e-3a4b-4c5d-8e9f-0a1b2c3d4e5f"
+
+	var tests = []struct {
+		testDesc string
+		base     string
+		ref      types.ManagedObjectReference
+		want     string
+	}{
+		{
+			"Test that a VM is linked to the hosts and clusters tree",
+			"https://vc01.local.corp",
+			types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"},
+			"https://vc01.local.corp/ui/app/vm;nav=h/urn:vmomi:VirtualMachine:vm-42:" + instance + "/summary",
+		},
+		{
+			"Test that a host is linked and a trailing slash of the base is dropped",
+			"https://vc01.local.corp/",
+			types.ManagedObjectReference{Type: "HostSystem", Value: "host-21"},
+			"https://vc01.local.corp/ui/app/host;nav=h/urn:vmomi:HostSystem:host-21:" + instance + "/summary",
+		},
+		{
+			"Test that a datastore is linked to the storage tree",
+			"https://vc01.local.corp",
+			types.ManagedObjectReference{Type: "Datastore", Value: "datastore-11"},
+			"https://vc01.local.corp/ui/app/datastore;nav=s/urn:vmomi:Datastore:datastore-11:" + instance + "/summary",
+		},
+		{
+			"Test that a task is not linked",
+			"https://vc01.local.corp",
+			types.ManagedObjectReference{Type: "Task", Value: "task-1207"},
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := objectLink(tc.base, instance, tc.ref)
+		if got == tc.want {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestTriage shows failed tasks are routed to the sinks of their class, with
+// the fault of the event or, for tasks still running, of the task retrieved
+// from vCenter.
+func TestTriage(t *testing.T) {
+	posted := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted[r.URL.Path] = string(body)
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		client = &vsClient{govmomi: &govmomi.Client{Client: c}}
+		defer func() { client = nil }()
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		// Powering on a powered on VM fails.
+		task, err := vm.PowerOn(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		_ = task.Wait(ctx)
+
+		var cfg vcConfig
+		cfg.Triage.Tasks = []string{"VirtualMachine.relocate", "VirtualMachine.powerOn"}
+		cfg.Triage.Classes = []faultClass{
+			{Name: "capacity", Faults: []string{"NoDiskSpace"}, WebhookURL: srv.URL + "/capacity"},
+			{Name: "conflict", Faults: []string{"InvalidState"}},
+		}
+		cfg.Notify.WebhookURL = srv.URL + "/default"
+		cfg.VCenter.Server = "vc01.local.corp"
+		cfg.Links.Enabled = true
+
+		failed := &taskInfo{
+			Task:          types.ManagedObjectReference{Type: "Task", Value: "task-1207"},
+			DescriptionId: "VirtualMachine.relocate",
+			EntityName:    "db-03",
+			State:         types.TaskInfoStateError,
+			Error:         &taskError{LocalizedMessage: "There is not enough space"},
+		}
+		failed.Error.Fault.TypeName = "NoDiskSpace"
+
+		var tests = []struct {
+			testDesc    string
+			info        *taskInfo
+			wantClass   string
+			wantSkipped bool
+			wantPath    string
+			wantLink    string
+		}{
+			{
+				"Test that a failed task is routed to the sink of its class",
+				failed,
+				"capacity", false, "/capacity", "",
+			},
+			{
+				"Test that a running task is retrieved and routed to the default sinks with the link of its VM",
+				&taskInfo{Task: task.Reference(), State: types.TaskInfoStateRunning},
+				"conflict", false, "/default",
+				objectLink("https://vc01.local.corp", c.ServiceContent.About.InstanceUuid, vm.Reference()),
+			},
+			{
+				"Test that other tasks are skipped",
+				&taskInfo{Task: task.Reference(), DescriptionId: "VirtualMachine.rename", State: types.TaskInfoStateError},
+				"", true, "", "",
+			},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			clear(posted)
+
+			rep := report{Task: tc.info.Task.Value}
+			if err := triage(ctx, &cfg, &rep, tc.info); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			body, got := posted[tc.wantPath]
+			linked := rep.Link == tc.wantLink && (tc.wantLink == "" || strings.Contains(body, tc.wantLink))
+			if rep.Class == tc.wantClass && (rep.Skipped != "") == tc.wantSkipped && (tc.wantPath == "" || got) && len(posted) == len(rep.Routed) && linked {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected class %q, skipped %v, a post to %q and link %q, got: %+v, posted %v. %v", tc.wantClass, tc.wantSkipped, tc.wantPath, tc.wantLink, rep, posted, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
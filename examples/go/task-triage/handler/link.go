@@ -0,0 +1,71 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// uiView is the view and navigation tree of objects in the vSphere Client.
+type uiView struct {
+	view string
+	nav  string // h hosts and clusters, s storage, n networking, v VMs and templates
+}
+
+// uiViews are the views of the vSphere Client by managed object type. Other
+// objects, e.g. tasks, are not linked.
+var uiViews = map[string]uiView{
+	"VirtualMachine":                 {"vm", "h"},
+	"HostSystem":                     {"host", "h"},
+	"ClusterComputeResource":         {"cluster", "h"},
+	"ResourcePool":                   {"resourcepool", "h"},
+	"Datacenter":                     {"datacenter", "h"},
+	"Datastore":                      {"datastore", "s"},
+	"StoragePod":                     {"dscluster", "s"},
+	"Network":                        {"network", "n"},
+	"DistributedVirtualPortgroup":    {"dvportgroup", "n"},
+	"VmwareDistributedVirtualSwitch": {"dvs", "n"},
+	"Folder":                         {"folder", "v"},
+}
+
+// objectLink returns the link to the summary of ref in the vSphere Client at
+// base, e.g. https://vc01.local.corp/ui/app/vm;nav=h/urn:vmomi:VirtualMachine:vm-42:<instance>/summary.
+// instance is the instance UUID of vCenter, which the object URNs carry.
+// Objects without view get no link.
+func objectLink(base, instance string, ref types.ManagedObjectReference) string {
+	v, ok := uiViews[ref.Type]
+	if !ok || instance == "" || ref.Value == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%v/ui/app/%v;nav=%v/urn:vmomi:%v:%v:%v/summary", strings.TrimSuffix(base, "/"), v.view, v.nav, ref.Type, ref.Value, instance)
+}
+
+// entityLink returns the link to ref in the vSphere Client, if [links] is
+// enabled. Without instance_uuid, the instance UUID is taken from the vCenter
+// connection. Links are best effort, so failures to connect are logged only.
+func entityLink(ctx context.Context, cfg *vcConfig, ref *types.ManagedObjectReference) string {
+	if !cfg.Links.Enabled || ref == nil {
+		return ""
+	}
+
+	instance := cfg.Links.InstanceUUID
+	if instance == "" {
+		clt, err := vsConnect(ctx, cfg)
+		if err != nil {
+			slog.Error("linking entity failed", "entity", ref.Value, "err", err)
+			return ""
+		}
+		instance = clt.instanceUUID()
+	}
+
+	base := cfg.Links.UIURL
+	if base == "" {
+		base = "https://" + cfg.VCenter.Server
+	}
+
+	return objectLink(base, instance, *ref)
+}
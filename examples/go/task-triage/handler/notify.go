@@ -0,0 +1,113 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// failureMessage returns the notification of a failed task.
+func failureMessage(rep *report) message {
+	entity := rep.Entity
+	if rep.EntityName != "" {
+		entity = rep.EntityName
+	}
+
+	msg := message{
+		Title: fmt.Sprintf("Task failed: %v", rep.Class),
+		Text:  fmt.Sprintf("%v of %v failed: %v", rep.TaskType, entity, rep.Message),
+		Fields: map[string]string{
+			"class": rep.Class,
+			"task":  rep.Task,
+		},
+		Time: time.Now().UTC(),
+	}
+
+	// Only the context known is posted.
+	for k, v := range map[string]string{"entity": rep.Entity, "link": rep.Link, "initiator": rep.Initiator, "fault": rep.Fault} {
+		if v != "" {
+			msg.Fields[k] = v
+		}
+	}
+
+	return msg
+}
+
+// notify posts msg to the webhook and Slack sinks which are set and returns
+// the names of the sinks it was posted to.
+func notify(ctx context.Context, webhookURL, slackWebhookURL string, msg message) ([]string, error) {
+	var routed []string
+	var errs []error
+
+	if webhookURL != "" {
+		if err := post(ctx, webhookURL, msg); err != nil {
+			errs = append(errs, err)
+		} else {
+			routed = append(routed, "webhook")
+		}
+	}
+
+	if slackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		err := post(ctx, slackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text})
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			routed = append(routed, "slack")
+		}
+	}
+
+	return routed, errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
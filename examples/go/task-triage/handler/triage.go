@@ -0,0 +1,222 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// unclassified is the class of faults matching no class, e.g. of tasks whose
+// fault type is unknown.
+const unclassified = "unclassified"
+
+// faultClass is a [[triage.classes]] section.
+type faultClass struct {
+	Name string
+	// Faults are the type names of the faults of the class. A fault also
+	// matches the faults it derives from, e.g. InvalidPowerState matches
+	// InvalidState.
+	Faults []string
+	// Sinks of the class, by default the [notify] sinks.
+	WebhookURL      string `toml:"webhook_url"`
+	SlackWebhookURL string `toml:"slack_webhook_url"`
+}
+
+// defaultClasses classify the faults if no classes are configured. Their
+// faults are routed to the [notify] sinks.
+var defaultClasses = []faultClass{
+	{Name: "capacity", Faults: []string{"InsufficientResourcesFault", "NoDiskSpace", "InsufficientDisks"}},
+	{Name: "permission", Faults: []string{"NoPermission", "NotAuthenticated", "InvalidLogin"}},
+	{Name: "conflict", Faults: []string{"InvalidState", "TaskInProgress", "ConcurrentAccess", "ResourceInUse"}},
+	{Name: "connectivity", Faults: []string{"HostCommunication", "HostConnectFault", "Timedout"}},
+	{Name: "storage", Faults: []string{"FileFault", "InvalidDatastore"}},
+	{Name: "configuration", Faults: []string{"VmConfigFault", "MigrationFault", "InvalidArgument"}},
+}
+
+// sinks reports whether the class has sinks of its own.
+func (c faultClass) sinks() bool {
+	return c.WebhookURL != "" || c.SlackWebhookURL != ""
+}
+
+// classes returns the configured classes or, without, defaultClasses.
+func (cfg *vcConfig) classes() []faultClass {
+	if len(cfg.Triage.Classes) > 0 {
+		return cfg.Triage.Classes
+	}
+
+	return defaultClasses
+}
+
+// classify returns the class of a fault with the type names, most specific
+// first, or nil. The most specific fault matching a class decides, so a class
+// of NoDiskSpace takes precedence over one of FileFault.
+func (cfg *vcConfig) classify(names []string) *faultClass {
+	classes := cfg.classes()
+
+	for _, name := range names {
+		for i, c := range classes {
+			for _, f := range c.Faults {
+				if f == name {
+					return &classes[i]
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// faultNames returns the type names of a fault type and of the faults it
+// derives from, most specific first, e.g. InvalidPowerState, InvalidState,
+// VimFault and MethodFault.
+func faultNames(t reflect.Type) []string {
+	if t == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var names []string
+	for t.Kind() == reflect.Struct {
+		names = append(names, t.Name())
+
+		// Faults embed the fault they derive from as first field.
+		if t.NumField() == 0 || !t.Field(0).Anonymous {
+			break
+		}
+		t = t.Field(0).Type
+	}
+
+	return names
+}
+
+// triage classifies the fault of a failed task of info and routes it to the
+// sinks of its class. Tasks still running when their event was created, and
+// failed tasks whose event lacks the fault type, are retrieved from vCenter
+// first.
+func triage(ctx context.Context, cfg *vcConfig, rep *report, info *taskInfo) error {
+	rep.TaskType = info.DescriptionId
+
+	// Other tasks are skipped without retrieving them.
+	if info.DescriptionId != "" && !cfg.triagesTask(info.DescriptionId) {
+		rep.Skipped = fmt.Sprintf("task type %v is not triaged", info.DescriptionId)
+		return nil
+	}
+
+	var faultType reflect.Type
+	if info.Error != nil && info.Error.Fault.TypeName != "" {
+		faultType, _ = types.TypeFunc()(info.Error.Fault.TypeName)
+	}
+
+	running := info.State == "" || info.State == types.TaskInfoStateQueued || info.State == types.TaskInfoStateRunning
+	if running || (info.State == types.TaskInfoStateError && faultType == nil) {
+		ti, err := lookupTask(ctx, cfg, info.Task)
+		if err != nil {
+			// The event may still tell what failed.
+			rep.LookupError = err.Error()
+			slog.Error("retrieving task failed", "task", info.Task.Value, "err", err)
+		} else {
+			info = fromTaskInfo(ti, info)
+			if ti.Error != nil {
+				faultType = reflect.TypeOf(ti.Error.Fault)
+			}
+		}
+	}
+
+	rep.TaskType = info.DescriptionId
+	if !cfg.triagesTask(info.DescriptionId) {
+		rep.Skipped = fmt.Sprintf("task type %v is not triaged", info.DescriptionId)
+		return nil
+	}
+
+	switch info.State {
+	case types.TaskInfoStateError:
+	case types.TaskInfoStateSuccess:
+		rep.Skipped = "task succeeded"
+		return nil
+	default:
+		rep.Skipped = fmt.Sprintf("task did not fail yet, state %q", info.State)
+		return nil
+	}
+
+	if info.Entity != nil {
+		rep.Entity = info.Entity.Value
+	}
+	rep.EntityName = info.EntityName
+	rep.Link = entityLink(ctx, cfg, info.Entity)
+	if rep.Initiator == "" && info.Reason != nil {
+		rep.Initiator = info.Reason.UserName
+	}
+	if info.Error != nil {
+		rep.Message = info.Error.LocalizedMessage
+		rep.Fault = info.Error.Fault.TypeName
+	}
+
+	names := faultNames(faultType)
+	if len(names) > 0 {
+		rep.Fault = names[0]
+	}
+
+	webhook, slack := cfg.Notify.WebhookURL, cfg.Notify.SlackWebhookURL
+	rep.Class = unclassified
+	if c := cfg.classify(names); c != nil {
+		rep.Class = c.Name
+		if c.sinks() {
+			webhook, slack = c.WebhookURL, c.SlackWebhookURL
+		}
+	}
+
+	routed, err := notify(ctx, webhook, slack, failureMessage(rep))
+	rep.Routed = routed
+	if err != nil {
+		return fmt.Errorf("notify of class %v failed: %w", rep.Class, err)
+	}
+
+	if len(routed) == 0 {
+		slog.Info("no sinks for fault class", "class", rep.Class, "task", rep.Task)
+	}
+
+	return nil
+}
+
+// lookupTask retrieves a task from vCenter, waiting up to the configured time
+// for it to complete.
+func lookupTask(ctx context.Context, cfg *vcConfig, ref types.ManagedObjectReference) (*types.TaskInfo, error) {
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect to vSphere failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.wait())
+	defer cancel()
+
+	return clt.taskInfo(ctx, ref)
+}
+
+// fromTaskInfo returns the fields of ti the function reads. Fields ti lacks,
+// e.g. the initiator of tasks which vCenter did not record, are kept from the
+// event info.
+func fromTaskInfo(ti *types.TaskInfo, event *taskInfo) *taskInfo {
+	info := *event
+	info.DescriptionId = ti.DescriptionId
+	info.Entity = ti.Entity
+	info.EntityName = ti.EntityName
+	info.State = ti.State
+
+	if ti.Error != nil {
+		info.Error = &taskError{LocalizedMessage: ti.Error.LocalizedMessage}
+		if names := faultNames(reflect.TypeOf(ti.Error.Fault)); len(names) > 0 {
+			info.Error.Fault.TypeName = names[0]
+		}
+	}
+
+	if r, ok := ti.Reason.(*types.TaskReasonUser); ok {
+		info.Reason = &taskReason{UserName: r.UserName}
+	}
+
+	return &info
+}
@@ -0,0 +1,212 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vmtxPath is the vcenter vm-template API of library items.
+const vmtxPath = "/vcenter/vm-template/library-items"
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// vmHardware retrieves the hardware of a VM.
+func (clt *vsClient) vmHardware(ctx context.Context, ref types.ManagedObjectReference) (hardware, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"config.hardware"}, &vm)
+	if err != nil {
+		return hardware{}, fmt.Errorf("retrieve hardware of %v failed: %w", ref.Value, err)
+	}
+
+	if vm.Config == nil {
+		return hardware{}, fmt.Errorf("no hardware of %v", ref.Value)
+	}
+
+	hw := vm.Config.Hardware
+	res := hardware{
+		CPUs:           int(hw.NumCPU),
+		CoresPerSocket: int(hw.NumCoresPerSocket),
+		MemoryMiB:      int64(hw.MemoryMB),
+		Disks:          map[string]string{},
+		NICs:           map[string]string{},
+	}
+
+	for _, dev := range hw.Device {
+		key := strconv.Itoa(int(dev.GetVirtualDevice().Key))
+
+		switch d := dev.(type) {
+		case *types.VirtualDisk:
+			res.Disks[key] = capacity(d.CapacityInBytes)
+		case types.BaseVirtualEthernetCard:
+			res.NICs[key] = backingNetwork(d.GetVirtualEthernetCard().Backing)
+		}
+	}
+
+	return res, nil
+}
+
+// backingNetwork returns the identifier of the network of a NIC, as used by
+// the vcenter vm-template API.
+func backingNetwork(backing types.BaseVirtualDeviceBackingInfo) string {
+	switch b := backing.(type) {
+	case *types.VirtualEthernetCardNetworkBackingInfo:
+		if b.Network != nil {
+			return b.Network.Value
+		}
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		return b.Port.PortgroupKey
+	case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+		return b.OpaqueNetworkId
+	}
+
+	return ""
+}
+
+// libraries returns the ids of the Content Libraries named names, or of all
+// libraries without names.
+func (clt *vsClient) libraries(ctx context.Context, names []string) ([]string, error) {
+	m := library.NewManager(clt.rest)
+
+	if len(names) == 0 {
+		ids, err := m.ListLibraries(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list libraries failed: %w", err)
+		}
+		return ids, nil
+	}
+
+	var ids []string
+	for _, name := range names {
+		found, err := m.FindLibrary(ctx, library.Find{Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("find library %q failed: %w", name, err)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("library %q not found", name)
+		}
+		ids = append(ids, found...)
+	}
+
+	return ids, nil
+}
+
+// templateItems returns the ids of the VM template items of a library.
+func (clt *vsClient) templateItems(ctx context.Context, libraryID string) ([]string, error) {
+	m := library.NewManager(clt.rest)
+
+	ids, err := m.FindLibraryItems(ctx, library.FindItem{LibraryID: libraryID, Type: library.ItemTypeVMTX})
+	if err != nil {
+		return nil, fmt.Errorf("list templates of library %v failed: %w", libraryID, err)
+	}
+
+	return ids, nil
+}
+
+// templateInfo retrieves the VM template of a library item.
+func (clt *vsClient) templateInfo(ctx context.Context, itemID string) (*templateInfo, error) {
+	var info templateInfo
+
+	req := clt.rest.Resource(vmtxPath).WithID(itemID).Request(http.MethodGet)
+	err := clt.rest.Do(ctx, req, &info)
+	if err != nil {
+		return nil, fmt.Errorf("get template of library item %v failed: %w", itemID, err)
+	}
+
+	return &info, nil
+}
+
+// item retrieves a library item.
+func (clt *vsClient) item(ctx context.Context, itemID string) (*library.Item, error) {
+	item, err := library.NewManager(clt.rest).GetLibraryItem(ctx, itemID)
+	if err != nil {
+		return nil, fmt.Errorf("get library item %v failed: %w", itemID, err)
+	}
+
+	return item, nil
+}
+
+// tag attaches an existing tag to a VM.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	m := tags.NewManager(clt.rest)
+
+	err := m.AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package function
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// hardwareFields are the hardware compared, which can be ignored in
+// vcconfig.toml.
+var hardwareFields = map[string]bool{
+	"cpu":              true,
+	"cores_per_socket": true,
+	"memory":           true,
+	"disks":            true,
+	"nics":             true,
+}
+
+// hardware of a VM or described by a library item. Devices are keyed by their
+// device key, which VMs keep when cloned from a template.
+type hardware struct {
+	CPUs           int
+	CoresPerSocket int
+	MemoryMiB      int64
+	Disks          map[string]string // capacity, see capacity()
+	NICs           map[string]string // network
+}
+
+// difference is hardware of a VM not matching its library item.
+type difference struct {
+	Field    string `json:"field"`
+	Template string `json:"template"`
+	VM       string `json:"vm"`
+}
+
+// templateInfo is the VM template of a library item, as described by the
+// vcenter vm-template API. Maps are lists of key value pairs in this API.
+type templateInfo struct {
+	VMTemplate string `json:"vm_template"`
+	CPU        struct {
+		Count          int `json:"count"`
+		CoresPerSocket int `json:"cores_per_socket"`
+	} `json:"cpu"`
+	Memory struct {
+		SizeMiB int64 `json:"size_MiB"`
+	} `json:"memory"`
+	Disks []struct {
+		Key   string `json:"key"`
+		Value struct {
+			Capacity int64 `json:"capacity"`
+		} `json:"value"`
+	} `json:"disks"`
+	NICs []struct {
+		Key   string `json:"key"`
+		Value struct {
+			Network string `json:"network"`
+		} `json:"value"`
+	} `json:"nics"`
+}
+
+// hardware returns the hardware described by info.
+func (info *templateInfo) hardware() hardware {
+	hw := hardware{
+		CPUs:           info.CPU.Count,
+		CoresPerSocket: info.CPU.CoresPerSocket,
+		MemoryMiB:      info.Memory.SizeMiB,
+		Disks:          make(map[string]string, len(info.Disks)),
+		NICs:           make(map[string]string, len(info.NICs)),
+	}
+
+	for _, d := range info.Disks {
+		hw.Disks[d.Key] = capacity(d.Value.Capacity)
+	}
+	for _, n := range info.NICs {
+		hw.NICs[n.Key] = n.Value.Network
+	}
+
+	return hw
+}
+
+// compare returns the differences of vm from the template, ordered by field.
+// Fields in ignore are not compared.
+func compare(template, vm hardware, ignore map[string]bool) []difference {
+	var diffs []difference
+
+	add := func(field, t, v string) {
+		if t != v {
+			diffs = append(diffs, difference{Field: field, Template: t, VM: v})
+		}
+	}
+
+	if !ignore["cpu"] {
+		add("cpu", strconv.Itoa(template.CPUs), strconv.Itoa(vm.CPUs))
+	}
+	if !ignore["cores_per_socket"] {
+		add("cores_per_socket", strconv.Itoa(template.CoresPerSocket), strconv.Itoa(vm.CoresPerSocket))
+	}
+	if !ignore["memory"] {
+		add("memory", fmt.Sprintf("%d MiB", template.MemoryMiB), fmt.Sprintf("%d MiB", vm.MemoryMiB))
+	}
+
+	if !ignore["disks"] {
+		diffs = append(diffs, compareDevices("disk", template.Disks, vm.Disks)...)
+	}
+	if !ignore["nics"] {
+		diffs = append(diffs, compareDevices("nic", template.NICs, vm.NICs)...)
+	}
+
+	return diffs
+}
+
+// compareDevices returns the differences of the devices of a VM from the
+// devices of the template, ordered by device key. Devices missing on either
+// side are none.
+func compareDevices(kind string, template, vm map[string]string) []difference {
+	all := make([]string, 0, len(template)+len(vm))
+	for key := range template {
+		all = append(all, key)
+	}
+	for key := range vm {
+		if _, ok := template[key]; !ok {
+			all = append(all, key)
+		}
+	}
+	sort.Strings(all)
+
+	var diffs []difference
+	for _, key := range all {
+		t, ok := template[key]
+		if !ok {
+			t = "none"
+		}
+		v, ok := vm[key]
+		if !ok {
+			v = "none"
+		}
+
+		if t != v {
+			diffs = append(diffs, difference{Field: kind + " " + key, Template: t, VM: v})
+		}
+	}
+
+	return diffs
+}
+
+// capacity formats the capacity of a disk in bytes.
+func capacity(bytes int64) string {
+	return strconv.FormatFloat(float64(bytes)/(1<<30), 'f', -1, 64) + " GiB"
+}
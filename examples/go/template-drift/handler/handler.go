@@ -0,0 +1,396 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// supportedEvents are deployments from a template and clones, which include
+// deployments of Content Library VM templates.
+var supportedEvents = map[string]bool{
+	"VmDeployedEvent": true,
+	"VmClonedEvent":   true,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Drift struct {
+		// Libraries are the names of the Content Libraries searched for the
+		// item of a template, by default all libraries.
+		Libraries []string
+		// TagURN is attached to VMs whose hardware drifted from their item.
+		TagURN string `toml:"tag_urn"`
+		// Ignore lists hardware not compared, see hardwareFields.
+		Ignore []string
+	}
+	Notify struct {
+		// Drifted VMs are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event. The template of VmDeployedEvent
+// is SrcTemplate, the source of VmClonedEvent is SourceVm.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		CreatedTime time.Time              `json:"CreatedTime"`
+		Vm          *types.VmEventArgument `json:"Vm,omitempty"`
+		SrcTemplate *types.VmEventArgument `json:"SrcTemplate,omitempty"`
+		SourceVm    *types.VmEventArgument `json:"SourceVm,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// source returns the template or VM the VM of the event was created from.
+func (event *incoming) source() *types.VmEventArgument {
+	if event.Data.SrcTemplate != nil {
+		return event.Data.SrcTemplate
+	}
+
+	return event.Data.SourceVm
+}
+
+// report describes the drift of a deployed VM from its library item and the
+// actions taken.
+type report struct {
+	Event       string       `json:"event"`
+	VM          string       `json:"vm"`
+	Name        string       `json:"name,omitempty"`
+	Template    string       `json:"template"`
+	Item        string       `json:"item,omitempty"`
+	Drift       bool         `json:"drift"`
+	Differences []difference `json:"differences,omitempty"`
+	Actions     []string     `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+
+	// items caches the library items of templates across invocations.
+	items = newItemCache()
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	rep := report{
+		Event:    event.Subject,
+		VM:       event.Data.Vm.Vm.Value,
+		Name:     event.Data.Vm.Name,
+		Template: event.source().Name,
+	}
+
+	actionErr := check(ctx, clt, cfg, &rep, event.Data.Vm.Vm, event.source().Vm)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("checking of drift failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// check compares the hardware of vm with the hardware described by the library
+// item of source and acts on a drift. Completed actions are added to rep, the
+// joined errors of failed actions are returned. Sources which are no template
+// of a library item are skipped.
+func check(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm, source types.ManagedObjectReference) error {
+	item, described, err := items.lookup(ctx, clt, source, cfg.Drift.Libraries)
+	if errors.Is(err, errNoItem) {
+		rep.Actions = append(rep.Actions, "no library item")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rep.Item = item.Name
+
+	actual, err := clt.vmHardware(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	rep.Differences = compare(described, actual, cfg.ignored())
+	rep.Drift = len(rep.Differences) > 0
+	if !rep.Drift {
+		return nil
+	}
+
+	var errs []error
+
+	if cfg.Drift.TagURN != "" {
+		if err := clt.tag(ctx, vm, cfg.Drift.TagURN); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "tagged")
+		}
+	}
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, driftMessage(rep, time.Now())); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ignored returns the hardware fields not compared.
+func (cfg *vcConfig) ignored() map[string]bool {
+	ignore := make(map[string]bool, len(cfg.Drift.Ignore))
+	for _, f := range cfg.Drift.Ignore {
+		ignore[f] = true
+	}
+
+	return ignore
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	for _, f := range cfg.Drift.Ignore {
+		if !hardwareFields[f] {
+			return fmt.Errorf("unsupported drift ignore %q", f)
+		}
+	}
+
+	// A drift nobody learns about is not worth detecting.
+	if cfg.Drift.TagURN == "" && cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return errors.New("required field(s) missing, including drift tag_urn or a notify sink")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a deployment or clone event with the created VM and its
+// source.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !supportedEvents[event.Subject] {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty virtual machine")
+	}
+
+	if src := event.source(); src == nil || src.Vm.Value == "" {
+		return nil, errors.New("empty source template")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,385 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// fakeCatalog holds VM template items by id, in a single library.
+type fakeCatalog struct {
+	templates map[string]string // template by item id
+	infos     int               // calls of templateInfo
+}
+
+func (f *fakeCatalog) libraries(context.Context, []string) ([]string, error) {
+	return []string{"lib-1"}, nil
+}
+
+func (f *fakeCatalog) templateItems(context.Context, string) ([]string, error) {
+	var ids []string
+	for id := range f.templates {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (f *fakeCatalog) templateInfo(_ context.Context, id string) (*templateInfo, error) {
+	f.infos++
+	return &templateInfo{VMTemplate: f.templates[id]}, nil
+}
+
+func (f *fakeCatalog) item(_ context.Context, id string) (*library.Item, error) {
+	return &library.Item{ID: id, Name: "item-" + id}, nil
+}
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagOnly := vcConfig{}
+	tagOnly.VCenter.Server = "veba.local.corp"
+	tagOnly.VCenter.User = "admin@vsphere.local"
+	tagOnly.VCenter.Password = "password1234"
+	tagOnly.Drift.TagURN = "urn:vmomi:InventoryServiceTag:7a4b6c1d-2e3f-4a5b-8c6d-9e0f1a2b3c4d:GLOBAL"
+
+	notifyOnly := vcConfig{}
+	notifyOnly.VCenter.Server = "veba.local.corp"
+	notifyOnly.VCenter.User = "admin@vsphere.local"
+	notifyOnly.VCenter.Password = "password1234"
+	notifyOnly.VCenter.Insecure = true
+	notifyOnly.Drift.Libraries = []string{"templates-prod", "templates-dev"}
+	notifyOnly.Drift.Ignore = []string{"memory", "nics"}
+	notifyOnly.Notify.WebhookURL = "https://hooks.local.corp/drift"
+	notifyOnly.Notify.SlackWebhookURL = "https://hooks.slack.com/services/T000/B000/XXXX"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a tag loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagOnly,
+		},
+		{
+			"Test that toml file with libraries, ignored hardware and notify sinks loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&notifyOnly,
+		},
+		{
+			"Test that toml file missing vCenter password results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag and notify sink results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that ignoring unsupported hardware results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the VM and source of deployments and clones are read
+// and other events are rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that the template of a deployment is read", "testdata/event.json", false, "vm-97 from vm-61"},
+		{"Test that the source of a clone is read", "testdata/event2.json", false, "vm-102 from vm-64"},
+		{"Event should return error if source is empty", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is no deployment or clone", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := event.Data.Vm.Vm.Value + " from " + event.source().Vm.Value
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestCompare ensures the hardware of VMs is compared with the hardware
+// described by a library item.
+func TestCompare(t *testing.T) {
+	body, err := os.ReadFile("testdata/template.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var info templateInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	template := info.hardware()
+
+	deployed := func(change func(hw *hardware)) hardware {
+		hw := hardware{
+			CPUs:           2,
+			CoresPerSocket: 1,
+			MemoryMiB:      4096,
+			Disks:          map[string]string{"2000": "40 GiB"},
+			NICs:           map[string]string{"4000": "network-13"},
+		}
+		change(&hw)
+		return hw
+	}
+
+	var tests = []struct {
+		testDesc string
+		vm       hardware
+		ignore   map[string]bool
+		want     []difference
+	}{
+		{
+			"Test that a VM matching its item has no differences",
+			deployed(func(*hardware) {}),
+			nil,
+			nil,
+		},
+		{
+			"Test that changed CPUs and memory are differences",
+			deployed(func(hw *hardware) { hw.CPUs = 4; hw.MemoryMiB = 8192 }),
+			nil,
+			[]difference{{"cpu", "2", "4"}, {"memory", "4096 MiB", "8192 MiB"}},
+		},
+		{
+			"Test that resized, added and removed devices are differences",
+			deployed(func(hw *hardware) {
+				hw.Disks = map[string]string{"2000": "60 GiB", "2001": "10 GiB"}
+				hw.NICs = map[string]string{}
+			}),
+			nil,
+			[]difference{{"disk 2000", "40 GiB", "60 GiB"}, {"disk 2001", "none", "10 GiB"}, {"nic 4000", "network-13", "none"}},
+		},
+		{
+			"Test that ignored hardware is not compared",
+			deployed(func(hw *hardware) { hw.MemoryMiB = 8192; hw.NICs["4000"] = "network-14" }),
+			map[string]bool{"memory": true, "nics": true},
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := compare(template, tc.vm, tc.ignore)
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestLookup ensures the library item of a template is found once and
+// searched again once its template changed.
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+	cat := &fakeCatalog{templates: map[string]string{"item-1": "vm-61", "item-2": "vm-64"}}
+	c := newItemCache()
+
+	var tests = []struct {
+		testDesc  string
+		source    string
+		change    func()
+		want      string
+		wantInfos int // calls of templateInfo
+	}{
+		{"Test that the item of a template is searched", "vm-61", func() {}, "item-item-1", -1},
+		{"Test that the item of a template is cached", "vm-61", func() {}, "item-item-1", 1},
+		{"Test that the item of a replaced template is searched again", "vm-61", func() { cat.templates["item-1"] = "vm-70" }, "", -1},
+		{"Test that a source without item is no template", "vm-99", func() {}, "", -1},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		tc.change()
+		cat.infos = 0
+
+		item, _, err := c.lookup(ctx, cat, types.ManagedObjectReference{Type: "VirtualMachine", Value: tc.source}, nil)
+
+		var got string
+		switch {
+		case errors.Is(err, errNoItem):
+		case err != nil:
+			t.Fatal(failMark, err)
+		default:
+			got = item.Name
+		}
+
+		if got == tc.want && (tc.wantInfos < 0 || cat.infos == tc.wantInfos) {
+			t.Logf("got expected: %q after %d lookups. %v", got, cat.infos, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q after %d lookups. %v", tc.want, got, cat.infos, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestVMHardware ensures the hardware of a VM is retrieved from vSphere.
+func TestVMHardware(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var want mo.VirtualMachine
+		if err := vm.Properties(ctx, vm.Reference(), []string{"config.hardware"}, &want); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that CPUs, memory, disks and NICs of a VM are retrieved ===========")
+		hw, err := clt.vmHardware(ctx, vm.Reference())
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+
+		disks := object.VirtualDeviceList(want.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+		nics := object.VirtualDeviceList(want.Config.Hardware.Device).SelectByType((*types.VirtualEthernetCard)(nil))
+
+		if hw.CPUs == int(want.Config.Hardware.NumCPU) && hw.MemoryMiB == int64(want.Config.Hardware.MemoryMB) &&
+			len(hw.Disks) == len(disks) && len(hw.NICs) == len(nics) && len(hw.NICs) > 0 {
+			t.Logf("got expected: %+v. %v", hw, passMark)
+		} else {
+			t.Logf("expected %d CPUs, %d MiB, %d disks and %d NICs, got: %+v. %v",
+				want.Config.Hardware.NumCPU, want.Config.Hardware.MemoryMB, len(disks), len(nics), hw, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that the hardware of a missing VM results in error ===========")
+		_, err = clt.vmHardware(ctx, types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-missing"})
+		if err != nil {
+			t.Logf("got an error, as expected: %v. %v", err, passMark)
+		} else {
+			t.Log("expected an error for a missing VM.", failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// errNoItem is returned for sources which are no template of a library item.
+var errNoItem = errors.New("no library item of template")
+
+// catalog looks up the VM template items of Content Libraries.
+type catalog interface {
+	libraries(ctx context.Context, names []string) ([]string, error)
+	templateItems(ctx context.Context, libraryID string) ([]string, error)
+	templateInfo(ctx context.Context, itemID string) (*templateInfo, error)
+	item(ctx context.Context, itemID string) (*library.Item, error)
+}
+
+// itemCache remembers the library item of each template, so the libraries are
+// only searched for the first deployment of a template.
+type itemCache struct {
+	mu    sync.Mutex
+	items map[string]string // library item id by template
+}
+
+func newItemCache() *itemCache {
+	return &itemCache{items: map[string]string{}}
+}
+
+// lookup returns the library item whose VM template is source, and the
+// hardware it describes. Cached items are verified to still be backed by
+// source, e.g. after the item was updated, which replaces its template.
+func (c *itemCache) lookup(ctx context.Context, cat catalog, source types.ManagedObjectReference, names []string) (*library.Item, hardware, error) {
+	c.mu.Lock()
+	id, ok := c.items[source.Value]
+	c.mu.Unlock()
+
+	if ok {
+		info, err := cat.templateInfo(ctx, id)
+		if err == nil && info.VMTemplate == source.Value {
+			return c.found(ctx, cat, id, info)
+		}
+		c.forget(source.Value)
+	}
+
+	libs, err := cat.libraries(ctx, names)
+	if err != nil {
+		return nil, hardware{}, err
+	}
+
+	for _, lib := range libs {
+		ids, err := cat.templateItems(ctx, lib)
+		if err != nil {
+			return nil, hardware{}, err
+		}
+
+		for _, id := range ids {
+			info, err := cat.templateInfo(ctx, id)
+			if err != nil {
+				return nil, hardware{}, err
+			}
+
+			if info.VMTemplate != source.Value {
+				continue
+			}
+
+			c.mu.Lock()
+			c.items[source.Value] = id
+			c.mu.Unlock()
+
+			return c.found(ctx, cat, id, info)
+		}
+	}
+
+	return nil, hardware{}, errNoItem
+}
+
+// found returns the item id and the hardware described by info.
+func (c *itemCache) found(ctx context.Context, cat catalog, id string, info *templateInfo) (*library.Item, hardware, error) {
+	item, err := cat.item(ctx, id)
+	if err != nil {
+		return nil, hardware{}, err
+	}
+
+	return item, info.hardware(), nil
+}
+
+// forget removes the item of a template.
+func (c *itemCache) forget(template string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items, template)
+}
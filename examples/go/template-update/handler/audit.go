@@ -0,0 +1,42 @@
+package function
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// auditVersion identifies the audit records of tag descriptions. The record
+// is the one of package tagaudit of the tagging function, so its tools read
+// the tags created by either function. The examples build as modules of their
+// own, so the format is repeated here.
+const auditVersion = 1
+
+// auditRecord is the audit context of a created tag: why and when it was
+// created.
+type auditRecord struct {
+	Version  int       `json:"veba_audit"`
+	Previous string    `json:"previous,omitempty"` // value replaced by the tag, if any
+	Value    string    `json:"value"`              // value the tag represents
+	EventID  string    `json:"event_id,omitempty"` // ID of the triggering event
+	Time     time.Time `json:"time"`
+}
+
+// auditDescription returns the description of a tag created for value, which
+// replaces previous, if any, by the CloudEvent eventID.
+func auditDescription(value, previous, eventID string) string {
+	b, err := json.Marshal(auditRecord{
+		Version:  auditVersion,
+		Previous: previous,
+		Value:    value,
+		EventID:  eventID,
+		Time:     time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		// The tag is still created, only without audit record.
+		slog.Error("encoding tag audit record failed", "value", value, "err", err)
+		return ""
+	}
+
+	return string(b)
+}
@@ -0,0 +1,295 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// templateInfo holds the name of a VM, whether it is a template, and its
+// recorded last change.
+type templateInfo struct {
+	Name     string
+	Template bool
+	// Recorded is nil without recorded change.
+	Recorded *record
+}
+
+// fieldKey returns the key of the VM custom attribute name. It is created if
+// it does not exist and create is set, otherwise the key is -1.
+func (clt *vsClient) fieldKey(ctx context.Context, name string, create bool) (int32, error) {
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return 0, fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	key, err := m.FindKey(ctx, name)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, object.ErrKeyNameNotFound) {
+		return 0, fmt.Errorf("find custom attribute %v failed: %w", name, err)
+	}
+	if !create {
+		return -1, nil
+	}
+
+	def, err := m.Add(ctx, name, "VirtualMachine", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("create custom attribute %v failed: %w", name, err)
+	}
+
+	return def.Key, nil
+}
+
+// templateInfo retrieves the name of a VM, whether it is a template and the
+// change recorded in the custom attribute field, if field is set. Recorded
+// values which are no record are ignored.
+func (clt *vsClient) templateInfo(ctx context.Context, ref types.ManagedObjectReference, field string) (*templateInfo, error) {
+	key := int32(-1)
+	if field != "" {
+		var err error
+		key, err = clt.fieldKey(ctx, field, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "config.template", "customValue"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve template %v failed: %w", ref.Value, err)
+	}
+
+	info := templateInfo{Name: vm.Name}
+	if vm.Config != nil {
+		info.Template = vm.Config.Template
+	}
+
+	for _, v := range vm.CustomValue {
+		s, ok := v.(*types.CustomFieldStringValue)
+		if !ok || s.Key != key {
+			continue
+		}
+
+		var r record
+		if err := json.Unmarshal([]byte(s.Value), &r); err == nil {
+			info.Recorded = &r
+		}
+	}
+
+	return &info, nil
+}
+
+// setRecord records the change r of a template in the custom attribute field.
+func (clt *vsClient) setRecord(ctx context.Context, ref types.ManagedObjectReference, field string, r record) error {
+	key, err := clt.fieldKey(ctx, field, true)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encoding record failed: %w", err)
+	}
+
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	err = m.Set(ctx, ref, key, string(value))
+	if err != nil {
+		return fmt.Errorf("record change of %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// categoryID returns the id of the tag category name, which is created with
+// single cardinality for VMs if it does not exist.
+func (clt *vsClient) categoryID(ctx context.Context, name string) (string, error) {
+	m := tags.NewManager(clt.rest)
+
+	find := func() (string, error) {
+		categories, err := m.GetCategories(ctx)
+		if err != nil {
+			return "", fmt.Errorf("list tag categories failed: %w", err)
+		}
+		for _, c := range categories {
+			if c.Name == name {
+				return c.ID, nil
+			}
+		}
+		return "", nil
+	}
+
+	id, err := find()
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	id, err = m.CreateCategory(ctx, &tags.Category{
+		Name:            name,
+		Description:     "Versions of VM templates",
+		Cardinality:     "SINGLE",
+		AssociableTypes: []string{"VirtualMachine"},
+	})
+	if err == nil {
+		return id, nil
+	}
+
+	// Another replica may have created the category meanwhile.
+	if id, ferr := find(); ferr == nil && id != "" {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("create tag category %v failed: %w", name, err)
+}
+
+// attachedTags returns the tags of category attached to a VM.
+func (clt *vsClient) attachedTags(ctx context.Context, ref types.ManagedObjectReference, categoryID string) ([]tags.Tag, error) {
+	attached, err := tags.NewManager(clt.rest).GetAttachedTags(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	var out []tags.Tag
+	for _, t := range attached {
+		if t.CategoryID == categoryID {
+			out = append(out, t)
+		}
+	}
+
+	return out, nil
+}
+
+// tagID returns the id of the tag name of category, which is created with
+// description if it does not exist.
+func (clt *vsClient) tagID(ctx context.Context, categoryID, name, description string) (string, error) {
+	m := tags.NewManager(clt.rest)
+
+	find := func() (string, error) {
+		all, err := m.GetTagsForCategory(ctx, categoryID)
+		if err != nil {
+			return "", fmt.Errorf("list tags of category %v failed: %w", categoryID, err)
+		}
+		for _, t := range all {
+			if t.Name == name {
+				return t.ID, nil
+			}
+		}
+		return "", nil
+	}
+
+	id, err := find()
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	id, err = m.CreateTag(ctx, &tags.Tag{Name: name, CategoryID: categoryID, Description: description})
+	if err == nil {
+		return id, nil
+	}
+
+	// Another replica may have created the tag meanwhile.
+	if id, ferr := find(); ferr == nil && id != "" {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("create tag %v failed: %w", name, err)
+}
+
+// tag attaches an existing tag to a VM.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from a VM.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,425 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Subjects of the supported events. Marking a VM as template is reported by
+// the TaskEvent of the task markAsTemplateTask.
+const (
+	subjectTask         = "TaskEvent"
+	subjectReconfigured = "VmReconfiguredEvent"
+	markAsTemplateTask  = "VirtualMachine.markAsTemplate"
+)
+
+// Changes of templates.
+const (
+	changeMarked       = "marked as template"
+	changeReconfigured = "reconfigured"
+)
+
+// Defaults of the [template] section.
+const (
+	defaultCategory  = "template-version"
+	defaultAttribute = "template-change"
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Template struct {
+		// Templates are name patterns of the watched templates, by
+		// default all templates.
+		Templates []string
+		// Category holds the version tags v1, v2, ... of the templates.
+		// The category and its tags are created if missing.
+		Category string
+		// Attribute is the custom attribute recording the last change of
+		// a template, "-" to not record changes.
+		Attribute string
+	}
+	// Pipelines are the image pipelines built from templates.
+	Pipelines []pipeline
+	Notify    struct {
+		// Changes are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// pipeline is an image pipeline depending on templates.
+type pipeline struct {
+	Name string
+	// Templates are name patterns of the templates the pipeline is built
+	// from.
+	Templates []string
+	// Owners are told to rebuild the automation of the pipeline.
+	Owners []string
+	// WebhookURL receives the changes of the templates as JSON, e.g. to
+	// trigger a rebuild.
+	WebhookURL string `toml:"webhook_url"`
+}
+
+// Incoming is a subsection of a Cloud Event. Info is set for TaskEvent,
+// ConfigSpec for VmReconfiguredEvent.
+type incoming struct {
+	ID      string `json:"id,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Key         int32                  `json:"Key"`
+		CreatedTime time.Time              `json:"CreatedTime"`
+		UserName    string                 `json:"UserName"`
+		Vm          *types.VmEventArgument `json:"Vm,omitempty"`
+		Info        *struct {
+			DescriptionId string `json:"DescriptionId"`
+		} `json:"Info,omitempty"`
+		ConfigSpec map[string]json.RawMessage `json:"ConfigSpec,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// otherTask reports whether event is the TaskEvent of another task than
+// marking a VM as template.
+func (event *incoming) otherTask() bool {
+	return event.Subject == subjectTask && (event.Data.Info == nil || event.Data.Info.DescriptionId != markAsTemplateTask)
+}
+
+// report describes the change of a template and the actions taken.
+type report struct {
+	Event    string `json:"event"`
+	Template string `json:"template,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Change   string `json:"change,omitempty"`
+	// Settings are the settings changed by a reconfiguration.
+	Settings  []string `json:"settings,omitempty"`
+	User      string   `json:"user,omitempty"`
+	Version   int      `json:"version,omitempty"`
+	Pipelines []string `json:"pipelines,omitempty"`
+	Skipped   string   `json:"skipped,omitempty"`
+	Actions   []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Tasks other than marking as template are skipped before connecting.
+	if event.otherTask() {
+		return reportResponse(&report{Event: event.Subject, Skipped: "not a mark as template task"}, nil)
+	}
+
+	rep := report{
+		Event:    event.Subject,
+		Template: event.Data.Vm.Vm.Value,
+		Name:     event.Data.Vm.Name,
+		User:     event.Data.UserName,
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	return reportResponse(&rep, update(ctx, clt, cfg, &rep, event))
+}
+
+// reportResponse returns rep as JSON, with status 500 if an action failed
+// with actionErr.
+func reportResponse(rep *report, actionErr error) (handler.Response, error) {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("handling of template change failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// category returns the tag category of the version tags.
+func (cfg *vcConfig) category() string {
+	if cfg.Template.Category == "" {
+		return defaultCategory
+	}
+
+	return cfg.Template.Category
+}
+
+// attribute returns the custom attribute recording changes or "" if changes
+// are not recorded.
+func (cfg *vcConfig) attribute() string {
+	switch cfg.Template.Attribute {
+	case "":
+		return defaultAttribute
+	case "-":
+		return ""
+	}
+
+	return cfg.Template.Attribute
+}
+
+// watched reports whether the template name is watched.
+func (cfg *vcConfig) watched(name string) bool {
+	return len(cfg.Template.Templates) == 0 || matches(cfg.Template.Templates, name)
+}
+
+// matches reports whether name matches one of patterns. Patterns are
+// validated with the config.
+func matches(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	patterns := cfg.Template.Templates
+	for i, p := range cfg.Pipelines {
+		if p.Name == "" {
+			return fmt.Errorf("required field(s) missing, including name of pipeline %d", i+1)
+		}
+		if len(p.Templates) == 0 {
+			return fmt.Errorf("required field(s) missing, including templates of pipeline %v", p.Name)
+		}
+		patterns = append(patterns, p.Templates...)
+	}
+
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid template pattern %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a task or reconfiguration event. Events of VMs must
+// name the VM, events of other tasks are returned as is to be skipped.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if event.Subject != subjectTask && event.Subject != subjectReconfigured {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.otherTask() {
+		return &event, nil
+	}
+
+	if event.Data.Vm == nil || event.Data.Vm.Vm.Value == "" {
+		return nil, errors.New("empty virtual machine")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
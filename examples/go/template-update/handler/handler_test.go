@@ -0,0 +1,406 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	want := vcConfig{}
+	want.VCenter.Server = "veba.local.corp"
+	want.VCenter.User = "admin@vsphere.local"
+	want.VCenter.Password = "password1234"
+	want.Template.Templates = []string{"centos*", "ubuntu*"}
+	want.Pipelines = []pipeline{{
+		Name:       "linux-images",
+		Templates:  []string{"centos*"},
+		Owners:     []string{"image-team@example.com"},
+		WebhookURL: "https://ci.local.corp/hooks/linux-images",
+	}}
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with templates and pipelines loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&want,
+		},
+		{
+			"Test that toml file missing vCenter password results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that an invalid template pattern results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the template of mark as template tasks and
+// reconfigurations is read, other tasks are passed on to be skipped and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that the VM marked as template is read", "testdata/event.json", false, "vm-61"},
+		{"Test that the reconfigured VM is read", "testdata/event2.json", false, "vm-61"},
+		{"Test that other tasks are read to be skipped", "testdata/event3.json", false, "other task"},
+		{"Event should return error if VM is empty", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is no task or reconfiguration", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := "other task"
+		if !event.otherTask() {
+			got = event.Data.Vm.Vm.Value
+		}
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestChangedSettings ensures only the settings set by a reconfiguration are
+// reported.
+func TestChangedSettings(t *testing.T) {
+	body, err := os.ReadFile("testdata/event2.json")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+	event, err := parseEvent(body)
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	t.Log("=========== Test that unset settings and the change version are ignored ===========")
+	want := []string{"cpuHotAddEnabled", "deviceChange", "memoryMB", "numCPUs"}
+	if got := changedSettings(event.Data.ConfigSpec); reflect.DeepEqual(got, want) {
+		t.Logf("got expected: %v. %v", got, passMark)
+	} else {
+		t.Logf("expected: %v, got: %v. %v", want, got, failMark)
+		t.Fail()
+	}
+}
+
+// TestTagVersion ensures the version is read from tags named like versions.
+func TestTagVersion(t *testing.T) {
+	var tests = []struct {
+		testDesc string
+		names    []string
+		want     int
+	}{
+		{"Test that templates without version tag have version 0", nil, 0},
+		{"Test that the version is read from the tag", []string{"v3"}, 3},
+		{"Test that the highest version wins", []string{"v2", "v10"}, 10},
+		{"Test that tags not named like versions are ignored", []string{"golden", "3", "v"}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		var attached []tags.Tag
+		for _, n := range tc.names {
+			attached = append(attached, tags.Tag{Name: n})
+		}
+
+		if got := tagVersion(attached); got == tc.want {
+			t.Logf("got expected: %d. %v", got, passMark)
+		} else {
+			t.Logf("expected: %d, got: %d. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestPipelinesFor ensures the pipelines of a template are found by the name
+// patterns of their templates.
+func TestPipelinesFor(t *testing.T) {
+	var cfg vcConfig
+	cfg.Pipelines = []pipeline{
+		{Name: "linux-images", Templates: []string{"centos*", "ubuntu*"}},
+		{Name: "k8s-nodes", Templates: []string{"ubuntu22-*"}},
+	}
+
+	var tests = []struct {
+		testDesc string
+		template string
+		want     string
+	}{
+		{"Test that a template of one pipeline is found", "centos7-base", "linux-images"},
+		{"Test that a template of two pipelines is found in both", "ubuntu22-base", "linux-images,k8s-nodes"},
+		{"Test that a template of no pipeline has none", "win2019-base", ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		var names []string
+		for _, p := range cfg.pipelinesFor(tc.template) {
+			names = append(names, p.Name)
+		}
+
+		if got := strings.Join(names, ","); got == tc.want {
+			t.Logf("got expected: %q. %v", got, passMark)
+		} else {
+			t.Logf("expected: %q, got: %q. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestUpdate shows the changes of a template are recorded, bump its version
+// tag and notify its pipeline, a redelivered event does not bump again and
+// VMs which are no template are skipped.
+func TestUpdate(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		template, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM1")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		// Only powered off VMs can be marked as template.
+		task, err := template.PowerOff(ctx)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := template.MarkAsTemplate(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		var mu sync.Mutex
+		var posted []message
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var msg message
+			json.NewDecoder(r.Body).Decode(&msg)
+			mu.Lock()
+			posted = append(posted, msg)
+			mu.Unlock()
+		}))
+		defer srv.Close()
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Pipelines = []pipeline{{Name: "linux-images", Templates: []string{"DC0_H0_*"}, Owners: []string{"image-team@example.com"}, WebhookURL: srv.URL}}
+
+		event := func(subject string, key int32, ref types.ManagedObjectReference) *incoming {
+			var e incoming
+			e.ID = "event-" + strconv.Itoa(int(key))
+			e.Subject = subject
+			e.Data.Key = key
+			e.Data.UserName = "image-admin"
+			e.Data.Vm = &types.VmEventArgument{Vm: ref}
+			if subject == subjectReconfigured {
+				e.Data.ConfigSpec = map[string]json.RawMessage{"NumCPUs": json.RawMessage("4")}
+			}
+			return &e
+		}
+
+		var tests = []struct {
+			testDesc    string
+			event       *incoming
+			wantVersion int
+			wantActions string
+			wantSkipped string
+			wantPosted  int
+		}{
+			{"Test that marking as template records version 1", event(subjectTask, 1, template.Reference()), 1, "recorded,tagged v1,notified pipeline linux-images", "", 1},
+			{"Test that a redelivered event does not bump the version", event(subjectTask, 1, template.Reference()), 1, "already recorded,notified pipeline linux-images", "", 2},
+			{"Test that a reconfiguration bumps the version", event(subjectReconfigured, 2, template.Reference()), 2, "recorded,tagged v2,notified pipeline linux-images", "", 3},
+			{"Test that VMs which are no template are skipped", event(subjectReconfigured, 3, vm.Reference()), 0, "", "not a template", 3},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			rep := report{Event: tc.event.Subject, Template: tc.event.Data.Vm.Vm.Value, User: tc.event.Data.UserName}
+			err := update(ctx, clt, &cfg, &rep, tc.event)
+
+			mu.Lock()
+			n := len(posted)
+			mu.Unlock()
+
+			if err == nil && rep.Version == tc.wantVersion && strings.Join(rep.Actions, ",") == tc.wantActions &&
+				rep.Skipped == tc.wantSkipped && n == tc.wantPosted {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected: version %d, actions %q, skipped %q, %d posted, got: %+v, %d posted (%v). %v",
+					tc.wantVersion, tc.wantActions, tc.wantSkipped, tc.wantPosted, rep, n, err, failMark)
+				t.Fail()
+			}
+		}
+
+		t.Log("=========== Test that only the tag of the latest version is attached ===========")
+		categoryID, err := clt.categoryID(ctx, defaultCategory)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		attached, err := clt.attachedTags(ctx, template.Reference(), categoryID)
+		if err == nil && len(attached) == 1 && attached[0].Name == "v2" {
+			t.Logf("got expected: v2. %v", passMark)
+		} else {
+			t.Logf("expected v2, got: %+v (%v). %v", attached, err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a created version tag records the event and the version it follows ===========")
+		if len(attached) != 1 {
+			t.Fatalf("expected one version tag, got: %+v. %v", attached, failMark)
+		}
+		var rec auditRecord
+		err = json.Unmarshal([]byte(attached[0].Description), &rec)
+		if err == nil && rec.Version == auditVersion && rec.Value == "v2" && rec.Previous == "v1" && rec.EventID == "event-2" && !rec.Time.IsZero() {
+			t.Logf("got expected audit record: %+v. %v", rec, passMark)
+		} else {
+			t.Logf("expected audit record of v2 following v1 by event-2, got: %q (%v). %v", attached[0].Description, err, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that the pipeline is asked to rebuild ===========")
+		mu.Lock()
+		last := posted[len(posted)-1]
+		mu.Unlock()
+		if last.Fields["pipeline"] == "linux-images" && last.Fields["owners"] == "image-team@example.com" &&
+			last.Fields["version"] == "v2" && last.Fields["settings"] == "numCPUs" {
+			t.Logf("got expected: %v. %v", last.Text, passMark)
+		} else {
+			t.Logf("expected the v2 change for linux-images, got: %+v. %v", last, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
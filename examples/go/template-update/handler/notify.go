@@ -0,0 +1,165 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// pipelinesFor returns the pipelines built from the template name.
+func (cfg *vcConfig) pipelinesFor(name string) []pipeline {
+	var out []pipeline
+	for _, p := range cfg.Pipelines {
+		if matches(p.Templates, name) {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+// changeMessage returns the notification of the change of rep, asking the
+// owners of pipelines to rebuild their automation.
+func changeMessage(rep *report, pipelines []pipeline) message {
+	msg := message{
+		Title: "Template updated",
+		Text:  describe(rep),
+		Fields: map[string]string{
+			"template": rep.Template,
+			"version":  versionName(rep.Version),
+			"change":   rep.Change,
+		},
+		Time: time.Now().UTC(),
+	}
+	if rep.User != "" {
+		msg.Fields["user"] = rep.User
+	}
+	if len(rep.Settings) > 0 {
+		msg.Fields["settings"] = strings.Join(rep.Settings, ", ")
+	}
+
+	var owners []string
+	seen := map[string]bool{}
+	for _, p := range pipelines {
+		for _, o := range p.Owners {
+			if !seen[o] {
+				seen[o] = true
+				owners = append(owners, o)
+			}
+		}
+	}
+	sort.Strings(owners)
+	if len(owners) > 0 {
+		msg.Fields["owners"] = strings.Join(owners, ", ")
+		msg.Text += "; rebuild the dependent images and automation"
+	}
+
+	return msg
+}
+
+// notifyOwners posts the change of rep to the configured sinks, naming the
+// owners of the pipelines built from the template, and to the webhook of each
+// of these pipelines. The pipelines are added to rep.
+func notifyOwners(ctx context.Context, cfg *vcConfig, rep *report) error {
+	pipelines := cfg.pipelinesFor(rep.Name)
+	msg := changeMessage(rep, pipelines)
+
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, msg); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	for _, p := range pipelines {
+		rep.Pipelines = append(rep.Pipelines, p.Name)
+		if p.WebhookURL == "" {
+			continue
+		}
+
+		pmsg := msg
+		pmsg.Fields = map[string]string{"pipeline": p.Name}
+		for k, v := range msg.Fields {
+			pmsg.Fields[k] = v
+		}
+		if err := post(ctx, p.WebhookURL, pmsg); err != nil {
+			errs = append(errs, fmt.Errorf("notifying pipeline %v failed: %w", p.Name, err))
+			continue
+		}
+		rep.Actions = append(rep.Actions, "notified pipeline "+p.Name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
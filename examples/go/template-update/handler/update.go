@@ -0,0 +1,201 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// record is the last change of a template, as recorded in its custom
+// attribute. Event is the key of the vCenter event, so redelivered events
+// are recognized.
+type record struct {
+	Event   int32     `json:"event"`
+	Version int       `json:"version"`
+	Change  string    `json:"change"`
+	User    string    `json:"user,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// update records the change of the template of event, bumps its version tag
+// and notifies the owners of the pipelines built from it. Completed actions
+// are added to rep, the joined errors of failed actions are returned. VMs
+// which are no template and templates not watched are skipped.
+func update(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, event *incoming) error {
+	ref := event.Data.Vm.Vm
+	info, err := clt.templateInfo(ctx, ref, cfg.attribute())
+	if err != nil {
+		return err
+	}
+	rep.Name = info.Name
+
+	switch {
+	case !info.Template:
+		rep.Skipped = "not a template"
+		return nil
+	case !cfg.watched(info.Name):
+		rep.Skipped = "template not watched"
+		return nil
+	}
+
+	rep.Change = changeMarked
+	if event.Subject == subjectReconfigured {
+		rep.Change = changeReconfigured
+		rep.Settings = changedSettings(event.Data.ConfigSpec)
+	}
+
+	categoryID, err := clt.categoryID(ctx, cfg.category())
+	if err != nil {
+		return err
+	}
+	attached, err := clt.attachedTags(ctx, ref, categoryID)
+	if err != nil {
+		return err
+	}
+
+	// The recorded version is the source of truth, the tag follows it. A
+	// redelivered event finishes its update without bumping again.
+	redelivered := info.Recorded != nil && info.Recorded.Event == event.Data.Key
+	if redelivered {
+		rep.Version = info.Recorded.Version
+		rep.Actions = append(rep.Actions, "already recorded")
+	} else {
+		current := tagVersion(attached)
+		if info.Recorded != nil {
+			current = max(current, info.Recorded.Version)
+		}
+		rep.Version = current + 1
+
+		if field := cfg.attribute(); field != "" {
+			r := record{Event: event.Data.Key, Version: rep.Version, Change: rep.Change, User: rep.User, Time: event.Data.CreatedTime}
+			if err := clt.setRecord(ctx, ref, field, r); err != nil {
+				return err
+			}
+			rep.Actions = append(rep.Actions, "recorded")
+		}
+	}
+
+	var errs []error
+
+	changed, err := setVersion(ctx, clt, ref, categoryID, attached, rep.Version, event.ID)
+	if err != nil {
+		errs = append(errs, err)
+	} else if changed {
+		rep.Actions = append(rep.Actions, "tagged "+versionName(rep.Version))
+	}
+
+	errs = append(errs, notifyOwners(ctx, cfg, rep))
+
+	return errors.Join(errs...)
+}
+
+// setVersion attaches the version tag of version to the template ref and
+// detaches its other tags of the category, as the category allows one tag
+// per template. A created tag records the event eventID and the version it
+// follows. It reports whether the tags changed.
+func setVersion(ctx context.Context, clt *vsClient, ref types.ManagedObjectReference, categoryID string, attached []tags.Tag, version int, eventID string) (bool, error) {
+	name := versionName(version)
+
+	changed := false
+	for _, t := range attached {
+		if t.Name == name {
+			continue
+		}
+		if err := clt.untag(ctx, ref, t.ID); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	for _, t := range attached {
+		if t.Name == name {
+			return changed, nil
+		}
+	}
+
+	var previous string
+	if version > 1 {
+		previous = versionName(version - 1)
+	}
+
+	tagID, err := clt.tagID(ctx, categoryID, name, auditDescription(name, previous, eventID))
+	if err != nil {
+		return changed, err
+	}
+	if err := clt.tag(ctx, ref, tagID); err != nil {
+		return changed, err
+	}
+
+	return true, nil
+}
+
+// versionName returns the name of the tag of version, e.g. v3.
+func versionName(version int) string {
+	return "v" + strconv.Itoa(version)
+}
+
+// tagVersion returns the highest version of the version tags, 0 without
+// version tag. Tags not named like versionName are ignored.
+func tagVersion(attached []tags.Tag) int {
+	version := 0
+	for _, t := range attached {
+		n, err := strconv.Atoi(strings.TrimPrefix(t.Name, "v"))
+		if err != nil || !strings.HasPrefix(t.Name, "v") {
+			continue
+		}
+		version = max(version, n)
+	}
+
+	return version
+}
+
+// changedSettings returns the sorted names of the settings set in the config
+// spec of a reconfiguration, with the first letter in lower case as in the
+// vSphere API, e.g. numCPUs and deviceChange. The change version, which every
+// spec of vCenter carries, is no setting.
+func changedSettings(spec map[string]json.RawMessage) []string {
+	var out []string
+	for k, v := range spec {
+		v = bytes.TrimSpace(v)
+		if k == "ChangeVersion" || len(v) == 0 || emptyJSON[string(v)] {
+			continue
+		}
+		out = append(out, strings.ToLower(k[:1])+k[1:])
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// emptyJSON are the encodings of unset values of a config spec. Booleans of
+// config specs are pointers, so false is a change.
+var emptyJSON = map[string]bool{
+	"null": true,
+	`""`:   true,
+	"0":    true,
+	"[]":   true,
+	"{}":   true,
+}
+
+// describe returns the change of rep for people, e.g. "centos7-base
+// reconfigured by admin (numCPUs, memoryMB), now v3".
+func describe(rep *report) string {
+	text := fmt.Sprintf("%v %v", rep.Name, rep.Change)
+	if rep.User != "" {
+		text += " by " + rep.User
+	}
+	if len(rep.Settings) > 0 {
+		text += " (" + strings.Join(rep.Settings, ", ") + ")"
+	}
+
+	return text + ", now " + versionName(rep.Version)
+}
@@ -0,0 +1,181 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// datastoreSpace holds the space of a datastore and the VMs placed on it.
+type datastoreSpace struct {
+	Name          string
+	Accessible    bool
+	CapacityBytes int64
+	FreeBytes     int64
+	VMs           []types.ManagedObjectReference
+}
+
+// datastoreSpace retrieves the capacity and free space of a datastore and its
+// VMs.
+func (clt *vsClient) datastoreSpace(ctx context.Context, ref types.ManagedObjectReference) (*datastoreSpace, error) {
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var ds mo.Datastore
+	err := pc.RetrieveOne(ctx, ref, []string{"summary", "vm"}, &ds)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve space of datastore %v failed: %w", ref.Value, err)
+	}
+
+	return &datastoreSpace{
+		Name:          ds.Summary.Name,
+		Accessible:    ds.Summary.Accessible,
+		CapacityBytes: ds.Summary.Capacity,
+		FreeBytes:     ds.Summary.FreeSpace,
+		VMs:           ds.Vm,
+	}, nil
+}
+
+// thinDisks retrieves the inflation of the thin disks of vms on ds.
+func (clt *vsClient) thinDisks(ctx context.Context, ds types.ManagedObjectReference, vms []types.ManagedObjectReference) ([]inflation, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+
+	var content []mo.VirtualMachine
+	err := property.DefaultCollector(clt.govmomi.Client).Retrieve(ctx, vms, []string{"name", "config.hardware.device", "layoutEx"}, &content)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve disks of the VMs of datastore %v failed: %w", ds.Value, err)
+	}
+
+	usage := make([]inflation, 0, len(content))
+	for _, vm := range content {
+		usage = append(usage, thinUsage(vm, ds))
+	}
+
+	return usage, nil
+}
+
+// datastores lists all datastores.
+func (clt *vsClient) datastores(ctx context.Context) ([]types.ManagedObjectReference, error) {
+	c := clt.govmomi.Client
+
+	v, err := view.NewManager(c).CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"Datastore"}, true)
+	if err != nil {
+		return nil, fmt.Errorf("list datastores failed: %w", err)
+	}
+	defer v.Destroy(ctx)
+
+	refs, err := v.Find(ctx, []string{"Datastore"}, property.Filter{})
+	if err != nil {
+		return nil, fmt.Errorf("list datastores failed: %w", err)
+	}
+
+	return refs, nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
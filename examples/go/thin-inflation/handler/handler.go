@@ -0,0 +1,394 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents check their datastore if no events are configured.
+var defaultEvents = []string{"AlarmStatusChangedEvent", "DatastoreCapacityIncreasedEvent"}
+
+// defaultMaxRatio tolerates thin disks growing by up to the free space of
+// their datastore if max_ratio is not configured.
+const defaultMaxRatio = 1.0
+
+// defaultTop is the number of VMs listed as offenders if top is not
+// configured.
+const defaultTop = 5
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Inflation struct {
+		// Events check their datastore, e.g. the datastore of an alarm,
+		// by default defaultEvents.
+		Events []string
+		// IntervalSeconds checks all datastores periodically, 0 disables
+		// the periodic check.
+		IntervalSeconds int `toml:"interval_seconds"`
+		// MaxRatio is the highest tolerated ratio of the space thin disks
+		// may still grow by to the free space of their datastore, by
+		// default defaultMaxRatio.
+		MaxRatio float64 `toml:"max_ratio"`
+		// TagURN is attached to datastores exceeding MaxRatio and detached
+		// once they no longer do.
+		TagURN string `toml:"tag_urn"`
+		// Top limits the VMs listed as offenders, by default defaultTop.
+		Top int
+	}
+	Notify struct {
+		// Datastores exceeding max_ratio are posted to the configured
+		// sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Datastore *types.DatastoreEventArgument     `json:"Datastore,omitempty"`
+		Ds        *types.DatastoreEventArgument     `json:"Ds,omitempty"`
+		Entity    *types.ManagedEntityEventArgument `json:"Entity,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// datastore returns the datastore of the event, nil if it has none.
+func (e *incoming) datastore() *types.ManagedObjectReference {
+	// Datastore events name their datastore as Datastore, other events
+	// as Ds.
+	for _, ds := range []*types.DatastoreEventArgument{e.Data.Datastore, e.Data.Ds} {
+		if ds != nil && ds.Datastore.Value != "" {
+			return &ds.Datastore
+		}
+	}
+
+	// Alarms of datastores name them as entity only.
+	if en := e.Data.Entity; en != nil && en.Entity.Type == "Datastore" && en.Entity.Value != "" {
+		return &en.Entity
+	}
+
+	return nil
+}
+
+// report describes the space thin disks of a datastore may still grow by,
+// the VMs contributing most to it and the actions taken.
+type report struct {
+	Event            string      `json:"event,omitempty"`
+	Datastore        string      `json:"datastore"`
+	Name             string      `json:"name,omitempty"`
+	CapacityBytes    int64       `json:"capacity_bytes"`
+	FreeBytes        int64       `json:"free_bytes"`
+	ProvisionedBytes int64       `json:"provisioned_bytes"`
+	CommittedBytes   int64       `json:"committed_bytes"`
+	InflationBytes   int64       `json:"inflation_bytes"`
+	Ratio            float64     `json:"ratio"`
+	MaxRatio         float64     `json:"max_ratio"`
+	Exceeded         bool        `json:"exceeded"`
+	VMs              []inflation `json:"vms,omitempty"`
+	Skipped          string      `json:"skipped,omitempty"`
+	Actions          []string    `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+	scanOnce sync.Once  // For scanPeriodically() to be started once.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	scanOnce.Do(func() {
+		go scanPeriodically(context.Background(), cfgPath)
+	})
+
+	ds := event.datastore()
+	rep := report{
+		Event:     event.Subject,
+		Datastore: ds.Value,
+	}
+
+	actionErr := check(ctx, clt, cfg, &rep, *ds)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("checking of thin disk inflation failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether event checks its datastore.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Inflation.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxRatio returns the highest tolerated ratio of inflation to free space.
+func (cfg *vcConfig) maxRatio() float64 {
+	if cfg.Inflation.MaxRatio > 0 {
+		return cfg.Inflation.MaxRatio
+	}
+
+	return defaultMaxRatio
+}
+
+// top returns the number of VMs listed as offenders.
+func (cfg *vcConfig) top() int {
+	if cfg.Inflation.Top > 0 {
+		return cfg.Inflation.Top
+	}
+
+	return defaultTop
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// An exceeded datastore nobody learns about is not worth checking.
+	if cfg.Inflation.TagURN == "" && cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return errors.New("required field(s) missing, including inflation tag_urn or a notify sink")
+	}
+
+	i := cfg.Inflation
+	if i.IntervalSeconds < 0 || i.MaxRatio < 0 || i.Top < 0 {
+		return errors.New("inflation interval_seconds, max_ratio and top must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event of a datastore.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.datastore() == nil {
+		return nil, errors.New("empty datastore")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
@@ -0,0 +1,379 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+const gibibyte = 1 << 30
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Inflation.Events = []string{"AlarmStatusChangedEvent", "DatastoreCapacityIncreasedEvent"}
+	tagged.Inflation.IntervalSeconds = 3600
+	tagged.Inflation.MaxRatio = 0.8
+	tagged.Inflation.TagURN = "urn:vmomi:InventoryServiceTag:7a2c5e91-4b3d-4f68-9e1a-0c6d8b2f4e73:GLOBAL"
+	tagged.Inflation.Top = 3
+	tagged.Notify.SlackWebhookURL = "https://hooks.slack.com/services/storage"
+
+	notified := vcConfig{}
+	notified.VCenter = tagged.VCenter
+	notified.VCenter.Insecure = true
+	notified.Notify.WebhookURL = "https://hooks.local.corp/inflation"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with a tag and an interval loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file with only a webhook loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&notified,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without tag or sinks results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with a negative max_ratio results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures configured events of a datastore are read and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that alarm of a datastore is readable", "testdata/event.json", false, "datastore-15"},
+		{"Test that datastore event is readable", "testdata/event2.json", false, "datastore-15"},
+		{"Event should return error if it has no datastore", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.datastore().Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// thinDisk adds a disk of provisioned bytes with a file of committed bytes on
+// ds to vm.
+func thinDisk(vm *mo.VirtualMachine, ds types.ManagedObjectReference, key int32, thin bool, provisioned, committed int64) {
+	if vm.Config == nil {
+		vm.Config = &types.VirtualMachineConfigInfo{}
+	}
+	if vm.LayoutEx == nil {
+		vm.LayoutEx = &types.VirtualMachineFileLayoutEx{}
+	}
+
+	vm.Config.Hardware.Device = append(vm.Config.Hardware.Device, &types.VirtualDisk{
+		VirtualDevice: types.VirtualDevice{
+			Key: key,
+			Backing: &types.VirtualDiskFlatVer2BackingInfo{
+				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{Datastore: &ds},
+				ThinProvisioned:              types.NewBool(thin),
+			},
+		},
+		CapacityInBytes: provisioned,
+	})
+
+	file := key * 10
+	vm.LayoutEx.File = append(vm.LayoutEx.File, types.VirtualMachineFileLayoutExFileInfo{Key: file, Size: committed})
+	vm.LayoutEx.Disk = append(vm.LayoutEx.Disk, types.VirtualMachineFileLayoutExDiskLayout{
+		Key:   key,
+		Chain: []types.VirtualMachineFileLayoutExDiskUnit{{FileKey: []int32{file}}},
+	})
+}
+
+// TestThinUsage shows only thin disks on the datastore count and disks may
+// grow by their provisioned size less their committed size.
+func TestThinUsage(t *testing.T) {
+	ds := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-15"}
+	other := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-16"}
+
+	vm := func(disks func(vm *mo.VirtualMachine)) mo.VirtualMachine {
+		var v mo.VirtualMachine
+		v.Name = "web-01"
+		v.Self = types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-57"}
+		if disks != nil {
+			disks(&v)
+		}
+		return v
+	}
+
+	var tests = []struct {
+		testDesc  string
+		vm        mo.VirtualMachine
+		wantDisks int
+		wantBytes int64
+	}{
+		{"Test that a VM without config has no thin disks", vm(nil), 0, 0},
+		{"Test that a thin disk may grow by its uncommitted size", vm(func(v *mo.VirtualMachine) { thinDisk(v, ds, 2000, true, 100*gibibyte, 30*gibibyte) }), 1, 70 * gibibyte},
+		{"Test that thin disks add up", vm(func(v *mo.VirtualMachine) {
+			thinDisk(v, ds, 2000, true, 100*gibibyte, 30*gibibyte)
+			thinDisk(v, ds, 2001, true, 50*gibibyte, 40*gibibyte)
+		}), 2, 80 * gibibyte},
+		{"Test that thick disks are ignored", vm(func(v *mo.VirtualMachine) { thinDisk(v, ds, 2000, false, 100*gibibyte, 100*gibibyte) }), 0, 0},
+		{"Test that disks on other datastores are ignored", vm(func(v *mo.VirtualMachine) { thinDisk(v, other, 2000, true, 100*gibibyte, 1*gibibyte) }), 0, 0},
+		{"Test that disks committing more than provisioned do not shrink", vm(func(v *mo.VirtualMachine) { thinDisk(v, ds, 2000, true, 10*gibibyte, 12*gibibyte) }), 1, 0},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		got := thinUsage(tc.vm, ds)
+		if got.Disks == tc.wantDisks && got.InflationBytes == tc.wantBytes {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected %d disks growing by %d, got: %+v. %v", tc.wantDisks, tc.wantBytes, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestCheck ensures datastores whose thin disks may grow by more than their
+// free space are tagged and posted once with their top offenders and
+// untagged once the disks fit.
+func TestCheck(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		posts = append(posts, string(b))
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "storage", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "thin-inflation", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		finder := find.NewFinder(c)
+		ds, err := finder.Datastore(ctx, "LocalDS_0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		vm, err := finder.VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Inflation.TagURN = tagID
+		cfg.Notify.WebhookURL = srv.URL
+
+		sd := simulator.Map.Get(ds.Reference()).(*simulator.Datastore)
+		free := func(bytes int64) func() {
+			return func() {
+				sd.Summary.Capacity = 1024 * gibibyte
+				sd.Summary.FreeSpace = bytes
+			}
+		}
+		grow := func() {
+			free(100 * gibibyte)()
+			sv := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine)
+			thinDisk(&sv.VirtualMachine, ds.Reference(), 2100, true, 500*gibibyte, 20*gibibyte)
+		}
+
+		var tests = []struct {
+			testDesc     string
+			setup        func()
+			wantExceeded bool
+			wantActions  string
+			wantPosts    int
+		}{
+			{"Test that a datastore with enough free space is not tagged", free(1000 * gibibyte), false, "", 0},
+			{"Test that a datastore whose thin disks may outgrow it is tagged and posted", grow, true, "tagged,notified", 1},
+			{"Test that a tagged datastore is not posted again", nil, true, "already tagged", 1},
+			{"Test that a datastore with enough free space again is untagged", free(1000 * gibibyte), false, "untagged", 1},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			rep := report{Datastore: ds.Reference().Value}
+			if err := check(ctx, clt, &cfg, &rep, ds.Reference()); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if rep.Exceeded == tc.wantExceeded && got == tc.wantActions && len(posts) == tc.wantPosts {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected exceeded %v, actions %q and %d posts, got: %+v, %d posts. %v", tc.wantExceeded, tc.wantActions, tc.wantPosts, rep, len(posts), failMark)
+				t.Fail()
+			}
+		}
+
+		// The post lists the VM of the growing disk.
+		if len(posts) > 0 && strings.Contains(posts[0], "vm DC0_H0_VM0") && strings.Contains(posts[0], "may grow by 480 GiB") {
+			t.Logf("got expected offender: %v. %v", posts[0], passMark)
+		} else {
+			t.Logf("expected offender DC0_H0_VM0, got: %v. %v", posts, failMark)
+			t.Fail()
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
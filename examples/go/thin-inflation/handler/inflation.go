@@ -0,0 +1,247 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// scanPollInterval is the time between checks whether the periodic check was
+// enabled in vcconfig.toml.
+const scanPollInterval = time.Minute
+
+// inflation is the space the thin disks of a VM on a datastore may still
+// grow by.
+type inflation struct {
+	VM               string `json:"vm"`
+	Name             string `json:"name"`
+	Disks            int    `json:"disks"`
+	ProvisionedBytes int64  `json:"provisioned_bytes"`
+	CommittedBytes   int64  `json:"committed_bytes"`
+	InflationBytes   int64  `json:"inflation_bytes"`
+}
+
+// thinUsage returns the thin disks of vm on ds, their provisioned size and
+// the size of their files. Disks with snapshots count the files of the whole
+// chain, so their inflation may be underestimated. VMs without thin disks on
+// ds have no Disks.
+func thinUsage(vm mo.VirtualMachine, ds types.ManagedObjectReference) inflation {
+	u := inflation{VM: vm.Self.Value, Name: vm.Name}
+
+	// Inaccessible VMs have no config.
+	if vm.Config == nil {
+		return u
+	}
+
+	sizes := map[int32]int64{}
+	chains := map[int32][]int32{}
+	if vm.LayoutEx != nil {
+		for _, f := range vm.LayoutEx.File {
+			sizes[f.Key] = f.Size
+		}
+		for _, d := range vm.LayoutEx.Disk {
+			for _, c := range d.Chain {
+				chains[d.Key] = append(chains[d.Key], c.FileKey...)
+			}
+		}
+	}
+
+	for _, dev := range vm.Config.Hardware.Device {
+		disk, ok := dev.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+
+		b, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if !ok || b.ThinProvisioned == nil || !*b.ThinProvisioned || b.Datastore == nil || *b.Datastore != ds {
+			continue
+		}
+
+		provisioned := disk.CapacityInBytes
+		if provisioned == 0 {
+			provisioned = disk.CapacityInKB * 1024
+		}
+
+		var committed int64
+		for _, key := range chains[disk.Key] {
+			committed += sizes[key]
+		}
+
+		u.Disks++
+		u.ProvisionedBytes += provisioned
+		u.CommittedBytes += committed
+		if provisioned > committed {
+			u.InflationBytes += provisioned - committed
+		}
+	}
+
+	return u
+}
+
+// assess adds the inflation of vms to rep and determines whether it exceeds
+// maxRatio of the free space. The top VMs by inflation are listed.
+func assess(rep *report, vms []inflation, maxRatio float64, top int) {
+	var offenders []inflation
+	for _, v := range vms {
+		if v.Disks == 0 {
+			continue
+		}
+
+		rep.ProvisionedBytes += v.ProvisionedBytes
+		rep.CommittedBytes += v.CommittedBytes
+		rep.InflationBytes += v.InflationBytes
+
+		if v.InflationBytes > 0 {
+			offenders = append(offenders, v)
+		}
+	}
+
+	rep.MaxRatio = maxRatio
+	if rep.FreeBytes > 0 {
+		rep.Ratio = math.Round(float64(rep.InflationBytes)/float64(rep.FreeBytes)*1000) / 1000
+	}
+	rep.Exceeded = float64(rep.InflationBytes) > float64(rep.FreeBytes)*maxRatio
+
+	sort.SliceStable(offenders, func(i, j int) bool {
+		return offenders[i].InflationBytes > offenders[j].InflationBytes
+	})
+	if len(offenders) > top {
+		offenders = offenders[:top]
+	}
+	rep.VMs = offenders
+}
+
+// check assesses the thin disks of ds. Exceeding datastores are tagged and
+// posted with their top offending VMs, datastores no longer exceeding are
+// untagged. Completed actions are added to rep.
+func check(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, ds types.ManagedObjectReference) error {
+	space, err := clt.datastoreSpace(ctx, ds)
+	if err != nil {
+		return err
+	}
+	rep.Name = space.Name
+	rep.CapacityBytes = space.CapacityBytes
+	rep.FreeBytes = space.FreeBytes
+
+	// The space of inaccessible datastores is not current.
+	if !space.Accessible {
+		rep.Skipped = "datastore not accessible"
+		return nil
+	}
+
+	vms, err := clt.thinDisks(ctx, ds, space.VMs)
+	if err != nil {
+		return err
+	}
+	assess(rep, vms, cfg.maxRatio(), cfg.top())
+
+	if !rep.Exceeded {
+		return release(ctx, clt, cfg, rep, ds)
+	}
+
+	// The tag marks datastores already reported, so each datastore is only
+	// posted once until its inflation fits again.
+	if cfg.Inflation.TagURN != "" {
+		tagged, err := clt.tagged(ctx, ds, cfg.Inflation.TagURN)
+		if err != nil {
+			return err
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return nil
+		}
+
+		if err := clt.tag(ctx, ds, cfg.Inflation.TagURN); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "tagged")
+	}
+
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" {
+		return nil
+	}
+
+	if err := notify(ctx, cfg, inflationMessage(rep)); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "notified")
+
+	return nil
+}
+
+// release detaches the tag of exceeding datastores from ds, if attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, ds types.ManagedObjectReference) error {
+	if cfg.Inflation.TagURN == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, ds, cfg.Inflation.TagURN)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, ds, cfg.Inflation.TagURN); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+// scanPeriodically checks all datastores every [inflation] interval_seconds
+// until ctx is done. The config is reloaded before every run, so enabling,
+// disabling or changing the interval does not require a restart.
+func scanPeriodically(ctx context.Context, path string) {
+	for {
+		interval := scanPollInterval
+
+		cfg, err := loadTomlCfg(path)
+		if err == nil && cfg.Inflation.IntervalSeconds > 0 {
+			interval = time.Duration(cfg.Inflation.IntervalSeconds) * time.Second
+
+			if err := scan(ctx, cfg); err != nil {
+				slog.Error("periodic check of datastores failed", "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scan checks all datastores and logs their reports. A failing datastore does
+// not stop the check of the others.
+func scan(ctx context.Context, cfg *vcConfig) error {
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	refs, err := clt.datastores(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range refs {
+		rep := report{Datastore: ds.Value}
+		err := check(ctx, clt, cfg, &rep, ds)
+
+		body, _ := json.Marshal(rep)
+		if err != nil {
+			slog.Error("datastore check failed", "report", string(body), "err", err)
+			continue
+		}
+		slog.Info("datastore checked", "report", string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// inflationMessage returns the notification of a datastore whose thin disks
+// may grow by more than its free space, listing the top offending VMs.
+func inflationMessage(rep *report) message {
+	name := rep.Datastore
+	if rep.Name != "" {
+		name = rep.Name
+	}
+
+	msg := message{
+		Title: "Thin disk inflation exceeds free space",
+		Text:  fmt.Sprintf("Thin disks on datastore %v may grow by %v, but only %v are free", name, gib(rep.InflationBytes), gib(rep.FreeBytes)),
+		Fields: map[string]string{
+			"datastore":   rep.Datastore,
+			"capacity":    gib(rep.CapacityBytes),
+			"free":        gib(rep.FreeBytes),
+			"provisioned": gib(rep.ProvisionedBytes),
+			"committed":   gib(rep.CommittedBytes),
+			"ratio":       fmt.Sprintf("%v of %v tolerated", rep.Ratio, rep.MaxRatio),
+		},
+		Time: time.Now().UTC(),
+	}
+	for _, v := range rep.VMs {
+		msg.Fields["vm "+v.Name] = fmt.Sprintf("may grow by %v, %v of %v committed", gib(v.InflationBytes), gib(v.CommittedBytes), gib(v.ProvisionedBytes))
+	}
+
+	return msg
+}
+
+// gib formats bytes in GiB with up to one decimal.
+func gib(bytes int64) string {
+	return strconv.FormatFloat(math.Round(float64(bytes)/(1<<30)*10)/10, 'f', -1, 64) + " GiB"
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
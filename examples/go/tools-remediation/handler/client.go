@@ -0,0 +1,231 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+	rest    *rest.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	rc := rest.NewClient(gc.Client)
+	err = rc.Login(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("log in to rest api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc, rest: rc}, nil
+}
+
+// vmTools holds the state of the VMware Tools of a VM and its owners.
+type vmTools struct {
+	Name          string
+	Template      bool
+	PowerState    types.VirtualMachinePowerState
+	RunningStatus string
+	VersionStatus string
+	UpgradePolicy string
+	Owners        []string
+}
+
+// vmTools retrieves the state of the VMware Tools of a VM and its owners from
+// the custom attribute field.
+func (clt *vsClient) vmTools(ctx context.Context, ref types.ManagedObjectReference, field string) (*vmTools, error) {
+	key, err := clt.fieldKey(ctx, field)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+
+	var vm mo.VirtualMachine
+	err = pc.RetrieveOne(ctx, ref, []string{"name", "config.template", "config.tools", "runtime.powerState", "guest", "customValue"}, &vm)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve VMware Tools of %v failed: %w", ref.Value, err)
+	}
+
+	t := vmTools{Name: vm.Name, PowerState: vm.Runtime.PowerState}
+	if vm.Config != nil {
+		t.Template = vm.Config.Template
+		if vm.Config.Tools != nil {
+			t.UpgradePolicy = vm.Config.Tools.ToolsUpgradePolicy
+		}
+	}
+	if vm.Guest != nil {
+		t.RunningStatus = vm.Guest.ToolsRunningStatus
+		t.VersionStatus = vm.Guest.ToolsVersionStatus2
+	}
+
+	// The last value of the field is the current one.
+	for _, v := range vm.CustomValue {
+		if s, ok := v.(*types.CustomFieldStringValue); ok && s.Key == key {
+			t.Owners = owners(s.Value)
+		}
+	}
+
+	return &t, nil
+}
+
+// owners splits the value of the owner field into its owners.
+func owners(value string) []string {
+	var list []string
+	for _, o := range strings.Split(value, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			list = append(list, o)
+		}
+	}
+
+	return list
+}
+
+// fieldKey returns the key of the custom attribute name, -1 if it does not
+// exist.
+func (clt *vsClient) fieldKey(ctx context.Context, name string) (int32, error) {
+	m, err := object.GetCustomFieldsManager(clt.govmomi.Client)
+	if err != nil {
+		return 0, fmt.Errorf("get custom attributes failed: %w", err)
+	}
+
+	key, err := m.FindKey(ctx, name)
+	if errors.Is(err, object.ErrKeyNameNotFound) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("find custom attribute %v failed: %w", name, err)
+	}
+
+	return key, nil
+}
+
+// waitRunning waits up to wait for the VMware Tools of a VM to run and
+// returns their last running status.
+func (clt *vsClient) waitRunning(ctx context.Context, ref types.ManagedObjectReference, wait time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	status := ""
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := property.Wait(ctx, pc, ref, []string{"guest.toolsRunningStatus"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if s, ok := c.Val.(string); ok {
+				status = s
+			}
+		}
+		return status == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+	})
+	// VMware Tools not starting in time are no failure, but not running.
+	if err != nil && ctx.Err() == nil {
+		return "", fmt.Errorf("wait for VMware Tools of %v failed: %w", ref.Value, err)
+	}
+
+	return status, nil
+}
+
+// upgradeTools starts the upgrade of the VMware Tools of a VM and returns the
+// upgrade task.
+func (clt *vsClient) upgradeTools(ctx context.Context, ref types.ManagedObjectReference) (string, error) {
+	task, err := object.NewVirtualMachine(clt.govmomi.Client, ref).UpgradeTools(ctx, "")
+	if err != nil {
+		return "", fmt.Errorf("upgrade VMware Tools of %v failed: %w", ref.Value, err)
+	}
+
+	return task.Reference().Value, nil
+}
+
+// tagged reports whether a tag is attached to an object.
+func (clt *vsClient) tagged(ctx context.Context, ref types.ManagedObjectReference, tagID string) (bool, error) {
+	attached, err := tags.NewManager(clt.rest).ListAttachedTags(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %v failed: %w", ref.Value, err)
+	}
+
+	for _, id := range attached {
+		if id == tagID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tag attaches an existing tag to an object.
+func (clt *vsClient) tag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).AttachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("attaching tag to %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// untag detaches a tag from an object.
+func (clt *vsClient) untag(ctx context.Context, ref types.ManagedObjectReference, tagID string) error {
+	err := tags.NewManager(clt.rest).DetachTag(ctx, tagID, ref)
+	if err != nil {
+		return fmt.Errorf("detaching tag from %v failed: %w", ref.Value, err)
+	}
+
+	return nil
+}
+
+// active reports whether the sessions of the client are still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	rs, err := clt.rest.Session(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rs != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	// Log out of both APIs, even if the first logout fails.
+	if clt.govmomi != nil {
+		if err := clt.govmomi.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("govmomi api logout failed: %w", err))
+		}
+	}
+
+	if clt.rest != nil {
+		if err := clt.rest.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rest api logout failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
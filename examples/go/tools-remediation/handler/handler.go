@@ -0,0 +1,390 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// defaultEvents check the VMware Tools of their VM if no events are
+// configured.
+var defaultEvents = []string{"AlarmStatusChangedEvent", "VmPoweredOnEvent", "VmGuestRebootEvent"}
+
+// Defaults of vcconfig.toml.
+const (
+	// defaultWaitSeconds is the time given to VMware Tools to start, e.g.
+	// while the guest boots after power on.
+	defaultWaitSeconds = 120
+	// defaultOwnerField is the custom attribute naming the owners of a VM.
+	defaultOwnerField = "owner"
+)
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Tools struct {
+		// Events check the VMware Tools of their VM, by default
+		// defaultEvents.
+		Events []string
+		// WaitSeconds is the maximum time waited for VMware Tools to
+		// start before they count as not running, by default
+		// defaultWaitSeconds.
+		WaitSeconds int `toml:"wait_seconds"`
+		// NotRunningTagURN is attached to VMs whose VMware Tools are not
+		// running and detached once they run again.
+		NotRunningTagURN string `toml:"not_running_tag_urn"`
+		// UpgradeTagURN allows the upgrade of out of date VMware Tools of
+		// the VMs carrying it.
+		UpgradeTagURN string `toml:"upgrade_tag_urn"`
+		// UpgradeByPolicy allows the upgrade of out of date VMware Tools
+		// of the VMs whose tools upgrade policy is upgradeAtPowerCycle.
+		UpgradeByPolicy bool `toml:"upgrade_by_policy"`
+		// OwnerField is the custom attribute of VMs naming their owners,
+		// separated by commas, by default defaultOwnerField.
+		OwnerField string `toml:"owner_field"`
+	}
+	Notify struct {
+		// VMs whose VMware Tools are not running or are upgraded are
+		// posted to the configured sinks, mentioning their owners.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event.
+type incoming struct {
+	Subject string `json:"subject,omitempty"`
+	Data    struct {
+		Vm     *types.VmEventArgument            `json:"Vm,omitempty"`
+		Entity *types.ManagedEntityEventArgument `json:"Entity,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// vm returns the VM of the event, nil if it has none.
+func (e *incoming) vm() *types.ManagedObjectReference {
+	if vm := e.Data.Vm; vm != nil && vm.Vm.Value != "" {
+		return &vm.Vm
+	}
+
+	// Alarms of VMs name them as entity only.
+	if en := e.Data.Entity; en != nil && en.Entity.Type == "VirtualMachine" && en.Entity.Value != "" {
+		return &en.Entity
+	}
+
+	return nil
+}
+
+// report describes the VMware Tools of a VM and the actions taken.
+type report struct {
+	Event         string   `json:"event,omitempty"`
+	VM            string   `json:"vm"`
+	Name          string   `json:"name,omitempty"`
+	RunningStatus string   `json:"running_status,omitempty"`
+	VersionStatus string   `json:"version_status,omitempty"`
+	UpgradePolicy string   `json:"upgrade_policy,omitempty"`
+	Owners        []string `json:"owners,omitempty"`
+	UpgradeTask   string   `json:"upgrade_task,omitempty"`
+	Skipped       string   `json:"skipped,omitempty"`
+	Actions       []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		wrapErr := fmt.Errorf("connect to vSphere failed: %w", err)
+		slog.Error("connect to vSphere failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	vm := event.vm()
+	rep := report{
+		Event: event.Subject,
+		VM:    vm.Value,
+	}
+
+	actionErr := remediate(ctx, clt, cfg, &rep, *vm)
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("remediation of VMware Tools failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// checks reports whether event checks the VMware Tools of its VM.
+func (cfg *vcConfig) checks(event string) bool {
+	events := cfg.Tools.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitSeconds returns the maximum time waited for VMware Tools to start.
+func (cfg *vcConfig) waitSeconds() int {
+	if cfg.Tools.WaitSeconds > 0 {
+		return cfg.Tools.WaitSeconds
+	}
+
+	return defaultWaitSeconds
+}
+
+// ownerField returns the custom attribute naming the owners of VMs.
+func (cfg *vcConfig) ownerField() string {
+	if cfg.Tools.OwnerField != "" {
+		return cfg.Tools.OwnerField
+	}
+
+	return defaultOwnerField
+}
+
+// notifies reports whether a notify sink is configured.
+func (cfg *vcConfig) notifies() bool {
+	return cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != ""
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	// A function which neither tags, upgrades nor notifies does nothing.
+	t := cfg.Tools
+	if t.NotRunningTagURN == "" && t.UpgradeTagURN == "" && !t.UpgradeByPolicy && !cfg.notifies() {
+		return errors.New("required field(s) missing, including tools not_running_tag_urn, upgrade_tag_urn, upgrade_by_policy or a notify sink")
+	}
+
+	if t.WaitSeconds < 0 {
+		return errors.New("tools wait_seconds must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a configured event of a VM.
+func parseEvent(req []byte, cfg *vcConfig) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !cfg.checks(event.Subject) {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.vm() == nil {
+		return nil, errors.New("empty VM")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
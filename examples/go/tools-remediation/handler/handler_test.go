@@ -0,0 +1,351 @@
+package function
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	tagged := vcConfig{}
+	tagged.VCenter.Server = "veba.local.corp"
+	tagged.VCenter.User = "admin@vsphere.local"
+	tagged.VCenter.Password = "password1234"
+	tagged.Tools.Events = []string{"VmPoweredOnEvent", "AlarmStatusChangedEvent"}
+	tagged.Tools.WaitSeconds = 300
+	tagged.Tools.NotRunningTagURN = "urn:vmomi:InventoryServiceTag:4e8b2c71-9a3d-4f56-b1e7-2d0c6a9f3b58:GLOBAL"
+	tagged.Tools.UpgradeTagURN = "urn:vmomi:InventoryServiceTag:8c1f5a3e-6b2d-4e97-a4c8-1f7e3d9b0a62:GLOBAL"
+	tagged.Tools.OwnerField = "app-owner"
+	tagged.Notify.SlackWebhookURL = "https://hooks.slack.com/services/vmops"
+
+	upgraded := vcConfig{}
+	upgraded.VCenter = tagged.VCenter
+	upgraded.VCenter.Insecure = true
+	upgraded.Tools.UpgradeByPolicy = true
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file with tags and a sink loads correctly",
+			"testdata/vcconfig.toml",
+			false,
+			&tagged,
+		},
+		{
+			"Test that toml file upgrading by policy only loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&upgraded,
+		},
+		{
+			"Test that vcconfig.toml missing essential information results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml which neither tags, upgrades nor notifies results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml with a negative wait_seconds results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that a missing vcconfig.toml results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(got, tc.want) {
+			t.Logf("got expected: %+v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %+v, got: %+v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseEvent shows configured events of VMs are accepted.
+func TestParseEvent(t *testing.T) {
+	cfg, err := loadTomlCfg("testdata/vcconfig.toml")
+	if err != nil {
+		t.Fatal("Test failing due to improper test setup.", failMark, err)
+	}
+
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      string
+	}{
+		{"Test that alarm of a VM is readable", "testdata/event.json", false, "vm-42"},
+		{"Test that VM event is readable", "testdata/event2.json", false, "vm-42"},
+		{"Event should return error if it has no VM", "testdata/eventErr1.json", true, ""},
+		{"Event should return error if it is not configured", "testdata/eventErr2.json", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body, cfg)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		if got := event.vm().Value; got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestAllowsUpgrade shows only out of date tools are upgraded, and only if
+// the upgrade tag or the tools upgrade policy allows it.
+func TestAllowsUpgrade(t *testing.T) {
+	var byTag vcConfig
+	byTag.Tools.UpgradeTagURN = "urn:vmomi:InventoryServiceTag:8c1f5a3e-6b2d-4e97-a4c8-1f7e3d9b0a62:GLOBAL"
+
+	var byPolicy vcConfig
+	byPolicy.Tools.UpgradeByPolicy = true
+
+	var tests = []struct {
+		testDesc      string
+		cfg           *vcConfig
+		versionStatus types.VirtualMachineToolsVersionStatus
+		policy        string
+		tagged        bool
+		want          bool
+	}{
+		{"Test that tagged VMs with outdated tools are upgraded", &byTag, types.VirtualMachineToolsVersionStatusGuestToolsNeedUpgrade, "manual", true, true},
+		{"Test that untagged VMs are not upgraded", &byTag, types.VirtualMachineToolsVersionStatusGuestToolsNeedUpgrade, upgradeAtPowerCycle, false, false},
+		{"Test that VMs upgrading at power cycle are upgraded by policy", &byPolicy, types.VirtualMachineToolsVersionStatusGuestToolsSupportedOld, upgradeAtPowerCycle, false, true},
+		{"Test that VMs upgrading manually are not upgraded by policy", &byPolicy, types.VirtualMachineToolsVersionStatusGuestToolsTooOld, "manual", true, false},
+		{"Test that current tools are not upgraded", &byTag, types.VirtualMachineToolsVersionStatusGuestToolsCurrent, "manual", true, false},
+		{"Test that tools managed by the guest are not upgraded", &byPolicy, types.VirtualMachineToolsVersionStatusGuestToolsUnmanaged, upgradeAtPowerCycle, true, false},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+
+		got := outOfDate(string(tc.versionStatus)) && tc.cfg.allowsUpgrade(tc.policy, tc.tagged)
+		if got == tc.want {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestRemediate shows VMs whose tools do not run are tagged and posted to
+// their owners once, and untagged once their tools run again.
+func TestRemediate(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		posts = append(posts, string(b))
+	}))
+	defer srv.Close()
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		m := tags.NewManager(rc)
+		categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "tools", Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		tagID, err := m.CreateTag(ctx, &tags.Tag{Name: "tools-not-running", CategoryID: categoryID})
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "DC0_H0_VM0")
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		fields, err := object.GetCustomFieldsManager(c)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		def, err := fields.Add(ctx, defaultOwnerField, "VirtualMachine", nil, nil)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		if err := fields.Set(ctx, vm.Reference(), def.Key, "app-team@local.corp, @web-oncall"); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+
+		var cfg vcConfig
+		cfg.Tools.WaitSeconds = 1
+		cfg.Tools.NotRunningTagURN = tagID
+		cfg.Notify.WebhookURL = srv.URL
+
+		sv := simulator.Map.Get(vm.Reference()).(*simulator.VirtualMachine)
+		tools := func(running types.VirtualMachineToolsRunningStatus, version types.VirtualMachineToolsVersionStatus) func() {
+			return func() {
+				sv.Guest.ToolsRunningStatus = string(running)
+				sv.Guest.ToolsVersionStatus2 = string(version)
+			}
+		}
+
+		var tests = []struct {
+			testDesc    string
+			setup       func()
+			wantActions string
+			wantPosts   int
+		}{
+			{"Test that a VM whose tools do not start is tagged and posted", tools(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning, ""), "tagged,notified", 1},
+			{"Test that a tagged VM is not posted again", nil, "already tagged", 1},
+			{"Test that a VM whose tools run again is untagged", tools(types.VirtualMachineToolsRunningStatusGuestToolsRunning, types.VirtualMachineToolsVersionStatusGuestToolsCurrent), "untagged", 1},
+			{"Test that outdated tools are not upgraded without permission", tools(types.VirtualMachineToolsRunningStatusGuestToolsRunning, types.VirtualMachineToolsVersionStatusGuestToolsNeedUpgrade), "upgrade not allowed", 1},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			rep := report{VM: vm.Reference().Value}
+			if err := remediate(ctx, clt, &cfg, &rep, vm.Reference()); err != nil {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+				continue
+			}
+
+			got := strings.Join(rep.Actions, ",")
+			if got == tc.wantActions && len(posts) == tc.wantPosts {
+				t.Logf("got expected: %+v. %v", rep, passMark)
+			} else {
+				t.Logf("expected actions %q and %d posts, got: %+v, %d posts. %v", tc.wantActions, tc.wantPosts, rep, len(posts), failMark)
+				t.Fail()
+			}
+		}
+
+		// The post names the owners of the VM, so a webhook can route it.
+		if len(posts) > 0 && strings.Contains(posts[0], `"owners":["app-team@local.corp","@web-oncall"]`) {
+			t.Logf("got expected owners: %v. %v", posts[0], passMark)
+		} else {
+			t.Logf("expected owners of DC0_H0_VM0, got: %v. %v", posts, failMark)
+			t.Fail()
+		}
+
+		t.Log("=========== Test that a powered off VM is skipped ===========")
+		sv.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOff
+		rep := report{VM: vm.Reference().Value}
+		if err := remediate(ctx, clt, &cfg, &rep, vm.Reference()); err != nil || rep.Skipped != "not powered on" {
+			t.Logf("expected skipped VM, got: %+v, %v. %v", rep, err, failMark)
+			t.Fail()
+		} else {
+			t.Logf("got expected: %+v. %v", rep, passMark)
+		}
+	})
+}
+
+// TestActive shows clients are no longer active once one of their sessions
+// expired, so vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		rc := rest.NewClient(c)
+		if err := rc.Login(ctx, simulator.DefaultLogin); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}, rest: rc}
+		sm := session.NewManager(c)
+
+		var tests = []struct {
+			testDesc string
+			expire   func() error
+			want     bool
+		}{
+			{"Test that a logged in client is active", func() error { return nil }, true},
+			{"Test that a client whose SOAP session expired is not active", func() error { return sm.Logout(ctx) }, false},
+			{"Test that a client whose vAPI session expired is not active", func() error {
+				if err := sm.Login(ctx, simulator.DefaultLogin); err != nil {
+					return err
+				}
+				return rc.Logout(ctx)
+			}, false},
+		}
+
+		for _, tc := range tests {
+			t.Logf("=========== %v ===========", tc.testDesc)
+			if err := tc.expire(); err != nil {
+				t.Fatal("Test failing due to improper test setup.", failMark, err)
+			}
+
+			got, err := clt.active(ctx)
+			if err == nil && got == tc.want {
+				t.Logf("got expected: %v. %v", got, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v (%v). %v", tc.want, got, err, failMark)
+				t.Fail()
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function, with the owners of the VM, so a webhook can route it to
+// them.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Owners []string          `json:"owners,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// vmMessage returns a notification about the VMware Tools of the VM of rep.
+func vmMessage(rep *report, title, text string) message {
+	msg := message{
+		Title: title,
+		Text:  text,
+		Fields: map[string]string{
+			"vm":             rep.VM,
+			"running_status": rep.RunningStatus,
+			"version_status": rep.VersionStatus,
+			"owners":         "none",
+		},
+		Owners: rep.Owners,
+		Time:   time.Now().UTC(),
+	}
+	if len(rep.Owners) > 0 {
+		msg.Fields["owners"] = strings.Join(rep.Owners, ", ")
+	}
+	if rep.UpgradePolicy != "" {
+		msg.Fields["upgrade_policy"] = rep.UpgradePolicy
+	}
+	if rep.UpgradeTask != "" {
+		msg.Fields["upgrade_task"] = rep.UpgradeTask
+	}
+
+	return msg
+}
+
+// notRunningMessage returns the notification of a VM whose VMware Tools are
+// not running.
+func notRunningMessage(rep *report) message {
+	return vmMessage(rep, "VMware Tools not running",
+		fmt.Sprintf("VMware Tools of VM %v are not running, guest operations, quiesced backups and graceful shutdowns fail", name(rep)))
+}
+
+// upgradeMessage returns the notification of a VM whose VMware Tools are
+// upgraded.
+func upgradeMessage(rep *report) message {
+	return vmMessage(rep, "VMware Tools upgrade started",
+		fmt.Sprintf("VMware Tools of VM %v are out of date and are upgraded, the guest may reboot", name(rep)))
+}
+
+// name returns the name of the VM of rep, its managed object id if unknown.
+func name(rep *report) string {
+	if rep.Name != "" {
+		return rep.Name
+	}
+
+	return rep.VM
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
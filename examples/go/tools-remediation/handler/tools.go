@@ -0,0 +1,190 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// upgradeAtPowerCycle is the tools upgrade policy of VMs which upgrade their
+// VMware Tools automatically.
+const upgradeAtPowerCycle = "upgradeAtPowerCycle"
+
+// outOfDate reports whether VMware Tools of the version status need an
+// upgrade. Tools managed by the guest, e.g. open-vm-tools, are never out of
+// date, since they are upgraded with the guest packages.
+func outOfDate(versionStatus string) bool {
+	switch types.VirtualMachineToolsVersionStatus(versionStatus) {
+	case types.VirtualMachineToolsVersionStatusGuestToolsNeedUpgrade,
+		types.VirtualMachineToolsVersionStatusGuestToolsSupportedOld,
+		types.VirtualMachineToolsVersionStatusGuestToolsTooOld,
+		types.VirtualMachineToolsVersionStatusGuestToolsBlacklisted:
+		return true
+	}
+
+	return false
+}
+
+// allowsUpgrade reports whether cfg allows upgrading the VMware Tools of a VM
+// with the tools upgrade policy, which carries the upgrade tag if tagged.
+func (cfg *vcConfig) allowsUpgrade(policy string, tagged bool) bool {
+	if cfg.Tools.UpgradeByPolicy && policy == upgradeAtPowerCycle {
+		return true
+	}
+
+	return cfg.Tools.UpgradeTagURN != "" && tagged
+}
+
+// remediate checks the VMware Tools of vm. VMs whose tools do not run in time
+// are tagged and posted, VMs whose tools run again are untagged. Out of date
+// tools are upgraded if allowed. Completed actions are added to rep, the
+// joined errors of failed actions are returned.
+func remediate(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	t, err := clt.vmTools(ctx, vm, cfg.ownerField())
+	if err != nil {
+		return err
+	}
+	t.fill(rep)
+
+	switch {
+	case t.Template:
+		rep.Skipped = "template"
+		return nil
+	case t.PowerState != types.VirtualMachinePowerStatePoweredOn:
+		rep.Skipped = "not powered on"
+		return nil
+	}
+
+	// The tools of a VM just powered on start with the guest.
+	if t.RunningStatus != string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+		status, err := clt.waitRunning(ctx, vm, time.Duration(cfg.waitSeconds())*time.Second)
+		if err != nil {
+			return err
+		}
+		if status != string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+			return notRunning(ctx, clt, cfg, rep, vm)
+		}
+
+		// The version is only known once the tools run.
+		t, err = clt.vmTools(ctx, vm, cfg.ownerField())
+		if err != nil {
+			return err
+		}
+		t.fill(rep)
+	}
+
+	var errs []error
+	if err := release(ctx, clt, cfg, rep, vm); err != nil {
+		errs = append(errs, err)
+	}
+	if err := upgrade(ctx, clt, cfg, rep, vm, t); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// fill copies the state of the tools to rep.
+func (t *vmTools) fill(rep *report) {
+	rep.Name = t.Name
+	rep.RunningStatus = t.RunningStatus
+	rep.VersionStatus = t.VersionStatus
+	rep.UpgradePolicy = t.UpgradePolicy
+	rep.Owners = t.Owners
+}
+
+// notRunning tags vm as not running VMware Tools and posts it to its owners.
+// The tag marks VMs already reported, so each VM is only posted once until
+// its tools run again.
+func notRunning(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	if urn := cfg.Tools.NotRunningTagURN; urn != "" {
+		tagged, err := clt.tagged(ctx, vm, urn)
+		if err != nil {
+			return err
+		}
+		if tagged {
+			rep.Actions = append(rep.Actions, "already tagged")
+			return nil
+		}
+
+		if err := clt.tag(ctx, vm, urn); err != nil {
+			return err
+		}
+		rep.Actions = append(rep.Actions, "tagged")
+	}
+
+	if !cfg.notifies() {
+		return nil
+	}
+
+	if err := notify(ctx, cfg, notRunningMessage(rep)); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "notified")
+
+	return nil
+}
+
+// release detaches the tag of VMs not running VMware Tools from vm, if
+// attached.
+func release(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference) error {
+	urn := cfg.Tools.NotRunningTagURN
+	if urn == "" {
+		return nil
+	}
+
+	tagged, err := clt.tagged(ctx, vm, urn)
+	if err != nil || !tagged {
+		return err
+	}
+
+	if err := clt.untag(ctx, vm, urn); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "untagged")
+
+	return nil
+}
+
+// upgrade starts the upgrade of the out of date VMware Tools of vm, if
+// allowed, and posts it to the owners of vm. The upgrade is not waited for,
+// since it may reboot the guest.
+func upgrade(ctx context.Context, clt *vsClient, cfg *vcConfig, rep *report, vm types.ManagedObjectReference, t *vmTools) error {
+	if !outOfDate(t.VersionStatus) {
+		return nil
+	}
+
+	tagged := false
+	if cfg.Tools.UpgradeTagURN != "" {
+		var err error
+		tagged, err = clt.tagged(ctx, vm, cfg.Tools.UpgradeTagURN)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !cfg.allowsUpgrade(t.UpgradePolicy, tagged) {
+		rep.Actions = append(rep.Actions, "upgrade not allowed")
+		return nil
+	}
+
+	task, err := clt.upgradeTools(ctx, vm)
+	if err != nil {
+		return err
+	}
+	rep.UpgradeTask = task
+	rep.Actions = append(rep.Actions, "upgrade started")
+
+	if !cfg.notifies() {
+		return nil
+	}
+
+	if err := notify(ctx, cfg, upgradeMessage(rep)); err != nil {
+		return err
+	}
+	rep.Actions = append(rep.Actions, "notified")
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vsClient is a client for vSphere.
+type vsClient struct {
+	govmomi *govmomi.Client
+}
+
+func newClient(ctx context.Context, u url.URL, insecure bool) (*vsClient, error) {
+	gc, err := govmomi.NewClient(ctx, &u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to govmomi api failed: %w", err)
+	}
+
+	return &vsClient{govmomi: gc}, nil
+}
+
+// drsBehavior returns the DRS automation level of cluster and whether DRS is
+// enabled.
+func (clt *vsClient) drsBehavior(ctx context.Context, cluster types.ManagedObjectReference) (types.DrsBehavior, bool, error) {
+	var cr mo.ClusterComputeResource
+
+	pc := property.DefaultCollector(clt.govmomi.Client)
+	err := pc.RetrieveOne(ctx, cluster, []string{"configurationEx"}, &cr)
+	if err != nil {
+		return "", false, fmt.Errorf("retrieve DRS configuration of %v failed: %w", cluster.Value, err)
+	}
+
+	cfg, ok := cr.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return "", false, fmt.Errorf("unexpected configuration of %v: %T", cluster.Value, cr.ConfigurationEx)
+	}
+
+	enabled := cfg.DrsConfig.Enabled != nil && *cfg.DrsConfig.Enabled
+
+	return cfg.DrsConfig.DefaultVmBehavior, enabled, nil
+}
+
+// setDRSBehavior sets the DRS automation level of cluster. Other settings of
+// the cluster are left as they are.
+func (clt *vsClient) setDRSBehavior(ctx context.Context, cluster types.ManagedObjectReference, level types.DrsBehavior) error {
+	spec := types.ClusterConfigSpecEx{
+		DrsConfig: &types.ClusterDrsConfigInfo{DefaultVmBehavior: level},
+	}
+
+	task, err := object.NewClusterComputeResource(clt.govmomi.Client, cluster).Reconfigure(ctx, &spec, true)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("setting DRS of %v to %v failed: %w", cluster.Value, level, err)
+	}
+
+	return nil
+}
+
+// active reports whether the session of the client is still valid. vCenter
+// ends sessions which are idle for too long, by default 30 minutes.
+func (clt *vsClient) active(ctx context.Context) (bool, error) {
+	s, err := session.NewManager(clt.govmomi.Client).UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return s != nil, nil
+}
+
+func (clt *vsClient) logout(ctx context.Context) error {
+	// Nothing to log out of before the first connect.
+	if clt == nil || clt.govmomi == nil {
+		return nil
+	}
+
+	if err := clt.govmomi.Logout(ctx); err != nil {
+		return fmt.Errorf("govmomi api logout failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/pelletier/go-toml"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const cfgPath = "/var/openfaas/secrets/vcconfig"
+
+// Defaults of vcconfig.toml.
+const (
+	defaultMaxMigrations = 20
+	defaultWindowSeconds = 600
+	defaultThrottleLevel = string(types.DrsBehaviorPartiallyAutomated)
+)
+
+// supportedEvents are migrations, whether started by a user or by DRS.
+var supportedEvents = map[string]bool{
+	"VmMigratedEvent":    true,
+	"DrsVmMigratedEvent": true,
+}
+
+// vcConfig represents the toml vcconfig file
+type vcConfig struct {
+	VCenter struct {
+		Server   string
+		User     string
+		Password string
+		Insecure bool
+	}
+	Storm struct {
+		// MaxMigrations of a cluster within the window are tolerated, one
+		// more is a storm.
+		MaxMigrations int `toml:"max_migrations"`
+		// WindowSeconds is the length of the sliding window migrations are
+		// counted in.
+		WindowSeconds int `toml:"window_seconds"`
+		// Throttle sets the DRS automation level of the cluster to
+		// ThrottleLevel during a storm and restores it afterwards. vCenter
+		// settings are only required with throttling.
+		Throttle      bool
+		ThrottleLevel string `toml:"throttle_level"`
+	}
+	Notify struct {
+		// Storms and their end are posted to the configured sinks.
+		WebhookURL      string `toml:"webhook_url"`
+		SlackWebhookURL string `toml:"slack_webhook_url"`
+	}
+}
+
+// Incoming is a subsection of a Cloud Event. DrsVmMigratedEvent has the same
+// fields as VmMigratedEvent.
+type incoming struct {
+	Subject string                `json:"subject,omitempty"`
+	Data    types.VmMigratedEvent `json:"data,omitempty"`
+}
+
+// report describes the migrations of a cluster and the actions taken.
+type report struct {
+	Event      string   `json:"event"`
+	Cluster    string   `json:"cluster"`
+	Name       string   `json:"name,omitempty"`
+	Migrations int      `json:"migrations"`
+	Window     string   `json:"window"`
+	Storm      bool     `json:"storm"`
+	Actions    []string `json:"actions,omitempty"`
+}
+
+// verifyAfter is the idle time after which the session is verified before it
+// is used again, since vCenter logs out idle sessions.
+const verifyAfter = 5 * time.Minute
+
+var (
+	lock     sync.Mutex // Lock protects client and lastUsed.
+	client   *vsClient  // Client persists vSphere connection.
+	lastUsed time.Time  // LastUsed is when client was last handed out.
+	once     sync.Once  // For restoreLoop() to be started once.
+
+	// migrations are counted across invocations of this replica.
+	migrations = newWindow()
+	// storms are the ongoing storms of this replica.
+	storms = newStorms()
+)
+
+// Handle a function invocation
+func Handle(req handler.Request) (handler.Response, error) {
+	ctx := req.Context()
+
+	// Load config every time, to ensure the most updated version is used.
+	cfg, err := loadTomlCfg(cfgPath)
+	if err != nil {
+		wrapErr := fmt.Errorf("loading of vcconfig failed: %w", err)
+		slog.Error("loading of vcconfig failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, wrapErr
+	}
+
+	event, err := parseEvent(req.Body)
+	if err != nil {
+		wrapErr := fmt.Errorf("parsing of event failed: %w", err)
+		slog.Debug("parsing of event failed", "err", err)
+
+		return handler.Response{
+			Body:       []byte(wrapErr.Error()),
+			StatusCode: http.StatusBadRequest,
+		}, wrapErr
+	}
+
+	// Storms subside without events, e.g. once DRS is throttled.
+	once.Do(func() { go restoreLoop(context.Background()) })
+
+	// Redelivered or delayed events are counted when they happened.
+	at := event.Data.CreatedTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	cluster := event.Data.ComputeResource.ComputeResource
+	rep := report{
+		Event:      event.Subject,
+		Cluster:    cluster.Value,
+		Name:       event.Data.ComputeResource.Name,
+		Migrations: migrations.add(cluster.Value, at, cfg.window()),
+		Window:     cfg.window().String(),
+	}
+	rep.Storm = rep.Migrations > cfg.Storm.MaxMigrations
+
+	var actionErr error
+	// Each storm is only acted on when it starts.
+	if rep.Storm && storms.start(cluster, at) {
+		actionErr = act(ctx, cfg, &rep, cluster)
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return handler.Response{
+			Body:       []byte(err.Error()),
+			StatusCode: http.StatusInternalServerError,
+		}, err
+	}
+	slog.Info("event processed", "report", string(body))
+
+	if actionErr != nil {
+		return handler.Response{
+			Body:       body,
+			StatusCode: http.StatusInternalServerError,
+		}, fmt.Errorf("acting on storm failed: %w", actionErr)
+	}
+
+	return handler.Response{
+		Body:       body,
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+// act notifies of a storm starting and throttles DRS of the cluster, if
+// configured. Completed actions are added to rep, the joined errors of failed
+// actions are returned.
+func act(ctx context.Context, cfg *vcConfig, rep *report, cluster types.ManagedObjectReference) error {
+	var errs []error
+
+	if cfg.Storm.Throttle {
+		if err := throttle(ctx, cfg, rep, cluster); err != nil {
+			// The next event exceeding the threshold retries throttling.
+			storms.end(cluster)
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+		if err := notify(ctx, cfg, stormMessage(rep, time.Now())); err != nil {
+			errs = append(errs, err)
+		} else {
+			rep.Actions = append(rep.Actions, "notified")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// throttle sets the DRS automation level of the cluster to the throttle level
+// and records the level to restore. Clusters without DRS or with a level at
+// least as conservative are left as they are.
+func throttle(ctx context.Context, cfg *vcConfig, rep *report, cluster types.ManagedObjectReference) error {
+	// Standalone hosts have no DRS.
+	if cluster.Type != "ClusterComputeResource" {
+		rep.Actions = append(rep.Actions, "no cluster to throttle")
+		return nil
+	}
+
+	// Connect to vSphere govmomi API once and persist connection with global variable.
+	clt, err := vsConnect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	restore, err := storms.throttle(ctx, clt, cluster, types.DrsBehavior(cfg.Storm.ThrottleLevel))
+	if err != nil {
+		return err
+	}
+
+	if restore == "" {
+		rep.Actions = append(rep.Actions, "DRS already conservative")
+		return nil
+	}
+	rep.Actions = append(rep.Actions, fmt.Sprintf("DRS set from %v to %v", restore, cfg.Storm.ThrottleLevel))
+
+	return nil
+}
+
+// window returns the length of the sliding window migrations are counted in.
+func (cfg *vcConfig) window() time.Duration {
+	return time.Duration(cfg.Storm.WindowSeconds) * time.Second
+}
+
+// vsConnect connects to vSphere govmomi API using information from vcconfig.toml
+// and returns the persisted client. The client is replaced once its session
+// expired, e.g. after vCenter logged out the idle session. Callers use the
+// returned client, since a concurrent invocation may replace the persisted one.
+func vsConnect(ctx context.Context, cfg *vcConfig) (*vsClient, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Verifying the session costs a round trip, so only sessions idle for
+	// verifyAfter are verified.
+	if client != nil && time.Since(lastUsed) > verifyAfter {
+		active, err := client.active(ctx)
+		if err != nil || !active {
+			slog.Debug("vSphere session expired, reconnect", "err", err)
+			// A session of the other API may still be valid.
+			_ = client.logout(ctx)
+			client = nil
+		}
+	}
+
+	if client != nil {
+		lastUsed = time.Now()
+		return client, nil
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.VCenter.Server,
+		Path:   "sdk",
+	}
+	u.User = url.UserPassword(cfg.VCenter.User, cfg.VCenter.Password)
+	insecure := cfg.VCenter.Insecure
+
+	slog.Debug("connect to vSphere")
+
+	c, err := newClient(ctx, u, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("connection to vSphere API failed: %w", err)
+	}
+
+	// Set global variable to persist connection.
+	client = c
+	lastUsed = time.Now()
+
+	return c, nil
+}
+
+func loadTomlCfg(path string) (*vcConfig, error) {
+	var cfg vcConfig
+
+	secret, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vcconfig.toml: %w", err)
+	}
+
+	err = secret.Unmarshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal vcconfig.toml: %w", err)
+	}
+
+	if cfg.Storm.MaxMigrations == 0 {
+		cfg.Storm.MaxMigrations = defaultMaxMigrations
+	}
+	if cfg.Storm.WindowSeconds == 0 {
+		cfg.Storm.WindowSeconds = defaultWindowSeconds
+	}
+	if cfg.Storm.ThrottleLevel == "" {
+		cfg.Storm.ThrottleLevel = defaultThrottleLevel
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("insufficient information in vcconfig.toml: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ValidateConfig ensures the bare minimum of information is in the config file.
+func validateConfig(cfg vcConfig) error {
+	if cfg.Storm.MaxMigrations < 0 || cfg.Storm.WindowSeconds < 0 {
+		return errors.New("storm max_migrations and window_seconds must not be negative")
+	}
+
+	// Throttling to fully automated would not throttle at all.
+	switch types.DrsBehavior(cfg.Storm.ThrottleLevel) {
+	case types.DrsBehaviorManual, types.DrsBehaviorPartiallyAutomated:
+	default:
+		return fmt.Errorf("unsupported storm throttle_level %q", cfg.Storm.ThrottleLevel)
+	}
+
+	if cfg.Notify.WebhookURL == "" && cfg.Notify.SlackWebhookURL == "" && !cfg.Storm.Throttle {
+		return errors.New("required field(s) missing, including a notify sink or storm throttle")
+	}
+
+	// vSphere is only needed for throttling.
+	if !cfg.Storm.Throttle {
+		return nil
+	}
+
+	reqFields := map[string]string{
+		"vcenter server":   cfg.VCenter.Server,
+		"vcenter user":     cfg.VCenter.User,
+		"vcenter password": cfg.VCenter.Password,
+	}
+
+	// Multiple fields may be missing, but err on the first encountered.
+	for k, v := range reqFields {
+		if v == "" {
+			return errors.New("required field(s) missing, including " + k)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	// write_debug enables the debug logs.
+	level := slog.LevelInfo
+	if debug() {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Log out of vSphere on shutdown, whether or not an event was processed.
+	go handleSignal()
+}
+
+// Debug determines verbose logging
+func debug() bool {
+	verbose := os.Getenv("write_debug")
+
+	if verbose == "true" {
+		return true
+	}
+
+	return false
+}
+
+// parseEvent returns a migration event of a VM in a cluster or on a
+// standalone host.
+func parseEvent(req []byte) (*incoming, error) {
+	var event incoming
+
+	err := json.Unmarshal(req, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parsing of request failed: %w", err)
+	}
+
+	if !supportedEvents[event.Subject] {
+		return nil, fmt.Errorf("unsupported event %q", event.Subject)
+	}
+
+	if event.Data.ComputeResource == nil || event.Data.ComputeResource.ComputeResource.Value == "" {
+		return nil, errors.New("empty compute resource")
+	}
+
+	return &event, nil
+}
+
+func handleSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	// Throttled clusters keep their level, it is logged to restore by hand.
+	storms.each(func(cluster types.ManagedObjectReference, s *storm) {
+		if s.restore != "" {
+			slog.Warn("shutting down while DRS is throttled", "cluster", cluster.Value, "restore", s.restore)
+		}
+	})
+
+	slog.Debug("got signal, log out of vSphere")
+
+	// The signal context is done, so the logout needs a context of its own.
+	err := client.logout(context.Background())
+	if err != nil {
+		slog.Debug("vSphere logout failed", "err", err)
+		return
+	}
+	slog.Debug("logged out of vSphere")
+}
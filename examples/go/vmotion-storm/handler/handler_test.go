@@ -0,0 +1,300 @@
+package function
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const passMark = "\u2713"
+const failMark = "\u2717"
+
+// fakeDRS holds the DRS automation level of a single cluster.
+type fakeDRS struct {
+	level   types.DrsBehavior
+	enabled bool
+	sets    int
+}
+
+func (f *fakeDRS) drsBehavior(context.Context, types.ManagedObjectReference) (types.DrsBehavior, bool, error) {
+	return f.level, f.enabled, nil
+}
+
+func (f *fakeDRS) setDRSBehavior(_ context.Context, _ types.ManagedObjectReference, level types.DrsBehavior) error {
+	f.level = level
+	f.sets++
+	return nil
+}
+
+// TestLoadTomlCfg shows valid vcconfig.toml files can be loaded and processed.
+func TestLoadTomlCfg(t *testing.T) {
+	notifyOnly := vcConfig{}
+	notifyOnly.Storm.MaxMigrations = 20
+	notifyOnly.Storm.WindowSeconds = 600
+	notifyOnly.Storm.ThrottleLevel = "partiallyAutomated"
+	notifyOnly.Notify.SlackWebhookURL = "https://hooks.slack.com/services/T000/B000/XXXX"
+
+	withThrottle := vcConfig{}
+	withThrottle.VCenter.Server = "veba.local.corp"
+	withThrottle.VCenter.User = "admin@vsphere.local"
+	withThrottle.VCenter.Password = "password1234"
+	withThrottle.Storm.MaxMigrations = 10
+	withThrottle.Storm.WindowSeconds = 300
+	withThrottle.Storm.Throttle = true
+	withThrottle.Storm.ThrottleLevel = "manual"
+	withThrottle.Notify.WebhookURL = "https://hooks.local.corp/vmotion"
+
+	var tests = []struct {
+		testDesc  string
+		cfgPath   string
+		expectErr bool
+		want      *vcConfig
+	}{
+		{
+			"Test that toml file without vCenter loads correctly with default threshold, window and level",
+			"testdata/vcconfig.toml",
+			false,
+			&notifyOnly,
+		},
+		{
+			"Test that toml file with throttling loads correctly",
+			"testdata/vcconfig2.toml",
+			false,
+			&withThrottle,
+		},
+		{
+			"Test that throttling without vCenter settings results in error",
+			"testdata/vcconfigErr1.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that vcconfig.toml without notify sink and throttling results in error",
+			"testdata/vcconfigErr2.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that throttling to fully automated results in error",
+			"testdata/vcconfigErr3.toml",
+			true,
+			nil,
+		},
+		{
+			"Test that missing toml file results in error",
+			"testdata/missing.toml",
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		cfg, err := loadTomlCfg(tc.cfgPath)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+		} else {
+			if reflect.DeepEqual(cfg, tc.want) {
+				t.Logf("got expected: %v. %v", tc.want, passMark)
+			} else {
+				t.Logf("expected: %v, got: %v. %v", tc.want, cfg, failMark)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestParseEvent ensures the cluster of migration events is read and other
+// events are rejected.
+func TestParseEvent(t *testing.T) {
+	var tests = []struct {
+		testDesc  string
+		jsonPath  string
+		expectErr bool
+		want      types.ManagedObjectReference
+	}{
+		{
+			"Test that the cluster of a DRS migration is read",
+			"testdata/event.json",
+			false,
+			types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c7"},
+		},
+		{
+			"Test that the standalone host of a migration is read",
+			"testdata/event2.json",
+			false,
+			types.ManagedObjectReference{Type: "ComputeResource", Value: "domain-s21"},
+		},
+		{
+			"Event should return error if compute resource is empty",
+			"testdata/eventErr1.json",
+			true,
+			types.ManagedObjectReference{},
+		},
+		{
+			"Event should return error if it is no migration event",
+			"testdata/eventErr2.json",
+			true,
+			types.ManagedObjectReference{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		body, err := os.ReadFile(tc.jsonPath)
+		if err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+
+		event, err := parseEvent(body)
+		if err != nil {
+			if tc.expectErr {
+				// An error is expected.
+				t.Logf("got an error, as expected: %v. %v", err, passMark)
+			} else {
+				t.Log(tc.testDesc, failMark, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		got := event.Data.ComputeResource.ComputeResource
+		if got == tc.want && !tc.expectErr {
+			t.Logf("got expected: %v. %v", got, passMark)
+		} else {
+			t.Logf("expected: %v, got: %v. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestWindow ensures migrations are counted per cluster within the sliding
+// window.
+func TestWindow(t *testing.T) {
+	w := newWindow()
+	size := time.Minute
+	start := time.Date(2020, 6, 8, 14, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		testDesc string
+		cluster  string
+		after    time.Duration
+		want     int
+	}{
+		{"Test that the first migration is counted", "domain-c7", 0, 1},
+		{"Test that migrations within the window add up", "domain-c7", 30 * time.Second, 2},
+		{"Test that migrations are counted per cluster", "domain-c8", 40 * time.Second, 1},
+		{"Test that migrations before the window are dropped", "domain-c7", 80 * time.Second, 2},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		got := w.add(tc.cluster, start.Add(tc.after), size)
+		if got == tc.want {
+			t.Logf("got expected: %d. %v", got, passMark)
+		} else {
+			t.Logf("expected: %d, got: %d. %v", tc.want, got, failMark)
+			t.Fail()
+		}
+	}
+
+	t.Log("=========== Test that a cluster without migrations in the window counts none ===========")
+	if got := w.count("domain-c7", start.Add(5*time.Minute), size); got == 0 {
+		t.Logf("got expected: %d. %v", got, passMark)
+	} else {
+		t.Logf("expected: 0, got: %d. %v", got, failMark)
+		t.Fail()
+	}
+}
+
+// TestThrottle ensures DRS is only throttled to a more conservative level and
+// restored after the storm, unless it was changed meanwhile.
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	cluster := types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c7"}
+	manual := types.DrsBehaviorManual
+	partially := types.DrsBehaviorPartiallyAutomated
+	fully := types.DrsBehaviorFullyAutomated
+
+	var tests = []struct {
+		testDesc    string
+		drs         fakeDRS
+		changeTo    types.DrsBehavior // level set by an operator during the storm
+		wantRestore types.DrsBehavior
+		wantLevel   types.DrsBehavior // level after the storm
+	}{
+		{"Test that fully automated DRS is throttled and restored", fakeDRS{level: fully, enabled: true}, "", fully, fully},
+		{"Test that manual DRS is left as it is", fakeDRS{level: manual, enabled: true}, "", "", manual},
+		{"Test that disabled DRS is left as it is", fakeDRS{level: fully}, "", "", fully},
+		{"Test that DRS changed during the storm is not restored", fakeDRS{level: fully, enabled: true}, manual, fully, manual},
+	}
+
+	for _, tc := range tests {
+		t.Logf("=========== %v ===========", tc.testDesc)
+		s := newStorms()
+		d := tc.drs
+
+		if !s.start(cluster, time.Now()) || s.start(cluster, time.Now()) {
+			t.Fatal("expected a storm to start once.", failMark)
+		}
+
+		restore, err := s.throttle(ctx, &d, cluster, partially)
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+		if tc.changeTo != "" {
+			d.level = tc.changeTo
+		}
+
+		text, err := s.subside(ctx, &d, cluster, s.snapshot()[cluster])
+		if err != nil {
+			t.Fatal(failMark, err)
+		}
+
+		if restore == tc.wantRestore && d.level == tc.wantLevel && len(s.snapshot()) == 0 {
+			t.Logf("got expected: restore %q, level %v, %v. %v", restore, d.level, text, passMark)
+		} else {
+			t.Logf("expected: restore %q, level %v, got: restore %q, level %v, %v. %v", tc.wantRestore, tc.wantLevel, restore, d.level, text, failMark)
+			t.Fail()
+		}
+	}
+}
+
+// TestActive shows clients are no longer active once their session expired, so
+// vsConnect replaces them.
+func TestActive(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		clt := &vsClient{govmomi: &govmomi.Client{Client: c}}
+
+		t.Log("=========== Test that a logged in client is active ===========")
+		got, err := clt.active(ctx)
+		if err != nil || !got {
+			t.Fatalf("expected: true, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: true. %v", passMark)
+
+		t.Log("=========== Test that a client whose session expired is not active ===========")
+		if err := session.NewManager(c).Logout(ctx); err != nil {
+			t.Fatal("Test failing due to improper test setup.", failMark, err)
+		}
+		got, err = clt.active(ctx)
+		if err != nil || got {
+			t.Fatalf("expected: false, got: %v (%v). %v", got, err, failMark)
+		}
+		t.Logf("got expected: false. %v", passMark)
+	})
+}
@@ -0,0 +1,116 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message is a notification, as posted by the notification sinks of the
+// tagging function.
+type message struct {
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// stormMessage returns the notification of a storm starting in a cluster.
+func stormMessage(rep *report, now time.Time) message {
+	name := rep.Cluster
+	if rep.Name != "" {
+		name = rep.Name
+	}
+
+	msg := message{
+		Title: "vMotion storm",
+		Text:  fmt.Sprintf("%d migrations in %v within %v", rep.Migrations, name, rep.Window),
+		Fields: map[string]string{
+			"cluster":    rep.Cluster,
+			"migrations": strconv.Itoa(rep.Migrations),
+			"window":     rep.Window,
+		},
+		Time: now.UTC(),
+	}
+	if len(rep.Actions) > 0 {
+		msg.Fields["actions"] = strings.Join(rep.Actions, ", ")
+	}
+
+	return msg
+}
+
+// subsidedMessage returns the notification of a storm which subsided, text
+// describes whether DRS was restored.
+func subsidedMessage(cluster, text string, migrations int, window time.Duration, now time.Time) message {
+	return message{
+		Title: "vMotion storm subsided",
+		Text:  fmt.Sprintf("%v: %v", cluster, text),
+		Fields: map[string]string{
+			"cluster":    cluster,
+			"migrations": strconv.Itoa(migrations),
+			"window":     window.String(),
+		},
+		Time: now.UTC(),
+	}
+}
+
+// notify posts msg to the configured webhook and Slack sinks.
+func notify(ctx context.Context, cfg *vcConfig, msg message) error {
+	var errs []error
+
+	if cfg.Notify.WebhookURL != "" {
+		errs = append(errs, post(ctx, cfg.Notify.WebhookURL, msg))
+	}
+
+	if cfg.Notify.SlackWebhookURL != "" {
+		text := fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text)
+
+		names := make([]string, 0, len(msg.Fields))
+		for k := range msg.Fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			text += fmt.Sprintf("\n- %s: %s", k, msg.Fields[k])
+		}
+
+		errs = append(errs, post(ctx, cfg.Notify.SlackWebhookURL, struct {
+			Text string `json:"text"`
+		}{text}))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding notification failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending notification failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notification rejected: %v", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// restoreInterval is the time between checks whether storms subsided.
+const restoreInterval = 30 * time.Second
+
+// conservativeness ranks DRS automation levels, higher levels migrate less.
+var conservativeness = map[types.DrsBehavior]int{
+	types.DrsBehaviorFullyAutomated:     0,
+	types.DrsBehaviorPartiallyAutomated: 1,
+	types.DrsBehaviorManual:             2,
+}
+
+// drs reads and sets the DRS automation level of clusters, it is replaced in
+// tests.
+type drs interface {
+	drsBehavior(ctx context.Context, cluster types.ManagedObjectReference) (types.DrsBehavior, bool, error)
+	setDRSBehavior(ctx context.Context, cluster types.ManagedObjectReference, level types.DrsBehavior) error
+}
+
+// storm is an ongoing vMotion storm in a cluster.
+type storm struct {
+	started time.Time
+	// restore is the DRS automation level before the storm, empty if DRS
+	// was not throttled.
+	restore types.DrsBehavior
+	// level is the DRS automation level set during the storm.
+	level types.DrsBehavior
+}
+
+// stormSet holds the ongoing storms by cluster.
+type stormSet struct {
+	mu     sync.Mutex
+	active map[types.ManagedObjectReference]*storm
+}
+
+func newStorms() *stormSet {
+	return &stormSet{active: map[types.ManagedObjectReference]*storm{}}
+}
+
+// start records a storm in cluster starting at t and reports whether it is
+// new. A storm lasts until it is ended, however many events exceed the
+// threshold meanwhile.
+func (s *stormSet) start(cluster types.ManagedObjectReference, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[cluster]; ok {
+		return false
+	}
+	s.active[cluster] = &storm{started: t}
+
+	return true
+}
+
+// end forgets the storm in cluster.
+func (s *stormSet) end(cluster types.ManagedObjectReference) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.active, cluster)
+}
+
+// snapshot returns a copy of the ongoing storms, so they can be checked
+// without holding the lock during vSphere calls.
+func (s *stormSet) snapshot() map[types.ManagedObjectReference]storm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[types.ManagedObjectReference]storm, len(s.active))
+	for cluster, st := range s.active {
+		out[cluster] = *st
+	}
+
+	return out
+}
+
+// each calls f for every ongoing storm.
+func (s *stormSet) each(f func(cluster types.ManagedObjectReference, st *storm)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for cluster, st := range s.active {
+		f(cluster, st)
+	}
+}
+
+// throttle sets the DRS automation level of the storm in cluster to level and
+// returns the level to restore. Clusters without DRS or with a level at least
+// as conservative are left as they are, and "" is returned.
+func (s *stormSet) throttle(ctx context.Context, d drs, cluster types.ManagedObjectReference, level types.DrsBehavior) (types.DrsBehavior, error) {
+	current, enabled, err := d.drsBehavior(ctx, cluster)
+	if err != nil {
+		return "", err
+	}
+
+	if !enabled || conservativeness[current] >= conservativeness[level] {
+		return "", nil
+	}
+
+	if err := d.setDRSBehavior(ctx, cluster, level); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.active[cluster]; ok {
+		st.restore = current
+		st.level = level
+	}
+
+	return current, nil
+}
+
+// subside ends the storm in cluster and restores the DRS automation level of
+// the cluster. A level changed during the storm, e.g. by an operator, is kept.
+// If restoring fails, the storm is kept, so it is retried.
+func (s *stormSet) subside(ctx context.Context, d drs, cluster types.ManagedObjectReference, st storm) (string, error) {
+	if st.restore == "" {
+		s.end(cluster)
+		return "storm subsided", nil
+	}
+
+	current, _, err := d.drsBehavior(ctx, cluster)
+	if err != nil {
+		return "", err
+	}
+
+	if current != st.level {
+		s.end(cluster)
+		return fmt.Sprintf("storm subsided, DRS changed to %v meanwhile and was not restored", current), nil
+	}
+
+	if err := d.setDRSBehavior(ctx, cluster, st.restore); err != nil {
+		return "", err
+	}
+	s.end(cluster)
+
+	return fmt.Sprintf("storm subsided, DRS restored from %v to %v", st.level, st.restore), nil
+}
+
+// restoreLoop ends the storms whose clusters are back at or below the
+// threshold until ctx is done. The config is reloaded before every check.
+func restoreLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restoreInterval):
+		}
+
+		cfg, err := loadTomlCfg(cfgPath)
+		if err != nil {
+			slog.Debug("loading of vcconfig failed", "err", err)
+			continue
+		}
+
+		checkStorms(ctx, cfg, time.Now())
+	}
+}
+
+// checkStorms ends the storms whose clusters are back at or below the
+// threshold at now and notifies of their end.
+func checkStorms(ctx context.Context, cfg *vcConfig, now time.Time) {
+	for cluster, st := range storms.snapshot() {
+		n := migrations.count(cluster.Value, now, cfg.window())
+		if n > cfg.Storm.MaxMigrations {
+			continue
+		}
+
+		var d drs
+		if st.restore != "" {
+			clt, err := vsConnect(ctx, cfg)
+			if err != nil {
+				slog.Error("restoring DRS failed", "cluster", cluster.Value, "restore", st.restore, "err", err)
+				continue
+			}
+			d = clt
+		}
+
+		text, err := storms.subside(ctx, d, cluster, st)
+		if err != nil {
+			slog.Error("restoring DRS failed", "cluster", cluster.Value, "restore", st.restore, "err", err)
+			continue
+		}
+		slog.Info(text, "cluster", cluster.Value, "migrations", n, "duration", now.Sub(st.started).Round(time.Second))
+
+		if cfg.Notify.WebhookURL != "" || cfg.Notify.SlackWebhookURL != "" {
+			if err := notify(ctx, cfg, subsidedMessage(cluster.Value, text, n, cfg.window(), now)); err != nil {
+				slog.Error("notifying of subsided storm failed", "cluster", cluster.Value, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package function
+
+import (
+	"sync"
+	"time"
+)
+
+// window counts the migrations of each cluster within a sliding time window.
+// Clusters without migrations in the window are forgotten, so memory is
+// bounded by the clusters with migrations within one window.
+type window struct {
+	mu         sync.Mutex
+	migrations map[string][]time.Time
+}
+
+func newWindow() *window {
+	return &window{migrations: map[string][]time.Time{}}
+}
+
+// add records a migration in cluster at t and returns the number of
+// migrations in cluster within the window of length size ending at t.
+func (w *window) add(cluster string, t time.Time, size time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.migrations[cluster] = append(w.migrations[cluster], t)
+	w.prune(t, size)
+
+	return len(w.migrations[cluster])
+}
+
+// count returns the number of migrations in cluster within the window of
+// length size ending at now.
+func (w *window) count(cluster string, now time.Time, size time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.prune(now, size)
+
+	return len(w.migrations[cluster])
+}
+
+// prune drops migrations before the window ending at now. w.mu must be held.
+func (w *window) prune(now time.Time, size time.Duration) {
+	start := now.Add(-size)
+
+	for cluster, times := range w.migrations {
+		kept := times[:0]
+		for _, t := range times {
+			// Events may arrive out of order.
+			if t.After(start) {
+				kept = append(kept, t)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(w.migrations, cluster)
+			continue
+		}
+		w.migrations[cluster] = kept
+	}
+}